@@ -0,0 +1,256 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/google/cups-connector/history"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/manager"
+
+	"github.com/golang/glog"
+)
+
+// Server serves a local HTTP API for fleet tooling to list printers and
+// jobs, pause, resume and test printers, synchronize printers, cancel jobs
+// and report on the fleet.
+// Responses are JSON, except for the read-only dashboard at /.
+type Server struct {
+	pms        []*manager.PrinterManager
+	jobHistory *history.Store
+	token      string
+	listener   net.Listener
+}
+
+// NewServer serves the admin API on listener, which is bound already, so
+// that it can be bound before root privileges are dropped, to requests that
+// carry token in an "Authorization" header, either as a Bearer token, or as
+// the password of HTTP Basic authentication, which browsers prompt for on
+// the dashboard. pms holds one manager
+// per GCP account that printers are sharded across. Fleet reports are made
+// from jobHistory, which is nil when the job history isn't kept.
+func NewServer(pms []*manager.PrinterManager, jobHistory *history.Store, listener net.Listener, token string) (*Server, error) {
+	if token == "" {
+		return nil, errors.New("Refusing to serve the admin API without an admin token")
+	}
+
+	s := Server{pms, jobHistory, token, listener}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.authorized(s.dashboard))
+	mux.HandleFunc("/printers", s.authorized(s.printers))
+	mux.HandleFunc("/printers/", s.authorized(s.printer))
+	mux.HandleFunc("/sync", s.authorized(s.sync))
+	mux.HandleFunc("/jobs", s.authorized(s.jobs))
+	mux.HandleFunc("/jobs/", s.authorized(s.job))
+	mux.HandleFunc("/report", s.authorized(s.report))
+	go func() {
+		// Serve returns when the listener is closed by Quit.
+		if err := http.Serve(listener, mux); err != nil {
+			glog.Infof("Stopped serving the admin API: %s", err)
+		}
+	}()
+
+	return &s, nil
+}
+
+func (s *Server) Quit() {
+	s.listener.Close()
+}
+
+// authorized wraps a handler with a check of the request's token. The token
+// is a bearer token, or, for browsers, the password of HTTP basic
+// authentication with any user name.
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := requestToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			glog.Warningf("Unauthorized admin request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+lib.ShortName+`"`)
+			writeError(w, http.StatusUnauthorized, "Missing or wrong admin token")
+			return
+		}
+		glog.Infof("Admin request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		handler(w, r)
+	}
+}
+
+// requestToken returns the token of a request's Authorization header, which
+// must be of the Bearer or Basic scheme.
+func requestToken(r *http.Request) (string, bool) {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, true
+	}
+	const prefix = "Bearer "
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return "", false
+	}
+	return authorization[len(prefix):], true
+}
+
+func (s *Server) printers(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	type printer struct {
+		Account int `json:"account"`
+		manager.PrinterStatus
+	}
+	printers := []printer{}
+	for i, pm := range s.pms {
+		for _, status := range pm.Printers() {
+			printers = append(printers, printer{i, status})
+		}
+	}
+	writeJSON(w, printers)
+}
+
+// printer handles /printers/<name>/pause, /printers/<name>/resume and
+// /printers/<name>/test.
+func (s *Server) printer(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(strings.TrimPrefix(r.URL.Path, "/printers/"))
+	if action != "pause" && action != "resume" && action != "test" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+
+	if action == "test" {
+		for _, pm := range s.pms {
+			if result, found := pm.TestPrint(name); found {
+				writeJSON(w, result)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Printer %s is not registered", name))
+		return
+	}
+
+	for _, pm := range s.pms {
+		var found bool
+		if action == "pause" {
+			found = pm.PausePrinter(name)
+		} else {
+			found = pm.ResumePrinter(name)
+		}
+		if found {
+			writeJSON(w, map[string]string{"printer": name, "action": action})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("Printer %s is not registered", name))
+}
+
+func (s *Server) sync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		for _, pm := range s.pms {
+			if err := pm.SyncPrinters(); err != nil {
+				glog.Error(err)
+			}
+		}
+	default:
+		requireMethod(w, r, "GET")
+		return
+	}
+
+	type account struct {
+		Account int `json:"account"`
+		manager.SyncStatus
+	}
+	accounts := make([]account, len(s.pms))
+	for i, pm := range s.pms {
+		accounts[i] = account{i, pm.SyncStatus()}
+	}
+	writeJSON(w, accounts)
+}
+
+func (s *Server) jobs(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	jobs := []manager.JobStatus{}
+	for _, pm := range s.pms {
+		jobs = append(jobs, pm.InFlightJobs()...)
+	}
+	writeJSON(w, jobs)
+}
+
+// job handles /jobs/<gcp job id>/cancel.
+func (s *Server) job(w http.ResponseWriter, r *http.Request) {
+	gcpJobID, action := splitAction(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if action != "cancel" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+
+	for _, pm := range s.pms {
+		found, err := pm.CancelJob(gcpJobID)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if found {
+			writeJSON(w, map[string]string{"job": gcpJobID, "action": action})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("Job %s is not in flight", gcpJobID))
+}
+
+// splitAction splits "<name>/<action>" at the last slash, because printer
+// names can't contain slashes but job IDs could.
+func splitAction(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return path, ""
+	}
+	return path[:i], path[i+1:]
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Use %s", method))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	b, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package admin
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorized(t *testing.T) {
+	const token = "0123456789abcdef"
+	s := Server{token: token}
+	handler := s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, test := range []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"bearer", "Bearer " + token, http.StatusNoContent},
+		// Browsers send the token as the password, with any user name.
+		{"basic", "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:"+token)), http.StatusNoContent},
+		{"basic, wrong password", "Basic " + base64.StdEncoding.EncodeToString([]byte(token+":")), http.StatusUnauthorized},
+		{"no scheme", token, http.StatusUnauthorized},
+		{"lowercase scheme", "bearer " + token, http.StatusUnauthorized},
+		{"wrong token", "Bearer fedcba9876543210", http.StatusUnauthorized},
+		{"token prefix", "Bearer " + token[:8], http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	} {
+		r, err := http.NewRequest("GET", "/printers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", test.name)
+		}
+	}
+}
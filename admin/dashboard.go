@@ -0,0 +1,120 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/manager"
+
+	"github.com/golang/glog"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.bad { color: #c00; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Updated {{time .Now}}; refreshes every 30 seconds.</p>
+{{range .Accounts}}
+<h2>Account {{.Account}}</h2>
+<p>
+Printers last synchronized: {{time .Sync.LastSync}}
+{{if .Sync.LastError}}<span class="bad">{{.Sync.LastError}}</span>{{end}}
+{{if .Sync.Degraded}}<span class="bad">GCP unreachable; using cached printers</span>{{end}}
+</p>
+<p>Jobs done: {{.JobsDone}}; failed: <span{{if .JobsError}} class="bad"{{end}}>{{.JobsError}}</span>; printing: {{.JobsPrinting}}</p>
+
+<h3>Printers</h3>
+<table>
+<tr><th>Name</th><th>GCP ID</th><th>State</th><th>Paused</th></tr>
+{{range .Printers}}<tr><td>{{.Name}}</td><td>{{.GCPID}}</td><td{{if eq .State "STOPPED"}} class="bad"{{end}}>{{.State}}</td><td>{{if .Paused}}paused{{end}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+
+<h3>Jobs in flight</h3>
+<table>
+<tr><th>GCP job ID</th><th>Printer</th><th>Title</th><th>Owner</th><th>CUPS job ID</th><th>State</th><th>Received</th></tr>
+{{range .InFlightJobs}}<tr><td>{{.GCPJobID}}</td><td>{{.PrinterName}}</td><td>{{.Title}}</td><td>{{.OwnerID}}</td><td>{{if .CUPSJobID}}{{.CUPSJobID}}{{end}}</td><td>{{.State}}</td><td>{{time .Received}}</td></tr>
+{{else}}<tr><td colspan="7">None</td></tr>
+{{end}}</table>
+
+<h3>Recent jobs</h3>
+<table>
+<tr><th>GCP job ID</th><th>Printer</th><th>Title</th><th>Owner</th><th>State</th><th>Finished</th><th>Phases</th><th>Error</th></tr>
+{{range .RecentJobs}}<tr><td>{{.GCPJobID}}</td><td>{{.PrinterName}}</td><td>{{.Title}}</td><td>{{.OwnerID}}</td><td{{if ne .State "DONE"}} class="bad"{{end}}>{{.State}}</td><td>{{time .Finished}}</td><td>{{range $phase, $seconds := .PhaseSeconds}}{{$phase}} {{printf "%.1f" $seconds}}s {{end}}</td><td>{{.Error}}</td></tr>
+{{else}}<tr><td colspan="8">None</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+type dashboardAccount struct {
+	Account                           int
+	Sync                              manager.SyncStatus
+	JobsDone, JobsError, JobsPrinting uint
+	Printers                          []manager.PrinterStatus
+	InFlightJobs, RecentJobs          []manager.JobStatus
+}
+
+// dashboard serves a read-only HTML page showing printers, jobs and errors,
+// for diagnosing the connector from a browser.
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	data := struct {
+		Name     string
+		Now      time.Time
+		Accounts []dashboardAccount
+	}{lib.FullName, time.Now(), make([]dashboardAccount, len(s.pms))}
+	for i, pm := range s.pms {
+		done, errored, printing, _ := pm.GetJobStats()
+		data.Accounts[i] = dashboardAccount{
+			Account:      i,
+			Sync:         pm.SyncStatus(),
+			JobsDone:     done,
+			JobsError:    errored,
+			JobsPrinting: printing,
+			Printers:     pm.Printers(),
+			InFlightJobs: pm.InFlightJobs(),
+			RecentJobs:   pm.RecentJobs(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		glog.Warningf("Failed to render the admin dashboard: %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/cups-connector/history"
+)
+
+// Days that a fleet report covers when the request doesn't say.
+const defaultReportDays = 30
+
+// report handles /report?days=<days>&format=<json or html>.
+func (s *Server) report(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	if s.jobHistory == nil {
+		writeError(w, http.StatusNotFound, "The job history is not kept; set job_history_file")
+		return
+	}
+
+	days := defaultReportDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days <= 0 {
+			writeError(w, http.StatusBadRequest, "days must be a positive number")
+			return
+		}
+	}
+
+	records, err := s.jobHistory.Read()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	to := time.Now()
+	report := history.NewReport(records, to.AddDate(0, 0, -days), to)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, report)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		report.WriteHTML(w)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json or html")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// Kinds of alerts.
+const (
+	// A printer entered the STOPPED state.
+	PrinterStopped = "printer_stopped"
+	// A printer reported faults over SNMP, like a jammed tray.
+	PrinterFault = "printer_fault"
+	// The share of a printer's recent jobs that failed reached the
+	// threshold.
+	JobErrorRate = "job_error_rate"
+)
+
+// How long a hook may take to run.
+const hookTimeout = 30 * time.Second
+
+// Alert describes something that ops should look at.
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Printer string    `json:"printer"`
+	GCPID   string    `json:"gcp_printer_id"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+var (
+	mutex   sync.RWMutex
+	command string
+	url     string
+	client  = &http.Client{Timeout: hookTimeout}
+)
+
+// Start sends alerts to hooks: alertCommand is run with the alert as JSON on
+// its standard input, and the alert is POSTed as JSON to alertURL. Either
+// may be empty. Until Start is called, alerts are only logged.
+func Start(alertCommand, alertURL string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	command = alertCommand
+	url = alertURL
+}
+
+// Send logs a, and fires the hooks in the background.
+func Send(a Alert) {
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	glog.Warningf("Alert %s for printer %s: %s", a.Kind, a.Printer, a.Message)
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if command == "" && url == "" {
+		return
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		glog.Errorf("Failed to encode alert: %s", err)
+		return
+	}
+	if command != "" {
+		go func(command string) {
+			if err := runCommand(command, a, b); err != nil {
+				glog.Errorf("Failed to run alert command %s: %s", command, err)
+			}
+		}(command)
+	}
+	if url != "" {
+		go func(url string) {
+			if err := post(url, b); err != nil {
+				glog.Errorf("Failed to post alert to %s: %s", url, err)
+			}
+		}(url)
+	}
+}
+
+// runCommand runs command with the alert as JSON on its standard input, and
+// in environment variables, for simple shell scripts.
+func runCommand(command string, a Alert, b []byte) error {
+	cmd := exec.Command(command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(),
+		"ALERT_KIND="+a.Kind,
+		"ALERT_PRINTER="+a.Printer,
+		"ALERT_GCP_PRINTER_ID="+a.GCPID,
+		"ALERT_MESSAGE="+a.Message)
+
+	if err := lib.StartCommand(cmd); err != nil {
+		return err
+	}
+	return lib.WaitCommand(cmd, hookTimeout)
+}
+
+func post(url string, b []byte) error {
+	response, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("answered %s", response.Status)
+	}
+	return nil
+}
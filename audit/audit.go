@@ -0,0 +1,230 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package audit keeps a tamper-evident log of print activity. Entries are
+// JSON lines, each with the SHA-256 hash of its content and of the previous
+// entry, so that changing, removing or reordering entries breaks the chain
+// from that entry on.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events.
+const (
+	JobReceived = "job_received"
+	JobFinished = "job_finished"
+	// An incomplete last line, left by a crash while it was written, was
+	// removed; see Open.
+	LogRepaired = "log_repaired"
+)
+
+// IncompleteLineError indicates that the last line of an audit log file
+// doesn't end with a newline: the connector stopped while writing it, so
+// its entry was never acknowledged.
+type IncompleteLineError struct {
+	Filename string
+	Line     int
+	// Where the line starts, and its length, in bytes.
+	Offset, Length int64
+}
+
+func (e *IncompleteLineError) Error() string {
+	return fmt.Sprintf("Line %d of audit log %s is incomplete; the connector stopped while writing it", e.Line, e.Filename)
+}
+
+// Entry is one event of the audit log.
+type Entry struct {
+	// Number of the entry, from 1.
+	Seq          uint64    `json:"seq"`
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	GCPJobID     string    `json:"gcp_job_id"`
+	Owner        string    `json:"owner"`
+	GCPPrinterID string    `json:"gcp_printer_id"`
+	Printer      string    `json:"printer,omitempty"`
+	Pages        int32     `json:"pages,omitempty"`
+	// GCP job state of finished jobs, like DONE or ABORTED.
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Hash of the previous entry; empty in the first entry.
+	PrevHash string `json:"prev_hash"`
+	// Hex SHA-256 of this entry, with Hash empty.
+	Hash string `json:"hash"`
+}
+
+// hash returns the hash of e, with e.Hash empty.
+func (e Entry) hash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends entries to an audit log file.
+type Log struct {
+	mutex    sync.Mutex
+	f        *os.File
+	lastSeq  uint64
+	lastHash string
+}
+
+// Open opens the audit log file filename for appending, and creates it
+// when it doesn't exist. New entries continue the chain from the last
+// entry in the file. An incomplete last line is removed, and a LogRepaired
+// entry says so.
+func Open(filename string) (*Log, error) {
+	var last Entry
+	err := readFile(filename, func(line int, e Entry) error {
+		last = e
+		return nil
+	})
+	incomplete, _ := err.(*IncompleteLineError)
+	if incomplete != nil {
+		if err = os.Truncate(filename, incomplete.Offset); err != nil {
+			return nil, fmt.Errorf("Failed to remove the incomplete last line of audit log %s: %s", filename, err)
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit log: %s", err)
+	}
+	l := &Log{f: f, lastSeq: last.Seq, lastHash: last.Hash}
+
+	if incomplete != nil {
+		err = l.Append(Entry{
+			Event: LogRepaired,
+			Error: fmt.Sprintf("removed incomplete line %d, of %d bytes", incomplete.Line, incomplete.Length),
+		})
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Append chains e to the previous entry, writes it, and syncs the file, so
+// that acknowledged entries survive a crash. Seq, PrevHash and Hash are set
+// here; Time is set when it is zero.
+func (l *Log) Append(e Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq = l.lastSeq + 1
+	e.PrevHash = l.lastHash
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = l.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("Failed to write audit log: %s", err)
+	}
+	if err = l.f.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync audit log: %s", err)
+	}
+
+	l.lastSeq, l.lastHash = e.Seq, e.Hash
+	return nil
+}
+
+// Close closes the file.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.f.Close()
+}
+
+// Verify checks the chain of the audit log file filename, and returns the
+// number of entries. The error names the first line where the chain
+// breaks. An incomplete last line, which the connector removes when it
+// starts, is reported with an *IncompleteLineError, after the entries
+// before it are checked.
+func Verify(filename string) (int, error) {
+	var prev Entry
+	entries := 0
+	err := readFile(filename, func(line int, e Entry) error {
+		hash, err := e.hash()
+		if err != nil {
+			return err
+		}
+		switch {
+		case hash != e.Hash:
+			return fmt.Errorf("Line %d of audit log %s was changed: its hash doesn't match its content", line, filename)
+		case e.PrevHash != prev.Hash:
+			return fmt.Errorf("Line %d of audit log %s doesn't follow the entry before it: entries were removed, added or reordered", line, filename)
+		case e.Seq != prev.Seq+1:
+			return fmt.Errorf("Line %d of audit log %s has sequence number %d, not %d", line, filename, e.Seq, prev.Seq+1)
+		}
+		prev = e
+		entries++
+		return nil
+	})
+	return entries, err
+}
+
+// readFile calls f with each entry of the audit log file filename, in
+// order, and stops at the first error. A last line without a newline isn't
+// parsed; an *IncompleteLineError is returned instead.
+func readFile(filename string, f func(line int, e Entry) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) > 0 {
+				return &IncompleteLineError{filename, line, offset, int64(len(b))}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read audit log: %s", err)
+		}
+		offset += int64(len(b))
+
+		var e Entry
+		if err = json.Unmarshal(b, &e); err != nil {
+			return fmt.Errorf("Failed to parse line %d of audit log %s: %s", line, filename, err)
+		}
+		if err = f(line, e); err != nil {
+			return err
+		}
+	}
+}
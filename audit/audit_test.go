@@ -0,0 +1,131 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	l, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err = l.Append(Entry{Event: JobReceived, GCPJobID: id, Owner: "user@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// Reopening continues the chain.
+	l, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Append(Entry{Event: JobFinished, GCPJobID: "a", State: "DONE", Pages: 2}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if entries, err := Verify(filename); err != nil || entries != 3 {
+		t.Fatalf("expected 3 intact entries, got %d, %v", entries, err)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+
+	changed := bytes.Replace(b, []byte(`"gcp_job_id":"b"`), []byte(`"gcp_job_id":"c"`), 1)
+	if err = ioutil.WriteFile(filename, changed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Verify(filename); err == nil || !strings.Contains(err.Error(), "Line 2 ") {
+		t.Errorf("expected line 2 to be reported changed, got %v", err)
+	}
+
+	removed := append(append([]byte{}, lines[0]...), lines[2]...)
+	if err = ioutil.WriteFile(filename, removed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Verify(filename); err == nil || !strings.Contains(err.Error(), "Line 2 ") {
+		t.Errorf("expected line 2 to be reported out of chain, got %v", err)
+	}
+}
+
+func TestIncompleteLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	l, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err = l.Append(Entry{Event: JobReceived, GCPJobID: id, Owner: "user@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// A crash while the third entry was written.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"seq":3,"time":"2015-`))
+	f.Close()
+
+	entries, err := Verify(filename)
+	if e, ok := err.(*IncompleteLineError); !ok || e.Line != 3 {
+		t.Errorf("expected line 3 to be reported incomplete, got %v", err)
+	}
+	if entries != 2 {
+		t.Errorf("expected 2 intact entries before the incomplete line, got %d", entries)
+	}
+
+	// Reopening removes the line, and logs that it did.
+	l, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Append(Entry{Event: JobFinished, GCPJobID: "a", State: "DONE"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if entries, err := Verify(filename); err != nil || entries != 4 {
+		t.Fatalf("expected 4 intact entries, got %d, %v", entries, err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !strings.Contains(lines[2], `"event":"log_repaired"`) || !strings.Contains(lines[2], "removed incomplete line 3, of 22 bytes") {
+		t.Errorf("expected line 3 to be a log_repaired entry, got %s", lines[2])
+	}
+}
@@ -23,48 +23,166 @@ import (
 	"github.com/google/cups-connector/gcp"
 	"github.com/google/cups-connector/lib"
 
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
 
+// Interval between checks whether an anonymous registration was claimed.
+const anonymousRegistrationPollInterval = 5 * time.Second
+
 // All flags are string type. This makes parsing "not set" easier, and
 // allows default values to be separated.
 var (
+	anonymousRegistrationFlag = flag.String(
+		"anonymous-registration", "",
+		"Whether to register without user credentials, and print a URL to claim the connector with (true/false)")
 	retainUserOAuthTokenFlag = flag.String(
 		"retain-user-oauth-token", "",
 		"Whether to retain the user's OAuth token to enable automatic sharing (true/false)")
 	shareScopeFlag = flag.String(
 		"share-scope", "",
 		"Scope (user, group, domain) to share printers with")
+	shareRoleFlag = flag.String(
+		"share-role", "",
+		"Role (USER or MANAGER) to share printers with")
+	shareRevokeUnlistedFlag = flag.String(
+		"share-revoke-unlisted", "",
+		"Whether to unshare printers from scopes that aren't configured")
+	jobOwnerAllowlistFlag = flag.String(
+		"job-owner-allowlist", "",
+		"Comma-separated email addresses and domains whose jobs are printed; empty allows everyone")
 	proxyNameFlag = flag.String(
 		"proxy-name", "",
 		"User-chosen name of this proxy. Should be unique per Google user account")
+	proxyConflictActionFlag = flag.String(
+		"proxy-conflict-action", "",
+		"What to do when another connector runs with the same proxy name: warn or refuse to start")
 	gcpMaxConcurrentDownloadsFlag = flag.String(
 		"gcp-max-concurrent-downloads", "",
 		"Maximum quantity of PDFs to download concurrently")
+	gcpMaxDownloadMBFlag = flag.String(
+		"gcp-max-download-mb", "",
+		"Maximum size, in megabytes, of a job document; zero means no limit")
+	gcpMaxJobAgeFlag = flag.String(
+		"gcp-max-job-age", "",
+		"Maximum age of a job when it is fetched; older jobs are aborted")
+	gcpMaxJobsPerMinuteFlag = flag.String(
+		"gcp-max-jobs-per-minute", "",
+		"Maximum quantity of each printer's jobs to start per minute; zero means no limit")
+	backendFlag = flag.String(
+		"backend", "",
+		"Print system that printers and jobs live in: cups, or exec for executables")
 	cupsMaxConnectionsFlag = flag.String(
 		"cups-max-connections", "",
 		"Max connections to CUPS server")
 	cupsConnectTimeoutFlag = flag.String(
 		"cups-connect-timeout", "",
 		"CUPS timeout for opening a new connection")
+	cupsListTimeoutFlag = flag.String(
+		"cups-list-timeout", "",
+		"How long CUPS may stay silent when listing printers")
+	cupsPPDTimeoutFlag = flag.String(
+		"cups-ppd-timeout", "",
+		"How long CUPS may stay silent when fetching a PPD")
+	cupsPrintTimeoutFlag = flag.String(
+		"cups-print-timeout", "",
+		"How long CUPS may stay silent when submitting a job")
+	cupsJobStateTimeoutFlag = flag.String(
+		"cups-job-state-timeout", "",
+		"How long CUPS may stay silent when getting the state of a job")
+	cupsPPDFetchWorkersFlag = flag.String(
+		"cups-ppd-fetch-workers", "",
+		"Maximum quantity of PPDs to fetch from CUPS at the same time")
+	cupsPPDTranslatorFlag = flag.String(
+		"cups-ppd-translator", "",
+		"What translates PPDs to capabilities: gcp, or local for the connector itself")
 	cupsJobQueueSizeFlag = flag.String(
 		"cups-job-queue-size", "",
 		"CUPS job queue size")
 	cupsPrinterPollIntervalFlag = flag.String(
 		"cups-printer-poll-interval", "",
 		"Interval, in seconds, between CUPS printer state polls")
+	cupsPrinterStatePollIntervalFlag = flag.String(
+		"cups-printer-state-poll-interval", "",
+		"Interval, in seconds, between CUPS printer state polls that only report state changes")
+	cupsPrinterFullFetchIntervalFlag = flag.String(
+		"cups-printer-full-fetch-interval", "",
+		"Interval, in seconds, between fetches of all attributes of all CUPS printers")
+	cupsWatchFilesFlag = flag.String(
+		"cups-watch-files", "",
+		"Comma-separated CUPS configuration files whose changes synchronize printers immediately")
 	cupsJobFullUsernameFlag = flag.String(
 		"cups-job-full-username", "",
 		"Whether to use the full username (joe@example.com) in CUPS jobs")
+	cupsJobUserFlag = flag.String(
+		"cups-job-user", "",
+		"CUPS user to submit all jobs as; empty submits jobs as their owners")
+	cupsJobAccountingOwnerFlag = flag.String(
+		"cups-job-accounting-owner", "",
+		"Whether to send the GCP job owner in the job-accounting-user-id attribute")
 	cupsIgnoreRawPrintersFlag = flag.String(
 		"cups-ignore-raw-printers", "",
 		"Whether to ignore raw printers")
+	cupsSharedPrintersOnlyFlag = flag.String(
+		"cups-shared-printers-only", "",
+		"Whether to register only the printers that CUPS shares")
+	cupsStreamJobsFlag = flag.String(
+		"cups-stream-jobs", "",
+		"Whether to stream jobs into CUPS without temporary files")
 	copyPrinterInfoToDisplayNameFlag = flag.String(
 		"copy-printer-info-to-display-name", "",
 		"Whether to copy the CUPS printer's printer-info attribute to the GCP printer's defaultDisplayName")
 	monitorSocketFilenameFlag = flag.String(
 		"socket-filename", "",
 		"Filename of unix socket for connector-check to talk to connector")
+	healthListenAddressFlag = flag.String(
+		"health-listen-address", "",
+		"Address to serve the /healthz and /readyz HTTP endpoints on, like localhost:8088")
+	adminListenAddressFlag = flag.String(
+		"admin-listen-address", "",
+		"Address to serve the admin HTTP API on, like localhost:8089")
+	adminTokenFlag = flag.String(
+		"admin-token", "",
+		"Token that admin HTTP API requests must carry")
+	logFormatFlag = flag.String(
+		"log-format", "",
+		"Log format: text, or json to also write JSON lines to stderr")
+	logMaxMegabytesFlag = flag.String(
+		"log-max-megabytes", "",
+		"Size in megabytes at which log files are rotated")
+	logMaxFilesFlag = flag.String(
+		"log-max-files", "",
+		"Rotated log files to keep per severity; 0 keeps all")
+	logCompressFlag = flag.String(
+		"log-compress", "",
+		"Whether to gzip rotated log files")
+	syslogAddressFlag = flag.String(
+		"syslog-address", "",
+		"Syslog server to send log lines to, like udp://loghost:514 or unix:///dev/log")
+	syslogFacilityFlag = flag.String(
+		"syslog-facility", "",
+		"Syslog facility, like daemon or local0")
+	metricsStatsDAddressFlag = flag.String(
+		"metrics-statsd-address", "",
+		"StatsD server to send metrics to, like localhost:8125")
+	metricsOTLPEndpointFlag = flag.String(
+		"metrics-otlp-endpoint", "",
+		"OpenTelemetry collector to send metrics to, like http://localhost:4318")
+	metricsPrefixFlag = flag.String(
+		"metrics-prefix", "",
+		"Prefix of metric names")
+	metricsIntervalFlag = flag.String(
+		"metrics-interval", "",
+		"How often to sample gauges and send metrics to the OpenTelemetry collector")
+	alertCommandFlag = flag.String(
+		"alert-command", "",
+		"Executable to run with each printer alert as JSON on its standard input")
+	alertURLFlag = flag.String(
+		"alert-url", "",
+		"URL to POST printer alerts to, as JSON")
+	alertJobErrorPercentFlag = flag.String(
+		"alert-job-error-percent", "",
+		"Percentage of a printer's last 10 jobs that must fail to send an alert; 0 disables")
 	gcpBaseURLFlag = flag.String(
 		"gcp-base-url", "",
 		"GCP API base URL")
@@ -74,12 +192,27 @@ var (
 	gcpXMPPPortFlag = flag.String(
 		"gcp-xmpp-port", "",
 		"GCP XMPP port number")
+	gcpXMPPFallbackPortFlag = flag.String(
+		"gcp-xmpp-fallback-port", "",
+		"GCP XMPP port number to try when the XMPP port is unreachable; 0 disables")
+	gcpXMPPServerHostnameFlag = flag.String(
+		"gcp-xmpp-server-hostname", "",
+		"Hostname that the GCP XMPP server's TLS certificate must be valid for")
+	gcpXMPPCloudPrintJIDFlag = flag.String(
+		"gcp-xmpp-cloudprint-jid", "",
+		"JID of the GCP service on XMPP")
 	gcpXMPPPingTimeoutFlag = flag.String(
 		"gcp-xmpp-ping-timeout", "",
 		"GCP XMPP ping timeout (give up waiting for ping response after this)")
 	gcpXMPPPingIntervalDefaultFlag = flag.String(
 		"gcp-xmpp-ping-interval-default", "",
 		"GCP XMPP ping interval default (ping every this often)")
+	gcpXMPPPingIntervalAutoFlag = flag.String(
+		"gcp-xmpp-ping-interval-auto", "",
+		"Whether to shorten the GCP XMPP ping interval until pings survive the network's idle timeout")
+	gcpXMPPPingIntervalFileFlag = flag.String(
+		"gcp-xmpp-ping-interval-file", "",
+		"File to save GCP XMPP ping interval tuning to")
 	gcpOAuthClientIDFlag = flag.String(
 		"gcp-oauth-client-id", "",
 		"GCP OAuth client ID")
@@ -101,10 +234,100 @@ var (
 	snmpMaxConnectionsFlag = flag.String(
 		"snmp-max-connections", "",
 		"Max connections to SNMP agents")
+	snmpPollIntervalFlag = flag.String(
+		"snmp-poll-interval", "",
+		"Printer state poll interval over SNMP")
+	snmpPauseOnFaultFlag = flag.String(
+		"snmp-pause-on-fault", "",
+		"Whether to leave jobs queued for printers that report faults over SNMP")
+	printerProbeIntervalFlag = flag.String(
+		"printer-probe-interval", "",
+		"How long a printer device may be silent before it is probed before fetching jobs; 0s disables")
+	printerProbeTimeoutFlag = flag.String(
+		"printer-probe-timeout", "",
+		"How long to wait for a printer device to accept a connection")
+	discoveryEnableFlag = flag.String(
+		"discovery-enable", "",
+		"Whether to add CUPS queues for IPP printers found on the local network")
+	discoveryIntervalFlag = flag.String(
+		"discovery-interval", "",
+		"Interval between discoveries of printers on the local network")
+	gcpProxyURLFlag = flag.String(
+		"gcp-proxy-url", "",
+		"Proxy for GCP API requests, like http://host:port or socks5://host:port")
+	xmppProxyURLFlag = flag.String(
+		"xmpp-proxy-url", "",
+		"Proxy for the XMPP connection, like http://host:port or socks5://host:port")
+	tlsCAFileFlag = flag.String(
+		"tls-ca-file", "",
+		"PEM bundle of CAs to trust for connections to Google")
+	tlsPinsFlag = flag.String(
+		"tls-pins", "",
+		"Comma-separated base64 SHA-256 public key pins for connections to Google")
+	gcpFallbackPollIntervalMinFlag = flag.String(
+		"gcp-fallback-poll-interval-min", "",
+		"Min interval between GCP job polls while XMPP is unavailable")
+	gcpFallbackPollIntervalMaxFlag = flag.String(
+		"gcp-fallback-poll-interval-max", "",
+		"Max interval between GCP job polls while XMPP is unavailable")
+	localPrintingEnableFlag = flag.String(
+		"local-printing-enable", "",
+		"Enable Privet local discovery and local printing")
+	localPortLowFlag = flag.String(
+		"local-port-low", "",
+		"Lowest port for Privet HTTP servers")
+	localPortHighFlag = flag.String(
+		"local-port-high", "",
+		"Highest port for Privet HTTP servers")
+	gcpUploadTimeoutFlag = flag.String(
+		"gcp-upload-timeout", "",
+		"Timeout for uploads of PPDs and capabilities to GCP")
+	gcpCompressUploadsFlag = flag.String(
+		"gcp-compress-uploads", "",
+		"Whether to gzip-compress uploads of PPDs and capabilities to GCP")
+	gcpPrinterCacheFileFlag = flag.String(
+		"gcp-printer-cache-file", "",
+		"File to save the GCP printer list in, for starting while GCP is unreachable")
+	jobHistoryFileFlag = flag.String(
+		"job-history-file", "",
+		"File to record finished jobs and printer state changes in, for fleet reports")
+	auditLogFileFlag = flag.String(
+		"audit-log-file", "",
+		"File to append a tamper-evident audit log of print jobs to")
+	runAsUserFlag = flag.String(
+		"run-as-user", "",
+		"User to run as, once the connector has done what needs root")
+	runAsGroupFlag = flag.String(
+		"run-as-group", "",
+		"Group to run as; empty is the primary group of -run-as-user")
+	spoolEncryptFlag = flag.String(
+		"spool-encrypt", "",
+		"Whether to encrypt downloaded job documents with a key held only in memory")
+	spoolShredFlag = flag.String(
+		"spool-shred", "",
+		"Whether to overwrite downloaded job documents before removing them")
+	quarantineDirFlag = flag.String(
+		"quarantine-dir", "",
+		"Directory to keep the documents of failed jobs in, for debugging")
+	quarantineMaxJobsFlag = flag.String(
+		"quarantine-max-jobs", "",
+		"How many failed jobs to keep in -quarantine-dir")
+	credentialsStoreFlag = flag.String(
+		"credentials-store", "",
+		"Where to keep refresh tokens: file or keyring (the OS keyring)")
 
 	gcpUserOAuthRefreshTokenFlag = flag.String(
 		"gcp-user-refresh-token", "",
 		"GCP user refresh token, useful when managing many connectors")
+	robotRefreshTokenFlag = flag.String(
+		"robot-refresh-token", "",
+		"GCP robot refresh token of an existing robot account; with -xmpp-jid, skips registration")
+	xmppJIDFlag = flag.String(
+		"xmpp-jid", "",
+		"XMPP JID of an existing robot account; with -robot-refresh-token, skips registration")
+	nonInteractiveFlag = flag.String(
+		"non-interactive", "",
+		"Whether to fail, rather than prompt, when an answer is missing from the flags and environment (true/false)")
 	gcpAPITimeoutFlag = flag.Duration(
 		"gcp-api-timeout", 5*time.Second,
 		"GCP API timeout, for debugging")
@@ -167,6 +390,20 @@ func flagToBool(flag *string, defaultValue bool) bool {
 	return value
 }
 
+// flagToStringSlice returns the comma-separated value of a flag, or its
+// default, as a string slice.
+func flagToStringSlice(flag *string, defaultValue []string) []string {
+	if flag == nil {
+		panic("Flag pointer is nil")
+	}
+
+	if *flag == "" {
+		return defaultValue
+	}
+
+	return strings.Split(*flag, ",")
+}
+
 // flagToString returns the value of a flag, or it's default, as a string.
 func flagToString(flag *string, defaultValue string) string {
 	if flag == nil {
@@ -198,6 +435,26 @@ func flagToDurationString(flag *string, defaultValue string) string {
 	return *flag
 }
 
+// newTransport creates an http.Transport that honors the proxy and TLS flags.
+func newTransport() (*http.Transport, error) {
+	tlsConfig, err := lib.NewTLSConfig(flagToString(tlsCAFileFlag, lib.DefaultConfig.TLSCAFile),
+		flagToStringSlice(tlsPinsFlag, lib.DefaultConfig.TLSPins))
+	if err != nil {
+		return nil, err
+	}
+	return gcp.NewTransport(flagToString(gcpProxyURLFlag, lib.DefaultConfig.GCPProxyURL), tlsConfig)
+}
+
+// oauthContext creates a context that makes OAuth requests through the
+// GCP proxy, if any.
+func oauthContext() context.Context {
+	transport, err := newTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return context.WithValue(oauth2.NoContext, oauth2.HTTPClient, &http.Client{Transport: transport})
+}
+
 // getUserClientFromUser steps the user through the process of acquiring an OAuth refresh token.
 func getUserClientFromUser(retainUserOAuthToken bool) (*http.Client, string) {
 	config := &oauth2.Config{
@@ -217,7 +474,8 @@ func getUserClientFromUser(retainUserOAuthToken bool) (*http.Client, string) {
 	fmt.Println("")
 
 	authCode := scanNonEmptyString("After authenticating, enter the provided code here:")
-	token, err := config.Exchange(oauth2.NoContext, authCode)
+	ctx := oauthContext()
+	token, err := config.Exchange(ctx, authCode)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -230,7 +488,7 @@ func getUserClientFromUser(retainUserOAuthToken bool) (*http.Client, string) {
 		userRefreshToken = token.RefreshToken
 	}
 
-	client := config.Client(oauth2.NoContext, token)
+	client := config.Client(ctx, token)
 	client.Timeout = *gcpAPITimeoutFlag
 
 	return client, userRefreshToken
@@ -250,7 +508,7 @@ func getUserClientFromToken(userRefreshToken string) *http.Client {
 	}
 
 	token := &oauth2.Token{RefreshToken: userRefreshToken}
-	client := config.Client(oauth2.NoContext, token)
+	client := config.Client(oauthContext(), token)
 	client.Timeout = *gcpAPITimeoutFlag
 
 	return client
@@ -289,6 +547,48 @@ func initRobotAccount(userClient *http.Client) (string, string) {
 	return robotInit.XMPPJID, robotInit.AuthCode
 }
 
+// createRobotAccountAnonymously registers a placeholder printer without any
+// user credentials, then waits for a user to claim it. Claiming the printer
+// creates the robot account.
+func createRobotAccountAnonymously(proxyName string) (string, string) {
+	transport, err := newTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &http.Client{Transport: transport, Timeout: *gcpAPITimeoutFlag}
+
+	registration, err := gcp.RegisterAnonymous(client, flagToString(gcpBaseURLFlag, lib.DefaultConfig.GCPBaseURL), proxyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Login to Google as the user that will own the printers, then visit this URL:")
+	fmt.Println("")
+	fmt.Println(registration.CompleteInviteURL)
+	fmt.Println("")
+	fmt.Printf("Or visit %s and enter the claim token %s\n", registration.InvitePageURL, registration.RegistrationToken)
+	fmt.Println("")
+	fmt.Printf("Waiting up to %s for the connector to be claimed...\n", registration.TokenDuration.String())
+
+	oauthClientID := flagToString(gcpOAuthClientIDFlag, lib.DefaultConfig.GCPOAuthClientID)
+	deadline := time.Now().Add(registration.TokenDuration)
+	for time.Now().Before(deadline) {
+		time.Sleep(anonymousRegistrationPollInterval)
+
+		claim, err := gcp.PollAnonymousRegistration(client, registration, oauthClientID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if claim != nil {
+			fmt.Printf("Claimed by %s\n", claim.UserEmail)
+			return claim.XMPPJID, verifyRobotAccount(claim.AuthCode)
+		}
+	}
+
+	log.Fatal("The claim token expired before the connector was claimed")
+	panic("unreachable")
+}
+
 func verifyRobotAccount(authCode string) string {
 	config := &oauth2.Config{
 		ClientID:     flagToString(gcpOAuthClientIDFlag, lib.DefaultConfig.GCPOAuthClientID),
@@ -301,7 +601,7 @@ func verifyRobotAccount(authCode string) string {
 		Scopes:      []string{gcp.ScopeCloudPrint, gcp.ScopeGoogleTalk},
 	}
 
-	token, err := config.Exchange(oauth2.NoContext, authCode)
+	token, err := config.Exchange(oauthContext(), authCode)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -318,26 +618,79 @@ func createRobotAccount(userClient *http.Client) (string, string) {
 
 func createConfigFile(xmppJID, robotRefreshToken, userRefreshToken, shareScope, proxy string) {
 	config := lib.Config{
+		lib.CurrentConfigVersion,
 		xmppJID,
 		robotRefreshToken,
 		userRefreshToken,
 		shareScope,
+		nil,
+		nil,
+		nil,
+		nil,
+		flagToString(shareRoleFlag, lib.DefaultConfig.ShareRole),
+		flagToBool(shareRevokeUnlistedFlag, lib.DefaultConfig.ShareRevokeUnlisted),
+		nil,
+		nil,
+		flagToStringSlice(jobOwnerAllowlistFlag, lib.DefaultConfig.JobOwnerAllowlist),
+		nil,
+		nil,
 		proxy,
+		flagToString(proxyConflictActionFlag, lib.DefaultConfig.ProxyConflictAction),
 		flagToUint(gcpMaxConcurrentDownloadsFlag, lib.DefaultConfig.GCPMaxConcurrentDownloads),
+		flagToUint(gcpMaxDownloadMBFlag, lib.DefaultConfig.GCPMaxDownloadMB),
+		flagToDurationString(gcpMaxJobAgeFlag, lib.DefaultConfig.GCPMaxJobAge),
+		flagToUint(gcpMaxJobsPerMinuteFlag, lib.DefaultConfig.GCPMaxJobsPerMinute),
+		flagToString(backendFlag, lib.DefaultConfig.Backend),
+		nil,
 		flagToUint(cupsMaxConnectionsFlag, lib.DefaultConfig.CUPSMaxConnections),
 		flagToDurationString(cupsConnectTimeoutFlag, lib.DefaultConfig.CUPSConnectTimeout),
+		flagToDurationString(cupsListTimeoutFlag, lib.DefaultConfig.CUPSListTimeout),
+		flagToDurationString(cupsPPDTimeoutFlag, lib.DefaultConfig.CUPSPPDTimeout),
+		flagToDurationString(cupsPrintTimeoutFlag, lib.DefaultConfig.CUPSPrintTimeout),
+		flagToDurationString(cupsJobStateTimeoutFlag, lib.DefaultConfig.CUPSJobStateTimeout),
+		flagToUint(cupsPPDFetchWorkersFlag, lib.DefaultConfig.CUPSPPDFetchWorkers),
+		flagToString(cupsPPDTranslatorFlag, lib.DefaultConfig.CUPSPPDTranslator),
 		flagToUint(cupsJobQueueSizeFlag, lib.DefaultConfig.CUPSJobQueueSize),
 		flagToDurationString(cupsPrinterPollIntervalFlag, lib.DefaultConfig.CUPSPrinterPollInterval),
+		flagToDurationString(cupsPrinterStatePollIntervalFlag, lib.DefaultConfig.CUPSPrinterStatePollInterval),
+		flagToDurationString(cupsPrinterFullFetchIntervalFlag, lib.DefaultConfig.CUPSPrinterFullFetchInterval),
+		flagToStringSlice(cupsWatchFilesFlag, lib.DefaultConfig.CUPSWatchFiles),
 		lib.DefaultConfig.CUPSPrinterAttributes,
 		flagToBool(cupsJobFullUsernameFlag, lib.DefaultConfig.CUPSJobFullUsername),
+		flagToString(cupsJobUserFlag, lib.DefaultConfig.CUPSJobUser),
+		flagToBool(cupsJobAccountingOwnerFlag, lib.DefaultConfig.CUPSJobAccountingOwner),
+		nil,
 		flagToBool(cupsIgnoreRawPrintersFlag, lib.DefaultConfig.CUPSIgnoreRawPrinters),
+		flagToBool(cupsSharedPrintersOnlyFlag, lib.DefaultConfig.CUPSSharedPrintersOnly),
+		flagToBool(cupsStreamJobsFlag, lib.DefaultConfig.CUPSStreamJobs),
 		flagToBool(copyPrinterInfoToDisplayNameFlag, lib.DefaultConfig.CopyPrinterInfoToDisplayName),
 		flagToString(monitorSocketFilenameFlag, lib.DefaultConfig.MonitorSocketFilename),
+		flagToString(healthListenAddressFlag, lib.DefaultConfig.HealthListenAddress),
+		flagToString(adminListenAddressFlag, lib.DefaultConfig.AdminListenAddress),
+		flagToString(adminTokenFlag, lib.DefaultConfig.AdminToken),
+		flagToString(logFormatFlag, lib.DefaultConfig.LogFormat),
+		flagToUint(logMaxMegabytesFlag, lib.DefaultConfig.LogMaxMegabytes),
+		flagToUint(logMaxFilesFlag, lib.DefaultConfig.LogMaxFiles),
+		flagToBool(logCompressFlag, lib.DefaultConfig.LogCompress),
+		flagToString(syslogAddressFlag, lib.DefaultConfig.SyslogAddress),
+		flagToString(syslogFacilityFlag, lib.DefaultConfig.SyslogFacility),
+		flagToString(metricsStatsDAddressFlag, lib.DefaultConfig.MetricsStatsDAddress),
+		flagToString(metricsOTLPEndpointFlag, lib.DefaultConfig.MetricsOTLPEndpoint),
+		flagToString(metricsPrefixFlag, lib.DefaultConfig.MetricsPrefix),
+		flagToDurationString(metricsIntervalFlag, lib.DefaultConfig.MetricsInterval),
+		flagToString(alertCommandFlag, lib.DefaultConfig.AlertCommand),
+		flagToString(alertURLFlag, lib.DefaultConfig.AlertURL),
+		flagToUint(alertJobErrorPercentFlag, lib.DefaultConfig.AlertJobErrorPercent),
 		flagToString(gcpBaseURLFlag, lib.DefaultConfig.GCPBaseURL),
 		flagToString(gcpXMPPServerFlag, lib.DefaultConfig.XMPPServer),
 		flagToUint16(gcpXMPPPortFlag, lib.DefaultConfig.XMPPPort),
+		flagToUint16(gcpXMPPFallbackPortFlag, lib.DefaultConfig.XMPPFallbackPort),
+		flagToString(gcpXMPPServerHostnameFlag, lib.DefaultConfig.XMPPServerHostname),
+		flagToString(gcpXMPPCloudPrintJIDFlag, lib.DefaultConfig.XMPPCloudPrintJID),
 		flagToDurationString(gcpXMPPPingTimeoutFlag, lib.DefaultConfig.XMPPPingTimeout),
 		flagToDurationString(gcpXMPPPingIntervalDefaultFlag, lib.DefaultConfig.XMPPPingIntervalDefault),
+		flagToBool(gcpXMPPPingIntervalAutoFlag, lib.DefaultConfig.XMPPPingIntervalAuto),
+		flagToString(gcpXMPPPingIntervalFileFlag, lib.DefaultConfig.XMPPPingIntervalFile),
 		flagToString(gcpOAuthClientIDFlag, lib.DefaultConfig.GCPOAuthClientID),
 		flagToString(gcpOAuthClientSecretFlag, lib.DefaultConfig.GCPOAuthClientSecret),
 		flagToString(gcpOAuthAuthURLFlag, lib.DefaultConfig.GCPOAuthAuthURL),
@@ -345,6 +698,37 @@ func createConfigFile(xmppJID, robotRefreshToken, userRefreshToken, shareScope,
 		flagToBool(snmpEnableFlag, lib.DefaultConfig.SNMPEnable),
 		flagToString(snmpCommunityFlag, lib.DefaultConfig.SNMPCommunity),
 		flagToUint(snmpMaxConnectionsFlag, lib.DefaultConfig.SNMPMaxConnections),
+		flagToDurationString(snmpPollIntervalFlag, lib.DefaultConfig.SNMPPollInterval),
+		flagToBool(snmpPauseOnFaultFlag, lib.DefaultConfig.SNMPPauseOnFault),
+		flagToDurationString(printerProbeIntervalFlag, lib.DefaultConfig.PrinterProbeInterval),
+		flagToDurationString(printerProbeTimeoutFlag, lib.DefaultConfig.PrinterProbeTimeout),
+		flagToBool(discoveryEnableFlag, lib.DefaultConfig.DiscoveryEnable),
+		nil,
+		flagToDurationString(discoveryIntervalFlag, lib.DefaultConfig.DiscoveryInterval),
+		flagToString(gcpProxyURLFlag, lib.DefaultConfig.GCPProxyURL),
+		flagToString(xmppProxyURLFlag, lib.DefaultConfig.XMPPProxyURL),
+		flagToString(tlsCAFileFlag, lib.DefaultConfig.TLSCAFile),
+		flagToStringSlice(tlsPinsFlag, lib.DefaultConfig.TLSPins),
+		flagToDurationString(gcpFallbackPollIntervalMinFlag, lib.DefaultConfig.FallbackPollIntervalMin),
+		flagToDurationString(gcpFallbackPollIntervalMaxFlag, lib.DefaultConfig.FallbackPollIntervalMax),
+		flagToBool(localPrintingEnableFlag, lib.DefaultConfig.LocalPrintingEnable),
+		flagToUint16(localPortLowFlag, lib.DefaultConfig.LocalPortLow),
+		flagToUint16(localPortHighFlag, lib.DefaultConfig.LocalPortHigh),
+		flagToDurationString(gcpUploadTimeoutFlag, lib.DefaultConfig.GCPUploadTimeout),
+		flagToBool(gcpCompressUploadsFlag, lib.DefaultConfig.GCPCompressUploads),
+		flagToString(gcpPrinterCacheFileFlag, lib.DefaultConfig.GCPPrinterCacheFile),
+		flagToString(jobHistoryFileFlag, lib.DefaultConfig.JobHistoryFile),
+		flagToString(auditLogFileFlag, lib.DefaultConfig.AuditLogFile),
+		flagToString(runAsUserFlag, lib.DefaultConfig.RunAsUser),
+		flagToString(runAsGroupFlag, lib.DefaultConfig.RunAsGroup),
+		flagToBool(spoolEncryptFlag, lib.DefaultConfig.SpoolEncrypt),
+		flagToBool(spoolShredFlag, lib.DefaultConfig.SpoolShred),
+		flagToString(quarantineDirFlag, lib.DefaultConfig.QuarantineDir),
+		flagToUint(quarantineMaxJobsFlag, lib.DefaultConfig.QuarantineMaxJobs),
+		flagToString(credentialsStoreFlag, lib.DefaultConfig.CredentialsStore),
+		"",
+		nil,
+		nil,
 	}
 
 	if err := config.ToFile(); err != nil {
@@ -352,6 +736,41 @@ func createConfigFile(xmppJID, robotRefreshToken, userRefreshToken, shareScope,
 	}
 }
 
+// applyFlagEnv sets the flags that aren't on the command line from
+// environment variables, named like the config overrides, so that
+// CUPS_CONNECTOR_PROXY_NAME sets -proxy-name.
+func applyFlagEnv() {
+	set := make(map[string]struct{})
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = struct{}{}
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, exists := set[f.Name]; exists {
+			return
+		}
+		name := flagEnvName(f.Name)
+		if value := os.Getenv(name); value != "" {
+			if err := flag.Set(f.Name, value); err != nil {
+				log.Fatalf("Failed to parse environment variable %s: %s", name, err)
+			}
+		}
+	})
+}
+
+// flagEnvName returns the environment variable that sets a flag.
+func flagEnvName(flagName string) string {
+	return lib.ConfigEnvName(strings.Replace(flagName, "-", "_", -1))
+}
+
+// requireInteractive exits when prompting isn't allowed, naming the flag
+// that would have provided the answer.
+func requireInteractive(flagName string) {
+	if nonInteractive, _ := stringToBool(*nonInteractiveFlag); nonInteractive {
+		log.Fatalf("Set -%s, or %s, to initialize without prompting", flagName, flagEnvName(flagName))
+	}
+}
+
 func scanNonEmptyString(prompt string) string {
 	for {
 		var answer string
@@ -396,11 +815,20 @@ func stringToBool(val string) (bool, bool) {
 
 func main() {
 	flag.Parse()
+	applyFlagEnv()
 	fmt.Println(lib.FullName)
 
 	var parsed bool
+	var anonymousRegistration bool
+	if parsed, anonymousRegistration = stringToBool(*anonymousRegistrationFlag); !parsed {
+		anonymousRegistration = false
+	}
+
 	var retainUserOAuthToken bool
-	if parsed, retainUserOAuthToken = stringToBool(*retainUserOAuthTokenFlag); !parsed {
+	if anonymousRegistration {
+		retainUserOAuthToken = false
+	} else if parsed, retainUserOAuthToken = stringToBool(*retainUserOAuthTokenFlag); !parsed {
+		requireInteractive("retain-user-oauth-token")
 		retainUserOAuthToken = scanYesOrNo(
 			"Would you like to retain the user OAuth token to enable automatic sharing?")
 	}
@@ -410,6 +838,7 @@ func main() {
 		if len(*shareScopeFlag) > 0 {
 			shareScope = *shareScopeFlag
 		} else {
+			requireInteractive("share-scope")
 			shareScope = scanNonEmptyString("User or group email address, or domain name, to share with:")
 		}
 	} else {
@@ -419,22 +848,38 @@ func main() {
 
 	proxyName := *proxyNameFlag
 	if len(proxyName) < 1 {
+		requireInteractive("proxy-name")
 		proxyName = scanNonEmptyString("Proxy name for this CloudPrint-CUPS server:")
 	}
 
-	var userClient *http.Client
-	userRefreshToken := flagToString(gcpUserOAuthRefreshTokenFlag, "")
-	if userRefreshToken == "" {
-		userClient, userRefreshToken = getUserClientFromUser(retainUserOAuthToken)
+	var xmppJID, robotRefreshToken, userRefreshToken string
+	if *robotRefreshTokenFlag != "" && *xmppJIDFlag != "" {
+		// The robot account exists already; keep the user's token for sharing.
+		xmppJID, robotRefreshToken = *xmppJIDFlag, *robotRefreshTokenFlag
+		if retainUserOAuthToken {
+			userRefreshToken = flagToString(gcpUserOAuthRefreshTokenFlag, "")
+		}
+	} else if *robotRefreshTokenFlag != "" || *xmppJIDFlag != "" {
+		log.Fatal("Set both -robot-refresh-token and -xmpp-jid, or neither")
+	} else if anonymousRegistration {
+		xmppJID, robotRefreshToken = createRobotAccountAnonymously(proxyName)
+		fmt.Println("Acquired OAuth credentials for robot account")
+		fmt.Println("")
 	} else {
-		userClient = getUserClientFromToken(userRefreshToken)
-	}
-	fmt.Println("")
-
-	xmppJID, robotRefreshToken := createRobotAccount(userClient)
+		var userClient *http.Client
+		userRefreshToken = flagToString(gcpUserOAuthRefreshTokenFlag, "")
+		if userRefreshToken == "" {
+			requireInteractive("gcp-user-refresh-token")
+			userClient, userRefreshToken = getUserClientFromUser(retainUserOAuthToken)
+		} else {
+			userClient = getUserClientFromToken(userRefreshToken)
+		}
+		fmt.Println("")
 
-	fmt.Println("Acquired OAuth credentials for robot account")
-	fmt.Println("")
+		xmppJID, robotRefreshToken = createRobotAccount(userClient)
+		fmt.Println("Acquired OAuth credentials for robot account")
+		fmt.Println("")
+	}
 
 	createConfigFile(xmppJID, robotRefreshToken, userRefreshToken, shareScope, proxyName)
 	fmt.Printf("The config file %s is ready to rock.\n", *lib.ConfigFilename)
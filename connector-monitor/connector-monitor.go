@@ -18,9 +18,18 @@ import (
 	"github.com/google/cups-connector/lib"
 )
 
-var timeoutFlag = flag.Duration(
-	"timeout", time.Second*10,
-	"wait for a response for this long")
+// The JSON monitor protocol version; see monitor.ProtocolVersion, which
+// isn't imported to keep this tool free of CUPS dependencies.
+const monitorProtocolVersion = 1
+
+var (
+	timeoutFlag = flag.Duration(
+		"timeout", time.Second*10,
+		"wait for a response for this long")
+	jsonFlag = flag.Bool(
+		"json", false,
+		"ask for JSON stats, including per-printer stats")
+)
 
 func main() {
 	flag.Parse()
@@ -52,6 +61,13 @@ func main() {
 	}
 	defer conn.Close()
 
+	if *jsonFlag {
+		request := fmt.Sprintf("{\"version\":%d}\n", monitorProtocolVersion)
+		if _, err = conn.Write([]byte(request)); err != nil {
+			panic(err)
+		}
+	}
+
 	buf, err := ioutil.ReadAll(conn)
 	if err != nil {
 		panic(err)
@@ -8,35 +8,86 @@ https://developers.google.com/open-source/licenses/bsd
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/google/cups-connector/audit"
 	"github.com/google/cups-connector/gcp"
+	"github.com/google/cups-connector/history"
 	"github.com/google/cups-connector/lib"
 
 	"github.com/golang/glog"
 )
 
 var (
+	listGCPPrintersFlag = flag.Bool(
+		"list-gcp-printers", false,
+		"List all printers associated with this connector, with their GCP IDs and connection statuses")
 	deleteAllGCPPrintersFlag = flag.Bool(
 		"delete-all-gcp-printers", false,
-		"Delete all printers associated with this connector")
+		"Delete all printers associated with this connector; needs -yes")
+	deleteGCPPrintersFlag = flag.String(
+		"delete-gcp-printers", "",
+		"Delete the printers associated with this connector whose names match this regular expression; needs -yes")
+	yesFlag = flag.Bool(
+		"yes", false,
+		"Confirm that printers should be deleted; without it, the printers are only listed")
 	updateConfigFileFlag = flag.Bool(
 		"update-config-file", false,
 		"Add new options to config file after update")
+	migrateCredentialsToKeyringFlag = flag.Bool(
+		"migrate-credentials-to-keyring", false,
+		"Move refresh tokens from the config file to the OS keyring")
+	fleetReportFlag = flag.String(
+		"fleet-report", "",
+		"Write a report on each printer, from the job history, to this file; HTML when it ends in .html, JSON otherwise")
+	verifyAuditLogFlag = flag.Bool(
+		"verify-audit-log", false,
+		"Check that the audit log wasn't tampered with; exit with status 1 when it was")
+	monitorFlag = flag.Bool(
+		"monitor", false,
+		"Print the stats of the running connector; exit with status 1 when it reports a problem")
+	monitorJSONFlag = flag.Bool(
+		"monitor-json", false,
+		"Print the -monitor stats as JSON")
+	reportDaysFlag = flag.Int(
+		"report-days", 30,
+		"Days that the fleet report covers, up to now")
 )
 
 func main() {
 	flag.Parse()
-	fmt.Println(lib.FullName)
+	if !(*monitorFlag && *monitorJSONFlag) {
+		// Keep JSON output parseable.
+		fmt.Println(lib.FullName)
+	}
 
-	if *deleteAllGCPPrintersFlag {
-		deleteAllGCPPrinters()
+	if *monitorFlag {
+		monitor(*monitorJSONFlag)
+	} else if *listGCPPrintersFlag {
+		listGCPPrinters()
+	} else if *deleteAllGCPPrintersFlag {
+		deleteGCPPrinters(nil)
+	} else if *deleteGCPPrintersFlag != "" {
+		pattern, err := regexp.Compile(*deleteGCPPrintersFlag)
+		if err != nil {
+			glog.Fatalf("Failed to parse printer name pattern: %s", err)
+		}
+		deleteGCPPrinters(pattern)
 	} else if *updateConfigFileFlag {
 		updateConfigFile()
+	} else if *migrateCredentialsToKeyringFlag {
+		migrateCredentialsToKeyring()
+	} else if *fleetReportFlag != "" {
+		writeFleetReport()
+	} else if *verifyAuditLogFlag {
+		verifyAuditLog()
 	} else {
 		fmt.Println("no tool specified")
 	}
@@ -45,32 +96,69 @@ func main() {
 // updateConfigFile opens the config file, adds any missing fields,
 // writes the config file back.
 func updateConfigFile() {
-	// Config as parsed by the connector.
-	config, err := lib.ConfigFromFile()
-	if err != nil {
+	// Options renamed since the config file was written keep their values.
+	if backupFilename, err := lib.MigrateConfigFile(); err != nil {
 		panic(err)
+	} else if backupFilename != "" {
+		fmt.Printf("Upgraded config file to version %d; the old file is %s\n", lib.CurrentConfigVersion, backupFilename)
 	}
 
-	// Same config in []byte format.
-	configRaw, err := ioutil.ReadFile(*lib.ConfigFilename)
+	// Config as parsed by the connector, without environment overrides,
+	// which shouldn't be written to the file.
+	config, err := lib.ConfigFromFileWithoutEnv()
 	if err != nil {
 		panic(err)
 	}
 
 	// Same config in map format so that we can detect missing keys.
-	var configMap map[string]interface{}
-	if err = json.Unmarshal(configRaw, &configMap); err != nil {
+	configMap, err := lib.ConfigMapFromFile()
+	if err != nil {
 		panic(err)
 	}
 
 	// No changes detected yet.
 	dirty := false
 
+	if _, exists := configMap["share_role"]; !exists {
+		dirty = true
+		fmt.Println("Added share_role")
+		config.ShareRole = lib.DefaultConfig.ShareRole
+	}
+	if _, exists := configMap["share_revoke_unlisted"]; !exists {
+		dirty = true
+		fmt.Println("Added share_revoke_unlisted")
+		config.ShareRevokeUnlisted = lib.DefaultConfig.ShareRevokeUnlisted
+	}
+	if _, exists := configMap["proxy_conflict_action"]; !exists {
+		dirty = true
+		fmt.Println("Added proxy_conflict_action")
+		config.ProxyConflictAction = lib.DefaultConfig.ProxyConflictAction
+	}
 	if _, exists := configMap["gcp_max_concurrent_downloads"]; !exists {
 		dirty = true
 		fmt.Println("Added gcp_max_concurrent_downloads")
 		config.GCPMaxConcurrentDownloads = lib.DefaultConfig.GCPMaxConcurrentDownloads
 	}
+	if _, exists := configMap["gcp_max_download_mb"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_max_download_mb")
+		config.GCPMaxDownloadMB = lib.DefaultConfig.GCPMaxDownloadMB
+	}
+	if _, exists := configMap["gcp_max_job_age"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_max_job_age")
+		config.GCPMaxJobAge = lib.DefaultConfig.GCPMaxJobAge
+	}
+	if _, exists := configMap["gcp_max_jobs_per_minute"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_max_jobs_per_minute")
+		config.GCPMaxJobsPerMinute = lib.DefaultConfig.GCPMaxJobsPerMinute
+	}
+	if _, exists := configMap["backend"]; !exists {
+		dirty = true
+		fmt.Println("Added backend")
+		config.Backend = lib.DefaultConfig.Backend
+	}
 	if _, exists := configMap["cups_max_connections"]; !exists {
 		dirty = true
 		fmt.Println("Added cups_max_connections")
@@ -81,6 +169,37 @@ func updateConfigFile() {
 		fmt.Println("Added cups_connect_timeout")
 		config.CUPSConnectTimeout = lib.DefaultConfig.CUPSConnectTimeout
 	}
+	if _, exists := configMap["cups_list_timeout"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_list_timeout")
+		config.CUPSListTimeout = lib.DefaultConfig.CUPSListTimeout
+	}
+	if _, exists := configMap["cups_ppd_timeout"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_ppd_timeout")
+		config.CUPSPPDTimeout = lib.DefaultConfig.CUPSPPDTimeout
+	}
+	if _, exists := configMap["cups_print_timeout"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_print_timeout")
+		config.CUPSPrintTimeout = lib.DefaultConfig.CUPSPrintTimeout
+	}
+	if _, exists := configMap["cups_job_state_timeout"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_job_state_timeout")
+		config.CUPSJobStateTimeout = lib.DefaultConfig.CUPSJobStateTimeout
+	}
+	if _, exists := configMap["cups_ppd_fetch_workers"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_ppd_fetch_workers")
+		config.CUPSPPDFetchWorkers = lib.DefaultConfig.CUPSPPDFetchWorkers
+	}
+	if _, exists := configMap["cups_ppd_translator"]; !exists {
+		dirty = true
+		// Configs from before the local translator keep GCP's.
+		fmt.Println("Added cups_ppd_translator, as gcp; set it to local to translate PPDs locally")
+		config.CUPSPPDTranslator = lib.PPDTranslatorGCP
+	}
 	if _, exists := configMap["cups_job_queue_size"]; !exists {
 		dirty = true
 		fmt.Println("Added cups_job_queue_size")
@@ -91,22 +210,32 @@ func updateConfigFile() {
 		fmt.Println("Added cups_printer_poll_interval")
 		config.CUPSPrinterPollInterval = lib.DefaultConfig.CUPSPrinterPollInterval
 	}
+	if _, exists := configMap["cups_printer_state_poll_interval"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_printer_state_poll_interval")
+		config.CUPSPrinterStatePollInterval = lib.DefaultConfig.CUPSPrinterStatePollInterval
+	}
+	if _, exists := configMap["cups_printer_full_fetch_interval"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_printer_full_fetch_interval")
+		config.CUPSPrinterFullFetchInterval = lib.DefaultConfig.CUPSPrinterFullFetchInterval
+	}
+	if _, exists := configMap["cups_watch_files"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_watch_files")
+		config.CUPSWatchFiles = lib.DefaultConfig.CUPSWatchFiles
+	}
 	if _, exists := configMap["cups_printer_attributes"]; !exists {
 		dirty = true
 		fmt.Println("Added cups_printer_attributes")
 		config.CUPSPrinterAttributes = lib.DefaultConfig.CUPSPrinterAttributes
 	} else {
-		// Make sure all required attributes are present.
-		s := make(map[string]struct{}, len(config.CUPSPrinterAttributes))
-		for _, a := range config.CUPSPrinterAttributes {
-			s[a] = struct{}{}
-		}
-		for _, a := range lib.DefaultConfig.CUPSPrinterAttributes {
-			if _, exists := s[a]; !exists {
-				dirty = true
-				fmt.Printf("Added %s to cups_printer_attributes\n", a)
-				config.CUPSPrinterAttributes = append(config.CUPSPrinterAttributes, a)
-			}
+		// Make sure the attributes that the config needs are present; others
+		// may have been left out on purpose.
+		for _, a := range lib.MissingCUPSPrinterAttributes(config) {
+			dirty = true
+			fmt.Printf("Added %s to cups_printer_attributes\n", a)
+			config.CUPSPrinterAttributes = append(config.CUPSPrinterAttributes, a)
 		}
 	}
 	if _, exists := configMap["cups_job_full_username"]; !exists {
@@ -114,11 +243,31 @@ func updateConfigFile() {
 		fmt.Println("Added cups_job_full_username")
 		config.CUPSJobFullUsername = lib.DefaultConfig.CUPSJobFullUsername
 	}
+	if _, exists := configMap["cups_job_user"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_job_user")
+		config.CUPSJobUser = lib.DefaultConfig.CUPSJobUser
+	}
+	if _, exists := configMap["cups_job_accounting_owner"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_job_accounting_owner")
+		config.CUPSJobAccountingOwner = lib.DefaultConfig.CUPSJobAccountingOwner
+	}
 	if _, exists := configMap["cups_ignore_raw_printers"]; !exists {
 		dirty = true
 		fmt.Println("Added cups_ignore_raw_printers")
 		config.CUPSIgnoreRawPrinters = lib.DefaultConfig.CUPSIgnoreRawPrinters
 	}
+	if _, exists := configMap["cups_shared_printers_only"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_shared_printers_only")
+		config.CUPSSharedPrintersOnly = lib.DefaultConfig.CUPSSharedPrintersOnly
+	}
+	if _, exists := configMap["cups_stream_jobs"]; !exists {
+		dirty = true
+		fmt.Println("Added cups_stream_jobs")
+		config.CUPSStreamJobs = lib.DefaultConfig.CUPSStreamJobs
+	}
 	if _, exists := configMap["copy_printer_info_to_display_name"]; !exists {
 		dirty = true
 		fmt.Println("Added copy_printer_info_to_display_name")
@@ -129,6 +278,86 @@ func updateConfigFile() {
 		fmt.Println("Added monitor_socket_filename")
 		config.MonitorSocketFilename = lib.DefaultConfig.MonitorSocketFilename
 	}
+	if _, exists := configMap["health_listen_address"]; !exists {
+		dirty = true
+		fmt.Println("Added health_listen_address")
+		config.HealthListenAddress = lib.DefaultConfig.HealthListenAddress
+	}
+	if _, exists := configMap["admin_listen_address"]; !exists {
+		dirty = true
+		fmt.Println("Added admin_listen_address")
+		config.AdminListenAddress = lib.DefaultConfig.AdminListenAddress
+	}
+	if _, exists := configMap["admin_token"]; !exists {
+		dirty = true
+		fmt.Println("Added admin_token")
+		config.AdminToken = lib.DefaultConfig.AdminToken
+	}
+	if _, exists := configMap["log_format"]; !exists {
+		dirty = true
+		fmt.Println("Added log_format")
+		config.LogFormat = lib.DefaultConfig.LogFormat
+	}
+	if _, exists := configMap["log_max_megabytes"]; !exists {
+		dirty = true
+		fmt.Println("Added log_max_megabytes")
+		config.LogMaxMegabytes = lib.DefaultConfig.LogMaxMegabytes
+	}
+	if _, exists := configMap["log_max_files"]; !exists {
+		dirty = true
+		fmt.Println("Added log_max_files")
+		config.LogMaxFiles = lib.DefaultConfig.LogMaxFiles
+	}
+	if _, exists := configMap["log_compress"]; !exists {
+		dirty = true
+		fmt.Println("Added log_compress")
+		config.LogCompress = lib.DefaultConfig.LogCompress
+	}
+	if _, exists := configMap["syslog_address"]; !exists {
+		dirty = true
+		fmt.Println("Added syslog_address")
+		config.SyslogAddress = lib.DefaultConfig.SyslogAddress
+	}
+	if _, exists := configMap["syslog_facility"]; !exists {
+		dirty = true
+		fmt.Println("Added syslog_facility")
+		config.SyslogFacility = lib.DefaultConfig.SyslogFacility
+	}
+	if _, exists := configMap["metrics_statsd_address"]; !exists {
+		dirty = true
+		fmt.Println("Added metrics_statsd_address")
+		config.MetricsStatsDAddress = lib.DefaultConfig.MetricsStatsDAddress
+	}
+	if _, exists := configMap["metrics_otlp_endpoint"]; !exists {
+		dirty = true
+		fmt.Println("Added metrics_otlp_endpoint")
+		config.MetricsOTLPEndpoint = lib.DefaultConfig.MetricsOTLPEndpoint
+	}
+	if _, exists := configMap["metrics_prefix"]; !exists {
+		dirty = true
+		fmt.Println("Added metrics_prefix")
+		config.MetricsPrefix = lib.DefaultConfig.MetricsPrefix
+	}
+	if _, exists := configMap["metrics_interval"]; !exists {
+		dirty = true
+		fmt.Println("Added metrics_interval")
+		config.MetricsInterval = lib.DefaultConfig.MetricsInterval
+	}
+	if _, exists := configMap["alert_command"]; !exists {
+		dirty = true
+		fmt.Println("Added alert_command")
+		config.AlertCommand = lib.DefaultConfig.AlertCommand
+	}
+	if _, exists := configMap["alert_url"]; !exists {
+		dirty = true
+		fmt.Println("Added alert_url")
+		config.AlertURL = lib.DefaultConfig.AlertURL
+	}
+	if _, exists := configMap["alert_job_error_percent"]; !exists {
+		dirty = true
+		fmt.Println("Added alert_job_error_percent")
+		config.AlertJobErrorPercent = lib.DefaultConfig.AlertJobErrorPercent
+	}
 	if _, exists := configMap["gcp_base_url"]; !exists {
 		dirty = true
 		fmt.Println("Added gcp_base_url")
@@ -144,6 +373,21 @@ func updateConfigFile() {
 		fmt.Println("Added xmpp_port")
 		config.XMPPPort = lib.DefaultConfig.XMPPPort
 	}
+	if _, exists := configMap["xmpp_fallback_port"]; !exists {
+		dirty = true
+		fmt.Println("Added xmpp_fallback_port")
+		config.XMPPFallbackPort = lib.DefaultConfig.XMPPFallbackPort
+	}
+	if _, exists := configMap["xmpp_server_hostname"]; !exists {
+		dirty = true
+		fmt.Println("Added xmpp_server_hostname")
+		config.XMPPServerHostname = lib.DefaultConfig.XMPPServerHostname
+	}
+	if _, exists := configMap["xmpp_cloudprint_jid"]; !exists {
+		dirty = true
+		fmt.Println("Added xmpp_cloudprint_jid")
+		config.XMPPCloudPrintJID = lib.DefaultConfig.XMPPCloudPrintJID
+	}
 	if _, exists := configMap["gcp_xmpp_ping_timeout"]; !exists {
 		dirty = true
 		fmt.Println("Added gcp_xmpp_ping_timeout")
@@ -154,6 +398,16 @@ func updateConfigFile() {
 		fmt.Println("Added gcp_xmpp_ping_interval_default")
 		config.XMPPPingIntervalDefault = lib.DefaultConfig.XMPPPingIntervalDefault
 	}
+	if _, exists := configMap["gcp_xmpp_ping_interval_auto"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_xmpp_ping_interval_auto")
+		config.XMPPPingIntervalAuto = lib.DefaultConfig.XMPPPingIntervalAuto
+	}
+	if _, exists := configMap["gcp_xmpp_ping_interval_file"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_xmpp_ping_interval_file")
+		config.XMPPPingIntervalFile = lib.DefaultConfig.XMPPPingIntervalFile
+	}
 	if _, exists := configMap["gcp_oauth_client_id"]; !exists {
 		dirty = true
 		fmt.Println("Added gcp_oauth_client_id")
@@ -189,6 +443,121 @@ func updateConfigFile() {
 		fmt.Println("Added snmp_max_connections")
 		config.SNMPMaxConnections = lib.DefaultConfig.SNMPMaxConnections
 	}
+	if _, exists := configMap["snmp_poll_interval"]; !exists {
+		dirty = true
+		fmt.Println("Added snmp_poll_interval")
+		config.SNMPPollInterval = lib.DefaultConfig.SNMPPollInterval
+	}
+	if _, exists := configMap["snmp_pause_on_fault"]; !exists {
+		dirty = true
+		fmt.Println("Added snmp_pause_on_fault")
+		config.SNMPPauseOnFault = lib.DefaultConfig.SNMPPauseOnFault
+	}
+	if _, exists := configMap["printer_probe_interval"]; !exists {
+		dirty = true
+		fmt.Println("Added printer_probe_interval")
+		config.PrinterProbeInterval = lib.DefaultConfig.PrinterProbeInterval
+	}
+	if _, exists := configMap["printer_probe_timeout"]; !exists {
+		dirty = true
+		fmt.Println("Added printer_probe_timeout")
+		config.PrinterProbeTimeout = lib.DefaultConfig.PrinterProbeTimeout
+	}
+	if _, exists := configMap["discovery_enable"]; !exists {
+		dirty = true
+		fmt.Println("Added discovery_enable")
+		config.DiscoveryEnable = lib.DefaultConfig.DiscoveryEnable
+	}
+	if _, exists := configMap["discovery_interval"]; !exists {
+		dirty = true
+		fmt.Println("Added discovery_interval")
+		config.DiscoveryInterval = lib.DefaultConfig.DiscoveryInterval
+	}
+	if _, exists := configMap["gcp_fallback_poll_interval_min"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_fallback_poll_interval_min")
+		config.FallbackPollIntervalMin = lib.DefaultConfig.FallbackPollIntervalMin
+	}
+	if _, exists := configMap["gcp_fallback_poll_interval_max"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_fallback_poll_interval_max")
+		config.FallbackPollIntervalMax = lib.DefaultConfig.FallbackPollIntervalMax
+	}
+	if _, exists := configMap["local_printing_enable"]; !exists {
+		dirty = true
+		fmt.Println("Added local_printing_enable")
+		config.LocalPrintingEnable = lib.DefaultConfig.LocalPrintingEnable
+	}
+	if _, exists := configMap["local_port_low"]; !exists {
+		dirty = true
+		fmt.Println("Added local_port_low")
+		config.LocalPortLow = lib.DefaultConfig.LocalPortLow
+	}
+	if _, exists := configMap["local_port_high"]; !exists {
+		dirty = true
+		fmt.Println("Added local_port_high")
+		config.LocalPortHigh = lib.DefaultConfig.LocalPortHigh
+	}
+	if _, exists := configMap["gcp_upload_timeout"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_upload_timeout")
+		config.GCPUploadTimeout = lib.DefaultConfig.GCPUploadTimeout
+	}
+	if _, exists := configMap["gcp_compress_uploads"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_compress_uploads")
+		config.GCPCompressUploads = lib.DefaultConfig.GCPCompressUploads
+	}
+	if _, exists := configMap["gcp_printer_cache_file"]; !exists {
+		dirty = true
+		fmt.Println("Added gcp_printer_cache_file")
+		config.GCPPrinterCacheFile = lib.DefaultConfig.GCPPrinterCacheFile
+	}
+	if _, exists := configMap["job_history_file"]; !exists {
+		dirty = true
+		fmt.Println("Added job_history_file")
+		config.JobHistoryFile = lib.DefaultConfig.JobHistoryFile
+	}
+	if _, exists := configMap["audit_log_file"]; !exists {
+		dirty = true
+		fmt.Println("Added audit_log_file")
+		config.AuditLogFile = lib.DefaultConfig.AuditLogFile
+	}
+	if _, exists := configMap["run_as_user"]; !exists {
+		dirty = true
+		fmt.Println("Added run_as_user")
+		config.RunAsUser = lib.DefaultConfig.RunAsUser
+	}
+	if _, exists := configMap["run_as_group"]; !exists {
+		dirty = true
+		fmt.Println("Added run_as_group")
+		config.RunAsGroup = lib.DefaultConfig.RunAsGroup
+	}
+	if _, exists := configMap["spool_encrypt"]; !exists {
+		dirty = true
+		fmt.Println("Added spool_encrypt")
+		config.SpoolEncrypt = lib.DefaultConfig.SpoolEncrypt
+	}
+	if _, exists := configMap["spool_shred"]; !exists {
+		dirty = true
+		fmt.Println("Added spool_shred")
+		config.SpoolShred = lib.DefaultConfig.SpoolShred
+	}
+	if _, exists := configMap["quarantine_dir"]; !exists {
+		dirty = true
+		fmt.Println("Added quarantine_dir")
+		config.QuarantineDir = lib.DefaultConfig.QuarantineDir
+	}
+	if _, exists := configMap["quarantine_max_jobs"]; !exists {
+		dirty = true
+		fmt.Println("Added quarantine_max_jobs")
+		config.QuarantineMaxJobs = lib.DefaultConfig.QuarantineMaxJobs
+	}
+	if _, exists := configMap["credentials_store"]; !exists {
+		dirty = true
+		fmt.Println("Added credentials_store")
+		config.CredentialsStore = lib.DefaultConfig.CredentialsStore
+	}
 
 	if dirty {
 		config.ToFile()
@@ -198,46 +567,202 @@ func updateConfigFile() {
 	}
 }
 
-// deleteAllGCPPrinters finds all GCP printers associated with this
-// connector, deletes them from GCP.
-func deleteAllGCPPrinters() {
+// migrateCredentialsToKeyring moves the refresh tokens from the config file
+// to the OS keyring, and sets credentials_store to keyring.
+func migrateCredentialsToKeyring() {
+	config, err := lib.ConfigFromFileWithoutEnv()
+	if err != nil {
+		panic(err)
+	}
+	if config.CredentialsStore == lib.CredentialsStoreKeyring {
+		fmt.Println("Refresh tokens are already in the keyring")
+		return
+	}
+
+	config.CredentialsStore = lib.CredentialsStoreKeyring
+	if err = config.ToFile(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Moved refresh tokens to the keyring and wrote %s\n", *lib.ConfigFilename)
+}
+
+// writeFleetReport writes a report on each printer, from the job history
+// file, to the file named by the fleet-report flag.
+func writeFleetReport() {
+	config, err := lib.ConfigFromFile()
+	if err != nil {
+		panic(err)
+	}
+	if config.JobHistoryFile == "" {
+		glog.Fatal("The job history is not kept; set job_history_file")
+	}
+	if *reportDaysFlag <= 0 {
+		glog.Fatal("report-days must be positive")
+	}
+
+	records, err := history.ReadFile(config.JobHistoryFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	to := time.Now()
+	report := history.NewReport(records, to.AddDate(0, 0, -*reportDaysFlag), to)
+
+	f, err := os.Create(*fleetReportFlag)
+	if err != nil {
+		glog.Fatalf("Failed to create fleet report: %s", err)
+	}
+	if strings.HasSuffix(*fleetReportFlag, ".html") {
+		err = report.WriteHTML(f)
+	} else {
+		err = report.WriteJSON(f)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		glog.Fatalf("Failed to write fleet report: %s", err)
+	}
+	fmt.Printf("Wrote a report on %d printers over %d days to %s\n", len(report.Printers), *reportDaysFlag, *fleetReportFlag)
+}
+
+// verifyAuditLog checks the chain of the audit log file, and exits with
+// status 1 when it is broken.
+func verifyAuditLog() {
 	config, err := lib.ConfigFromFile()
 	if err != nil {
 		panic(err)
 	}
+	if config.AuditLogFile == "" {
+		glog.Fatal("The audit log is not kept; set audit_log_file")
+	}
+
+	entries, err := audit.Verify(config.AuditLogFile)
+	if incomplete, ok := err.(*audit.IncompleteLineError); ok {
+		// Not tampering: a crash while the entry was written.
+		fmt.Printf("Audit log %s is intact, with %d entries, followed by an incomplete line %d, which the connector removes when it starts\n",
+			config.AuditLogFile, entries, incomplete.Line)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Audit log %s is intact, with %d entries\n", config.AuditLogFile, entries)
+}
 
+// newGCPs connects to GCP with each account of config.
+func newGCPs(config *lib.Config) []*gcp.GoogleCloudPrint {
 	gcpXMPPPingIntervalDefault, err := time.ParseDuration(config.XMPPPingIntervalDefault)
 	if err != nil {
 		glog.Fatalf("Failed to parse xmpp ping interval default: %s", err)
 	}
+	gcpUploadTimeout, err := time.ParseDuration(config.GCPUploadTimeout)
+	if err != nil {
+		glog.Fatalf("Failed to parse upload timeout: %s", err)
+	}
 
-	gcp, err := gcp.NewGoogleCloudPrint(config.GCPBaseURL, config.RobotRefreshToken,
-		config.UserRefreshToken, config.ProxyName, config.GCPOAuthClientID,
-		config.GCPOAuthClientSecret, config.GCPOAuthAuthURL, config.GCPOAuthTokenURL,
-		gcpXMPPPingIntervalDefault)
+	tlsConfig, err := lib.NewTLSConfig(config.TLSCAFile, config.TLSPins)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
-	printers, err := gcp.List()
+	accounts := config.Accounts()
+	gcps := make([]*gcp.GoogleCloudPrint, len(accounts))
+	for i, account := range accounts {
+		gcps[i], err = gcp.NewGoogleCloudPrint(config.GCPBaseURL, account.RobotRefreshToken,
+			account.UserRefreshToken, account.ProxyName, config.GCPOAuthClientID,
+			config.GCPOAuthClientSecret, config.GCPOAuthAuthURL, config.GCPOAuthTokenURL,
+			config.GCPProxyURL, tlsConfig, gcpXMPPPingIntervalDefault, gcpUploadTimeout, config.GCPCompressUploads, nil, nil)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	return gcps
+}
+
+// listGCPPrinters prints the GCP printers associated with this connector,
+// in all of its accounts, sorted by name.
+func listGCPPrinters() {
+	config, err := lib.ConfigFromFile()
 	if err != nil {
-		glog.Fatal(err)
+		panic(err)
 	}
 
-	ch := make(chan bool)
-	for gcpID, name := range printers {
-		go func(gcpID, name string) {
-			err := gcp.Delete(gcpID)
-			if err != nil {
-				fmt.Printf("Failed to delete %s \"%s\": %s\n", gcpID, name, err)
-			} else {
-				fmt.Printf("Deleted %s \"%s\" from GCP\n", gcpID, name)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tGCP ID\tNAME\tDISPLAY NAME\tPROXY\tSTATUS")
+	var total int
+	for i, gcp := range newGCPs(config) {
+		printers, err := gcp.ListSummaries()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		sort.Sort(printerSummariesByName(printers))
+		for _, p := range printers {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i, p.GCPID, p.Name, p.DisplayName, p.Proxy, p.ConnectionStatus)
+		}
+		total += len(printers)
+	}
+	w.Flush()
+	fmt.Printf("%d printers\n", total)
+}
+
+type printerSummariesByName []gcp.PrinterSummary
+
+func (s printerSummariesByName) Len() int           { return len(s) }
+func (s printerSummariesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s printerSummariesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// deleteGCPPrinters finds the GCP printers associated with this connector,
+// in all of its accounts, whose names match pattern, or all of them when
+// pattern is nil, and deletes them from GCP. Without the yes flag, it only
+// lists the printers that it would delete.
+func deleteGCPPrinters(pattern *regexp.Regexp) {
+	config, err := lib.ConfigFromFile()
+	if err != nil {
+		panic(err)
+	}
+
+	var matched int
+	for _, gcp := range newGCPs(config) {
+		printers, err := gcp.List()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		for gcpID, name := range printers {
+			if pattern != nil && !pattern.MatchString(name) {
+				delete(printers, gcpID)
+			}
+		}
+		matched += len(printers)
+
+		if !*yesFlag {
+			for gcpID, name := range printers {
+				fmt.Printf("Would delete %s \"%s\"\n", gcpID, name)
 			}
-			ch <- true
-		}(gcpID, name)
+			continue
+		}
+
+		ch := make(chan bool)
+		for gcpID, name := range printers {
+			go func(gcpID, name string) {
+				err := gcp.Delete(gcpID)
+				if err != nil {
+					fmt.Printf("Failed to delete %s \"%s\": %s\n", gcpID, name, err)
+				} else {
+					fmt.Printf("Deleted %s \"%s\" from GCP\n", gcpID, name)
+				}
+				ch <- true
+			}(gcpID, name)
+		}
+
+		for _ = range printers {
+			<-ch
+		}
 	}
 
-	for _ = range printers {
-		<-ch
+	if !*yesFlag && matched > 0 {
+		fmt.Printf("Run again with -yes to delete these %d printers\n", matched)
+	} else if matched == 0 {
+		fmt.Println("No printers to delete")
 	}
 }
@@ -0,0 +1,213 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// The JSON monitor protocol version; see monitor.ProtocolVersion, which
+// isn't imported to keep this tool free of CUPS dependencies.
+const monitorProtocolVersion = 1
+
+// How long to wait for the connector to answer.
+const monitorTimeout = 10 * time.Second
+
+// monitorStats is the part of monitor.Stats that this tool shows.
+type monitorStats struct {
+	Version int    `json:"version"`
+	Error   string `json:"error"`
+
+	CUPS struct {
+		Reachable      bool   `json:"reachable"`
+		Error          string `json:"error"`
+		Printers       int    `json:"printers"`
+		RawPrinters    int    `json:"raw_printers"`
+		Connections    uint   `json:"connections"`
+		MaxConnections uint   `json:"max_connections"`
+	} `json:"cups"`
+
+	Accounts []struct {
+		Account         int       `json:"account"`
+		ProxyName       string    `json:"proxy_name"`
+		AuthError       string    `json:"auth_error"`
+		LastSync        time.Time `json:"last_sync"`
+		LastSyncSuccess time.Time `json:"last_sync_success"`
+		LastSyncError   string    `json:"last_sync_error"`
+		Degraded        bool      `json:"degraded"`
+		XMPPConnected   bool      `json:"xmpp_connected"`
+		XMPPReconnects  uint      `json:"xmpp_reconnects"`
+		XMPPReadErrors  uint      `json:"xmpp_read_errors"`
+		Downloads       uint      `json:"downloads"`
+		MaxDownloads    uint      `json:"max_downloads"`
+	} `json:"accounts"`
+
+	Jobs struct {
+		Done       uint `json:"done"`
+		Error      uint `json:"error"`
+		InProgress uint `json:"in_progress"`
+	} `json:"jobs"`
+
+	Printers []struct {
+		Account        int    `json:"account"`
+		Name           string `json:"name"`
+		State          string `json:"state"`
+		Paused         bool   `json:"paused"`
+		JobsDone       uint   `json:"jobs_done"`
+		JobsError      uint   `json:"jobs_error"`
+		JobsCancelled  uint   `json:"jobs_cancelled"`
+		JobsInProgress uint   `json:"jobs_in_progress"`
+		QueueOccupancy uint   `json:"queue_occupancy"`
+		QueueSize      uint   `json:"queue_size"`
+		LastError      string `json:"last_error"`
+	} `json:"printers"`
+}
+
+// monitor asks the running connector for its stats over the monitor socket,
+// and prints them as text, or as indented JSON with asJSON. Exits with
+// status 1 when the connector reports a problem, for health checks.
+func monitor(asJSON bool) {
+	config, err := lib.ConfigFromFile()
+	if err != nil {
+		panic(err)
+	}
+
+	b, err := requestMonitorStats(config.MonitorSocketFilename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var stats monitorStats
+	if err = json.Unmarshal(b, &stats); err != nil {
+		glog.Fatalf("Failed to parse monitor stats: %s", err)
+	}
+
+	if asJSON {
+		var out bytes.Buffer
+		json.Indent(&out, bytes.TrimSpace(b), "", "  ")
+		out.WriteByte('\n')
+		out.WriteTo(os.Stdout)
+	} else {
+		printMonitorStats(&stats)
+	}
+
+	if problems := monitorProblems(&stats); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		os.Exit(1)
+	}
+}
+
+// requestMonitorStats returns the JSON stats of the connector listening on
+// socketFilename.
+func requestMonitorStats(socketFilename string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", socketFilename, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("No connector is running, or it is not listening to socket %s", socketFilename)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(monitorTimeout))
+
+	request := fmt.Sprintf("{\"version\":%d}\n", monitorProtocolVersion)
+	if _, err = conn.Write([]byte(request)); err != nil {
+		return nil, fmt.Errorf("Failed to ask the connector for stats: %s", err)
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read stats from the connector: %s", err)
+	}
+	return b, nil
+}
+
+func printMonitorStats(stats *monitorStats) {
+	if stats.CUPS.Reachable {
+		fmt.Printf("CUPS: %d printers, %d raw; %d of %d connections open\n",
+			stats.CUPS.Printers, stats.CUPS.RawPrinters, stats.CUPS.Connections, stats.CUPS.MaxConnections)
+	} else {
+		fmt.Printf("CUPS: unreachable: %s\n", stats.CUPS.Error)
+	}
+
+	for _, account := range stats.Accounts {
+		xmpp := "connected"
+		if !account.XMPPConnected {
+			xmpp = "disconnected"
+		}
+		if account.XMPPReadErrors > 0 {
+			xmpp = fmt.Sprintf("%s, backing off after %d failed reads", xmpp, account.XMPPReadErrors)
+		}
+		fmt.Printf("Account %d (%s): last synchronized %s, XMPP %s, %d reconnects, %d of %d downloads\n",
+			account.Account, account.ProxyName, formatTime(account.LastSyncSuccess), xmpp, account.XMPPReconnects,
+			account.Downloads, account.MaxDownloads)
+	}
+
+	fmt.Printf("Jobs: %d done, %d errors, %d in progress\n", stats.Jobs.Done, stats.Jobs.Error, stats.Jobs.InProgress)
+
+	if len(stats.Printers) == 0 {
+		return
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tPRINTER\tSTATE\tDONE\tERRORS\tCANCELLED\tIN PROGRESS\tQUEUE\tLAST ERROR")
+	for _, p := range stats.Printers {
+		state := p.State
+		if p.Paused {
+			state += ", paused"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d/%d\t%s\n", p.Account, p.Name, state,
+			p.JobsDone, p.JobsError, p.JobsCancelled, p.JobsInProgress, p.QueueOccupancy, p.QueueSize, p.LastError)
+	}
+	w.Flush()
+}
+
+// monitorProblems returns what is wrong with the connector, according to
+// stats.
+func monitorProblems(stats *monitorStats) []string {
+	if stats.Error != "" {
+		return []string{stats.Error}
+	}
+
+	var problems []string
+	if !stats.CUPS.Reachable {
+		problems = append(problems, fmt.Sprintf("CUPS is unreachable: %s", stats.CUPS.Error))
+	}
+	for _, account := range stats.Accounts {
+		if account.AuthError != "" {
+			problems = append(problems, fmt.Sprintf("Account %d credentials don't work; re-authorize with connector-init: %s", account.Account, account.AuthError))
+		}
+		if account.LastSyncError != "" {
+			problems = append(problems, fmt.Sprintf("Account %d failed to synchronize printers: %s", account.Account, account.LastSyncError))
+		}
+		if account.Degraded {
+			problems = append(problems, fmt.Sprintf("Account %d runs with cached printers; GCP was unreachable at startup", account.Account))
+		}
+		if !account.XMPPConnected {
+			problems = append(problems, fmt.Sprintf("Account %d XMPP is disconnected", account.Account))
+		}
+	}
+	return problems
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(t)/time.Second*time.Second)
+}
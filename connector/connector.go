@@ -8,18 +8,32 @@ https://developers.google.com/open-source/licenses/bsd
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/google/cups-connector/admin"
+	"github.com/google/cups-connector/alert"
+	"github.com/google/cups-connector/audit"
 	"github.com/google/cups-connector/cups"
+	"github.com/google/cups-connector/directory"
+	"github.com/google/cups-connector/discovery"
+	"github.com/google/cups-connector/execbackend"
 	"github.com/google/cups-connector/gcp"
+	"github.com/google/cups-connector/history"
 	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/logger"
 	"github.com/google/cups-connector/manager"
+	"github.com/google/cups-connector/metrics"
 	"github.com/google/cups-connector/monitor"
+	"github.com/google/cups-connector/privet"
 	"github.com/google/cups-connector/snmp"
 	"github.com/google/cups-connector/xmpp"
 
@@ -32,11 +46,43 @@ func main() {
 	glog.Error(lib.FullName)
 	fmt.Println(lib.FullName)
 
+	if *validateConfigFlag {
+		if problems := validateConfig(); problems > 0 {
+			fmt.Printf("Found %d problems\n", problems)
+			glog.Flush()
+			os.Exit(1)
+		}
+		fmt.Println("Config is valid")
+		return
+	}
+
+	if backupFilename, err := lib.MigrateConfigFile(); err != nil {
+		glog.Warningf("Failed to upgrade config file %s to version %d; reading it as is: %s", *lib.ConfigFilename, lib.CurrentConfigVersion, err)
+	} else if backupFilename != "" {
+		glog.Infof("Upgraded config file %s to version %d; the old file is %s", *lib.ConfigFilename, lib.CurrentConfigVersion, backupFilename)
+	}
+
 	config, err := lib.ConfigFromFile()
 	if err != nil {
 		glog.Fatal(err)
 	}
 
+	if !*foregroundFlag {
+		runInBackground()
+	}
+
+	if config.LogFormat != "" {
+		if err = logger.SetFormat(config.LogFormat); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	logger.StartRotation(config.LogMaxMegabytes, config.LogMaxFiles, config.LogCompress)
+	if config.SyslogAddress != "" {
+		if err = logger.SetSyslog(config.SyslogAddress, config.SyslogFacility); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
 	if _, err := os.Stat(config.MonitorSocketFilename); !os.IsNotExist(err) {
 		if err != nil {
 			glog.Fatal(err)
@@ -46,11 +92,28 @@ func main() {
 			config.MonitorSocketFilename)
 	}
 
+	if *pidFileFlag != "" {
+		if err = writePIDFile(*pidFileFlag); err != nil {
+			glog.Fatal(err)
+		}
+		defer os.Remove(*pidFileFlag)
+	}
+
 	cupsConnectTimeout, err := time.ParseDuration(config.CUPSConnectTimeout)
 	if err != nil {
 		glog.Fatalf("Failed to parse cups connect timeout: %s", err)
 	}
 
+	cupsTimeouts, err := parseCUPSTimeouts(config)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	cupsPrinterFullFetchInterval, err := time.ParseDuration(config.CUPSPrinterFullFetchInterval)
+	if err != nil {
+		glog.Fatalf("Failed to parse cups printer full fetch interval: %s", err)
+	}
+
 	gcpXMPPPingTimeout, err := time.ParseDuration(config.XMPPPingTimeout)
 	if err != nil {
 		glog.Fatalf("Failed to parse xmpp ping timeout: %s", err)
@@ -59,30 +122,120 @@ func main() {
 	if err != nil {
 		glog.Fatalf("Failed to parse xmpp ping interval default: %s", err)
 	}
-
-	gcp, err := gcp.NewGoogleCloudPrint(config.GCPBaseURL, config.RobotRefreshToken, config.UserRefreshToken,
-		config.ProxyName, config.GCPOAuthClientID, config.GCPOAuthClientSecret,
-		config.GCPOAuthAuthURL, config.GCPOAuthTokenURL, gcpXMPPPingIntervalDefault)
+	gcpUploadTimeout, err := time.ParseDuration(config.GCPUploadTimeout)
 	if err != nil {
-		glog.Fatal(err)
+		glog.Fatalf("Failed to parse upload timeout: %s", err)
 	}
-
-	xmpp, err := xmpp.NewXMPP(config.XMPPJID, config.ProxyName, config.XMPPServer, config.XMPPPort, gcpXMPPPingTimeout, gcpXMPPPingIntervalDefault, gcp.GetRobotAccessToken)
+	printerPollInterval, err := time.ParseDuration(config.CUPSPrinterPollInterval)
 	if err != nil {
-		glog.Fatal(err)
+		glog.Fatalf("Failed to parse printer poll interval: %s", err)
+	}
+	printerStatePollInterval, err := time.ParseDuration(config.CUPSPrinterStatePollInterval)
+	if err != nil {
+		glog.Fatalf("Failed to parse printer state poll interval: %s", err)
+	}
+	gcpFallbackPollIntervalMin, err := time.ParseDuration(config.FallbackPollIntervalMin)
+	if err != nil {
+		glog.Fatalf("Failed to parse fallback poll interval min: %s", err)
+	}
+	gcpFallbackPollIntervalMax, err := time.ParseDuration(config.FallbackPollIntervalMax)
+	if err != nil {
+		glog.Fatalf("Failed to parse fallback poll interval max: %s", err)
+	}
+	gcpMaxJobAge, err := time.ParseDuration(config.GCPMaxJobAge)
+	if err != nil {
+		glog.Fatalf("Failed to parse max job age: %s", err)
+	}
+	printerProbeInterval, err := time.ParseDuration(config.PrinterProbeInterval)
+	if err != nil {
+		glog.Fatalf("Failed to parse printer probe interval: %s", err)
+	}
+	printerProbeTimeout, err := time.ParseDuration(config.PrinterProbeTimeout)
+	if err != nil {
+		glog.Fatalf("Failed to parse printer probe timeout: %s", err)
 	}
-	defer xmpp.Quit()
 
-	cups, err := cups.NewCUPS(config.CopyPrinterInfoToDisplayName, config.CUPSPrinterAttributes,
-		config.CUPSMaxConnections, cupsConnectTimeout, gcp.Translate)
+	tlsConfig, err := lib.NewTLSConfig(config.TLSCAFile, config.TLSPins)
 	if err != nil {
 		glog.Fatal(err)
 	}
-	defer cups.Quit()
+
+	accounts := config.Accounts()
+	var sharder *lib.Sharder
+	if len(accounts) > 1 {
+		glog.Infof("Sharding printers across %d GCP accounts, %d of them profiles", len(accounts), len(config.Profiles))
+		sharder, err = lib.NewSharder(accounts)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	gcps := make([]*gcp.GoogleCloudPrint, len(accounts))
+	xmpps := make([]*xmpp.XMPP, len(accounts))
+	pingIntervalFiles := make([]string, 0, len(accounts))
+	for i, account := range accounts {
+		pingIntervalFile := config.XMPPPingIntervalFile
+		if pingIntervalFile != "" && len(accounts) > 1 {
+			// One tuning per account.
+			pingIntervalFile = fmt.Sprintf("%s.%d", pingIntervalFile, i)
+		}
+		if pingIntervalFile != "" && config.XMPPPingIntervalAuto {
+			pingIntervalFiles = append(pingIntervalFiles, pingIntervalFile)
+		}
+
+		gcps[i], err = gcp.NewGoogleCloudPrint(config.GCPBaseURL, account.RobotRefreshToken, account.UserRefreshToken,
+			account.ProxyName, config.GCPOAuthClientID, config.GCPOAuthClientSecret,
+			config.GCPOAuthAuthURL, config.GCPOAuthTokenURL, config.GCPProxyURL, tlsConfig,
+			gcpXMPPPingIntervalDefault, gcpUploadTimeout, config.GCPCompressUploads, refreshTokenSaver(i, true), refreshTokenSaver(i, false))
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer gcps[i].Quit()
+
+		xmpps[i], err = xmpp.NewXMPP(account.XMPPJID, account.ProxyName, config.XMPPServer, config.XMPPPort, config.XMPPFallbackPort, config.XMPPServerHostname, config.XMPPCloudPrintJID, config.XMPPProxyURL, tlsConfig, gcpXMPPPingTimeout, gcpXMPPPingIntervalDefault, config.XMPPPingIntervalAuto, pingIntervalFile, gcps[i].GetRobotAccessToken)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer xmpps[i].Quit()
+	}
+
+	var backend manager.PrintBackend
+	if config.Backend == lib.BackendExec {
+		if config.ExecBackend == nil {
+			glog.Fatalf("Backend %s needs exec_backend", lib.BackendExec)
+		}
+		glog.Info("Printing with the exec backend")
+		backend, err = execbackend.NewExecBackend(*config.ExecBackend)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	} else {
+		if missing := lib.MissingCUPSPrinterAttributes(config); len(missing) > 0 {
+			glog.Fatalf("cups_printer_attributes lacks %s, which the config needs; run connector-util -update-config-file", strings.Join(missing, ", "))
+		}
+		translatePPD := gcps[0].Translate
+		if config.CUPSPPDTranslator == lib.PPDTranslatorLocal {
+			translatePPD = lib.TranslatePPD
+		}
+		c, err := cups.NewCUPS(config.CopyPrinterInfoToDisplayName, config.CUPSPrinterAttributes,
+			config.CUPSMaxConnections, cupsConnectTimeout, cupsTimeouts, config.CUPSPPDFetchWorkers, cupsPrinterFullFetchInterval, translatePPD)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer c.Quit()
+		backend = c
+	}
+
+	alert.Start(config.AlertCommand, config.AlertURL)
 
 	var snmpManager *snmp.SNMPManager
+	var snmpPollInterval time.Duration
 	if config.SNMPEnable {
 		glog.Info("SNMP enabled")
+		snmpPollInterval, err = time.ParseDuration(config.SNMPPollInterval)
+		if err != nil {
+			glog.Fatalf("Failed to parse snmp poll interval: %s", err)
+		}
 		snmpManager, err = snmp.NewSNMPManager(config.SNMPCommunity, config.SNMPMaxConnections)
 		if err != nil {
 			glog.Fatal(err)
@@ -90,39 +243,558 @@ func main() {
 		defer snmpManager.Quit()
 	}
 
-	pm, err := manager.NewPrinterManager(cups, gcp, xmpp, snmpManager, config.CUPSPrinterPollInterval,
-		config.GCPMaxConcurrentDownloads, config.CUPSJobQueueSize, config.CUPSJobFullUsername,
-		config.CUPSIgnoreRawPrinters, config.ShareScope)
+	var priv *privet.Privet
+	if config.LocalPrintingEnable {
+		glog.Info("Local printing enabled")
+		priv, err = privet.NewPrivet(config.GCPBaseURL, config.LocalPortLow, config.LocalPortHigh)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer priv.Quit()
+	}
+
+	var jobHistory *history.Store
+	if config.JobHistoryFile != "" {
+		jobHistory = history.NewStore(config.JobHistoryFile)
+	}
+
+	var auditLog *audit.Log
+	if config.AuditLogFile != "" {
+		auditLog, err = audit.Open(config.AuditLogFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer auditLog.Close()
+	}
+
+	// Printers are tagged with the host that runs the connector, to detect
+	// other connectors with the same proxy name.
+	instance, err := os.Hostname()
 	if err != nil {
+		glog.Fatalf("Failed to get the hostname: %s", err)
+	}
+
+	spool, err := lib.NewSpool(config.SpoolEncrypt, config.SpoolShred)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	// Directories whose group members printers are shared with; resolved as
+	// often as the most frequent of them asks.
+	var shareDirectories []directory.Resolver
+	var shareDirectoryInterval time.Duration
+	addShareDirectory := func(resolver directory.Resolver, option, refreshInterval string) {
+		interval, err := time.ParseDuration(refreshInterval)
+		if err != nil {
+			glog.Fatalf("Failed to parse %s refresh interval: %s", option, err)
+		}
+		if shareDirectoryInterval == 0 || interval < shareDirectoryInterval {
+			shareDirectoryInterval = interval
+		}
+		shareDirectories = append(shareDirectories, resolver)
+	}
+	if config.LDAPShare != nil {
+		l, err := directory.NewLDAP(config.LDAPShare)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		refreshInterval := config.LDAPShare.RefreshInterval
+		if refreshInterval == "" {
+			refreshInterval = lib.DefaultLDAPRefreshInterval
+		}
+		addShareDirectory(l, "ldap_share", refreshInterval)
+	}
+	if config.GoogleDirectoryShare != nil {
+		g, err := directory.NewGoogleDirectory(config.GoogleDirectoryShare)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		refreshInterval := config.GoogleDirectoryShare.RefreshInterval
+		if refreshInterval == "" {
+			refreshInterval = lib.DefaultGoogleDirectoryRefreshInterval
+		}
+		addShareDirectory(g, "google_directory_share", refreshInterval)
+	}
+	var shareDirectory directory.Resolver
+	if len(shareDirectories) > 0 {
+		shareDirectory = directory.Union(shareDirectories...)
+	}
+
+	printerCacheFiles := make([]string, len(accounts))
+	for i := range accounts {
+		printerCacheFiles[i] = config.GCPPrinterCacheFile
+		if printerCacheFiles[i] != "" && len(accounts) > 1 {
+			// One cache per account.
+			printerCacheFiles[i] = fmt.Sprintf("%s.%d", printerCacheFiles[i], i)
+		}
+	}
+
+	// Sockets that may need root are bound before root privileges are
+	// dropped, which happens before anything runs on behalf of jobs.
+	var healthListener, adminListener net.Listener
+	if config.HealthListenAddress != "" {
+		healthListener, err = net.Listen("tcp", config.HealthListenAddress)
+		if err != nil {
+			glog.Fatalf("Failed to listen for health checks on %s: %s", config.HealthListenAddress, err)
+		}
+	}
+	if config.AdminListenAddress != "" {
+		adminListener, err = net.Listen("tcp", config.AdminListenAddress)
+		if err != nil {
+			glog.Fatalf("Failed to listen for admin requests on %s: %s", config.AdminListenAddress, err)
+		}
+	}
+
+	if err = dropPrivileges(config, writableFiles(config, append(printerCacheFiles, pingIntervalFiles...))); err != nil {
 		glog.Fatal(err)
 	}
-	defer pm.Quit()
 
-	m, err := monitor.NewMonitor(cups, gcp, pm, config.MonitorSocketFilename)
+	pms := make([]*manager.PrinterManager, len(accounts))
+	for i, account := range accounts {
+		printerCacheFile := printerCacheFiles[i]
+		// Profiles are other tenants, whose printers aren't shared with the
+		// directory groups.
+		accountDirectory := shareDirectory
+		if account.Profile != "" {
+			accountDirectory = nil
+		}
+		pms[i], err = manager.NewPrinterManager(manager.Options{
+			Backend:                 backend,
+			GCP:                     gcps[i],
+			XMPP:                    xmpps[i],
+			SNMP:                    snmpManager,
+			Privet:                  priv,
+			Settings:                managerSettings(config, account, printerPollInterval, printerStatePollInterval, gcpMaxJobAge, printerProbeInterval, printerProbeTimeout),
+			AcceptInvites:           account.AcceptInvites,
+			FallbackPollIntervalMin: gcpFallbackPollIntervalMin,
+			FallbackPollIntervalMax: gcpFallbackPollIntervalMax,
+			PrinterCacheFile:        printerCacheFile,
+			Sharder:                 sharder,
+			Shard:                   i,
+			SNMPPollInterval:        snmpPollInterval,
+			SNMPPauseOnFault:        config.SNMPPauseOnFault,
+			JobHistory:              jobHistory,
+			AuditLog:                auditLog,
+			Instance:                instance,
+			RefuseProxyConflict:     config.ProxyConflictAction == lib.ProxyConflictRefuse,
+			Spool:                   spool,
+			QuarantineDir:           config.QuarantineDir,
+			QuarantineMaxJobs:       config.QuarantineMaxJobs,
+			Directory:               accountDirectory,
+			DirectoryInterval:       shareDirectoryInterval,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer pms[i].Quit()
+	}
+
+	if config.Backend != lib.BackendExec && len(config.CUPSWatchFiles) > 0 {
+		changes, err := lib.WatchFiles(config.CUPSWatchFiles)
+		if err != nil {
+			glog.Warningf("Printers will be synchronized every %s only: %s", config.CUPSPrinterPollInterval, err)
+		} else {
+			go func() {
+				for range changes {
+					glog.Info("CUPS configuration changed, synchronizing printers")
+					for _, pm := range pms {
+						pm.SyncPrintersSoon()
+					}
+				}
+			}()
+		}
+	}
+
+	if config.DiscoveryEnable {
+		c, ok := backend.(*cups.CUPS)
+		if !ok {
+			glog.Fatal("discovery_enable needs the CUPS backend")
+		}
+		discoveryInterval, err := time.ParseDuration(config.DiscoveryInterval)
+		if err != nil {
+			glog.Fatalf("Failed to parse discovery interval: %s", err)
+		}
+		var finder discovery.PrinterFinder
+		if len(config.DiscoveryNetworks) > 0 {
+			// Apart from snmpManager, which refuses concurrent queries, so
+			// that long sweeps don't hold up printer state polls.
+			s, err := snmp.NewSNMPManager(config.SNMPCommunity, config.SNMPMaxConnections)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			defer s.Quit()
+			finder = s
+		}
+		d, err := discovery.NewDiscovery(c, finder, config.DiscoveryNetworks, discoveryInterval, func() {
+			for _, pm := range pms {
+				pm.SyncPrintersSoon()
+			}
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer d.Quit()
+		glog.Info("Discovering printers on the local network")
+	}
+
+	m, err := monitor.NewMonitor(backend, gcps, pms, xmpps, config.MonitorSocketFilename)
 	if err != nil {
 		glog.Fatal(err)
 	}
 	defer m.Quit()
 
+	if healthListener != nil {
+		h := monitor.NewHealthServer(backend, gcps, pms, xmpps, healthListener)
+		defer h.Quit()
+		glog.Infof("Serving health checks on %s", config.HealthListenAddress)
+	}
+
+	if adminListener != nil {
+		a, err := admin.NewServer(pms, jobHistory, adminListener, config.AdminToken)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer a.Quit()
+		glog.Infof("Serving the admin API on %s", config.AdminListenAddress)
+	}
+
 	glog.Errorf("Ready to rock as proxy '%s'\n", config.ProxyName)
 	fmt.Printf("Ready to rock as proxy '%s'\n", config.ProxyName)
 
-	waitIndefinitely()
+	systemdQuit := make(chan struct{})
+	notifySystemd(pms, systemdQuit)
+
+	metricsQuit := make(chan struct{})
+	if err = startMetrics(config, backend, pms, xmpps, metricsQuit); err != nil {
+		glog.Fatal(err)
+	}
+
+	waitIndefinitely(func() {
+		config = reloadConfig(config, pms)
+	}, func() {
+		dumpState(pms)
+	})
+
+	close(systemdQuit)
+	close(metricsQuit)
+	metrics.Stop()
+	lib.SDNotify("STOPPING=1")
 
 	glog.Error("Shutting down")
 	fmt.Println("")
 	fmt.Println("Shutting down")
 }
 
-// Blocks until Ctrl-C or SIGTERM.
-func waitIndefinitely() {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
-	<-ch
+// refreshTokenSaver returns a function that writes a replaced refresh token
+// to the config file, for the robot or user credentials of the account'th
+// account (see lib.Config.Accounts).
+func refreshTokenSaver(account int, robot bool) gcp.RefreshTokenSaver {
+	return func(refreshToken string) error {
+		return lib.UpdateConfigFile(func(config *lib.Config) {
+			robotRefreshToken, userRefreshToken := &config.RobotRefreshToken, &config.UserRefreshToken
+			if account > 0 && account <= len(config.ShardAccounts) {
+				robotRefreshToken = &config.ShardAccounts[account-1].RobotRefreshToken
+				userRefreshToken = &config.ShardAccounts[account-1].UserRefreshToken
+			} else if p := account - 1 - len(config.ShardAccounts); p >= 0 && p < len(config.Profiles) {
+				robotRefreshToken = &config.Profiles[p].RobotRefreshToken
+				userRefreshToken = &config.Profiles[p].UserRefreshToken
+			}
+			if robot {
+				*robotRefreshToken = refreshToken
+			} else {
+				*userRefreshToken = refreshToken
+			}
+		})
+	}
+}
+
+// Config keys that reloadConfig applies without a restart.
+var reloadableConfigKeys = map[string]struct{}{
+	"cups_printer_poll_interval":       struct{}{},
+	"cups_printer_state_poll_interval": struct{}{},
+	"gcp_max_concurrent_downloads":     struct{}{},
+	"gcp_max_download_mb":              struct{}{},
+	"gcp_max_job_age":                  struct{}{},
+	"gcp_max_jobs_per_minute":          struct{}{},
+	"cups_job_queue_size":              struct{}{},
+	"cups_job_full_username":           struct{}{},
+	"cups_job_user":                    struct{}{},
+	"cups_job_accounting_owner":        struct{}{},
+	"cups_job_hold_until":              struct{}{},
+	"cups_ignore_raw_printers":         struct{}{},
+	"cups_shared_printers_only":        struct{}{},
+	"cups_stream_jobs":                 struct{}{},
+	"share_scope":                      struct{}{},
+	"share_scopes":                     struct{}{},
+	"printer_share_scopes":             struct{}{},
+	"share_role":                       struct{}{},
+	"share_revoke_unlisted":            struct{}{},
+	"printer_tags":                     struct{}{},
+	"printer_daily_quota":              struct{}{},
+	"alert_command":                    struct{}{},
+	"alert_url":                        struct{}{},
+	"alert_job_error_percent":          struct{}{},
+	"job_owner_allowlist":              struct{}{},
+	"job_owner_map":                    struct{}{},
+	"printer_probe_interval":           struct{}{},
+	"printer_probe_timeout":            struct{}{},
+}
+
+// parseCUPSTimeouts parses the CUPS request timeouts of config.
+func parseCUPSTimeouts(config *lib.Config) (cups.Timeouts, error) {
+	var t cups.Timeouts
+	for _, d := range []struct {
+		key   string
+		value string
+		t     *time.Duration
+	}{
+		{"cups_list_timeout", config.CUPSListTimeout, &t.List},
+		{"cups_ppd_timeout", config.CUPSPPDTimeout, &t.PPD},
+		{"cups_print_timeout", config.CUPSPrintTimeout, &t.Print},
+		{"cups_job_state_timeout", config.CUPSJobStateTimeout, &t.JobState},
+	} {
+		var err error
+		if *d.t, err = time.ParseDuration(d.value); err != nil {
+			return t, fmt.Errorf("Failed to parse %s: %s", d.key, err)
+		}
+	}
+	return t, nil
+}
+
+// managerSettings returns the PrinterManager settings of an account, from
+// config and the durations parsed from it.
+func managerSettings(config *lib.Config, account lib.ShardAccount, ppi, pspi, maxJobAge, probeInterval, probeTimeout time.Duration) manager.Settings {
+	return manager.Settings{
+		PrinterPollInterval:      ppi,
+		PrinterStatePollInterval: pspi,
+		GCPMaxConcurrentDownload: config.GCPMaxConcurrentDownloads,
+		CUPSQueueSize:            config.CUPSJobQueueSize,
+		JobFullUsername:          config.CUPSJobFullUsername,
+		IgnoreRawPrinters:        config.CUPSIgnoreRawPrinters,
+		SharedPrintersOnly:       config.CUPSSharedPrintersOnly,
+		StreamJobs:               config.CUPSStreamJobs,
+		ShareScopes:              account.AllShareScopes(),
+		PrinterShareScopes:       config.PrinterShareScopes,
+		ShareRole:                config.ShareRole,
+		ShareRevokeUnlisted:      config.ShareRevokeUnlisted,
+		PrinterTags:              config.PrinterTags,
+		PrinterDailyQuota:        config.PrinterDailyQuota,
+		AlertJobErrorPercent:     config.AlertJobErrorPercent,
+		JobOwnerAllowlist:        config.JobOwnerAllowlist,
+		JobOwnerMap:              config.JobOwnerMap,
+		JobUser:                  config.CUPSJobUser,
+		JobAccountingOwner:       config.CUPSJobAccountingOwner,
+		JobHoldUntil:             config.CUPSJobHoldUntil,
+		MaxDownloadMB:            config.GCPMaxDownloadMB,
+		MaxJobAge:                maxJobAge,
+		MaxJobsPerMinute:         config.GCPMaxJobsPerMinute,
+		ProbeInterval:            probeInterval,
+		ProbeTimeout:             probeTimeout,
+	}
+}
+
+// reloadConfig reads the config file again, and applies changes to the
+// reloadable settings to pms. Changes to other settings are logged; they
+// take effect after a restart. Returns the config that is in effect.
+func reloadConfig(running *lib.Config, pms []*manager.PrinterManager) *lib.Config {
+	config, err := lib.ConfigFromFile()
+	if err != nil {
+		glog.Errorf("Failed to reload config file: %s", err)
+		return running
+	}
+
+	// The connector writes replaced refresh tokens to the config file
+	// itself, so they are not changes.
+	current := *running
+	current.RobotRefreshToken, current.UserRefreshToken = config.RobotRefreshToken, config.UserRefreshToken
+	if len(current.ShardAccounts) == len(config.ShardAccounts) {
+		current.ShardAccounts = append([]lib.ShardAccount{}, running.ShardAccounts...)
+		for i := range current.ShardAccounts {
+			current.ShardAccounts[i].RobotRefreshToken = config.ShardAccounts[i].RobotRefreshToken
+			current.ShardAccounts[i].UserRefreshToken = config.ShardAccounts[i].UserRefreshToken
+		}
+	}
+	if len(current.Profiles) == len(config.Profiles) {
+		current.Profiles = append([]lib.Profile{}, running.Profiles...)
+		for i := range current.Profiles {
+			current.Profiles[i].RobotRefreshToken = config.Profiles[i].RobotRefreshToken
+			current.Profiles[i].UserRefreshToken = config.Profiles[i].UserRefreshToken
+		}
+	}
+
+	changed, err := changedConfigKeys(&current, config)
+	if err != nil {
+		glog.Errorf("Failed to reload config file: %s", err)
+		return running
+	}
+	if len(changed) == 0 {
+		glog.Info("Reloaded config file; nothing changed")
+		return &current
+	}
+
+	var applied, restart []string
+	for _, key := range changed {
+		if _, exists := reloadableConfigKeys[key]; exists {
+			applied = append(applied, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	if len(restart) > 0 {
+		glog.Warningf("Config changes to %s take effect after a restart", strings.Join(restart, ", "))
+	}
+	if len(applied) == 0 {
+		return &current
+	}
+
+	ppi, err := time.ParseDuration(config.CUPSPrinterPollInterval)
+	if err != nil {
+		glog.Errorf("Not reloading config file, failed to parse printer poll interval: %s", err)
+		return &current
+	}
+	pspi, err := time.ParseDuration(config.CUPSPrinterStatePollInterval)
+	if err != nil {
+		glog.Errorf("Not reloading config file, failed to parse printer state poll interval: %s", err)
+		return &current
+	}
+	maxJobAge, err := time.ParseDuration(config.GCPMaxJobAge)
+	if err != nil {
+		glog.Errorf("Not reloading config file, failed to parse max job age: %s", err)
+		return &current
+	}
+	probeInterval, err := time.ParseDuration(config.PrinterProbeInterval)
+	if err != nil {
+		glog.Errorf("Not reloading config file, failed to parse printer probe interval: %s", err)
+		return &current
+	}
+	probeTimeout, err := time.ParseDuration(config.PrinterProbeTimeout)
+	if err != nil {
+		glog.Errorf("Not reloading config file, failed to parse printer probe timeout: %s", err)
+		return &current
+	}
+
+	// Share scopes come from the accounts. When the accounts changed, which
+	// takes a restart, keep the running accounts' scopes.
+	next := current
+	next.ShareScope, next.ShareScopes = config.ShareScope, config.ShareScopes
+	if len(config.ShardAccounts) == len(current.ShardAccounts) {
+		next.ShardAccounts = append([]lib.ShardAccount{}, current.ShardAccounts...)
+		for i := range next.ShardAccounts {
+			next.ShardAccounts[i].ShareScope = config.ShardAccounts[i].ShareScope
+			next.ShardAccounts[i].ShareScopes = config.ShardAccounts[i].ShareScopes
+		}
+	}
+	if len(config.Profiles) == len(current.Profiles) {
+		next.Profiles = append([]lib.Profile{}, current.Profiles...)
+		for i := range next.Profiles {
+			next.Profiles[i].ShareScope = config.Profiles[i].ShareScope
+			next.Profiles[i].ShareScopes = config.Profiles[i].ShareScopes
+		}
+	}
+	next.CUPSPrinterPollInterval = config.CUPSPrinterPollInterval
+	next.CUPSPrinterStatePollInterval = config.CUPSPrinterStatePollInterval
+	next.GCPMaxConcurrentDownloads = config.GCPMaxConcurrentDownloads
+	next.GCPMaxDownloadMB = config.GCPMaxDownloadMB
+	next.GCPMaxJobAge = config.GCPMaxJobAge
+	next.GCPMaxJobsPerMinute = config.GCPMaxJobsPerMinute
+	next.CUPSJobQueueSize = config.CUPSJobQueueSize
+	next.CUPSJobFullUsername = config.CUPSJobFullUsername
+	next.CUPSJobUser = config.CUPSJobUser
+	next.CUPSJobAccountingOwner = config.CUPSJobAccountingOwner
+	next.CUPSJobHoldUntil = config.CUPSJobHoldUntil
+	next.CUPSIgnoreRawPrinters = config.CUPSIgnoreRawPrinters
+	next.CUPSSharedPrintersOnly = config.CUPSSharedPrintersOnly
+	next.CUPSStreamJobs = config.CUPSStreamJobs
+	next.PrinterShareScopes = config.PrinterShareScopes
+	next.ShareRole = config.ShareRole
+	next.ShareRevokeUnlisted = config.ShareRevokeUnlisted
+	next.PrinterTags = config.PrinterTags
+	next.PrinterDailyQuota = config.PrinterDailyQuota
+	next.AlertCommand = config.AlertCommand
+	next.AlertURL = config.AlertURL
+	next.AlertJobErrorPercent = config.AlertJobErrorPercent
+	next.JobOwnerAllowlist = config.JobOwnerAllowlist
+	next.JobOwnerMap = config.JobOwnerMap
+	next.PrinterProbeInterval = config.PrinterProbeInterval
+	next.PrinterProbeTimeout = config.PrinterProbeTimeout
+	if next.Backend != lib.BackendExec {
+		if missing := lib.MissingCUPSPrinterAttributes(&next); len(missing) > 0 {
+			glog.Errorf("Not reloading config file, cups_printer_attributes lacks %s, which the config needs", strings.Join(missing, ", "))
+			return &current
+		}
+	}
+
+	for i, account := range next.Accounts() {
+		if i >= len(pms) {
+			break
+		}
+		err := pms[i].Reconfigure(managerSettings(&next, account, ppi, pspi, maxJobAge, probeInterval, probeTimeout))
+		if err != nil {
+			glog.Errorf("Not reloading config file: %s", err)
+			return &current
+		}
+	}
+	alert.Start(next.AlertCommand, next.AlertURL)
+
+	glog.Infof("Reloaded config file; applied changes to %s", strings.Join(applied, ", "))
+	return &next
+}
+
+// changedConfigKeys returns the JSON keys of the settings that differ
+// between two configs, sorted.
+func changedConfigKeys(a, b *lib.Config) ([]string, error) {
+	var am, bm map[string]json.RawMessage
+	for _, c := range []struct {
+		config *lib.Config
+		m      *map[string]json.RawMessage
+	}{{a, &am}, {b, &bm}} {
+		j, err := json.Marshal(c.config)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(j, c.m); err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []string
+	for key, value := range am {
+		if string(value) != string(bm[key]) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range bm {
+		if _, exists := am[key]; !exists {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Blocks until Ctrl-C or SIGTERM. Calls reload on SIGHUP, and dump on SIGUSR1.
+func waitIndefinitely(reload, dump func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range ch {
+		if sig == syscall.SIGHUP {
+			glog.Info("SIGHUP received; reloading config file")
+			reload()
+		} else if sig == syscall.SIGUSR1 {
+			glog.Info("SIGUSR1 received; dumping internal state")
+			dump()
+		} else {
+			break
+		}
+	}
 
 	go func() {
 		// In case the process doesn't die very quickly, wait for a second termination request.
-		<-ch
+		for sig := range ch {
+			if sig != syscall.SIGHUP && sig != syscall.SIGUSR1 {
+				break
+			}
+		}
 		fmt.Println("Second termination request received")
 		os.Exit(1)
 	}()
@@ -0,0 +1,82 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	pidFileFlag = flag.String(
+		"pid-file", "",
+		"Write the connector's process ID to this file, and remove it at shutdown")
+	foregroundFlag = flag.Bool(
+		"foreground", true,
+		"Stay in the foreground, for supervisors like systemd; false detaches from the terminal")
+)
+
+// Set in the environment of the process that runs in the background, so
+// that it doesn't detach again.
+const backgroundEnv = "CUPS_CONNECTOR_DETACHED"
+
+// runInBackground starts this program again, detached from the terminal in
+// a new session, and exits. Does nothing in the detached process.
+func runInBackground() {
+	if os.Getenv(backgroundEnv) != "" {
+		return
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Printf("Failed to open %s: %s\n", os.DevNull, err)
+		os.Exit(1)
+	}
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), backgroundEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = cmd.Start(); err != nil {
+		fmt.Printf("Failed to start in the background: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Started in the background as process %d\n", cmd.Process.Pid)
+	os.Exit(0)
+}
+
+// writePIDFile writes this process's ID to filename. Fails when the file
+// names another process that is running; a file left by a process that
+// died is replaced.
+func writePIDFile(filename string) error {
+	if b, err := ioutil.ReadFile(filename); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && pid != os.Getpid() && syscall.Kill(pid, 0) == nil {
+			return fmt.Errorf("A connector is already running as process %d, according to PID file %s", pid, filename)
+		}
+		os.Remove(filename)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read PID file %s: %s", filename, err)
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create PID file: %s", err)
+	}
+	if _, err = fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to write PID file: %s", err)
+	}
+	return f.Close()
+}
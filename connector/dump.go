@@ -0,0 +1,60 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/cups-connector/manager"
+)
+
+// dumpState writes the internal state of the printer managers, and the
+// stacks of all goroutines, to a file in the temporary directory, to debug
+// a connector that appears hung.
+func dumpState(pms []*manager.PrinterManager) {
+	filename := filepath.Join(os.TempDir(),
+		fmt.Sprintf("cups-connector-state.%d.%s.txt", os.Getpid(), time.Now().Format("20060102-150405")))
+	f, err := os.Create(filename)
+	if err != nil {
+		glog.Errorf("Failed to dump internal state: %s", err)
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "Internal state at %s\n", time.Now().Format(time.RFC3339))
+	for i, pm := range pms {
+		fmt.Fprintf(w, "\n=== Printer manager %d ===\n", i)
+		pm.DumpState(w)
+	}
+
+	// runtime.Stack truncates to the buffer; grow it until everything fits.
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	fmt.Fprintf(w, "\n=== %d goroutines ===\n", runtime.NumGoroutine())
+	w.Write(buf)
+
+	if err = w.Flush(); err != nil {
+		glog.Errorf("Failed to dump internal state: %s", err)
+		return
+	}
+	glog.Infof("Dumped internal state to %s", filename)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/manager"
+	"github.com/google/cups-connector/metrics"
+	"github.com/google/cups-connector/xmpp"
+)
+
+// startMetrics sends metrics to the exporters in config, and samples gauges
+// every metrics interval until quit is closed. Does nothing when no
+// exporter is configured. Call metrics.Stop to send what's left.
+func startMetrics(config *lib.Config, backend manager.PrintBackend, pms []*manager.PrinterManager, xmpps []*xmpp.XMPP, quit <-chan struct{}) error {
+	if config.MetricsStatsDAddress == "" && config.MetricsOTLPEndpoint == "" {
+		return nil
+	}
+
+	interval, err := time.ParseDuration(config.MetricsInterval)
+	if err != nil {
+		return fmt.Errorf("Failed to parse metrics interval: %s", err)
+	}
+
+	var exporters []metrics.Exporter
+	if config.MetricsStatsDAddress != "" {
+		e, err := metrics.NewStatsDExporter(config.MetricsStatsDAddress)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, e)
+		glog.Infof("Sending metrics to StatsD at %s", config.MetricsStatsDAddress)
+	}
+	if config.MetricsOTLPEndpoint != "" {
+		e, err := metrics.NewOTLPExporter(config.MetricsOTLPEndpoint, interval)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, e)
+		glog.Infof("Sending metrics to the OpenTelemetry collector at %s", config.MetricsOTLPEndpoint)
+	}
+	metrics.Start(config.MetricsPrefix, exporters...)
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			sampleGauges(backend, pms, xmpps)
+			select {
+			case <-t.C:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// sampleGauges sends the gauges, which describe the connector's state
+// rather than events.
+func sampleGauges(backend manager.PrintBackend, pms []*manager.PrinterManager, xmpps []*xmpp.XMPP) {
+	if c, ok := backend.(manager.ConnectionCounter); ok {
+		metrics.Gauge("cups.connections", float64(c.ConnQtyOpen()), nil)
+	}
+
+	for i, pm := range pms {
+		account := metrics.Tags{"account": fmt.Sprint(i)}
+		metrics.Gauge("printers", float64(len(pm.Printers())), account)
+		metrics.Gauge("jobs.in_flight", float64(len(pm.InFlightJobs())), account)
+		metrics.Gauge("jobs.downloading", float64(pm.GetDownloadStats().Downloads), account)
+
+		var connected float64
+		if xmpps[i].Health().Connected {
+			connected = 1
+		}
+		metrics.Gauge("xmpp.connected", connected, account)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// Modes of access(2).
+const (
+	accessExecute = 1
+	accessWrite   = 2
+)
+
+// dropPrivileges switches to run_as_user and run_as_group for good, once
+// the connector has done what needs root, like binding sockets. Files that
+// the connector keeps writing, which it may have created as root, are given
+// to the user first; returns an error when the user can't write them, or
+// the directories that they are in. files are named by writableFiles.
+func dropPrivileges(config *lib.Config, files []string) error {
+	if config.RunAsUser == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupUserGroup(config.RunAsUser, config.RunAsGroup)
+	if err != nil {
+		return err
+	}
+	if os.Getuid() != 0 {
+		if os.Getuid() == uid {
+			return nil
+		}
+		return fmt.Errorf("The connector must start as root to run as %s", config.RunAsUser)
+	}
+
+	for _, file := range files {
+		// Directories, like /tmp, are left alone.
+		if fi, err := os.Lstat(file); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Chown(file, uid, gid); err != nil {
+			return fmt.Errorf("Failed to give %s to %s: %s", file, config.RunAsUser, err)
+		}
+	}
+
+	// Groups first, while still root.
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("Failed to set groups: %s", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("Failed to set group ID %d: %s", gid, err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("Failed to set user ID %d: %s", uid, err)
+	}
+	if syscall.Setuid(0) == nil {
+		return fmt.Errorf("Failed to drop root privileges for good")
+	}
+	glog.Infof("Running as user %s, user ID %d, group ID %d", config.RunAsUser, uid, gid)
+
+	var problems []string
+	for _, file := range files {
+		if err := checkWritable(file); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("As %s, %s", config.RunAsUser, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// lookupUserGroup returns the IDs of a user, and of a group, or the user's
+// primary group when group is empty.
+func lookupUserGroup(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidString := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidString = g.Gid
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// writableFiles returns the files that the connector keeps writing, and the
+// directories that it creates files in, as they are named in config, and
+// accountFiles, the files that are kept per account.
+func writableFiles(config *lib.Config, accountFiles []string) []string {
+	files := []string{*lib.ConfigFilename, os.TempDir(), config.MonitorSocketFilename}
+	if f := flag.Lookup("log_dir"); f != nil && f.Value.String() != "" {
+		files = append(files, f.Value.String())
+	}
+	if *pidFileFlag != "" {
+		files = append(files, *pidFileFlag)
+	}
+	for _, file := range append([]string{config.JobHistoryFile, config.AuditLogFile, config.QuarantineDir}, accountFiles...) {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// checkWritable checks that a file, if it exists, and its directory, are
+// writable, so that it can be replaced or removed.
+func checkWritable(file string) error {
+	if fi, err := os.Lstat(file); err == nil && fi.Mode().IsRegular() {
+		if err = syscall.Access(file, accessWrite); err != nil {
+			return fmt.Errorf("%s isn't writable", file)
+		}
+	}
+	if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+		if err = syscall.Access(file, accessWrite|accessExecute); err != nil {
+			return fmt.Errorf("directory %s isn't writable", file)
+		}
+		return nil
+	}
+	dir := filepath.Dir(file)
+	if err := syscall.Access(dir, accessWrite|accessExecute); err != nil {
+		return fmt.Errorf("directory %s isn't writable", dir)
+	}
+	return nil
+}
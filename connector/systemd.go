@@ -0,0 +1,116 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/manager"
+)
+
+// How often to check whether printers are synchronized, before READY=1.
+const readyCheckInterval = time.Second
+
+// How often to send job counts in STATUS= notifications.
+const statusInterval = 30 * time.Second
+
+// notifySystemd tells systemd that the connector is ready once each printer
+// manager has synchronized printers, then sends job counts, and pets the
+// watchdog while the managers' loops are alive. It does nothing when the
+// connector does not run as a Type=notify service.
+func notifySystemd(pms []*manager.PrinterManager, quit <-chan struct{}) {
+	go func() {
+		t := time.NewTicker(readyCheckInterval)
+		defer t.Stop()
+
+		for !printersSynced(pms) {
+			select {
+			case <-t.C:
+			case <-quit:
+				return
+			}
+		}
+		if err := lib.SDNotify("READY=1\nSTATUS=" + jobStatus(pms)); err != nil {
+			glog.Warning(err)
+		}
+
+		t = time.NewTicker(statusInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := lib.SDNotify("STATUS=" + jobStatus(pms)); err != nil {
+					glog.Warning(err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	interval := lib.SDWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	glog.Infof("Notifying the systemd watchdog every %s", (interval / 2).String())
+	go func() {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				if !printerManagersAlive(pms, interval) {
+					// Let systemd restart the connector.
+					continue
+				}
+				if err := lib.SDNotify("WATCHDOG=1"); err != nil {
+					glog.Warning(err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+// printersSynced returns true when each printer manager has synchronized
+// printers successfully at least once.
+func printersSynced(pms []*manager.PrinterManager) bool {
+	for _, pm := range pms {
+		if pm.SyncStatus().LastSuccess.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+func printerManagersAlive(pms []*manager.PrinterManager, maxAge time.Duration) bool {
+	for _, pm := range pms {
+		if !pm.Alive(maxAge) {
+			return false
+		}
+	}
+	return true
+}
+
+// jobStatus summarizes the job counts of the printer managers.
+func jobStatus(pms []*manager.PrinterManager) string {
+	var done, errored, inProgress uint
+	for _, pm := range pms {
+		d, e, p, err := pm.GetJobStats()
+		if err != nil {
+			continue
+		}
+		done, errored, inProgress = done+d, errored+e, inProgress+p
+	}
+	return fmt.Sprintf("%d jobs done, %d errored, %d in progress", done, errored, inProgress)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/google/cups-connector/cups"
+	"github.com/google/cups-connector/gcp"
+	"github.com/google/cups-connector/lib"
+)
+
+var validateConfigFlag = flag.Bool(
+	"validate-config", false,
+	"Check the config file, CUPS and GCP, then exit without starting the connector")
+
+// validateConfig checks the config file, then tries CUPS and each GCP
+// account with it, printing a diagnostic for each problem found. Returns
+// the number of problems.
+func validateConfig() int {
+	fmt.Printf("Validating config file %s\n", *lib.ConfigFilename)
+
+	configMap, err := lib.ConfigMapFromFile()
+	if err != nil {
+		fmt.Printf("  Failed to read config file: %s\n", err)
+		return 1
+	}
+	config, err := lib.ConfigFromFile()
+	if err != nil {
+		fmt.Printf("  Failed to read config file: %s\n", err)
+		return 1
+	}
+
+	problems := lib.ValidateConfig(config, configMap)
+	for _, problem := range problems {
+		fmt.Printf("  %s\n", problem)
+	}
+	if len(problems) > 0 {
+		// The online checks would fail for the same reasons.
+		return len(problems)
+	}
+
+	if config.Backend == lib.BackendExec {
+		fmt.Println("Finding exec backend executables")
+		b := config.ExecBackend
+		for _, command := range []string{b.ListPrinters, b.Capabilities, b.Print, b.JobState, b.CancelJob} {
+			if _, err := exec.LookPath(command); err != nil {
+				fmt.Printf("  %s\n", err)
+				problems = append(problems, err.Error())
+			}
+		}
+	} else {
+		cupsConnectTimeout, _ := time.ParseDuration(config.CUPSConnectTimeout)
+		cupsTimeouts, _ := parseCUPSTimeouts(config)
+		cupsPrinterFullFetchInterval, _ := time.ParseDuration(config.CUPSPrinterFullFetchInterval)
+		fmt.Println("Connecting to CUPS")
+		if c, err := cups.NewCUPS(config.CopyPrinterInfoToDisplayName, config.CUPSPrinterAttributes,
+			config.CUPSMaxConnections, cupsConnectTimeout, cupsTimeouts, config.CUPSPPDFetchWorkers, cupsPrinterFullFetchInterval, nil); err != nil {
+			fmt.Printf("  %s; check cups_printer_attributes\n", err)
+			problems = append(problems, err.Error())
+		} else {
+			if states, err := c.GetPrinterStates(); err != nil {
+				fmt.Printf("  Failed to list CUPS printers: %s; check that CUPS is running and that cups_connect_timeout is long enough\n", err)
+				problems = append(problems, err.Error())
+			} else {
+				fmt.Printf("  Found %d CUPS printers\n", len(states))
+			}
+			c.Quit()
+		}
+	}
+
+	tlsConfig, _ := lib.NewTLSConfig(config.TLSCAFile, config.TLSPins)
+	pingIntervalDefault, _ := time.ParseDuration(config.XMPPPingIntervalDefault)
+	uploadTimeout, _ := time.ParseDuration(config.GCPUploadTimeout)
+	for _, account := range config.Accounts() {
+		fmt.Printf("Connecting to GCP as %s\n", account.XMPPJID)
+		// No savers: validation doesn't write the config file.
+		g, err := gcp.NewGoogleCloudPrint(config.GCPBaseURL, account.RobotRefreshToken, account.UserRefreshToken,
+			account.ProxyName, config.GCPOAuthClientID, config.GCPOAuthClientSecret,
+			config.GCPOAuthAuthURL, config.GCPOAuthTokenURL, config.GCPProxyURL, tlsConfig,
+			pingIntervalDefault, uploadTimeout, config.GCPCompressUploads, nil, nil)
+		if err != nil {
+			fmt.Printf("  %s\n", err)
+			problems = append(problems, err.Error())
+			continue
+		}
+		if printers, err := g.List(); err != nil {
+			fmt.Printf("  Failed to list GCP printers: %s; check gcp_base_url, gcp_proxy_url and the refresh tokens, or run connector-init again\n", err)
+			problems = append(problems, err.Error())
+		} else {
+			fmt.Printf("  Found %d GCP printers registered to proxy %s\n", len(printers), account.ProxyName)
+		}
+		g.Quit()
+	}
+
+	return len(problems)
+}
@@ -60,6 +60,12 @@ func CreateTempFile() (*os.File, error) {
 	return os.NewFile(uintptr(fd), C.GoString(filename)), nil
 }
 
+// CreateTempFile creates a file that CUPS can read, like the function
+// CreateTempFile.
+func (c *CUPS) CreateTempFile() (*os.File, error) {
+	return CreateTempFile()
+}
+
 // uname returns strings similar to the Unix uname command:
 // sysname, nodename, release, version, machine
 func uname() (string, string, string, string, string, error) {
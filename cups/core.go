@@ -9,7 +9,10 @@ package cups
 
 /*
 #cgo LDFLAGS: -lcups
+#cgo freebsd openbsd CFLAGS: -I/usr/local/include
+#cgo freebsd openbsd LDFLAGS: -L/usr/local/lib
 #include <cups/cups.h>
+#include <errno.h>      // ETIMEDOUT
 #include <stddef.h>     // size_t
 #include <stdlib.h>     // free, malloc
 #include <sys/socket.h> // AF_UNSPEC
@@ -20,6 +23,7 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"strings"
@@ -35,6 +39,18 @@ const (
 	// jobURIFormat is the string format required by the CUPS API
 	// to do things like query the state of a job.
 	jobURIFormat = "/jobs/%d"
+
+	// printerURIFormat is the string format required by the CUPS API
+	// to do things like query the attributes of a printer.
+	printerURIFormat = "/printers/%s"
+
+	// When cupsd restarts, it takes a few seconds to accept connections.
+	// Try to connect this many times before giving up.
+	connectMaxAttempts = 4
+
+	// Wait this long after the first failed connection attempt, then
+	// double the wait after each subsequent failure.
+	connectRetryBackoff = time.Second
 )
 
 // cupsCore handles CUPS API interaction and connection management.
@@ -48,9 +64,10 @@ type cupsCore struct {
 	// connectionPool allows a connection to be reused instead of closed.
 	connectionPool chan *C.http_t
 	hostIsLocal    bool
+	timeouts       Timeouts
 }
 
-func newCUPSCore(maxConnections uint, connectTimeout time.Duration) (*cupsCore, error) {
+func newCUPSCore(maxConnections uint, connectTimeout time.Duration, timeouts Timeouts) (*cupsCore, error) {
 	host := C.cupsServer()
 	port := C.ippPort()
 	encryption := C.cupsEncryption()
@@ -79,11 +96,11 @@ func newCUPSCore(maxConnections uint, connectTimeout time.Duration) (*cupsCore,
 	cs := lib.NewSemaphore(maxConnections)
 	cp := make(chan *C.http_t)
 
-	cc := &cupsCore{host, port, encryption, timeout, cs, cp, hostIsLocal}
+	cc := &cupsCore{host, port, encryption, timeout, cs, cp, hostIsLocal, timeouts}
 
 	// This connection isn't used, just checks that a connection is possible
 	// before returning from the constructor.
-	http, err := cc.connect()
+	http, err := cc.connect(timeouts.List)
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +115,7 @@ func newCUPSCore(maxConnections uint, connectTimeout time.Duration) (*cupsCore,
 // Returns the CUPS job ID, which is 0 (and meaningless) when err
 // is not nil.
 func (cc *cupsCore) printFile(user, printername, filename, title *C.char, numOptions C.int, options *C.cups_option_t) (C.int, error) {
-	http, err := cc.connect()
+	http, err := cc.connect(cc.timeouts.Print)
 	if err != nil {
 		return 0, err
 	}
@@ -107,6 +124,10 @@ func (cc *cupsCore) printFile(user, printername, filename, title *C.char, numOpt
 	C.cupsSetUser(user)
 	jobID := C.cupsPrintFile2(http, printername, filename, title, numOptions, options)
 	if jobID == 0 {
+		if C.cupsLastError() == C.IPP_STATUS_ERROR_SERVICE_UNAVAILABLE {
+			return 0, &lib.UnreachableError{Message: fmt.Sprintf("Failed to call cupsPrintFile2(); CUPS server unreachable: %s",
+				C.GoString(C.cupsLastErrorString()))}
+		}
 		return 0, fmt.Errorf("Failed to call cupsPrintFile2(): %d %s",
 			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
 	}
@@ -114,6 +135,162 @@ func (cc *cupsCore) printFile(user, printername, filename, title *C.char, numOpt
 	return jobID, nil
 }
 
+// printFiles prints several documents as one job by calling
+// C.cupsPrintFiles2().
+// Returns the CUPS job ID, which is 0 (and meaningless) when err
+// is not nil.
+func (cc *cupsCore) printFiles(user, printername *C.char, numFiles C.int, filenames **C.char, title *C.char, numOptions C.int, options *C.cups_option_t) (C.int, error) {
+	http, err := cc.connect(cc.timeouts.Print)
+	if err != nil {
+		return 0, err
+	}
+	defer cc.disconnect(http)
+
+	C.cupsSetUser(user)
+	jobID := C.cupsPrintFiles2(http, printername, numFiles, filenames, title, numOptions, options)
+	if jobID == 0 {
+		if C.cupsLastError() == C.IPP_STATUS_ERROR_SERVICE_UNAVAILABLE {
+			return 0, &lib.UnreachableError{Message: fmt.Sprintf("Failed to call cupsPrintFiles2(); CUPS server unreachable: %s",
+				C.GoString(C.cupsLastErrorString()))}
+		}
+		return 0, fmt.Errorf("Failed to call cupsPrintFiles2(): %d %s",
+			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+	}
+
+	return jobID, nil
+}
+
+// printStream prints by calling C.cupsCreateJob(), then streams the
+// document to CUPS with C.cupsStartDocument(). write is called to
+// write the document to CUPS. format is the document's MIME type, or nil
+// to let CUPS detect it.
+//
+// Returns the CUPS job ID, which is 0 (and meaningless) when err
+// is not nil. Returns a *lib.StreamUnsupportedError, before write is called,
+// if the CUPS server does not support streaming.
+func (cc *cupsCore) printStream(user, printername, title, format *C.char, numOptions C.int, options *C.cups_option_t, write func(io.Writer) error) (C.int, error) {
+	http, err := cc.connect(cc.timeouts.Print)
+	if err != nil {
+		return 0, err
+	}
+
+	C.cupsSetUser(user)
+	jobID := C.cupsCreateJob(http, printername, title, numOptions, options)
+	if jobID == 0 {
+		switch C.cupsLastError() {
+		case C.IPP_STATUS_ERROR_SERVICE_UNAVAILABLE:
+			err = &lib.UnreachableError{Message: fmt.Sprintf("Failed to call cupsCreateJob(); CUPS server unreachable: %s",
+				C.GoString(C.cupsLastErrorString()))}
+		case C.IPP_STATUS_ERROR_OPERATION_NOT_SUPPORTED:
+			err = &lib.StreamUnsupportedError{Message: fmt.Sprintf("Failed to call cupsCreateJob(); streaming not supported: %s",
+				C.GoString(C.cupsLastErrorString()))}
+		default:
+			err = fmt.Errorf("Failed to call cupsCreateJob(): %d %s",
+				int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		}
+		cc.disconnect(http)
+		return 0, err
+	}
+
+	if format == nil {
+		format = C.DOCUMENT_FORMAT_AUTO
+	}
+	if C.cupsStartDocument(http, printername, jobID, nil, format, 1) != C.HTTP_STATUS_CONTINUE {
+		err = fmt.Errorf("Failed to call cupsStartDocument(): %d %s",
+			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		C.cupsCancelJob2(http, printername, jobID, 0)
+		cc.disconnect(http)
+		return 0, err
+	}
+
+	if err = write(&requestDataWriter{http}); err != nil {
+		// Drop the connection mid-request, so that CUPS never prints a
+		// partial document, then cancel the job on a new connection.
+		C.httpClose(http)
+		cc.disconnect(nil)
+		if cancelErr := cc.cancelJob(user, printername, jobID); cancelErr != nil {
+			glog.Warning(cancelErr)
+		}
+		return 0, err
+	}
+
+	if C.cupsFinishDocument(http, printername) != C.IPP_STATUS_OK {
+		err = fmt.Errorf("Failed to call cupsFinishDocument(): %d %s",
+			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		cc.disconnect(http)
+		return 0, err
+	}
+
+	cc.disconnect(http)
+	return jobID, nil
+}
+
+// requestDataWriter writes the body of an open CUPS request by calling
+// C.cupsWriteRequestData().
+type requestDataWriter struct {
+	http *C.http_t
+}
+
+func (w *requestDataWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if C.cupsWriteRequestData(w.http, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p))) != C.HTTP_STATUS_CONTINUE {
+		return 0, fmt.Errorf("Failed to call cupsWriteRequestData(): %d %s",
+			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+	}
+	return len(p), nil
+}
+
+// cancelJob cancels a CUPS job by calling C.cupsCancelJob2().
+func (cc *cupsCore) cancelJob(user, printername *C.char, jobID C.int) error {
+	http, err := cc.connect(cc.timeouts.JobState)
+	if err != nil {
+		return fmt.Errorf("Failed to cancel CUPS job %d: %s", int(jobID), err)
+	}
+	defer cc.disconnect(http)
+
+	C.cupsSetUser(user)
+	if C.cupsCancelJob2(http, printername, jobID, 0) != C.IPP_STATUS_OK {
+		return fmt.Errorf("Failed to cancel CUPS job %d: %d %s", int(jobID),
+			int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+	}
+	return nil
+}
+
+// addPrinter adds a printer, or modifies the printer with the same name, by
+// calling C.doRequest (IPP_OP_CUPS_ADD_MODIFY_PRINTER). The printer is
+// enabled and accepts jobs. CUPS generates its PPD from the printer itself
+// when ppdName is "everywhere".
+func (cc *cupsCore) addPrinter(printername, deviceURI, ppdName, info, location *C.char) error {
+	uri, err := createPrinterURI(printername)
+	if err != nil {
+		return err
+	}
+	defer C.free(unsafe.Pointer(uri))
+
+	// ippNewRequest() returns ipp_t pointer which does not need explicit free.
+	request := C.ippNewRequest(C.IPP_OP_CUPS_ADD_MODIFY_PRINTER)
+	C.ippAddString(request, C.IPP_TAG_OPERATION, C.IPP_TAG_URI, C.PRINTER_URI_ATTRIBUTE, nil, uri)
+	C.ippAddString(request, C.IPP_TAG_PRINTER, C.IPP_TAG_URI, C.DEVICE_URI_ATTRIBUTE, nil, deviceURI)
+	C.ippAddString(request, C.IPP_TAG_OPERATION, C.IPP_TAG_NAME, C.PPD_NAME_ATTRIBUTE, nil, ppdName)
+	C.ippAddString(request, C.IPP_TAG_PRINTER, C.IPP_TAG_TEXT, C.PRINTER_INFO_ATTRIBUTE, nil, info)
+	C.ippAddString(request, C.IPP_TAG_PRINTER, C.IPP_TAG_TEXT, C.PRINTER_LOCATION_ATTRIBUTE, nil, location)
+	C.ippAddBoolean(request, C.IPP_TAG_PRINTER, C.ACCEPTING_JOBS_ATTRIBUTE, 1)
+	C.ippAddInteger(request, C.IPP_TAG_PRINTER, C.IPP_TAG_ENUM, C.PRINTER_STATE_ATTRIBUTE, C.IPP_PSTATE_IDLE)
+
+	response, err := cc.doRequest(request, cc.timeouts.PPD, []C.ipp_status_t{C.IPP_STATUS_OK})
+	if _, ok := err.(*lib.UnreachableError); ok {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_CUPS_ADD_MODIFY_PRINTER]: %s", err)
+	}
+
+	// cupsDoRequest() returns ipp_t pointer which needs explicit free.
+	C.ippDelete(response)
+	return nil
+}
+
 // getPrinters gets the current list and state of printers by calling
 // C.doRequest (IPP_OP_CUPS_GET_PRINTERS).
 //
@@ -124,9 +301,11 @@ func (cc *cupsCore) getPrinters(attributes **C.char, attrSize C.int) (*C.ipp_t,
 	C.ippAddStrings(request, C.IPP_TAG_OPERATION, C.IPP_TAG_KEYWORD, C.REQUESTED_ATTRIBUTES,
 		attrSize, nil, attributes)
 
-	response, err := cc.doRequest(request,
+	response, err := cc.doRequest(request, cc.timeouts.List,
 		[]C.ipp_status_t{C.IPP_STATUS_OK, C.IPP_STATUS_ERROR_NOT_FOUND})
-	if err != nil {
+	if _, ok := err.(*lib.UnreachableError); ok {
+		return nil, err
+	} else if err != nil {
 		err = fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_CUPS_GET_PRINTERS]: %s", err)
 		return nil, err
 	}
@@ -134,6 +313,34 @@ func (cc *cupsCore) getPrinters(attributes **C.char, attrSize C.int) (*C.ipp_t,
 	return response, nil
 }
 
+// getPrinterAttributes gets the requested attributes of one printer by
+// calling C.doRequest (IPP_OP_GET_PRINTER_ATTRIBUTES).
+//
+// The caller is responsible to C.ippDelete the returned *C.ipp_t response.
+func (cc *cupsCore) getPrinterAttributes(printername *C.char, attributes **C.char, attrSize C.int) (*C.ipp_t, error) {
+	uri, err := createPrinterURI(printername)
+	if err != nil {
+		return nil, err
+	}
+	defer C.free(unsafe.Pointer(uri))
+
+	// ippNewRequest() returns ipp_t pointer which does not need explicit free.
+	request := C.ippNewRequest(C.IPP_OP_GET_PRINTER_ATTRIBUTES)
+	C.ippAddString(request, C.IPP_TAG_OPERATION, C.IPP_TAG_URI, C.PRINTER_URI_ATTRIBUTE, nil, uri)
+	C.ippAddStrings(request, C.IPP_TAG_OPERATION, C.IPP_TAG_KEYWORD, C.REQUESTED_ATTRIBUTES,
+		attrSize, nil, attributes)
+
+	response, err := cc.doRequest(request, cc.timeouts.List, []C.ipp_status_t{C.IPP_STATUS_OK})
+	if _, ok := err.(*lib.UnreachableError); ok {
+		return nil, err
+	} else if err != nil {
+		err = fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_GET_PRINTER_ATTRIBUTES]: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
 // getPPD gets the filename of the PPD for a printer by calling
 // C.cupsGetPPD3. If the PPD hasn't changed since the time indicated
 // by modtime, then the returned filename is a nil pointer.
@@ -157,7 +364,7 @@ func (cc *cupsCore) getPPD(printername *C.char, modtime *C.time_t) (*C.char, err
 		// is on the local filesystem.
 		// Still need OS thread lock; see else.
 		var err error
-		http, err = cc.connect()
+		http, err = cc.connect(cc.timeouts.PPD)
 		if err != nil {
 			return nil, err
 		}
@@ -218,8 +425,10 @@ func (cc *cupsCore) getJobAttributes(jobID C.int, attributes **C.char) (*C.ipp_t
 	C.ippAddStrings(request, C.IPP_TAG_OPERATION, C.IPP_TAG_KEYWORD, C.REQUESTED_ATTRIBUTES,
 		C.int(0), nil, attributes)
 
-	response, err := cc.doRequest(request, []C.ipp_status_t{C.IPP_STATUS_OK})
-	if err != nil {
+	response, err := cc.doRequest(request, cc.timeouts.JobState, []C.ipp_status_t{C.IPP_STATUS_OK})
+	if _, ok := err.(*lib.UnreachableError); ok {
+		return nil, err
+	} else if err != nil {
 		err = fmt.Errorf("Failed to call cupsDoRequest() [IPP_OP_GET_JOB_ATTRIBUTES]: %s", err)
 		return nil, err
 	}
@@ -244,22 +453,57 @@ func createJobURI(jobID C.int) (*C.char, error) {
 	return uri, nil
 }
 
-// doRequest calls cupsDoRequest().
-func (cc *cupsCore) doRequest(request *C.ipp_t, acceptableStatusCodes []C.ipp_status_t) (*C.ipp_t, error) {
-	http, err := cc.connect()
+// createPrinterURI creates a uri string for the printer-uri attribute, used
+// to get the attributes of a CUPS printer.
+func createPrinterURI(printername *C.char) (*C.char, error) {
+	name := C.GoString(printername)
+	// Each byte of the name may be percent-encoded.
+	length := C.size_t(urlMaxLength + 3*len(name))
+	uri := (*C.char)(C.malloc(length))
+	if uri == nil {
+		return nil, errors.New("Failed to malloc; out of memory?")
+	}
+
+	resource := C.CString(fmt.Sprintf(printerURIFormat, name))
+	defer C.free(unsafe.Pointer(resource))
+	C.httpAssembleURI(C.HTTP_URI_CODING_ALL,
+		uri, C.int(length), C.IPP, nil, C.cupsServer(), C.ippPort(), resource)
+
+	return uri, nil
+}
+
+// doRequest calls cupsDoRequest(), failing when CUPS is silent for longer
+// than timeout.
+//
+// Returns an *lib.UnreachableError if the CUPS server could not be contacted.
+func (cc *cupsCore) doRequest(request *C.ipp_t, timeout time.Duration, acceptableStatusCodes []C.ipp_status_t) (*C.ipp_t, error) {
+	http, err := cc.connect(timeout)
 	if err != nil {
 		return nil, err
 	}
-	defer cc.disconnect(http)
 
 	if C.ippValidateAttributes(request) != 1 {
+		cc.disconnect(http)
 		return nil, fmt.Errorf("Bad IPP request: %s", C.GoString(C.cupsLastErrorString()))
 	}
 
 	response := C.cupsDoRequest(http, request, C.POST_RESOURCE)
 	if response == nil {
-		return nil, fmt.Errorf("cupsDoRequest failed: %d %s", int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		if C.cupsLastError() == C.IPP_STATUS_ERROR_SERVICE_UNAVAILABLE {
+			err = &lib.UnreachableError{Message: fmt.Sprintf("cupsDoRequest failed; CUPS server unreachable: %s",
+				C.GoString(C.cupsLastErrorString()))}
+			// This connection is probably stale because cupsd restarted.
+			// Close it rather than return it to the pool.
+			C.httpClose(http)
+			cc.disconnect(nil)
+			return nil, err
+		}
+		err = fmt.Errorf("cupsDoRequest failed: %d %s", int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		cc.disconnect(http)
+		return nil, err
 	}
+	defer cc.disconnect(http)
+
 	statusCode := C.ippGetStatusCode(response)
 	for _, sc := range acceptableStatusCodes {
 		if statusCode == sc {
@@ -272,13 +516,18 @@ func (cc *cupsCore) doRequest(request *C.ipp_t, acceptableStatusCodes []C.ipp_st
 
 // connect calls C.httpConnect2 to create a new, open connection to
 // the CUPS server specified by environment variables, client.conf, etc.
+// Requests on the connection fail when CUPS is silent for longer than
+// timeout.
 //
 // connect also acquires the connection semaphore and locks the OS
 // thread to allow the CUPS API to use thread-local storage cleanly.
 //
+// When a new connection can't be created, connect retries with backoff,
+// then returns an *lib.UnreachableError.
+//
 // The caller is responsible to close the connection when finished
 // using cupsCore.disconnect.
-func (cc *cupsCore) connect() (*C.http_t, error) {
+func (cc *cupsCore) connect(timeout time.Duration) (*C.http_t, error) {
 	cc.connectionSemaphore.Acquire()
 
 	// Lock the OS thread so that thread-local storage is available to
@@ -293,14 +542,25 @@ func (cc *cupsCore) connect() (*C.http_t, error) {
 		http = h
 	default:
 		// No connection available for reuse; create a new one.
-		http = C.httpConnect2(cc.host, cc.port, nil, C.AF_UNSPEC, cc.encryption, 1, cc.connectTimeout, nil)
-		if http == nil {
-			defer cc.disconnect(http)
-			return nil, fmt.Errorf("Failed to connect to CUPS server %s:%d because %d %s",
-				C.GoString(cc.host), int(cc.port), int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))
+		for i := 0; ; i++ {
+			http = C.httpConnect2(cc.host, cc.port, nil, C.AF_UNSPEC, cc.encryption, 1, cc.connectTimeout, nil)
+			if http != nil {
+				break
+			}
+			if i+1 >= connectMaxAttempts {
+				err := &lib.UnreachableError{Message: fmt.Sprintf("Failed to connect to CUPS server %s:%d because %d %s",
+					C.GoString(cc.host), int(cc.port), int(C.cupsLastError()), C.GoString(C.cupsLastErrorString()))}
+				cc.disconnect(nil)
+				return nil, err
+			}
+			glog.Warningf("Failed to connect to CUPS server %s:%d; retrying", C.GoString(cc.host), int(cc.port))
+			time.Sleep(connectRetryBackoff << uint(i))
 		}
 	}
 
+	// Pooled connections carry the timeout of their last use.
+	C.httpSetTimeout(http, C.double(timeout.Seconds()), nil, nil)
+
 	return http, nil
 }
 
@@ -308,8 +568,19 @@ func (cc *cupsCore) connect() (*C.http_t, error) {
 // unlocks the OS thread and the connection semaphore.
 //
 // The http argument may be nil; the OS thread and semaphore are still
-// treated the same as described above.
+// treated the same as described above. A connection whose last request
+// timed out is closed rather than reused, as it may be mid-response.
 func (cc *cupsCore) disconnect(http *C.http_t) {
+	if http != nil && C.httpError(http) == C.ETIMEDOUT {
+		C.httpClose(http)
+		http = nil
+	}
+	if http == nil {
+		runtime.UnlockOSThread()
+		cc.connectionSemaphore.Release()
+		return
+	}
+
 	go func() {
 		select {
 		case cc.connectionPool <- http:
@@ -14,7 +14,15 @@ const char
 	*POST_RESOURCE              = "/",
 	*REQUESTED_ATTRIBUTES       = "requested-attributes",
 	*JOB_URI_ATTRIBUTE          = "job-uri",
-	*IPP                        = "ipp";
+	*PRINTER_URI_ATTRIBUTE      = "printer-uri",
+	*DEVICE_URI_ATTRIBUTE       = "device-uri",
+	*PPD_NAME_ATTRIBUTE         = "ppd-name",
+	*PRINTER_INFO_ATTRIBUTE     = "printer-info",
+	*PRINTER_LOCATION_ATTRIBUTE = "printer-location",
+	*PRINTER_STATE_ATTRIBUTE    = "printer-state",
+	*ACCEPTING_JOBS_ATTRIBUTE   = "printer-is-accepting-jobs",
+	*IPP                        = "ipp",
+	*DOCUMENT_FORMAT_AUTO       = CUPS_FORMAT_AUTO;
 
 // Allocates a new char**, initializes the values to NULL.
 char **newArrayOfStrings(int size) {
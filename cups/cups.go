@@ -18,12 +18,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -37,33 +39,49 @@ const (
 	// CUPS "URL" length are always less than 40. For example: /job/1234567
 	urlMaxLength = 100
 
+	// How often to log progress while fetching PPDs.
+	ppdFetchProgressInterval = 10 * time.Second
+
 	attrDeviceURI           = "device-uri"
 	attrMarkerLevels        = "marker-levels"
 	attrMarkerNames         = "marker-names"
 	attrMarkerTypes         = "marker-types"
 	attrPrinterInfo         = "printer-info"
+	attrPrinterIsShared     = "printer-is-shared"
+	attrPrinterLocation     = "printer-location"
 	attrPrinterMakeAndModel = "printer-make-and-model"
 	attrPrinterName         = "printer-name"
 	attrPrinterState        = "printer-state"
 	attrPrinterStateReasons = "printer-state-reasons"
 	attrPrinterUUID         = "printer-uuid"
 
+	attrMarkerChangeTime        = "marker-change-time"
+	attrPrinterConfigChangeTime = "printer-config-change-time"
+	attrPrinterStateChangeTime  = "printer-state-change-time"
+
 	attrJobState                = "job-state"
 	attrJobMediaSheetsCompleted = "job-media-sheets-completed"
 )
 
 var (
+	// Printer attributes without which printers can't be listed. Other
+	// attributes are optional, or needed only by some config options; see
+	// lib.MissingCUPSPrinterAttributes.
 	requiredPrinterAttributes []string = []string{
-		attrDeviceURI,
+		attrPrinterName,
+		attrPrinterState,
+		attrPrinterStateReasons,
+		attrPrinterUUID,
+	}
+
+	// Printer attributes needed to build printer state.
+	stateAttributes []string = []string{
 		attrMarkerLevels,
 		attrMarkerNames,
 		attrMarkerTypes,
-		attrPrinterInfo,
-		attrPrinterMakeAndModel,
 		attrPrinterName,
 		attrPrinterState,
 		attrPrinterStateReasons,
-		attrPrinterUUID,
 	}
 
 	jobAttributes []string = []string{
@@ -72,6 +90,21 @@ var (
 	}
 )
 
+// Timeouts bounds how long CUPS may go silent during each kind of request,
+// so that a hung cupsd or backend fails the request instead of blocking its
+// caller forever.
+type Timeouts struct {
+	// Listing printers and their attributes.
+	List time.Duration
+	// Fetching PPDs from remote CUPS servers, and adding printers, whose
+	// PPD CUPS may make. PPDs of a local server are read from its files.
+	PPD time.Duration
+	// Submitting jobs, including their documents.
+	Print time.Duration
+	// Getting the states of jobs, and canceling them.
+	JobState time.Duration
+}
+
 // Interface between Go and the CUPS API.
 type CUPS struct {
 	cc                *cupsCore
@@ -80,14 +113,21 @@ type CUPS struct {
 	printerAttributes []string
 	systemTags        map[string]string
 	translatePPDToCDD func(string) (*cdd.PrinterDescriptionSection, error)
+	ppdFetchWorkers   uint
+
+	// See listPrinters.
+	fullFetchInterval time.Duration
+	listMutex         sync.Mutex
+	listed            map[string]map[string][]string
+	lastFullFetch     time.Time
 }
 
-func NewCUPS(infoToDisplayName bool, printerAttributes []string, maxConnections uint, connectTimeout time.Duration, translatePPDToCDD func(string) (*cdd.PrinterDescriptionSection, error)) (*CUPS, error) {
+func NewCUPS(infoToDisplayName bool, printerAttributes []string, maxConnections uint, connectTimeout time.Duration, timeouts Timeouts, ppdFetchWorkers uint, fullFetchInterval time.Duration, translatePPDToCDD func(string) (*cdd.PrinterDescriptionSection, error)) (*CUPS, error) {
 	if err := checkPrinterAttributes(printerAttributes); err != nil {
 		return nil, err
 	}
 
-	cc, err := newCUPSCore(maxConnections, connectTimeout)
+	cc, err := newCUPSCore(maxConnections, connectTimeout, timeouts)
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +144,8 @@ func NewCUPS(infoToDisplayName bool, printerAttributes []string, maxConnections
 		infoToDisplayName: infoToDisplayName,
 		printerAttributes: printerAttributes,
 		systemTags:        systemTags,
+		ppdFetchWorkers:   ppdFetchWorkers,
+		fullFetchInterval: fullFetchInterval,
 	}
 
 	return c, nil
@@ -125,13 +167,95 @@ func (c *CUPS) ConnQtyMax() uint {
 
 // GetPrinters gets all CUPS printers found on the CUPS server.
 func (c *CUPS) GetPrinters() ([]lib.Printer, error) {
-	pa := C.newArrayOfStrings(C.int(len(c.printerAttributes)))
-	defer C.freeStringArrayAndStrings(pa, C.int(len(c.printerAttributes)))
-	for i, a := range c.printerAttributes {
+	printers, err := c.listPrinters()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range printers {
+		printers[i].GCPVersion = lib.GCPAPIVersion
+		printers[i].ConnectorVersion = lib.ShortName
+		printers[i].SetupURL = lib.ConnectorHomeURL
+		printers[i].SupportURL = lib.ConnectorHomeURL
+		printers[i].UpdateURL = lib.ConnectorHomeURL
+	}
+	printers = c.addDescriptionToPrinters(printers)
+
+	return printers, nil
+}
+
+// GetPrinterStates gets the state of all CUPS printers found on the CUPS
+// server, keyed by printer name. This is much cheaper than GetPrinters().
+func (c *CUPS) GetPrinterStates() (map[string]*cdd.PrinterStateSection, error) {
+	printers, err := c.getPrinters(stateAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]*cdd.PrinterStateSection, len(printers))
+	for i := range printers {
+		states[printers[i].Name] = printers[i].State
+	}
+
+	return states, nil
+}
+
+// getPrinters gets all CUPS printers found on the CUPS server, with only
+// the requested attributes.
+func (c *CUPS) getPrinters(attributes []string) ([]lib.Printer, error) {
+	printerTags, err := c.getPrinterTags(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	printers := make([]lib.Printer, 0, len(printerTags))
+	for _, tags := range printerTags {
+		printers = append(printers, tagsToPrinter(tags, c.systemTags, c.infoToDisplayName))
+	}
+	return printers, nil
+}
+
+// GetDeviceURIs gets the device-uri of every CUPS printer, by printer name.
+func (c *CUPS) GetDeviceURIs() (map[string]string, error) {
+	printerTags, err := c.getPrinterTags([]string{attrPrinterName, attrDeviceURI})
+	if err != nil {
+		return nil, err
+	}
+
+	deviceURIs := make(map[string]string, len(printerTags))
+	for _, tags := range printerTags {
+		deviceURIs[tagValue(tags, attrPrinterName)] = tagValue(tags, attrDeviceURI)
+	}
+	return deviceURIs, nil
+}
+
+// AddEverywherePrinter adds an enabled CUPS queue for an IPP Everywhere
+// printer, whose PPD CUPS generates by asking the printer.
+func (c *CUPS) AddEverywherePrinter(printername, deviceURI, info, location string) error {
+	pn := C.CString(printername)
+	defer C.free(unsafe.Pointer(pn))
+	du := C.CString(deviceURI)
+	defer C.free(unsafe.Pointer(du))
+	ppd := C.CString("everywhere")
+	defer C.free(unsafe.Pointer(ppd))
+	i := C.CString(info)
+	defer C.free(unsafe.Pointer(i))
+	l := C.CString(location)
+	defer C.free(unsafe.Pointer(l))
+
+	return c.cc.addPrinter(pn, du, ppd, i, l)
+}
+
+// getPrinterTags gets the requested attributes of all CUPS printers found
+// on the CUPS server, as tags.
+func (c *CUPS) getPrinterTags(attributes []string) ([]map[string][]string, error) {
+	pa := C.newArrayOfStrings(C.int(len(attributes)))
+	defer C.freeStringArrayAndStrings(pa, C.int(len(attributes)))
+	for i, a := range attributes {
 		C.setStringArrayValue(pa, C.int(i), C.CString(a))
 	}
 
-	response, err := c.cc.getPrinters(pa, C.int(len(c.printerAttributes)))
+	response, err := c.cc.getPrinters(pa, C.int(len(attributes)))
 	if err != nil {
 		return nil, err
 	}
@@ -141,57 +265,88 @@ func (c *CUPS) GetPrinters() ([]lib.Printer, error) {
 
 	if C.ippGetStatusCode(response) == C.IPP_STATUS_ERROR_NOT_FOUND {
 		// Normal error when there are no printers.
-		return make([]lib.Printer, 0), nil
+		return make([]map[string][]string, 0), nil
 	}
 
-	printers := c.responseToPrinters(response)
-	for i := range printers {
-		printers[i].GCPVersion = lib.GCPAPIVersion
-		printers[i].ConnectorVersion = lib.ShortName
-		printers[i].SetupURL = lib.ConnectorHomeURL
-		printers[i].SupportURL = lib.ConnectorHomeURL
-		printers[i].UpdateURL = lib.ConnectorHomeURL
+	return responseToTags(response, len(attributes)), nil
+}
+
+// getPrinterTagsByName gets the requested attributes of one CUPS printer,
+// as tags.
+func (c *CUPS) getPrinterTagsByName(printername string, attributes []string) (map[string][]string, error) {
+	pa := C.newArrayOfStrings(C.int(len(attributes)))
+	defer C.freeStringArrayAndStrings(pa, C.int(len(attributes)))
+	for i, a := range attributes {
+		C.setStringArrayValue(pa, C.int(i), C.CString(a))
 	}
-	printers = c.addDescriptionToPrinters(printers)
 
-	return printers, nil
+	pn := C.CString(printername)
+	defer C.free(unsafe.Pointer(pn))
+
+	response, err := c.cc.getPrinterAttributes(pn, pa, C.int(len(attributes)))
+	if err != nil {
+		return nil, err
+	}
+
+	// cupsDoRequest() returns ipp_t pointer which needs explicit free.
+	defer C.ippDelete(response)
+
+	printerTags := responseToTags(response, len(attributes))
+	if len(printerTags) == 0 {
+		return nil, fmt.Errorf("CUPS returned no attributes for printer %s", printername)
+	}
+	return printerTags[0], nil
 }
 
-// responseToPrinters converts a C.ipp_t to a slice of lib.Printers.
-func (c *CUPS) responseToPrinters(response *C.ipp_t) []lib.Printer {
-	printers := make([]lib.Printer, 0, 1)
+// responseToTags converts a C.ipp_t to a slice of tags, one per printer.
+func responseToTags(response *C.ipp_t, attributeQuantity int) []map[string][]string {
+	printerTags := make([]map[string][]string, 0, 1)
 
 	for a := C.ippFirstAttribute(response); a != nil; a = C.ippNextAttribute(response) {
 		if C.ippGetGroupTag(a) != C.IPP_TAG_PRINTER {
 			continue
 		}
 
-		attributes := make([]*C.ipp_attribute_t, 0, C.int(len(c.printerAttributes)))
+		attributes := make([]*C.ipp_attribute_t, 0, attributeQuantity)
 		for ; a != nil && C.ippGetGroupTag(a) == C.IPP_TAG_PRINTER; a = C.ippNextAttribute(response) {
 			attributes = append(attributes, a)
 		}
-		tags := attributesToTags(attributes)
-		p := tagsToPrinter(tags, c.systemTags, c.infoToDisplayName)
-
-		printers = append(printers, p)
+		printerTags = append(printerTags, attributesToTags(attributes))
 	}
 
-	return printers
+	return printerTags
 }
 
 // addPPDHashToPrinters fetches description, PPD hash, manufacturer, model for
-// all argument printers, concurrently.
+// all argument printers, with at most ppdFetchWorkers fetches at a time.
 //
 // Returns a new printer slice, because it can shrink due to raw or
 // mis-configured printers.
 func (c *CUPS) addDescriptionToPrinters(printers []lib.Printer) []lib.Printer {
-	var wg sync.WaitGroup
-	ch := make(chan *lib.Printer, len(printers))
-
+	todo := make(chan *lib.Printer, len(printers))
 	for i := range printers {
 		if !lib.PrinterIsRaw(printers[i]) {
-			wg.Add(1)
-			go func(p *lib.Printer) {
+			todo <- &printers[i]
+		}
+	}
+	close(todo)
+	total := len(todo)
+
+	var wg sync.WaitGroup
+	ch := make(chan *lib.Printer, total)
+	var fetched int32
+
+	workers := int(c.ppdFetchWorkers)
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > total {
+		workers = total
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for p := range todo {
 				if description, ppdHash, manufacturer, model, err := c.pc.getDescription(p.Name); err == nil {
 					p.Description.Absorb(description)
 					p.CapsHash = ppdHash
@@ -201,12 +356,30 @@ func (c *CUPS) addDescriptionToPrinters(printers []lib.Printer) []lib.Printer {
 				} else {
 					glog.Error(err)
 				}
-				wg.Done()
-			}(&printers[i])
-		}
+				atomic.AddInt32(&fetched, 1)
+			}
+			wg.Done()
+		}()
 	}
 
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Fetching many PPDs, like when registering many printers for the first
+	// time, can take a while.
+	t := time.NewTicker(ppdFetchProgressInterval)
+	defer t.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-t.C:
+			glog.Infof("Fetched %d of %d PPDs from CUPS", atomic.LoadInt32(&fetched), total)
+		}
+	}
 	close(ch)
 
 	result := make([]lib.Printer, 0, len(ch))
@@ -220,7 +393,7 @@ func (c *CUPS) addDescriptionToPrinters(printers []lib.Printer) []lib.Printer {
 func getSystemTags() (map[string]string, error) {
 	tags := make(map[string]string)
 
-	tags["connector-version"] = lib.BuildDate
+	tags[lib.ConnectorVersionTagKey] = lib.BuildDate
 	hostname, err := os.Hostname()
 	if err == nil {
 		tags["system-hostname"] = hostname
@@ -311,29 +484,48 @@ func convertJobState(cupsState, pages int32) cdd.PrintJobStateDiff {
 }
 
 // Print sends a new print job to the specified printer. The job ID
-// is returned.
-func (c *CUPS) Print(printername, filename, title, user string, ticket cdd.CloudJobTicket) (uint32, error) {
+// is returned. format is the document's MIME type, or "" to let CUPS
+// detect it.
+//
+// When the printer can't make collated copies (see clientSideCopies), the
+// document is sent once per copy, as one job, so that the copies are
+// collated.
+func (c *CUPS) Print(printername, filename, title, user, format string, ticket cdd.CloudJobTicket) (uint32, error) {
 	pn := C.CString(printername)
 	defer C.free(unsafe.Pointer(pn))
-	fn := C.CString(filename)
-	defer C.free(unsafe.Pointer(fn))
 	t := C.CString(title)
 	defer C.free(unsafe.Pointer(t))
 
-	options := ticketToOptions(ticket)
-	numOptions := C.int(0)
-	var o *C.cups_option_t = nil
-	for key, value := range options {
-		k, v := C.CString(key), C.CString(value)
-		numOptions = C.cupsAddOption(k, v, numOptions, &o)
-		C.free(unsafe.Pointer(k))
-		C.free(unsafe.Pointer(v))
+	copies := c.clientSideCopies(printername, ticket)
+	if copies > 1 {
+		ticket.Print.Copies = nil
+		ticket.Print.Collate = nil
 	}
+
+	// cupsPrintFile2 takes the format from the document-format option.
+	numOptions, o := c.jobOptions(printername, ticket, format)
 	defer C.cupsFreeOptions(numOptions, o)
 
 	u := C.CString(user)
 	defer C.free(unsafe.Pointer(u))
 
+	if copies > 1 {
+		fns := C.newArrayOfStrings(C.int(copies))
+		defer C.freeStringArrayAndStrings(fns, C.int(copies))
+		for i := 0; i < copies; i++ {
+			C.setStringArrayValue(fns, C.int(i), C.CString(filename))
+		}
+
+		jobID, err := c.cc.printFiles(u, pn, C.int(copies), fns, t, numOptions, o)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(jobID), nil
+	}
+
+	fn := C.CString(filename)
+	defer C.free(unsafe.Pointer(fn))
+
 	jobID, err := c.cc.printFile(u, pn, fn, t, numOptions, o)
 	if err != nil {
 		return 0, err
@@ -342,87 +534,81 @@ func (c *CUPS) Print(printername, filename, title, user string, ticket cdd.Cloud
 	return uint32(jobID), nil
 }
 
-func ticketToOptions(ticket cdd.CloudJobTicket) map[string]string {
-	m := make(map[string]string)
+// clientSideCopies returns the quantity of copies that the connector has to
+// make for a job, because the printer's PPD says that it can't make copies,
+// or 1 when the printer or CUPS makes the copies.
+func (c *CUPS) clientSideCopies(printername string, ticket cdd.CloudJobTicket) int {
+	return ticketCopies(ticket, c.pc.getNoCopies(printername))
+}
 
-	for _, vti := range ticket.Print.VendorTicketItem {
-		m[vti.ID] = vti.Value
-	}
-	if ticket.Print.Color != nil {
-		m["ColorModel"] = ticket.Print.Color.VendorID
-	}
-	if ticket.Print.Duplex != nil {
-		switch ticket.Print.Duplex.Type {
-		case "LONG_EDGE":
-			m["Duplex"] = "DuplexNoTumble"
-		case "SHORT_EDGE":
-			m["Duplex"] = "DuplexTumble"
-		case "NO_DUPLEX":
-			m["Duplex"] = "None"
-		}
-	}
-	if ticket.Print.PageOrientation != nil {
-		switch ticket.Print.PageOrientation.Type {
-		case "PORTRAIT":
-			m["orientation-requested"] = "3"
-		case "LANDSCAPE":
-			m["orientation-requested"] = "4"
-		}
-	}
-	if ticket.Print.Copies != nil {
-		m["copies"] = strconv.FormatInt(int64(ticket.Print.Copies.Copies), 10)
-	}
-	if ticket.Print.Margins != nil {
-		m["page-top"] = micronsToPoints(ticket.Print.Margins.TopMicrons)
-		m["page-right"] = micronsToPoints(ticket.Print.Margins.RightMicrons)
-		m["page-bottom"] = micronsToPoints(ticket.Print.Margins.BottomMicrons)
-		m["page-left"] = micronsToPoints(ticket.Print.Margins.LeftMicrons)
-	}
-	if ticket.Print.DPI != nil {
-		if ticket.Print.DPI.VendorID != "" {
-			m["Resolution"] = ticket.Print.DPI.VendorID
-		} else {
-			m["Resolution"] = fmt.Sprintf("%dx%xdpi",
-				ticket.Print.DPI.HorizontalDPI, ticket.Print.DPI.VerticalDPI)
-		}
-	}
-	if ticket.Print.FitToPage != nil {
-		switch ticket.Print.FitToPage.Type {
-		case "FIT_TO_PAGE":
-			m["fit-to-page"] = "true"
-		case "NO_FITTING":
-			m["fit-to-page"] = "false"
-		}
-	}
-	if ticket.Print.MediaSize != nil {
-		if ticket.Print.MediaSize.VendorID != "" {
-			m["media"] = ticket.Print.MediaSize.VendorID
-		} else {
-			widthPoints := micronsToPoints(ticket.Print.MediaSize.WidthMicrons)
-			heightPoints := micronsToPoints(ticket.Print.MediaSize.HeightMicrons)
-			m["media"] = fmt.Sprintf("Custom.%sx%s", widthPoints, heightPoints)
-		}
+// PrintStream sends a new job to CUPS without a file. write is called
+// to write the job document to CUPS. format is the document's MIME type,
+// or "" to let CUPS detect it. Returns the CUPS job ID.
+//
+// Returns a *lib.StreamUnsupportedError, without calling write, when the CUPS
+// server can't receive job documents as streams, or when the connector has
+// to make copies for the printer; use Print instead.
+func (c *CUPS) PrintStream(printername, title, user, format string, ticket cdd.CloudJobTicket, write func(io.Writer) error) (uint32, error) {
+	if copies := c.clientSideCopies(printername, ticket); copies > 1 {
+		return 0, &lib.StreamUnsupportedError{Message: fmt.Sprintf(
+			"Printer %s can't make copies, so the connector sends the document %d times", printername, copies)}
 	}
-	if ticket.Print.Collate != nil {
-		if ticket.Print.Collate.Collate {
-			m["Collate"] = "true"
-		} else {
-			m["Collate"] = "false"
-		}
+
+	pn := C.CString(printername)
+	defer C.free(unsafe.Pointer(pn))
+	t := C.CString(title)
+	defer C.free(unsafe.Pointer(t))
+
+	numOptions, o := c.jobOptions(printername, ticket, "")
+	defer C.cupsFreeOptions(numOptions, o)
+
+	u := C.CString(user)
+	defer C.free(unsafe.Pointer(u))
+
+	var f *C.char
+	if format != "" {
+		f = C.CString(format)
+		defer C.free(unsafe.Pointer(f))
 	}
-	if ticket.Print.ReverseOrder != nil {
-		if ticket.Print.ReverseOrder.ReverseOrder {
-			m["outputorder"] = "reverse"
-		} else {
-			m["outputorder"] = "normal"
-		}
+
+	jobID, err := c.cc.printStream(u, pn, t, f, numOptions, o, write)
+	if err != nil {
+		return 0, err
 	}
 
-	return m
+	return uint32(jobID), nil
 }
 
-func micronsToPoints(microns int32) string {
-	return strconv.Itoa(int(float32(microns)*72/25400 + 0.5))
+// CancelJob cancels a CUPS job, as the user that submitted it.
+func (c *CUPS) CancelJob(printername, user string, jobID uint32) error {
+	pn := C.CString(printername)
+	defer C.free(unsafe.Pointer(pn))
+	u := C.CString(user)
+	defer C.free(unsafe.Pointer(u))
+
+	return c.cc.cancelJob(u, pn, C.int(jobID))
+}
+
+// jobOptions converts a ticket to CUPS options for a printer, adding the
+// document-format option when format is not "".
+//
+// The caller is responsible to C.cupsFreeOptions the returned options.
+func (c *CUPS) jobOptions(printername string, ticket cdd.CloudJobTicket, format string) (C.int, *C.cups_option_t) {
+	options := ticketToOptions(ticket)
+	resolvePPDConstraints(options, c.pc.getConstraints(printername))
+	if format != "" {
+		options["document-format"] = format
+	}
+	numOptions := C.int(0)
+	var o *C.cups_option_t = nil
+	for key, value := range options {
+		k, v := C.CString(key), C.CString(value)
+		numOptions = C.cupsAddOption(k, v, numOptions, &o)
+		C.free(unsafe.Pointer(k))
+		C.free(unsafe.Pointer(v))
+	}
+
+	return numOptions, o
 }
 
 // convertIPPDateToTime converts an RFC 2579 date to a time.Time object.
@@ -564,38 +750,11 @@ func tagsToPrinter(printerTags map[string][]string, systemTags map[string]string
 		uuid = u[0]
 	}
 
-	state := cdd.PrinterStateSection{}
-
+	var printerState string
 	if s, ok := printerTags[attrPrinterState]; ok {
-		switch s[0] {
-		case "3":
-			state.State = cdd.CloudDeviceStateIdle
-		case "4":
-			state.State = cdd.CloudDeviceStateProcessing
-		case "5":
-			state.State = cdd.CloudDeviceStateStopped
-		default:
-			state.State = cdd.CloudDeviceStateIdle
-		}
-	}
-
-	if reasons, ok := printerTags[attrPrinterStateReasons]; ok && len(reasons) > 0 {
-		sort.Strings(reasons)
-		state.VendorState = &cdd.VendorState{Item: make([]cdd.VendorStateItem, len(reasons))}
-		for i, reason := range reasons {
-			vendorState := cdd.VendorStateItem{DescriptionLocalized: cdd.NewLocalizedString(reason)}
-			if strings.HasSuffix(reason, "-error") {
-				vendorState.State = cdd.VendorStateError
-			} else if strings.HasSuffix(reason, "-warning") {
-				vendorState.State = cdd.VendorStateWarning
-			} else if strings.HasSuffix(reason, "-report") {
-				vendorState.State = cdd.VendorStateInfo
-			} else {
-				vendorState.State = cdd.VendorStateInfo
-			}
-			state.VendorState.Item[i] = vendorState
-		}
+		printerState = s[0]
 	}
+	state := convertPrinterState(printerState, printerTags[attrPrinterStateReasons])
 
 	markers, markerState := convertMarkers(printerTags[attrMarkerNames], printerTags[attrMarkerTypes], printerTags[attrMarkerLevels])
 	state.MarkerState = markerState
@@ -610,13 +769,123 @@ func tagsToPrinter(printerTags map[string][]string, systemTags map[string]string
 	}
 	p.SetTagshash()
 
-	if pi, ok := printerTags[attrPrinterInfo]; ok && infoToDisplayName {
-		p.DefaultDisplayName = pi[0]
+	if pi, ok := printerTags[attrPrinterInfo]; ok && len(pi) > 0 {
+		p.Info = pi[0]
+		if infoToDisplayName {
+			p.DefaultDisplayName = pi[0]
+		}
+	}
+	if pl, ok := printerTags[attrPrinterLocation]; ok && len(pl) > 0 {
+		p.Location = pl[0]
 	}
 
 	return p
 }
 
+// Printer state reasons (without -error, -warning, -report suffix) that
+// are reported in CDS input tray, output bin, cover and media path
+// sections, rather than only as vendor state.
+var (
+	cupsReasonToInputTrayState = map[string]cdd.InputTrayStateType{
+		"media-empty":        cdd.InputTrayStateEmpty,
+		"media-needed":       cdd.InputTrayStateEmpty,
+		"input-tray-missing": cdd.InputTrayStateOff,
+	}
+	cupsReasonToOutputBinState = map[string]cdd.OutputBinStateType{
+		"output-area-full":    cdd.OutputBinStateFull,
+		"output-tray-missing": cdd.OutputBinStateOff,
+	}
+	cupsReasonToCoverState = map[string]cdd.CoverStateType{
+		"cover-open":     cdd.CoverStateOpen,
+		"door-open":      cdd.CoverStateOpen,
+		"interlock-open": cdd.CoverStateOpen,
+	}
+	cupsReasonToMediaPathState = map[string]cdd.MediaPathStateType{
+		"media-jam": cdd.MediaPathStateMediaJam,
+	}
+)
+
+// convertPrinterState converts CUPS printer-state and printer-state-reasons
+// to a CDS printer state section, without markers.
+func convertPrinterState(printerState string, reasons []string) cdd.PrinterStateSection {
+	state := cdd.PrinterStateSection{}
+
+	switch printerState {
+	case "3":
+		state.State = cdd.CloudDeviceStateIdle
+	case "4":
+		state.State = cdd.CloudDeviceStateProcessing
+	case "5":
+		state.State = cdd.CloudDeviceStateStopped
+	default:
+		state.State = cdd.CloudDeviceStateIdle
+	}
+
+	reasons = append([]string{}, reasons...)
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		if reason == "none" {
+			continue
+		}
+
+		vendorState := cdd.VendorStateItem{DescriptionLocalized: cdd.NewLocalizedString(reason)}
+		if strings.HasSuffix(reason, "-error") {
+			vendorState.State = cdd.VendorStateError
+		} else if strings.HasSuffix(reason, "-warning") {
+			vendorState.State = cdd.VendorStateWarning
+		} else if strings.HasSuffix(reason, "-report") {
+			vendorState.State = cdd.VendorStateInfo
+		} else {
+			vendorState.State = cdd.VendorStateInfo
+		}
+		if state.VendorState == nil {
+			state.VendorState = &cdd.VendorState{}
+		}
+		state.VendorState.Item = append(state.VendorState.Item, vendorState)
+
+		if vendorState.State == cdd.VendorStateInfo {
+			// Reports don't affect the state of printer parts.
+			continue
+		}
+		keyword := strings.TrimSuffix(strings.TrimSuffix(reason, "-error"), "-warning")
+
+		if s, ok := cupsReasonToInputTrayState[keyword]; ok {
+			if state.InputTrayState == nil {
+				state.InputTrayState = &cdd.InputTrayState{}
+			}
+			state.InputTrayState.Item = append(state.InputTrayState.Item,
+				cdd.InputTrayStateItem{VendorID: keyword, State: s, VendorMessage: reason})
+		}
+		if s, ok := cupsReasonToOutputBinState[keyword]; ok {
+			if state.OutputBinState == nil {
+				state.OutputBinState = &cdd.OutputBinState{}
+			}
+			state.OutputBinState.Item = append(state.OutputBinState.Item,
+				cdd.OutputBinStateItem{VendorID: keyword, State: s, VendorMessage: reason})
+		}
+		if s, ok := cupsReasonToCoverState[keyword]; ok {
+			if state.CoverState == nil {
+				state.CoverState = &cdd.CoverState{}
+			}
+			state.CoverState.Item = append(state.CoverState.Item,
+				cdd.CoverStateItem{VendorID: keyword, State: s, VendorMessage: reason})
+		}
+		if s, ok := cupsReasonToMediaPathState[keyword]; ok {
+			if state.MediaPathState == nil {
+				state.MediaPathState = &cdd.MediaPathState{}
+			}
+			state.MediaPathState.Item = append(state.MediaPathState.Item,
+				cdd.MediaPathStateItem{VendorID: keyword, State: s, VendorMessage: reason})
+		}
+		if vendorState.State == cdd.VendorStateError {
+			// The printer can't print until an error is resolved.
+			state.State = cdd.CloudDeviceStateStopped
+		}
+	}
+
+	return state
+}
+
 var cupsMarkerNameToGCP map[string]cdd.MarkerColorType = map[string]cdd.MarkerColorType{
 	"black":        cdd.MarkerColorBlack,
 	"color":        cdd.MarkerColorColor,
@@ -15,7 +15,15 @@ extern const char
 	*POST_RESOURCE,
 	*REQUESTED_ATTRIBUTES,
 	*JOB_URI_ATTRIBUTE,
-	*IPP;
+	*PRINTER_URI_ATTRIBUTE,
+	*DEVICE_URI_ATTRIBUTE,
+	*PPD_NAME_ATTRIBUTE,
+	*PRINTER_INFO_ATTRIBUTE,
+	*PRINTER_LOCATION_ATTRIBUTE,
+	*PRINTER_STATE_ATTRIBUTE,
+	*ACCEPTING_JOBS_ATTRIBUTE,
+	*IPP,
+	*DOCUMENT_FORMAT_AUTO;
 
 char **newArrayOfStrings(int size);
 
@@ -8,15 +8,18 @@ https://developers.google.com/open-source/licenses/bsd
 package cups
 
 import (
-	"regexp"
 	"strings"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
 )
 
+// Vendor capabilities for PPD custom options (like a secure print PIN)
+// have this suffix appended to the option keyword. See ticketToOptions().
+const ppdCustomSuffix = lib.PPDCustomSuffix
+
 var (
-	// Get manufacturer name from PPD.
-	reManufacturer = regexp.MustCompile(`(?m)^\*Manufacturer:\s*"(.+)"\s*$`)
-	// Get model name from PPD.
-	reModel = regexp.MustCompile(`(?m)^\*ModelName:\s*"(.+)"\s*$`)
 	// Source of data: PPD Spec 4.3, Table D.1.
 	manTitleCaseLookup = map[string]string{
 		"ADOBE":        "Adobe",
@@ -40,18 +43,17 @@ var (
 	}
 )
 
-// parseManufacturerAndModel finds the *Manufacturer and *ModelName values in a PPD string.
-func parseManufacturerAndModel(ppd string) (string, string) {
+// manufacturerAndModel returns the manufacturer and model of a PPD, without
+// the manufacturer in the model.
+func manufacturerAndModel(ppd *lib.PPD) (string, string) {
 	manufacturer := "Unknown"
-	res := reManufacturer.FindStringSubmatch(ppd)
-	if len(res) > 1 && res[1] != "" {
-		manufacturer = res[1]
+	if ppd.Manufacturer != "" {
+		manufacturer = ppd.Manufacturer
 	}
 
 	model := "Unknown"
-	res = reModel.FindStringSubmatch(ppd)
-	if len(res) > 1 && res[1] != "" {
-		model = res[1]
+	if ppd.ModelName != "" {
+		model = ppd.ModelName
 	}
 
 	if strings.HasPrefix(model, manufacturer) && len(model) > len(manufacturer) {
@@ -67,3 +69,29 @@ func parseManufacturerAndModel(ppd string) (string, string) {
 
 	return manufacturer, model
 }
+
+// constraintMatches answers the question "is this option value selected
+// by this constraint choice?"
+func constraintMatches(options map[string]string, keyword, choice string) bool {
+	value, exists := options[keyword]
+	if !exists {
+		return false
+	}
+	if choice == "" {
+		return value != "None" && value != "False" && value != "Off"
+	}
+	return value == choice
+}
+
+// resolvePPDConstraints removes options that conflict with other options
+// according to constraints. Of two conflicting options, the second one in
+// the constraint is removed.
+func resolvePPDConstraints(options map[string]string, constraints []lib.PPDConstraint) {
+	for _, c := range constraints {
+		if constraintMatches(options, c.Keyword1, c.Choice1) && constraintMatches(options, c.Keyword2, c.Choice2) {
+			glog.Warningf("Option %s=%s conflicts with %s=%s; ignoring it",
+				c.Keyword2, options[c.Keyword2], c.Keyword1, options[c.Keyword1])
+			delete(options, c.Keyword2)
+		}
+	}
+}
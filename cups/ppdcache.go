@@ -24,6 +24,9 @@ import (
 	"unsafe"
 
 	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
 )
 
 var numberUpCapability = cdd.VendorCapability{
@@ -112,6 +115,32 @@ func (pc *ppdCache) removePPD(printername string) {
 	}
 }
 
+// getConstraints gets the constraints of a printer's PPD, if the PPD has
+// been cached.
+func (pc *ppdCache) getConstraints(printername string) []lib.PPDConstraint {
+	pc.cacheMutex.RLock()
+	pce, exists := pc.cache[printername]
+	pc.cacheMutex.RUnlock()
+
+	if !exists {
+		return nil
+	}
+	return pce.getConstraints()
+}
+
+// getNoCopies answers the question "does the printer's PPD say that it can't
+// make copies?", if the PPD has been cached.
+func (pc *ppdCache) getNoCopies(printername string) bool {
+	pc.cacheMutex.RLock()
+	pce, exists := pc.cache[printername]
+	pc.cacheMutex.RUnlock()
+
+	if !exists {
+		return false
+	}
+	return pce.getNoCopies()
+}
+
 func (pc *ppdCache) getDescription(printername string) (*cdd.PrinterDescriptionSection, string, string, string, error) {
 	description, hash, manufacturer, model, err := pc.getPPDCacheEntry(printername)
 	if err != nil {
@@ -162,6 +191,8 @@ type ppdCacheEntry struct {
 	filename     string
 	hash         string
 	description  cdd.PrinterDescriptionSection
+	constraints  []lib.PPDConstraint
+	noCopies     bool
 	manufacturer string
 	model        string
 	mutex        sync.Mutex
@@ -195,6 +226,21 @@ func (pce *ppdCacheEntry) getFields() (cdd.PrinterDescriptionSection, string, st
 	return pce.description, pce.hash, pce.manufacturer, pce.model
 }
 
+// getNoCopies gets whether the PPD of this ppdCacheEntry says that the
+// printer can't make copies, under a lock.
+func (pce *ppdCacheEntry) getNoCopies() bool {
+	pce.mutex.Lock()
+	defer pce.mutex.Unlock()
+	return pce.noCopies
+}
+
+// getConstraints gets the PPD constraints of this ppdCacheEntry under a lock.
+func (pce *ppdCacheEntry) getConstraints() []lib.PPDConstraint {
+	pce.mutex.Lock()
+	defer pce.mutex.Unlock()
+	return pce.constraints
+}
+
 // free frees the memory that stores the name and buffer fields, and deletes
 // the file named by the buffer field. If the file doesn't exist, no error is
 // returned.
@@ -253,11 +299,19 @@ func (pce *ppdCacheEntry) refresh(cc *cupsCore, translatePPDToCDD func(string) (
 	}
 
 	contentString := content.String()
+	ppd, err := lib.ParsePPD(contentString)
+	if err != nil {
+		// GCP's translation service may still take the PPD, without the
+		// constraints and options that the connector reads from it. The
+		// local translator fails on it below.
+		glog.Warningf("Failed to parse the PPD of printer %s; sending it as it is: %s", pce.printername, err)
+		ppd = &lib.PPD{}
+	}
 	description, err := translatePPDToCDD(contentString)
 	if err != nil {
 		return err
 	}
-	manufacturer, model := parseManufacturerAndModel(contentString)
+	manufacturer, model := manufacturerAndModel(ppd)
 
 	description.SupportedContentType = &[]cdd.SupportedContentType{
 		cdd.SupportedContentType{
@@ -274,9 +328,13 @@ func (pce *ppdCacheEntry) refresh(cc *cupsCore, translatePPDToCDD func(string) (
 	if description.VendorCapability == nil {
 		description.VendorCapability = &[]cdd.VendorCapability{}
 	}
+	*description.VendorCapability = append(*description.VendorCapability,
+		ppd.VendorCapabilities(*description.VendorCapability)...)
 	*description.VendorCapability = append(*description.VendorCapability, numberUpCapability)
 
 	pce.description = *description
+	pce.constraints = ppd.Constraints
+	pce.noCopies = ppd.MaxCopies == 1
 	pce.hash = fmt.Sprintf("%x", hash.Sum(nil))
 	pce.manufacturer = manufacturer
 	pce.model = model
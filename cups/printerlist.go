@@ -0,0 +1,137 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// Attributes that tell when a printer last changed.
+var changeTimeAttributes = []string{
+	attrPrinterName,
+	attrPrinterStateChangeTime,
+	attrPrinterConfigChangeTime,
+	attrMarkerChangeTime,
+}
+
+// listPrinters gets all CUPS printers found on the CUPS server, with the
+// configured attributes.
+//
+// Fetching every attribute of every printer is expensive on a busy server,
+// so only the change time attributes are fetched for all printers, then the
+// full attributes of printers that changed since the last call. All
+// attributes of all printers are fetched every fullFetchInterval, in case
+// an attribute changed without a change time.
+func (c *CUPS) listPrinters() ([]lib.Printer, error) {
+	c.listMutex.Lock()
+	defer c.listMutex.Unlock()
+
+	attributes := append(append([]string{}, c.printerAttributes...), changeTimeAttributes...)
+
+	var printerTags []map[string][]string
+	if c.listed != nil && c.fullFetchInterval > 0 && time.Since(c.lastFullFetch) < c.fullFetchInterval {
+		var err error
+		if printerTags, err = c.getChangedPrinterTags(attributes); err != nil {
+			return nil, err
+		}
+	}
+
+	if printerTags == nil {
+		var err error
+		if printerTags, err = c.getPrinterTags(attributes); err != nil {
+			return nil, err
+		}
+		c.lastFullFetch = time.Now()
+	}
+
+	c.listed = make(map[string]map[string][]string, len(printerTags))
+	printers := make([]lib.Printer, 0, len(printerTags))
+	for _, tags := range printerTags {
+		c.listed[tagValue(tags, attrPrinterName)] = tags
+		printers = append(printers, tagsToPrinter(c.withoutChangeTimes(tags), c.systemTags, c.infoToDisplayName))
+	}
+
+	return printers, nil
+}
+
+// getChangedPrinterTags gets the tags of all printers, reusing the tags from
+// the last call for printers that haven't changed since. Returns nil, without
+// an error, when CUPS doesn't report change times.
+func (c *CUPS) getChangedPrinterTags(attributes []string) ([]map[string][]string, error) {
+	changeTimes, err := c.getPrinterTags(changeTimeAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	printerTags := make([]map[string][]string, 0, len(changeTimes))
+	var fetched int
+	for _, times := range changeTimes {
+		if tagValue(times, attrPrinterStateChangeTime) == "" {
+			glog.Warning("CUPS doesn't report when printers change; fetching all printer attributes")
+			return nil, nil
+		}
+
+		name := tagValue(times, attrPrinterName)
+		if tags, exists := c.listed[name]; exists && changeTime(tags) == changeTime(times) {
+			printerTags = append(printerTags, tags)
+			continue
+		}
+
+		tags, err := c.getPrinterTagsByName(name, attributes)
+		if err != nil {
+			return nil, err
+		}
+		printerTags = append(printerTags, tags)
+		fetched++
+	}
+
+	glog.V(1).Infof("Fetched attributes of %d changed CUPS printers, of %d", fetched, len(printerTags))
+	return printerTags, nil
+}
+
+// withoutChangeTimes copies tags, without the change time attributes that
+// weren't asked for in the config, so that they don't change the printer's
+// tags hash.
+func (c *CUPS) withoutChangeTimes(tags map[string][]string) map[string][]string {
+	if contains(c.printerAttributes, "all") {
+		return tags
+	}
+
+	result := make(map[string][]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	for _, a := range changeTimeAttributes {
+		if !contains(c.printerAttributes, a) {
+			delete(result, a)
+		}
+	}
+	return result
+}
+
+// changeTime combines a printer's change time attributes.
+func changeTime(tags map[string][]string) string {
+	return strings.Join([]string{
+		tagValue(tags, attrPrinterStateChangeTime),
+		tagValue(tags, attrPrinterConfigChangeTime),
+		tagValue(tags, attrMarkerChangeTime),
+	}, ",")
+}
+
+// tagValue returns the first value of a tag, or the empty string.
+func tagValue(tags map[string][]string, key string) string {
+	if v := tags[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package cups
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+// ticketToOptions converts a CloudJobTicket to CUPS job options.
+//
+// Items that came from PPD options (vendor items, and items with a vendor
+// ID) are passed through as PPD choices. Other items are converted to the
+// standard IPP/CUPS options that the CUPS filters understand, with lengths
+// converted from microns to points.
+func ticketToOptions(ticket cdd.CloudJobTicket) map[string]string {
+	m := make(map[string]string)
+
+	for _, vti := range ticket.Print.VendorTicketItem {
+		if strings.HasSuffix(vti.ID, ppdCustomSuffix) {
+			continue
+		}
+		switch vti.Value {
+		case "true":
+			// Boolean PPD options are spelled True and False.
+			m[vti.ID] = "True"
+		case "false":
+			m[vti.ID] = "False"
+		default:
+			m[vti.ID] = vti.Value
+		}
+	}
+	for _, vti := range ticket.Print.VendorTicketItem {
+		// Custom option values, like a secure print PIN, override choices.
+		if strings.HasSuffix(vti.ID, ppdCustomSuffix) && vti.Value != "" {
+			m[strings.TrimSuffix(vti.ID, ppdCustomSuffix)] = "Custom." + vti.Value
+		}
+	}
+	if ticket.Print.Color != nil {
+		if ticket.Print.Color.VendorID != "" {
+			m["ColorModel"] = ticket.Print.Color.VendorID
+		} else {
+			switch ticket.Print.Color.Type {
+			case "STANDARD_COLOR":
+				m["print-color-mode"] = "color"
+			case "STANDARD_MONOCHROME":
+				m["print-color-mode"] = "monochrome"
+			}
+		}
+	}
+	if ticket.Print.Duplex != nil {
+		switch ticket.Print.Duplex.Type {
+		case "LONG_EDGE":
+			m["Duplex"] = "DuplexNoTumble"
+		case "SHORT_EDGE":
+			m["Duplex"] = "DuplexTumble"
+		case "NO_DUPLEX":
+			m["Duplex"] = "None"
+		}
+	}
+	if ticket.Print.PageOrientation != nil {
+		switch ticket.Print.PageOrientation.Type {
+		case "PORTRAIT":
+			m["orientation-requested"] = "3"
+		case "LANDSCAPE":
+			m["orientation-requested"] = "4"
+		}
+		// AUTO is the CUPS default; CUPS rotates to fit.
+	}
+	if ticket.Print.Copies != nil && ticket.Print.Copies.Copies > 0 {
+		m["copies"] = strconv.FormatInt(int64(ticket.Print.Copies.Copies), 10)
+	}
+	if ticket.Print.Margins != nil {
+		m["page-top"] = micronsToPoints(ticket.Print.Margins.TopMicrons)
+		m["page-right"] = micronsToPoints(ticket.Print.Margins.RightMicrons)
+		m["page-bottom"] = micronsToPoints(ticket.Print.Margins.BottomMicrons)
+		m["page-left"] = micronsToPoints(ticket.Print.Margins.LeftMicrons)
+	}
+	if ticket.Print.DPI != nil {
+		if ticket.Print.DPI.VendorID != "" {
+			m["Resolution"] = ticket.Print.DPI.VendorID
+		} else if ticket.Print.DPI.HorizontalDPI == ticket.Print.DPI.VerticalDPI {
+			m["Resolution"] = fmt.Sprintf("%ddpi", ticket.Print.DPI.HorizontalDPI)
+		} else {
+			m["Resolution"] = fmt.Sprintf("%dx%ddpi",
+				ticket.Print.DPI.HorizontalDPI, ticket.Print.DPI.VerticalDPI)
+		}
+	}
+	if ticket.Print.FitToPage != nil {
+		// fit-to-page is understood by older CUPS filters, print-scaling by newer.
+		switch ticket.Print.FitToPage.Type {
+		case "FIT_TO_PAGE", "GROW_TO_PAGE":
+			m["fit-to-page"] = "true"
+			m["print-scaling"] = "fit"
+		case "SHRINK_TO_PAGE":
+			m["fit-to-page"] = "true"
+			m["print-scaling"] = "auto"
+		case "FILL_PAGE":
+			m["fit-to-page"] = "true"
+			m["print-scaling"] = "fill"
+		case "NO_FITTING":
+			m["fit-to-page"] = "false"
+			m["print-scaling"] = "none"
+		}
+	}
+	if ticket.Print.PageRange != nil {
+		if pageRanges := pageRangesOption(ticket.Print.PageRange.Interval); pageRanges != "" {
+			m["page-ranges"] = pageRanges
+		}
+	}
+	if ticket.Print.MediaSize != nil {
+		if ticket.Print.MediaSize.VendorID != "" {
+			m["media"] = ticket.Print.MediaSize.VendorID
+		} else {
+			widthPoints := micronsToPoints(ticket.Print.MediaSize.WidthMicrons)
+			heightPoints := micronsToPoints(ticket.Print.MediaSize.HeightMicrons)
+			m["media"] = fmt.Sprintf("Custom.%sx%s", widthPoints, heightPoints)
+		}
+	}
+	if ticket.Print.Collate != nil {
+		// Collate is the PPD option; multiple-document-handling is the IPP
+		// attribute, for printers without a Collate option.
+		if ticket.Print.Collate.Collate {
+			m["Collate"] = "True"
+			m["multiple-document-handling"] = "separate-documents-collated-copies"
+		} else {
+			m["Collate"] = "False"
+			m["multiple-document-handling"] = "separate-documents-uncollated-copies"
+		}
+	}
+	if ticket.Print.ReverseOrder != nil {
+		if ticket.Print.ReverseOrder.ReverseOrder {
+			m["outputorder"] = "reverse"
+		} else {
+			m["outputorder"] = "normal"
+		}
+	}
+
+	return m
+}
+
+// ticketCopies returns the quantity of copies that the connector has to make
+// of a ticket's document, when noCopies says that the printer can't make
+// copies, or 1 when the printer or CUPS makes the copies.
+//
+// Copies made by sending the document several times are collated, so
+// uncollated copies are left to CUPS, with the option Collate=False (see
+// ticketToOptions), whose filters make them.
+func ticketCopies(ticket cdd.CloudJobTicket, noCopies bool) int {
+	if !noCopies || ticket.Print.Copies == nil || ticket.Print.Copies.Copies <= 1 {
+		return 1
+	}
+	if ticket.Print.Collate != nil && !ticket.Print.Collate.Collate {
+		return 1
+	}
+	return int(ticket.Print.Copies.Copies)
+}
+
+// pageRangesOption formats page range intervals as a CUPS page-ranges
+// value, like "1-3,5,7-". Intervals without an end run to the last page.
+// Invalid intervals are skipped.
+func pageRangesOption(intervals []cdd.PageRangeInterval) string {
+	ranges := make([]string, 0, len(intervals))
+	for _, interval := range intervals {
+		start := interval.Start
+		if start < 1 {
+			start = 1
+		}
+		switch {
+		case interval.End == 0:
+			ranges = append(ranges, fmt.Sprintf("%d-", start))
+		case interval.End == start:
+			ranges = append(ranges, strconv.Itoa(int(start)))
+		case interval.End > start:
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, interval.End))
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+func micronsToPoints(microns int32) string {
+	return strconv.Itoa(int(float32(microns)*72/25400 + 0.5))
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package cups
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+// Sample tickets, as GCP sends them, and the options they translate to.
+var ticketTests = []struct {
+	name    string
+	ticket  string
+	options map[string]string
+}{
+	{
+		"empty",
+		`{"version": "1.0", "print": {}}`,
+		map[string]string{},
+	},
+	{
+		"vendor items",
+		`{"version": "1.0", "print": {"vendor_ticket_item": [
+			{"id": "InputSlot", "value": "Tray2"},
+			{"id": "Staple", "value": "true"},
+			{"id": "Booklet", "value": "false"},
+			{"id": "PIN", "value": "None"},
+			{"id": "PIN.Custom", "value": "1234"},
+			{"id": "Account.Custom", "value": ""}]}}`,
+		map[string]string{
+			"InputSlot": "Tray2",
+			"Staple":    "True",
+			"Booklet":   "False",
+			"PIN":       "Custom.1234",
+		},
+	},
+	{
+		"color by vendor ID",
+		`{"version": "1.0", "print": {"color": {"vendor_id": "Gray", "type": "STANDARD_MONOCHROME"}}}`,
+		map[string]string{"ColorModel": "Gray"},
+	},
+	{
+		"color by type",
+		`{"version": "1.0", "print": {"color": {"type": "STANDARD_COLOR"}}}`,
+		map[string]string{"print-color-mode": "color"},
+	},
+	{
+		"duplex and orientation",
+		`{"version": "1.0", "print": {"duplex": {"type": "SHORT_EDGE"}, "page_orientation": {"type": "LANDSCAPE"}}}`,
+		map[string]string{"Duplex": "DuplexTumble", "orientation-requested": "4"},
+	},
+	{
+		"automatic orientation",
+		`{"version": "1.0", "print": {"page_orientation": {"type": "AUTO"}}}`,
+		map[string]string{},
+	},
+	{
+		"copies and collation",
+		`{"version": "1.0", "print": {"copies": {"copies": 3}, "collate": {"collate": false}}}`,
+		map[string]string{
+			"copies":                     "3",
+			"Collate":                    "False",
+			"multiple-document-handling": "separate-documents-uncollated-copies",
+		},
+	},
+	{
+		"margins",
+		`{"version": "1.0", "print": {"margins": {"top_microns": 25400, "right_microns": 12700, "bottom_microns": 0, "left_microns": 6350}}}`,
+		map[string]string{"page-top": "72", "page-right": "36", "page-bottom": "0", "page-left": "18"},
+	},
+	{
+		"square DPI",
+		`{"version": "1.0", "print": {"dpi": {"horizontal_dpi": 600, "vertical_dpi": 600}}}`,
+		map[string]string{"Resolution": "600dpi"},
+	},
+	{
+		"rectangular DPI",
+		`{"version": "1.0", "print": {"dpi": {"horizontal_dpi": 1200, "vertical_dpi": 600}}}`,
+		map[string]string{"Resolution": "1200x600dpi"},
+	},
+	{
+		"DPI by vendor ID",
+		`{"version": "1.0", "print": {"dpi": {"horizontal_dpi": 300, "vertical_dpi": 300, "vendor_id": "300x300dpi"}}}`,
+		map[string]string{"Resolution": "300x300dpi"},
+	},
+	{
+		"fit to page",
+		`{"version": "1.0", "print": {"fit_to_page": {"type": "FIT_TO_PAGE"}}}`,
+		map[string]string{"fit-to-page": "true", "print-scaling": "fit"},
+	},
+	{
+		"fill page",
+		`{"version": "1.0", "print": {"fit_to_page": {"type": "FILL_PAGE"}}}`,
+		map[string]string{"fit-to-page": "true", "print-scaling": "fill"},
+	},
+	{
+		"no fitting",
+		`{"version": "1.0", "print": {"fit_to_page": {"type": "NO_FITTING"}}}`,
+		map[string]string{"fit-to-page": "false", "print-scaling": "none"},
+	},
+	{
+		"page ranges",
+		`{"version": "1.0", "print": {"page_range": {"interval": [{"start": 1, "end": 3}, {"start": 5, "end": 5}, {"start": 7}]}}}`,
+		map[string]string{"page-ranges": "1-3,5,7-"},
+	},
+	{
+		"invalid page range",
+		`{"version": "1.0", "print": {"page_range": {"interval": [{"start": 4, "end": 2}]}}}`,
+		map[string]string{},
+	},
+	{
+		"media by vendor ID",
+		`{"version": "1.0", "print": {"media_size": {"width_microns": 210000, "height_microns": 297000, "vendor_id": "A4"}}}`,
+		map[string]string{"media": "A4"},
+	},
+	{
+		"custom media",
+		`{"version": "1.0", "print": {"media_size": {"width_microns": 215900, "height_microns": 279400}}}`,
+		map[string]string{"media": "Custom.612x792"},
+	},
+	{
+		"reverse order",
+		`{"version": "1.0", "print": {"reverse_order": {"reverse_order": true}}}`,
+		map[string]string{"outputorder": "reverse"},
+	},
+}
+
+func TestTicketToOptions(t *testing.T) {
+	for _, tt := range ticketTests {
+		var ticket cdd.CloudJobTicket
+		if err := json.Unmarshal([]byte(tt.ticket), &ticket); err != nil {
+			t.Fatalf("%s: failed to unmarshal ticket: %s", tt.name, err)
+		}
+		if options := ticketToOptions(ticket); !reflect.DeepEqual(options, tt.options) {
+			t.Errorf("%s: got options %v, want %v", tt.name, options, tt.options)
+		}
+	}
+}
+
+func TestTicketCopies(t *testing.T) {
+	for _, tt := range []struct {
+		ticket   string
+		noCopies bool
+		copies   int
+	}{
+		{`{"version": "1.0", "print": {"copies": {"copies": 3}}}`, false, 1},
+		{`{"version": "1.0", "print": {"copies": {"copies": 3}}}`, true, 3},
+		{`{"version": "1.0", "print": {"copies": {"copies": 3}, "collate": {"collate": true}}}`, true, 3},
+		// CUPS makes uncollated copies.
+		{`{"version": "1.0", "print": {"copies": {"copies": 3}, "collate": {"collate": false}}}`, true, 1},
+		{`{"version": "1.0", "print": {"copies": {"copies": 1}}}`, true, 1},
+		{`{"version": "1.0", "print": {}}`, true, 1},
+	} {
+		var ticket cdd.CloudJobTicket
+		if err := json.Unmarshal([]byte(tt.ticket), &ticket); err != nil {
+			t.Fatalf("Failed to unmarshal ticket %s: %s", tt.ticket, err)
+		}
+		if copies := ticketCopies(ticket, tt.noCopies); copies != tt.copies {
+			t.Errorf("ticketCopies(%s, %t) = %d, want %d", tt.ticket, tt.noCopies, copies, tt.copies)
+		}
+	}
+}
+
+func TestMicronsToPoints(t *testing.T) {
+	for microns, points := range map[int32]string{
+		0:      "0",
+		352:    "1", // 0.998pt rounds up.
+		25400:  "72",
+		210000: "595",
+		297000: "842",
+	} {
+		if p := micronsToPoints(microns); p != points {
+			t.Errorf("micronsToPoints(%d) = %s, want %s", microns, p, points)
+		}
+	}
+}
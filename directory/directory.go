@@ -0,0 +1,66 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package directory resolves groups in a directory, like LDAP, into the
+// email addresses of their members, so that printers can be shared with
+// them.
+package directory
+
+import (
+	"sort"
+	"strings"
+)
+
+// Resolver resolves groups into the email addresses of their members.
+type Resolver interface {
+	// Members returns the email addresses of the members of all groups,
+	// lowercased, sorted, and without duplicates.
+	Members() ([]string, error)
+}
+
+// normalizeMembers lowercases, sorts, and removes duplicates and empty
+// strings from a list of email addresses.
+func normalizeMembers(members []string) []string {
+	seen := make(map[string]struct{}, len(members))
+	normalized := make([]string, 0, len(members))
+	for _, member := range members {
+		member = strings.ToLower(strings.TrimSpace(member))
+		if _, exists := seen[member]; exists || member == "" {
+			continue
+		}
+		seen[member] = struct{}{}
+		normalized = append(normalized, member)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// union is a Resolver of the members of several resolvers.
+type union []Resolver
+
+// Union returns a Resolver of the members of all resolvers, which fails
+// when one of them fails.
+func Union(resolvers ...Resolver) Resolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	return union(resolvers)
+}
+
+// Members implements Resolver.
+func (u union) Members() ([]string, error) {
+	var members []string
+	for _, resolver := range u {
+		m, err := resolver.Members()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m...)
+	}
+	return normalizeMembers(members), nil
+}
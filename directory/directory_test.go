@@ -0,0 +1,22 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package directory
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeMembers(t *testing.T) {
+	got := normalizeMembers([]string{"Bob@Example.com", "", "alice@example.com", " bob@example.com", "carol@example.com"})
+	want := []string{"alice@example.com", "bob@example.com", "carol@example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeMembers() = %v, want %v", got, want)
+	}
+}
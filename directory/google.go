@@ -0,0 +1,214 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	googleDirectoryURL = "https://admin.googleapis.com/admin/directory/v1/"
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+
+	// How long to wait for the Directory API to answer a request.
+	googleDirectoryTimeout = 30 * time.Second
+)
+
+// Read-only scopes of the Directory API, which the service account needs.
+var googleDirectoryScopes = []string{
+	"https://www.googleapis.com/auth/admin.directory.user.readonly",
+	"https://www.googleapis.com/auth/admin.directory.group.member.readonly",
+}
+
+// GoogleDirectory resolves Google Workspace org units and groups into the
+// email addresses of their active users, with the Admin SDK Directory API.
+type GoogleDirectory struct {
+	client   *http.Client
+	baseURL  string
+	customer string
+	orgUnits []string
+	groups   []string
+}
+
+// serviceAccountKey is the part of a service account's JSON key that
+// signs token requests.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// NewGoogleDirectory returns a Resolver of the org units and groups in
+// config, which acts as config.AdminEmail with the service account in
+// config.CredentialsFile.
+func NewGoogleDirectory(config *lib.GoogleDirectoryShare) (*GoogleDirectory, error) {
+	b, err := ioutil.ReadFile(config.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Google directory credentials: %s", err)
+	}
+	var key serviceAccountKey
+	if err = json.Unmarshal(b, &key); err != nil {
+		return nil, fmt.Errorf("Failed to parse Google directory credentials %s: %s", config.CredentialsFile, err)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("Google directory credentials %s aren't the JSON key of a service account", config.CredentialsFile)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = googleTokenURL
+	}
+
+	jwtConfig := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Subject:      config.AdminEmail,
+		Scopes:       googleDirectoryScopes,
+		TokenURL:     key.TokenURI,
+	}
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, &http.Client{Timeout: googleDirectoryTimeout})
+	client := jwtConfig.Client(ctx)
+	client.Timeout = googleDirectoryTimeout
+
+	customer := config.Customer
+	if customer == "" {
+		customer = lib.DefaultGoogleDirectoryCustomer
+	}
+	return newGoogleDirectory(client, googleDirectoryURL, customer, config.OrgUnits, config.Groups), nil
+}
+
+func newGoogleDirectory(client *http.Client, baseURL, customer string, orgUnits, groups []string) *GoogleDirectory {
+	return &GoogleDirectory{
+		client:   client,
+		baseURL:  baseURL,
+		customer: customer,
+		orgUnits: orgUnits,
+		groups:   groups,
+	}
+}
+
+// Members returns the email addresses of the active users of all org units
+// and groups.
+//
+// Implements Resolver.
+func (d *GoogleDirectory) Members() ([]string, error) {
+	var members []string
+	for _, orgUnit := range d.orgUnits {
+		m, err := d.orgUnitUsers(orgUnit)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m...)
+	}
+	for _, group := range d.groups {
+		m, err := d.groupMembers(group)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m...)
+	}
+	return normalizeMembers(members), nil
+}
+
+// orgUnitUsers returns the email addresses of the users that aren't
+// suspended in an org unit, and in its child org units.
+func (d *GoogleDirectory) orgUnitUsers(orgUnit string) ([]string, error) {
+	query := url.Values{}
+	query.Set("customer", d.customer)
+	query.Set("query", fmt.Sprintf("orgUnitPath='%s' isSuspended=false", orgUnit))
+	query.Set("maxResults", "500")
+	query.Set("fields", "users(primaryEmail),nextPageToken")
+
+	var users []string
+	for {
+		var page struct {
+			Users []struct {
+				PrimaryEmail string `json:"primaryEmail"`
+			} `json:"users"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := d.get("users", query, &page); err != nil {
+			return nil, fmt.Errorf("Failed to list the users of org unit %s: %s", orgUnit, err)
+		}
+		for _, user := range page.Users {
+			users = append(users, user.PrimaryEmail)
+		}
+		if page.NextPageToken == "" {
+			return users, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// groupMembers returns the email addresses of the active users in a group,
+// and in the groups nested in it.
+func (d *GoogleDirectory) groupMembers(group string) ([]string, error) {
+	query := url.Values{}
+	query.Set("includeDerivedMembership", "true")
+	query.Set("maxResults", "200")
+	query.Set("fields", "members(email,type,status),nextPageToken")
+
+	var members []string
+	for {
+		var page struct {
+			Members []struct {
+				Email  string `json:"email"`
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"members"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := d.get(fmt.Sprintf("groups/%s/members", url.PathEscape(group)), query, &page); err != nil {
+			return nil, fmt.Errorf("Failed to list the members of group %s: %s", group, err)
+		}
+		for _, member := range page.Members {
+			// Nested groups are listed too, besides their users.
+			if member.Type == "USER" && member.Status == "ACTIVE" {
+				members = append(members, member.Email)
+			}
+		}
+		if page.NextPageToken == "" {
+			return members, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// get gets a Directory API resource, and decodes its JSON into v.
+func (d *GoogleDirectory) get(resource string, query url.Values, v interface{}) error {
+	response, err := d.client.Get(d.baseURL + resource + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(response.Body).Decode(&body) == nil && body.Error.Message != "" {
+			return fmt.Errorf("%s: %s", response.Status, body.Error.Message)
+		}
+		return fmt.Errorf("%s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package directory
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGoogleDirectoryMembers(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch r.URL.Path {
+		case "/users":
+			if got, want := query.Get("query"), "orgUnitPath='/Engineering' isSuspended=false"; got != want {
+				t.Errorf("users query = %q, want %q", got, want)
+			}
+			if query.Get("pageToken") == "" {
+				fmt.Fprint(w, `{"users": [{"primaryEmail": "Bob@example.com"}], "nextPageToken": "2"}`)
+			} else {
+				fmt.Fprint(w, `{"users": [{"primaryEmail": "alice@example.com"}]}`)
+			}
+		case "/groups/printing@example.com/members":
+			fmt.Fprint(w, `{"members": [
+				{"email": "carol@example.com", "type": "USER", "status": "ACTIVE"},
+				{"email": "dave@example.com", "type": "USER", "status": "SUSPENDED"},
+				{"email": "nested@example.com", "type": "GROUP", "status": "ACTIVE"},
+				{"email": "bob@example.com", "type": "USER", "status": "ACTIVE"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"message": "Resource Not Found"}}`)
+		}
+	}))
+	defer s.Close()
+
+	d := newGoogleDirectory(http.DefaultClient, s.URL+"/", "my_customer", []string{"/Engineering"}, []string{"printing@example.com"})
+	got, err := d.Members()
+	if err != nil {
+		t.Fatalf("Members failed: %s", err)
+	}
+	want := []string{"alice@example.com", "bob@example.com", "carol@example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Members() = %v, want %v", got, want)
+	}
+
+	d = newGoogleDirectory(http.DefaultClient, s.URL+"/", "my_customer", nil, []string{"missing@example.com"})
+	if _, err = d.Members(); err == nil {
+		t.Error("Members of a missing group succeeded, want an error")
+	}
+}
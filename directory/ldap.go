@@ -0,0 +1,176 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package directory
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+	"gopkg.in/ldap.v2"
+)
+
+// How long to wait for the LDAP server to answer.
+const ldapTimeout = 30 * time.Second
+
+// LDAP resolves LDAP groups into the email addresses of their members,
+// including the members of nested groups.
+type LDAP struct {
+	address         string
+	useTLS          bool
+	startTLS        bool
+	tlsConfig       *tls.Config
+	bindDN          string
+	bindPassword    string
+	groups          []string
+	memberAttribute string
+	mailAttribute   string
+}
+
+// NewLDAP returns a Resolver of the groups in config.
+func NewLDAP(config *lib.LDAPShare) (*LDAP, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse LDAP URL %s: %s", config.URL, err)
+	}
+	var port string
+	switch u.Scheme {
+	case "ldap":
+		port = "389"
+	case "ldaps":
+		port = "636"
+	default:
+		return nil, fmt.Errorf("LDAP URL %s must start with ldap:// or ldaps://", config.URL)
+	}
+	host := u.Host
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		host, port = h, p
+	}
+
+	tlsConfig, err := lib.NewTLSConfig(config.CAFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.ServerName = host
+
+	l := &LDAP{
+		address:         net.JoinHostPort(host, port),
+		useTLS:          u.Scheme == "ldaps",
+		startTLS:        u.Scheme == "ldap" && config.StartTLS,
+		tlsConfig:       tlsConfig,
+		bindDN:          config.BindDN,
+		bindPassword:    config.BindPassword,
+		groups:          config.Groups,
+		memberAttribute: config.MemberAttribute,
+		mailAttribute:   config.MailAttribute,
+	}
+	if l.memberAttribute == "" {
+		l.memberAttribute = lib.DefaultLDAPMemberAttribute
+	}
+	if l.mailAttribute == "" {
+		l.mailAttribute = lib.DefaultLDAPMailAttribute
+	}
+	return l, nil
+}
+
+// connect connects to the LDAP server, and binds.
+func (l *LDAP) connect() (*ldap.Conn, error) {
+	var conn *ldap.Conn
+	var err error
+	if l.useTLS {
+		conn, err = ldap.DialTLS("tcp", l.address, l.tlsConfig)
+	} else {
+		conn, err = ldap.Dial("tcp", l.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to LDAP server %s: %s", l.address, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if l.startTLS {
+		if err = conn.StartTLS(l.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to start TLS with LDAP server %s: %s", l.address, err)
+		}
+	}
+	if l.bindDN != "" {
+		if err = conn.Bind(l.bindDN, l.bindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to bind to LDAP server %s as %s: %s", l.address, l.bindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// Members returns the email addresses of the members of all groups.
+//
+// Implements Resolver.
+func (l *LDAP) Members() ([]string, error) {
+	conn, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var members []string
+	visited := make(map[string]struct{})
+	for _, group := range l.groups {
+		m, err := l.resolve(conn, group, visited, true)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m...)
+	}
+	return normalizeMembers(members), nil
+}
+
+// resolve returns the email address of the entry with dn, or the email
+// addresses of its members when it's a group, which has members; a group's
+// own address isn't among them. Entries in visited are skipped, so that
+// cycles of groups end. A missing configured group is an error, rather
+// than a group without members.
+func (l *LDAP) resolve(conn *ldap.Conn, dn string, visited map[string]struct{}, configured bool) ([]string, error) {
+	if _, exists := visited[dn]; exists {
+		return nil, nil
+	}
+	visited[dn] = struct{}{}
+
+	request := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, int(ldapTimeout/time.Second),
+		false, "(objectClass=*)", []string{l.memberAttribute, l.mailAttribute}, nil)
+	result, err := conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) && !configured {
+		// A member that was deleted, or that the bind DN can't see.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up %s in LDAP: %s", dn, err)
+	}
+
+	var members []string
+	for _, entry := range result.Entries {
+		memberDNs := entry.GetAttributeValues(l.memberAttribute)
+		if len(memberDNs) == 0 {
+			members = append(members, entry.GetAttributeValues(l.mailAttribute)...)
+		}
+		for _, memberDN := range memberDNs {
+			m, err := l.resolve(conn, memberDN, visited, false)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, m...)
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package discovery finds IPP printers on the local network, over mDNS and
+// with an SNMP sweep, and adds CUPS queues for them.
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// How long to wait for mDNS answers.
+	mdnsTimeout = 4 * time.Second
+
+	// How long to wait for the IPP port of a printer found over SNMP.
+	ippDialTimeout = 2 * time.Second
+
+	// The IPP port, and the IPP Everywhere resource path.
+	ippPort     = 631
+	ippResource = "ipp/print"
+
+	// Longest CUPS queue name.
+	queueNameMaxLength = 127
+)
+
+// Document formats that CUPS can make an IPP Everywhere PPD for.
+var everywherePDLs = []string{"image/pwg-raster", "image/urf", "application/pdf"}
+
+// Printer is an IPP printer found on the network.
+type Printer struct {
+	// The mDNS service instance name, or empty when found over SNMP.
+	Name      string
+	Host      string
+	Port      uint16
+	Resource  string
+	Secure    bool
+	MakeModel string
+	Location  string
+	// Comma-separated document formats, from the mDNS pdl key.
+	PDLs string
+}
+
+// DeviceURI returns the CUPS device-uri of p.
+func (p *Printer) DeviceURI() string {
+	scheme := "ipp"
+	if p.Secure {
+		scheme = "ipps"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port))),
+		Path:   "/" + p.Resource,
+	}
+	return u.String()
+}
+
+// key identifies p across discoveries: by mDNS instance name, which
+// outlives DHCP leases, or else by address.
+func (p *Printer) key() string {
+	if p.Name != "" {
+		return "mdns:" + strings.ToLower(p.Name)
+	}
+	return p.Host
+}
+
+// supportsEverywhere tells whether p advertises a document format that
+// CUPS can drive without a vendor PPD. Printers that don't advertise
+// formats are assumed to.
+func (p *Printer) supportsEverywhere() bool {
+	if p.PDLs == "" {
+		return true
+	}
+	for _, pdl := range strings.Split(p.PDLs, ",") {
+		for _, e := range everywherePDLs {
+			if strings.EqualFold(strings.TrimSpace(pdl), e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// QueueBackend lists and adds CUPS queues.
+type QueueBackend interface {
+	GetDeviceURIs() (map[string]string, error)
+	AddEverywherePrinter(printername, deviceURI, info, location string) error
+}
+
+// PrinterFinder finds the hosts that answer SNMP as printers.
+type PrinterFinder interface {
+	FindPrinters(hostnames []string) ([]string, error)
+}
+
+// Discovery periodically finds IPP printers on the local network, and adds
+// a CUPS queue, with a PPD that CUPS makes from the printer, for each
+// printer that no queue prints to yet.
+type Discovery struct {
+	backend  QueueBackend
+	snmp     PrinterFinder
+	networks []*net.IPNet
+	added    func()
+
+	// Printers that this connector added queues for, or skipped, by
+	// Printer.key, so that a queue that an admin deletes is not added again.
+	handled map[string]struct{}
+
+	quit chan struct{}
+}
+
+// NewDiscovery starts to look for printers every interval, over mDNS, and
+// over SNMP in networks when snmp is not nil. added is called after queues
+// are added.
+func NewDiscovery(backend QueueBackend, snmp PrinterFinder, networks []string, interval time.Duration, added func()) (*Discovery, error) {
+	ipNets := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse discovery network %s: %s", network, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+
+	d := Discovery{
+		backend:  backend,
+		snmp:     snmp,
+		networks: ipNets,
+		added:    added,
+		handled:  make(map[string]struct{}),
+		quit:     make(chan struct{}),
+	}
+
+	go func() {
+		t := time.NewTimer(0)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				d.discover()
+				t.Reset(interval)
+			case <-d.quit:
+				return
+			}
+		}
+	}()
+
+	return &d, nil
+}
+
+func (d *Discovery) Quit() {
+	close(d.quit)
+}
+
+// discover finds printers and adds queues for the new ones.
+func (d *Discovery) discover() {
+	printers, err := browseMDNS(mdnsTimeout)
+	if err != nil {
+		glog.Warningf("Failed to discover printers over mDNS: %s", err)
+	}
+	if d.snmp != nil && len(d.networks) > 0 {
+		swept, err := d.sweep(printers)
+		if err != nil {
+			glog.Warningf("Failed to discover printers over SNMP: %s", err)
+		}
+		printers = append(printers, swept...)
+	}
+	if len(printers) == 0 {
+		return
+	}
+
+	deviceURIs, err := d.backend.GetDeviceURIs()
+	if err != nil {
+		glog.Warningf("Failed to list CUPS queues to add discovered printers to: %s", err)
+		return
+	}
+	hosts := make(map[string]struct{}, len(deviceURIs))
+	for _, deviceURI := range deviceURIs {
+		hosts[deviceURIHost(deviceURI)] = struct{}{}
+	}
+
+	var added int
+	for i := range printers {
+		p := &printers[i]
+		if _, exists := d.handled[p.key()]; exists {
+			continue
+		}
+		if _, exists := hosts[strings.ToLower(p.Host)]; exists {
+			continue
+		}
+		if p.Name != "" {
+			if _, exists := hosts[strings.ToLower(p.Name)]; exists {
+				continue
+			}
+		}
+		if !p.supportsEverywhere() {
+			glog.Infof("Not adding a CUPS queue for discovered printer %s at %s, which supports none of %s", p.Name, p.Host, strings.Join(everywherePDLs, ", "))
+			d.handled[p.key()] = struct{}{}
+			continue
+		}
+
+		name := queueName(p, deviceURIs)
+		info := p.Name
+		if info == "" {
+			info = p.MakeModel
+		}
+		if err := d.backend.AddEverywherePrinter(name, p.DeviceURI(), info, p.Location); err != nil {
+			glog.Errorf("Failed to add a CUPS queue for discovered printer %s: %s", p.DeviceURI(), err)
+			continue
+		}
+		glog.Infof("Added CUPS queue %s for discovered printer %s", name, p.DeviceURI())
+		d.handled[p.key()] = struct{}{}
+		deviceURIs[name] = p.DeviceURI()
+		added++
+	}
+
+	if added > 0 && d.added != nil {
+		d.added()
+	}
+}
+
+// sweep asks every address of the networks for the Printer MIB over SNMP,
+// and returns the printers that answer, and that accept IPP connections.
+// Hosts of known printers are skipped.
+func (d *Discovery) sweep(known []Printer) ([]Printer, error) {
+	skip := make(map[string]struct{}, len(known))
+	for _, p := range known {
+		skip[p.Host] = struct{}{}
+	}
+
+	var hostnames []string
+	for _, ipNet := range d.networks {
+		for _, ip := range networkHosts(ipNet) {
+			if _, exists := skip[ip]; !exists {
+				hostnames = append(hostnames, ip)
+			}
+		}
+	}
+
+	hosts, err := d.snmp.FindPrinters(hostnames)
+	if err != nil {
+		return nil, err
+	}
+
+	printers := make([]Printer, 0, len(hosts))
+	for _, host := range hosts {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(ippPort)), ippDialTimeout)
+		if err != nil {
+			glog.V(1).Infof("Printer %s answers SNMP, but not IPP: %s", host, err)
+			continue
+		}
+		conn.Close()
+		printers = append(printers, Printer{Host: host, Port: ippPort, Resource: ippResource})
+	}
+	return printers, nil
+}
+
+// networkHosts returns the IPv4 host addresses of a network, without its
+// network and broadcast addresses.
+func networkHosts(ipNet *net.IPNet) []string {
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		return nil
+	}
+	ones, bits := ipNet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	first := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+
+	hosts := make([]string, 0, size)
+	for i := uint32(0); i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		n := first + i
+		hosts = append(hosts, net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String())
+	}
+	return hosts
+}
+
+// deviceURIHost returns the lower case host that a CUPS device-uri prints
+// to. For dnssd URIs, like dnssd://Printer%20Name._ipp._tcp.local./, that is
+// the service instance name.
+func deviceURIHost(deviceURI string) string {
+	if strings.HasPrefix(deviceURI, "dnssd://") {
+		name := strings.SplitN(strings.TrimPrefix(deviceURI, "dnssd://"), "/", 2)[0]
+		if n, err := url.PathUnescape(name); err == nil {
+			name = n
+		}
+		name = strings.ToLower(name)
+		for _, serviceType := range ippServiceTypes {
+			if i := strings.Index(name, "."+strings.SplitN(serviceType, ".", 2)[0]+"."); i > 0 {
+				return name[:i]
+			}
+		}
+		return name
+	}
+
+	u, err := url.Parse(deviceURI)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// queueName makes a CUPS queue name for p, unused in deviceURIs. CUPS
+// queue names can't have spaces, slashes, quotes or #.
+func queueName(p *Printer, deviceURIs map[string]string) string {
+	base := p.Name
+	if base == "" {
+		base = "printer-" + p.Host
+	}
+	base = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, base)
+	if len(base) > queueNameMaxLength-4 {
+		base = base[:queueNameMaxLength-4]
+	}
+
+	name := base
+	for i := 2; ; i++ {
+		if _, exists := deviceURIs[name]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
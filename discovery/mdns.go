@@ -0,0 +1,333 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA   uint16 = 1
+	dnsTypePTR uint16 = 12
+	dnsTypeTXT uint16 = 16
+	dnsTypeSRV uint16 = 33
+
+	dnsClassIN uint16 = 1
+
+	// Longest DNS name, and most compression pointers followed in one name.
+	dnsMaxNameLength = 255
+	dnsMaxPointers   = 32
+
+	// The mDNS group and port, RFC 6762.
+	mdnsAddress = "224.0.0.251:5353"
+)
+
+// DNS-SD service types of IPP printers, RFC 8010 and PWG 5100.14.
+var ippServiceTypes = []string{"_ipp._tcp.local", "_ipps._tcp.local"}
+
+// dnsRecord is a resource record of a DNS message, with the fields of the
+// types that DNS-SD uses.
+type dnsRecord struct {
+	name   []string
+	rrtype uint16
+	// PTR and SRV.
+	target []string
+	// SRV.
+	port uint16
+	// TXT.
+	txt map[string]string
+	// A.
+	ip net.IP
+}
+
+// dnsQuestion is a question of a DNS query.
+type dnsQuestion struct {
+	name   []string
+	rrtype uint16
+}
+
+// dnsName joins labels into a lower case name, to compare names.
+func dnsName(labels []string) string {
+	escaped := make([]string, len(labels))
+	for i, label := range labels {
+		escaped[i] = strings.Replace(strings.ToLower(label), ".", `\.`, -1)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// newDNSQuery builds a DNS query message.
+func newDNSQuery(questions []dnsQuestion) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	for _, q := range questions {
+		for _, label := range q.name {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+		msg = append(msg, 0, byte(q.rrtype>>8), byte(q.rrtype), byte(dnsClassIN>>8), byte(dnsClassIN))
+	}
+	return msg
+}
+
+// readDNSName reads the labels of the name at offset off of msg, following
+// compression pointers. Returns the offset after the name.
+func readDNSName(msg []byte, off int) ([]string, int, error) {
+	var labels []string
+	end := -1
+	length := 0
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return nil, 0, errors.New("DNS name is truncated")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return labels, end, nil
+
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return nil, 0, errors.New("DNS name is truncated")
+			}
+			if pointers++; pointers > dnsMaxPointers {
+				return nil, 0, errors.New("DNS name has too many compression pointers")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+
+		case l&0xc0 != 0:
+			return nil, 0, fmt.Errorf("DNS name has an unknown label type %#x", l&0xc0)
+
+		default:
+			if off+1+l > len(msg) {
+				return nil, 0, errors.New("DNS name is truncated")
+			}
+			if length += l + 1; length > dnsMaxNameLength {
+				return nil, 0, errors.New("DNS name is too long")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// parseDNSMessage returns the answer, authority and additional records of
+// msg.
+func parseDNSMessage(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("DNS message is truncated")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	records := make([]dnsRecord, 0, count)
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errors.New("DNS record is truncated")
+		}
+		r := dnsRecord{name: name, rrtype: binary.BigEndian.Uint16(msg[off:])}
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, errors.New("DNS record data is truncated")
+		}
+		rdata := msg[off : off+rdlength]
+
+		switch r.rrtype {
+		case dnsTypePTR:
+			if r.target, _, err = readDNSName(msg, off); err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if rdlength < 7 {
+				return nil, errors.New("DNS SRV record is truncated")
+			}
+			r.port = binary.BigEndian.Uint16(rdata[4:])
+			if r.target, _, err = readDNSName(msg, off+6); err != nil {
+				return nil, err
+			}
+		case dnsTypeTXT:
+			r.txt = make(map[string]string)
+			for j := 0; j < len(rdata); {
+				l := int(rdata[j])
+				if j+1+l > len(rdata) {
+					return nil, errors.New("DNS TXT record is truncated")
+				}
+				kv := string(rdata[j+1 : j+1+l])
+				if k := strings.SplitN(kv, "=", 2); len(k) == 2 {
+					r.txt[strings.ToLower(k[0])] = k[1]
+				} else if kv != "" {
+					r.txt[strings.ToLower(kv)] = ""
+				}
+				j += 1 + l
+			}
+		case dnsTypeA:
+			if rdlength != net.IPv4len {
+				return nil, errors.New("DNS A record has the wrong length")
+			}
+			r.ip = net.IP(append([]byte{}, rdata...))
+		}
+		records = append(records, r)
+		off += rdlength
+	}
+
+	return records, nil
+}
+
+// browseMDNS asks for IPP printers over multicast DNS, on the interface of
+// the default route, and returns those that answer within timeout.
+//
+// The query is sent from an ephemeral port, so responders answer by unicast
+// to that port (RFC 6762 section 6.7), and the connector need not bind port
+// 5353, which Avahi or mDNSResponder may hold.
+func browseMDNS(timeout time.Duration) ([]Printer, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open a socket for mDNS: %s", err)
+	}
+	defer conn.Close()
+
+	var records []dnsRecord
+	exchange := func(questions []dnsQuestion, wait time.Duration) error {
+		if _, err := conn.WriteToUDP(newDNSQuery(questions), group); err != nil {
+			return fmt.Errorf("Failed to send mDNS query: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		buf := make([]byte, 9000)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					return nil
+				}
+				return fmt.Errorf("Failed to read mDNS responses: %s", err)
+			}
+			if rs, err := parseDNSMessage(buf[:n]); err == nil {
+				records = append(records, rs...)
+			}
+		}
+	}
+
+	questions := make([]dnsQuestion, len(ippServiceTypes))
+	for i, serviceType := range ippServiceTypes {
+		questions[i] = dnsQuestion{strings.Split(serviceType, "."), dnsTypePTR}
+	}
+	if err = exchange(questions, timeout/2); err != nil {
+		return nil, err
+	}
+
+	// Responders usually add the SRV, TXT and A records of the instances
+	// to their answers; ask for those that they didn't.
+	_, missing := printersFromRecords(records)
+	if len(missing) > 0 {
+		if err = exchange(missing, timeout/2); err != nil {
+			return nil, err
+		}
+	}
+
+	printers, _ := printersFromRecords(records)
+	return printers, nil
+}
+
+// printersFromRecords assembles the IPP printers that records describe.
+// Also returns the questions to ask for the records that are missing to
+// describe the other printers.
+func printersFromRecords(records []dnsRecord) ([]Printer, []dnsQuestion) {
+	srvs := make(map[string]dnsRecord)
+	txts := make(map[string]dnsRecord)
+	ips := make(map[string]net.IP)
+	for _, r := range records {
+		switch r.rrtype {
+		case dnsTypeSRV:
+			srvs[dnsName(r.name)] = r
+		case dnsTypeTXT:
+			txts[dnsName(r.name)] = r
+		case dnsTypeA:
+			ips[dnsName(r.name)] = r.ip
+		}
+	}
+
+	serviceTypes := make(map[string]struct{}, len(ippServiceTypes))
+	for _, serviceType := range ippServiceTypes {
+		serviceTypes[serviceType] = struct{}{}
+	}
+
+	printers := make([]Printer, 0)
+	var missing []dnsQuestion
+	seen := make(map[string]struct{})
+	for _, r := range records {
+		if r.rrtype != dnsTypePTR || len(r.name) == 0 || len(r.target) < 2 {
+			continue
+		}
+		// Any host may answer, with records of other services too.
+		if _, exists := serviceTypes[dnsName(r.name)]; !exists {
+			continue
+		}
+		instance := dnsName(r.target)
+		if _, exists := seen[instance]; exists {
+			continue
+		}
+		seen[instance] = struct{}{}
+
+		srv, srvExists := srvs[instance]
+		txt, txtExists := txts[instance]
+		if !srvExists || !txtExists {
+			missing = append(missing, dnsQuestion{r.target, dnsTypeSRV}, dnsQuestion{r.target, dnsTypeTXT})
+			continue
+		}
+		ip, ipExists := ips[dnsName(srv.target)]
+		if !ipExists {
+			missing = append(missing, dnsQuestion{srv.target, dnsTypeA})
+			continue
+		}
+
+		rp := strings.TrimPrefix(txt.txt["rp"], "/")
+		if rp == "" {
+			rp = "ipp/print"
+		}
+		printers = append(printers, Printer{
+			Name:      r.target[0],
+			Host:      ip.String(),
+			Port:      srv.port,
+			Resource:  rp,
+			Secure:    strings.ToLower(r.name[0]) == "_ipps",
+			MakeModel: txt.txt["ty"],
+			Location:  txt.txt["note"],
+			PDLs:      txt.txt["pdl"],
+		})
+	}
+
+	return printers, missing
+}
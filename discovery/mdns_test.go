@@ -0,0 +1,150 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package discovery
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// dnsResponse builds a DNS response with one PTR answer, and SRV, TXT and A
+// additional records, using compression pointers like mDNS responders do.
+func dnsResponse() []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	binary.BigEndian.PutUint16(msg[10:], 3)
+
+	record := func(name []byte, rrtype uint16, rdata []byte) {
+		msg = append(msg, name...)
+		msg = append(msg, byte(rrtype>>8), byte(rrtype), 0x80, 1, 0, 0, 0x11, 0x94, byte(len(rdata)>>8), byte(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	pointer := func(off int) []byte {
+		return []byte{0xc0 | byte(off>>8), byte(off)}
+	}
+
+	// _ipp._tcp.local PTR "Office Printer"._ipp._tcp.local
+	serviceOff := len(msg)
+	record([]byte("\x04_ipp\x04_tcp\x05local\x00"), dnsTypePTR, nil)
+	instanceOff := len(msg)
+	rdata := append([]byte("\x0eOffice Printer"), pointer(serviceOff)...)
+	msg = msg[:len(msg)-2]
+	msg = append(msg, byte(len(rdata)>>8), byte(len(rdata)))
+	msg = append(msg, rdata...)
+
+	// SRV 0 0 631 printer.local
+	hostOff := len(msg) + 2 + 10 + 6
+	record(pointer(instanceOff), dnsTypeSRV, append([]byte{0, 0, 0, 0, 0x02, 0x77, 0x07}, append([]byte("printer"), pointer(serviceOff+10)...)...))
+	record(pointer(instanceOff), dnsTypeTXT, []byte("\x0crp=ipp/print\x0dty=Acme Laser\x0cnote=Floor 2\x14pdl=image/pwg-raster"))
+	record(pointer(hostOff), dnsTypeA, []byte{192, 168, 1, 20})
+
+	return msg
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	records, err := parseDNSMessage(dnsResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Got %d records, expected 4", len(records))
+	}
+	if got := dnsName(records[0].target); got != "office printer._ipp._tcp.local" {
+		t.Errorf("PTR target %q", got)
+	}
+	if records[1].port != 631 || dnsName(records[1].target) != "printer.local" {
+		t.Errorf("SRV %d %q", records[1].port, dnsName(records[1].target))
+	}
+
+	printers, missing := printersFromRecords(records)
+	if len(missing) > 0 {
+		t.Errorf("Missing %v", missing)
+	}
+	expected := []Printer{{
+		Name:      "Office Printer",
+		Host:      "192.168.1.20",
+		Port:      631,
+		Resource:  "ipp/print",
+		MakeModel: "Acme Laser",
+		Location:  "Floor 2",
+		PDLs:      "image/pwg-raster",
+	}}
+	if !reflect.DeepEqual(printers, expected) {
+		t.Fatalf("Got %+v, expected %+v", printers, expected)
+	}
+	if uri := printers[0].DeviceURI(); uri != "ipp://192.168.1.20:631/ipp/print" {
+		t.Errorf("Device URI %s", uri)
+	}
+}
+
+func TestParseDNSMessagePointerLoop(t *testing.T) {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	msg = append(msg, 0xc0, 12)
+	if _, err := parseDNSMessage(msg); err == nil {
+		t.Error("Parsed a name that points to itself")
+	}
+}
+
+func TestPrintersFromRecordsMissing(t *testing.T) {
+	records := []dnsRecord{{
+		name:   []string{"_ipp", "_tcp", "local"},
+		rrtype: dnsTypePTR,
+		target: []string{"Printer", "_ipp", "_tcp", "local"},
+	}}
+	printers, missing := printersFromRecords(records)
+	if len(printers) != 0 {
+		t.Errorf("Got printers %+v without SRV records", printers)
+	}
+	if len(missing) != 2 || missing[0].rrtype != dnsTypeSRV || missing[1].rrtype != dnsTypeTXT {
+		t.Errorf("Missing %+v, expected SRV and TXT questions", missing)
+	}
+}
+
+func TestPrintersFromRecordsIgnoresOtherOwners(t *testing.T) {
+	records := []dnsRecord{{
+		// The root name.
+		name:   nil,
+		rrtype: dnsTypePTR,
+		target: []string{"Root", "_ipp", "_tcp", "local"},
+	}, {
+		name:   []string{"_http", "_tcp", "local"},
+		rrtype: dnsTypePTR,
+		target: []string{"Web", "_http", "_tcp", "local"},
+	}}
+	printers, missing := printersFromRecords(records)
+	if len(printers) != 0 || len(missing) != 0 {
+		t.Errorf("Got printers %+v and missing %+v from PTR records of other owners", printers, missing)
+	}
+}
+
+func TestDeviceURIHost(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"ipp://192.168.1.20:631/ipp/print":                     "192.168.1.20",
+		"socket://Printer.Example.com":                         "printer.example.com",
+		"dnssd://Office%20Printer._ipp._tcp.local./?uuid=1234": "office printer",
+		"usb://Acme/Laser?serial=1":                            "acme",
+		"ipps://[fe80::1]:443/ipp/print":                       "fe80::1",
+	} {
+		if got := deviceURIHost(uri); got != expected {
+			t.Errorf("deviceURIHost(%q) = %q, expected %q", uri, got, expected)
+		}
+	}
+}
+
+func TestQueueName(t *testing.T) {
+	existing := map[string]string{"Office_Printer": "ipp://10.0.0.1/ipp/print"}
+	if got := queueName(&Printer{Name: "Office Printer"}, existing); got != "Office_Printer-2" {
+		t.Errorf("Got queue name %q", got)
+	}
+	if got := queueName(&Printer{Host: "10.0.0.2"}, existing); got != "printer-10_0_0_2" {
+		t.Errorf("Got queue name %q", got)
+	}
+}
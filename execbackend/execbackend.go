@@ -0,0 +1,344 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package execbackend is a print backend that delegates to executables,
+// for devices that CUPS doesn't drive. Executables can be sandboxed; see
+// lib.Sandbox. Each executable reads a JSON request
+// on its standard input and writes a JSON response on its standard output.
+// Exit status 75 (EX_TEMPFAIL) means that the device is temporarily
+// unreachable; any other non-zero status is an error, explained by what the
+// executable writes on its standard error.
+package execbackend
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// How long an executable may take to answer. A variable, for tests.
+var commandTimeout = time.Minute
+
+// Exit status of an executable that can't reach the device, from
+// sysexits.h.
+const exitTempFail = 75
+
+// ExecBackend runs executables to list printers, report their capabilities,
+// and print.
+type ExecBackend struct {
+	config lib.ExecBackendConfig
+	// Executables by key, like "print".
+	commands map[string]string
+
+	// Capabilities by printer name, until RemoveCachedPPD.
+	capabilitiesMutex sync.Mutex
+	capabilities      map[string]capabilities
+}
+
+type capabilities struct {
+	description *cdd.PrinterDescriptionSection
+	hash        string
+}
+
+// NewExecBackend runs the executables in config, which must all be set.
+func NewExecBackend(config lib.ExecBackendConfig) (*ExecBackend, error) {
+	if missing := config.Missing(); len(missing) > 0 {
+		return nil, fmt.Errorf("The exec backend needs exec_backend.%s", strings.Join(missing, ", exec_backend."))
+	}
+
+	return &ExecBackend{
+		config:       config,
+		commands:     config.Commands(),
+		capabilities: make(map[string]capabilities),
+	}, nil
+}
+
+// printer is a printer as list_printers writes it.
+type printer struct {
+	Name         string                   `json:"name"`
+	DisplayName  string                   `json:"display_name"`
+	Info         string                   `json:"info"`
+	Location     string                   `json:"location"`
+	UUID         string                   `json:"uuid"`
+	Manufacturer string                   `json:"manufacturer"`
+	Model        string                   `json:"model"`
+	State        *cdd.PrinterStateSection `json:"state"`
+	Shared       bool                     `json:"shared"`
+}
+
+func (b *ExecBackend) listPrinters() ([]printer, error) {
+	var response struct {
+		Printers []printer `json:"printers"`
+	}
+	if err := b.run("list_printers", struct{}{}, &response); err != nil {
+		return nil, err
+	}
+	for i := range response.Printers {
+		if response.Printers[i].State == nil {
+			response.Printers[i].State = &cdd.PrinterStateSection{State: cdd.CloudDeviceStateIdle}
+		}
+	}
+	return response.Printers, nil
+}
+
+// GetPrinters runs list_printers, and capabilities for each printer whose
+// capabilities aren't cached. Printers whose capabilities can't be got are
+// left out.
+func (b *ExecBackend) GetPrinters() ([]lib.Printer, error) {
+	ps, err := b.listPrinters()
+	if err != nil {
+		return nil, err
+	}
+
+	printers := make([]lib.Printer, 0, len(ps))
+	for _, p := range ps {
+		c, err := b.getCapabilities(p.Name)
+		if err != nil {
+			glog.Errorf("Failed to get capabilities of printer %s: %s", p.Name, err)
+			continue
+		}
+
+		description := *c.description
+		printer := lib.Printer{
+			Name:               p.Name,
+			DefaultDisplayName: p.DisplayName,
+			Info:               p.Info,
+			Location:           p.Location,
+			UUID:               p.UUID,
+			Manufacturer:       p.Manufacturer,
+			Model:              p.Model,
+			GCPVersion:         lib.GCPAPIVersion,
+			SetupURL:           lib.ConnectorHomeURL,
+			SupportURL:         lib.ConnectorHomeURL,
+			UpdateURL:          lib.ConnectorHomeURL,
+			ConnectorVersion:   lib.ShortName,
+			State:              p.State,
+			Description:        &description,
+			CapsHash:           c.hash,
+			Tags:               map[string]string{"printer-name": p.Name},
+		}
+		if p.Shared {
+			printer.Tags["printer-is-shared"] = "true"
+		}
+		printer.SetTagshash()
+		printers = append(printers, printer)
+	}
+
+	return printers, nil
+}
+
+// GetPrinterStates runs list_printers.
+func (b *ExecBackend) GetPrinterStates() (map[string]*cdd.PrinterStateSection, error) {
+	ps, err := b.listPrinters()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]*cdd.PrinterStateSection, len(ps))
+	for _, p := range ps {
+		states[p.Name] = p.State
+	}
+	return states, nil
+}
+
+func (b *ExecBackend) getCapabilities(printerName string) (capabilities, error) {
+	b.capabilitiesMutex.Lock()
+	c, exists := b.capabilities[printerName]
+	b.capabilitiesMutex.Unlock()
+	if exists {
+		return c, nil
+	}
+
+	var out bytes.Buffer
+	request := struct {
+		Printer string `json:"printer"`
+	}{printerName}
+	if err := b.runOutput("capabilities", request, &out); err != nil {
+		return capabilities{}, err
+	}
+	var description cdd.PrinterDescriptionSection
+	if err := json.Unmarshal(out.Bytes(), &description); err != nil {
+		return capabilities{}, fmt.Errorf("Failed to parse the output of %s: %s", b.commands["capabilities"], err)
+	}
+	c = capabilities{&description, fmt.Sprintf("%x", md5.Sum(out.Bytes()))}
+
+	b.capabilitiesMutex.Lock()
+	b.capabilities[printerName] = c
+	b.capabilitiesMutex.Unlock()
+	return c, nil
+}
+
+// RemoveCachedPPD forgets the capabilities of a printer.
+func (b *ExecBackend) RemoveCachedPPD(printerName string) {
+	b.capabilitiesMutex.Lock()
+	defer b.capabilitiesMutex.Unlock()
+	delete(b.capabilities, printerName)
+}
+
+// CreateTempFile creates a file in the default temporary directory.
+func (b *ExecBackend) CreateTempFile() (*os.File, error) {
+	return ioutil.TempFile("", "cups-connector-")
+}
+
+// Print runs print with the file that holds the document.
+func (b *ExecBackend) Print(printerName, filename, title, user, format string, ticket cdd.CloudJobTicket) (uint32, error) {
+	request := struct {
+		Printer     string             `json:"printer"`
+		File        string             `json:"file"`
+		Title       string             `json:"title"`
+		User        string             `json:"user"`
+		ContentType string             `json:"content_type"`
+		Ticket      cdd.CloudJobTicket `json:"ticket"`
+	}{printerName, filename, title, user, format, ticket}
+	var response struct {
+		JobID uint32 `json:"job_id"`
+	}
+	if err := sandboxChown(b.config.SandboxOf("print"), filename); err != nil {
+		return 0, err
+	}
+	if err := b.run("print", request, &response); err != nil {
+		return 0, err
+	}
+	if response.JobID == 0 {
+		return 0, fmt.Errorf("%s didn't answer a job_id", b.commands["print"])
+	}
+	return response.JobID, nil
+}
+
+// PrintStream always returns a *lib.StreamUnsupportedError; executables
+// print from files.
+func (b *ExecBackend) PrintStream(printerName, title, user, format string, ticket cdd.CloudJobTicket, write func(io.Writer) error) (uint32, error) {
+	return 0, &lib.StreamUnsupportedError{Message: "The exec backend prints from files"}
+}
+
+// GetJobState runs job_state.
+func (b *ExecBackend) GetJobState(jobID uint32) (cdd.PrintJobStateDiff, error) {
+	request := struct {
+		JobID uint32 `json:"job_id"`
+	}{jobID}
+	var response struct {
+		State        string `json:"state"`
+		PagesPrinted int32  `json:"pages_printed"`
+	}
+	if err := b.run("job_state", request, &response); err != nil {
+		return cdd.PrintJobStateDiff{}, err
+	}
+	return convertJobState(response.State, response.PagesPrinted)
+}
+
+// convertJobState converts a job state that job_state writes, like DONE, to
+// cdd.PrintJobStateDiff.
+func convertJobState(state string, pages int32) (cdd.PrintJobStateDiff, error) {
+	diff := cdd.PrintJobStateDiff{PagesPrinted: pages}
+
+	switch state {
+	case "IN_PROGRESS":
+		diff.State = cdd.JobState{Type: "IN_PROGRESS"}
+	case "STOPPED":
+		diff.State = cdd.JobState{
+			Type:              "STOPPED",
+			DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "OTHER"},
+		}
+	case "CANCELED":
+		diff.State = cdd.JobState{
+			Type:            "ABORTED",
+			UserActionCause: &cdd.UserActionCause{ActionCode: "CANCELLED"}, // Spelled with two L's.
+		}
+	case "ABORTED":
+		diff.State = cdd.JobState{
+			Type:              "ABORTED",
+			DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "PRINT_FAILURE"},
+		}
+	case "DONE":
+		diff.State = cdd.JobState{Type: "DONE"}
+	default:
+		return diff, fmt.Errorf("Unknown job state %q; expected IN_PROGRESS, STOPPED, CANCELED, ABORTED or DONE", state)
+	}
+
+	return diff, nil
+}
+
+// CancelJob runs cancel_job.
+func (b *ExecBackend) CancelJob(printerName, user string, jobID uint32) error {
+	request := struct {
+		Printer string `json:"printer"`
+		User    string `json:"user"`
+		JobID   uint32 `json:"job_id"`
+	}{printerName, user, jobID}
+	return b.runOutput("cancel_job", request, ioutil.Discard)
+}
+
+// run runs the executable with key, like "print", with request as JSON on
+// its standard input, and parses its standard output into response.
+func (b *ExecBackend) run(key string, request, response interface{}) error {
+	command := b.commands[key]
+	var out bytes.Buffer
+	if err := b.runOutput(key, request, &out); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out.Bytes(), response); err != nil {
+		return fmt.Errorf("Failed to parse the output of %s: %s", command, err)
+	}
+	return nil
+}
+
+// runOutput runs the executable with key, in its sandbox, with request as
+// JSON on its standard input, and copies its standard output to out.
+func (b *ExecBackend) runOutput(key string, request interface{}, out io.Writer) error {
+	command := b.commands[key]
+	r, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := sandboxCommand(b.config.SandboxOf(key), command)
+	if err != nil {
+		return fmt.Errorf("Failed to sandbox %s: %s", command, err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(r)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+
+	if err = lib.StartCommand(cmd); err != nil {
+		return fmt.Errorf("Failed to run %s: %s", command, err)
+	}
+	err = lib.WaitCommand(cmd, commandTimeout)
+	if _, ok := err.(*lib.CommandTimeoutError); ok {
+		return &lib.UnreachableError{Message: fmt.Sprintf("%s was %s", command, err)}
+	}
+	if err == nil {
+		return nil
+	}
+
+	message := fmt.Sprintf("%s failed: %s", command, err)
+	if s := strings.TrimSpace(stderr.String()); s != "" {
+		message = fmt.Sprintf("%s: %s", message, s)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == exitTempFail {
+			return &lib.UnreachableError{Message: message}
+		}
+	}
+	return errors.New(message)
+}
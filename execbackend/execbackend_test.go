@@ -0,0 +1,95 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package execbackend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+)
+
+// newTestBackend returns an ExecBackend whose list_printers executable is
+// a shell script; the other executables fail.
+func newTestBackend(t *testing.T, dir, listPrinters string) *ExecBackend {
+	script := filepath.Join(dir, "list_printers")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+listPrinters+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewExecBackend(lib.ExecBackendConfig{
+		ListPrinters: script,
+		Capabilities: "/bin/false",
+		Print:        "/bin/false",
+		JobState:     "/bin/false",
+		CancelJob:    "/bin/false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestBackend(t, dir, `cat >/dev/null; echo '{"printers": [{"name": "p1"}]}'`)
+	printers, err := b.listPrinters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printers) != 1 || printers[0].Name != "p1" || printers[0].State == nil {
+		t.Errorf("Got printers %+v, want p1, idle", printers)
+	}
+
+	b = newTestBackend(t, dir, `echo "no paper" >&2; exit 1`)
+	_, err = b.listPrinters()
+	if err == nil || !strings.Contains(err.Error(), "no paper") {
+		t.Errorf("Got error %v, want one with the standard error", err)
+	}
+	if _, ok := err.(*lib.UnreachableError); ok {
+		t.Errorf("Exit status 1 is reported as unreachable")
+	}
+
+	b = newTestBackend(t, dir, `exit 75`)
+	if _, err = b.listPrinters(); err == nil {
+		t.Errorf("Exit status 75 returned no error")
+	} else if _, ok := err.(*lib.UnreachableError); !ok {
+		t.Errorf("Exit status 75 is reported as %T, want unreachable", err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(timeout time.Duration) { commandTimeout = timeout }(commandTimeout)
+	commandTimeout = 100 * time.Millisecond
+
+	// The sleep holds standard output open after the script is killed.
+	b := newTestBackend(t, dir, `sleep 60; echo '{}'`)
+	start := time.Now()
+	_, err = b.listPrinters()
+	if _, ok := err.(*lib.UnreachableError); !ok {
+		t.Errorf("Got error %v, want unreachable", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("listPrinters returned after %s; want the helper killed", elapsed)
+	}
+}
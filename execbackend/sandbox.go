@@ -0,0 +1,87 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package execbackend
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/google/cups-connector/lib"
+)
+
+// sandboxCommand returns a command that runs name in sandbox s: under its
+// wrapper, with its resource limits, as its user.
+func sandboxCommand(s lib.Sandbox, name string) (*exec.Cmd, error) {
+	args := append(append([]string{}, s.Wrapper...), name)
+
+	// Go can't set the resource limits of a child process, so the shell
+	// sets them, then execs the helper. POSIX ulimit -f counts 512-byte
+	// blocks; -v, which sh on Linux and the BSDs has, counts KiB.
+	var limits string
+	if s.CPUSeconds > 0 {
+		limits += fmt.Sprintf("ulimit -t %d && ", s.CPUSeconds)
+	}
+	if s.MemoryBytes > 0 {
+		limits += fmt.Sprintf("ulimit -v %d && ", s.MemoryBytes/1024)
+	}
+	if s.FileSizeBytes > 0 {
+		limits += fmt.Sprintf("ulimit -f %d && ", s.FileSizeBytes/512)
+	}
+	if limits != "" {
+		args = append([]string{"/bin/sh", "-c", limits + `exec "$@"`, "sh"}, args...)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	if s.User != "" {
+		uid, gid, err := lookupUser(s.User)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uid, Gid: gid},
+		}
+	}
+	return cmd, nil
+}
+
+// sandboxChown gives a file to the user of sandbox s, if it has one, so
+// that the helper can read it.
+func sandboxChown(s lib.Sandbox, filename string) error {
+	if s.User == "" {
+		return nil
+	}
+	uid, gid, err := lookupUser(s.User)
+	if err != nil {
+		return err
+	}
+	if err = os.Chown(filename, int(uid), int(gid)); err != nil {
+		return fmt.Errorf("Failed to give %s to sandbox user %s: %s", filename, s.User, err)
+	}
+	return nil
+}
+
+// lookupUser returns the user ID and primary group ID of a user name.
+func lookupUser(name string) (uint32, uint32, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(uid), uint32(gid), nil
+}
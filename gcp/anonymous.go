@@ -0,0 +1,134 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package gcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+)
+
+// AnonymousRegistration is a printer registered without user credentials,
+// waiting for a user to claim it.
+type AnonymousRegistration struct {
+	// Token that the user may enter manually at InvitePageURL.
+	RegistrationToken string
+	// URL that claims the printer when visited by the logged-in user.
+	CompleteInviteURL string
+	// URL of the page where the user may enter RegistrationToken.
+	InvitePageURL string
+	// URL to poll, after appending the OAuth client ID, until claimed.
+	PollingURL string
+	// The registration expires this long after it was created.
+	TokenDuration time.Duration
+}
+
+// AnonymousClaim is the result of a claimed anonymous registration.
+type AnonymousClaim struct {
+	XMPPJID   string
+	AuthCode  string
+	UserEmail string
+}
+
+// RegisterAnonymous calls google.com/cloudprint/register without any OAuth
+// credentials, to start the GCP 2.0 anonymous registration flow.
+//
+// The registered printer serves as a placeholder named after the proxy. Once
+// the connector runs with the resulting robot account, it deletes the
+// placeholder, because no CUPS printer matches it.
+func RegisterAnonymous(hc *http.Client, baseURL, proxyName string) (*AnonymousRegistration, error) {
+	capabilities, err := marshalCapabilities(&cdd.PrinterDescriptionSection{
+		SupportedContentType: cdd.NewSupportedContentType("application/pdf"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	semanticState, err := marshalSemanticState(&cdd.PrinterStateSection{State: cdd.CloudDeviceStateIdle})
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("name", proxyName)
+	form.Set("default_display_name", proxyName)
+	form.Set("proxy", proxyName)
+	form.Set("uuid", proxyName)
+	form.Set("manufacturer", "Google")
+	form.Set("model", lib.ShortName)
+	form.Set("gcp_version", "2.0")
+	form.Set("setup_url", lib.ConnectorHomeURL)
+	form.Set("support_url", lib.ConnectorHomeURL)
+	form.Set("update_url", lib.ConnectorHomeURL)
+	form.Set("firmware", lib.BuildDate)
+	form.Set("semantic_state", semanticState)
+	form.Set("use_cdd", "true")
+	form.Set("capabilities", capabilities)
+
+	responseBody, _, _, err := postWithRateLimitRetry(hc, baseURL+"register", form)
+	if err != nil {
+		return nil, err
+	}
+
+	var registerData struct {
+		RegistrationToken string          `json:"registration_token"`
+		TokenDuration     json.RawMessage `json:"token_duration"`
+		CompleteInviteURL string          `json:"complete_invite_url"`
+		InvitePageURL     string          `json:"invite_page_url"`
+		PollingURL        string          `json:"polling_url"`
+	}
+	if err = json.Unmarshal(responseBody, &registerData); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal anonymous registration: %s", err)
+	}
+
+	// Accept the duration as either a JSON number or a JSON string.
+	tokenDuration := strings.Trim(string(registerData.TokenDuration), "\"")
+	var seconds int64
+	if _, err = fmt.Sscan(tokenDuration, &seconds); err != nil {
+		return nil, fmt.Errorf("Failed to parse registration token duration %s: %s", tokenDuration, err)
+	}
+
+	return &AnonymousRegistration{
+		RegistrationToken: registerData.RegistrationToken,
+		CompleteInviteURL: registerData.CompleteInviteURL,
+		InvitePageURL:     registerData.InvitePageURL,
+		PollingURL:        registerData.PollingURL,
+		TokenDuration:     time.Duration(seconds) * time.Second,
+	}, nil
+}
+
+// PollAnonymousRegistration checks whether a user has claimed an anonymous
+// registration. Returns nil without error when the printer is not claimed yet.
+func PollAnonymousRegistration(hc *http.Client, registration *AnonymousRegistration, oauthClientID string) (*AnonymousClaim, error) {
+	response, err := getWithRetry(hc, registration.PollingURL+oauthClientID)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var pollData struct {
+		Success   bool   `json:"success"`
+		XMPPJID   string `json:"xmpp_jid"`
+		AuthCode  string `json:"authorization_code"`
+		UserEmail string `json:"user_email"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&pollData); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal anonymous registration status: %s", err)
+	}
+	if !pollData.Success {
+		return nil, nil
+	}
+
+	return &AnonymousClaim{pollData.XMPPJID, pollData.AuthCode, pollData.UserEmail}, nil
+}
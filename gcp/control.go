@@ -0,0 +1,169 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package gcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+
+	"github.com/golang/glog"
+)
+
+// Send coalesced, non-final job state updates this often.
+const controlFlushInterval = 3 * time.Second
+
+// Try a non-final job state update this many times before giving up on it,
+// and reporting the job as failed instead.
+const controlMaxAttempts = 5
+
+// controlFailedState reports a job whose state couldn't be updated.
+var controlFailedState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:              "STOPPED",
+		DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "OTHER"},
+	},
+}
+
+// pendingControl is a queued job state update.
+type pendingControl struct {
+	state cdd.PrintJobStateDiff
+	// Number of times sending the update failed.
+	failures int
+}
+
+// controlBatcher coalesces job state updates, so that a job whose state
+// changes several times between flushes costs one /control call.
+//
+// Final job states (anything but QUEUED and IN_PROGRESS) are not delayed;
+// they are sent immediately, after any in-progress flush, so that they
+// can't be overwritten by an earlier state.
+type controlBatcher struct {
+	send func(jobID string, state cdd.PrintJobStateDiff) error
+
+	pendingMutex sync.Mutex
+	pending      map[string]pendingControl
+
+	// Held while sending, to keep updates to the same job in order.
+	sendMutex sync.Mutex
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newControlBatcher(send func(jobID string, state cdd.PrintJobStateDiff) error) *controlBatcher {
+	b := controlBatcher{
+		send:    send,
+		pending: make(map[string]pendingControl),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.flushPeriodically()
+	return &b
+}
+
+// isFinalJobState answers the question "is this the last update that GCP
+// will receive about this job?"
+func isFinalJobState(state cdd.PrintJobStateDiff) bool {
+	return state.State.Type != "QUEUED" && state.State.Type != "IN_PROGRESS"
+}
+
+// control queues a job state update. Final states are sent before
+// returning; the error is returned only for those.
+func (b *controlBatcher) control(jobID string, state cdd.PrintJobStateDiff) error {
+	if !isFinalJobState(state) {
+		b.pendingMutex.Lock()
+		b.pending[jobID] = pendingControl{state: state}
+		b.pendingMutex.Unlock()
+		return nil
+	}
+
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+
+	b.pendingMutex.Lock()
+	delete(b.pending, jobID)
+	b.pendingMutex.Unlock()
+
+	return b.send(jobID, state)
+}
+
+func (b *controlBatcher) flushPeriodically() {
+	t := time.NewTimer(controlFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			b.flush()
+			t.Reset(controlFlushInterval)
+
+		case <-b.quit:
+			b.flush()
+			close(b.done)
+			return
+		}
+	}
+}
+
+// flush sends all pending updates concurrently.
+func (b *controlBatcher) flush() {
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+
+	b.pendingMutex.Lock()
+	pending := b.pending
+	b.pending = make(map[string]pendingControl)
+	b.pendingMutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for jobID, p := range pending {
+		wg.Add(1)
+		go func(jobID string, p pendingControl) {
+			defer wg.Done()
+			err := b.send(jobID, p.state)
+			if err == nil {
+				return
+			}
+			p.failures++
+			if p.failures < controlMaxAttempts {
+				glog.Errorf("Failed to update state of job %s: %s", jobID, err)
+				b.requeue(jobID, p)
+				return
+			}
+
+			glog.Errorf("Failed to update state of job %s %d times, reporting it as failed: %s", jobID, p.failures, err)
+			if err = b.send(jobID, controlFailedState); err != nil {
+				glog.Errorf("Failed to report job %s as failed: %s", jobID, err)
+			}
+		}(jobID, p)
+	}
+	wg.Wait()
+}
+
+// requeue puts an update that failed back in the queue, unless a newer
+// update has been queued for the same job since.
+func (b *controlBatcher) requeue(jobID string, p pendingControl) {
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
+
+	if _, exists := b.pending[jobID]; !exists {
+		b.pending[jobID] = p
+	}
+}
+
+// stop sends pending updates and stops the flush goroutine.
+func (b *controlBatcher) stop() {
+	close(b.quit)
+	<-b.done
+}
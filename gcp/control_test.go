@@ -0,0 +1,97 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package gcp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+// fakeControl records the job states that a controlBatcher sends, and fails
+// to send non-final states while failing is true.
+type fakeControl struct {
+	mu      sync.Mutex
+	failing bool
+	sent    []string
+}
+
+func (c *fakeControl) send(jobID string, state cdd.PrintJobStateDiff) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failing && !isFinalJobState(state) {
+		return errors.New("GCP unreachable")
+	}
+	c.sent = append(c.sent, jobID+" "+state.State.Type)
+	return nil
+}
+
+// newTestControlBatcher returns a controlBatcher that only flushes when
+// flush is called.
+func newTestControlBatcher(c *fakeControl) *controlBatcher {
+	return &controlBatcher{send: c.send, pending: make(map[string]pendingControl)}
+}
+
+func inProgress() cdd.PrintJobStateDiff {
+	return cdd.PrintJobStateDiff{State: cdd.JobState{Type: "IN_PROGRESS"}}
+}
+
+func TestControlCoalesces(t *testing.T) {
+	c := &fakeControl{}
+	b := newTestControlBatcher(c)
+	b.control("job1", cdd.PrintJobStateDiff{State: cdd.JobState{Type: "QUEUED"}})
+	b.control("job1", inProgress())
+	b.flush()
+	if len(c.sent) != 1 || c.sent[0] != "job1 IN_PROGRESS" {
+		t.Errorf("Sent %v, want [job1 IN_PROGRESS]", c.sent)
+	}
+
+	// A final state is sent immediately, and replaces the pending one.
+	b.control("job1", inProgress())
+	b.control("job1", cdd.PrintJobStateDiff{State: cdd.JobState{Type: "DONE"}})
+	b.flush()
+	if len(c.sent) != 2 || c.sent[1] != "job1 DONE" {
+		t.Errorf("Sent %v, want [job1 IN_PROGRESS job1 DONE]", c.sent)
+	}
+}
+
+func TestControlRetries(t *testing.T) {
+	c := &fakeControl{failing: true}
+	b := newTestControlBatcher(c)
+	b.control("job1", inProgress())
+
+	b.flush()
+	c.failing = false
+	b.flush()
+	if len(c.sent) != 1 || c.sent[0] != "job1 IN_PROGRESS" {
+		t.Errorf("Sent %v after a retry, want [job1 IN_PROGRESS]", c.sent)
+	}
+}
+
+func TestControlGivesUp(t *testing.T) {
+	c := &fakeControl{failing: true}
+	b := newTestControlBatcher(c)
+	b.control("job1", inProgress())
+
+	for i := 1; i < controlMaxAttempts; i++ {
+		b.flush()
+		if len(b.pending) != 1 || len(c.sent) != 0 {
+			t.Fatalf("After %d failures, %d updates are pending and %v were sent; want 1 pending", i, len(b.pending), c.sent)
+		}
+	}
+	b.flush()
+	if len(b.pending) != 0 {
+		t.Errorf("After %d failures, %d updates are pending, want 0", controlMaxAttempts, len(b.pending))
+	}
+	if len(c.sent) != 1 || c.sent[0] != "job1 STOPPED" {
+		t.Errorf("After %d failures, sent %v, want [job1 STOPPED]", controlMaxAttempts, c.sent)
+	}
+}
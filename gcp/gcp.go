@@ -11,6 +11,7 @@ package gcp
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,13 +19,14 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/oauth2"
-
 	"github.com/google/cups-connector/cdd"
 	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
 )
 
 const (
@@ -42,47 +44,83 @@ const (
 
 // GoogleCloudPrint is the interface between Go and the Google Cloud Print API.
 type GoogleCloudPrint struct {
-	baseURL                 string
-	robotClient             *http.Client
+	baseURL          string
+	robotClient      *http.Client
+	robotTokenSource *tokenSource
+	// Like robotClient, with a timeout suitable for large uploads.
+	uploadClient            *http.Client
+	compressUploads         bool
 	userClient              *http.Client
 	proxyName               string
 	xmppPingIntervalDefault time.Duration
+	controlBatcher          *controlBatcher
 }
 
 // NewGoogleCloudPrint establishes a connection with GCP, returns a new GoogleCloudPrint object.
-func NewGoogleCloudPrint(baseURL, robotRefreshToken, userRefreshToken, proxyName, oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL string, xmppPingIntervalDefault time.Duration) (*GoogleCloudPrint, error) {
-	robotClient, err := newClient(oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, robotRefreshToken, ScopeCloudPrint, ScopeGoogleTalk)
+//
+// When the OAuth server replaces a refresh token, the new token is passed
+// to saveRobotRefreshToken or saveUserRefreshToken, if not nil.
+//
+// Connections use tlsConfig, which may be nil (see lib.NewTLSConfig).
+//
+// PPDs and capabilities are uploaded with uploadTimeout (zero means no
+// timeout), and gzip-compressed when compressUploads is true.
+func NewGoogleCloudPrint(baseURL, robotRefreshToken, userRefreshToken, proxyName, oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, proxyURL string, tlsConfig *tls.Config, xmppPingIntervalDefault, uploadTimeout time.Duration, compressUploads bool, saveRobotRefreshToken, saveUserRefreshToken RefreshTokenSaver) (*GoogleCloudPrint, error) {
+	transport, err := NewTransport(proxyURL, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 
+	robotClient, robotTokenSource := newClient(transport, saveRobotRefreshToken, oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, robotRefreshToken, ScopeCloudPrint, ScopeGoogleTalk)
+
 	var userClient *http.Client
 	if userRefreshToken != "" {
-		userClient, err = newClient(oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, userRefreshToken, ScopeCloudPrint)
-		if err != nil {
-			return nil, err
-		}
+		userClient, _ = newClient(transport, saveUserRefreshToken, oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, userRefreshToken, ScopeCloudPrint)
 	}
 
+	uploadClient := *robotClient
+	uploadClient.Timeout = uploadTimeout
+
 	gcp := &GoogleCloudPrint{
 		baseURL:                 baseURL,
 		robotClient:             robotClient,
+		robotTokenSource:        robotTokenSource,
+		uploadClient:            &uploadClient,
+		compressUploads:         compressUploads,
 		userClient:              userClient,
 		proxyName:               proxyName,
 		xmppPingIntervalDefault: xmppPingIntervalDefault,
 	}
+	gcp.controlBatcher = newControlBatcher(gcp.control)
 
 	return gcp, nil
 }
 
+// Quit sends any job state updates that are waiting to be sent.
+func (gcp *GoogleCloudPrint) Quit() {
+	gcp.controlBatcher.stop()
+}
+
 func (gcp *GoogleCloudPrint) GetRobotAccessToken() (string, error) {
-	token, err := gcp.robotClient.Transport.(*oauth2.Transport).Source.Token()
+	token, err := gcp.robotTokenSource.Token()
 	if err != nil {
 		return "", err
 	}
 	return token.AccessToken, nil
 }
 
+// AuthError returns an error when the robot account's refresh token has
+// been permanently rejected, meaning that the connector can't do its job
+// until the token is replaced. Returns nil otherwise.
+func (gcp *GoogleCloudPrint) AuthError() error {
+	return gcp.robotTokenSource.AuthError()
+}
+
+// ProxyName returns the proxy name that printers are registered under.
+func (gcp *GoogleCloudPrint) ProxyName() string {
+	return gcp.proxyName
+}
+
 // CanShare answers the question "can we share printers when they are registered?"
 func (gcp *GoogleCloudPrint) CanShare() bool {
 	return gcp.userClient != nil
@@ -111,9 +149,17 @@ type deviceActionCause struct {
 	ErrorCode string `json:"error_code"`
 }
 
-// Control calls google.com/cloudprint/control to set the state of a
-// GCP print job.
+// Control sets the state of a GCP print job.
+//
+// Updates to QUEUED or IN_PROGRESS are coalesced and sent a little later;
+// other (final) states are sent before returning.
 func (gcp *GoogleCloudPrint) Control(jobID string, state cdd.PrintJobStateDiff) error {
+	return gcp.controlBatcher.control(jobID, state)
+}
+
+// control calls google.com/cloudprint/control to set the state of a
+// GCP print job.
+func (gcp *GoogleCloudPrint) control(jobID string, state cdd.PrintJobStateDiff) error {
 	semanticState, err := json.Marshal(state)
 	if err != nil {
 		return err
@@ -159,10 +205,11 @@ func (gcp *GoogleCloudPrint) Fetch(gcpID string) ([]lib.Job, error) {
 
 	var jobsData struct {
 		Jobs []struct {
-			ID      string
-			Title   string
-			FileURL string
-			OwnerID string
+			ID         string
+			Title      string
+			FileURL    string
+			OwnerID    string
+			CreateTime string
 		}
 	}
 	if err = json.Unmarshal(responseBody, &jobsData); err != nil {
@@ -179,6 +226,10 @@ func (gcp *GoogleCloudPrint) Fetch(gcpID string) ([]lib.Job, error) {
 			OwnerID:      jobData.OwnerID,
 			Title:        jobData.Title,
 		}
+		if ms, err := strconv.ParseInt(jobData.CreateTime, 10, 64); err == nil {
+			// Milliseconds since the epoch.
+			jobs[i].CreateTime = time.Unix(0, ms*int64(time.Millisecond))
+		}
 	}
 
 	return jobs, nil
@@ -190,9 +241,38 @@ func (gcp *GoogleCloudPrint) Fetch(gcpID string) ([]lib.Job, error) {
 // Returns map of GCPID => printer name. GCPID is unique to GCP; printer name
 // should be unique to CUPS. Use Printer to get details about each printer.
 func (gcp *GoogleCloudPrint) List() (map[string]string, error) {
+	summaries, err := gcp.ListSummaries()
+	if err != nil {
+		return nil, err
+	}
+
+	printers := make(map[string]string, len(summaries))
+	for _, p := range summaries {
+		printers[p.GCPID] = p.Name
+	}
+
+	return printers, nil
+}
+
+// PrinterSummary is what google.com/cloudprint/list says about a printer.
+type PrinterSummary struct {
+	GCPID       string `json:"gcp_id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Proxy       string `json:"proxy"`
+	// ONLINE, OFFLINE, DORMANT or UNKNOWN.
+	ConnectionStatus string `json:"connection_status"`
+	// Quantity of jobs that wait in GCP to be fetched.
+	QueuedJobsCount uint `json:"queued_jobs_count"`
+}
+
+// ListSummaries calls google.com/cloudprint/list to get all GCP printers
+// assigned to this connector, with their display names, connection
+// statuses and queued job quantities.
+func (gcp *GoogleCloudPrint) ListSummaries() ([]PrinterSummary, error) {
 	form := url.Values{}
 	form.Set("proxy", gcp.proxyName)
-	form.Set("extra_fields", "-tags")
+	form.Set("extra_fields", "-tags,connectionStatus,queuedJobsCount")
 
 	responseBody, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"list", form)
 	if err != nil {
@@ -201,17 +281,21 @@ func (gcp *GoogleCloudPrint) List() (map[string]string, error) {
 
 	var listData struct {
 		Printers []struct {
-			ID   string `json:"id"`
-			Name string `json:"name"`
+			ID               string `json:"id"`
+			Name             string `json:"name"`
+			DisplayName      string `json:"displayName"`
+			Proxy            string `json:"proxy"`
+			ConnectionStatus string `json:"connectionStatus"`
+			QueuedJobsCount  uint   `json:"queuedJobsCount"`
 		}
 	}
 	if err = json.Unmarshal(responseBody, &listData); err != nil {
 		return nil, err
 	}
 
-	printers := make(map[string]string, len(listData.Printers))
-	for _, p := range listData.Printers {
-		printers[p.ID] = p.Name
+	printers := make([]PrinterSummary, len(listData.Printers))
+	for i, p := range listData.Printers {
+		printers[i] = PrinterSummary{p.ID, p.Name, p.DisplayName, p.Proxy, p.ConnectionStatus, p.QueuedJobsCount}
 	}
 
 	return printers, nil
@@ -219,14 +303,21 @@ func (gcp *GoogleCloudPrint) List() (map[string]string, error) {
 
 // Register calls google.com/cloudprint/register to register a GCP printer.
 //
-// Sets the GCPID field in the printer arg.
+// Sets the GCPID and LocalSettings fields in the printer arg. Printers are
+// registered with the default XMPP ping interval.
 func (gcp *GoogleCloudPrint) Register(printer *lib.Printer) error {
 	capabilities, err := marshalCapabilities(printer.Description)
 	if err != nil {
 		return err
 	}
 
-	semanticState, err := json.Marshal(cdd.CloudDeviceState{Printer: printer.State})
+	semanticState, err := marshalSemanticState(printer.State)
+	if err != nil {
+		return err
+	}
+
+	localSettings := lib.LocalSettings{XMPPTimeoutValue: uint(gcp.xmppPingIntervalDefault.Seconds())}
+	localSettingsJSON, err := marshalLocalSettings(&localSettings)
 	if err != nil {
 		return err
 	}
@@ -234,6 +325,8 @@ func (gcp *GoogleCloudPrint) Register(printer *lib.Printer) error {
 	form := url.Values{}
 	form.Set("name", printer.Name)
 	form.Set("default_display_name", printer.DefaultDisplayName)
+	form.Set("description", printer.Info)
+	form.Set("location", printer.Location)
 	form.Set("proxy", gcp.proxyName)
 	form.Set("uuid", printer.UUID)
 	form.Set("manufacturer", printer.Manufacturer)
@@ -243,10 +336,14 @@ func (gcp *GoogleCloudPrint) Register(printer *lib.Printer) error {
 	form.Set("support_url", lib.ConnectorHomeURL)
 	form.Set("update_url", lib.ConnectorHomeURL)
 	form.Set("firmware", printer.ConnectorVersion)
-	form.Set("semantic_state", string(semanticState))
+	form.Set("semantic_state", semanticState)
 	form.Set("use_cdd", "true")
 	form.Set("capabilities", capabilities)
 	form.Set("capsHash", printer.CapsHash)
+	form.Set("local_settings", localSettingsJSON)
+	if printer.DailyQuota > 0 {
+		setQuota(form, printer.DailyQuota)
+	}
 
 	sortedKeys := make([]string, 0, len(printer.Tags))
 	for key := range printer.Tags {
@@ -257,7 +354,7 @@ func (gcp *GoogleCloudPrint) Register(printer *lib.Printer) error {
 		form.Add("tag", fmt.Sprintf("%s%s=%s", gcpTagPrefix, key, printer.Tags[key]))
 	}
 
-	responseBody, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"register", form)
+	responseBody, _, _, err := postWithBackoff(gcp.uploadClient, gcp.baseURL+"register", form, false, gcp.compressUploads)
 	if err != nil {
 		return err
 	}
@@ -272,21 +369,77 @@ func (gcp *GoogleCloudPrint) Register(printer *lib.Printer) error {
 	}
 
 	printer.GCPID = registerData.Printers[0].ID
+	printer.LocalSettings = localSettings
+
+	return nil
+}
+
+// SetLocalSettings calls google.com/cloudprint/update to set the current
+// local settings of a GCP printer, which confirms pending changes.
+func (gcp *GoogleCloudPrint) SetLocalSettings(gcpID string, settings *lib.LocalSettings) error {
+	localSettings, err := marshalLocalSettings(settings)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("printerid", gcpID)
+	form.Set("proxy", gcp.proxyName)
+	form.Set("local_settings", localSettings)
+
+	if _, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"update", form); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateState calls google.com/cloudprint/update to update only the
+// state of a GCP printer.
+func (gcp *GoogleCloudPrint) UpdateState(gcpID string, state *cdd.PrinterStateSection) error {
+	semanticState, err := marshalSemanticState(state)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("printerid", gcpID)
+	form.Set("proxy", gcp.proxyName)
+	form.Set("semantic_state", semanticState)
+
+	if _, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"update", form); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 // Update calls google.com/cloudprint/update to update a GCP printer.
+//
+// Only changed fields are sent. Capabilities are sent, with the upload
+// timeout and compression, only when diff.CapabilitiesChanged; otherwise
+// the update is a small metadata-only request.
 func (gcp *GoogleCloudPrint) Update(diff *lib.PrinterDiff) error {
-	// Ignores Name field because it never changes.
-
 	form := url.Values{}
 	form.Set("printerid", diff.Printer.GCPID)
 	form.Set("proxy", gcp.proxyName)
 
+	if diff.NameChanged {
+		form.Set("name", diff.Printer.Name)
+	}
+	if diff.UUIDChanged {
+		form.Set("uuid", diff.Printer.UUID)
+	}
+
 	if diff.DefaultDisplayNameChanged {
 		form.Set("default_display_name", diff.Printer.DefaultDisplayName)
 	}
+	if diff.InfoChanged {
+		form.Set("description", diff.Printer.Info)
+	}
+	if diff.LocationChanged {
+		form.Set("location", diff.Printer.Location)
+	}
 	if diff.ManufacturerChanged {
 		form.Set("manufacturer", diff.Printer.Manufacturer)
 	}
@@ -308,16 +461,19 @@ func (gcp *GoogleCloudPrint) Update(diff *lib.PrinterDiff) error {
 	if diff.ConnectorVersionChanged {
 		form.Set("firmware", diff.Printer.ConnectorVersion)
 	}
+	if diff.DailyQuotaChanged {
+		setQuota(form, diff.Printer.DailyQuota)
+	}
 
-	if diff.StateChanged || diff.DescriptionChanged || diff.GCPVersionChanged {
-		semanticState, err := json.Marshal(cdd.CloudDeviceState{Printer: diff.Printer.State})
+	if diff.StateChanged || diff.CapabilitiesChanged() {
+		semanticState, err := marshalSemanticState(diff.Printer.State)
 		if err != nil {
 			return err
 		}
-		form.Set("semantic_state", string(semanticState))
+		form.Set("semantic_state", semanticState)
 	}
 
-	if diff.CapsHashChanged || diff.DescriptionChanged || diff.GCPVersionChanged {
+	if diff.CapabilitiesChanged() {
 		capabilities, err := marshalCapabilities(diff.Printer.Description)
 		if err != nil {
 			return err
@@ -341,7 +497,14 @@ func (gcp *GoogleCloudPrint) Update(diff *lib.PrinterDiff) error {
 		form.Set("remove_tag", gcpTagPrefix+".*")
 	}
 
-	if _, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"update", form); err != nil {
+	if !diff.CapabilitiesChanged() {
+		if _, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"update", form); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if _, _, _, err := postWithBackoff(gcp.uploadClient, gcp.baseURL+"update", form, true, gcp.compressUploads); err != nil {
 		return err
 	}
 
@@ -367,6 +530,8 @@ func (gcp *GoogleCloudPrint) Printer(gcpID string) (*lib.Printer, uint, error) {
 			ID                 string                     `json:"id"`
 			Name               string                     `json:"name"`
 			DefaultDisplayName string                     `json:"defaultDisplayName"`
+			Description        string                     `json:"description"`
+			Location           string                     `json:"location"`
 			UUID               string                     `json:"uuid"`
 			Manufacturer       string                     `json:"manufacturer"`
 			Model              string                     `json:"model"`
@@ -380,6 +545,13 @@ func (gcp *GoogleCloudPrint) Printer(gcpID string) (*lib.Printer, uint, error) {
 			Tags               []string                   `json:"tags"`
 			QueuedJobsCount    uint                       `json:"queuedJobsCount"`
 			SemanticState      cdd.CloudDeviceState       `json:"semanticState"`
+			UpdateTime         string                     `json:"updateTime"`
+			QuotaEnabled       bool                       `json:"quotaEnabled"`
+			DailyQuota         uint                       `json:"dailyQuota"`
+			LocalSettings      struct {
+				Current lib.LocalSettings  `json:"current"`
+				Pending *lib.LocalSettings `json:"pending"`
+			} `json:"local_settings"`
 		}
 	}
 	if err = json.Unmarshal(responseBody, &printersData); err != nil {
@@ -403,6 +575,8 @@ func (gcp *GoogleCloudPrint) Printer(gcpID string) (*lib.Printer, uint, error) {
 		GCPID:              p.ID,
 		Name:               p.Name,
 		DefaultDisplayName: p.DefaultDisplayName,
+		Info:               p.Description,
+		Location:           p.Location,
 		UUID:               p.UUID,
 		Manufacturer:       p.Manufacturer,
 		Model:              p.Model,
@@ -415,7 +589,17 @@ func (gcp *GoogleCloudPrint) Printer(gcpID string) (*lib.Printer, uint, error) {
 		Description:        p.Capabilities.Printer,
 		CapsHash:           p.CapsHash,
 		Tags:               tags,
+		LocalSettings:      p.LocalSettings.Current,
+		PendingSettings:    p.LocalSettings.Pending,
 	}
+	if p.QuotaEnabled {
+		printer.DailyQuota = p.DailyQuota
+	}
+	if ms, err := strconv.ParseInt(p.UpdateTime, 10, 64); err == nil {
+		// Milliseconds since the epoch.
+		printer.GCPUpdateTime = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	printer.SetDescriptionHash()
 
 	return printer, p.QueuedJobsCount, err
 }
@@ -426,7 +610,7 @@ func (gcp *GoogleCloudPrint) Translate(ppd string) (*cdd.PrinterDescriptionSecti
 	form := url.Values{}
 	form.Set("capabilities", ppd)
 
-	responseBody, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"tools/cdd/translate", form)
+	responseBody, _, _, err := postWithBackoff(gcp.uploadClient, gcp.baseURL+"tools/cdd/translate", form, true, gcp.compressUploads)
 	if err != nil {
 		return nil, err
 	}
@@ -444,6 +628,40 @@ func (gcp *GoogleCloudPrint) Translate(ppd string) (*cdd.PrinterDescriptionSecti
 	return response.CDD.Printer, nil
 }
 
+func marshalSemanticState(state *cdd.PrinterStateSection) (string, error) {
+	cds := cdd.CloudDeviceState{
+		Version: "1.0",
+		Printer: state,
+	}
+
+	semanticState, err := json.Marshal(cds)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal CDS: %s", err)
+	}
+
+	return string(semanticState), nil
+}
+
+// setQuota sets the quota fields of a register or update form. A zero
+// dailyQuota disables the quota.
+func setQuota(form url.Values, dailyQuota uint) {
+	form.Set("quota_enabled", strconv.FormatBool(dailyQuota > 0))
+	form.Set("daily_quota", strconv.FormatUint(uint64(dailyQuota), 10))
+}
+
+// marshalLocalSettings marshals settings as the current local settings of
+// a printer.
+func marshalLocalSettings(settings *lib.LocalSettings) (string, error) {
+	localSettings, err := json.Marshal(struct {
+		Current *lib.LocalSettings `json:"current"`
+	}{settings})
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal local settings: %s", err)
+	}
+
+	return string(localSettings), nil
+}
+
 func marshalCapabilities(description *cdd.PrinterDescriptionSection) (string, error) {
 	capabilities := cdd.CloudDeviceDescription{
 		Version: "1.0",
@@ -458,8 +676,9 @@ func marshalCapabilities(description *cdd.PrinterDescriptionSection) (string, er
 	return string(cdd), nil
 }
 
-// Share calls google.com/cloudprint/share to share a registered GCP printer.
-func (gcp *GoogleCloudPrint) Share(gcpID, shareScope string) error {
+// Share calls google.com/cloudprint/share to share a registered GCP printer
+// with role (USER or MANAGER).
+func (gcp *GoogleCloudPrint) Share(gcpID, shareScope, role string) error {
 	if gcp.userClient == nil {
 		return errors.New("Cannot share because user OAuth credentials not provided.")
 	}
@@ -467,7 +686,7 @@ func (gcp *GoogleCloudPrint) Share(gcpID, shareScope string) error {
 	form := url.Values{}
 	form.Set("printerid", gcpID)
 	form.Set("scope", shareScope)
-	form.Set("role", "USER")
+	form.Set("role", role)
 	form.Set("skip_notification", "true")
 
 	if _, _, _, err := postWithRetry(gcp.userClient, gcp.baseURL+"share", form); err != nil {
@@ -477,22 +696,204 @@ func (gcp *GoogleCloudPrint) Share(gcpID, shareScope string) error {
 	return nil
 }
 
-// Download downloads a URL (a print job PDF) directly to a Writer.
-func (gcp *GoogleCloudPrint) Download(dst io.Writer, url string) error {
-	response, err := getWithRetry(gcp.robotClient, url)
-	if err != nil {
+// Unshare calls google.com/cloudprint/unshare to revoke a scope's access
+// to a registered GCP printer.
+func (gcp *GoogleCloudPrint) Unshare(gcpID, shareScope string) error {
+	if gcp.userClient == nil {
+		return errors.New("Cannot unshare because user OAuth credentials not provided.")
+	}
+
+	form := url.Values{}
+	form.Set("printerid", gcpID)
+	form.Set("scope", shareScope)
+
+	if _, _, _, err := postWithRetry(gcp.userClient, gcp.baseURL+"unshare", form); err != nil {
 		return err
 	}
-	defer response.Body.Close()
 
-	_, err = io.Copy(dst, response.Body)
-	if err != nil {
+	return nil
+}
+
+// ProcessInvite calls google.com/cloudprint/processinvite to accept or
+// reject an invitation to share a printer with the robot account.
+func (gcp *GoogleCloudPrint) ProcessInvite(gcpID string, accept bool) error {
+	form := url.Values{}
+	form.Set("printerid", gcpID)
+	form.Set("accept", strconv.FormatBool(accept))
+
+	if _, _, _, err := postWithRetry(gcp.robotClient, gcp.baseURL+"processinvite", form); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// Access calls google.com/cloudprint/printer to get the scopes that a GCP
+// printer is shared with. Returns a map of scope -> role; the owner has
+// role OWNER.
+func (gcp *GoogleCloudPrint) Access(gcpID string) (map[string]string, error) {
+	if gcp.userClient == nil {
+		return nil, errors.New("Cannot get access because user OAuth credentials not provided.")
+	}
+
+	form := url.Values{}
+	form.Set("printerid", gcpID)
+
+	responseBody, _, _, err := postWithRetry(gcp.userClient, gcp.baseURL+"printer", form)
+	if err != nil {
+		return nil, err
+	}
+
+	var printersData struct {
+		Printers []struct {
+			Access []struct {
+				Scope string `json:"scope"`
+				Role  string `json:"role"`
+			} `json:"access"`
+		}
+	}
+	if err = json.Unmarshal(responseBody, &printersData); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal printer access: %s", err)
+	}
+
+	access := make(map[string]string)
+	for _, a := range printersData.Printers[0].Access { // If the slice were empty, postWithRetry would have returned an error.
+		access[a.Scope] = a.Role
+	}
+
+	return access, nil
+}
+
+// Download downloads a URL (a print job PDF) directly to a Writer.
+//
+// Interrupted transfers are resumed with HTTP Range requests. When the
+// server doesn't honor the Range header, the download starts over, which
+// requires dst to be seekable and truncatable, like *os.File.
+//
+// When contentType is not "", GCP is asked to convert the document to that
+// content type, like image/pwg-raster; otherwise GCP chooses.
+//
+// When maxSize is more than zero, documents larger than maxSize bytes
+// aren't downloaded, or stop downloading when they reach maxSize, with a
+// *DownloadTooLargeError.
+//
+// Returns the document's Content-Type, as declared by the server.
+func (gcp *GoogleCloudPrint) Download(dst io.Writer, url, contentType string, maxSize int64) (string, error) {
+	var written int64
+	var declaredContentType string
+	for retry := 0; ; retry++ {
+		response, partial, httpStatusCode, retryAfter, err := getFrom(gcp.robotClient, url, contentType, written)
+		if err == nil {
+			if !partial {
+				if err = restartDownload(dst, written); err != nil {
+					response.Body.Close()
+					return "", err
+				}
+				written = 0
+			}
+			if written == 0 {
+				declaredContentType = response.Header.Get("Content-Type")
+			}
+			if maxSize > 0 && response.ContentLength >= 0 && written+response.ContentLength > maxSize {
+				response.Body.Close()
+				return "", &DownloadTooLargeError{Size: written + response.ContentLength, MaxSize: maxSize}
+			}
+
+			w := downloadWriter{w: dst, left: maxSize - written, maxSize: maxSize}
+			var n int64
+			n, err = io.Copy(&w, response.Body)
+			response.Body.Close()
+			written += n
+			if err == nil {
+				return declaredContentType, nil
+			}
+			if w.err != nil {
+				return "", w.err
+			}
+			if n > 0 {
+				// Progress was made, so the link is flaky rather than down.
+				retry = 0
+			}
+			httpStatusCode = 0
+		}
+
+		if retry >= maxRetries || !retryable(httpStatusCode, true) {
+			return "", err
+		}
+
+		delay := retryDelay(retry, retryAfter)
+		glog.Warningf("Resuming download at byte %d in %s: %s", written, delay.String(), err)
+		time.Sleep(delay)
+	}
+}
+
+// DownloadTooLargeError is returned by Download when a document is larger
+// than the maximum size.
+type DownloadTooLargeError struct {
+	// The size of the document, or zero when it's unknown.
+	Size    int64
+	MaxSize int64
+}
+
+func (e *DownloadTooLargeError) Error() string {
+	if e.Size == 0 {
+		return fmt.Sprintf("document is larger than the maximum of %d bytes", e.MaxSize)
+	}
+	return fmt.Sprintf("document is %d bytes, larger than the maximum of %d bytes", e.Size, e.MaxSize)
+}
+
+// downloadWriter remembers write errors, to tell them apart from read
+// errors, which are worth retrying. When maxSize is more than zero, writing
+// more than left bytes fails with a *DownloadTooLargeError.
+type downloadWriter struct {
+	w       io.Writer
+	err     error
+	left    int64
+	maxSize int64
+}
+
+func (dw *downloadWriter) Write(p []byte) (int, error) {
+	if dw.maxSize > 0 {
+		if int64(len(p)) > dw.left {
+			dw.err = &DownloadTooLargeError{MaxSize: dw.maxSize}
+			return 0, dw.err
+		}
+		dw.left -= int64(len(p))
+	}
+
+	n, err := dw.w.Write(p)
+	if err != nil {
+		dw.err = err
+	}
+	return n, err
+}
+
+// restartDownload discards the written bytes of a download, so that it
+// can start over from the beginning.
+func restartDownload(dst io.Writer, written int64) error {
+	if written == 0 {
+		return nil
+	}
+
+	f, ok := dst.(interface {
+		io.Seeker
+		Truncate(size int64) error
+	})
+	if !ok {
+		return errors.New("Failed to resume download: server ignored Range request")
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("Failed to restart download: %s", err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return fmt.Errorf("Failed to restart download: %s", err)
+	}
+
+	glog.Warning("Server ignored Range request; restarting download")
+	return nil
+}
+
 // Ticket gets a ticket, aka print job options.
 func (gcp *GoogleCloudPrint) Ticket(gcpJobID string) (cdd.CloudJobTicket, error) {
 	form := url.Values{}
@@ -517,3 +918,26 @@ func (gcp *GoogleCloudPrint) Ticket(gcpJobID string) (cdd.CloudJobTicket, error)
 
 	return ticket, nil
 }
+
+// ProximityToken gets a proximity token for Privet users to access a printer
+// through the cloud. The JSON proximity token is returned along with the HTTP
+// status code of the GCP response.
+func (gcp *GoogleCloudPrint) ProximityToken(gcpID, user string) ([]byte, int, error) {
+	form := url.Values{}
+	form.Set("printerid", gcpID)
+	form.Set("user", user)
+
+	responseBody, _, httpStatusCode, err := postWithRetry(gcp.robotClient, gcp.baseURL+"proximitytoken", form)
+	if err != nil {
+		return nil, httpStatusCode, err
+	}
+
+	var token struct {
+		ProximityToken json.RawMessage `json:"proximity_token"`
+	}
+	if err = json.Unmarshal(responseBody, &token); err != nil {
+		return nil, httpStatusCode, fmt.Errorf("Failed to unmarshal proximity token: %s", err)
+	}
+
+	return token.ProximityToken, httpStatusCode, nil
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package gcp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/gcp/gcptest"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/xmpp"
+)
+
+func newTestGoogleCloudPrint(t *testing.T, s *gcptest.Server) *GoogleCloudPrint {
+	gcp, err := NewGoogleCloudPrint(s.BaseURL(), "robot-refresh-token", "", "test-proxy", "client-id", "client-secret", s.AuthURL(), s.TokenURL(), "", nil, 5*time.Minute, 0, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create GoogleCloudPrint: %s", err)
+	}
+	return gcp
+}
+
+func TestPrinterLifecycle(t *testing.T) {
+	s := gcptest.NewServer()
+	defer s.Close()
+	gcp := newTestGoogleCloudPrint(t, s)
+	defer gcp.Quit()
+
+	printer := lib.Printer{
+		Name:               "printer1",
+		DefaultDisplayName: "Printer One",
+		Location:           "Lobby",
+		UUID:               "uuid-1",
+		GCPVersion:         "2.0",
+		State:              &cdd.PrinterStateSection{State: cdd.CloudDeviceStateIdle},
+		Description:        &cdd.PrinterDescriptionSection{},
+		CapsHash:           "hash-1",
+		Tags:               map[string]string{"printer-make-and-model": "Fake"},
+	}
+	if err := gcp.Register(&printer); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if printer.GCPID == "" {
+		t.Fatal("Register didn't set GCPID")
+	}
+
+	printers, err := gcp.List()
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	if len(printers) != 1 || printers[printer.GCPID] != "printer1" {
+		t.Fatalf("List returned %v, want only %s => printer1", printers, printer.GCPID)
+	}
+
+	p, queued, err := gcp.Printer(printer.GCPID)
+	if err != nil {
+		t.Fatalf("Printer failed: %s", err)
+	}
+	if p.Name != printer.Name || p.Location != printer.Location || p.CapsHash != printer.CapsHash {
+		t.Errorf("Printer returned %+v, want fields of %+v", p, printer)
+	}
+	if p.Tags["printer-make-and-model"] != "Fake" {
+		t.Errorf("Printer returned tags %v, want printer-make-and-model=Fake", p.Tags)
+	}
+	if queued != 0 {
+		t.Errorf("Printer returned %d queued jobs, want 0", queued)
+	}
+
+	// A renamed CUPS queue keeps its GCP printer.
+	renamed := printer
+	renamed.Name = "printer2"
+	if err = gcp.Update(&lib.PrinterDiff{Operation: lib.UpdatePrinter, Printer: renamed, NameChanged: true}); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if printers, err = gcp.List(); err != nil || printers[printer.GCPID] != "printer2" {
+		t.Fatalf("List after rename returned %v, %v; want %s => printer2", printers, err, printer.GCPID)
+	}
+
+	if err = gcp.Delete(printer.GCPID); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if printers, err = gcp.List(); err != nil || len(printers) != 0 {
+		t.Fatalf("List after Delete returned %v, %v; want no printers", printers, err)
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	s := gcptest.NewServer()
+	defer s.Close()
+	gcp := newTestGoogleCloudPrint(t, s)
+
+	printer := lib.Printer{
+		Name:        "printer1",
+		State:       &cdd.PrinterStateSection{State: cdd.CloudDeviceStateIdle},
+		Description: &cdd.PrinterDescriptionSection{},
+	}
+	if err := gcp.Register(&printer); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+
+	jobs, err := gcp.Fetch(printer.GCPID)
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("Fetch with no jobs returned %v, %v; want no jobs", jobs, err)
+	}
+
+	ticket := cdd.CloudJobTicket{
+		Version: "1.0",
+		Print:   cdd.PrintTicketSection{Copies: &cdd.CopiesTicketItem{Copies: 2}},
+	}
+	document := []byte("%PDF-1.4 fake document")
+	jobID := s.AddJob(printer.GCPID, "Job One", "owner@example.com", ticket, document)
+
+	select {
+	case n := <-s.Notifications():
+		if n.GCPID != printer.GCPID || n.Type != xmpp.PrinterNewJobs {
+			t.Errorf("Got notification %+v, want new jobs for %s", n, printer.GCPID)
+		}
+	default:
+		t.Error("AddJob didn't send a notification")
+	}
+
+	if jobs, err = gcp.Fetch(printer.GCPID); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].GCPJobID != jobID || jobs[0].Title != "Job One" || jobs[0].OwnerID != "owner@example.com" {
+		t.Fatalf("Fetch returned %+v, want job %s", jobs, jobID)
+	}
+	if created, _ := s.Job(jobID); !jobs[0].CreateTime.Equal(created.Created.Truncate(time.Millisecond)) {
+		t.Errorf("Fetch returned create time %s, want %s", jobs[0].CreateTime, created.Created)
+	}
+
+	gotTicket, err := gcp.Ticket(jobID)
+	if err != nil {
+		t.Fatalf("Ticket failed: %s", err)
+	}
+	if gotTicket.Print.Copies == nil || gotTicket.Print.Copies.Copies != 2 {
+		t.Errorf("Ticket returned %+v, want 2 copies", gotTicket.Print)
+	}
+
+	var b bytes.Buffer
+	contentType, err := gcp.Download(&b, jobs[0].FileURL, "", 0)
+	if err != nil {
+		t.Fatalf("Download failed: %s", err)
+	}
+	if contentType != "application/pdf" {
+		t.Errorf("Download returned Content-Type %q, want application/pdf", contentType)
+	}
+	if !bytes.Equal(b.Bytes(), document) {
+		t.Errorf("Download returned %q, want %q", b.Bytes(), document)
+	}
+
+	inProgress := cdd.PrintJobStateDiff{State: cdd.JobState{Type: "IN_PROGRESS"}}
+	done := cdd.PrintJobStateDiff{State: cdd.JobState{Type: "DONE"}}
+	if err = gcp.Control(jobID, inProgress); err != nil {
+		t.Fatalf("Control failed: %s", err)
+	}
+	if err = gcp.Control(jobID, done); err != nil {
+		t.Fatalf("Control failed: %s", err)
+	}
+	gcp.Quit()
+
+	job, _ := s.Job(jobID)
+	if len(job.States) == 0 || job.States[len(job.States)-1].State.Type != "DONE" {
+		t.Errorf("Job states are %+v, want DONE last", job.States)
+	}
+
+	if jobs, err = gcp.Fetch(printer.GCPID); err != nil || len(jobs) != 0 {
+		t.Errorf("Fetch after DONE returned %v, %v; want no jobs", jobs, err)
+	}
+}
+
+func TestDownloadMaxSize(t *testing.T) {
+	document := bytes.Repeat([]byte("%PDF-1.4 "), 1000)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Flushing before the end sends the document without a
+			// Content-Length, so only the byte count can enforce the limit.
+			half := len(document) / 2
+			w.Write(document[:half])
+			w.(http.Flusher).Flush()
+			w.Write(document[half:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(document)))
+		w.Write(document)
+	}))
+	defer files.Close()
+
+	s := gcptest.NewServer()
+	defer s.Close()
+	gcp := newTestGoogleCloudPrint(t, s)
+	defer gcp.Quit()
+
+	size := int64(len(document))
+	for _, test := range []struct {
+		path     string
+		maxSize  int64
+		wantSize int64
+		tooLarge bool
+	}{
+		{"/sized", 0, 0, false},
+		{"/sized", size, 0, false},
+		{"/sized", size + 1, 0, false},
+		{"/sized", size - 1, size, true},
+		{"/chunked", 0, 0, false},
+		{"/chunked", size, 0, false},
+		{"/chunked", size - 1, 0, true},
+		{"/chunked", 1, 0, true},
+	} {
+		var b bytes.Buffer
+		_, err := gcp.Download(&b, files.URL+test.path, "", test.maxSize)
+		if !test.tooLarge {
+			if err != nil {
+				t.Errorf("Download of %s with maximum %d failed: %s", test.path, test.maxSize, err)
+			} else if !bytes.Equal(b.Bytes(), document) {
+				t.Errorf("Download of %s with maximum %d returned %d bytes, want %d", test.path, test.maxSize, b.Len(), size)
+			}
+			continue
+		}
+		tooLarge, ok := err.(*DownloadTooLargeError)
+		if !ok {
+			t.Errorf("Download of %s with maximum %d returned %v, want a *DownloadTooLargeError", test.path, test.maxSize, err)
+			continue
+		}
+		if tooLarge.Size != test.wantSize || tooLarge.MaxSize != test.maxSize {
+			t.Errorf("Download of %s returned %+v, want size %d and maximum %d", test.path, tooLarge, test.wantSize, test.maxSize)
+		}
+		if int64(b.Len()) > test.maxSize {
+			t.Errorf("Download of %s wrote %d bytes, more than the maximum of %d", test.path, b.Len(), test.maxSize)
+		}
+	}
+}
+
+func TestDownloadWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := downloadWriter{w: &b, left: 10, maxSize: 10}
+	// Writes that reach the maximum exactly succeed.
+	for _, p := range []string{"01234", "5678", "9"} {
+		if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) returned %d, %v; want %d, nil", p, n, err, len(p))
+		}
+	}
+	if n, err := w.Write([]byte("x")); n != 0 || err == nil || err != w.err {
+		t.Errorf("Write past the maximum returned %d, %v; want 0 and the remembered error", n, err)
+	}
+	if _, ok := w.err.(*DownloadTooLargeError); !ok {
+		t.Errorf("Write past the maximum remembered %v, want a *DownloadTooLargeError", w.err)
+	}
+	if b.String() != "0123456789" {
+		t.Errorf("Wrote %q, want 0123456789", b.String())
+	}
+
+	// Without a maximum, any amount can be written.
+	b.Reset()
+	w = downloadWriter{w: &b}
+	big := bytes.Repeat([]byte("x"), 1<<16)
+	if n, err := w.Write(big); err != nil || n != len(big) {
+		t.Errorf("Write without a maximum returned %d, %v; want %d, nil", n, err, len(big))
+	}
+}
@@ -0,0 +1,520 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package gcptest implements a fake Google Cloud Print service, for
+// exercising the gcp and manager packages in tests without credentials.
+//
+// The fake implements the API calls that the connector makes to manage
+// printers and print jobs, and the OAuth token endpoint. Print job
+// notifications are delivered on a channel, instead of over XMPP.
+package gcptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/xmpp"
+)
+
+// Printer is a printer registered with the fake service.
+type Printer struct {
+	ID                 string
+	Proxy              string
+	Name               string
+	DefaultDisplayName string
+	Description        string
+	Location           string
+	UUID               string
+	Manufacturer       string
+	Model              string
+	GCPVersion         string
+	SetupURL           string
+	SupportURL         string
+	UpdateURL          string
+	Firmware           string
+	Capabilities       json.RawMessage
+	CapsHash           string
+	SemanticState      json.RawMessage
+	Tags               []string
+	// Roles of the scopes that the printer is shared with, by scope.
+	Access map[string]string
+}
+
+// Job is a print job submitted to the fake service.
+type Job struct {
+	ID        string
+	PrinterID string
+	Title     string
+	OwnerID   string
+	Ticket    cdd.CloudJobTicket
+	Document  []byte
+	Created   time.Time
+	// State updates received from the connector, oldest first.
+	States []cdd.PrintJobStateDiff
+}
+
+// Server is a fake Google Cloud Print service.
+type Server struct {
+	URL string
+
+	server        *httptest.Server
+	notifications chan xmpp.PrinterNotification
+
+	mutex    sync.Mutex
+	nextID   int
+	printers map[string]*Printer
+	jobs     map[string]*Job
+	jobOrder []string
+}
+
+// NewServer starts a fake Google Cloud Print service. The caller should
+// call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		notifications: make(chan xmpp.PrinterNotification, 100),
+		printers:      make(map[string]*Printer),
+		jobs:          make(map[string]*Job),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/o/oauth2/auth", s.handleAuth)
+	mux.HandleFunc("/o/oauth2/token", s.handleToken)
+	mux.HandleFunc("/cloudprint/list", s.handleList)
+	mux.HandleFunc("/cloudprint/printer", s.handlePrinter)
+	mux.HandleFunc("/cloudprint/register", s.handleRegister)
+	mux.HandleFunc("/cloudprint/update", s.handleUpdate)
+	mux.HandleFunc("/cloudprint/delete", s.handleDelete)
+	mux.HandleFunc("/cloudprint/fetch", s.handleFetch)
+	mux.HandleFunc("/cloudprint/ticket", s.handleTicket)
+	mux.HandleFunc("/cloudprint/control", s.handleControl)
+	mux.HandleFunc("/cloudprint/download/", s.handleDownload)
+	mux.HandleFunc("/cloudprint/share", s.handleShare)
+	mux.HandleFunc("/cloudprint/unshare", s.handleUnshare)
+
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+
+	return s
+}
+
+// Close shuts down the fake service.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// BaseURL is the GCP API URL prefix of the fake service.
+func (s *Server) BaseURL() string {
+	return s.URL + "/cloudprint/"
+}
+
+// AuthURL is the OAuth authorization URL of the fake service.
+func (s *Server) AuthURL() string {
+	return s.URL + "/o/oauth2/auth"
+}
+
+// TokenURL is the OAuth token URL of the fake service. Any refresh token
+// is accepted.
+func (s *Server) TokenURL() string {
+	return s.URL + "/o/oauth2/token"
+}
+
+// Notifications receives a PrinterNewJobs notification when a job is
+// added, and a PrinterDelete notification when a printer is deleted with
+// DeletePrinter, like XMPP notifications from GCP.
+func (s *Server) Notifications() <-chan xmpp.PrinterNotification {
+	return s.notifications
+}
+
+// Printers returns copies of the registered printers.
+func (s *Server) Printers() []Printer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	printers := make([]Printer, 0, len(s.printers))
+	for _, p := range s.printers {
+		printer := *p
+		printer.Access = make(map[string]string, len(p.Access))
+		for scope, role := range p.Access {
+			printer.Access[scope] = role
+		}
+		printers = append(printers, printer)
+	}
+	return printers
+}
+
+// DeletePrinter deletes a printer, as if by the user, and notifies.
+func (s *Server) DeletePrinter(printerID string) {
+	s.mutex.Lock()
+	delete(s.printers, printerID)
+	s.mutex.Unlock()
+
+	s.notify(printerID, xmpp.PrinterDelete)
+}
+
+// AddJob submits a print job to a printer, and notifies. Returns the job ID.
+func (s *Server) AddJob(printerID, title, ownerID string, ticket cdd.CloudJobTicket, document []byte) string {
+	s.mutex.Lock()
+	id := s.newID("job")
+	s.jobs[id] = &Job{
+		ID:        id,
+		PrinterID: printerID,
+		Title:     title,
+		OwnerID:   ownerID,
+		Ticket:    ticket,
+		Document:  document,
+		Created:   time.Now(),
+	}
+	s.jobOrder = append(s.jobOrder, id)
+	s.mutex.Unlock()
+
+	s.notify(printerID, xmpp.PrinterNewJobs)
+	return id
+}
+
+// Job returns a copy of a job, and whether it exists.
+func (s *Server) Job(jobID string) (Job, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job, exists := s.jobs[jobID]
+	if !exists {
+		return Job{}, false
+	}
+	j := *job
+	j.States = append([]cdd.PrintJobStateDiff{}, job.States...)
+	return j, true
+}
+
+func (s *Server) notify(printerID string, t xmpp.PrinterNotificationType) {
+	select {
+	case s.notifications <- xmpp.PrinterNotification{GCPID: printerID, Type: t}:
+	default:
+		// Nobody is listening; drop it, like a disconnected XMPP conversation.
+	}
+}
+
+// newID returns a new unique ID. Called with mutex held.
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-%d", prefix, s.nextID)
+}
+
+// jobStateType returns the latest state of a job. Called with mutex held.
+func jobStateType(job *Job) string {
+	if len(job.States) == 0 {
+		return "QUEUED"
+	}
+	return job.States[len(job.States)-1].State.Type
+}
+
+func writeSuccess(w http.ResponseWriter, response map[string]interface{}) {
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+	response["success"] = true
+	writeJSON(w, response)
+}
+
+func writeFailure(w http.ResponseWriter, errorCode int, message string) {
+	writeJSON(w, map[string]interface{}{
+		"success":   false,
+		"errorCode": errorCode,
+		"message":   message,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Interactive authorization is not supported by the fake service", http.StatusNotImplemented)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"access_token": "fake-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Hour / time.Second),
+	})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	proxy := r.FormValue("proxy")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	printers := []map[string]string{}
+	for _, p := range s.printers {
+		if p.Proxy == proxy {
+			printers = append(printers, map[string]string{"id": p.ID, "name": p.Name})
+		}
+	}
+	writeSuccess(w, map[string]interface{}{"printers": printers})
+}
+
+func (s *Server) handlePrinter(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, exists := s.printers[r.FormValue("printerid")]
+	if !exists {
+		writeFailure(w, 404, "Printer not found")
+		return
+	}
+
+	var queuedJobsCount int
+	for _, job := range s.jobs {
+		if job.PrinterID == p.ID && jobStateType(job) == "QUEUED" {
+			queuedJobsCount++
+		}
+	}
+
+	printer := map[string]interface{}{
+		"id":                 p.ID,
+		"proxy":              p.Proxy,
+		"name":               p.Name,
+		"defaultDisplayName": p.DefaultDisplayName,
+		"description":        p.Description,
+		"location":           p.Location,
+		"uuid":               p.UUID,
+		"manufacturer":       p.Manufacturer,
+		"model":              p.Model,
+		"gcpVersion":         p.GCPVersion,
+		"setupUrl":           p.SetupURL,
+		"supportUrl":         p.SupportURL,
+		"updateUrl":          p.UpdateURL,
+		"firmware":           p.Firmware,
+		"capsHash":           p.CapsHash,
+		"tags":               p.Tags,
+		"queuedJobsCount":    queuedJobsCount,
+	}
+	access := []map[string]string{}
+	for scope, role := range p.Access {
+		access = append(access, map[string]string{"scope": scope, "role": role})
+	}
+	printer["access"] = access
+	if len(p.Capabilities) > 0 {
+		printer["capabilities"] = p.Capabilities
+	}
+	if len(p.SemanticState) > 0 {
+		printer["semanticState"] = p.SemanticState
+	}
+	writeSuccess(w, map[string]interface{}{"printers": []interface{}{printer}})
+}
+
+// updatePrinter sets the fields of p that are present in the form of r.
+func updatePrinter(p *Printer, r *http.Request) error {
+	r.ParseForm()
+	strings := map[string]*string{
+		"proxy":                &p.Proxy,
+		"name":                 &p.Name,
+		"default_display_name": &p.DefaultDisplayName,
+		"description":          &p.Description,
+		"location":             &p.Location,
+		"uuid":                 &p.UUID,
+		"manufacturer":         &p.Manufacturer,
+		"model":                &p.Model,
+		"gcp_version":          &p.GCPVersion,
+		"setup_url":            &p.SetupURL,
+		"support_url":          &p.SupportURL,
+		"update_url":           &p.UpdateURL,
+		"firmware":             &p.Firmware,
+		"capsHash":             &p.CapsHash,
+	}
+	for key, field := range strings {
+		if values, exists := r.Form[key]; exists {
+			*field = values[0]
+		}
+	}
+
+	raws := map[string]*json.RawMessage{
+		"capabilities":   &p.Capabilities,
+		"semantic_state": &p.SemanticState,
+	}
+	for key, field := range raws {
+		if values, exists := r.Form[key]; exists {
+			if !json.Valid([]byte(values[0])) {
+				return fmt.Errorf("Invalid JSON in %s", key)
+			}
+			*field = json.RawMessage(values[0])
+		}
+	}
+
+	if _, exists := r.Form["remove_tag"]; exists {
+		p.Tags = nil
+	}
+	p.Tags = append(p.Tags, r.Form["tag"]...)
+
+	return nil
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	p := &Printer{}
+	if err := updatePrinter(p, r); err != nil {
+		writeFailure(w, 400, err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	p.ID = s.newID("printer")
+	s.printers[p.ID] = p
+	s.mutex.Unlock()
+
+	writeSuccess(w, map[string]interface{}{
+		"printers": []map[string]string{{"id": p.ID, "name": p.Name}},
+	})
+}
+
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, exists := s.printers[r.FormValue("printerid")]
+	if !exists {
+		writeFailure(w, 404, "Printer not found")
+		return
+	}
+	if err := updatePrinter(p, r); err != nil {
+		writeFailure(w, 400, err.Error())
+		return
+	}
+	writeSuccess(w, nil)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	printerID := r.FormValue("printerid")
+	if _, exists := s.printers[printerID]; !exists {
+		writeFailure(w, 404, "Printer not found")
+		return
+	}
+	delete(s.printers, printerID)
+	writeSuccess(w, nil)
+}
+
+func (s *Server) handleShare(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, exists := s.printers[r.FormValue("printerid")]
+	if !exists {
+		writeFailure(w, 404, "Printer not found")
+		return
+	}
+	if p.Access == nil {
+		p.Access = make(map[string]string)
+	}
+	p.Access[r.FormValue("scope")] = r.FormValue("role")
+	writeSuccess(w, nil)
+}
+
+func (s *Server) handleUnshare(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, exists := s.printers[r.FormValue("printerid")]
+	if !exists {
+		writeFailure(w, 404, "Printer not found")
+		return
+	}
+	delete(p.Access, r.FormValue("scope"))
+	writeSuccess(w, nil)
+}
+
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
+	printerID := r.FormValue("printerid")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobs := []map[string]string{}
+	for _, id := range s.jobOrder {
+		job := s.jobs[id]
+		if job.PrinterID != printerID || jobStateType(job) != "QUEUED" {
+			continue
+		}
+		jobs = append(jobs, map[string]string{
+			"id":      job.ID,
+			"title":   job.Title,
+			"ownerId": job.OwnerID,
+			"fileUrl": s.BaseURL() + "download/" + job.ID,
+			// Milliseconds since the epoch.
+			"createTime": strconv.FormatInt(job.Created.UnixNano()/int64(time.Millisecond), 10),
+		})
+	}
+	if len(jobs) == 0 {
+		writeFailure(w, 413, "Zero print jobs returned")
+		return
+	}
+	writeSuccess(w, map[string]interface{}{"jobs": jobs})
+}
+
+func (s *Server) handleTicket(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job, exists := s.jobs[r.FormValue("jobid")]
+	if !exists {
+		writeFailure(w, 404, "Job not found")
+		return
+	}
+	// Like GCP, the ticket is the whole response.
+	writeJSON(w, job.Ticket)
+}
+
+func (s *Server) handleControl(w http.ResponseWriter, r *http.Request) {
+	var diff cdd.PrintJobStateDiff
+	if err := json.Unmarshal([]byte(r.FormValue("semantic_state_diff")), &diff); err != nil {
+		writeFailure(w, 400, fmt.Sprintf("Invalid semantic_state_diff: %s", err))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job, exists := s.jobs[r.FormValue("jobid")]
+	if !exists {
+		writeFailure(w, 404, "Job not found")
+		return
+	}
+	job.States = append(job.States, diff)
+	writeSuccess(w, nil)
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	jobID := strings.TrimPrefix(r.URL.Path, "/cloudprint/download/")
+
+	s.mutex.Lock()
+	job, exists := s.jobs[jobID]
+	var document []byte
+	if exists {
+		document = job.Document
+	}
+	s.mutex.Unlock()
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	// ServeContent honors Range requests.
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(document))
+}
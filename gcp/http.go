@@ -8,15 +8,27 @@ https://developers.google.com/open-source/licenses/bsd
 package gcp
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/metrics"
 
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
 	"golang.org/x/oauth2"
 )
 
@@ -38,9 +50,88 @@ https://github.com/golang/go/issues/6336
 */
 var lock *lib.Semaphore = lib.NewSemaphore(100)
 
+// Keep this many idle connections to each GCP host, instead of the default
+// two, so that concurrent API calls and downloads reuse connections rather
+// than set up new TLS sessions.
+const maxIdleConnsPerHost = 32
+
+// NewTransport creates an http.Transport that connects through the proxy
+// indicated by proxyURL (see lib.NewProxyDialFunc). When proxyURL is empty,
+// the HTTP_PROXY and HTTPS_PROXY environment variables are honored.
+//
+// The transport speaks HTTP/2 to servers that support it, and counts the
+// connections it opens in the gcp.connections metric.
+//
+// tlsConfig may be nil (see lib.NewTLSConfig).
+func NewTransport(proxyURL string, tlsConfig *tls.Config) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if tlsConfig != nil {
+		// Enabling HTTP/2 changes the config, which is shared with XMPP.
+		tlsConfig = tlsConfig.Clone()
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                countDials(dialer.Dial),
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+	}
+
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse GCP proxy URL %s: %s", proxyURL, err)
+		}
+		if u.Scheme == "http" {
+			// net/http knows how to CONNECT through an HTTP proxy.
+			transport.Proxy = http.ProxyURL(u)
+		} else {
+			dial, err := lib.NewProxyDialFunc(proxyURL, dialer)
+			if err != nil {
+				return nil, err
+			}
+			transport.Proxy = nil
+			transport.Dial = countDials(dial)
+		}
+	}
+
+	// net/http only enables HTTP/2 by itself when the transport has no
+	// custom dialer or TLS config.
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, fmt.Errorf("Failed to enable HTTP/2 for GCP: %s", err)
+	}
+
+	return transport, nil
+}
+
+// countDials wraps dial, to count new connections. Compared to the
+// gcp.requests metric, this shows how often connections are reused.
+func countDials(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err == nil {
+			metrics.Count("gcp.connections", 1, nil)
+		}
+		return conn, err
+	}
+}
+
+// do sends a request to GCP, limited by lock.
+func do(hc *http.Client, request *http.Request) (*http.Response, error) {
+	lock.Acquire()
+	response, err := hc.Do(request)
+	lock.Release()
+	metrics.Count("gcp.requests", 1, nil)
+	return response, err
+}
+
 // newClient creates an instance of http.Client, wrapped with OAuth
-// credentials.
-func newClient(oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, refreshToken string, scopes ...string) (*http.Client, error) {
+// credentials. All requests, including OAuth token refreshes, use
+// transport. Replaced refresh tokens are passed to save, if not nil.
+func newClient(transport http.RoundTripper, save RefreshTokenSaver, oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, refreshToken string, scopes ...string) (*http.Client, *tokenSource) {
 	config := &oauth2.Config{
 		ClientID:     oauthClientID,
 		ClientSecret: oauthClientSecret,
@@ -52,85 +143,275 @@ func newClient(oauthClientID, oauthClientSecret, oauthAuthURL, oauthTokenURL, re
 		Scopes:      scopes,
 	}
 
-	token := &oauth2.Token{RefreshToken: refreshToken}
-	client := config.Client(oauth2.NoContext, token)
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, &http.Client{Transport: transport})
+	source := newTokenSource(ctx, config, refreshToken, save)
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: source,
+			Base:   transport,
+		},
+	}
 
-	return client, nil
+	return client, source
 }
 
-// getWithRetry calls get() and retries once on HTTP failure
-// (response code != 200).
-func getWithRetry(hc *http.Client, url string) (*http.Response, error) {
-	response, err := get(hc, url)
-	if response != nil && response.StatusCode == 200 {
-		return response, err
+const (
+	// Retry transient failures this many times before giving up.
+	maxRetries = 4
+
+	// Wait this long before the first retry, then double the wait for each
+	// subsequent retry. A random jitter of up to +/- 50% is applied.
+	retryBackoffInitial = time.Second
+
+	// Don't wait longer than this before a retry, even when GCP asks to.
+	retryBackoffMax = 2 * time.Minute
+)
+
+// retryable answers the question "is it worth retrying a request that
+// failed with this HTTP status code?"
+//
+// Too Many Requests (429) and Service Unavailable (503) mean that the request
+// was not processed, so they can always be retried; so does Forbidden (403)
+// when it is a rate limit, which statusCode reports as 429. Other server and
+// network failures (5xx, 0) may have happened after the request was
+// processed, so those are retried only if the request is idempotent.
+func retryable(httpStatusCode int, idempotent bool) bool {
+	switch {
+	case httpStatusCode == 429 || httpStatusCode == 503:
+		return true
+	case httpStatusCode == 0 || httpStatusCode >= 500:
+		return idempotent
+	}
+	return false
+}
+
+// rateLimitReasons are the reasons that Google APIs give in 403 responses
+// when the caller is rate-limited, rather than forbidden.
+var rateLimitReasons = map[string]struct{}{
+	"rateLimitExceeded":     struct{}{},
+	"userRateLimitExceeded": struct{}{},
+}
+
+// statusCode returns the HTTP status code of a failed response, for
+// retryable, with rate limits that are answered 403 Forbidden reported as
+// 429 Too Many Requests. The body of a 403 response is read to find its
+// reason.
+func statusCode(response *http.Response) int {
+	if response.StatusCode != http.StatusForbidden {
+		return response.StatusCode
+	}
+
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&body); err != nil {
+		return response.StatusCode
+	}
+	for _, e := range body.Error.Errors {
+		if _, exists := rateLimitReasons[e.Reason]; exists {
+			return 429
+		}
+	}
+	return response.StatusCode
+}
+
+// retryDelay calculates how long to wait before the retry-th retry, honoring
+// the Retry-After value if provided by GCP.
+func retryDelay(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > retryBackoffMax {
+			return retryBackoffMax
+		}
+		return retryAfter
+	}
+
+	delay := retryBackoffInitial << uint(retry)
+	if delay > retryBackoffMax {
+		delay = retryBackoffMax
 	}
+	// Jitter by +/- 50% so that many goroutines don't retry in lock step.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
 
-	return get(hc, url)
+// parseRetryAfter parses the Retry-After HTTP header, which is either
+// a quantity of seconds or an HTTP date. Returns zero if the header is
+// missing or malformed.
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(time.Now())
+	}
+	return 0
+}
+
+// getWithRetry calls get() and retries transient failures with
+// exponential backoff.
+func getWithRetry(hc *http.Client, url string) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		response, httpStatusCode, retryAfter, err := get(hc, url)
+		if err == nil || retry >= maxRetries || !retryable(httpStatusCode, true) {
+			return response, err
+		}
+
+		delay := retryDelay(retry, retryAfter)
+		glog.Warningf("Retrying GET in %s: %s", delay.String(), err)
+		time.Sleep(delay)
+	}
 }
 
 // get GETs a URL. Returns the response object (not body), in case the body
 // is very large.
 //
+// Returns the response, HTTP status, Retry-After duration, and error.
+//
 // The caller must close the returned Response.Body object if err == nil.
-func get(hc *http.Client, url string) (*http.Response, error) {
+func get(hc *http.Client, url string) (*http.Response, int, time.Duration, error) {
 	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
 	}
 	request.Header.Set("X-CloudPrint-Proxy", lib.ShortName)
 
-	lock.Acquire()
-	response, err := hc.Do(request)
-	lock.Release()
+	response, err := do(hc, request)
 	if err != nil {
-		return nil, fmt.Errorf("GET failure: %s", err)
+		return nil, 0, 0, fmt.Errorf("GET failure: %s", err)
 	}
 	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("GET HTTP-level failure: %s %s", url, response.Status)
+		defer response.Body.Close()
+		return nil, statusCode(response), parseRetryAfter(response.Header),
+			fmt.Errorf("GET HTTP-level failure: %s %s", url, response.Status)
 	}
 
-	return response, nil
+	return response, response.StatusCode, 0, nil
 }
 
-// postWithRetry calls post() and retries once on HTTP failure
-// (response code != 200).
-func postWithRetry(hc *http.Client, url string, form url.Values) ([]byte, uint, int, error) {
-	responseBody, gcpErrorCode, httpStatusCode, err := post(hc, url, form)
-	if responseBody != nil && httpStatusCode == 200 {
-		return responseBody, gcpErrorCode, httpStatusCode, err
+// getFrom GETs a URL, asking the server with a Range header to skip the
+// first offset bytes. Servers that don't support ranges respond with the
+// whole resource. When accept is not "", the server is asked with an Accept
+// header for that content type.
+//
+// Returns the response, whether the response body starts at offset, HTTP
+// status, Retry-After duration, and error.
+//
+// The caller must close the returned Response.Body object if err == nil.
+func getFrom(hc *http.Client, url, accept string, offset int64) (*http.Response, bool, int, time.Duration, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, 0, 0, err
+	}
+	request.Header.Set("X-CloudPrint-Proxy", lib.ShortName)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	response, err := do(hc, request)
+	if err != nil {
+		return nil, false, 0, 0, fmt.Errorf("GET failure: %s", err)
 	}
 
-	return post(hc, url, form)
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response, offset == 0, response.StatusCode, 0, nil
+	case http.StatusPartialContent:
+		if offset > 0 && strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return response, true, response.StatusCode, 0, nil
+		}
+		response.Body.Close()
+		return nil, false, response.StatusCode, 0,
+			fmt.Errorf("GET unexpected Content-Range: %s %s", url, response.Header.Get("Content-Range"))
+	default:
+		defer response.Body.Close()
+		return nil, false, statusCode(response), parseRetryAfter(response.Header),
+			fmt.Errorf("GET HTTP-level failure: %s %s", url, response.Status)
+	}
 }
 
-// post POSTs to a URL. Returns the body of the response.
+// postWithRetry calls post() and retries transient failures with
+// exponential backoff. Use for idempotent API calls.
+func postWithRetry(hc *http.Client, url string, form url.Values) ([]byte, uint, int, error) {
+	return postWithBackoff(hc, url, form, true, false)
+}
+
+// postWithRateLimitRetry calls post() and retries only when GCP rejected
+// the request without processing it. Use for API calls that are not
+// idempotent, like register.
+func postWithRateLimitRetry(hc *http.Client, url string, form url.Values) ([]byte, uint, int, error) {
+	return postWithBackoff(hc, url, form, false, false)
+}
+
+// postWithBackoff calls post() like postWithRetry, or like
+// postWithRateLimitRetry when not idempotent. Use directly for API calls
+// with large bodies, like PPDs and CDDs, which are gzip-compressed when
+// compress is true.
+func postWithBackoff(hc *http.Client, url string, form url.Values, idempotent, compress bool) ([]byte, uint, int, error) {
+	for retry := 0; ; retry++ {
+		responseBody, gcpErrorCode, httpStatusCode, retryAfter, err := post(hc, url, form, compress)
+		if err == nil || retry >= maxRetries || !retryable(httpStatusCode, idempotent) {
+			return responseBody, gcpErrorCode, httpStatusCode, err
+		}
+
+		delay := retryDelay(retry, retryAfter)
+		glog.Warningf("Retrying POST in %s: %s", delay.String(), err)
+		time.Sleep(delay)
+	}
+}
+
+// post POSTs to a URL. Returns the body of the response. When compress is
+// true, the request body is gzip-compressed.
 //
-// Returns the response body, GCP error code, HTTP status, and error.
-// On success, only the response body is guaranteed to be non-zero.
-func post(hc *http.Client, url string, form url.Values) ([]byte, uint, int, error) {
-	requestBody := strings.NewReader(form.Encode())
+// Returns the response body, GCP error code, HTTP status, Retry-After
+// duration, and error. On success, only the response body is guaranteed
+// to be non-zero.
+func post(hc *http.Client, url string, form url.Values, compress bool) ([]byte, uint, int, time.Duration, error) {
+	var requestBody io.Reader = strings.NewReader(form.Encode())
+	if compress {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := io.Copy(w, requestBody); err != nil {
+			return nil, 0, 0, 0, fmt.Errorf("Failed to compress POST body: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, 0, 0, fmt.Errorf("Failed to compress POST body: %s", err)
+		}
+		requestBody = &b
+	}
+
 	request, err := http.NewRequest("POST", url, requestBody)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if compress {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
 	request.Header.Set("X-CloudPrint-Proxy", lib.ShortName)
 
-	lock.Acquire()
-	response, err := hc.Do(request)
-	lock.Release()
+	response, err := do(hc, request)
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("POST failure: %s", err)
+		return nil, 0, 0, 0, fmt.Errorf("POST failure: %s", err)
 	}
 	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		return nil, 0, response.StatusCode, fmt.Errorf("/%s POST HTTP-level failure: %s", url, response.Status)
+		return nil, 0, statusCode(response), parseRetryAfter(response.Header),
+			fmt.Errorf("/%s POST HTTP-level failure: %s", url, response.Status)
 	}
 
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, 0, response.StatusCode, err
+		return nil, 0, response.StatusCode, 0, err
 	}
 
 	var responseStatus struct {
@@ -139,12 +420,12 @@ func post(hc *http.Client, url string, form url.Values) ([]byte, uint, int, erro
 		ErrorCode uint
 	}
 	if err = json.Unmarshal(responseBody, &responseStatus); err != nil {
-		return responseBody, 0, response.StatusCode, err
+		return responseBody, 0, response.StatusCode, 0, err
 	}
 	if !responseStatus.Success {
-		return responseBody, responseStatus.ErrorCode, response.StatusCode, fmt.Errorf(
+		return responseBody, responseStatus.ErrorCode, response.StatusCode, 0, fmt.Errorf(
 			"%s call failed: %s", url, responseStatus.Message)
 	}
 
-	return responseBody, 0, response.StatusCode, nil
+	return responseBody, 0, response.StatusCode, 0, nil
 }
@@ -0,0 +1,112 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package gcp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		httpStatusCode int
+		idempotent     bool
+		want           bool
+	}{
+		{429, false, true},
+		{503, false, true},
+		{500, true, true},
+		{500, false, false},
+		{0, true, true},
+		{0, false, false},
+		{403, true, false},
+		{404, true, false},
+	} {
+		if got := retryable(test.httpStatusCode, test.idempotent); got != test.want {
+			t.Errorf("retryable(%d, %t) = %t, want %t", test.httpStatusCode, test.idempotent, got, test.want)
+		}
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		body   string
+		want   int
+	}{
+		{403, `{"error": {"errors": [{"domain": "usageLimits", "reason": "rateLimitExceeded"}], "code": 403}}`, 429},
+		{403, `{"error": {"errors": [{"reason": "userRateLimitExceeded"}]}}`, 429},
+		{403, `{"error": {"errors": [{"reason": "dailyLimitExceeded"}]}}`, 403},
+		{403, `{"error": {"errors": [{"reason": "forbidden"}]}}`, 403},
+		{403, `<html>Forbidden</html>`, 403},
+		{403, ``, 403},
+		{500, `{"error": {"errors": [{"reason": "rateLimitExceeded"}]}}`, 500},
+	} {
+		response := &http.Response{StatusCode: test.status, Body: ioutil.NopCloser(strings.NewReader(test.body))}
+		if got := statusCode(response); got != test.want {
+			t.Errorf("statusCode(%d, %s) = %d, want %d", test.status, test.body, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	// Retry-After is honored, up to retryBackoffMax.
+	if delay := retryDelay(0, 7*time.Second); delay != 7*time.Second {
+		t.Errorf("retryDelay with Retry-After 7s = %s", delay)
+	}
+	if delay := retryDelay(0, time.Hour); delay != retryBackoffMax {
+		t.Errorf("retryDelay with Retry-After 1h = %s, want %s", delay, retryBackoffMax)
+	}
+
+	// Otherwise the backoff doubles, with +/- 50% jitter, up to
+	// retryBackoffMax, with jitter too.
+	for retry := 0; retry < 10; retry++ {
+		base := retryBackoffInitial << uint(retry)
+		if base > retryBackoffMax {
+			base = retryBackoffMax
+		}
+		for i := 0; i < 20; i++ {
+			delay := retryDelay(retry, 0)
+			if delay < base/2 || delay >= base/2+base {
+				t.Errorf("retryDelay(%d, 0) = %s, want within [%s, %s)", retry, delay, base/2, base/2+base)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+	} {
+		header := http.Header{}
+		if test.value != "" {
+			header.Set("Retry-After", test.value)
+		}
+		if got := parseRetryAfter(header); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+
+	// An HTTP date, which has a resolution of one second.
+	header := http.Header{}
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got := parseRetryAfter(header); got <= 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter of a date in a minute = %s", got)
+	}
+}
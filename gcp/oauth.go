@@ -0,0 +1,129 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package gcp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Refresh access tokens this long before they expire, so that
+	// requests in flight never carry an expired token.
+	tokenRefreshMargin = 5 * time.Minute
+
+	// After the refresh token has been rejected, try it again this often,
+	// in case the rejection was a mistake on the server side.
+	tokenRetryInterval = 10 * time.Minute
+)
+
+// RefreshTokenSaver persists a refresh token that the OAuth server issued
+// to replace the previous one.
+type RefreshTokenSaver func(refreshToken string) error
+
+// tokenSource is an oauth2.TokenSource that refreshes access tokens before
+// they expire, saves replaced refresh tokens, and remembers when the refresh
+// token has been permanently rejected.
+type tokenSource struct {
+	config *oauth2.Config
+	ctx    context.Context
+	save   RefreshTokenSaver
+
+	mutex          sync.Mutex
+	token          *oauth2.Token
+	authErr        error
+	authErrLastTry time.Time
+}
+
+func newTokenSource(ctx context.Context, config *oauth2.Config, refreshToken string, save RefreshTokenSaver) *tokenSource {
+	return &tokenSource{
+		config: config,
+		ctx:    ctx,
+		save:   save,
+		token:  &oauth2.Token{RefreshToken: refreshToken},
+	}
+}
+
+// Token returns a valid access token, refreshing it when it expires
+// within tokenRefreshMargin.
+func (ts *tokenSource) Token() (*oauth2.Token, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.token.AccessToken != "" && ts.token.Expiry.After(time.Now().Add(tokenRefreshMargin)) {
+		token := *ts.token
+		return &token, nil
+	}
+
+	if ts.authErr != nil && time.Since(ts.authErrLastTry) < tokenRetryInterval {
+		return nil, ts.authErr
+	}
+
+	refreshToken := ts.token.RefreshToken
+	token, err := ts.config.TokenSource(ts.ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		if !isPermanentTokenError(err) {
+			return nil, fmt.Errorf("Failed to refresh OAuth access token: %s", err)
+		}
+		if ts.authErr == nil {
+			glog.Errorf("OAuth refresh token was rejected; pausing until it is accepted again: %s", err)
+		}
+		ts.authErr = fmt.Errorf("OAuth refresh token was rejected: %s", err)
+		ts.authErrLastTry = time.Now()
+		return nil, ts.authErr
+	}
+
+	if ts.authErr != nil {
+		glog.Info("OAuth refresh token was accepted again")
+		ts.authErr = nil
+	}
+
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	} else if token.RefreshToken != refreshToken && ts.save != nil {
+		if err := ts.save(token.RefreshToken); err != nil {
+			glog.Errorf("Failed to save new OAuth refresh token: %s", err)
+		} else {
+			glog.Info("Saved new OAuth refresh token")
+		}
+	}
+
+	ts.token = token
+	copy := *token
+	return &copy, nil
+}
+
+// AuthError returns the error with which the refresh token was permanently
+// rejected, or nil if the refresh token is OK.
+func (ts *tokenSource) AuthError() error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.authErr
+}
+
+// isPermanentTokenError answers the question "did the OAuth server reject
+// the refresh token itself, rather than fail for some temporary reason?"
+func isPermanentTokenError(err error) bool {
+	re, ok := err.(*oauth2.RetrieveError)
+	if !ok || re.Response == nil {
+		return false
+	}
+	if re.Response.StatusCode != 400 && re.Response.StatusCode != 401 {
+		return false
+	}
+	body := string(re.Body)
+	return strings.Contains(body, "invalid_grant") || strings.Contains(body, "unauthorized_client") ||
+		strings.Contains(body, "invalid_client")
+}
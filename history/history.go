@@ -0,0 +1,123 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package history keeps a file of finished jobs and printer state changes,
+// and reports on the printer fleet from it.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of records.
+const (
+	KindJob          = "job"
+	KindPrinterState = "printer_state"
+)
+
+// Record is a finished job, or a change of a printer's state.
+type Record struct {
+	// When the job finished, or when the printer's state changed.
+	Time         time.Time `json:"time"`
+	Kind         string    `json:"kind"`
+	Printer      string    `json:"printer"`
+	GCPPrinterID string    `json:"gcp_printer_id"`
+	// GCP job state, like DONE or ABORTED, or printer state, like IDLE or
+	// STOPPED.
+	State string `json:"state"`
+
+	GCPJobID string `json:"gcp_job_id,omitempty"`
+	Pages    int32  `json:"pages,omitempty"`
+	// Seconds from receipt of the job to its finish, and seconds that CUPS
+	// spent printing it.
+	Seconds      float64 `json:"seconds,omitempty"`
+	PrintSeconds float64 `json:"print_seconds,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	// GCP job owner, an email address, whatever CUPS user the job was
+	// submitted as.
+	Owner string `json:"owner,omitempty"`
+	// Whether a local client printed the job while GCP was unreachable.
+	Offline bool `json:"offline,omitempty"`
+}
+
+// Store appends records to a file, one JSON object per line.
+type Store struct {
+	mutex    sync.Mutex
+	filename string
+}
+
+// NewStore appends records to filename, which is created when it doesn't
+// exist.
+func NewStore(filename string) *Store {
+	return &Store{filename: filename}
+}
+
+// Append adds r to the end of the file.
+func (s *Store) Append(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open job history file: %s", err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("Failed to write job history file: %s", err)
+	}
+	return nil
+}
+
+// Read returns the records in the file, oldest first.
+func (s *Store) Read() ([]Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return ReadFile(s.filename)
+}
+
+// ReadFile returns the records in the job history file filename, oldest
+// first. A missing file has no records.
+func ReadFile(filename string) ([]Record, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open job history file: %s", err)
+	}
+	defer f.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("Failed to parse line %d of job history file %s: %s", line, filename, err)
+		}
+		records = append(records, r)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read job history file: %s", err)
+	}
+	return records, nil
+}
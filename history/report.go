@@ -0,0 +1,181 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// Report summarizes the jobs and states of each printer over a period.
+type Report struct {
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Printers []PrinterReport `json:"printers"`
+}
+
+// PrinterReport summarizes the jobs and states of one printer.
+type PrinterReport struct {
+	Name  string `json:"name"`
+	GCPID string `json:"gcp_printer_id"`
+
+	Jobs      uint  `json:"jobs"`
+	JobsDone  uint  `json:"jobs_done"`
+	JobsError uint  `json:"jobs_error"`
+	Pages     int64 `json:"pages"`
+	// Jobs that local clients printed while GCP was unreachable.
+	OfflineJobs uint `json:"offline_jobs"`
+	// Share of jobs that didn't finish DONE, from 0 to 1.
+	ErrorRate float64 `json:"error_rate"`
+	// Average seconds that CUPS spent printing a job.
+	AveragePrintSeconds float64 `json:"average_print_seconds"`
+	// Share of the period that the printer wasn't STOPPED, from 0 to 1.
+	Uptime float64 `json:"uptime"`
+
+	printSeconds float64
+	printedJobs  uint
+	stoppedSince time.Time
+	downtime     time.Duration
+}
+
+// NewReport summarizes records, oldest first, from from to to. Records
+// before from count only for the state that printers were in at from;
+// printers are up until a record says otherwise.
+func NewReport(records []Record, from, to time.Time) Report {
+	printers := make(map[string]*PrinterReport)
+	printer := func(r Record) *PrinterReport {
+		p, exists := printers[r.GCPPrinterID]
+		if !exists {
+			p = &PrinterReport{GCPID: r.GCPPrinterID}
+			printers[r.GCPPrinterID] = p
+		}
+		p.Name = r.Printer
+		return p
+	}
+
+	for _, r := range records {
+		if r.Time.After(to) {
+			continue
+		}
+
+		switch r.Kind {
+		case KindPrinterState:
+			p := printer(r)
+			t := r.Time
+			if t.Before(from) {
+				t = from
+			}
+			if r.State == "STOPPED" {
+				if p.stoppedSince.IsZero() {
+					p.stoppedSince = t
+				}
+			} else if !p.stoppedSince.IsZero() {
+				p.downtime += t.Sub(p.stoppedSince)
+				p.stoppedSince = time.Time{}
+			}
+
+		case KindJob:
+			if r.Time.Before(from) {
+				continue
+			}
+			p := printer(r)
+			p.Jobs++
+			if r.State == "DONE" {
+				p.JobsDone++
+			} else {
+				p.JobsError++
+			}
+			p.Pages += int64(r.Pages)
+			if r.Offline {
+				p.OfflineJobs++
+			}
+			if r.PrintSeconds > 0 {
+				p.printSeconds += r.PrintSeconds
+				p.printedJobs++
+			}
+		}
+	}
+
+	report := Report{From: from, To: to, Printers: make([]PrinterReport, 0, len(printers))}
+	period := to.Sub(from)
+	for _, p := range printers {
+		if !p.stoppedSince.IsZero() {
+			p.downtime += to.Sub(p.stoppedSince)
+		}
+		if p.Jobs > 0 {
+			p.ErrorRate = float64(p.JobsError) / float64(p.Jobs)
+		}
+		if p.printedJobs > 0 {
+			p.AveragePrintSeconds = p.printSeconds / float64(p.printedJobs)
+		}
+		p.Uptime = 1
+		if period > 0 {
+			p.Uptime = 1 - p.downtime.Seconds()/period.Seconds()
+		}
+		report.Printers = append(report.Printers, *p)
+	}
+	sort.Sort(printerReportsByName(report.Printers))
+
+	return report
+}
+
+type printerReportsByName []PrinterReport
+
+func (r printerReportsByName) Len() int           { return len(r) }
+func (r printerReportsByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+func (r printerReportsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// WriteJSON writes the report as indented JSON.
+func (r Report) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.1f%%", f*100)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Printer fleet report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Printer fleet report</h1>
+<p>From {{time .From}} to {{time .To}}</p>
+<table>
+<tr><th>Printer</th><th>Jobs</th><th>Done</th><th>Errors</th><th>Error rate</th><th>Pages</th><th>Offline jobs</th><th>Average print time</th><th>Uptime</th></tr>
+{{range .Printers}}<tr><td>{{.Name}}</td><td>{{.Jobs}}</td><td>{{.JobsDone}}</td><td>{{.JobsError}}</td><td>{{percent .ErrorRate}}</td><td>{{.Pages}}</td><td>{{.OfflineJobs}}</td><td>{{printf "%.1f" .AveragePrintSeconds}}s</td><td>{{percent .Uptime}}</td></tr>
+{{else}}<tr><td colspan="9">No printers</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as an HTML page.
+func (r Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
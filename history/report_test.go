@@ -0,0 +1,92 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewReport(t *testing.T) {
+	from := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(100 * time.Hour)
+	records := []Record{
+		// Before the period: only the state counts.
+		{Time: from.Add(-time.Hour), Kind: KindJob, Printer: "a", GCPPrinterID: "1", State: "DONE", Pages: 5},
+		{Time: from.Add(-time.Hour), Kind: KindPrinterState, Printer: "b", GCPPrinterID: "2", State: "STOPPED"},
+		{Time: from.Add(time.Hour), Kind: KindJob, Printer: "a", GCPPrinterID: "1", State: "DONE", Pages: 2, PrintSeconds: 10},
+		{Time: from.Add(2 * time.Hour), Kind: KindJob, Printer: "a", GCPPrinterID: "1", State: "ABORTED", Pages: 1},
+		{Time: from.Add(3 * time.Hour), Kind: KindJob, Printer: "a", GCPPrinterID: "1", State: "DONE", Pages: 3, PrintSeconds: 20, Offline: true},
+		{Time: from.Add(10 * time.Hour), Kind: KindPrinterState, Printer: "b", GCPPrinterID: "2", State: "IDLE"},
+		{Time: from.Add(90 * time.Hour), Kind: KindPrinterState, Printer: "a", GCPPrinterID: "1", State: "STOPPED"},
+		// After the period.
+		{Time: to.Add(time.Hour), Kind: KindJob, Printer: "b", GCPPrinterID: "2", State: "DONE"},
+	}
+
+	report := NewReport(records, from, to)
+	if len(report.Printers) != 2 {
+		t.Fatalf("expected 2 printers, got %+v", report.Printers)
+	}
+
+	a := report.Printers[0]
+	if a.Name != "a" || a.Jobs != 3 || a.JobsDone != 2 || a.JobsError != 1 || a.Pages != 6 {
+		t.Errorf("wrong jobs of printer a: %+v", a)
+	}
+	if a.OfflineJobs != 1 {
+		t.Errorf("expected printer a to print 1 job offline, got %d", a.OfflineJobs)
+	}
+	if a.AveragePrintSeconds != 15 {
+		t.Errorf("expected printer a to print in 15 seconds on average, got %f", a.AveragePrintSeconds)
+	}
+	if a.ErrorRate < 0.33 || a.ErrorRate > 0.34 {
+		t.Errorf("expected printer a error rate of 1/3, got %f", a.ErrorRate)
+	}
+	if a.Uptime != 0.9 {
+		t.Errorf("expected printer a uptime of 0.9, got %f", a.Uptime)
+	}
+
+	b := report.Printers[1]
+	if b.Name != "b" || b.Jobs != 0 {
+		t.Errorf("wrong jobs of printer b: %+v", b)
+	}
+	if b.Uptime != 0.9 {
+		t.Errorf("expected printer b uptime of 0.9, got %f", b.Uptime)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStore(filepath.Join(dir, "jobs.json"))
+	records, err := s.Read()
+	if err != nil || len(records) != 0 {
+		t.Fatalf("expected no records in a missing file, got %v, %s", records, err)
+	}
+
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, id := range []string{"x", "y"} {
+		if err = s.Append(Record{Time: now, Kind: KindJob, GCPJobID: id, State: "DONE"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err = s.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].GCPJobID != "x" || records[1].GCPJobID != "y" || !records[1].Time.Equal(now) {
+		t.Errorf("wrong records read back: %+v", records)
+	}
+}
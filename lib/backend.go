@@ -0,0 +1,29 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+// UnreachableError indicates that the print system, like the CUPS server,
+// could not be contacted, as opposed to the print system reporting an
+// error. This happens when cupsd restarts, and is usually temporary.
+type UnreachableError struct {
+	Message string
+}
+
+func (e *UnreachableError) Error() string {
+	return e.Message
+}
+
+// StreamUnsupportedError indicates that the print system can't receive a
+// job document as a stream, so the document must be printed from a file.
+type StreamUnsupportedError struct {
+	Message string
+}
+
+func (e *StreamUnsupportedError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// commandKillDelay is how long WaitCommand waits for a killed command to
+// close its output, before it gives up on it.
+const commandKillDelay = 5 * time.Second
+
+// CommandTimeoutError indicates that a command ran longer than it may, and
+// was killed.
+type CommandTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *CommandTimeoutError) Error() string {
+	return fmt.Sprintf("killed after %s", e.Timeout)
+}
+
+// StartCommand starts cmd in a process group of its own, so that
+// WaitCommand can kill the processes that it starts, too.
+func StartCommand(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return cmd.Start()
+}
+
+// WaitCommand waits for a command that StartCommand started to exit. When
+// it runs longer than timeout, its process group is killed, and a
+// *CommandTimeoutError is returned. Killing only the command would leave
+// Wait waiting for children that hold its output open, like those of a
+// shell script.
+//
+// A child that left the process group can hold the output open still; then
+// WaitCommand returns after commandKillDelay anyway, and cmd's output
+// writers may be written to until the child exits.
+func WaitCommand(cmd *exec.Cmd, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	select {
+	case <-done:
+	case <-time.After(commandKillDelay):
+	}
+	return &CommandTimeoutError{timeout}
+}
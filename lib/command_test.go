@@ -0,0 +1,59 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWaitCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "echo hello")
+	cmd.Stdout = &stdout
+	if err := StartCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitCommand(cmd, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("Got output %q, want hello", stdout.String())
+	}
+
+	cmd = exec.Command("/bin/sh", "-c", "exit 3")
+	if err := StartCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitCommand(cmd, 10*time.Second); err == nil {
+		t.Errorf("Failed command returned no error")
+	} else if _, ok := err.(*exec.ExitError); !ok {
+		t.Errorf("Got %T error, want *exec.ExitError", err)
+	}
+}
+
+func TestWaitCommandKillsChildren(t *testing.T) {
+	// The sleep holds the shell's stdout open after the shell is killed.
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "sleep 60; echo done")
+	cmd.Stdout = &stdout
+	if err := StartCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := WaitCommand(cmd, 100*time.Millisecond)
+	if e, ok := err.(*CommandTimeoutError); !ok || e.Timeout != 100*time.Millisecond {
+		t.Errorf("Got error %v, want a CommandTimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed >= commandKillDelay {
+		t.Errorf("WaitCommand returned after %s; the children weren't killed", elapsed)
+	}
+}
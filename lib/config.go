@@ -10,8 +10,12 @@ package lib
 import (
 	"encoding/json"
 	"flag"
-	"io/ioutil"
+	"os"
+	"regexp"
 	"runtime"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -30,11 +34,17 @@ var (
 
 	FullName string = "Google Cloud Print CUPS Connector version " + BuildDate + "-" + runtime.GOOS
 
+	// When the connector started.
+	StartTime = time.Now()
+
 	ConfigFilename = flag.String(
 		"config-filename", "cups-connector.config.json", "Name of config file")
 )
 
 type Config struct {
+	// Version of the config file schema; see CurrentConfigVersion.
+	ConfigVersion uint `json:"config_version"`
+
 	// Associated with root account. XMPP credential.
 	XMPPJID string `json:"xmpp_jid"`
 
@@ -47,39 +57,224 @@ type Config struct {
 	// Scope (user, group, domain) to share printers with.
 	ShareScope string `json:"share_scope,omitempty"`
 
+	// Additional scopes (users, groups, domains) to share printers with.
+	ShareScopes []string `json:"share_scopes,omitempty"`
+
+	// Scopes to share individual printers with, in addition to the scopes
+	// above, keyed by CUPS printer name.
+	PrinterShareScopes map[string][]string `json:"printer_share_scopes,omitempty"`
+
+	// Tags to add to GCP printers, like building or cost center, by CUPS
+	// printer name. The tags under "*" are added to all printers.
+	PrinterTags map[string]map[string]string `json:"printer_tags,omitempty"`
+
+	// Pages that each printer may print per day, by CUPS printer name; the
+	// quota under "*" applies to printers without their own. Zero means no
+	// quota.
+	PrinterDailyQuota map[string]uint `json:"printer_daily_quota,omitempty"`
+
+	// Role (USER or MANAGER) to share printers with.
+	ShareRole string `json:"share_role"`
+
+	// Whether to unshare printers from scopes that aren't configured above.
+	ShareRevokeUnlisted bool `json:"share_revoke_unlisted"`
+
+	// LDAP groups whose members printers are shared with, as users, in
+	// addition to the scopes above.
+	LDAPShare *LDAPShare `json:"ldap_share,omitempty"`
+
+	// Google Workspace org units and groups whose users printers are
+	// shared with, in addition to the scopes above.
+	GoogleDirectoryShare *GoogleDirectoryShare `json:"google_directory_share,omitempty"`
+
+	// Owners whose jobs are printed, as email addresses or domains like
+	// example.com; jobs of other owners are aborted, even when printers
+	// were re-shared with them. Empty allows everyone.
+	JobOwnerAllowlist []string `json:"job_owner_allowlist,omitempty"`
+
+	// How to translate job owners into the CUPS users that their jobs are
+	// submitted as. Owners that aren't mapped are submitted as their email
+	// address, or its local part; see cups_job_full_username.
+	JobOwnerMap *JobOwnerMap `json:"job_owner_map,omitempty"`
+
+	// IDs of GCP printers, shared with the robot account above by other
+	// accounts, whose share invitations are accepted automatically.
+	AcceptInvites []string `json:"accept_invites,omitempty"`
+
 	// User-chosen name of this proxy. Should be unique per Google user account.
 	ProxyName string `json:"proxy_name"`
 
+	// What to do at startup when another connector instance, on another
+	// host, seems to be running with the same proxy name: "warn" logs an
+	// error; "refuse" exits.
+	ProxyConflictAction string `json:"proxy_conflict_action"`
+
 	// Maximum quantity of PDFs to download concurrently.
 	GCPMaxConcurrentDownloads uint `json:"gcp_max_concurrent_downloads"`
 
+	// Maximum size, in megabytes, of a job document. Larger jobs are
+	// aborted. Zero means no limit.
+	GCPMaxDownloadMB uint `json:"gcp_max_download_mb"`
+
+	// Maximum age of a job when it is fetched. Older jobs are aborted
+	// instead of printed. Zero means no limit.
+	GCPMaxJobAge string `json:"gcp_max_job_age"`
+
+	// Maximum quantity of each printer's jobs to start processing per
+	// minute. Zero means no limit.
+	GCPMaxJobsPerMinute uint `json:"gcp_max_jobs_per_minute"`
+
+	// Print system that printers and jobs live in: "cups", or "exec" for
+	// the executables in exec_backend.
+	Backend string `json:"backend"`
+
+	// Executables of the exec backend.
+	ExecBackend *ExecBackendConfig `json:"exec_backend,omitempty"`
+
 	// Maximum quantity of open CUPS connections.
 	CUPSMaxConnections uint `json:"cups_max_connections"`
 
 	// CUPS timeout for opening a new connection.
 	CUPSConnectTimeout string `json:"cups_connect_timeout"`
 
+	// How long CUPS may stay silent when listing printers.
+	CUPSListTimeout string `json:"cups_list_timeout"`
+
+	// How long CUPS may stay silent when fetching a PPD, or adding a printer.
+	CUPSPPDTimeout string `json:"cups_ppd_timeout"`
+
+	// How long CUPS may stay silent when submitting a job.
+	CUPSPrintTimeout string `json:"cups_print_timeout"`
+
+	// How long CUPS may stay silent when getting the state of a job, or
+	// canceling it.
+	CUPSJobStateTimeout string `json:"cups_job_state_timeout"`
+
+	// Maximum quantity of PPDs to fetch from CUPS at the same time.
+	CUPSPPDFetchWorkers uint `json:"cups_ppd_fetch_workers"`
+
+	// What translates PPDs to capabilities: gcp, GCP's translation service,
+	// or local, the connector itself. Empty, in configs from before the
+	// local translator, means gcp.
+	CUPSPPDTranslator string `json:"cups_ppd_translator"`
+
 	// CUPS job queue size.
 	CUPSJobQueueSize uint `json:"cups_job_queue_size"`
 
 	// Interval (eg 10s, 1m) between CUPS printer state polls.
 	CUPSPrinterPollInterval string `json:"cups_printer_poll_interval"`
 
+	// Interval (eg 10s, 1m) between CUPS printer state polls, which only
+	// report printer state changes to GCP.
+	CUPSPrinterStatePollInterval string `json:"cups_printer_state_poll_interval"`
+
+	// Interval (eg 1h) between fetches of all attributes of all CUPS
+	// printers. In between, only printers that changed are fetched. Zero
+	// means that all printers are fetched on each poll.
+	CUPSPrinterFullFetchInterval string `json:"cups_printer_full_fetch_interval"`
+
+	// CUPS configuration files, like printers.conf, whose changes make the
+	// connector synchronize printers without waiting for the poll interval.
+	// Empty disables.
+	CUPSWatchFiles []string `json:"cups_watch_files"`
+
 	// CUPS printer attributes to copy to GCP.
 	CUPSPrinterAttributes []string `json:"cups_printer_attributes"`
 
 	// Whether to use the full username (joe@example.com) in CUPS jobs.
 	CUPSJobFullUsername bool `json:"cups_job_full_username"`
 
+	// CUPS user to submit all jobs as, for CUPS policies that only let a
+	// service account print. Empty submits jobs as their owners.
+	CUPSJobUser string `json:"cups_job_user"`
+
+	// Whether to send the GCP job owner in the job-accounting-user-id
+	// attribute of CUPS jobs.
+	CUPSJobAccountingOwner bool `json:"cups_job_accounting_owner"`
+
+	// When to print jobs, as CUPS job-hold-until values like "night" or
+	// "22:00" (UTC), by CUPS printer name; the value under "*" applies to
+	// printers without their own. A job-hold-until vendor ticket item takes
+	// precedence.
+	CUPSJobHoldUntil map[string]string `json:"cups_job_hold_until,omitempty"`
+
 	// Whether to ignore printers with make/model 'Local Raw Printer'.
 	CUPSIgnoreRawPrinters bool `json:"cups_ignore_raw_printers"`
 
+	// Whether to register only the printers that CUPS shares, those with
+	// printer-is-shared true.
+	CUPSSharedPrintersOnly bool `json:"cups_shared_printers_only"`
+
+	// Whether to stream job documents from GCP into CUPS, instead of
+	// downloading them to temporary files first.
+	CUPSStreamJobs bool `json:"cups_stream_jobs"`
+
 	// Whether to copy the CUPS printer's printer-info attribute to the GCP printer's defaultDisplayName.
 	CopyPrinterInfoToDisplayName bool `json:"copy_printer_info_to_display_name"`
 
 	// Filename of unix socket for connector-check to talk to connector.
 	MonitorSocketFilename string `json:"monitor_socket_filename"`
 
+	// Address, like "localhost:8088", to serve the /healthz and /readyz
+	// HTTP endpoints on. Empty disables.
+	HealthListenAddress string `json:"health_listen_address"`
+
+	// Address, like "localhost:8089", to serve the admin HTTP API on.
+	// Empty disables.
+	AdminListenAddress string `json:"admin_listen_address"`
+
+	// Token that admin API requests must carry, in an
+	// "Authorization: Bearer" header, or as the password of HTTP Basic
+	// authentication, with any user name.
+	AdminToken string `json:"admin_token"`
+
+	// Log format: "text" logs with glog only; "json" also writes JSON lines,
+	// with fields like gcp_job_id and printer, to stderr.
+	LogFormat string `json:"log_format"`
+
+	// Size, in megabytes, at which log files are rotated.
+	LogMaxMegabytes uint `json:"log_max_megabytes"`
+
+	// Rotated log files to keep per severity; 0 keeps all.
+	LogMaxFiles uint `json:"log_max_files"`
+
+	// Whether to gzip rotated log files.
+	LogCompress bool `json:"log_compress"`
+
+	// Syslog server to send log lines to, like "udp://loghost:514",
+	// "tcp://loghost:601" or "unix:///dev/log". Empty disables.
+	SyslogAddress string `json:"syslog_address"`
+
+	// Syslog facility, like "daemon" or "local0".
+	SyslogFacility string `json:"syslog_facility"`
+
+	// StatsD server to send metrics to, like "localhost:8125". Empty
+	// disables.
+	MetricsStatsDAddress string `json:"metrics_statsd_address"`
+
+	// OpenTelemetry collector to send metrics to, as OTLP/HTTP, like
+	// "http://localhost:4318". Empty disables.
+	MetricsOTLPEndpoint string `json:"metrics_otlp_endpoint"`
+
+	// Prefix of metric names.
+	MetricsPrefix string `json:"metrics_prefix"`
+
+	// How often to sample gauges, like jobs in flight, and to send
+	// metrics to the OpenTelemetry collector.
+	MetricsInterval string `json:"metrics_interval"`
+
+	// Executable to run when a printer stops, reports a fault, or fails
+	// too many jobs, with the alert as JSON on its standard input. Empty
+	// disables.
+	AlertCommand string `json:"alert_command"`
+
+	// URL to POST alerts to, as JSON. Empty disables.
+	AlertURL string `json:"alert_url"`
+
+	// Percentage of a printer's last 10 jobs that must fail to send an
+	// alert. 0 disables.
+	AlertJobErrorPercent uint `json:"alert_job_error_percent"`
+
 	// GCP API URL prefix.
 	GCPBaseURL string `json:"gcp_base_url"`
 
@@ -89,6 +284,16 @@ type Config struct {
 	// XMPP server port number.
 	XMPPPort uint16 `json:"xmpp_port"`
 
+	// XMPP server port number to try when xmpp_port is unreachable. Must
+	// differ from xmpp_port; 0 disables the fallback.
+	XMPPFallbackPort uint16 `json:"xmpp_fallback_port"`
+
+	// Hostname that the XMPP server's TLS certificate must be valid for.
+	XMPPServerHostname string `json:"xmpp_server_hostname"`
+
+	// JID of the GCP service, which sends print job notifications.
+	XMPPCloudPrintJID string `json:"xmpp_cloudprint_jid"`
+
 	// XMPP ping timeout (give up waiting after this time).
 	XMPPPingTimeout string `json:"gcp_xmpp_ping_timeout"`
 
@@ -97,6 +302,14 @@ type Config struct {
 	// be overridden through the GCP API update method.
 	XMPPPingIntervalDefault string `json:"gcp_xmpp_ping_interval_default"`
 
+	// Whether to shorten the XMPP ping interval automatically, until pings
+	// survive the idle timeout of the network, like a NAT's.
+	XMPPPingIntervalAuto bool `json:"gcp_xmpp_ping_interval_auto"`
+
+	// Where to save what XMPP ping interval tuning learned, to resume it
+	// after a restart; empty to not save it.
+	XMPPPingIntervalFile string `json:"gcp_xmpp_ping_interval_file"`
+
 	// OAuth2 client ID (not unique per client).
 	GCPOAuthClientID string `json:"gcp_oauth_client_id"`
 
@@ -117,17 +330,439 @@ type Config struct {
 
 	// Maximum quantity of open SNMP connections.
 	SNMPMaxConnections uint `json:"snmp_max_connections"`
+
+	// How often to poll printer states over SNMP, along with CUPS printer
+	// states, instead of cups_printer_state_poll_interval.
+	SNMPPollInterval string `json:"snmp_poll_interval"`
+
+	// Whether to leave jobs queued in GCP for printers that report a
+	// critical alert over SNMP, like door open or out of paper.
+	SNMPPauseOnFault bool `json:"snmp_pause_on_fault"`
+
+	// Before fetching jobs for a printer whose device hasn't answered for
+	// this long, connect to its device-uri, and leave the jobs queued in GCP
+	// when it doesn't answer. Zero disables.
+	PrinterProbeInterval string `json:"printer_probe_interval"`
+
+	// How long to wait for a printer device to accept a connection.
+	PrinterProbeTimeout string `json:"printer_probe_timeout"`
+
+	// Find IPP printers on the local network over mDNS, and add CUPS queues
+	// for the printers that no queue prints to.
+	DiscoveryEnable bool `json:"discovery_enable"`
+
+	// IPv4 networks, like 192.168.1.0/24, to also sweep for printers over
+	// SNMP, with snmp_community.
+	DiscoveryNetworks []string `json:"discovery_networks,omitempty"`
+
+	// Interval (eg 10m) between discoveries.
+	DiscoveryInterval string `json:"discovery_interval"`
+
+	// Proxy for GCP API and OAuth requests, like http://host:port or
+	// socks5://host:port. When empty, HTTPS_PROXY is honored.
+	GCPProxyURL string `json:"gcp_proxy_url,omitempty"`
+
+	// Proxy for the XMPP connection, like http://host:port (using CONNECT)
+	// or socks5://host:port. When empty, XMPP connects directly.
+	XMPPProxyURL string `json:"xmpp_proxy_url,omitempty"`
+
+	// PEM bundle of CAs to trust for GCP API, OAuth and XMPP connections,
+	// instead of the system CAs.
+	TLSCAFile string `json:"tls_ca_file,omitempty"`
+
+	// Base64 SHA-256 hashes of public keys (SubjectPublicKeyInfo), at least
+	// one of which must be in the certificate chain of GCP API, OAuth and
+	// XMPP servers.
+	TLSPins []string `json:"tls_pins,omitempty"`
+
+	// When XMPP is unavailable, poll GCP for jobs at least this often.
+	// The interval grows while no jobs are found, up to the max.
+	FallbackPollIntervalMin string `json:"gcp_fallback_poll_interval_min"`
+
+	// When XMPP is unavailable, poll GCP for jobs at most this often.
+	FallbackPollIntervalMax string `json:"gcp_fallback_poll_interval_max"`
+
+	// Enable Privet local discovery and local printing.
+	LocalPrintingEnable bool `json:"local_printing_enable"`
+
+	// Lowest port for the per-printer Privet HTTP servers.
+	LocalPortLow uint16 `json:"local_port_low"`
+
+	// Highest port for the per-printer Privet HTTP servers.
+	LocalPortHigh uint16 `json:"local_port_high"`
+
+	// Timeout for uploads of PPDs and capabilities to GCP, which can be
+	// several megabytes.
+	GCPUploadTimeout string `json:"gcp_upload_timeout"`
+
+	// Whether to gzip-compress uploads of PPDs and capabilities to GCP.
+	GCPCompressUploads bool `json:"gcp_compress_uploads"`
+
+	// File to save the GCP printer list in, so that the connector can start
+	// with the last known printers when GCP is unreachable. Empty disables.
+	GCPPrinterCacheFile string `json:"gcp_printer_cache_file"`
+
+	// File to record finished jobs and printer state changes in, for
+	// fleet reports. Empty disables.
+	JobHistoryFile string `json:"job_history_file"`
+
+	// File to append a tamper-evident audit log of received and finished
+	// jobs to. Empty disables.
+	AuditLogFile string `json:"audit_log_file"`
+
+	// User and group to run as, once the connector has done what needs
+	// root, like binding sockets; empty keeps the user that started it. An
+	// empty group is the user's primary group.
+	RunAsUser  string `json:"run_as_user"`
+	RunAsGroup string `json:"run_as_group"`
+
+	// Whether to encrypt downloaded job documents, with a random key that
+	// is only held in memory.
+	SpoolEncrypt bool `json:"spool_encrypt"`
+
+	// Whether to overwrite downloaded job documents with zeros before
+	// removing them.
+	SpoolShred bool `json:"spool_shred"`
+
+	// Directory to keep the documents, tickets and errors of failed jobs
+	// in, for debugging, instead of removing them. Empty disables.
+	QuarantineDir string `json:"quarantine_dir"`
+
+	// How many failed jobs to keep in quarantine_dir; the oldest are
+	// removed.
+	QuarantineMaxJobs uint `json:"quarantine_max_jobs"`
+
+	// Where to keep the refresh tokens: "file" keeps them in this file;
+	// "keyring" keeps them in the OS keyring (libsecret or the OS X
+	// keychain), keyed by XMPP JID.
+	CredentialsStore string `json:"credentials_store"`
+
+	// Regular expression of CUPS printer names to register under the
+	// account above, when printers are sharded across accounts.
+	PrinterNamePattern string `json:"printer_name_pattern,omitempty"`
+
+	// Additional GCP accounts to spread printers across, to stay below
+	// the per-account printer limit. Printers that don't match any
+	// printer_name_pattern are distributed by hash of the printer name
+	// among the accounts without a pattern.
+	ShardAccounts []ShardAccount `json:"shard_accounts,omitempty"`
+
+	// Connectors of other tenants, to run in this process, sharing its CUPS
+	// connections; see Profile.
+	Profiles []Profile `json:"profiles,omitempty"`
 }
 
+// JobOwnerMap translates job owners, email addresses, into CUPS users. The
+// users are tried first, then the patterns, in order, then the command.
+type JobOwnerMap struct {
+	// CUPS users by owner; owners are compared without regard to case.
+	Users map[string]string `json:"users,omitempty"`
+	// Regular expressions of owners, with the users that they map to.
+	Patterns []OwnerPattern `json:"patterns,omitempty"`
+	// Executable that gets an owner as its only argument, and prints its
+	// user, for lookups in a directory like LDAP. It prints nothing for
+	// owners that it doesn't know.
+	Command string `json:"command,omitempty"`
+}
+
+// LDAPShare resolves LDAP groups into the email addresses of their
+// members, again every RefreshInterval, so that printers are shared with
+// the members as they join and leave the groups.
+type LDAPShare struct {
+	// Server, like ldaps://ldap.example.com or ldap://ldap.example.com:389.
+	URL string `json:"url"`
+	// Whether to upgrade ldap:// connections to TLS with StartTLS.
+	StartTLS bool `json:"start_tls,omitempty"`
+	// PEM bundle of the CAs that issue the server's certificate, instead
+	// of the CAs that the system trusts.
+	CAFile string `json:"ca_file,omitempty"`
+	// DN and password to bind as; empty binds anonymously.
+	BindDN       string `json:"bind_dn,omitempty"`
+	BindPassword string `json:"bind_password,omitempty"`
+	// DNs of the groups, like cn=printing,ou=groups,dc=example,dc=com.
+	// Members that are groups themselves are resolved too.
+	Groups []string `json:"groups"`
+	// Attribute of groups that lists the DNs of their members; member by
+	// default.
+	MemberAttribute string `json:"member_attribute,omitempty"`
+	// Attribute of members that holds their email address; mail by
+	// default.
+	MailAttribute string `json:"mail_attribute,omitempty"`
+	// How often to resolve the groups again; 1h by default.
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+}
+
+// Defaults of LDAPShare.
+const (
+	DefaultLDAPMemberAttribute = "member"
+	DefaultLDAPMailAttribute   = "mail"
+	DefaultLDAPRefreshInterval = "1h"
+)
+
+// GoogleDirectoryShare resolves Google Workspace org units and groups into
+// the email addresses of their users, with the Admin SDK Directory API,
+// again every RefreshInterval, so that printers are shared with the users
+// as they join and leave.
+type GoogleDirectoryShare struct {
+	// JSON key of a service account with domain-wide delegation of the
+	// admin.directory.user.readonly and
+	// admin.directory.group.member.readonly scopes.
+	CredentialsFile string `json:"credentials_file"`
+	// Administrator that the service account acts as.
+	AdminEmail string `json:"admin_email"`
+	// Workspace customer ID; my_customer, the administrator's, by default.
+	Customer string `json:"customer,omitempty"`
+	// Org unit paths, like /Engineering. Users of child org units are
+	// included.
+	OrgUnits []string `json:"org_units,omitempty"`
+	// Group email addresses. Users of nested groups are included.
+	Groups []string `json:"groups,omitempty"`
+	// How often to resolve the org units and groups again; 1h by default.
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+}
+
+// Defaults of GoogleDirectoryShare.
+const (
+	DefaultGoogleDirectoryCustomer        = "my_customer"
+	DefaultGoogleDirectoryRefreshInterval = "1h"
+)
+
+// OwnerPattern maps the owners that match a regular expression to a user,
+// which may refer to submatches, like $1.
+type OwnerPattern struct {
+	Match string `json:"match"`
+	User  string `json:"user"`
+}
+
+// ExecBackendConfig holds the executables of the exec backend, which read a
+// JSON request on standard input and write a JSON response on standard
+// output.
+type ExecBackendConfig struct {
+	// Lists the printers, with their states.
+	ListPrinters string `json:"list_printers"`
+	// Reports a printer's capabilities, as a CDD printer description.
+	Capabilities string `json:"capabilities"`
+	// Submits a job from a file, and answers its job ID.
+	Print string `json:"print"`
+	// Reports the state of a job.
+	JobState string `json:"job_state"`
+	// Cancels a job.
+	CancelJob string `json:"cancel_job"`
+
+	// Restrictions on the executables above, by key, like "print"; the
+	// restrictions under "*" apply to executables without their own.
+	Sandbox map[string]Sandbox `json:"sandbox,omitempty"`
+}
+
+// Sandbox restricts an external helper, which may handle untrusted job
+// documents.
+type Sandbox struct {
+	// User to run the helper as; the connector must run as root.
+	User string `json:"user,omitempty"`
+	// Resource limits of the helper; zero means no limit.
+	CPUSeconds    uint   `json:"cpu_seconds,omitempty"`
+	MemoryBytes   uint64 `json:"memory_bytes,omitempty"`
+	FileSizeBytes uint64 `json:"file_size_bytes,omitempty"`
+	// Command and arguments to run the helper under, like bubblewrap, for a
+	// read-only file system and a seccomp filter.
+	Wrapper []string `json:"wrapper,omitempty"`
+}
+
+// Commands returns the executables, by key, like "print".
+func (c *ExecBackendConfig) Commands() map[string]string {
+	return map[string]string{
+		"list_printers": c.ListPrinters,
+		"capabilities":  c.Capabilities,
+		"print":         c.Print,
+		"job_state":     c.JobState,
+		"cancel_job":    c.CancelJob,
+	}
+}
+
+// Missing returns the keys of the executables that aren't set, sorted.
+func (c *ExecBackendConfig) Missing() []string {
+	var missing []string
+	for key, command := range c.Commands() {
+		if command == "" {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// SandboxOf returns the restrictions on the executable with key.
+func (c *ExecBackendConfig) SandboxOf(key string) Sandbox {
+	if s, exists := c.Sandbox[key]; exists {
+		return s
+	}
+	return c.Sandbox["*"]
+}
+
+// jobHoldUntilKeywords are the job-hold-until values, besides times of day,
+// that CUPS understands.
+var jobHoldUntilKeywords = map[string]struct{}{
+	"no-hold":      struct{}{},
+	"indefinite":   struct{}{},
+	"day-time":     struct{}{},
+	"evening":      struct{}{},
+	"night":        struct{}{},
+	"second-shift": struct{}{},
+	"third-shift":  struct{}{},
+	"weekend":      struct{}{},
+}
+
+var reJobHoldUntilTime = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9](:[0-5][0-9])?$`)
+
+// ValidJobHoldUntil says whether CUPS understands a job-hold-until value: a
+// keyword like "night", or a time of day, HH:MM or HH:MM:SS, in UTC.
+func ValidJobHoldUntil(value string) bool {
+	if _, exists := jobHoldUntilKeywords[value]; exists {
+		return true
+	}
+	return reJobHoldUntilTime.MatchString(value)
+}
+
+// ShardAccount holds the credentials of one of several GCP accounts
+// that printers are sharded across.
+type ShardAccount struct {
+	XMPPJID            string   `json:"xmpp_jid"`
+	RobotRefreshToken  string   `json:"robot_refresh_token"`
+	UserRefreshToken   string   `json:"user_refresh_token,omitempty"`
+	ShareScope         string   `json:"share_scope,omitempty"`
+	ShareScopes        []string `json:"share_scopes,omitempty"`
+	AcceptInvites      []string `json:"accept_invites,omitempty"`
+	PrinterNamePattern string   `json:"printer_name_pattern,omitempty"`
+
+	// Set by Config.Accounts: the name of the profile that the account
+	// belongs to, empty for the main and shard accounts, and the proxy name
+	// that the account's printers are registered under.
+	Profile   string `json:"-"`
+	ProxyName string `json:"-"`
+}
+
+// Profile is the connector of one tenant, with its own GCP account, proxy
+// name and share scopes, that runs in the same process as the main
+// account. The CUPS printers whose names match its printer_name_pattern are
+// registered under the profile, and aren't sharded across the main and
+// shard accounts; a printer may be in several profiles.
+type Profile struct {
+	// Name of the profile, for logs and monitoring.
+	Name string `json:"name"`
+	// Proxy name of the profile's printers; defaults to proxy_name, a dash
+	// and the profile name.
+	ProxyName string `json:"proxy_name,omitempty"`
+
+	XMPPJID            string   `json:"xmpp_jid"`
+	RobotRefreshToken  string   `json:"robot_refresh_token"`
+	UserRefreshToken   string   `json:"user_refresh_token,omitempty"`
+	ShareScope         string   `json:"share_scope,omitempty"`
+	ShareScopes        []string `json:"share_scopes,omitempty"`
+	AcceptInvites      []string `json:"accept_invites,omitempty"`
+	PrinterNamePattern string   `json:"printer_name_pattern"`
+}
+
+// AllShareScopes returns ShareScope and ShareScopes, without duplicates.
+func (a *ShardAccount) AllShareScopes() []string {
+	return uniqueScopes(append([]string{a.ShareScope}, a.ShareScopes...))
+}
+
+// uniqueScopes removes empty and duplicate scopes, preserving order.
+func uniqueScopes(scopes []string) []string {
+	seen := make(map[string]struct{}, len(scopes))
+	unique := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if _, exists := seen[scope]; exists || scope == "" {
+			continue
+		}
+		seen[scope] = struct{}{}
+		unique = append(unique, scope)
+	}
+	return unique
+}
+
+// Accounts returns the account configured at the top level of this
+// Config, followed by the shard accounts, and the accounts of the profiles.
+func (c *Config) Accounts() []ShardAccount {
+	accounts := make([]ShardAccount, 0, 1+len(c.ShardAccounts)+len(c.Profiles))
+	accounts = append(accounts, ShardAccount{
+		XMPPJID:            c.XMPPJID,
+		RobotRefreshToken:  c.RobotRefreshToken,
+		UserRefreshToken:   c.UserRefreshToken,
+		ShareScope:         c.ShareScope,
+		ShareScopes:        c.ShareScopes,
+		AcceptInvites:      c.AcceptInvites,
+		PrinterNamePattern: c.PrinterNamePattern,
+	})
+	accounts = append(accounts, c.ShardAccounts...)
+	for i := range accounts {
+		accounts[i].ProxyName = c.ProxyName
+	}
+
+	for _, p := range c.Profiles {
+		proxyName := p.ProxyName
+		if proxyName == "" {
+			proxyName = c.ProxyName + "-" + p.Name
+		}
+		accounts = append(accounts, ShardAccount{
+			XMPPJID:            p.XMPPJID,
+			RobotRefreshToken:  p.RobotRefreshToken,
+			UserRefreshToken:   p.UserRefreshToken,
+			ShareScope:         p.ShareScope,
+			ShareScopes:        p.ShareScopes,
+			AcceptInvites:      p.AcceptInvites,
+			PrinterNamePattern: p.PrinterNamePattern,
+			Profile:            p.Name,
+			ProxyName:          proxyName,
+		})
+	}
+	return accounts
+}
+
+// Values of Config.Backend.
+const (
+	BackendCUPS = "cups"
+	BackendExec = "exec"
+)
+
+// Values of Config.CUPSPPDTranslator.
+const (
+	PPDTranslatorGCP   = "gcp"
+	PPDTranslatorLocal = "local"
+)
+
+// Values of Config.ProxyConflictAction.
+const (
+	ProxyConflictWarn   = "warn"
+	ProxyConflictRefuse = "refuse"
+)
+
 // DefaultConfig represents reasonable default values for Config fields.
 // Omitted Config fields are omitted on purpose; they are unique per
 // connector instance.
 var DefaultConfig = Config{
-	GCPMaxConcurrentDownloads: 5,
-	CUPSMaxConnections:        5,
-	CUPSConnectTimeout:        "5s",
-	CUPSJobQueueSize:          3,
-	CUPSPrinterPollInterval:   "1m",
+	ConfigVersion:                CurrentConfigVersion,
+	ShareRole:                    "USER",
+	ShareRevokeUnlisted:          false,
+	ProxyConflictAction:          ProxyConflictWarn,
+	GCPMaxConcurrentDownloads:    5,
+	GCPMaxDownloadMB:             0,
+	GCPMaxJobAge:                 "0s",
+	GCPMaxJobsPerMinute:          0,
+	Backend:                      BackendCUPS,
+	CUPSMaxConnections:           5,
+	CUPSConnectTimeout:           "5s",
+	CUPSListTimeout:              "1m",
+	CUPSPPDTimeout:               "1m",
+	CUPSPrintTimeout:             "5m",
+	CUPSJobStateTimeout:          "30s",
+	CUPSPPDFetchWorkers:          3,
+	CUPSPPDTranslator:            PPDTranslatorLocal,
+	CUPSJobQueueSize:             3,
+	CUPSPrinterPollInterval:      "1m",
+	CUPSPrinterStatePollInterval: "10s",
+	CUPSPrinterFullFetchInterval: "1h",
+	CUPSWatchFiles:               []string{"/etc/cups/printers.conf", "/etc/cups/classes.conf"},
 	CUPSPrinterAttributes: []string{
 		"device-uri",
 		"printer-name",
@@ -137,19 +772,45 @@ var DefaultConfig = Config{
 		"printer-state",
 		"printer-state-reasons",
 		"printer-uuid",
+		"printer-is-shared",
 		"marker-names",
 		"marker-types",
 		"marker-levels",
 	},
 	CUPSJobFullUsername:          false,
+	CUPSJobUser:                  "",
+	CUPSJobAccountingOwner:       false,
 	CUPSIgnoreRawPrinters:        true,
+	CUPSSharedPrintersOnly:       false,
+	CUPSStreamJobs:               false,
 	CopyPrinterInfoToDisplayName: true,
 	MonitorSocketFilename:        "/var/run/cups-connector/monitor.sock",
+	HealthListenAddress:          "",
+	AdminListenAddress:           "",
+	AdminToken:                   "",
+	LogFormat:                    "text",
+	LogMaxMegabytes:              100,
+	LogMaxFiles:                  10,
+	LogCompress:                  true,
+	SyslogAddress:                "",
+	SyslogFacility:               "daemon",
+	MetricsStatsDAddress:         "",
+	MetricsOTLPEndpoint:          "",
+	MetricsPrefix:                "cups_connector",
+	MetricsInterval:              "15s",
+	AlertCommand:                 "",
+	AlertURL:                     "",
+	AlertJobErrorPercent:         0,
 	GCPBaseURL:                   "https://www.google.com/cloudprint/",
 	XMPPServer:                   "talk.google.com",
 	XMPPPort:                     443,
+	XMPPFallbackPort:             5222,
+	XMPPServerHostname:           "talk.google.com",
+	XMPPCloudPrintJID:            "cloudprint.google.com",
 	XMPPPingTimeout:              "5s",
 	XMPPPingIntervalDefault:      "2m",
+	XMPPPingIntervalAuto:         false,
+	XMPPPingIntervalFile:         "",
 	GCPOAuthClientID:             "539833558011-35iq8btpgas80nrs3o7mv99hm95d4dv6.apps.googleusercontent.com",
 	GCPOAuthClientSecret:         "V9BfPOvdiYuw12hDx5Y5nR0a",
 	GCPOAuthAuthURL:              "https://accounts.google.com/o/oauth2/auth",
@@ -157,42 +818,153 @@ var DefaultConfig = Config{
 	SNMPEnable:                   false,
 	SNMPCommunity:                "public",
 	SNMPMaxConnections:           100,
+	SNMPPollInterval:             "1m",
+	SNMPPauseOnFault:             false,
+	PrinterProbeInterval:         "0s",
+	PrinterProbeTimeout:          "5s",
+	DiscoveryEnable:              false,
+	DiscoveryInterval:            "10m",
+	FallbackPollIntervalMin:      "15s",
+	FallbackPollIntervalMax:      "5m",
+	LocalPrintingEnable:          false,
+	LocalPortLow:                 26000,
+	LocalPortHigh:                26999,
+	GCPUploadTimeout:             "10m",
+	GCPCompressUploads:           false,
+	GCPPrinterCacheFile:          "",
+	JobHistoryFile:               "",
+	AuditLogFile:                 "",
+	RunAsUser:                    "",
+	RunAsGroup:                   "",
+	SpoolEncrypt:                 false,
+	SpoolShred:                   false,
+	QuarantineDir:                "",
+	QuarantineMaxJobs:            10,
+	CredentialsStore:             CredentialsStoreFile,
 }
 
 // ConfigFromFile reads a Config object from the config file indicated by
-// the config filename flag.
+// the config filename flag. The file is YAML when its name ends with .yaml
+// or .yml, TOML when it ends with .toml, and JSON otherwise; all formats
+// use the JSON keys.
+//
+// Options set by CUPS_CONNECTOR_* environment variables (see ConfigEnvName)
+// override the file.
 func ConfigFromFile() (*Config, error) {
+	return configFromFile(true)
+}
+
+// ConfigFromFileWithoutEnv reads the config file like ConfigFromFile, but
+// ignores environment variables. Use it to read a config to write back to
+// the file, so that overrides aren't saved.
+func ConfigFromFileWithoutEnv() (*Config, error) {
+	return configFromFile(false)
+}
+
+func configFromFile(env bool) (*Config, error) {
 	if !flag.Parsed() {
 		flag.Parse()
 	}
 
-	b, err := ioutil.ReadFile(*ConfigFilename)
+	m, err := ConfigMapFromFile()
 	if err != nil {
 		return nil, err
 	}
 
-	var config Config
-	if err = json.Unmarshal(b, &config); err != nil {
-		return nil, err
+	if env {
+		overridden, err := applyConfigEnv(m)
+		if err != nil {
+			return nil, err
+		}
+		logConfigEnv(overridden)
 	}
 
-	return &config, nil
+	config, err := configFromMap(m)
+	if err != nil {
+		return nil, err
+	}
+	if config.CredentialsStore == CredentialsStoreKeyring {
+		if err = config.loadRefreshTokensFromKeyring(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
 }
 
-// ToFile writes this Config object to the config file indicated by ConfigFile.
+// ToFile writes this Config object to the config file indicated by ConfigFile,
+// in the format indicated by its filename (see ConfigFromFile).
+//
+// The file is replaced atomically, so that a crash while writing doesn't
+// leave a truncated config file (and lose the refresh tokens) behind.
+//
+// When CredentialsStore is keyring, the refresh tokens are written to the OS
+// keyring instead of the file.
 func (c *Config) ToFile() error {
 	if !flag.Parsed() {
 		flag.Parse()
 	}
 
-	b, err := json.MarshalIndent(c, "", "  ")
+	if c.CredentialsStore == CredentialsStoreKeyring {
+		withoutTokens := *c
+		withoutTokens.ShardAccounts = append([]ShardAccount(nil), c.ShardAccounts...)
+		withoutTokens.Profiles = append([]Profile(nil), c.Profiles...)
+		if err := withoutTokens.saveRefreshTokensToKeyring(); err != nil {
+			return err
+		}
+		c = &withoutTokens
+	}
+
+	var b []byte
+	var err error
+	if format := configFormat(*ConfigFilename); format == configFormatJSON {
+		// Marshal the struct directly, to keep the field order.
+		b, err = json.MarshalIndent(c, "", "  ")
+	} else {
+		var m map[string]interface{}
+		if m, err = configToMap(c); err == nil {
+			b, err = encodeConfigMap(m, format)
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	if err = ioutil.WriteFile(*ConfigFilename, b, 0600); err != nil {
+	tempFilename := *ConfigFilename + ".tmp"
+	f, err := os.OpenFile(tempFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+
+	if err = os.Rename(tempFilename, *ConfigFilename); err != nil {
+		os.Remove(tempFilename)
 		return err
 	}
 
 	return nil
 }
+
+var updateConfigFileMutex sync.Mutex
+
+// UpdateConfigFile reads the config file, passes it to update, and writes
+// the result back to the config file.
+func UpdateConfigFile(update func(*Config)) error {
+	updateConfigFileMutex.Lock()
+	defer updateConfigFileMutex.Unlock()
+
+	config, err := ConfigFromFileWithoutEnv()
+	if err != nil {
+		return err
+	}
+	update(config)
+	return config.ToFile()
+}
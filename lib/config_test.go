@@ -0,0 +1,40 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import "testing"
+
+func TestValidJobHoldUntil(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		valid bool
+	}{
+		{"no-hold", true},
+		{"indefinite", true},
+		{"night", true},
+		{"weekend", true},
+		{"second-shift", true},
+		{"00:00", true},
+		{"09:30", true},
+		{"23:59", true},
+		{"22:00:30", true},
+		{"", false},
+		{"Night", false},
+		{"tonight", false},
+		{"24:00", false},
+		{"9:30", false},
+		{"12:60", false},
+		{"12:00:60", false},
+		{"12:00 ", false},
+		{"night 22:00", false},
+	} {
+		if valid := ValidJobHoldUntil(test.value); valid != test.valid {
+			t.Errorf("ValidJobHoldUntil(%q) = %t, want %t", test.value, valid, test.valid)
+		}
+	}
+}
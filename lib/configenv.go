@@ -0,0 +1,114 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// ConfigEnvPrefix prefixes the environment variables that override config
+// options. The variable for an option is the prefix followed by the
+// option's key in upper case, like CUPS_CONNECTOR_ROBOT_REFRESH_TOKEN.
+const ConfigEnvPrefix = "CUPS_CONNECTOR_"
+
+// ConfigEnvName returns the environment variable that overrides the config
+// option with a JSON key.
+func ConfigEnvName(key string) string {
+	return ConfigEnvPrefix + strings.ToUpper(key)
+}
+
+// applyConfigEnv overrides values in a config map with the CUPS_CONNECTOR_*
+// environment variables that are set and not empty. String options take the variable's
+// value as is; other options take it as JSON, like true, 5 or ["a","b"].
+// Returns the overridden keys, sorted.
+func applyConfigEnv(m map[string]interface{}) ([]string, error) {
+	t := reflect.TypeOf(Config{})
+	var overridden []string
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := ConfigEnvName(key)
+		value := os.Getenv(name)
+		for _, oldKey := range oldConfigKeys(key) {
+			// Variables named after the key before it was renamed.
+			if value != "" {
+				break
+			}
+			name = ConfigEnvName(oldKey)
+			value = os.Getenv(name)
+		}
+		if value == "" {
+			continue
+		}
+
+		if t.Field(i).Type.Kind() == reflect.String {
+			m[key] = value
+		} else {
+			var v interface{}
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				return nil, fmt.Errorf("Failed to parse environment variable %s: %s", name, err)
+			}
+			m[key] = v
+		}
+		overridden = append(overridden, key)
+	}
+
+	sort.Strings(overridden)
+	return overridden, nil
+}
+
+// unknownConfigEnv returns the CUPS_CONNECTOR_* environment variables that
+// don't override any config option, sorted.
+func unknownConfigEnv() []string {
+	known := make(map[string]struct{})
+	for key := range configKeys(reflect.TypeOf(Config{})) {
+		known[ConfigEnvName(key)] = struct{}{}
+		for _, oldKey := range oldConfigKeys(key) {
+			known[ConfigEnvName(oldKey)] = struct{}{}
+		}
+	}
+
+	var unknown []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(name, ConfigEnvPrefix) {
+			continue
+		}
+		if _, exists := known[name]; !exists {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// logConfigEnv logs the options overridden by environment variables, without
+// their values, which may be credentials.
+func logConfigEnv(overridden []string) {
+	for _, key := range overridden {
+		glog.Infof("Config option %s overridden by environment variable %s", key, ConfigEnvName(key))
+		for _, oldKey := range oldConfigKeys(key) {
+			if os.Getenv(ConfigEnvName(oldKey)) != "" {
+				glog.Warningf("Environment variable %s is deprecated; it was renamed %s", ConfigEnvName(oldKey), ConfigEnvName(key))
+			}
+		}
+	}
+	for _, name := range unknownConfigEnv() {
+		glog.Warningf("Environment variable %s doesn't match any config option%s", name,
+			suggestKey(strings.ToLower(strings.TrimPrefix(name, ConfigEnvPrefix)), reflect.TypeOf(Config{})))
+	}
+}
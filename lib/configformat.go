@@ -0,0 +1,207 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file formats, detected by config filename extension.
+const (
+	configFormatJSON = "json"
+	configFormatYAML = "yaml"
+	configFormatTOML = "toml"
+)
+
+// configFormat returns the format of a config file, by filename extension.
+// Files with an unknown extension are JSON.
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".toml":
+		return configFormatTOML
+	default:
+		return configFormatJSON
+	}
+}
+
+// ConfigMapFromFile reads the config file indicated by the config filename
+// flag, in any format, as a map from JSON key to value. Values are the
+// types that encoding/json decodes to.
+//
+// Files from older releases are upgraded to CurrentConfigVersion, in memory
+// only (see MigrateConfigFile), with a warning for each deprecated key.
+func ConfigMapFromFile() (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(*ConfigFilename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeConfigMap(b, configFormat(*ConfigFilename))
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range migrateConfigMap(m) {
+		glog.Warning(warning)
+	}
+	return m, nil
+}
+
+// decodeConfigMap decodes a config file of any format to a map from JSON
+// key to value, so that all formats share the JSON schema of Config.
+func decodeConfigMap(b []byte, format string) (map[string]interface{}, error) {
+	var m map[string]interface{}
+
+	switch format {
+	case configFormatYAML:
+		var y map[interface{}]interface{}
+		if err := yaml.Unmarshal(b, &y); err != nil {
+			return nil, fmt.Errorf("Failed to parse YAML config file: %s", err)
+		}
+		v, err := jsonCompatible(y)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse YAML config file: %s", err)
+		}
+		m = v.(map[string]interface{})
+
+	case configFormatTOML:
+		if err := toml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("Failed to parse TOML config file: %s", err)
+		}
+
+	default:
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("Failed to parse JSON config file: %s", err)
+		}
+	}
+
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+	return m, nil
+}
+
+// encodeConfigMap encodes a map from JSON key to value in a config file
+// format. Comments in YAML and TOML files are not preserved.
+func encodeConfigMap(m map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case configFormatYAML:
+		return yaml.Marshal(m)
+
+	case configFormatTOML:
+		var b bytes.Buffer
+		if err := toml.NewEncoder(&b).Encode(m); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+
+	default:
+		return json.MarshalIndent(m, "", "  ")
+	}
+}
+
+// configToMap converts a Config to a map from JSON key to value. Numbers
+// are int64 when integral, so that YAML and TOML don't write them as floats.
+func configToMap(c *Config) (map[string]interface{}, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err = d.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	v, err := jsonCompatible(m)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+// configFromMap converts a map from JSON key to value to a Config.
+func configFromMap(m map[string]interface{}) (*Config, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// jsonCompatible converts YAML maps, which may have non-string keys, to
+// string-keyed maps, and json.Numbers to int64 or float64. Nulls are
+// dropped from maps, because TOML can't represent them.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("Key %v is not a string", key)
+			}
+			if value == nil {
+				continue
+			}
+			var err error
+			if m[k], err = jsonCompatible(value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			if value == nil {
+				continue
+			}
+			var err error
+			if m[k], err = jsonCompatible(value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i := range v {
+			var err error
+			if s[i], err = jsonCompatible(v[i]); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+
+	default:
+		return v, nil
+	}
+}
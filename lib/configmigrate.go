@@ -0,0 +1,148 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// CurrentConfigVersion is the version of the config file schema that this
+// connector writes. Config files without config_version are version 1.
+const CurrentConfigVersion uint = 1
+
+// configMigration upgrades a config file from one schema version to the
+// next.
+type configMigration struct {
+	// Keys renamed, from old to new.
+	renamed map[string]string
+}
+
+// configMigrations[i] upgrades a config file from version i+1 to i+2. A
+// rename also needs the connector-init flag renamed; environment variables
+// named after old keys are read under the new keys, see applyConfigEnv.
+var configMigrations = []configMigration{}
+
+// configMapVersion returns the schema version of a config map.
+func configMapVersion(m map[string]interface{}) uint {
+	var version float64
+	switch v := m["config_version"].(type) {
+	case float64:
+		version = v
+	case int64:
+		version = float64(v)
+	case int:
+		version = float64(v)
+	}
+	if version < 1 {
+		return 1
+	}
+	return uint(version)
+}
+
+// migrateConfigMap upgrades a config map to CurrentConfigVersion, so that
+// options from older releases keep their values. Returns a warning for each
+// deprecated key found, sorted. Maps from newer connectors are left alone.
+func migrateConfigMap(m map[string]interface{}) []string {
+	return applyConfigMigrations(m, configMigrations)
+}
+
+// applyConfigMigrations upgrades a config map to version
+// len(migrations)+1, with migrations[i] upgrading version i+1 to i+2.
+func applyConfigMigrations(m map[string]interface{}, migrations []configMigration) []string {
+	current := uint(len(migrations)) + 1
+	version := configMapVersion(m)
+	if version >= current {
+		return nil
+	}
+
+	var warnings []string
+	for _, migration := range migrations[version-1:] {
+		for oldKey, newKey := range migration.renamed {
+			value, exists := m[oldKey]
+			if !exists {
+				continue
+			}
+			delete(m, oldKey)
+			if _, exists := m[newKey]; exists {
+				warnings = append(warnings, fmt.Sprintf("Config option %s is deprecated, and ignored because %s is set too", oldKey, newKey))
+				continue
+			}
+			m[newKey] = value
+			warnings = append(warnings, fmt.Sprintf("Config option %s is deprecated; it was renamed %s", oldKey, newKey))
+		}
+	}
+	m["config_version"] = float64(current)
+
+	sort.Strings(warnings)
+	return warnings
+}
+
+// renamedConfigKey returns the current name of a key that a migration
+// renamed, if any.
+func renamedConfigKey(key string) (string, bool) {
+	renamed := false
+	for _, migration := range configMigrations {
+		if newKey, exists := migration.renamed[key]; exists {
+			key, renamed = newKey, true
+		}
+	}
+	return key, renamed
+}
+
+// oldConfigKeys returns the keys that migrations renamed to key, if any.
+func oldConfigKeys(key string) []string {
+	var oldKeys []string
+	for _, migration := range configMigrations {
+		for oldKey := range migration.renamed {
+			if newKey, _ := renamedConfigKey(oldKey); newKey == key {
+				oldKeys = append(oldKeys, oldKey)
+			}
+		}
+	}
+	sort.Strings(oldKeys)
+	return oldKeys
+}
+
+// MigrateConfigFile upgrades the config file indicated by the config
+// filename flag to CurrentConfigVersion, when it's older, in place. The old
+// file is copied first to a backup file named after its version, like
+// cups-connector.config.json.v1.bak. Returns the backup filename, or "" when
+// the file was current already.
+func MigrateConfigFile() (string, error) {
+	updateConfigFileMutex.Lock()
+	defer updateConfigFileMutex.Unlock()
+
+	b, err := ioutil.ReadFile(*ConfigFilename)
+	if err != nil {
+		return "", err
+	}
+	m, err := decodeConfigMap(b, configFormat(*ConfigFilename))
+	if err != nil {
+		return "", err
+	}
+	version := configMapVersion(m)
+	if version >= CurrentConfigVersion {
+		return "", nil
+	}
+
+	backupFilename := fmt.Sprintf("%s.v%d.bak", *ConfigFilename, version)
+	if err = ioutil.WriteFile(backupFilename, b, 0600); err != nil {
+		return "", fmt.Errorf("Failed to back up config file: %s", err)
+	}
+
+	config, err := ConfigFromFileWithoutEnv()
+	if err != nil {
+		return "", err
+	}
+	if err = config.ToFile(); err != nil {
+		return "", err
+	}
+	return backupFilename, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testConfigMigrations = []configMigration{
+	{renamed: map[string]string{"a": "b", "c": "d"}},
+	{renamed: map[string]string{"b": "e"}},
+}
+
+func TestCurrentConfigVersion(t *testing.T) {
+	if CurrentConfigVersion != uint(len(configMigrations))+1 {
+		t.Errorf("CurrentConfigVersion is %d with %d migrations", CurrentConfigVersion, len(configMigrations))
+	}
+}
+
+func TestConfigMapVersion(t *testing.T) {
+	cases := []struct {
+		m       map[string]interface{}
+		version uint
+	}{
+		{map[string]interface{}{}, 1},
+		{map[string]interface{}{"config_version": float64(2)}, 2},
+		{map[string]interface{}{"config_version": int64(3)}, 3},
+		{map[string]interface{}{"config_version": 4}, 4},
+		{map[string]interface{}{"config_version": float64(0)}, 1},
+		{map[string]interface{}{"config_version": "2"}, 1},
+	}
+	for _, c := range cases {
+		if version := configMapVersion(c.m); version != c.version {
+			t.Errorf("configMapVersion(%v) = %d, want %d", c.m, version, c.version)
+		}
+	}
+}
+
+func TestApplyConfigMigrations(t *testing.T) {
+	cases := []struct {
+		name     string
+		m        map[string]interface{}
+		want     map[string]interface{}
+		warnings []string
+	}{
+		{
+			"version 1",
+			map[string]interface{}{"a": "x", "c": "y", "f": "z"},
+			map[string]interface{}{"config_version": float64(3), "e": "x", "d": "y", "f": "z"},
+			[]string{
+				"Config option a is deprecated; it was renamed b",
+				"Config option b is deprecated; it was renamed e",
+				"Config option c is deprecated; it was renamed d",
+			},
+		},
+		{
+			"version 2",
+			map[string]interface{}{"config_version": float64(2), "a": "x", "b": "y"},
+			map[string]interface{}{"config_version": float64(3), "a": "x", "e": "y"},
+			[]string{"Config option b is deprecated; it was renamed e"},
+		},
+		{
+			"conflict",
+			map[string]interface{}{"c": "x", "d": "y"},
+			map[string]interface{}{"config_version": float64(3), "d": "y"},
+			[]string{"Config option c is deprecated, and ignored because d is set too"},
+		},
+		{
+			"current",
+			map[string]interface{}{"config_version": float64(3), "a": "x"},
+			map[string]interface{}{"config_version": float64(3), "a": "x"},
+			nil,
+		},
+		{
+			"newer",
+			map[string]interface{}{"config_version": float64(4), "a": "x"},
+			map[string]interface{}{"config_version": float64(4), "a": "x"},
+			nil,
+		},
+	}
+	for _, c := range cases {
+		warnings := applyConfigMigrations(c.m, testConfigMigrations)
+		if !reflect.DeepEqual(c.m, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.m, c.want)
+		}
+		if !reflect.DeepEqual(warnings, c.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", c.name, warnings, c.warnings)
+		}
+	}
+}
+
+func TestMigrateConfigMapCurrent(t *testing.T) {
+	m := map[string]interface{}{"proxy_name": "x"}
+	if warnings := migrateConfigMap(m); len(warnings) != 0 {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+	if _, exists := m["proxy_name"]; !exists {
+		t.Errorf("proxy_name was dropped")
+	}
+}
+
+func TestOldConfigKeys(t *testing.T) {
+	defer func(migrations []configMigration) { configMigrations = migrations }(configMigrations)
+	configMigrations = testConfigMigrations
+
+	if keys := oldConfigKeys("e"); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("oldConfigKeys(e) = %q", keys)
+	}
+	if keys := oldConfigKeys("d"); !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Errorf("oldConfigKeys(d) = %q", keys)
+	}
+	if keys := oldConfigKeys("f"); keys != nil {
+		t.Errorf("oldConfigKeys(f) = %q", keys)
+	}
+}
@@ -0,0 +1,509 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/cups-connector/logger"
+)
+
+// Shortest prefix of discovery_networks, to keep SNMP sweeps to 4096
+// addresses.
+const discoveryMinPrefixLength = 20
+
+// cupsPrinterAttributeNeeds returns the CUPS printer attributes that config
+// needs, beyond those that every config needs, with the option that needs
+// each.
+func cupsPrinterAttributeNeeds(config *Config) map[string]string {
+	needs := map[string]string{
+		"printer-name":          "",
+		"printer-state":         "",
+		"printer-state-reasons": "",
+		"printer-uuid":          "",
+	}
+	if config.CUPSIgnoreRawPrinters {
+		needs["printer-make-and-model"] = "cups_ignore_raw_printers"
+	}
+	if config.CUPSSharedPrintersOnly {
+		needs["printer-is-shared"] = "cups_shared_printers_only"
+	}
+	if config.CopyPrinterInfoToDisplayName {
+		needs["printer-info"] = "copy_printer_info_to_display_name"
+	}
+	if config.SNMPEnable {
+		needs["device-uri"] = "snmp_enable"
+	}
+	if d, err := time.ParseDuration(config.PrinterProbeInterval); err == nil && d > 0 {
+		needs["device-uri"] = "printer_probe_interval"
+	}
+	return needs
+}
+
+// MissingCUPSPrinterAttributes returns the attributes that config needs, and
+// that cups_printer_attributes lacks, sorted.
+func MissingCUPSPrinterAttributes(config *Config) []string {
+	requested := make(map[string]struct{}, len(config.CUPSPrinterAttributes))
+	for _, a := range config.CUPSPrinterAttributes {
+		requested[a] = struct{}{}
+	}
+	if _, exists := requested["all"]; exists {
+		return nil
+	}
+
+	var missing []string
+	for a := range cupsPrinterAttributeNeeds(config) {
+		if _, exists := requested[a]; !exists {
+			missing = append(missing, a)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ValidateConfig checks a config for mistakes that can be found without
+// connecting to anything. configMap is the config file as read by
+// ConfigMapFromFile, to find unknown keys. Returns one message per problem,
+// saying what to change.
+func ValidateConfig(config *Config, configMap map[string]interface{}) []string {
+	var problems []string
+	problemf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	for _, key := range unknownKeys(configMap, reflect.TypeOf(Config{})) {
+		problemf("Unknown key %s%s", key, suggestKey(key, reflect.TypeOf(Config{})))
+	}
+	if accounts, ok := configMap["shard_accounts"].([]interface{}); ok {
+		for i, account := range accounts {
+			if m, ok := account.(map[string]interface{}); ok {
+				for _, key := range unknownKeys(m, reflect.TypeOf(ShardAccount{})) {
+					problemf("Unknown key %s in shard_accounts[%d]%s", key, i, suggestKey(key, reflect.TypeOf(ShardAccount{})))
+				}
+			}
+		}
+	}
+	if profiles, ok := configMap["profiles"].([]interface{}); ok {
+		for i, profile := range profiles {
+			if m, ok := profile.(map[string]interface{}); ok {
+				for _, key := range unknownKeys(m, reflect.TypeOf(Profile{})) {
+					problemf("Unknown key %s in profiles[%d]%s", key, i, suggestKey(key, reflect.TypeOf(Profile{})))
+				}
+			}
+		}
+	}
+	if m, ok := configMap["job_owner_map"].(map[string]interface{}); ok {
+		for _, key := range unknownKeys(m, reflect.TypeOf(JobOwnerMap{})) {
+			problemf("Unknown key %s in job_owner_map%s", key, suggestKey(key, reflect.TypeOf(JobOwnerMap{})))
+		}
+	}
+	if m, ok := configMap["ldap_share"].(map[string]interface{}); ok {
+		for _, key := range unknownKeys(m, reflect.TypeOf(LDAPShare{})) {
+			problemf("Unknown key %s in ldap_share%s", key, suggestKey(key, reflect.TypeOf(LDAPShare{})))
+		}
+	}
+	if m, ok := configMap["google_directory_share"].(map[string]interface{}); ok {
+		for _, key := range unknownKeys(m, reflect.TypeOf(GoogleDirectoryShare{})) {
+			problemf("Unknown key %s in google_directory_share%s", key, suggestKey(key, reflect.TypeOf(GoogleDirectoryShare{})))
+		}
+	}
+	if m, ok := configMap["exec_backend"].(map[string]interface{}); ok {
+		for _, key := range unknownKeys(m, reflect.TypeOf(ExecBackendConfig{})) {
+			problemf("Unknown key %s in exec_backend%s", key, suggestKey(key, reflect.TypeOf(ExecBackendConfig{})))
+		}
+	}
+	if config.ConfigVersion > CurrentConfigVersion {
+		problemf("config_version is %d, but this connector reads up to version %d; upgrade the connector", config.ConfigVersion, CurrentConfigVersion)
+	}
+	for _, name := range unknownConfigEnv() {
+		problemf("Environment variable %s doesn't match any config option%s", name,
+			suggestKey(strings.ToLower(strings.TrimPrefix(name, ConfigEnvPrefix)), reflect.TypeOf(Config{})))
+	}
+
+	for i, account := range config.Accounts() {
+		name := "the main account"
+		if account.Profile != "" {
+			name = fmt.Sprintf("profile %s", account.Profile)
+		} else if i > 0 {
+			name = fmt.Sprintf("shard_accounts[%d]", i-1)
+		}
+		if account.XMPPJID == "" || account.RobotRefreshToken == "" {
+			problemf("xmpp_jid and robot_refresh_token of %s must be set; run connector-init to register", name)
+		}
+	}
+	if config.ProxyName == "" {
+		problemf("proxy_name must be set, to a name that is unique among your connectors")
+	}
+	profileNames := make(map[string]struct{}, len(config.Profiles))
+	for i, profile := range config.Profiles {
+		if profile.Name == "" {
+			problemf("name of profiles[%d] must be set", i)
+		} else if _, exists := profileNames[profile.Name]; exists {
+			problemf("Profile name %s is used more than once", profile.Name)
+		}
+		profileNames[profile.Name] = struct{}{}
+	}
+	proxyNames := map[string]struct{}{config.ProxyName: {}}
+	for _, account := range config.Accounts() {
+		if account.Profile == "" {
+			continue
+		}
+		if _, exists := proxyNames[account.ProxyName]; exists {
+			problemf("Proxy name %s of profile %s is used by the main account, or another profile", account.ProxyName, account.Profile)
+		}
+		proxyNames[account.ProxyName] = struct{}{}
+	}
+	if config.CredentialsStore != "" && config.CredentialsStore != CredentialsStoreFile &&
+		config.CredentialsStore != CredentialsStoreKeyring {
+		problemf("credentials_store must be %s or %s, not %q", CredentialsStoreFile, CredentialsStoreKeyring, config.CredentialsStore)
+	}
+	for printerName, tags := range config.PrinterTags {
+		for key := range tags {
+			if key == "" || strings.Contains(key, "=") {
+				problemf("printer_tags of %s: tag names must not be empty or contain \"=\", like %q", printerName, key)
+			}
+		}
+	}
+	for printerName, value := range config.CUPSJobHoldUntil {
+		if !ValidJobHoldUntil(value) {
+			problemf("cups_job_hold_until of %s must be a keyword like night or weekend, or a time like 22:00, not %q", printerName, value)
+		}
+	}
+	if config.AdminListenAddress != "" && len(config.AdminToken) < 16 {
+		problemf("admin_token must be set, to at least 16 random characters, when admin_listen_address is set")
+	}
+	if config.LogFormat != "" && config.LogFormat != "text" && config.LogFormat != "json" {
+		problemf("log_format must be text or json, not %q", config.LogFormat)
+	}
+	if config.MetricsStatsDAddress != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsStatsDAddress); err != nil {
+			problemf("metrics_statsd_address must be host:port, like localhost:8125: %s", err)
+		}
+	}
+	if config.MetricsOTLPEndpoint != "" {
+		if u, err := url.Parse(config.MetricsOTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problemf("metrics_otlp_endpoint must be an http or https URL, like http://localhost:4318, not %q", config.MetricsOTLPEndpoint)
+		}
+	}
+	if config.AlertURL != "" {
+		if u, err := url.Parse(config.AlertURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problemf("alert_url must be an http or https URL, not %q", config.AlertURL)
+		}
+	}
+	if config.AlertJobErrorPercent > 100 {
+		problemf("alert_job_error_percent must be at most 100, not %d", config.AlertJobErrorPercent)
+	}
+	if config.SyslogAddress != "" {
+		if _, _, err := logger.ParseSyslogAddress(config.SyslogAddress); err != nil {
+			problemf("syslog_address: %s", err)
+		}
+		if !logger.SyslogFacilityValid(config.SyslogFacility) {
+			problemf("syslog_facility %q is not a syslog facility, like daemon or local0", config.SyslogFacility)
+		}
+	}
+	switch config.Backend {
+	case BackendCUPS:
+	case BackendExec:
+		if config.ExecBackend == nil {
+			problemf("backend %s needs exec_backend", BackendExec)
+		} else {
+			for _, key := range config.ExecBackend.Missing() {
+				problemf("exec_backend.%s is missing", key)
+			}
+			commands := config.ExecBackend.Commands()
+			keys := make([]string, 0, len(config.ExecBackend.Sandbox))
+			for key := range config.ExecBackend.Sandbox {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				s := config.ExecBackend.Sandbox[key]
+				if _, exists := commands[key]; !exists && key != "*" {
+					problemf("exec_backend.sandbox.%s doesn't name an executable, like print, or *", key)
+				}
+				for _, arg := range s.Wrapper {
+					if arg == "" {
+						problemf("exec_backend.sandbox.%s.wrapper has an empty argument", key)
+					}
+				}
+			}
+		}
+	default:
+		problemf("backend must be %s or %s, not %q", BackendCUPS, BackendExec, config.Backend)
+	}
+	for _, owner := range config.JobOwnerAllowlist {
+		if owner == "" || strings.ContainsAny(owner, " \t") || strings.HasPrefix(owner, "@") || strings.HasSuffix(owner, "@") {
+			problemf("job_owner_allowlist entries must be email addresses or domains, like user@example.com or example.com, not %q", owner)
+		}
+	}
+	if strings.ContainsAny(config.CUPSJobUser, " \t") {
+		problemf("cups_job_user must be a CUPS user name, not %q", config.CUPSJobUser)
+	}
+	if config.JobOwnerMap != nil {
+		for owner, user := range config.JobOwnerMap.Users {
+			if user == "" || strings.ContainsAny(user, " \t") {
+				problemf("job_owner_map.users[%q] must be a CUPS user name, not %q", owner, user)
+			}
+		}
+		for i, p := range config.JobOwnerMap.Patterns {
+			if _, err := regexp.Compile(p.Match); err != nil {
+				problemf("job_owner_map.patterns[%d].match: %s", i, err)
+			}
+			if p.User == "" {
+				problemf("job_owner_map.patterns[%d].user must not be empty", i)
+			}
+		}
+	}
+	if l := config.LDAPShare; l != nil {
+		if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			problemf("ldap_share.url must be like ldaps://ldap.example.com, not %q", l.URL)
+		} else if u.Scheme == "ldap" && !l.StartTLS && l.BindPassword != "" {
+			problemf("ldap_share.bind_password would be sent in the clear; use an ldaps:// url, or set ldap_share.start_tls")
+		}
+		if len(l.Groups) == 0 {
+			problemf("ldap_share.groups must not be empty")
+		}
+		if l.RefreshInterval != "" {
+			if d, err := time.ParseDuration(l.RefreshInterval); err != nil || d <= 0 {
+				problemf("ldap_share.refresh_interval must be a positive duration, like 1h, not %q", l.RefreshInterval)
+			}
+		}
+		if config.UserRefreshToken == "" {
+			problemf("ldap_share needs user_refresh_token of the main account, to share printers")
+		}
+	}
+	if g := config.GoogleDirectoryShare; g != nil {
+		if g.CredentialsFile == "" {
+			problemf("google_directory_share.credentials_file must name the JSON key of a service account")
+		}
+		if !strings.Contains(g.AdminEmail, "@") {
+			problemf("google_directory_share.admin_email must be the email address of an administrator, not %q", g.AdminEmail)
+		}
+		if len(g.OrgUnits) == 0 && len(g.Groups) == 0 {
+			problemf("google_directory_share needs org_units or groups")
+		}
+		for _, orgUnit := range g.OrgUnits {
+			if !strings.HasPrefix(orgUnit, "/") || strings.Contains(orgUnit, "'") {
+				problemf("google_directory_share.org_units must be paths like /Engineering, not %q", orgUnit)
+			}
+		}
+		if g.RefreshInterval != "" {
+			if d, err := time.ParseDuration(g.RefreshInterval); err != nil || d <= 0 {
+				problemf("google_directory_share.refresh_interval must be a positive duration, like 1h, not %q", g.RefreshInterval)
+			}
+		}
+		if config.UserRefreshToken == "" {
+			problemf("google_directory_share needs user_refresh_token of the main account, to share printers")
+		}
+	}
+	if config.RunAsGroup != "" && config.RunAsUser == "" {
+		problemf("run_as_group needs run_as_user")
+	}
+	if config.RunAsUser != "" && config.ExecBackend != nil {
+		for key, s := range config.ExecBackend.Sandbox {
+			if s.User != "" && s.User != config.RunAsUser {
+				problemf("exec_backend.sandbox.%s.user needs root, which run_as_user gives up", key)
+			}
+		}
+	}
+	if config.ProxyConflictAction != ProxyConflictWarn && config.ProxyConflictAction != ProxyConflictRefuse {
+		problemf("proxy_conflict_action must be %s or %s, not %q", ProxyConflictWarn, ProxyConflictRefuse, config.ProxyConflictAction)
+	}
+	if config.ShareRole != "USER" && config.ShareRole != "MANAGER" {
+		problemf("share_role must be USER or MANAGER, not %q", config.ShareRole)
+	}
+
+	if config.Backend != BackendExec {
+		needs := cupsPrinterAttributeNeeds(config)
+		for _, a := range MissingCUPSPrinterAttributes(config) {
+			if needs[a] == "" {
+				problemf("cups_printer_attributes lacks %s", a)
+			} else {
+				problemf("cups_printer_attributes lacks %s, which %s needs", a, needs[a])
+			}
+		}
+	}
+	if config.DiscoveryEnable && config.Backend == BackendExec {
+		problemf("discovery_enable adds CUPS queues, and can't be used with backend %s", BackendExec)
+	}
+	for _, network := range config.DiscoveryNetworks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil || ipNet.IP.To4() == nil {
+			problemf("discovery_networks entry %q is not an IPv4 network, like 192.168.1.0/24", network)
+		} else if ones, _ := ipNet.Mask.Size(); ones < discoveryMinPrefixLength {
+			problemf("discovery_networks entry %q is larger than a /%d network", network, discoveryMinPrefixLength)
+		}
+	}
+
+	durations := []struct {
+		key      string
+		value    string
+		zeroIsOK bool
+	}{
+		{"cups_connect_timeout", config.CUPSConnectTimeout, false},
+		{"cups_list_timeout", config.CUPSListTimeout, false},
+		{"cups_ppd_timeout", config.CUPSPPDTimeout, false},
+		{"cups_print_timeout", config.CUPSPrintTimeout, false},
+		{"cups_job_state_timeout", config.CUPSJobStateTimeout, false},
+		{"cups_printer_poll_interval", config.CUPSPrinterPollInterval, false},
+		{"cups_printer_state_poll_interval", config.CUPSPrinterStatePollInterval, false},
+		{"cups_printer_full_fetch_interval", config.CUPSPrinterFullFetchInterval, true},
+		{"gcp_xmpp_ping_timeout", config.XMPPPingTimeout, false},
+		{"gcp_xmpp_ping_interval_default", config.XMPPPingIntervalDefault, false},
+		{"gcp_fallback_poll_interval_min", config.FallbackPollIntervalMin, false},
+		{"gcp_fallback_poll_interval_max", config.FallbackPollIntervalMax, false},
+		{"gcp_upload_timeout", config.GCPUploadTimeout, true},
+		{"gcp_max_job_age", config.GCPMaxJobAge, true},
+		{"discovery_interval", config.DiscoveryInterval, false},
+		{"printer_probe_interval", config.PrinterProbeInterval, true},
+		{"printer_probe_timeout", config.PrinterProbeTimeout, false},
+	}
+	if config.MetricsStatsDAddress != "" || config.MetricsOTLPEndpoint != "" {
+		durations = append(durations, struct {
+			key      string
+			value    string
+			zeroIsOK bool
+		}{"metrics_interval", config.MetricsInterval, false})
+	}
+	if config.SNMPEnable {
+		durations = append(durations, struct {
+			key      string
+			value    string
+			zeroIsOK bool
+		}{"snmp_poll_interval", config.SNMPPollInterval, false})
+	}
+	for _, d := range durations {
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			problemf("%s must be a duration like \"30s\", \"5m\" or \"1h\", not %q", d.key, d.value)
+		} else if v < 0 || v == 0 && !d.zeroIsOK {
+			problemf("%s must be positive, not %q", d.key, d.value)
+		}
+	}
+	min, minErr := time.ParseDuration(config.FallbackPollIntervalMin)
+	max, maxErr := time.ParseDuration(config.FallbackPollIntervalMax)
+	if minErr == nil && maxErr == nil && min > max {
+		problemf("gcp_fallback_poll_interval_min (%s) must not be longer than gcp_fallback_poll_interval_max (%s)", min, max)
+	}
+
+	if config.GCPMaxConcurrentDownloads == 0 {
+		problemf("gcp_max_concurrent_downloads must be at least 1")
+	}
+	if config.CUPSMaxConnections == 0 {
+		problemf("cups_max_connections must be at least 1")
+	}
+	if config.CUPSPPDFetchWorkers == 0 {
+		problemf("cups_ppd_fetch_workers must be at least 1")
+	}
+	if config.CUPSPPDTranslator != "" && config.CUPSPPDTranslator != PPDTranslatorGCP && config.CUPSPPDTranslator != PPDTranslatorLocal {
+		problemf("cups_ppd_translator must be %s or %s, not %q", PPDTranslatorGCP, PPDTranslatorLocal, config.CUPSPPDTranslator)
+	}
+	if config.CUPSJobQueueSize == 0 {
+		problemf("cups_job_queue_size must be at least 1")
+	}
+	if config.QuarantineDir != "" && config.QuarantineMaxJobs == 0 {
+		problemf("quarantine_max_jobs must be at least 1 when quarantine_dir is set")
+	}
+	if config.XMPPPingIntervalFile != "" && !config.XMPPPingIntervalAuto {
+		problemf("gcp_xmpp_ping_interval_file is set, but gcp_xmpp_ping_interval_auto isn't true")
+	}
+	if config.XMPPFallbackPort != 0 && config.XMPPFallbackPort == config.XMPPPort {
+		problemf("xmpp_fallback_port must differ from xmpp_port (%d), or be 0 to disable the fallback", config.XMPPPort)
+	}
+	if config.LocalPrintingEnable && config.LocalPortLow > config.LocalPortHigh {
+		problemf("local_port_low (%d) must not be higher than local_port_high (%d)", config.LocalPortLow, config.LocalPortHigh)
+	}
+
+	for key, proxyURL := range map[string]string{"gcp_proxy_url": config.GCPProxyURL, "xmpp_proxy_url": config.XMPPProxyURL} {
+		if _, err := NewProxyDialFunc(proxyURL, &net.Dialer{}); err != nil {
+			problemf("%s: %s", key, err)
+		}
+	}
+	if _, err := NewTLSConfig(config.TLSCAFile, config.TLSPins); err != nil {
+		problemf("tls_ca_file or tls_pins: %s", err)
+	}
+	if accounts := config.Accounts(); len(accounts) > 1 {
+		if _, err := NewSharder(accounts); err != nil {
+			problemf("shard_accounts or profiles: %s", err)
+		}
+	}
+
+	if len(config.MonitorSocketFilename) >= unixSocketPathMax {
+		problemf("monitor_socket_filename must be shorter than %d bytes on %s, not %d bytes long",
+			unixSocketPathMax, runtime.GOOS, len(config.MonitorSocketFilename))
+	}
+	dir := filepath.Dir(config.MonitorSocketFilename)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		problemf("The directory of monitor_socket_filename, %s, must exist and be writable by the connector", dir)
+	}
+
+	return problems
+}
+
+// configKeys returns the JSON keys of the fields of a struct type.
+func configKeys(t reflect.Type) map[string]struct{} {
+	keys := make(map[string]struct{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key != "" && key != "-" {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// unknownKeys returns the keys of m that aren't JSON keys of t, sorted.
+func unknownKeys(m map[string]interface{}, t reflect.Type) []string {
+	known := configKeys(t)
+	var unknown []string
+	for key := range m {
+		if _, exists := known[key]; !exists {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// suggestKey returns a "; did you mean" suggestion for an unknown key that
+// looks like a known key of t, like printerPollInterval for
+// cups_printer_poll_interval, or "" when nothing looks alike.
+func suggestKey(key string, t reflect.Type) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(s))
+	}
+
+	if t == reflect.TypeOf(Config{}) {
+		if newKey, renamed := renamedConfigKey(key); renamed {
+			return "; it was renamed " + newKey
+		}
+	}
+
+	k := normalize(key)
+	var suggestions []string
+	for known := range configKeys(t) {
+		if n := normalize(known); n == k || strings.HasSuffix(n, k) || strings.HasSuffix(k, n) {
+			suggestions = append(suggestions, known)
+		}
+	}
+	if len(suggestions) == 0 {
+		return ""
+	}
+	sort.Strings(suggestions)
+	return "; did you mean " + strings.Join(suggestions, " or ") + "?"
+}
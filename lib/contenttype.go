@@ -0,0 +1,95 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content types of job documents that CUPS can print.
+const (
+	ContentTypePDF        = "application/pdf"
+	ContentTypePostScript = "application/postscript"
+	ContentTypePWGRaster  = "image/pwg-raster"
+	ContentTypeJPEG       = "image/jpeg"
+	ContentTypePNG        = "image/png"
+	ContentTypeText       = "text/plain"
+)
+
+// ContentTypeSniffLen is the number of leading bytes of a document that
+// DetectContentType needs.
+const ContentTypeSniffLen = 512
+
+var contentTypeMagic = []struct {
+	magic       []byte
+	contentType string
+}{
+	{[]byte("%PDF-"), ContentTypePDF},
+	{[]byte("%!"), ContentTypePostScript},
+	{[]byte("RaS2"), ContentTypePWGRaster},
+	{[]byte{0xff, 0xd8, 0xff}, ContentTypeJPEG},
+	{[]byte("\x89PNG\r\n\x1a\n"), ContentTypePNG},
+}
+
+// DetectContentType determines the content type of a job document from
+// its first ContentTypeSniffLen bytes, or from the declared content type,
+// like an HTTP Content-Type header, when the bytes are inconclusive.
+// Returns the declared content type, without parameters, when nothing is
+// recognized, or "" when nothing is declared.
+func DetectContentType(head []byte, declared string) string {
+	for _, m := range contentTypeMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.contentType
+		}
+	}
+
+	declared = normalizeContentType(declared)
+	if declared != "" && declared != "application/octet-stream" {
+		return declared
+	}
+	if len(head) > 0 && validUTF8Prefix(head) && bytes.IndexByte(head, 0) < 0 {
+		return ContentTypeText
+	}
+	return declared
+}
+
+// validUTF8Prefix answers the question "is b valid UTF-8, except for a rune
+// cut off at the end?"
+func validUTF8Prefix(b []byte) bool {
+	// Drop the last rune if it's incomplete.
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				b = b[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(b)
+}
+
+// ContentTypeSupported answers the question "can CUPS print documents of
+// this content type?"
+func ContentTypeSupported(contentType string) bool {
+	switch normalizeContentType(contentType) {
+	case ContentTypePDF, ContentTypePostScript, ContentTypePWGRaster, ContentTypeJPEG, ContentTypePNG, ContentTypeText:
+		return true
+	}
+	return false
+}
+
+// normalizeContentType removes parameters, like charset, and lowercases.
+func normalizeContentType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
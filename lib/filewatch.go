@@ -0,0 +1,36 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import "time"
+
+// How long files must stay unchanged before a change is reported, so that a
+// command that rewrites several files is reported once.
+const fileWatchSettleTime = 2 * time.Second
+
+// settleChanges reports on the returned channel once no change arrived on
+// changes for fileWatchSettleTime.
+func settleChanges(changes <-chan struct{}) <-chan struct{} {
+	settled := make(chan struct{}, 1)
+	go func() {
+		var t <-chan time.Time
+		for {
+			select {
+			case <-changes:
+				t = time.After(fileWatchSettleTime)
+			case <-t:
+				t = nil
+				select {
+				case settled <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return settled
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// WatchFiles reports on the returned channel when any of filenames is
+// written, created, removed or replaced, with inotify. Their directories are
+// watched, rather than the files, because programs like cupsd replace files
+// by renaming new ones over them.
+func WatchFiles(filenames []string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start inotify: %s", err)
+	}
+
+	names := make(map[int32]map[string]struct{})
+	for _, filename := range filenames {
+		dir, name := filepath.Split(filepath.Clean(filename))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("Failed to watch %s: %s", dir, err)
+		}
+		if names[int32(wd)] == nil {
+			names[int32(wd)] = make(map[string]struct{})
+		}
+		names[int32(wd)][name] = struct{}{}
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		var buf [syscall.SizeofInotifyEvent * 64]byte
+		for {
+			n, err := syscall.Read(fd, buf[:])
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				glog.Errorf("Failed to read inotify events, no longer watching %v: %s", filenames, err)
+				return
+			}
+
+			changed := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				nameEnd := nameStart + int(event.Len)
+				if nameEnd > n {
+					break
+				}
+				name := string(buf[nameStart:nameEnd])
+				for i := range name {
+					if name[i] == 0 {
+						name = name[:i]
+						break
+					}
+				}
+				if _, exists := names[event.Wd][name]; exists {
+					changed = true
+				}
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					changed = true
+				}
+				offset = nameEnd
+			}
+
+			if changed {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return settleChanges(changes), nil
+}
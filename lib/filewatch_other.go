@@ -0,0 +1,58 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"os"
+	"time"
+)
+
+// How often files are checked for changes, on platforms without inotify.
+const fileWatchPollInterval = 5 * time.Second
+
+// WatchFiles reports on the returned channel when the modification time or
+// size of any of filenames changes, or when one is created or removed. Files
+// are polled, as there is no inotify on this platform.
+func WatchFiles(filenames []string) (<-chan struct{}, error) {
+	type fileStat struct {
+		modTime time.Time
+		size    int64
+	}
+	stat := func() []fileStat {
+		s := make([]fileStat, len(filenames))
+		for i, filename := range filenames {
+			if fi, err := os.Stat(filename); err == nil {
+				s[i] = fileStat{fi.ModTime(), fi.Size()}
+			}
+		}
+		return s
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		last := stat()
+		for range time.Tick(fileWatchPollInterval) {
+			current := stat()
+			for i := range current {
+				if current[i] != last[i] {
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+					break
+				}
+			}
+			last = current
+		}
+	}()
+
+	return settleChanges(changes), nil
+}
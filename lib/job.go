@@ -7,10 +7,17 @@ https://developers.google.com/open-source/licenses/bsd
 */
 package lib
 
+import "time"
+
 type Job struct {
 	GCPPrinterID string
 	GCPJobID     string
 	FileURL      string
 	OwnerID      string
 	Title        string
+	// When the job was submitted to GCP; zero when GCP didn't say.
+	CreateTime time.Time
+	// Whether a local client submitted the job with Privet, so that GCP
+	// doesn't know the job.
+	Local bool
 }
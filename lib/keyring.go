@@ -0,0 +1,165 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Values of Config.CredentialsStore.
+const (
+	CredentialsStoreFile    = "file"
+	CredentialsStoreKeyring = "keyring"
+)
+
+// keyringService names the connector's secrets in the OS keyring.
+const keyringService = "cups-connector"
+
+// keyringAccount returns the keyring account name of the robot or user
+// refresh token of the GCP account with an XMPP JID.
+func keyringAccount(xmppJID string, robot bool) string {
+	if robot {
+		return xmppJID + "/robot"
+	}
+	return xmppJID + "/user"
+}
+
+// keyringGet reads a secret from the OS keyring: the libsecret store
+// (GNOME Keyring, KWallet) via secret-tool, or the OS X keychain via
+// security.
+func keyringGet(account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", account)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Failed to read %s from the keyring: %s %s", account, err, strings.TrimSpace(stderr.String()))
+	}
+	secret := strings.TrimRight(stdout.String(), "\n")
+	if secret == "" {
+		return "", fmt.Errorf("Failed to read %s from the keyring: not found", account)
+	}
+	return secret, nil
+}
+
+// keyringSet writes a secret to the OS keyring, replacing any secret that
+// is already stored for account.
+func keyringSet(account, secret string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// security only takes the password as an argument, so give it the
+		// command on stdin, where other users can't see it, unlike argv.
+		command, err := securityAddCommand(account, secret)
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(command)
+	default:
+		cmd = exec.Command("secret-tool", "store", "--label", fmt.Sprintf("%s %s", keyringService, account),
+			"service", keyringService, "account", account)
+		cmd.Stdin = strings.NewReader(secret)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to write %s to the keyring: %s %s", account, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// securityAddCommand returns the security interactive mode command that
+// stores secret for account in the OS X keychain. Its words are quoted;
+// words with quotes, backslashes or newlines are refused, not escaped.
+func securityAddCommand(account, secret string) (string, error) {
+	words := []string{"add-generic-password", "-U", "-s", keyringService, "-a", account, "-w", secret}
+	for i, word := range words {
+		if strings.ContainsAny(word, "\"\\\n\r") {
+			return "", fmt.Errorf("Failed to write %s to the keyring: it contains a quote, backslash or newline", account)
+		}
+		words[i] = `"` + word + `"`
+	}
+	return strings.Join(words, " ") + "\n", nil
+}
+
+// accountTokens points to the refresh tokens of one account of a Config.
+type accountTokens struct {
+	xmppJID     string
+	robot, user *string
+}
+
+// refreshTokens returns pointers to the refresh tokens of each account of c.
+func (c *Config) refreshTokens() []accountTokens {
+	tokens := []accountTokens{{c.XMPPJID, &c.RobotRefreshToken, &c.UserRefreshToken}}
+	for i := range c.ShardAccounts {
+		a := &c.ShardAccounts[i]
+		tokens = append(tokens, accountTokens{a.XMPPJID, &a.RobotRefreshToken, &a.UserRefreshToken})
+	}
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		tokens = append(tokens, accountTokens{p.XMPPJID, &p.RobotRefreshToken, &p.UserRefreshToken})
+	}
+	return tokens
+}
+
+// loadRefreshTokensFromKeyring fills in the refresh tokens that are empty
+// in c from the OS keyring. A missing user refresh token is not an error,
+// because it is optional.
+func (c *Config) loadRefreshTokensFromKeyring() error {
+	for _, t := range c.refreshTokens() {
+		if *t.robot == "" {
+			secret, err := keyringGet(keyringAccount(t.xmppJID, true))
+			if err != nil {
+				return err
+			}
+			*t.robot = secret
+		}
+		if *t.user == "" {
+			if secret, err := keyringGet(keyringAccount(t.xmppJID, false)); err == nil {
+				*t.user = secret
+			}
+		}
+	}
+	return nil
+}
+
+// saveRefreshTokensToKeyring writes the refresh tokens of c to the OS
+// keyring, and empties them in c, so that they aren't written to the
+// config file.
+func (c *Config) saveRefreshTokensToKeyring() error {
+	for _, t := range c.refreshTokens() {
+		if t.xmppJID == "" {
+			return fmt.Errorf("Failed to write refresh tokens to the keyring: an account has no xmpp_jid")
+		}
+		for _, token := range []struct {
+			secret *string
+			robot  bool
+		}{{t.robot, true}, {t.user, false}} {
+			if *token.secret == "" {
+				continue
+			}
+			if err := keyringSet(keyringAccount(t.xmppJID, token.robot), *token.secret); err != nil {
+				return err
+			}
+			*token.secret = ""
+		}
+	}
+	return nil
+}
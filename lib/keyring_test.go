@@ -0,0 +1,27 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import "testing"
+
+func TestSecurityAddCommand(t *testing.T) {
+	command, err := securityAddCommand("abc@cloudprint.googleusercontent.com/robot", "1/token_with-chars.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `"add-generic-password" "-U" "-s" "cups-connector" "-a" "abc@cloudprint.googleusercontent.com/robot" "-w" "1/token_with-chars."` + "\n"
+	if command != expected {
+		t.Errorf("Got %q, want %q", command, expected)
+	}
+
+	for _, secret := range []string{`a"b`, `a\b`, "a\nb", "a\rb"} {
+		if _, err := securityAddCommand("account", secret); err == nil {
+			t.Errorf("Secret %q was accepted", secret)
+		}
+	}
+}
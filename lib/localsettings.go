@@ -0,0 +1,50 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import "time"
+
+// LocalSettings are the local_settings of a GCP printer, which its owner
+// changes in GCP. Changes are pending until the connector applies them, and
+// confirms them as current.
+type LocalSettings struct {
+	// Seconds between XMPP pings; zero means not set.
+	XMPPTimeoutValue uint `json:"xmpp_timeout_value,omitempty"`
+	// Whether the printer is announced on the local network; nil means yes.
+	LocalDiscovery *bool `json:"local_discovery,omitempty"`
+	// Whether local clients may get access tokens for the printer; nil
+	// means yes.
+	AccessTokenEnable *bool `json:"access_token_enable,omitempty"`
+	// Whether the printer takes jobs from local clients, and jobs that need
+	// to be converted first.
+	LocalPrintingEnabled      *bool `json:"printer/local_printing_enabled,omitempty"`
+	ConversionPrintingEnabled *bool `json:"printer/conversion_printing_enabled,omitempty"`
+}
+
+// XMPPPingInterval returns the XMPP ping interval, or zero when not set.
+func (s *LocalSettings) XMPPPingInterval() time.Duration {
+	return time.Duration(s.XMPPTimeoutValue) * time.Second
+}
+
+// LocalDiscoveryEnabled answers the question "should the printer be
+// announced on the local network?"
+func (s *LocalSettings) LocalDiscoveryEnabled() bool {
+	return s.LocalDiscovery == nil || *s.LocalDiscovery
+}
+
+// AccessTokenEnabled answers the question "may local clients get access
+// tokens for the printer?"
+func (s *LocalSettings) AccessTokenEnabled() bool {
+	return s.AccessTokenEnable == nil || *s.AccessTokenEnable
+}
+
+// LocalJobsEnabled answers the question "does the printer take jobs from
+// local clients?" nil means yes.
+func (s *LocalSettings) LocalJobsEnabled() bool {
+	return s.LocalPrintingEnabled == nil || *s.LocalPrintingEnabled
+}
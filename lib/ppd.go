@@ -0,0 +1,708 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/cups-connector/cdd"
+
+	"github.com/golang/glog"
+)
+
+// Vendor capabilities for PPD custom options (like a secure print PIN)
+// have this suffix appended to the option keyword.
+const PPDCustomSuffix = ".Custom"
+
+var (
+	// Options that are translated to standard CDD capabilities, so they
+	// don't need vendor capabilities.
+	ppdStandardKeywords = map[string]struct{}{
+		"PageSize":       struct{}{},
+		"PageRegion":     struct{}{},
+		"Resolution":     struct{}{},
+		"ColorModel":     struct{}{},
+		"Duplex":         struct{}{},
+		"Collate":        struct{}{},
+		"OutputOrder":    struct{}{},
+		"CustomPageSize": struct{}{},
+	}
+
+	// CDD media size names of the PPD PageSize choices that have one.
+	// Source of PPD names: PPD Spec 4.3, Table B.2.
+	ppdMediaSizeNames = map[string]string{
+		"Letter":     "NA_LETTER",
+		"Legal":      "NA_LEGAL",
+		"Executive":  "NA_EXECUTIVE",
+		"Tabloid":    "NA_LEDGER",
+		"Statement":  "NA_INVOICE",
+		"Env10":      "NA_NUMBER_10",
+		"EnvMonarch": "NA_MONARCH",
+		"A3":         "ISO_A3",
+		"A4":         "ISO_A4",
+		"A5":         "ISO_A5",
+		"A6":         "ISO_A6",
+		"B4":         "JIS_B4",
+		"B5":         "JIS_B5",
+		"ISOB5":      "ISO_B5",
+		"EnvC5":      "ISO_C5",
+		"EnvC6":      "ISO_C6",
+		"EnvDL":      "ISO_DL",
+	}
+
+	// ColorModel choices that print in shades of gray, lower case.
+	ppdMonochromeChoices = map[string]struct{}{
+		"gray":       struct{}{},
+		"grayscale":  struct{}{},
+		"black":      struct{}{},
+		"kgray":      struct{}{},
+		"mono":       struct{}{},
+		"monochrome": struct{}{},
+		"bw":         struct{}{},
+	}
+
+	// Get horizontal and vertical DPI from a Resolution choice, like 600dpi
+	// or 600x1200dpi.
+	rePPDResolution = regexp.MustCompile(`^(\d+)(?:x(\d+))?dpi$`)
+)
+
+// PPD is a PostScript Printer Description, as specified by Adobe's PPD
+// Spec 4.3, reduced to what the connector translates to capabilities.
+type PPD struct {
+	Manufacturer string
+	ModelName    string
+	ColorDevice  bool
+
+	// The most copies that the printer makes of a page; zero when the PPD
+	// doesn't say.
+	MaxCopies int
+
+	// UI options, in the PPD's order.
+	Options []PPDOption
+
+	// Parameters of custom options, like a secure print PIN, in the PPD's
+	// order.
+	CustomParams []PPDCustomParam
+
+	// UIConstraints and NonUIConstraints entries, in the PPD's order.
+	Constraints []PPDConstraint
+
+	// Sizes of PageSize choices, in points.
+	PaperDimensions map[string]PPDPaperDimension
+}
+
+// PPDOption is a UI option of a PPD, between OpenUI and CloseUI.
+type PPDOption struct {
+	Keyword string
+	Text    string
+	// PickOne, PickMany or Boolean.
+	UIType string
+	// The default choice; the first choice when the PPD's default isn't a
+	// choice.
+	Default string
+	Choices []PPDChoice
+}
+
+// PPDChoice is a choice of a PPD UI option.
+type PPDChoice struct {
+	Choice string
+	Text   string
+}
+
+// PPDCustomParam is a ParamCustom entry: a parameter of a custom value of
+// an option.
+type PPDCustomParam struct {
+	Keyword string
+	Param   string
+	Text    string
+	Order   int
+	// int, real, points, curve, invcurve, passcode, password or string.
+	Type     string
+	Min, Max string
+}
+
+// PPDConstraint is a PPD UIConstraints entry: Choice1 of option Keyword1
+// can't be combined with Choice2 of option Keyword2. An empty choice means
+// any choice except None, False and Off.
+type PPDConstraint struct {
+	Keyword1, Choice1 string
+	Keyword2, Choice2 string
+}
+
+// PPDPaperDimension is the size of a page, in points.
+type PPDPaperDimension struct {
+	Width, Height float64
+}
+
+// ppdStatement is one statement of a PPD, like
+// *PageSize Letter/US Letter: "<</PageSize[612 792]>>setpagedevice".
+type ppdStatement struct {
+	line        int
+	mainKeyword string
+	option      string
+	text        string
+	value       string
+}
+
+// parsePPDStatements splits a PPD into statements. Quoted values may span
+// lines; their quotes are removed. Comments are skipped.
+func parsePPDStatements(ppd string) ([]ppdStatement, error) {
+	lines := strings.Split(strings.Replace(strings.Replace(ppd, "\r\n", "\n", -1), "\r", "\n", -1), "\n")
+
+	var statements []ppdStatement
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if !strings.HasPrefix(line, "*") || strings.HasPrefix(line, "*%") {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			// *End, or a keyword without a value.
+			continue
+		}
+
+		s := ppdStatement{line: i + 1}
+		keywords := strings.TrimSpace(line[1:colon])
+		if space := strings.IndexAny(keywords, " \t"); space >= 0 {
+			s.mainKeyword = keywords[:space]
+			s.option = strings.TrimSpace(keywords[space+1:])
+			if slash := strings.Index(s.option, "/"); slash >= 0 {
+				s.text = ppdText(strings.TrimSpace(s.option[slash+1:]))
+				s.option = s.option[:slash]
+			}
+		} else {
+			s.mainKeyword = keywords
+		}
+
+		value := strings.TrimSpace(line[colon+1:])
+		if strings.HasPrefix(value, `"`) {
+			value = value[1:]
+			var parts []string
+			for !strings.Contains(value, `"`) {
+				parts = append(parts, value)
+				i++
+				if i == len(lines) {
+					return nil, fmt.Errorf("PPD line %d: the value of *%s has no closing quote", s.line, s.mainKeyword)
+				}
+				value = lines[i]
+			}
+			parts = append(parts, value[:strings.Index(value, `"`)])
+			value = strings.Join(parts, "\n")
+		}
+		s.value = value
+
+		statements = append(statements, s)
+	}
+	return statements, nil
+}
+
+// ppdText decodes the hex substrings of a PPD translation string, like
+// <E9> in Caf<E9>, and converts it to UTF-8 from ISOLatin1, the default
+// PPD encoding, unless it is valid UTF-8 already.
+func ppdText(s string) string {
+	var b []byte
+	for len(s) > 0 {
+		open := strings.Index(s, "<")
+		if open < 0 {
+			break
+		}
+		closing := strings.Index(s[open:], ">")
+		if closing < 0 {
+			break
+		}
+		decoded, err := hex.DecodeString(strings.Replace(s[open+1:open+closing], " ", "", -1))
+		if err != nil {
+			b = append(b, s[:open+closing+1]...)
+		} else {
+			b = append(b, s[:open]...)
+			b = append(b, decoded...)
+		}
+		s = s[open+closing+1:]
+	}
+	b = append(b, s...)
+
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i := range b {
+		runes[i] = rune(b[i])
+	}
+	return string(runes)
+}
+
+// ParsePPD parses a PPD. Malformed options are skipped, with a warning;
+// only a file that isn't a PPD at all is an error.
+func ParsePPD(ppd string) (*PPD, error) {
+	statements, err := parsePPDStatements(ppd)
+	if err != nil {
+		return nil, err
+	}
+	if len(statements) == 0 || statements[0].mainKeyword != "PPD-Adobe" {
+		return nil, errors.New("Not a PPD: it doesn't start with *PPD-Adobe")
+	}
+
+	p := PPD{PaperDimensions: make(map[string]PPDPaperDimension)}
+	defaults := make(map[string]string)
+	var open *PPDOption
+
+	for _, s := range statements {
+		switch s.mainKeyword {
+		case "Manufacturer":
+			p.Manufacturer = s.value
+		case "ModelName":
+			p.ModelName = s.value
+		case "ColorDevice":
+			p.ColorDevice = s.value == "True"
+		case "cupsMaxCopies":
+			p.MaxCopies, _ = strconv.Atoi(s.value)
+
+		case "OpenUI", "JCLOpenUI":
+			if open != nil {
+				glog.Warningf("PPD line %d: option %s isn't closed; skipping it", s.line, open.Keyword)
+			}
+			open = &PPDOption{
+				Keyword: strings.TrimPrefix(s.option, "*"),
+				Text:    s.text,
+				UIType:  s.value,
+			}
+			if open.Text == "" {
+				open.Text = open.Keyword
+			}
+
+		case "CloseUI", "JCLCloseUI":
+			if open == nil {
+				continue
+			}
+			if keyword := strings.TrimPrefix(s.value, "*"); keyword != open.Keyword {
+				glog.Warningf("PPD line %d: option %s is closed as %s; skipping it", s.line, open.Keyword, keyword)
+			} else {
+				p.Options = append(p.Options, *open)
+			}
+			open = nil
+
+		case "UIConstraints", "NonUIConstraints":
+			if c, ok := parsePPDConstraint(s.value); ok {
+				p.Constraints = append(p.Constraints, c)
+			} else {
+				glog.Warningf("PPD line %d: failed to parse constraint %q", s.line, s.value)
+			}
+
+		case "PaperDimension":
+			var d PPDPaperDimension
+			if _, err := fmt.Sscanf(s.value, "%g %g", &d.Width, &d.Height); err == nil {
+				p.PaperDimensions[s.option] = d
+			}
+
+		default:
+			switch {
+			case strings.HasPrefix(s.mainKeyword, "Default") && s.option == "":
+				defaults[strings.TrimPrefix(s.mainKeyword, "Default")] = s.value
+			case strings.HasPrefix(s.mainKeyword, "ParamCustom") && s.option != "":
+				if param, ok := parsePPDCustomParam(strings.TrimPrefix(s.mainKeyword, "ParamCustom"), s); ok {
+					p.CustomParams = append(p.CustomParams, param)
+				}
+			case open != nil && s.mainKeyword == open.Keyword && s.option != "":
+				text := s.text
+				if text == "" {
+					text = s.option
+				}
+				open.Choices = append(open.Choices, PPDChoice{s.option, text})
+			}
+		}
+	}
+	if open != nil {
+		glog.Warningf("PPD option %s isn't closed; skipping it", open.Keyword)
+	}
+
+	for i := range p.Options {
+		o := &p.Options[i]
+		o.Default = defaults[o.Keyword]
+		if o.choice(o.Default) == nil && len(o.Choices) > 0 {
+			o.Default = o.Choices[0].Choice
+		}
+	}
+
+	return &p, nil
+}
+
+// parsePPDConstraint parses the value of a UIConstraints entry, like
+// *Duplex DuplexNoTumble *InputSlot Envelope.
+func parsePPDConstraint(value string) (PPDConstraint, bool) {
+	var keywords, choices []string
+	for _, field := range strings.Fields(value) {
+		if strings.HasPrefix(field, "*") {
+			keywords = append(keywords, field[1:])
+			choices = append(choices, "")
+		} else if len(keywords) > 0 && choices[len(choices)-1] == "" {
+			choices[len(choices)-1] = field
+		} else {
+			return PPDConstraint{}, false
+		}
+	}
+	if len(keywords) != 2 {
+		return PPDConstraint{}, false
+	}
+	return PPDConstraint{keywords[0], choices[0], keywords[1], choices[1]}, true
+}
+
+// parsePPDCustomParam parses a ParamCustom entry, like
+// *ParamCustomPIN PIN/Secure PIN: 1 passcode 4 8.
+func parsePPDCustomParam(keyword string, s ppdStatement) (PPDCustomParam, bool) {
+	fields := strings.Fields(s.value)
+	if len(fields) != 4 {
+		return PPDCustomParam{}, false
+	}
+	order, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return PPDCustomParam{}, false
+	}
+	text := s.text
+	if text == "" {
+		text = s.option
+	}
+	return PPDCustomParam{
+		Keyword: keyword,
+		Param:   s.option,
+		Text:    text,
+		Order:   order,
+		Type:    fields[1],
+		Min:     fields[2],
+		Max:     fields[3],
+	}, true
+}
+
+// Option returns the UI option with a keyword, or nil.
+func (p *PPD) Option(keyword string) *PPDOption {
+	for i := range p.Options {
+		if p.Options[i].Keyword == keyword {
+			return &p.Options[i]
+		}
+	}
+	return nil
+}
+
+// choice returns the choice with a name, or nil.
+func (o *PPDOption) choice(name string) *PPDChoice {
+	for i := range o.Choices {
+		if o.Choices[i].Choice == name {
+			return &o.Choices[i]
+		}
+	}
+	return nil
+}
+
+// TranslatePPD translates a PPD to a CDD printer description, like GCP's
+// PPD translation service, but locally. The description depends only on
+// the PPD.
+func TranslatePPD(ppd string) (*cdd.PrinterDescriptionSection, error) {
+	p, err := ParsePPD(ppd)
+	if err != nil {
+		return nil, err
+	}
+	return p.Description(), nil
+}
+
+// Description translates a PPD to a CDD printer description: the standard
+// options to standard capabilities, and the others to vendor capabilities.
+func (p *PPD) Description() *cdd.PrinterDescriptionSection {
+	var description cdd.PrinterDescriptionSection
+
+	if o := p.Option("PageSize"); o != nil {
+		description.MediaSize = p.mediaSize(o)
+	}
+	description.Color = p.color()
+	if o := p.Option("Duplex"); o != nil {
+		description.Duplex = ppdDuplex(o)
+	}
+	if o := p.Option("Resolution"); o != nil {
+		description.DPI = ppdDPI(o)
+	}
+	if o := p.Option("OutputOrder"); o != nil {
+		description.ReverseOrder = &cdd.ReverseOrder{Default: o.Default == "Reverse"}
+	}
+	description.PageOrientation = &cdd.PageOrientation{
+		Option: []cdd.PageOrientationOption{
+			cdd.PageOrientationOption{Type: cdd.PageOrientationAuto, IsDefault: true},
+			cdd.PageOrientationOption{Type: cdd.PageOrientationPortrait},
+			cdd.PageOrientationOption{Type: cdd.PageOrientationLandscape},
+		},
+	}
+	if capabilities := p.VendorCapabilities(nil); len(capabilities) > 0 {
+		description.VendorCapability = &capabilities
+	}
+
+	return &description
+}
+
+// pointsToMicrons converts a PPD length to microns.
+func pointsToMicrons(points float64) int32 {
+	return int32(points*25400/72 + 0.5)
+}
+
+// mediaSize translates the PageSize option. Choices without a
+// PaperDimension are skipped.
+func (p *PPD) mediaSize(o *PPDOption) *cdd.MediaSize {
+	var mediaSize cdd.MediaSize
+	for _, c := range o.Choices {
+		d, exists := p.PaperDimensions[c.Choice]
+		if !exists {
+			continue
+		}
+		option := cdd.MediaSizeOption{
+			WidthMicrons:  pointsToMicrons(d.Width),
+			HeightMicrons: pointsToMicrons(d.Height),
+			IsDefault:     c.Choice == o.Default,
+			VendorID:      c.Choice,
+		}
+		// Like Letter.Fullbleed.
+		if name, exists := ppdMediaSizeNames[strings.SplitN(c.Choice, ".", 2)[0]]; exists {
+			option.Name = name
+		} else {
+			option.Name = "CUSTOM"
+			option.CustomDisplayNameLocalized = cdd.NewLocalizedString(c.Text)
+		}
+		mediaSize.Option = append(mediaSize.Option, option)
+	}
+
+	var width, height *PPDCustomParam
+	for i := range p.CustomParams {
+		switch param := &p.CustomParams[i]; {
+		case param.Keyword == "PageSize" && param.Param == "Width":
+			width = param
+		case param.Keyword == "PageSize" && param.Param == "Height":
+			height = param
+		}
+	}
+	if width != nil && height != nil {
+		minWidth, _ := strconv.ParseFloat(width.Min, 64)
+		maxWidth, _ := strconv.ParseFloat(width.Max, 64)
+		minHeight, _ := strconv.ParseFloat(height.Min, 64)
+		maxHeight, _ := strconv.ParseFloat(height.Max, 64)
+		mediaSize.MinWidthMicrons = pointsToMicrons(minWidth)
+		mediaSize.MaxWidthMicrons = pointsToMicrons(maxWidth)
+		mediaSize.MinHeightMicrons = pointsToMicrons(minHeight)
+		mediaSize.MaxHeightMicrons = pointsToMicrons(maxHeight)
+	}
+
+	if len(mediaSize.Option) == 0 {
+		return nil
+	}
+	return &mediaSize
+}
+
+// color translates the ColorModel option: the first gray choice is
+// standard monochrome, the first other choice standard color, and the rest
+// custom. Without ColorModel, ColorDevice says whether the printer prints
+// in color.
+func (p *PPD) color() *cdd.Color {
+	o := p.Option("ColorModel")
+	if o == nil {
+		if p.ColorDevice {
+			return &cdd.Color{Option: []cdd.ColorOption{
+				cdd.ColorOption{Type: cdd.ColorTypeStandardColor, IsDefault: true},
+				cdd.ColorOption{Type: cdd.ColorTypeStandardMonochrome},
+			}}
+		}
+		return &cdd.Color{Option: []cdd.ColorOption{
+			cdd.ColorOption{Type: cdd.ColorTypeStandardMonochrome, IsDefault: true},
+		}}
+	}
+
+	var color cdd.Color
+	var haveColor, haveMonochrome bool
+	for _, c := range o.Choices {
+		option := cdd.ColorOption{
+			VendorID:                   c.Choice,
+			IsDefault:                  c.Choice == o.Default,
+			CustomDisplayNameLocalized: cdd.NewLocalizedString(c.Text),
+		}
+		if _, exists := ppdMonochromeChoices[strings.ToLower(c.Choice)]; exists {
+			if haveMonochrome {
+				option.Type = cdd.ColorTypeCustomMonochrome
+			} else {
+				option.Type = cdd.ColorTypeStandardMonochrome
+				haveMonochrome = true
+			}
+		} else {
+			if haveColor {
+				option.Type = cdd.ColorTypeCustomColor
+			} else {
+				option.Type = cdd.ColorTypeStandardColor
+				haveColor = true
+			}
+		}
+		color.Option = append(color.Option, option)
+	}
+	if len(color.Option) == 0 {
+		return nil
+	}
+	return &color
+}
+
+// ppdDuplex translates the Duplex option. Choices that aren't standard
+// are skipped.
+func ppdDuplex(o *PPDOption) *cdd.Duplex {
+	var duplex cdd.Duplex
+	for _, c := range o.Choices {
+		var t cdd.DuplexType
+		switch c.Choice {
+		case "None", "False", "Off":
+			t = cdd.DuplexNoDuplex
+		case "DuplexNoTumble":
+			t = cdd.DuplexLongEdge
+		case "DuplexTumble":
+			t = cdd.DuplexShortEdge
+		default:
+			continue
+		}
+		duplex.Option = append(duplex.Option, cdd.DuplexOption{Type: t, IsDefault: c.Choice == o.Default})
+	}
+	if len(duplex.Option) == 0 {
+		return nil
+	}
+	return &duplex
+}
+
+// ppdDPI translates the Resolution option. Choices that don't name a
+// resolution, like 600dpi or 600x1200dpi, are skipped.
+func ppdDPI(o *PPDOption) *cdd.DPI {
+	var dpi cdd.DPI
+	for _, c := range o.Choices {
+		res := rePPDResolution.FindStringSubmatch(c.Choice)
+		if res == nil {
+			continue
+		}
+		horizontal, _ := strconv.Atoi(res[1])
+		vertical := horizontal
+		if res[2] != "" {
+			vertical, _ = strconv.Atoi(res[2])
+		}
+		option := cdd.DPIOption{
+			HorizontalDPI: int32(horizontal),
+			VerticalDPI:   int32(vertical),
+			IsDefault:     c.Choice == o.Default,
+			VendorID:      c.Choice,
+		}
+		if c.Text != c.Choice {
+			option.CustomDisplayNameLocalized = cdd.NewLocalizedString(c.Text)
+		}
+		dpi.Option = append(dpi.Option, option)
+	}
+	if len(dpi.Option) == 0 {
+		return nil
+	}
+	return &dpi
+}
+
+// VendorCapabilities translates the UI options of a PPD to vendor
+// capabilities, so that they can be selected when printing.
+//
+// Options that already have a capability in existing, and options that
+// map to standard CDD capabilities, are skipped.
+func (p *PPD) VendorCapabilities(existing []cdd.VendorCapability) []cdd.VendorCapability {
+	skip := make(map[string]struct{}, len(existing))
+	for _, vc := range existing {
+		skip[vc.ID] = struct{}{}
+	}
+
+	capabilities := make([]cdd.VendorCapability, 0)
+
+	for _, o := range p.Options {
+		if _, exists := ppdStandardKeywords[o.Keyword]; exists {
+			continue
+		}
+		if _, exists := skip[o.Keyword]; exists {
+			continue
+		}
+		if len(o.Choices) == 0 {
+			continue
+		}
+
+		vc := cdd.VendorCapability{
+			ID:                   o.Keyword,
+			DisplayNameLocalized: cdd.NewLocalizedString(o.Text),
+		}
+		if o.UIType == "Boolean" {
+			vc.Type = cdd.VendorCapabilityTypedValue
+			vc.TypedValueCap = &cdd.TypedValueCapability{
+				ValueType: cdd.TypedValueCapabilityValueBoolean,
+				Default:   strings.ToLower(o.Default),
+			}
+		} else {
+			options := make([]cdd.SelectCapabilityOption, 0, len(o.Choices))
+			for _, c := range o.Choices {
+				options = append(options, cdd.SelectCapabilityOption{
+					Value:                c.Choice,
+					IsDefault:            c.Choice == o.Default,
+					DisplayNameLocalized: cdd.NewLocalizedString(c.Text),
+				})
+			}
+			vc.Type = cdd.VendorCapabilitySelect
+			vc.SelectCap = &cdd.SelectCapability{Option: options}
+		}
+		capabilities = append(capabilities, vc)
+		skip[o.Keyword] = struct{}{}
+	}
+
+	// Custom options with more than one parameter can't be expressed as
+	// one vendor capability.
+	params := make(map[string]int)
+	for _, param := range p.CustomParams {
+		params[param.Keyword]++
+	}
+	for _, param := range p.CustomParams {
+		if params[param.Keyword] != 1 {
+			continue
+		}
+		if _, exists := ppdStandardKeywords[param.Keyword]; exists {
+			continue
+		}
+		if _, exists := skip[param.Keyword+PPDCustomSuffix]; exists {
+			continue
+		}
+
+		vc := cdd.VendorCapability{
+			ID:                   param.Keyword + PPDCustomSuffix,
+			DisplayNameLocalized: cdd.NewLocalizedString(param.Text),
+		}
+		switch param.Type {
+		case "int":
+			vc.Type = cdd.VendorCapabilityRange
+			vc.RangeCap = &cdd.RangeCapability{
+				ValueType: cdd.RangeCapabilityValueInteger,
+				Min:       param.Min,
+				Max:       param.Max,
+			}
+		case "real", "points", "curve", "invcurve":
+			vc.Type = cdd.VendorCapabilityRange
+			vc.RangeCap = &cdd.RangeCapability{
+				ValueType: cdd.RangeCapabilityValueFloat,
+				Min:       param.Min,
+				Max:       param.Max,
+			}
+		case "passcode", "password", "string":
+			vc.Type = cdd.VendorCapabilityTypedValue
+			vc.TypedValueCap = &cdd.TypedValueCapability{
+				ValueType: cdd.TypedValueCapabilityValueString,
+			}
+		default:
+			continue
+		}
+		capabilities = append(capabilities, vc)
+		skip[vc.ID] = struct{}{}
+	}
+
+	return capabilities
+}
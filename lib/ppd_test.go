@@ -0,0 +1,119 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files in testdata/ppd with the current translations")
+
+// ppdGolden is what a golden file holds for a PPD in testdata/ppd.
+type ppdGolden struct {
+	Manufacturer string                         `json:"manufacturer"`
+	ModelName    string                         `json:"model_name"`
+	MaxCopies    int                            `json:"max_copies"`
+	Constraints  []PPDConstraint                `json:"constraints"`
+	Printer      *cdd.PrinterDescriptionSection `json:"printer"`
+}
+
+// translatePPDFile translates a PPD file to the contents of its golden
+// file.
+func translatePPDFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePPD(string(b))
+	if err != nil {
+		return nil, err
+	}
+	golden := ppdGolden{p.Manufacturer, p.ModelName, p.MaxCopies, p.Constraints, p.Description()}
+	out, err := json.MarshalIndent(golden, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// TestTranslatePPDGolden translates each PPD in testdata/ppd, and compares
+// the result to the .json file of the same name. Run with -update to accept
+// an intended change.
+func TestTranslatePPDGolden(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/ppd/*.ppd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) == 0 {
+		t.Fatal("no PPDs in testdata/ppd")
+	}
+
+	for _, filename := range filenames {
+		got, err := translatePPDFile(filename)
+		if err != nil {
+			t.Errorf("%s: %s", filename, err)
+			continue
+		}
+		if again, _ := translatePPDFile(filename); !bytes.Equal(got, again) {
+			t.Errorf("%s: two translations differ", filename)
+		}
+
+		goldenFilename := strings.TrimSuffix(filename, ".ppd") + ".json"
+		if *updateGolden {
+			if err = ioutil.WriteFile(goldenFilename, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(goldenFilename)
+		if err != nil {
+			t.Errorf("%s: %s; run go test -update to create it", filename, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: translation differs from %s; run go test -update if the change is intended, and review the diff:\n%s",
+				filename, goldenFilename, got)
+		}
+	}
+}
+
+func TestParsePPDErrors(t *testing.T) {
+	for _, ppd := range []string{
+		"",
+		"%!PS-Adobe-3.0\n",
+		"*PPD-Adobe: \"4.3\"\n*ModelName: \"Unterminated\n",
+	} {
+		if _, err := ParsePPD(ppd); err == nil {
+			t.Errorf("ParsePPD(%q) succeeded, want an error", ppd)
+		}
+	}
+}
+
+func TestPPDText(t *testing.T) {
+	for text, want := range map[string]string{
+		"Plain":              "Plain",
+		"Caf<E9>":            "Café",
+		"Caf<C3A9>":          "Café",
+		"Caf<C3 A9> au lait": "Café au lait",
+		"Not <hex> at all":   "Not <hex> at all",
+		"Unclosed <E9":       "Unclosed <E9",
+		"Address – 1⅛ × 3½″": "Address – 1⅛ × 3½″",
+	} {
+		if got := ppdText(text); got != want {
+			t.Errorf("ppdText(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
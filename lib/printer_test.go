@@ -0,0 +1,159 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"testing"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+// gcpPrinterOf returns the GCP printer that a CUPS printer was registered
+// as, so that DiffPrinters finds no change between them.
+func gcpPrinterOf(p Printer, gcpID string) Printer {
+	p.GCPID = gcpID
+	p.SetDescriptionHash()
+	p.setDescriptionHashTag()
+	return p
+}
+
+func TestDiffPrintersNoChange(t *testing.T) {
+	cups := []Printer{{Name: "a", UUID: "ua"}, {Name: "b", UUID: "ub"}}
+	gcp := []Printer{gcpPrinterOf(cups[0], "ga"), gcpPrinterOf(cups[1], "gb")}
+
+	if diffs := DiffPrinters(cups, gcp); diffs != nil {
+		t.Errorf("Got %d diffs, want none", len(diffs))
+	}
+}
+
+func TestDiffPrintersMatchByUUID(t *testing.T) {
+	gcp := []Printer{gcpPrinterOf(Printer{Name: "old", UUID: "u1"}, "g1")}
+	cups := []Printer{{Name: "new", UUID: "u1"}}
+
+	diffs := DiffPrinters(cups, gcp)
+	if len(diffs) != 1 {
+		t.Fatalf("Got %d diffs, want 1", len(diffs))
+	}
+	d := diffs[0]
+	if d.Operation != UpdatePrinter || !d.NameChanged || d.UUIDChanged {
+		t.Errorf("Got operation %d, NameChanged %t, UUIDChanged %t; want a rename", d.Operation, d.NameChanged, d.UUIDChanged)
+	}
+	if d.Printer.Name != "new" || d.Printer.GCPID != "g1" {
+		t.Errorf("Got printer %s (%s), want new (g1)", d.Printer.Name, d.Printer.GCPID)
+	}
+}
+
+func TestDiffPrintersUUIDBeforeName(t *testing.T) {
+	// CUPS printer "a" was renamed "b", and a new printer was added as "a".
+	gcp := []Printer{gcpPrinterOf(Printer{Name: "a", UUID: "u1"}, "g1")}
+	cups := []Printer{{Name: "a", UUID: "u2"}, {Name: "b", UUID: "u1"}}
+
+	var renamed, registered bool
+	for _, d := range DiffPrinters(cups, gcp) {
+		switch {
+		case d.Operation == UpdatePrinter && d.Printer.GCPID == "g1" && d.Printer.Name == "b":
+			renamed = true
+		case d.Operation == RegisterPrinter && d.Printer.Name == "a":
+			registered = true
+		default:
+			t.Errorf("Unexpected diff %d of printer %s (%s)", d.Operation, d.Printer.Name, d.Printer.GCPID)
+		}
+	}
+	if !renamed || !registered {
+		t.Errorf("Renamed %t, registered %t; want both", renamed, registered)
+	}
+}
+
+func TestDiffPrintersMatchByName(t *testing.T) {
+	// Printers registered before UUIDs were kept match by name.
+	gcp := []Printer{gcpPrinterOf(Printer{Name: "a"}, "g1")}
+	cups := []Printer{{Name: "a", UUID: "u1"}}
+
+	diffs := DiffPrinters(cups, gcp)
+	if len(diffs) != 1 || diffs[0].Operation != UpdatePrinter || !diffs[0].UUIDChanged || diffs[0].Printer.GCPID != "g1" {
+		t.Errorf("Got %+v, want an update of g1 with a UUID", diffs)
+	}
+}
+
+func TestDiffPrintersDuplicates(t *testing.T) {
+	cups := []Printer{{Name: "a", UUID: "u1"}}
+	gcp := []Printer{gcpPrinterOf(cups[0], "g1"), gcpPrinterOf(cups[0], "g2"), gcpPrinterOf(Printer{Name: "a"}, "g3")}
+
+	diffs := DiffPrinters(cups, gcp)
+	if len(diffs) != 3 {
+		t.Fatalf("Got %d diffs, want 3", len(diffs))
+	}
+	if diffs[0].Operation != NoChangeToPrinter || diffs[0].Printer.GCPID != "g1" {
+		t.Errorf("Got operation %d of %s, want no change to g1", diffs[0].Operation, diffs[0].Printer.GCPID)
+	}
+	for _, d := range diffs[1:] {
+		if d.Operation != DeletePrinter {
+			t.Errorf("Got operation %d of duplicate %s, want delete", d.Operation, d.Printer.GCPID)
+		}
+	}
+}
+
+func TestDiffPrintersRegisterAndDelete(t *testing.T) {
+	gcp := []Printer{gcpPrinterOf(Printer{Name: "gone", UUID: "u1"}, "g1")}
+	cups := []Printer{{Name: "new", UUID: "u2"}}
+
+	diffs := DiffPrinters(cups, gcp)
+	if len(diffs) != 2 {
+		t.Fatalf("Got %d diffs, want 2", len(diffs))
+	}
+	if diffs[0].Operation != DeletePrinter || diffs[0].Printer.GCPID != "g1" {
+		t.Errorf("Got operation %d of %s, want delete of g1", diffs[0].Operation, diffs[0].Printer.GCPID)
+	}
+	if diffs[1].Operation != RegisterPrinter || diffs[1].Printer.Name != "new" {
+		t.Errorf("Got operation %d of %s, want register of new", diffs[1].Operation, diffs[1].Printer.Name)
+	}
+	if diffs[1].Printer.DescriptionHash == "" {
+		t.Errorf("New printer has no description hash")
+	}
+}
+
+func TestDiffPrintersDescriptionWithoutHash(t *testing.T) {
+	description := &cdd.PrinterDescriptionSection{SupportedContentType: cdd.NewSupportedContentType("application/pdf")}
+	cups := []Printer{{Name: "a", UUID: "u1", Description: description}}
+	// Without the hash of what was uploaded, the descriptions are compared.
+	gcp := gcpPrinterOf(cups[0], "g1")
+	gcp.DescriptionHash = ""
+	delete(gcp.Tags, DescriptionHashTagKey)
+
+	for _, d := range DiffPrinters(cups, []Printer{gcp}) {
+		if d.DescriptionChanged {
+			t.Errorf("Description of %s changed, want the same", d.Printer.Name)
+		}
+	}
+
+	changed := *description
+	changed.SupportedContentType = cdd.NewSupportedContentType("image/pwg-raster")
+	cups[0].Description = &changed
+	diffs := DiffPrinters(cups, []Printer{gcp})
+	if len(diffs) != 1 || !diffs[0].DescriptionChanged {
+		t.Errorf("Got %+v, want a changed description", diffs)
+	}
+}
+
+func TestSetDailyQuotas(t *testing.T) {
+	printers := []Printer{{Name: "a", DailyQuota: 7}, {Name: "b"}, {Name: "c", DailyQuota: 7}}
+
+	SetDailyQuotas(printers, map[string]uint{"a": 10, AllPrintersTagKey: 50, "c": 0})
+	for i, quota := range []uint{10, 50, 0} {
+		if printers[i].DailyQuota != quota {
+			t.Errorf("Quota of %s is %d, want %d", printers[i].Name, printers[i].DailyQuota, quota)
+		}
+	}
+
+	SetDailyQuotas(printers, nil)
+	for _, p := range printers {
+		if p.DailyQuota != 0 {
+			t.Errorf("Quota of %s is %d without quotas, want 0", p.Name, p.DailyQuota)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// SavePrinterCache writes the GCP printer list to filename, so that it can
+// be loaded with LoadPrinterCache when GCP is unreachable. The file is
+// replaced atomically. CUPSJobSemaphore is not saved.
+func SavePrinterCache(filename string, printers []Printer) error {
+	b, err := json.Marshal(printers)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal printer cache: %s", err)
+	}
+
+	tempFilename := filename + ".tmp"
+	if err = ioutil.WriteFile(tempFilename, b, 0600); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("Failed to write printer cache: %s", err)
+	}
+	if err = os.Rename(tempFilename, filename); err != nil {
+		os.Remove(tempFilename)
+		return fmt.Errorf("Failed to write printer cache: %s", err)
+	}
+
+	return nil
+}
+
+// LoadPrinterCache reads a GCP printer list saved by SavePrinterCache.
+func LoadPrinterCache(filename string) ([]Printer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read printer cache: %s", err)
+	}
+
+	var printers []Printer
+	if err = json.Unmarshal(b, &printers); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal printer cache %s: %s", filename, err)
+	}
+
+	return printers, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+)
+
+// Sharder assigns CUPS printers to one of several GCP accounts.
+//
+// A printer whose name matches an account's printer name pattern is
+// assigned to the first such account. Other printers are assigned by
+// hash of the printer name to one of the accounts without a pattern, or to
+// the first account, the main one, when every account has a pattern.
+//
+// Accounts of profiles are apart: a printer whose name matches a profile's
+// pattern is assigned to that profile, and to any other profile whose
+// pattern it matches, but not to the other accounts.
+type Sharder struct {
+	patterns []*regexp.Regexp
+	hashed   []int
+	profiles []int
+}
+
+// NewSharder compiles the printer name patterns of accounts.
+func NewSharder(accounts []ShardAccount) (*Sharder, error) {
+	s := Sharder{
+		patterns: make([]*regexp.Regexp, len(accounts)),
+		hashed:   make([]int, 0, len(accounts)),
+	}
+
+	for i, account := range accounts {
+		if account.Profile != "" {
+			if account.PrinterNamePattern == "" {
+				return nil, fmt.Errorf("Profile %s has no printer name pattern", account.Profile)
+			}
+			s.profiles = append(s.profiles, i)
+		} else if account.PrinterNamePattern == "" {
+			s.hashed = append(s.hashed, i)
+			continue
+		}
+		pattern, err := regexp.Compile(account.PrinterNamePattern)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse printer name pattern %s: %s", account.PrinterNamePattern, err)
+		}
+		s.patterns[i] = pattern
+	}
+
+	return &s, nil
+}
+
+// Shard returns the index of the account, other than a profile's, that
+// printerName is assigned to, or -1 if the printer is in a profile.
+func (s *Sharder) Shard(printerName string) int {
+	for _, i := range s.profiles {
+		if s.patterns[i].MatchString(printerName) {
+			return -1
+		}
+	}
+	for i, pattern := range s.patterns {
+		if pattern != nil && !s.isProfile(i) && pattern.MatchString(printerName) {
+			return i
+		}
+	}
+
+	if len(s.hashed) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(printerName))
+	return s.hashed[h.Sum32()%uint32(len(s.hashed))]
+}
+
+// isProfile answers the question "is account a profile's?"
+func (s *Sharder) isProfile(account int) bool {
+	for _, i := range s.profiles {
+		if i == account {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterPrinters returns the printers that are assigned to account shard.
+func (s *Sharder) FilterPrinters(printers []Printer, shard int) []Printer {
+	profile := s.isProfile(shard)
+	result := make([]Printer, 0, len(printers))
+	for i := range printers {
+		if profile && s.patterns[shard].MatchString(printers[i].Name) ||
+			!profile && s.Shard(printers[i].Name) == shard {
+			result = append(result, printers[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestSharder(t *testing.T) *Sharder {
+	s, err := NewSharder([]ShardAccount{
+		{},
+		{PrinterNamePattern: "^color-"},
+		{},
+		{Profile: "acme", PrinterNamePattern: "^acme-|-shared$"},
+		{Profile: "initech", PrinterNamePattern: "^initech-|-shared$"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestShard(t *testing.T) {
+	s := newTestSharder(t)
+	for printerName, want := range map[string]int{
+		"color-lobby":   1,
+		"acme-lobby":    -1,
+		"lobby-shared":  -1,
+		"initech-front": -1,
+	} {
+		if got := s.Shard(printerName); got != want {
+			t.Errorf("Shard(%q) = %d, want %d", printerName, got, want)
+		}
+	}
+
+	// Other printers are hashed to the accounts without a pattern, always
+	// the same way.
+	for _, printerName := range []string{"lobby", "floor2", "floor3", "mailroom"} {
+		got := s.Shard(printerName)
+		if got != 0 && got != 2 {
+			t.Errorf("Shard(%q) = %d, want 0 or 2", printerName, got)
+		}
+		if again := s.Shard(printerName); again != got {
+			t.Errorf("Shard(%q) = %d, then %d", printerName, got, again)
+		}
+	}
+}
+
+func TestShardWithoutHashedAccounts(t *testing.T) {
+	s, err := NewSharder([]ShardAccount{{PrinterNamePattern: "^mono-"}, {PrinterNamePattern: "^color-"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Printers that match no pattern go to the main account.
+	for printerName, want := range map[string]int{"mono-lobby": 0, "color-lobby": 1, "lobby": 0} {
+		if got := s.Shard(printerName); got != want {
+			t.Errorf("Shard(%s) = %d, want %d", printerName, got, want)
+		}
+	}
+}
+
+func TestNewSharderProfileWithoutPattern(t *testing.T) {
+	if _, err := NewSharder([]ShardAccount{{}, {Profile: "acme"}}); err == nil {
+		t.Error("NewSharder accepted a profile without a printer name pattern")
+	}
+}
+
+func TestIsProfile(t *testing.T) {
+	s := newTestSharder(t)
+	for account, want := range []bool{false, false, false, true, true} {
+		if got := s.isProfile(account); got != want {
+			t.Errorf("isProfile(%d) = %t, want %t", account, got, want)
+		}
+	}
+}
+
+func TestFilterPrinters(t *testing.T) {
+	s := newTestSharder(t)
+	printers := []Printer{{Name: "color-lobby"}, {Name: "acme-lobby"}, {Name: "initech-front"}, {Name: "lobby-shared"}}
+	names := func(printers []Printer) []string {
+		names := []string{}
+		for _, p := range printers {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	for shard, want := range map[int][]string{
+		1: {"color-lobby"},
+		3: {"acme-lobby", "lobby-shared"},
+		4: {"initech-front", "lobby-shared"},
+	} {
+		if got := names(s.FilterPrinters(printers, shard)); !reflect.DeepEqual(got, want) {
+			t.Errorf("FilterPrinters(%d) = %v, want %v", shard, got, want)
+		}
+	}
+}
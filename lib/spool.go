@@ -0,0 +1,133 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Spool handles the temporary files that job documents are downloaded to.
+// Files can be encrypted with AES-256, with a random key that is only ever
+// held in memory, and overwritten with zeros before they are removed.
+type Spool struct {
+	// Nil when files aren't encrypted.
+	block cipher.Block
+	shred bool
+}
+
+// NewSpool encrypts files when encrypt is true, and overwrites them before
+// removing them when shred is true.
+func NewSpool(encrypt, shred bool) (*Spool, error) {
+	s := &Spool{shred: shred}
+	if encrypt {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("Failed to make a spool encryption key: %s", err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		s.block = block
+	}
+	return s, nil
+}
+
+// Encrypted says whether files are encrypted.
+func (s *Spool) Encrypted() bool {
+	return s.block != nil
+}
+
+// Writer returns a writer that encrypts what it writes to f, which must be
+// empty. Returns f when files aren't encrypted.
+func (s *Spool) Writer(f *os.File) (io.Writer, error) {
+	if s.block == nil {
+		return f, nil
+	}
+
+	// Each file has a random IV, written before the ciphertext.
+	iv := make([]byte, s.block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("Failed to make a spool file IV: %s", err)
+	}
+	if _, err := f.Write(iv); err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: cipher.NewCTR(s.block, iv), W: f}, nil
+}
+
+// Open opens a file written through Writer, and decrypts what is read from
+// it.
+func (s *Spool) Open(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if s.block == nil {
+		return f, nil
+	}
+
+	iv := make([]byte, s.block.BlockSize())
+	if _, err = io.ReadFull(f, iv); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to read the IV of spool file %s: %s", filename, err)
+	}
+	return spoolReader{cipher.StreamReader{S: cipher.NewCTR(s.block, iv), R: f}, f}, nil
+}
+
+type spoolReader struct {
+	cipher.StreamReader
+	f *os.File
+}
+
+func (r spoolReader) Close() error {
+	return r.f.Close()
+}
+
+// Remove removes a file, after overwriting it with zeros when files are
+// shredded.
+func (s *Spool) Remove(filename string) error {
+	if s.shred {
+		if err := overwrite(filename); err != nil {
+			os.Remove(filename)
+			return fmt.Errorf("Failed to overwrite spool file %s: %s", filename, err)
+		}
+	}
+	return os.Remove(filename)
+}
+
+// overwrite writes zeros over the whole file, and syncs it to disk.
+func overwrite(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 32*1024)
+	for left := fi.Size(); left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err = f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		left -= n
+	}
+	return f.Sync()
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSpoolFile writes document through spool to a new file in dir, and
+// returns its name.
+func writeSpoolFile(t *testing.T, spool *Spool, dir string, document []byte) string {
+	f, err := ioutil.TempFile(dir, "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := spool.Writer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(document); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Larger than a buffer, and not a multiple of the AES block size.
+	document := bytes.Repeat([]byte("%PDF-1.4 document "), 5000)
+
+	for _, encrypt := range []bool{false, true} {
+		spool, err := NewSpool(encrypt, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spool.Encrypted() != encrypt {
+			t.Errorf("Encrypted() = %t, want %t", spool.Encrypted(), encrypt)
+		}
+		filename := writeSpoolFile(t, spool, dir, document)
+
+		onDisk, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypt == bytes.Contains(onDisk, document[:100]) {
+			t.Errorf("With encrypt %t, the file holds the plain document: %t", encrypt, !encrypt)
+		}
+
+		r, err := spool.Open(filename)
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Failed to read the spooled file: %s", err)
+		}
+		if !bytes.Equal(got, document) {
+			t.Errorf("With encrypt %t, read %d bytes that differ from the %d written", encrypt, len(got), len(document))
+		}
+	}
+}
+
+func TestSpoolKeysDiffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := NewSpool(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSpool(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := []byte("%PDF-1.4 document")
+	filename := writeSpoolFile(t, a, dir, document)
+
+	// Another spool's key can't decrypt the file.
+	r, err := b.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, _ := ioutil.ReadAll(r)
+	if bytes.Equal(got, document) {
+		t.Error("Another spool decrypted the file")
+	}
+}
+
+func TestSpoolOpenTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := NewSpool(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shorter than an IV.
+	filename := filepath.Join(dir, "short")
+	if err = ioutil.WriteFile(filename, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := spool.Open(filename); err == nil {
+		r.Close()
+		t.Error("Opened a file without a whole IV")
+	}
+}
+
+func TestSpoolRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	document := bytes.Repeat([]byte("secret "), 10000)
+
+	for _, shred := range []bool{false, true} {
+		spool, err := NewSpool(false, shred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := writeSpoolFile(t, spool, dir, document)
+		// A second link keeps the contents readable after Remove.
+		link := filename + ".link"
+		if err = os.Link(filename, link); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = spool.Remove(filename); err != nil {
+			t.Fatalf("Remove failed: %s", err)
+		}
+		if _, err = os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("With shred %t, the file wasn't removed", shred)
+		}
+
+		got, err := ioutil.ReadFile(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(document) {
+			t.Errorf("With shred %t, the file is %d bytes, want %d", shred, len(got), len(document))
+		}
+		if shredded := bytes.Equal(got, make([]byte, len(document))); shredded != shred {
+			t.Errorf("With shred %t, the file was overwritten with zeros: %t", shred, shredded)
+		}
+	}
+}
+
+func TestSpoolRemoveMissing(t *testing.T) {
+	spool, err := NewSpool(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = spool.Remove(filepath.Join(os.TempDir(), "missing-spool-file")); err == nil {
+		t.Error("Removing a missing file succeeded")
+	}
+}
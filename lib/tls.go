@@ -0,0 +1,94 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Pins may be written with this prefix, like HTTP Public Key Pinning pins.
+const pinPrefix = "sha256/"
+
+// NewTLSConfig creates a TLS config for connections to Google.
+//
+// When caFile is not empty, server certificates must be issued by a CA in
+// that PEM bundle, instead of by a CA trusted by the system.
+//
+// When pins is not empty, a server certificate chain must contain at least
+// one public key whose pin is in pins. A pin is the base64 SHA-256 hash of a
+// DER-encoded SubjectPublicKeyInfo, optionally prefixed with "sha256/".
+//
+// Returns nil when both caFile and pins are empty, meaning defaults.
+func NewTLSConfig(caFile string, pins []string) (*tls.Config, error) {
+	if caFile == "" && len(pins) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TLS CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to find any PEM certificates in TLS CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(pins) > 0 {
+		pinSet := make(map[string]struct{}, len(pins))
+		for _, pin := range pins {
+			pin = strings.TrimPrefix(pin, pinPrefix)
+			if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("TLS pin %s is not a base64 SHA-256 hash", pin)
+			}
+			pinSet[pin] = struct{}{}
+		}
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyPins(pinSet, verifiedChains)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyPins checks that at least one certificate in the verified chains
+// has a pinned public key. Mismatches are logged with the pins that were
+// found, so that pins can be updated after Google rotates keys.
+func verifyPins(pinSet map[string]struct{}, verifiedChains [][]*x509.Certificate) error {
+	var found []string
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			pin := base64.StdEncoding.EncodeToString(hash[:])
+			if _, exists := pinSet[pin]; exists {
+				return nil
+			}
+			found = append(found, fmt.Sprintf("%s (%s)", pinPrefix+pin, cert.Subject.CommonName))
+		}
+	}
+
+	var server string
+	if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+		server = verifiedChains[0][0].Subject.CommonName
+	}
+	glog.Errorf("TLS certificate of %s matches none of the configured pins; found %s", server, strings.Join(found, ", "))
+	return errors.New("TLS certificate chain matches none of the configured pins")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package lib
+
+// Size of sockaddr_un.sun_path, including the terminating NUL, on FreeBSD,
+// OpenBSD and OS X.
+const unixSocketPathMax = 104
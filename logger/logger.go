@@ -0,0 +1,103 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Log formats.
+const (
+	// Text logs with glog only, without fields.
+	FormatText = "text"
+	// JSON also writes one JSON object per line to stderr, with the
+	// fields, for log collectors like ELK and Stackdriver.
+	FormatJSON = "json"
+)
+
+// Fields are structured data about a log line, like gcp_job_id, printer,
+// cups_job_id and phase. Values must be marshalable to JSON.
+type Fields map[string]interface{}
+
+var (
+	mutex  sync.Mutex
+	format string    = FormatText
+	output io.Writer = os.Stderr
+)
+
+// SetFormat sets the log format: FormatText or FormatJSON.
+func SetFormat(f string) error {
+	if f != FormatText && f != FormatJSON {
+		return fmt.Errorf("Log format must be %s or %s, not %s", FormatText, FormatJSON, f)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	format = f
+	return nil
+}
+
+// Infof logs to glog at INFO, and with fields as JSON and to syslog when set.
+func Infof(fields Fields, f string, args ...interface{}) {
+	message := fmt.Sprintf(f, args...)
+	glog.InfoDepth(1, message)
+	write("INFO", fields, message)
+}
+
+// Warningf logs to glog at WARNING, and with fields as JSON and to syslog when set.
+func Warningf(fields Fields, f string, args ...interface{}) {
+	message := fmt.Sprintf(f, args...)
+	glog.WarningDepth(1, message)
+	write("WARNING", fields, message)
+}
+
+// Errorf logs to glog at ERROR, and with fields as JSON and to syslog when set.
+func Errorf(fields Fields, f string, args ...interface{}) {
+	message := fmt.Sprintf(f, args...)
+	glog.ErrorDepth(1, message)
+	write("ERROR", fields, message)
+}
+
+// write writes a log line to the outputs besides glog.
+func write(severity string, fields Fields, message string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if format == FormatJSON {
+		writeJSON(severity, fields, message)
+	}
+	if syslog != nil {
+		syslog.write(severity, fields, message)
+	}
+}
+
+// writeJSON writes a log line as JSON to output.
+func writeJSON(severity string, fields Fields, message string) {
+
+	line := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		line[key] = value
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["severity"] = severity
+	line["message"] = message
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		glog.Warningf("Failed to log as JSON: %s", err)
+		return
+	}
+	output.Write(append(b, '\n'))
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package logger
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	rotateInterval = time.Minute
+	gzipSuffix     = ".gz"
+)
+
+var severities = []string{"INFO", "WARNING", "ERROR", "FATAL"}
+
+// StartRotation caps glog's log files, for hosts without logrotate.
+//
+// glog starts a new file when one reaches maxMegabytes. Every minute, files
+// that glog no longer writes are gzipped, when compress is set, and all but
+// the newest maxFiles files of each severity are deleted; 0 keeps all.
+func StartRotation(maxMegabytes, maxFiles uint, compress bool) {
+	if maxMegabytes > 0 {
+		glog.MaxSize = uint64(maxMegabytes) * 1024 * 1024
+	}
+
+	go func() {
+		for {
+			rotate(logDir(), filepath.Base(os.Args[0]), maxFiles, compress)
+			time.Sleep(rotateInterval)
+		}
+	}()
+}
+
+// logDir returns the directory that glog writes log files to.
+func logDir() string {
+	if f := flag.Lookup("log_dir"); f != nil && f.Value.String() != "" {
+		return f.Value.String()
+	}
+	return os.TempDir()
+}
+
+// rotate compresses and deletes the log files of program in dir.
+func rotate(dir, program string, maxFiles uint, compress bool) {
+	for _, severity := range severities {
+		// Names end with a timestamp and PID, so they sort oldest first.
+		filenames, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%s.*.log.%s.*", program, severity)))
+		if err != nil {
+			glog.Warningf("Failed to list log files: %s", err)
+			continue
+		}
+		sort.Strings(filenames)
+
+		current, _ := os.Readlink(filepath.Join(dir, fmt.Sprintf("%s.%s", program, severity)))
+		if current != "" && !filepath.IsAbs(current) {
+			current = filepath.Join(dir, current)
+		}
+
+		if maxFiles > 0 && uint(len(filenames)) > maxFiles {
+			for _, filename := range filenames[:uint(len(filenames))-maxFiles] {
+				if filename == current {
+					continue
+				}
+				if err := os.Remove(filename); err != nil {
+					glog.Warningf("Failed to delete old log file: %s", err)
+				}
+			}
+			filenames = filenames[uint(len(filenames))-maxFiles:]
+		}
+
+		if !compress {
+			continue
+		}
+		for _, filename := range filenames {
+			if filename == current || strings.HasSuffix(filename, gzipSuffix) {
+				continue
+			}
+			if err := gzipFile(filename); err != nil {
+				glog.Warningf("Failed to compress log file: %s", err)
+			}
+		}
+	}
+}
+
+// gzipFile replaces filename with filename.gz.
+func gzipFile(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filename + gzipSuffix)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+	if _, err = io.Copy(w, src); err == nil {
+		err = w.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename + gzipSuffix)
+		return err
+	}
+
+	return os.Remove(filename)
+}
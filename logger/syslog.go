@@ -0,0 +1,267 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package logger
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	syslogWriteTimeout = 5 * time.Second
+	// How long to wait before dialing the syslog server again, after it
+	// failed.
+	syslogRetryInterval = 10 * time.Second
+	// How many log lines to queue while the syslog server is slow or
+	// unreachable; more are dropped.
+	syslogQueueSize = 1000
+	// SD-ID of the structured data that carries fields; 32473 is the
+	// enterprise number reserved for documentation by RFC 5612.
+	syslogSDID = "fields@32473"
+)
+
+// syslogFacilities maps facility names to RFC 5424 facility codes.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslogSeverities maps glog severities to RFC 5424 severity codes.
+var syslogSeverities = map[string]int{
+	"INFO":    6,
+	"WARNING": 4,
+	"ERROR":   3,
+}
+
+// syslogWriter sends RFC 5424 messages to a syslog server. Messages are
+// queued, and sent by send, so that logging doesn't wait for the server.
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	appName  string
+
+	queue chan string
+	// Messages dropped because the queue was full, since the last one that
+	// wasn't. Guarded by the logger mutex.
+	dropped uint
+
+	// Used by send only, after SetSyslog.
+	conn net.Conn
+}
+
+// syslog is nil until SetSyslog is called.
+var syslog *syslogWriter
+
+// SyslogFacilityValid returns true when facility is a syslog facility name,
+// like "daemon" or "local0".
+func SyslogFacilityValid(facility string) bool {
+	_, exists := syslogFacilities[facility]
+	return exists
+}
+
+// ParseSyslogAddress splits a syslog address, like "udp://loghost:514",
+// "tcp://loghost:601" or "unix:///dev/log", into network and address.
+func ParseSyslogAddress(address string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to parse syslog address %s: %s", address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("Syslog address %s has no host", address)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("Syslog address %s has no path", address)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("Syslog address %s must start with udp://, tcp:// or unix://", address)
+	}
+}
+
+// SetSyslog sends log lines, with their fields as structured data, to the
+// syslog server at address, with facility.
+func SetSyslog(address, facility string) error {
+	network, addr, err := ParseSyslogAddress(address)
+	if err != nil {
+		return err
+	}
+	code, exists := syslogFacilities[facility]
+	if !exists {
+		return fmt.Errorf("Unknown syslog facility %s", facility)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	w := &syslogWriter{
+		network:  network,
+		address:  addr,
+		facility: code,
+		hostname: hostname,
+		appName:  filepath.Base(os.Args[0]),
+		queue:    make(chan string, syslogQueueSize),
+	}
+	// Dial once here, to report a wrong address at startup.
+	if err = w.connect(); err != nil {
+		return err
+	}
+	go w.send()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	syslog = w
+	return nil
+}
+
+// connect dials the syslog server. The unix socket of a local syslog daemon,
+// like /dev/log, is usually a datagram socket, so that is tried first.
+func (w *syslogWriter) connect() error {
+	var conn net.Conn
+	var err error
+	if w.network == "unix" {
+		conn, err = net.DialTimeout("unixgram", w.address, syslogWriteTimeout)
+		if err != nil {
+			conn, err = net.DialTimeout("unix", w.address, syslogWriteTimeout)
+		}
+	} else {
+		conn, err = net.DialTimeout(w.network, w.address, syslogWriteTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to connect to syslog at %s: %s", w.address, err)
+	}
+	w.conn = conn
+	return nil
+}
+
+// write queues one log line for send, or drops it when the queue is full.
+// Called with the logger mutex held.
+func (w *syslogWriter) write(severity string, fields Fields, message string) {
+	m := w.format(severity, fields, message)
+	if w.network == "tcp" {
+		// RFC 6587 octet counting.
+		m = fmt.Sprintf("%d %s", len(m), m)
+	}
+
+	select {
+	case w.queue <- m:
+		if w.dropped > 0 {
+			glog.Warningf("Dropped %d log lines while syslog at %s was slow or unreachable", w.dropped, w.address)
+			w.dropped = 0
+		}
+	default:
+		w.dropped++
+	}
+}
+
+// send writes the queued log lines to the syslog server, in order. A line
+// that can't be written is retried every syslogRetryInterval, while the
+// queue fills up.
+func (w *syslogWriter) send() {
+	failing := false
+	for m := range w.queue {
+		for {
+			err := w.sendMessage(m)
+			if err == nil {
+				break
+			}
+			if !failing {
+				glog.Warningf("%s; retrying every %s", err, syslogRetryInterval)
+				failing = true
+			}
+			time.Sleep(syslogRetryInterval)
+		}
+		if failing {
+			glog.Infof("Writing to syslog at %s again", w.address)
+			failing = false
+		}
+	}
+}
+
+// sendMessage writes one log line, reconnecting once if the connection
+// broke.
+func (w *syslogWriter) sendMessage(m string) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err = w.connect(); err != nil {
+				return err
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err = w.conn.Write([]byte(m)); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return fmt.Errorf("Failed to write to syslog at %s: %s", w.address, err)
+}
+
+// format formats a log line as an RFC 5424 message.
+func (w *syslogWriter) format(severity string, fields Fields, message string) string {
+	priority := w.facility*8 + syslogSeverities[severity]
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s %s",
+		priority, timestamp, w.hostname, w.appName, os.Getpid(), structuredData(fields), message)
+}
+
+// structuredData formats fields as an RFC 5424 SD-ELEMENT, or "-" when there
+// are none.
+func structuredData(fields Fields) string {
+	if len(fields) == 0 {
+		return "-"
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// PARAM-VALUE must escape '"', '\' and ']'.
+	escaper := strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		params = append(params, fmt.Sprintf(`%s="%s"`, key, escaper.Replace(fmt.Sprint(fields[key]))))
+	}
+	return fmt.Sprintf("[%s %s]", syslogSDID, strings.Join(params, " "))
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/metrics"
+
+	"github.com/golang/glog"
+)
+
+// PrinterStatus describes a printer registered with GCP, for
+// administration tools.
+type PrinterStatus struct {
+	Name  string `json:"name"`
+	GCPID string `json:"gcp_id"`
+	// Printer state (IDLE, PROCESSING or STOPPED), as last reported to GCP.
+	State string `json:"state"`
+	// Whether jobs are left queued in GCP; see PausePrinter.
+	Paused bool `json:"paused"`
+	// Faults that the printer reports over SNMP, like "door open".
+	Faults []string `json:"faults,omitempty"`
+}
+
+// SyncStatus describes the outcome of the last printer sync.
+type SyncStatus struct {
+	// When the last sync finished; zero if none did yet.
+	LastSync time.Time `json:"last_sync"`
+	// When the last successful sync finished; zero if none did yet.
+	LastSuccess time.Time `json:"last_success"`
+	// Why the last sync failed; empty if it succeeded.
+	LastError string `json:"last_error,omitempty"`
+	// Whether the GCP printer list came from the cache, because GCP has
+	// been unreachable since startup.
+	Degraded bool `json:"degraded"`
+}
+
+// How many finished jobs RecentJobs remembers.
+const recentJobsQuantity = 50
+
+// JobStatus describes a job that has been received, and may have finished
+// printing.
+type JobStatus struct {
+	GCPJobID     string `json:"gcp_job_id"`
+	GCPPrinterID string `json:"gcp_printer_id"`
+	// CUPS printer name; empty until the job's printer is found.
+	PrinterName string `json:"printer_name,omitempty"`
+	Title       string `json:"title"`
+	OwnerID     string `json:"owner_id"`
+	// CUPS job ID; zero until the job is sent to CUPS.
+	CUPSJobID uint32 `json:"cups_job_id,omitempty"`
+	// GCP job state: QUEUED, IN_PROGRESS, DONE, ABORTED or STOPPED.
+	State string `json:"state"`
+	// Processing phase: receive, download, submit or follow.
+	Phase string `json:"phase"`
+	// Pages printed, as CUPS reports them.
+	Pages int32 `json:"pages,omitempty"`
+	// Why the job failed, when it failed before or while following CUPS.
+	Error    string    `json:"error,omitempty"`
+	Received time.Time `json:"received"`
+	// When the job finished; zero while in flight.
+	Finished time.Time `json:"finished"`
+	// Whether a local client submitted the job while GCP was unreachable.
+	Offline bool `json:"offline,omitempty"`
+	// Seconds spent in each phase that the job went through: download,
+	// queue (waiting for room in the printer's CUPS job queue), submit and
+	// print. Streamed jobs download while they submit.
+	PhaseSeconds map[string]float64 `json:"phase_seconds,omitempty"`
+
+	// CUPS user that the job is submitted as.
+	cupsUser string
+	// Whether CancelJob was called.
+	canceled bool
+	// Ticket of the job, and its downloaded document, kept while the job is
+	// in flight when failed jobs are quarantined.
+	ticket       *cdd.CloudJobTicket
+	documentFile string
+}
+
+// Printers returns the status of the printers that this manager has
+// registered with GCP, sorted by name.
+func (pm *PrinterManager) Printers() []PrinterStatus {
+	printers := pm.gcpPrintersByGCPID.GetAll()
+	statuses := make([]PrinterStatus, len(printers))
+	for i := range printers {
+		statuses[i] = PrinterStatus{
+			Name:   printers[i].Name,
+			GCPID:  printers[i].GCPID,
+			Paused: pm.printerPaused(printers[i].Name),
+			Faults: printers[i].SNMPFaults,
+		}
+		if printers[i].State != nil {
+			statuses[i].State = string(printers[i].State.State)
+		}
+	}
+	sort.Sort(printerStatusesByName(statuses))
+	return statuses
+}
+
+type printerStatusesByName []PrinterStatus
+
+func (s printerStatusesByName) Len() int           { return len(s) }
+func (s printerStatusesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s printerStatusesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// HasPrinter answers the question "does this manager handle the printer
+// named printerName?"
+func (pm *PrinterManager) HasPrinter(printerName string) bool {
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		if printer.Name == printerName {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncStatus returns the outcome of the last printer sync.
+func (pm *PrinterManager) SyncStatus() SyncStatus {
+	pm.syncStatusMutex.Lock()
+	defer pm.syncStatusMutex.Unlock()
+
+	return pm.syncStatus
+}
+
+// recordSync records the outcome of a printer sync for SyncStatus. Called
+// with syncMutex held.
+func (pm *PrinterManager) recordSync(err error) {
+	pm.syncStatusMutex.Lock()
+	defer pm.syncStatusMutex.Unlock()
+
+	pm.syncStatus.LastSync = time.Now()
+	pm.syncStatus.LastError = ""
+	metrics.Count("sync.runs", 1, nil)
+	if err != nil {
+		pm.syncStatus.LastError = err.Error()
+		metrics.Count("sync.errors", 1, nil)
+	} else if !pm.degraded {
+		pm.syncStatus.LastSuccess = pm.syncStatus.LastSync
+	}
+	pm.syncStatus.Degraded = pm.degraded
+}
+
+// SyncPrinters synchronizes printers now, rather than at the next printer
+// poll interval.
+func (pm *PrinterManager) SyncPrinters() error {
+	return pm.syncPrinters()
+}
+
+// SyncPrintersSoon asks the printer poll loop to synchronize printers now,
+// without waiting for it. Requests made while one is pending are merged.
+func (pm *PrinterManager) SyncPrintersSoon() {
+	select {
+	case pm.printerSyncRequests <- struct{}{}:
+	default:
+	}
+}
+
+// InFlightJobs returns the jobs that have been received, and are not
+// finished printing yet, oldest first.
+func (pm *PrinterManager) InFlightJobs() []JobStatus {
+	pm.jobsInFlightMutex.Lock()
+	defer pm.jobsInFlightMutex.Unlock()
+
+	jobs := make([]JobStatus, 0, len(pm.jobsInFlight))
+	for _, status := range pm.jobsInFlight {
+		jobs = append(jobs, *status)
+	}
+	sort.Sort(jobStatusesByReceived(jobs))
+	return jobs
+}
+
+// RecentJobs returns the jobs that finished most recently, newest first.
+func (pm *PrinterManager) RecentJobs() []JobStatus {
+	pm.jobsInFlightMutex.Lock()
+	defer pm.jobsInFlightMutex.Unlock()
+
+	jobs := make([]JobStatus, len(pm.recentJobs))
+	for i := range pm.recentJobs {
+		jobs[len(jobs)-1-i] = pm.recentJobs[i]
+	}
+	return jobs
+}
+
+// setJobState records the state of an in flight job, and why it failed.
+func (pm *PrinterManager) setJobState(gcpJobID, state, message string) {
+	pm.updateInFlightJob(gcpJobID, func(status *JobStatus) {
+		status.State = state
+		if message != "" {
+			status.Error = message
+		}
+	})
+}
+
+type jobStatusesByReceived []JobStatus
+
+func (s jobStatusesByReceived) Len() int           { return len(s) }
+func (s jobStatusesByReceived) Less(i, j int) bool { return s[i].Received.Before(s[j].Received) }
+func (s jobStatusesByReceived) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// CancelJob cancels an in flight job. A job that is in CUPS already is
+// canceled in CUPS; GCP is told when CUPS reports the job canceled. A job
+// that isn't in CUPS yet is canceled as soon as it is.
+//
+// Returns false when the job isn't in flight.
+func (pm *PrinterManager) CancelJob(gcpJobID string) (bool, error) {
+	var printerName, cupsUser string
+	var cupsJobID uint32
+	var exists bool
+	pm.updateInFlightJob(gcpJobID, func(status *JobStatus) {
+		exists = true
+		status.canceled = true
+		printerName, cupsUser, cupsJobID = status.PrinterName, status.cupsUser, status.CUPSJobID
+	})
+	if !exists {
+		return false, nil
+	}
+	if cupsJobID == 0 {
+		glog.Infof("Job %s will be canceled when it reaches CUPS", gcpJobID)
+		return true, nil
+	}
+
+	if err := pm.backend.CancelJob(printerName, cupsUser, cupsJobID); err != nil {
+		return true, fmt.Errorf("Failed to cancel job %s: %s", gcpJobID, err)
+	}
+	glog.Infof("Canceled job %s, CUPS job %d", gcpJobID, cupsJobID)
+	return true, nil
+}
+
+// PausePrinter stops fetching jobs for a printer; new jobs stay queued in
+// GCP until ResumePrinter is called. Jobs in flight are not affected.
+// Pausing lasts until the connector restarts.
+//
+// Returns false when this manager doesn't handle the printer.
+func (pm *PrinterManager) PausePrinter(printerName string) bool {
+	if !pm.HasPrinter(printerName) {
+		return false
+	}
+
+	pm.pausedPrintersMutex.Lock()
+	pm.pausedPrinters[printerName] = struct{}{}
+	pm.pausedPrintersMutex.Unlock()
+
+	glog.Infof("Paused printer %s", printerName)
+	return true
+}
+
+// ResumePrinter fetches jobs for a paused printer again, starting with the
+// jobs queued while it was paused.
+//
+// Returns false when this manager doesn't handle the printer.
+func (pm *PrinterManager) ResumePrinter(printerName string) bool {
+	if !pm.HasPrinter(printerName) {
+		return false
+	}
+
+	pm.pausedPrintersMutex.Lock()
+	delete(pm.pausedPrinters, printerName)
+	pm.pausedPrintersMutex.Unlock()
+
+	glog.Infof("Resumed printer %s", printerName)
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		if printer.Name == printerName {
+			go pm.handlePrinterNewJobs(printer.GCPID)
+		}
+	}
+	return true
+}
+
+func (pm *PrinterManager) printerPaused(printerName string) bool {
+	pm.pausedPrintersMutex.Lock()
+	defer pm.pausedPrintersMutex.Unlock()
+
+	_, paused := pm.pausedPrinters[printerName]
+	return paused
+}
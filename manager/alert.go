@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cups-connector/alert"
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+)
+
+// The job error rate of a printer is computed over its last alertJobWindow
+// jobs.
+const alertJobWindow = 10
+
+// alertPrinterChanges sends alerts for the printers that stopped, or that
+// reported SNMP faults, in currentPrinters and didn't in oldPrinters.
+func (pm *PrinterManager) alertPrinterChanges(oldPrinters, currentPrinters []lib.Printer) {
+	old := make(map[string]lib.Printer, len(oldPrinters))
+	for _, printer := range oldPrinters {
+		old[printer.GCPID] = printer
+	}
+
+	for _, printer := range currentPrinters {
+		oldPrinter, exists := old[printer.GCPID]
+		if !exists {
+			// New printers are announced by the logs; their state is news to no one.
+			continue
+		}
+		if printerStopped(printer) && !printerStopped(oldPrinter) {
+			alert.Send(alert.Alert{
+				Kind:    alert.PrinterStopped,
+				Printer: printer.Name,
+				GCPID:   printer.GCPID,
+				Message: fmt.Sprintf("Printer %s stopped", printer.Name),
+			})
+		}
+		if len(printer.SNMPFaults) > 0 && len(oldPrinter.SNMPFaults) == 0 {
+			alert.Send(alert.Alert{
+				Kind:    alert.PrinterFault,
+				Printer: printer.Name,
+				GCPID:   printer.GCPID,
+				Message: fmt.Sprintf("Printer %s reports %s", printer.Name, strings.Join(printer.SNMPFaults, "; ")),
+			})
+		}
+	}
+}
+
+func printerStopped(printer lib.Printer) bool {
+	return printer.State != nil && printer.State.State == cdd.CloudDeviceStateStopped
+}
+
+// alertJobErrorRate records whether a job of a printer failed, and sends an
+// alert when the share of failed jobs among the printer's last
+// alertJobWindow jobs reaches the configured percentage. The alert is sent
+// again only after the rate falls below the percentage. Called with
+// jobStatsMutex held.
+func (pm *PrinterManager) alertJobErrorRate(gcpPrinterID string, stats *printerJobStats, failed bool) {
+	stats.recentErrors = append(stats.recentErrors, failed)
+	if len(stats.recentErrors) > alertJobWindow {
+		stats.recentErrors = stats.recentErrors[len(stats.recentErrors)-alertJobWindow:]
+	}
+
+	percent := pm.settings().AlertJobErrorPercent
+	if percent == 0 || len(stats.recentErrors) < alertJobWindow {
+		return
+	}
+
+	var failures uint
+	for _, e := range stats.recentErrors {
+		if e {
+			failures++
+		}
+	}
+	if failures*100 < percent*alertJobWindow {
+		stats.alerted = false
+		return
+	}
+	if stats.alerted {
+		return
+	}
+	stats.alerted = true
+
+	name := gcpPrinterID
+	if printer, exists := pm.gcpPrintersByGCPID.Get(gcpPrinterID); exists {
+		name = printer.Name
+	}
+	alert.Send(alert.Alert{
+		Kind:    alert.JobErrorRate,
+		Printer: name,
+		GCPID:   gcpPrinterID,
+		Message: fmt.Sprintf("%d of the last %d jobs of printer %s failed", failures, alertJobWindow, name),
+	})
+}
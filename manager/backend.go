@@ -0,0 +1,55 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"io"
+	"os"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+)
+
+// PrintBackend is the native print system that printers and jobs live in.
+// *cups.CUPS is the usual one; others, like the Windows spooler, direct
+// IPP, or test fakes, can take its place.
+//
+// Methods that can't reach the print system return a *lib.UnreachableError,
+// which the PrinterManager treats as temporary.
+type PrintBackend interface {
+	// GetPrinters returns the printers, with their capabilities in
+	// Printer.Description.
+	GetPrinters() ([]lib.Printer, error)
+	// GetPrinterStates returns the state of each printer, by name.
+	GetPrinterStates() (map[string]*cdd.PrinterStateSection, error)
+	// RemoveCachedPPD forgets the capabilities of a printer, so that the
+	// next GetPrinters gets them again.
+	RemoveCachedPPD(printerName string)
+
+	// CreateTempFile creates a file that Print can read. The caller is
+	// responsible for deleting the file.
+	CreateTempFile() (*os.File, error)
+	// Print prints a file, and returns the backend's job ID.
+	Print(printerName, filename, title, user, format string, ticket cdd.CloudJobTicket) (uint32, error)
+	// PrintStream prints what write writes, and returns the backend's job
+	// ID. Returns a *lib.StreamUnsupportedError, without calling write,
+	// when the backend can't receive a stream.
+	PrintStream(printerName, title, user, format string, ticket cdd.CloudJobTicket, write func(io.Writer) error) (uint32, error)
+	// GetJobState returns the state of a job that Print or PrintStream
+	// started.
+	GetJobState(jobID uint32) (cdd.PrintJobStateDiff, error)
+	// CancelJob cancels a job that Print or PrintStream started.
+	CancelJob(printerName, user string, jobID uint32) error
+}
+
+// ConnectionCounter is implemented by backends that keep a pool of
+// connections, like *cups.CUPS.
+type ConnectionCounter interface {
+	ConnQtyOpen() uint
+	ConnQtyMax() uint
+}
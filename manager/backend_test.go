@@ -0,0 +1,288 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/gcp/gcptest"
+	"github.com/google/cups-connector/lib"
+)
+
+// fakeBackend is a PrintBackend that keeps printers and jobs in memory.
+type fakeBackend struct {
+	printers []lib.Printer
+	states   map[string]*cdd.PrinterStateSection
+	// When noStream is true, PrintStream returns a
+	// *lib.StreamUnsupportedError.
+	noStream bool
+	// When err isn't nil, every method returns it.
+	err error
+
+	mu        sync.Mutex
+	tempFiles []string
+	jobs      []fakeJob
+	jobStates map[uint32]cdd.PrintJobStateDiff
+	canceled  []uint32
+}
+
+// fakeJob is a job that fakeBackend printed.
+type fakeJob struct {
+	printerName, title, user, contentType string
+	document                              []byte
+	streamed                              bool
+}
+
+var _ PrintBackend = (*fakeBackend)(nil)
+
+func (b *fakeBackend) GetPrinters() ([]lib.Printer, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	printers := make([]lib.Printer, len(b.printers))
+	copy(printers, b.printers)
+	return printers, nil
+}
+
+func (b *fakeBackend) GetPrinterStates() (map[string]*cdd.PrinterStateSection, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.states, nil
+}
+
+func (b *fakeBackend) RemoveCachedPPD(printerName string) {}
+
+func (b *fakeBackend) CreateTempFile() (*os.File, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	f, err := ioutil.TempFile("", "fake-backend-")
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.tempFiles = append(b.tempFiles, f.Name())
+	b.mu.Unlock()
+	return f, nil
+}
+
+func (b *fakeBackend) Print(printerName, filename, title, user, format string, ticket cdd.CloudJobTicket) (uint32, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	document, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return b.addJob(fakeJob{printerName, title, user, format, document, false}), nil
+}
+
+func (b *fakeBackend) PrintStream(printerName, title, user, format string, ticket cdd.CloudJobTicket, write func(io.Writer) error) (uint32, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.noStream {
+		return 0, &lib.StreamUnsupportedError{Message: "streams are unsupported"}
+	}
+	var document bytes.Buffer
+	if err := write(&document); err != nil {
+		return 0, err
+	}
+	return b.addJob(fakeJob{printerName, title, user, format, document.Bytes(), true}), nil
+}
+
+func (b *fakeBackend) addJob(job fakeJob) uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobs = append(b.jobs, job)
+	return uint32(len(b.jobs))
+}
+
+func (b *fakeBackend) GetJobState(jobID uint32) (cdd.PrintJobStateDiff, error) {
+	if b.err != nil {
+		return cdd.PrintJobStateDiff{}, b.err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.jobStates[jobID], nil
+}
+
+func (b *fakeBackend) CancelJob(printerName, user string, jobID uint32) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.canceled = append(b.canceled, jobID)
+	return nil
+}
+
+// spoolFile writes document to a new file of spool, and returns its name.
+func spoolFile(t *testing.T, spool *lib.Spool, document string) string {
+	f, err := ioutil.TempFile("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := spool.Writer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(w, document); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestPrintFile(t *testing.T) {
+	const document = "%PDF-1.4 document"
+	for _, test := range []struct {
+		name          string
+		encrypt       bool
+		noStream      bool
+		wantStreamed  bool
+		wantTempFiles int
+	}{
+		{"plain", false, false, false, 0},
+		{"encrypted", true, false, true, 0},
+		{"encrypted, stream unsupported", true, true, false, 1},
+	} {
+		spool, err := lib.NewSpool(test.encrypt, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := spoolFile(t, spool, document)
+		defer os.Remove(filename)
+
+		backend := &fakeBackend{noStream: test.noStream}
+		pm := &PrinterManager{backend: backend, spool: spool}
+		jobID, err := pm.printFile("printer1", filename, "title", "user", lib.ContentTypePDF, cdd.CloudJobTicket{})
+		if err != nil {
+			t.Errorf("%s: printFile failed: %s", test.name, err)
+			continue
+		}
+		if len(backend.jobs) != 1 || jobID != 1 {
+			t.Errorf("%s: printed %d jobs, returned job %d; want job 1", test.name, len(backend.jobs), jobID)
+			continue
+		}
+		job := backend.jobs[0]
+		if string(job.document) != document || job.streamed != test.wantStreamed {
+			t.Errorf("%s: printed %q, streamed %t; want %q, streamed %t", test.name, job.document, job.streamed, document, test.wantStreamed)
+		}
+		if job.printerName != "printer1" || job.user != "user" || job.contentType != lib.ContentTypePDF {
+			t.Errorf("%s: printed job %+v", test.name, job)
+		}
+
+		// The decrypted copy is removed once the backend has it.
+		if len(backend.tempFiles) != test.wantTempFiles {
+			t.Errorf("%s: created %d temporary files, want %d", test.name, len(backend.tempFiles), test.wantTempFiles)
+		}
+		for _, name := range backend.tempFiles {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("%s: temporary file %s wasn't removed", test.name, name)
+				os.Remove(name)
+			}
+		}
+	}
+}
+
+func TestPrintFileUnreachable(t *testing.T) {
+	spool, err := lib.NewSpool(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := spoolFile(t, spool, "document")
+	defer os.Remove(filename)
+
+	backend := &fakeBackend{err: &lib.UnreachableError{Message: "backend unreachable"}}
+	pm := &PrinterManager{backend: backend, spool: spool}
+	_, err = pm.printFile("printer1", filename, "title", "user", lib.ContentTypePDF, cdd.CloudJobTicket{})
+	if _, ok := err.(*lib.UnreachableError); !ok {
+		t.Errorf("printFile returned %v, want an *lib.UnreachableError", err)
+	}
+}
+
+func TestStreamJob(t *testing.T) {
+	s := gcptest.NewServer()
+	defer s.Close()
+	pm := newTestPrinterManager(t, s, Settings{}, "printer1")
+	backend := &fakeBackend{}
+	pm.backend = backend
+	pm.downloadSemaphore = lib.NewSemaphore(1)
+	printer := lib.Printer{Name: "printer1", CUPSJobSemaphore: lib.NewSemaphore(1)}
+
+	const document = "%PDF-1.4 document"
+	jobID := s.AddJob(pm.gcpPrintersByGCPID.GetAll()[0].GCPID, "title", "user@example.com", cdd.CloudJobTicket{}, []byte(document))
+	job := &lib.Job{GCPJobID: jobID, FileURL: s.BaseURL() + "download/" + jobID}
+	if _, err := pm.streamJob(job, printer, cdd.CloudJobTicket{}, "title", "user"); err != nil {
+		t.Fatalf("streamJob failed: %s", err)
+	}
+	if len(backend.jobs) != 1 || string(backend.jobs[0].document) != document || !backend.jobs[0].streamed {
+		t.Errorf("Printed %+v, want %q streamed", backend.jobs, document)
+	}
+
+	// A document that can't be downloaded is a download failure, not a
+	// print failure.
+	job = &lib.Job{GCPJobID: "missing", FileURL: s.BaseURL() + "download/missing"}
+	_, err := pm.streamJob(job, printer, cdd.CloudJobTicket{}, "title", "user")
+	if _, ok := err.(*downloadError); !ok {
+		t.Errorf("streamJob of a missing document returned %v, want a *downloadError", err)
+	}
+}
+
+func TestStreamJobStreamUnsupported(t *testing.T) {
+	const document = "%PDF-1.4 document"
+	var downloads int32
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		io.WriteString(w, document)
+	}))
+	defer files.Close()
+
+	s := gcptest.NewServer()
+	defer s.Close()
+	pm := newTestPrinterManager(t, s, Settings{}, "printer1")
+	backend := &fakeBackend{noStream: true}
+	pm.backend = backend
+	pm.downloadSemaphore = lib.NewSemaphore(1)
+	spool, err := lib.NewSpool(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.spool = spool
+	printer := lib.Printer{Name: "printer1", CUPSJobSemaphore: lib.NewSemaphore(1)}
+
+	// The document is spooled from the stream, not downloaded again.
+	job := &lib.Job{GCPJobID: "job1", FileURL: files.URL + "/job1"}
+	if _, err := pm.streamJob(job, printer, cdd.CloudJobTicket{}, "title", "user"); err != nil {
+		t.Fatalf("streamJob failed: %s", err)
+	}
+	if len(backend.jobs) != 1 || string(backend.jobs[0].document) != document || backend.jobs[0].streamed {
+		t.Errorf("Printed %+v, want %q from a file", backend.jobs, document)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Downloaded the document %d times, want once", n)
+	}
+	for _, name := range backend.tempFiles {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Temporary file %s wasn't removed", name)
+			os.Remove(name)
+		}
+	}
+}
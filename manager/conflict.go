@@ -0,0 +1,71 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// Another connector instance that updated a printer this recently is
+// considered running. Printers are updated when their state changes, so a
+// running instance with idle printers can look stopped.
+const proxyConflictWindow = time.Hour
+
+// checkProxyConflict looks for GCP printers that another connector
+// instance, with the same proxy name, registered or updated last. Those
+// connectors delete each other's printers, because they don't have them in
+// CUPS. Returns an error when refuse is true and the other instance seems
+// to be running; logs otherwise.
+func checkProxyConflict(gcpPrinters []lib.Printer, proxyName, instance string, refuse bool) error {
+	type other struct {
+		printers   int
+		lastUpdate time.Time
+	}
+	others := make(map[string]*other)
+	for _, printer := range gcpPrinters {
+		i, exists := printer.Tags[lib.InstanceTagKey]
+		if !exists || i == instance {
+			// Printers registered before instances were tagged have no tag.
+			continue
+		}
+		o, exists := others[i]
+		if !exists {
+			o = &other{}
+			others[i] = o
+		}
+		o.printers++
+		if printer.GCPUpdateTime.After(o.lastUpdate) {
+			o.lastUpdate = printer.GCPUpdateTime
+		}
+	}
+
+	for i, o := range others {
+		if time.Since(o.lastUpdate) > proxyConflictWindow {
+			glog.Warningf("%d printers of proxy %s were last updated by connector %s, %s ago; taking them over. "+
+				"If that connector still runs, stop it, or give one of them another proxy_name, because connectors with the same proxy name delete each other's printers.",
+				o.printers, proxyName, i, time.Since(o.lastUpdate)/time.Second*time.Second)
+			continue
+		}
+
+		message := fmt.Sprintf("Connector %s, with the same proxy name %s, updated %d of its printers %s ago, and seems to be running. "+
+			"Connectors with the same proxy name delete each other's printers; give each connector its own proxy_name, "+
+			"or stop the other one, and wait %s, before starting this one.",
+			i, proxyName, o.printers, time.Since(o.lastUpdate)/time.Second*time.Second, proxyConflictWindow)
+		if refuse {
+			return fmt.Errorf("Refusing to start: %s", message)
+		}
+		glog.Error(message)
+	}
+
+	return nil
+}
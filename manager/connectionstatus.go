@@ -0,0 +1,75 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"github.com/google/cups-connector/logger"
+)
+
+// reconcileConnectionStatus asks GCP how it sees this connector's printers.
+// Printers that GCP considers OFFLINE or DORMANT, while the connector
+// serves them, report their state again, which GCP takes as a sign of
+// life. Printers with jobs queued in GCP, and none being processed, have
+// their jobs fetched, in case a notification was lost.
+func (pm *PrinterManager) reconcileConnectionStatus() {
+	if pm.credentialsRevoked() {
+		return
+	}
+
+	summaries, err := pm.gcp.ListSummaries()
+	if err != nil {
+		logger.Warningf(logger.Fields{"phase": "sync"}, "Failed to get connection status of printers: %s", err)
+		pm.setGCPReachable(false)
+		return
+	}
+	pm.setGCPReachable(true)
+
+	for _, summary := range summaries {
+		printer, exists := pm.gcpPrintersByGCPID.Get(summary.GCPID)
+		if !exists {
+			// Not synchronized yet, or deleted since.
+			continue
+		}
+
+		if summary.ConnectionStatus == "OFFLINE" || summary.ConnectionStatus == "DORMANT" {
+			logger.Infof(printerFields(&printer, "sync"), "GCP considers printer %s %s; reporting its state again", printer.Name, summary.ConnectionStatus)
+			if printer.State != nil {
+				if err := pm.gcp.UpdateState(printer.GCPID, printer.State); err != nil {
+					logger.Errorf(printerFields(&printer, "sync"), "Failed to report the state of printer %s to GCP: %s", printer.Name, err)
+				}
+			}
+		}
+
+		if summary.QueuedJobsCount > 0 && !pm.printerBusy(printer.GCPID) &&
+			!pm.printerPaused(printer.Name) && !pm.printerFaulted(printer) {
+			logger.Infof(printerFields(&printer, "sync"), "Printer %s has %d jobs queued in GCP, and none in progress; fetching them", printer.Name, summary.QueuedJobsCount)
+			go pm.handlePrinterNewJobs(printer.GCPID)
+		}
+	}
+}
+
+// printerBusy answers the question "is the connector processing any job of
+// the printer, or about to?"
+func (pm *PrinterManager) printerBusy(gcpID string) bool {
+	pm.dispatchMutex.Lock()
+	dispatching := len(pm.dispatchQueues[gcpID]) > 0 || pm.dispatchingByPrinter[gcpID] > 0
+	pm.dispatchMutex.Unlock()
+	if dispatching {
+		return true
+	}
+
+	pm.jobsInFlightMutex.Lock()
+	defer pm.jobsInFlightMutex.Unlock()
+
+	for _, status := range pm.jobsInFlight {
+		if status.GCPPrinterID == gcpID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"errors"
+
+	"github.com/google/cups-connector/logger"
+
+	"github.com/golang/glog"
+)
+
+// errCredentialsRevoked is returned by syncs while GCP rejects the
+// connector's credentials. It isn't logged; credentialsRevoked logged why
+// once already.
+var errCredentialsRevoked = errors.New("GCP rejected the connector's credentials; re-authorize the connector")
+
+// credentialsRevoked answers the question "does GCP reject the connector's
+// credentials, because the OAuth grant was revoked?" No jobs are fetched
+// then.
+//
+// When the credentials are first found rejected, one error says how to
+// re-authorize the connector, and the printers are announced offline
+// locally. When they work again, the printers are announced online, and the
+// jobs that were queued meanwhile are fetched.
+func (pm *PrinterManager) credentialsRevoked() bool {
+	err := pm.gcp.AuthError()
+
+	pm.credentialsMutex.Lock()
+	changed := (err != nil) != pm.revoked
+	pm.revoked = err != nil
+	pm.credentialsMutex.Unlock()
+
+	if !changed {
+		return err != nil
+	}
+
+	if err != nil {
+		logger.Errorf(logger.Fields{"phase": "auth"},
+			"GCP rejected the connector's credentials, so no jobs are fetched, and printers are offline; to re-authorize the connector, run connector-init, then restart the connector: %s", err)
+		pm.announceConnectionState()
+	} else {
+		logger.Infof(logger.Fields{"phase": "auth"}, "GCP accepts the connector's credentials again; fetching queued jobs")
+		pm.announceConnectionState()
+		go pm.handleAllPrintersNewJobs()
+	}
+	return err != nil
+}
+
+// setPrintersOnline announces whether the printers are reachable through
+// GCP to local clients; see announceConnectionState.
+func (pm *PrinterManager) setPrintersOnline(online bool) {
+	if pm.privet == nil {
+		return
+	}
+
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		if !pm.privet.HasPrinter(printer.GCPID) {
+			continue
+		}
+		if err := pm.privet.SetOnline(printer, online); err != nil {
+			glog.Warningf("Failed to announce whether printer %s is online: %s", printer.Name, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// directoryMembersScopes returns the members that the directory resolved
+// last, which printers are shared with as users.
+func (pm *PrinterManager) directoryMembersScopes() []string {
+	pm.directoryMutex.Lock()
+	defer pm.directoryMutex.Unlock()
+
+	return pm.directoryMembers
+}
+
+// directoryPending answers the question "are printers shared with a
+// directory whose members aren't resolved yet?" Sharing isn't reconciled
+// until they are, so that share_revoke_unlisted doesn't unshare them.
+func (pm *PrinterManager) directoryPending() bool {
+	pm.directoryMutex.Lock()
+	defer pm.directoryMutex.Unlock()
+
+	return pm.directory != nil && !pm.directoryResolved
+}
+
+// resolveMembersPeriodically resolves the directory's groups into members
+// now, and every interval, and shares the printers with the members. The
+// printers are unshared from members that left the groups, unless they're
+// configured scopes too.
+func (pm *PrinterManager) resolveMembersPeriodically(interval time.Duration) {
+	go func() {
+		t := time.NewTimer(0)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				pm.resolveMembers()
+				t.Reset(interval)
+			case <-pm.quit:
+				return
+			}
+		}
+	}()
+}
+
+// resolveMembers resolves the directory's groups into members once, and
+// reconciles sharing when the members changed. The members resolved last
+// are kept when the directory fails, or resolves to no members.
+func (pm *PrinterManager) resolveMembers() {
+	members, err := pm.directory.Members()
+	if err != nil {
+		glog.Errorf("Failed to resolve directory groups; sharing with the %d members resolved before: %s", len(pm.directoryMembersScopes()), err)
+		return
+	}
+
+	pm.directoryMutex.Lock()
+	previous, resolved := pm.directoryMembers, pm.directoryResolved
+	if len(members) == 0 && len(previous) > 0 {
+		// More likely a broken directory, or bind DN, than empty groups.
+		pm.directoryMutex.Unlock()
+		glog.Errorf("Directory groups resolved to no members; still sharing with the %d members resolved before, rather than unsharing all of them", len(previous))
+		return
+	}
+	pm.directoryMembers, pm.directoryResolved = members, true
+	pm.directoryMutex.Unlock()
+
+	current := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		current[member] = struct{}{}
+	}
+	var removed []string
+	for _, member := range previous {
+		if _, exists := current[member]; !exists {
+			removed = append(removed, member)
+		}
+	}
+	if resolved && len(removed) == 0 && len(members) == len(previous) {
+		return
+	}
+	glog.Infof("Directory groups have %d members; %d left since they were resolved before", len(members), len(removed))
+
+	if len(removed) > 0 && !pm.settings().ShareRevokeUnlisted {
+		// reconcileSharing unshares them otherwise.
+		pm.unshareRemovedMembers(removed)
+	}
+	pm.reconcileSharing()
+}
+
+// unshareRemovedMembers unshares all printers from members that left the
+// directory's groups, unless a printer's configured scopes have them.
+func (pm *PrinterManager) unshareRemovedMembers(removed []string) {
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		scopes := make(map[string]struct{})
+		for _, scope := range pm.shareScopesFor(printer.Name) {
+			scopes[scope] = struct{}{}
+		}
+		for _, member := range removed {
+			if _, exists := scopes[member]; exists {
+				continue
+			}
+			if err := pm.gcp.Unshare(printer.GCPID, member); err != nil {
+				glog.Errorf("Failed to unshare printer %s from %s: %s", printer.Name, member, err)
+			} else {
+				glog.Infof("Unshared %s from %s, who left the directory groups", printer.Name, member)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/cups-connector/gcp/gcptest"
+)
+
+// fakeResolver is a directory.Resolver that returns members, or err.
+type fakeResolver struct {
+	members []string
+	err     error
+}
+
+func (r *fakeResolver) Members() ([]string, error) {
+	return r.members, r.err
+}
+
+// access returns the scopes of the only printer of s, and their roles.
+func access(t *testing.T, s *gcptest.Server) map[string]string {
+	printers := s.Printers()
+	if len(printers) != 1 {
+		t.Fatalf("Got %d printers, want 1", len(printers))
+	}
+	return printers[0].Access
+}
+
+func TestResolveMembers(t *testing.T) {
+	for _, revokeUnlisted := range []bool{false, true} {
+		s := gcptest.NewServer()
+		resolver := &fakeResolver{members: []string{"alice@example.com", "bob@example.com"}}
+		pm := newTestPrinterManager(t, s, Settings{
+			ShareScopes:         []string{"admins@example.com"},
+			ShareRole:           "USER",
+			ShareRevokeUnlisted: revokeUnlisted,
+		}, "printer1")
+		pm.directory = resolver
+
+		if !pm.directoryPending() {
+			t.Error("directoryPending() = false before the members were resolved")
+		}
+		pm.resolveMembers()
+		if pm.directoryPending() {
+			t.Error("directoryPending() = true after the members were resolved")
+		}
+		want := map[string]string{"admins@example.com": "USER", "alice@example.com": "USER", "bob@example.com": "USER"}
+		if got := access(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("revoke %t: shared with %v, want %v", revokeUnlisted, got, want)
+		}
+
+		// Bob leaves, and carol joins.
+		resolver.members = []string{"alice@example.com", "carol@example.com"}
+		pm.resolveMembers()
+		want = map[string]string{"admins@example.com": "USER", "alice@example.com": "USER", "carol@example.com": "USER"}
+		if got := access(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("revoke %t: after a change, shared with %v, want %v", revokeUnlisted, got, want)
+		}
+
+		// Failures, and no members at all, keep the members resolved before.
+		for _, r := range []fakeResolver{{err: errors.New("LDAP is down")}, {members: []string{}}} {
+			*resolver = r
+			pm.resolveMembers()
+			if got := access(t, s); !reflect.DeepEqual(got, want) {
+				t.Errorf("revoke %t: after %+v, shared with %v, want %v", revokeUnlisted, r, got, want)
+			}
+			if got := pm.directoryMembersScopes(); !reflect.DeepEqual(got, []string{"alice@example.com", "carol@example.com"}) {
+				t.Errorf("revoke %t: after %+v, members are %v", revokeUnlisted, r, got)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestUnshareRemovedMembers(t *testing.T) {
+	s := gcptest.NewServer()
+	defer s.Close()
+	pm := newTestPrinterManager(t, s, Settings{
+		ShareScopes: []string{"bob@example.com"},
+		ShareRole:   "USER",
+	}, "printer1")
+	printer := pm.gcpPrintersByGCPID.GetAll()[0]
+	for _, scope := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		pm.share(&printer, scope)
+	}
+
+	// Bob is a configured scope too, so he keeps access.
+	pm.unshareRemovedMembers([]string{"alice@example.com", "bob@example.com"})
+	want := map[string]string{"bob@example.com": "USER", "carol@example.com": "USER"}
+	if got := access(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Shared with %v, want %v", got, want)
+	}
+}
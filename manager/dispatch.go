@@ -0,0 +1,143 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+)
+
+// queueJobs queues fetched jobs to be processed; see dispatchJobs. Jobs
+// that are queued already are ignored.
+func (pm *PrinterManager) queueJobs(jobs []lib.Job) {
+	pm.dispatchMutex.Lock()
+	for i := range jobs {
+		if _, exists := pm.dispatchQueued[jobs[i].GCPJobID]; exists {
+			continue
+		}
+		pm.dispatchQueued[jobs[i].GCPJobID] = struct{}{}
+		gcpID := jobs[i].GCPPrinterID
+		if len(pm.dispatchQueues[gcpID]) == 0 {
+			pm.dispatchOrder = append(pm.dispatchOrder, gcpID)
+		}
+		pm.dispatchQueues[gcpID] = append(pm.dispatchQueues[gcpID], &jobs[i])
+	}
+	pm.dispatchMutex.Unlock()
+
+	pm.wakeDispatcher()
+}
+
+// dispatchJobs processes queued jobs, taking turns between printers, so
+// that a printer with a large backlog can't hold up the others.
+//
+// Jobs are dispatched until they are submitted to CUPS, or fail. At most
+// GCPMaxConcurrentDownload jobs are dispatched at once, and at most
+// CUPSQueueSize of each printer. Each printer's jobs are dispatched at most
+// MaxJobsPerMinute per minute.
+func (pm *PrinterManager) dispatchJobs() {
+	go func() {
+		for {
+			var timeout <-chan time.Time
+			if wait := pm.dispatchNextJobs(); wait > 0 {
+				timeout = time.After(wait)
+			}
+
+			select {
+			case <-pm.dispatchWake:
+			case <-timeout:
+			case <-pm.quit:
+				return
+			}
+		}
+	}()
+}
+
+// dispatchNextJobs dispatches queued jobs while there is room. Returns how
+// long until the next rate limited printer may have a job dispatched, or
+// zero when no printer is waiting for its rate limit.
+func (pm *PrinterManager) dispatchNextJobs() time.Duration {
+	s := pm.settings()
+	var interval time.Duration
+	if s.MaxJobsPerMinute > 0 {
+		interval = time.Minute / time.Duration(s.MaxJobsPerMinute)
+	}
+
+	pm.dispatchMutex.Lock()
+	defer pm.dispatchMutex.Unlock()
+
+	for pm.dispatching < s.GCPMaxConcurrentDownload {
+		now := time.Now()
+		var wait time.Duration
+		i := 0
+		for ; i < len(pm.dispatchOrder); i++ {
+			gcpID := pm.dispatchOrder[i]
+			if pm.dispatchingByPrinter[gcpID] >= s.CUPSQueueSize {
+				continue
+			}
+			if d := pm.lastDispatch[gcpID].Add(interval).Sub(now); d > 0 {
+				if wait == 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+			break
+		}
+		if i == len(pm.dispatchOrder) {
+			return wait
+		}
+
+		// The printer goes to the back of the line.
+		gcpID := pm.dispatchOrder[i]
+		job := pm.dispatchQueues[gcpID][0]
+		pm.dispatchQueues[gcpID] = pm.dispatchQueues[gcpID][1:]
+		pm.dispatchOrder = append(pm.dispatchOrder[:i], pm.dispatchOrder[i+1:]...)
+		if len(pm.dispatchQueues[gcpID]) > 0 {
+			pm.dispatchOrder = append(pm.dispatchOrder, gcpID)
+		} else {
+			delete(pm.dispatchQueues, gcpID)
+		}
+		delete(pm.dispatchQueued, job.GCPJobID)
+
+		pm.lastDispatch[gcpID] = now
+		pm.dispatching++
+		pm.dispatchingByPrinter[gcpID]++
+		go pm.processJob(job, pm.jobSubmittedFunc(gcpID))
+	}
+	return 0
+}
+
+// jobSubmittedFunc returns the function that a dispatched job calls when it
+// is submitted to CUPS, or fails, to make room for another job. The
+// function may be called more than once.
+func (pm *PrinterManager) jobSubmittedFunc(gcpID string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pm.dispatchMutex.Lock()
+			pm.dispatching--
+			if pm.dispatchingByPrinter[gcpID] <= 1 {
+				delete(pm.dispatchingByPrinter, gcpID)
+			} else {
+				pm.dispatchingByPrinter[gcpID]--
+			}
+			pm.dispatchMutex.Unlock()
+
+			pm.wakeDispatcher()
+		})
+	}
+}
+
+// wakeDispatcher makes dispatchJobs look at the queues again.
+func (pm *PrinterManager) wakeDispatcher() {
+	select {
+	case pm.dispatchWake <- struct{}{}:
+	default:
+	}
+}
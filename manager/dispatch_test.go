@@ -0,0 +1,159 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+)
+
+// queueTestJobs queues n jobs of the printer gcpID. The jobs are in flight
+// already, so processJob returns from them at once.
+func queueTestJobs(pm *PrinterManager, gcpID string, n int) {
+	jobs := make([]lib.Job, n)
+	for i := range jobs {
+		jobs[i] = lib.Job{GCPJobID: fmt.Sprintf("%s-job%d", gcpID, i), GCPPrinterID: gcpID}
+		pm.jobsInFlight[jobs[i].GCPJobID] = &JobStatus{GCPJobID: jobs[i].GCPJobID}
+	}
+	pm.queueJobs(jobs)
+}
+
+// dispatchRound dispatches the next jobs, and returns how many of each
+// printer were dispatched, and the wait that dispatchNextJobs returned.
+// The dispatched jobs are held until the round is counted, then allowed
+// to finish.
+func dispatchRound(t *testing.T, pm *PrinterManager) (map[string]uint, time.Duration) {
+	// processJob blocks on the in flight jobs until they're counted.
+	pm.jobsInFlightMutex.Lock()
+	wait := pm.dispatchNextJobs()
+	pm.dispatchMutex.Lock()
+	dispatched := make(map[string]uint, len(pm.dispatchingByPrinter))
+	for gcpID, n := range pm.dispatchingByPrinter {
+		dispatched[gcpID] = n
+	}
+	pm.dispatchMutex.Unlock()
+	pm.jobsInFlightMutex.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		pm.dispatchMutex.Lock()
+		dispatching := pm.dispatching
+		pm.dispatchMutex.Unlock()
+		if dispatching == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dispatched jobs didn't finish", dispatching)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return dispatched, wait
+}
+
+func TestDispatchTakesTurns(t *testing.T) {
+	pm := newTestPrinterManager(t, nil, Settings{GCPMaxConcurrentDownload: 3, CUPSQueueSize: 10})
+	// The printer with the backlog is first in line.
+	queueTestJobs(pm, "a", 4)
+	queueTestJobs(pm, "b", 2)
+	queueTestJobs(pm, "c", 1)
+
+	for i, want := range []map[string]uint{
+		{"a": 1, "b": 1, "c": 1},
+		{"a": 2, "b": 1},
+		{"a": 1},
+		{},
+	} {
+		dispatched, wait := dispatchRound(t, pm)
+		if !reflect.DeepEqual(dispatched, want) {
+			t.Errorf("Round %d dispatched %v, want %v", i, dispatched, want)
+		}
+		if wait != 0 {
+			t.Errorf("Round %d returned wait %s, want 0", i, wait)
+		}
+	}
+
+	if len(pm.dispatchQueues) != 0 || len(pm.dispatchQueued) != 0 || len(pm.dispatchOrder) != 0 {
+		t.Errorf("Queues aren't empty: %v, %v, %v", pm.dispatchQueues, pm.dispatchQueued, pm.dispatchOrder)
+	}
+}
+
+func TestDispatchCUPSQueueSize(t *testing.T) {
+	pm := newTestPrinterManager(t, nil, Settings{GCPMaxConcurrentDownload: 5, CUPSQueueSize: 1})
+	queueTestJobs(pm, "a", 3)
+	queueTestJobs(pm, "b", 1)
+
+	// Each printer has one job dispatched at a time, though there's room
+	// for more downloads.
+	for i, want := range []map[string]uint{
+		{"a": 1, "b": 1},
+		{"a": 1},
+		{"a": 1},
+		{},
+	} {
+		if dispatched, _ := dispatchRound(t, pm); !reflect.DeepEqual(dispatched, want) {
+			t.Errorf("Round %d dispatched %v, want %v", i, dispatched, want)
+		}
+	}
+}
+
+func TestDispatchRateLimit(t *testing.T) {
+	pm := newTestPrinterManager(t, nil, Settings{GCPMaxConcurrentDownload: 5, CUPSQueueSize: 5, MaxJobsPerMinute: 1})
+	queueTestJobs(pm, "a", 2)
+	queueTestJobs(pm, "b", 1)
+
+	dispatched, wait := dispatchRound(t, pm)
+	if want := map[string]uint{"a": 1, "b": 1}; !reflect.DeepEqual(dispatched, want) {
+		t.Errorf("Dispatched %v, want %v", dispatched, want)
+	}
+	// Printer a waits a minute for its next job.
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("Returned wait %s, want up to a minute", wait)
+	}
+	dispatched, wait = dispatchRound(t, pm)
+	if len(dispatched) != 0 {
+		t.Errorf("Dispatched %v within the rate limit, want nothing", dispatched)
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("Returned wait %s, want up to a minute", wait)
+	}
+
+	// Once the minute is up, the job is dispatched.
+	pm.dispatchMutex.Lock()
+	pm.lastDispatch["a"] = pm.lastDispatch["a"].Add(-time.Minute)
+	pm.dispatchMutex.Unlock()
+	if dispatched, _ = dispatchRound(t, pm); !reflect.DeepEqual(dispatched, map[string]uint{"a": 1}) {
+		t.Errorf("Dispatched %v after the rate limit, want one job of a", dispatched)
+	}
+}
+
+func TestQueueJobsIgnoresQueued(t *testing.T) {
+	pm := newTestPrinterManager(t, nil, Settings{})
+	jobs := []lib.Job{{GCPJobID: "job1", GCPPrinterID: "a"}, {GCPJobID: "job2", GCPPrinterID: "a"}}
+	pm.queueJobs(jobs)
+	// Fetched again while still queued.
+	pm.queueJobs([]lib.Job{{GCPJobID: "job2", GCPPrinterID: "a"}, {GCPJobID: "job3", GCPPrinterID: "b"}})
+
+	if n := len(pm.dispatchQueues["a"]); n != 2 {
+		t.Errorf("Queued %d jobs of printer a, want 2", n)
+	}
+	if n := len(pm.dispatchQueues["b"]); n != 1 {
+		t.Errorf("Queued %d jobs of printer b, want 1", n)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(pm.dispatchOrder, want) {
+		t.Errorf("Dispatch order is %v, want %v", pm.dispatchOrder, want)
+	}
+	select {
+	case <-pm.dispatchWake:
+	default:
+		t.Error("queueJobs didn't wake the dispatcher")
+	}
+}
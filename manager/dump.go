@@ -0,0 +1,77 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// DumpState writes a human-readable summary of this manager's internal
+// state to w, to debug a connector that appears hung.
+func (pm *PrinterManager) DumpState(w io.Writer) {
+	now := time.Now()
+
+	syncStatus := pm.SyncStatus()
+	fmt.Fprintf(w, "Last sync: %s", formatAge(syncStatus.LastSync, now))
+	if syncStatus.LastError != "" {
+		fmt.Fprintf(w, ", failed: %s", syncStatus.LastError)
+	}
+	fmt.Fprintf(w, "\nLast successful sync: %s\n", formatAge(syncStatus.LastSuccess, now))
+	if syncStatus.Degraded {
+		fmt.Fprintln(w, "Degraded: printers were loaded from the cache")
+	}
+
+	pm.heartbeatsMutex.Lock()
+	loops := make([]string, 0, len(pm.heartbeats))
+	for loop := range pm.heartbeats {
+		loops = append(loops, loop)
+	}
+	sort.Strings(loops)
+	for _, loop := range loops {
+		fmt.Fprintf(w, "Loop %q last alive: %s\n", loop, formatAge(pm.heartbeats[loop], now))
+	}
+	pm.heartbeatsMutex.Unlock()
+
+	downloadSemaphore := pm.getDownloadSemaphore()
+	fmt.Fprintf(w, "Downloads: %d of %d\n", downloadSemaphore.Count(), downloadSemaphore.Size())
+
+	printers := pm.Printers()
+	fmt.Fprintf(w, "\n%d printers:\n", len(printers))
+	for _, printer := range printers {
+		fmt.Fprintf(w, "  %s (%s) state %s", printer.Name, printer.GCPID, printer.State)
+		if p, exists := pm.gcpPrintersByGCPID.Get(printer.GCPID); exists && p.CUPSJobSemaphore != nil {
+			fmt.Fprintf(w, ", CUPS jobs %d of %d", p.CUPSJobSemaphore.Count(), p.CUPSJobSemaphore.Size())
+		}
+		if printer.Paused {
+			fmt.Fprint(w, ", paused")
+		}
+		fmt.Fprintln(w)
+	}
+
+	jobs := pm.InFlightJobs()
+	fmt.Fprintf(w, "\n%d jobs in flight:\n", len(jobs))
+	for _, job := range jobs {
+		fmt.Fprintf(w, "  %s on %s, phase %s, state %s, received %s", job.GCPJobID, job.PrinterName,
+			job.Phase, job.State, formatAge(job.Received, now))
+		if job.CUPSJobID != 0 {
+			fmt.Fprintf(w, ", CUPS job %d", job.CUPSJobID)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// formatAge formats t as how long ago it was.
+func formatAge(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", now.Sub(t).String())
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+)
+
+// jobExpired says whether a job was submitted longer than maxAge before
+// now. Jobs don't expire when maxAge is zero, or when GCP didn't say when
+// they were submitted.
+func jobExpired(job *lib.Job, maxAge time.Duration, now time.Time) bool {
+	if maxAge == 0 || job.CreateTime.IsZero() {
+		return false
+	}
+	return now.Sub(job.CreateTime) > maxAge
+}
+
+// jobExpiredState reports a job that is too old to print to GCP.
+var jobExpiredState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:               "ABORTED",
+		ServiceActionCause: &cdd.ServiceActionCause{ErrorCode: "EXPIRATION"},
+	},
+}
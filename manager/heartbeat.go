@@ -0,0 +1,47 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How often the main loops report that they are alive.
+const heartbeatInterval = 10 * time.Second
+
+// Names of the main loops.
+const (
+	syncLoop          = "printer sync"
+	notificationsLoop = "XMPP notifications"
+)
+
+// heartbeat records that loop is alive.
+func (pm *PrinterManager) heartbeat(loop string) {
+	pm.heartbeatsMutex.Lock()
+	defer pm.heartbeatsMutex.Unlock()
+
+	pm.heartbeats[loop] = time.Now()
+}
+
+// Alive returns true when each main loop reported that it is alive within
+// maxAge. A loop that is stuck, like in a printer sync that never returns,
+// stops reporting.
+func (pm *PrinterManager) Alive(maxAge time.Duration) bool {
+	pm.heartbeatsMutex.Lock()
+	defer pm.heartbeatsMutex.Unlock()
+
+	for loop, t := range pm.heartbeats {
+		if time.Since(t) > maxAge {
+			glog.Warningf("The %s loop has not reported in %s", loop, time.Since(t).String())
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/google/cups-connector/audit"
+	"github.com/google/cups-connector/history"
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// recordJobHistory adds a finished job to the job history, if it is kept.
+func (pm *PrinterManager) recordJobHistory(status JobStatus) {
+	if pm.jobHistory == nil {
+		return
+	}
+
+	err := pm.jobHistory.Append(history.Record{
+		Time:         status.Finished,
+		Kind:         history.KindJob,
+		Printer:      status.PrinterName,
+		GCPPrinterID: status.GCPPrinterID,
+		State:        status.State,
+		GCPJobID:     status.GCPJobID,
+		Owner:        status.OwnerID,
+		Pages:        status.Pages,
+		Seconds:      status.Finished.Sub(status.Received).Seconds(),
+		PrintSeconds: status.PhaseSeconds["print"],
+		Error:        status.Error,
+		Offline:      status.Offline,
+	})
+	if err != nil {
+		glog.Warning(err)
+	}
+}
+
+// auditJobReceived adds a received job to the audit log, if it is kept.
+func (pm *PrinterManager) auditJobReceived(job *lib.Job) {
+	if pm.auditLog == nil {
+		return
+	}
+
+	err := pm.auditLog.Append(audit.Entry{
+		Event:        audit.JobReceived,
+		GCPJobID:     job.GCPJobID,
+		Owner:        job.OwnerID,
+		GCPPrinterID: job.GCPPrinterID,
+	})
+	if err != nil {
+		glog.Error(err)
+	}
+}
+
+// auditJobFinished adds a finished job, with its outcome, to the audit log,
+// if it is kept.
+func (pm *PrinterManager) auditJobFinished(status JobStatus) {
+	if pm.auditLog == nil {
+		return
+	}
+
+	err := pm.auditLog.Append(audit.Entry{
+		Time:         status.Finished,
+		Event:        audit.JobFinished,
+		GCPJobID:     status.GCPJobID,
+		Owner:        status.OwnerID,
+		GCPPrinterID: status.GCPPrinterID,
+		Printer:      status.PrinterName,
+		Pages:        status.Pages,
+		State:        status.State,
+		Error:        status.Error,
+	})
+	if err != nil {
+		glog.Error(err)
+	}
+}
+
+// recordPrinterStateHistory adds the printers that stopped, or that
+// stopped being stopped, between oldPrinters and currentPrinters to the job
+// history, if it is kept. Other state changes, like IDLE to PROCESSING,
+// would only grow the file.
+func (pm *PrinterManager) recordPrinterStateHistory(oldPrinters, currentPrinters []lib.Printer) {
+	if pm.jobHistory == nil {
+		return
+	}
+
+	old := make(map[string]lib.Printer, len(oldPrinters))
+	for _, printer := range oldPrinters {
+		old[printer.GCPID] = printer
+	}
+
+	for _, printer := range currentPrinters {
+		oldPrinter, exists := old[printer.GCPID]
+		if printer.State == nil || (exists && printerStopped(printer) == printerStopped(oldPrinter)) {
+			continue
+		}
+		if !exists && !printerStopped(printer) {
+			// New printers are up until a record says otherwise.
+			continue
+		}
+		err := pm.jobHistory.Append(history.Record{
+			Time:         time.Now(),
+			Kind:         history.KindPrinterState,
+			Printer:      printer.Name,
+			GCPPrinterID: printer.GCPID,
+			State:        string(printer.State.State),
+		})
+		if err != nil {
+			glog.Warning(err)
+		}
+	}
+}
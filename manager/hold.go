@@ -0,0 +1,35 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import "github.com/google/cups-connector/cdd"
+
+// jobHoldUntilAttribute is the CUPS job attribute that holds a job until a
+// later time. The CUPS backend sends vendor ticket items as job options.
+const jobHoldUntilAttribute = "job-hold-until"
+
+// jobHoldUntil returns the job-hold-until value to add to a job for a
+// printer: the printer's value in holdUntil, or else the value under "*".
+// Returns "" when the ticket has a value already, and when the job isn't
+// held.
+func jobHoldUntil(ticket cdd.CloudJobTicket, printerName string, holdUntil map[string]string) string {
+	for _, vti := range ticket.Print.VendorTicketItem {
+		if vti.ID == jobHoldUntilAttribute {
+			return ""
+		}
+	}
+
+	value, exists := holdUntil[printerName]
+	if !exists {
+		value = holdUntil["*"]
+	}
+	if value == "no-hold" {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/logger"
+	"github.com/google/cups-connector/metrics"
+	"github.com/google/cups-connector/privet"
+)
+
+// localJobID returns the ID of a local job among the connector's jobs,
+// which can't be confused with a GCP job ID.
+func localJobID(privetJobID string) string {
+	return "privet:" + privetJobID
+}
+
+// printLocalJob prints a job that a local client submitted with Privet,
+// through the same CUPS pipeline as GCP jobs, and follows it in the
+// background. Returns once CUPS has the job, or it failed; GCP isn't told
+// about the job, so it prints while GCP is unreachable too.
+//
+// Implements privet.PrintJobFunc.
+func (pm *PrinterManager) printLocalJob(localJob *privet.Job) error {
+	printer, exists := pm.gcpPrintersByGCPID.Get(localJob.GCPPrinterID)
+	if !exists {
+		return fmt.Errorf("Failed to find GCP printer %s", localJob.GCPPrinterID)
+	}
+	if len(pm.settings().JobOwnerAllowlist) > 0 {
+		// The allowlist can't be checked against a user that the client claims.
+		return &privet.JobError{Code: privet.ErrAccessDenied,
+			Message: "Local jobs are refused because job_owner_allowlist is set"}
+	}
+	if pm.printerPaused(printer.Name) || pm.printerFaulted(printer) {
+		return &privet.JobError{Code: privet.ErrPrinterBusy,
+			Message: fmt.Sprintf("Printer %s is paused", printer.Name)}
+	}
+	quota, ok := pm.reserveQuota(printer.GCPID)
+	if !ok {
+		return &privet.JobError{Code: privet.ErrPrinterBusy,
+			Message: fmt.Sprintf("Printer %s printed its daily quota of %d pages", printer.Name, quota)}
+	}
+
+	job := &lib.Job{
+		GCPPrinterID: printer.GCPID,
+		GCPJobID:     localJobID(localJob.ID),
+		OwnerID:      localJob.User,
+		Title:        localJob.Title,
+		CreateTime:   time.Now(),
+		Local:        true,
+	}
+	if !pm.addInFlightJob(job) {
+		pm.releaseQuota(printer.GCPID)
+		return fmt.Errorf("Job %s was received already", job.GCPJobID)
+	}
+
+	if pm.countOfflineJob(printer.GCPID) {
+		pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) { status.Offline = true })
+		logger.Infof(jobFields(job, "receive"), "Received local job %s from %s while GCP is unreachable", job.GCPJobID, job.OwnerID)
+	} else {
+		logger.Infof(jobFields(job, "receive"), "Received local job %s from %s", job.GCPJobID, job.OwnerID)
+	}
+	metrics.Count("jobs.received", 1, nil)
+	pm.auditJobReceived(job)
+
+	cupsJobID, err := pm.submitLocalJob(job, printer, localJob)
+	if err != nil {
+		pm.releaseQuota(printer.GCPID)
+		pm.removeJobDocument(job)
+		pm.deleteInFlightJob(job.GCPJobID)
+		return err
+	}
+	logger.Infof(cupsJobFields(job, cupsJobID, "submit"), "Submitted local job %s as CUPS job %d", job.GCPJobID, cupsJobID)
+
+	var canceled bool
+	ownerID := pm.jobUser(job)
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		status.CUPSJobID = cupsJobID
+		status.State = "IN_PROGRESS"
+		status.Phase = "follow"
+		canceled = status.canceled
+	})
+	if canceled {
+		if err = pm.backend.CancelJob(printer.Name, ownerID, cupsJobID); err != nil {
+			logger.Warningf(cupsJobFields(job, cupsJobID, "cancel"), "%s", err)
+		}
+	}
+
+	go func() {
+		defer pm.deleteInFlightJob(job.GCPJobID)
+		defer pm.removeJobDocument(job)
+		defer pm.releaseQuota(printer.GCPID)
+
+		t := time.Now()
+		pm.followJob(job, cupsJobID)
+		pm.recordJobPhase(job, printer.Name, "print", time.Since(t))
+	}()
+	return nil
+}
+
+// submitLocalJob writes the document of a local job to a temporary file,
+// and prints it. Returns the CUPS job ID.
+func (pm *PrinterManager) submitLocalJob(job *lib.Job, printer lib.Printer, localJob *privet.Job) (uint32, error) {
+	ticket := localJob.Ticket
+	ownerID := pm.jobUser(job)
+	pm.addJobAttributes(job, printer.Name, &ticket)
+
+	jobTitle := fmt.Sprintf("privet:%s %s", localJob.ID, job.Title)
+	if len(jobTitle) > 255 {
+		jobTitle = jobTitle[:255]
+	}
+
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		status.PrinterName = printer.Name
+		status.cupsUser = ownerID
+		status.ticket = &ticket
+		status.Phase = "download"
+	})
+
+	documentFile, err := pm.receiveLocalDocument(job, printer.Name, localJob.Document)
+	if err != nil {
+		return 0, err
+	}
+	if pm.quarantineDir == "" {
+		defer pm.spool.Remove(documentFile)
+	} else {
+		pm.keepJobDocument(job, documentFile)
+	}
+
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) { status.Phase = "submit" })
+	t := time.Now()
+	printer.CUPSJobSemaphore.Acquire()
+	pm.recordJobPhase(job, printer.Name, "queue", time.Since(t))
+	t = time.Now()
+	cupsJobID, err := pm.printFile(printer.Name, documentFile, jobTitle, ownerID, localJob.ContentType, ticket)
+	pm.recordJobPhase(job, printer.Name, "submit", time.Since(t))
+	printer.CUPSJobSemaphore.Release()
+
+	if err != nil {
+		message := fmt.Sprintf("Failed to send job %s to CUPS: %s", job.GCPJobID, err)
+		pm.failJob(job, message, cdd.PrintJobStateDiff{
+			State: cdd.JobState{
+				Type:              "STOPPED",
+				DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "PRINT_FAILURE"},
+			},
+		})
+		return 0, fmt.Errorf("%s", message)
+	}
+	return cupsJobID, nil
+}
+
+// receiveLocalDocument writes the document of a local job to a temporary
+// file, through the spool, and returns the filename. Documents larger than
+// gcp_max_download_mb are refused with a *privet.JobError.
+func (pm *PrinterManager) receiveLocalDocument(job *lib.Job, printerName string, document io.Reader) (string, error) {
+	failedState := cdd.PrintJobStateDiff{
+		State: cdd.JobState{
+			Type:              "STOPPED",
+			DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "OTHER"},
+		},
+	}
+
+	f, err := pm.backend.CreateTempFile()
+	if err != nil {
+		message := fmt.Sprintf("Failed to create a temporary file for job %s: %s", job.GCPJobID, err)
+		pm.failJob(job, message, failedState)
+		return "", fmt.Errorf("%s", message)
+	}
+
+	w, err := pm.spool.Writer(f)
+	if err != nil {
+		f.Close()
+		pm.spool.Remove(f.Name())
+		message := fmt.Sprintf("Failed to prepare a temporary file for job %s: %s", job.GCPJobID, err)
+		pm.failJob(job, message, failedState)
+		return "", fmt.Errorf("%s", message)
+	}
+
+	maxSize := pm.maxDownloadSize()
+	if maxSize > 0 {
+		// One byte more tells a document of the maximum size from a larger one.
+		document = io.LimitReader(document, maxSize+1)
+	}
+	t := time.Now()
+	n, err := io.Copy(w, document)
+	f.Close()
+	pm.recordJobPhase(job, printerName, "download", time.Since(t))
+	if err != nil {
+		pm.spool.Remove(f.Name())
+		message := fmt.Sprintf("Failed to receive document for job %s: %s", job.GCPJobID, err)
+		pm.failJob(job, message, failedState)
+		return "", fmt.Errorf("%s", message)
+	}
+	if maxSize > 0 && n > maxSize {
+		pm.spool.Remove(f.Name())
+		message := fmt.Sprintf("Refusing job %s: its document is larger than gcp_max_download_mb (%d MB)", job.GCPJobID, maxSize>>20)
+		pm.failJob(job, message, downloadTooLargeState)
+		return "", &privet.JobError{Code: privet.ErrDocumentTooLarge, Message: message}
+	}
+
+	return f.Name(), nil
+}
+
+// localJobState returns the state of a local job, while the job is in
+// flight or among the recent jobs.
+//
+// Implements privet.GetJobStateFunc.
+func (pm *PrinterManager) localJobState(privetJobID string) (cdd.PrintJobState, bool) {
+	id := localJobID(privetJobID)
+
+	pm.jobsInFlightMutex.Lock()
+	defer pm.jobsInFlightMutex.Unlock()
+
+	status, exists := pm.jobsInFlight[id]
+	if !exists {
+		for i := len(pm.recentJobs) - 1; i >= 0; i-- {
+			if pm.recentJobs[i].GCPJobID == id {
+				status, exists = &pm.recentJobs[i], true
+				break
+			}
+		}
+	}
+	if !exists {
+		return cdd.PrintJobState{}, false
+	}
+
+	return cdd.PrintJobState{
+		Version:      "1.0",
+		State:        cdd.JobState{Type: status.State},
+		PagesPrinted: status.Pages,
+	}, true
+}
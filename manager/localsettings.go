@@ -0,0 +1,127 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/logger"
+
+	"github.com/golang/glog"
+)
+
+// applyLocalSettings returns current with the pending changes that the
+// connector supports applied. Changes that it doesn't support, like
+// conversion printing, are confirmed as off, so that GCP shows what the
+// printer does.
+func applyLocalSettings(current lib.LocalSettings, pending *lib.LocalSettings) lib.LocalSettings {
+	next := current
+	if pending == nil {
+		return next
+	}
+
+	if pending.XMPPTimeoutValue > 0 {
+		next.XMPPTimeoutValue = pending.XMPPTimeoutValue
+	}
+	if pending.LocalDiscovery != nil {
+		next.LocalDiscovery = pending.LocalDiscovery
+	}
+	if pending.AccessTokenEnable != nil {
+		next.AccessTokenEnable = pending.AccessTokenEnable
+	}
+	if pending.LocalPrintingEnabled != nil {
+		next.LocalPrintingEnabled = pending.LocalPrintingEnabled
+	}
+
+	off := false
+	if pending.ConversionPrintingEnabled != nil {
+		next.ConversionPrintingEnabled = &off
+	}
+
+	return next
+}
+
+// handlePrinterUpdateSettings gets the local settings of a printer, whose
+// owner changed them, from GCP, and applies them.
+func (pm *PrinterManager) handlePrinterUpdateSettings(gcpID string) {
+	printer, _, err := pm.gcp.Printer(gcpID)
+	if err != nil {
+		logger.Errorf(logger.Fields{"gcp_printer_id": gcpID, "phase": "settings"}, "Failed to get local settings of printer %s: %s", gcpID, err)
+		return
+	}
+	pm.reconcileLocalSettings(printer)
+}
+
+// reconcileLocalSettings applies the pending local settings of printer, as
+// GCP reported it, and confirms them to GCP as current.
+func (pm *PrinterManager) reconcileLocalSettings(printer *lib.Printer) {
+	if printer.PendingSettings == nil {
+		return
+	}
+
+	next := applyLocalSettings(printer.LocalSettings, printer.PendingSettings)
+	if err := pm.gcp.SetLocalSettings(printer.GCPID, &next); err != nil {
+		logger.Errorf(printerFields(printer, "settings"), "Failed to confirm local settings of printer %s: %s", printer.Name, err)
+		return
+	}
+	logger.Infof(printerFields(printer, "settings"), "Applied local settings of printer %s", printer.Name)
+
+	// Keep the settings with the printer, which syncs carry over.
+	pm.syncMutex.Lock()
+	printers := pm.gcpPrintersByGCPID.GetAll()
+	for i := range printers {
+		if printers[i].GCPID != printer.GCPID {
+			continue
+		}
+		discoveryChanged := printers[i].LocalSettings.LocalDiscoveryEnabled() != next.LocalDiscoveryEnabled()
+		printers[i].LocalSettings = next
+		if pm.privet != nil && discoveryChanged {
+			pm.announceLocally(printers[i])
+		}
+	}
+	pm.gcpPrintersByGCPID.Refresh(printers)
+	pm.syncMutex.Unlock()
+
+	pm.updateXMPPPingInterval()
+}
+
+// announceLocally announces printer with Privet, or withdraws it, as its
+// local_discovery setting says.
+func (pm *PrinterManager) announceLocally(printer lib.Printer) {
+	if printer.LocalSettings.LocalDiscoveryEnabled() {
+		// AddPrinter is a no-op for printers that are already announced.
+		if err := pm.privet.AddPrinter(printer, pm.gcpPrintersByGCPID.Get, pm.gcp.ProximityToken, pm.printLocalJob, pm.localJobState); err != nil {
+			glog.Warningf("Failed to announce printer %s locally: %s", printer.Name, err)
+		}
+	} else if pm.privet.HasPrinter(printer.GCPID) {
+		if err := pm.privet.DeletePrinter(printer.GCPID); err != nil {
+			glog.Warningf("Failed to withdraw local announcement of printer %s: %s", printer.Name, err)
+		}
+	}
+}
+
+// updateXMPPPingInterval sets the XMPP ping interval to the shortest that
+// the printers' local settings ask for.
+func (pm *PrinterManager) updateXMPPPingInterval() {
+	var interval time.Duration
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		if i := printer.LocalSettings.XMPPPingInterval(); i > 0 && (interval == 0 || i < interval) {
+			interval = i
+		}
+	}
+
+	pm.xmppPingIntervalMutex.Lock()
+	defer pm.xmppPingIntervalMutex.Unlock()
+
+	if interval == 0 || interval == pm.xmppPingInterval {
+		return
+	}
+	pm.xmppPingInterval = interval
+	pm.xmpp.SetPingInterval(interval)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/cups-connector/lib"
+)
+
+func TestApplyLocalSettings(t *testing.T) {
+	on, off := true, false
+	current := lib.LocalSettings{
+		XMPPTimeoutValue:     300,
+		LocalDiscovery:       &on,
+		AccessTokenEnable:    &on,
+		LocalPrintingEnabled: &on,
+	}
+	with := func(change func(*lib.LocalSettings)) lib.LocalSettings {
+		s := current
+		change(&s)
+		return s
+	}
+
+	for _, test := range []struct {
+		name    string
+		pending *lib.LocalSettings
+		want    lib.LocalSettings
+	}{
+		{"nil pending", nil, current},
+		{"nothing pending", &lib.LocalSettings{}, current},
+		{"xmpp_timeout_value", &lib.LocalSettings{XMPPTimeoutValue: 60},
+			with(func(s *lib.LocalSettings) { s.XMPPTimeoutValue = 60 })},
+		{"local_discovery", &lib.LocalSettings{LocalDiscovery: &off},
+			with(func(s *lib.LocalSettings) { s.LocalDiscovery = &off })},
+		{"access_token_enable", &lib.LocalSettings{AccessTokenEnable: &off},
+			with(func(s *lib.LocalSettings) { s.AccessTokenEnable = &off })},
+		{"printer/local_printing_enabled", &lib.LocalSettings{LocalPrintingEnabled: &off},
+			with(func(s *lib.LocalSettings) { s.LocalPrintingEnabled = &off })},
+		// Conversion printing isn't supported, so it's confirmed as off.
+		{"printer/conversion_printing_enabled", &lib.LocalSettings{ConversionPrintingEnabled: &on},
+			with(func(s *lib.LocalSettings) { s.ConversionPrintingEnabled = &off })},
+		{"all", &lib.LocalSettings{XMPPTimeoutValue: 60, LocalDiscovery: &off, AccessTokenEnable: &off, LocalPrintingEnabled: &off, ConversionPrintingEnabled: &off},
+			lib.LocalSettings{XMPPTimeoutValue: 60, LocalDiscovery: &off, AccessTokenEnable: &off, LocalPrintingEnabled: &off, ConversionPrintingEnabled: &off}},
+	} {
+		if got := applyLocalSettings(current, test.pending); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: applyLocalSettings returned %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/google/cups-connector/logger"
+	"github.com/google/cups-connector/metrics"
+)
+
+// gcpUnreachable answers the question "did the last attempt to reach GCP
+// fail?" Local clients keep printing then, offline.
+func (pm *PrinterManager) gcpUnreachable() bool {
+	pm.offlineMutex.Lock()
+	defer pm.offlineMutex.Unlock()
+
+	return !pm.offlineSince.IsZero()
+}
+
+// setGCPReachable records whether GCP, or the network, answered the last
+// call that syncs make to it.
+//
+// When GCP becomes unreachable, the printers are announced offline
+// locally; local clients can still print to them. When it's reachable
+// again, the printers are announced online, their states are reported to
+// GCP again, and the local jobs printed meanwhile are accounted for, by
+// printer, in the log and in the jobs.offline metric. Their job history
+// records say offline.
+func (pm *PrinterManager) setGCPReachable(reachable bool) {
+	pm.offlineMutex.Lock()
+	since := pm.offlineSince
+	changed := reachable == !since.IsZero()
+	var offlineJobs map[string]uint
+	if changed && reachable {
+		pm.offlineSince = time.Time{}
+		offlineJobs, pm.offlineJobs = pm.offlineJobs, make(map[string]uint)
+	} else if changed {
+		pm.offlineSince = time.Now()
+	}
+	pm.offlineMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	pm.announceConnectionState()
+
+	if !reachable {
+		logger.Warningf(logger.Fields{"phase": "sync"}, "GCP is unreachable; printers take local jobs only, until it is reachable again")
+		return
+	}
+
+	logger.Infof(logger.Fields{"phase": "sync"}, "GCP is reachable again, after %s", time.Since(since)/time.Second*time.Second)
+	for gcpID, quantity := range offlineJobs {
+		printer, exists := pm.gcpPrintersByGCPID.Get(gcpID)
+		if !exists {
+			continue
+		}
+		logger.Infof(printerFields(&printer, "sync"), "Printer %s took %d local jobs while GCP was unreachable", printer.Name, quantity)
+		metrics.Count("jobs.offline", int64(quantity), metrics.Tags{"printer": printer.Name})
+	}
+	go pm.reportPrinterStates()
+}
+
+// countOfflineJob counts a local job received while GCP is unreachable,
+// and answers the question "is GCP unreachable?"
+func (pm *PrinterManager) countOfflineJob(gcpID string) bool {
+	pm.offlineMutex.Lock()
+	defer pm.offlineMutex.Unlock()
+
+	if pm.offlineSince.IsZero() {
+		return false
+	}
+	pm.offlineJobs[gcpID]++
+	return true
+}
+
+// reportPrinterStates reports the state of each printer to GCP, which
+// considered the printers offline while it was unreachable.
+func (pm *PrinterManager) reportPrinterStates() {
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		if printer.State == nil {
+			continue
+		}
+		if err := pm.gcp.UpdateState(printer.GCPID, printer.State); err != nil {
+			logger.Errorf(printerFields(&printer, "state"), "Failed to report the state of printer %s to GCP: %s", printer.Name, err)
+		}
+	}
+}
+
+// announceConnectionState announces the printers to local clients as online
+// while GCP is reachable, and accepts the connector's credentials.
+func (pm *PrinterManager) announceConnectionState() {
+	pm.credentialsMutex.Lock()
+	revoked := pm.revoked
+	pm.credentialsMutex.Unlock()
+
+	pm.setPrintersOnline(!revoked && !pm.gcpUnreachable())
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/logger"
+)
+
+// How long an owner map command may take to print a user. A variable, for
+// tests.
+var ownerMapCommandTimeout = 10 * time.Second
+
+// ownerAllowed says whether a job owner, an email address, matches the
+// allowlist: an email address, or a domain like example.com. An empty
+// allowlist allows everyone.
+func ownerAllowed(owner string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	owner = strings.ToLower(owner)
+	domain := owner[strings.LastIndex(owner, "@")+1:]
+	for _, allowed := range allowlist {
+		allowed = strings.ToLower(allowed)
+		if strings.Contains(allowed, "@") {
+			if owner == allowed {
+				return true
+			}
+		} else if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerForbiddenState reports a job whose owner isn't allowed to GCP.
+var ownerForbiddenState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:               "ABORTED",
+		ServiceActionCause: &cdd.ServiceActionCause{ErrorCode: "FETCH_DOCUMENT_FORBIDDEN"},
+	},
+}
+
+// jobAccountingUserIDAttribute is the IPP job attribute that job owners are
+// sent in, as a vendor ticket item, when JobAccountingOwner is set. The CUPS
+// backend sends vendor ticket items as job options.
+const jobAccountingUserIDAttribute = "job-accounting-user-id"
+
+// localJobUser is the CUPS user that local jobs are submitted as, unless
+// JobUser is set. The owner of a local job is what the client claims, so
+// it's never a CUPS user.
+const localJobUser = "privet"
+
+// jobUser returns the CUPS user to submit a job as: JobUser when it is set,
+// else localJobUser for a local job, else the user that JobOwnerMap maps the
+// job's owner to, or else the owner, without its domain unless
+// JobFullUsername.
+func (pm *PrinterManager) jobUser(job *lib.Job) string {
+	s := pm.settings()
+	if s.JobUser != "" {
+		return s.JobUser
+	}
+	if job.Local {
+		return localJobUser
+	}
+	if s.JobOwnerMap != nil {
+		user, err := mapOwner(job.OwnerID, s.JobOwnerMap, s.ownerPatterns)
+		if err != nil {
+			logger.Warningf(jobFields(job, "receive"), "Failed to map owner %s to a CUPS user: %s", job.OwnerID, err)
+		} else if user != "" {
+			return user
+		}
+	}
+
+	if s.JobFullUsername {
+		return job.OwnerID
+	}
+	return strings.Split(job.OwnerID, "@")[0]
+}
+
+// mapOwner returns the CUPS user that m maps owner to, or "" when m doesn't
+// map owner. patterns are m.Patterns, compiled.
+func mapOwner(owner string, m *lib.JobOwnerMap, patterns []*regexp.Regexp) (string, error) {
+	for o, user := range m.Users {
+		if strings.EqualFold(o, owner) {
+			return user, nil
+		}
+	}
+
+	for i, re := range patterns {
+		if match := re.FindStringSubmatchIndex(owner); match != nil {
+			return string(re.ExpandString(nil, m.Patterns[i].User, owner, match)), nil
+		}
+	}
+
+	if m.Command != "" {
+		return runOwnerMapCommand(m.Command, owner)
+	}
+	return "", nil
+}
+
+// runOwnerMapCommand runs command with owner as its argument, and returns
+// the first line that it prints.
+func runOwnerMapCommand(command, owner string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(command, owner)
+	cmd.Stdout = &stdout
+
+	if err := lib.StartCommand(cmd); err != nil {
+		return "", err
+	}
+	if err := lib.WaitCommand(cmd, ownerMapCommandTimeout); err != nil {
+		if _, ok := err.(*lib.CommandTimeoutError); ok {
+			return "", fmt.Errorf("%s %s", command, err)
+		}
+		return "", err
+	}
+
+	user := strings.TrimSpace(strings.SplitN(stdout.String(), "\n", 2)[0])
+	if strings.ContainsAny(user, " \t") {
+		return "", fmt.Errorf("%s printed %q, which isn't a user name", command, user)
+	}
+	return user, nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+)
+
+// writeOwnerMapCommand writes a shell script to dir, to use as an owner
+// map command.
+func writeOwnerMapCommand(t *testing.T, dir, script string) string {
+	command := filepath.Join(dir, "owner-map")
+	if err := ioutil.WriteFile(command, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestMapOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	command := writeOwnerMapCommand(t, dir, `case "$1" in carol@example.com) echo carol-ldap; echo ignored;; esac`)
+	s := Settings{
+		ShareRole:                "USER",
+		PrinterPollInterval:      time.Minute,
+		PrinterStatePollInterval: time.Minute,
+		JobOwnerMap: &lib.JobOwnerMap{
+			Users: map[string]string{"Alice@Example.com": "alice2"},
+			Patterns: []lib.OwnerPattern{
+				{Match: `^(\w+)@students\.example\.com$`, User: "s-$1"},
+				{Match: `^(\w+)@.*example\.com$`, User: "$1"},
+			},
+			Command: command,
+		},
+	}
+	if err = s.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		owner, want string
+	}{
+		{"alice@example.com", "alice2"},
+		{"bob@students.example.com", "s-bob"},
+		{"bob@staff.example.com", "bob"},
+		{"carol@example.org", ""},
+		{"carol@example.com", "carol"},
+	} {
+		got, err := mapOwner(test.owner, s.JobOwnerMap, s.ownerPatterns)
+		if err != nil {
+			t.Errorf("mapOwner(%q) failed: %s", test.owner, err)
+		} else if got != test.want {
+			t.Errorf("mapOwner(%q) = %q, want %q", test.owner, got, test.want)
+		}
+	}
+
+	// The command is tried after the patterns.
+	s.JobOwnerMap.Patterns = nil
+	if err = s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mapOwner("carol@example.com", s.JobOwnerMap, s.ownerPatterns); err != nil || got != "carol-ldap" {
+		t.Errorf("mapOwner with the command = %q, %v; want carol-ldap", got, err)
+	}
+}
+
+func TestMapOwnerCommandFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(timeout time.Duration) { ownerMapCommandTimeout = timeout }(ownerMapCommandTimeout)
+	ownerMapCommandTimeout = 100 * time.Millisecond
+
+	for _, script := range []string{
+		"exit 1",
+		"echo two words",
+		// The sleep holds standard output open after the script is killed.
+		"sleep 60; echo late",
+	} {
+		m := &lib.JobOwnerMap{Command: writeOwnerMapCommand(t, dir, script)}
+		start := time.Now()
+		if got, err := mapOwner("alice@example.com", m, nil); err == nil {
+			t.Errorf("Command %q mapped to %q, want an error", script, got)
+		}
+		if elapsed := time.Since(start); elapsed > 4*time.Second {
+			t.Errorf("Command %q returned after %s", script, elapsed)
+		}
+	}
+}
+
+func TestValidateOwnerPatterns(t *testing.T) {
+	s := Settings{
+		ShareRole:                "USER",
+		PrinterPollInterval:      time.Minute,
+		PrinterStatePollInterval: time.Minute,
+		JobOwnerMap:              &lib.JobOwnerMap{Patterns: []lib.OwnerPattern{{Match: "(", User: "x"}}},
+	}
+	if err := s.validate(); err == nil {
+		t.Errorf("Invalid pattern accepted")
+	}
+}
+
+func TestJobUserOfLocalJob(t *testing.T) {
+	m := &lib.JobOwnerMap{Users: map[string]string{"alice@example.com": "alice"}}
+	for _, test := range []struct {
+		s    Settings
+		want string
+	}{
+		{Settings{JobOwnerMap: m, JobFullUsername: true}, localJobUser},
+		{Settings{JobOwnerMap: m, JobUser: "printing"}, "printing"},
+	} {
+		pm := &PrinterManager{s: test.s}
+		job := &lib.Job{OwnerID: "alice@example.com", Local: true}
+		if got := pm.jobUser(job); got != test.want {
+			t.Errorf("jobUser of a local job with %+v = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestAddJobAttributesOfLocalJob(t *testing.T) {
+	pm := &PrinterManager{s: Settings{JobAccountingOwner: true}}
+	var ticket cdd.CloudJobTicket
+	pm.addJobAttributes(&lib.Job{OwnerID: "alice@example.com", Local: true}, "printer1", &ticket)
+	if len(ticket.Print.VendorTicketItem) > 0 {
+		t.Errorf("Local job has vendor ticket items %+v, want none", ticket.Print.VendorTicketItem)
+	}
+	pm.addJobAttributes(&lib.Job{OwnerID: "alice@example.com"}, "printer1", &ticket)
+	if len(ticket.Print.VendorTicketItem) != 1 || ticket.Print.VendorTicketItem[0].Value != "alice@example.com" {
+		t.Errorf("GCP job has vendor ticket items %+v, want the owner", ticket.Print.VendorTicketItem)
+	}
+}
@@ -8,110 +8,502 @@ https://developers.google.com/open-source/licenses/bsd
 package manager
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/cups-connector/audit"
 	"github.com/google/cups-connector/cdd"
-	"github.com/google/cups-connector/cups"
+	"github.com/google/cups-connector/directory"
 	"github.com/google/cups-connector/gcp"
+	"github.com/google/cups-connector/history"
 	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/logger"
+	"github.com/google/cups-connector/metrics"
+	"github.com/google/cups-connector/privet"
 	"github.com/google/cups-connector/snmp"
 	"github.com/google/cups-connector/xmpp"
 
 	"github.com/golang/glog"
 )
 
+// When the CUPS server can't be reached while following a job, keep
+// trying for this long before giving up on the job. cupsd restarts
+// are usually much quicker than this.
+const cupsUnreachableTimeout = 5 * time.Minute
+
 // Manages all interactions between CUPS and Google Cloud Print.
 type PrinterManager struct {
-	cups *cups.CUPS
-	gcp  *gcp.GoogleCloudPrint
-	xmpp *xmpp.XMPP
-	snmp *snmp.SNMPManager
+	backend PrintBackend
+	gcp     *gcp.GoogleCloudPrint
+	xmpp    *xmpp.XMPP
+	snmp    *snmp.SNMPManager
+
+	// Nil when local printing is disabled.
+	privet *privet.Privet
 
 	// Do not mutate this map, only replace it with a new one. See syncPrinters().
 	gcpPrintersByGCPID *lib.ConcurrentPrinterMap
-	downloadSemaphore  *lib.Semaphore
+	// Held while replacing gcpPrintersByGCPID contents.
+	syncMutex sync.Mutex
 
 	// Job stats are numbers reported to monitoring.
 	jobStatsMutex sync.Mutex
 	jobsDone      uint
 	jobsError     uint
+	// Job stats of each printer, by GCP ID. Guarded by jobStatsMutex.
+	printerJobStats map[string]*printerJobStats
 
 	// Jobs in flight are jobs that have been received, and are not
-	// finished printing yet. Key is the GCP Job ID; value is meaningless.
+	// finished printing yet. Key is the GCP Job ID.
 	jobsInFlightMutex sync.Mutex
-	jobsInFlight      map[string]struct{}
-
-	cupsQueueSize     uint
-	jobFullUsername   bool
-	ignoreRawPrinters bool
-	shareScope        string
+	jobsInFlight      map[string]*JobStatus
+	// The last recentJobsQuantity jobs to finish, oldest first. Guarded by
+	// jobsInFlightMutex.
+	recentJobs []JobStatus
+
+	// Fetched jobs that wait to be processed, by GCP printer ID, and the
+	// printers that have such jobs, in the order that they take turns; see
+	// dispatchJobs. Guarded by dispatchMutex, like the quantity of
+	// dispatched jobs that aren't submitted to CUPS yet, in total and by
+	// printer, and when each printer last had a job dispatched.
+	dispatchMutex        sync.Mutex
+	dispatchQueues       map[string][]*lib.Job
+	dispatchQueued       map[string]struct{}
+	dispatchOrder        []string
+	dispatching          uint
+	dispatchingByPrinter map[string]uint
+	lastDispatch         map[string]time.Time
+	dispatchWake         chan struct{}
+
+	// The XMPP ping interval that the printers' local settings ask for; see
+	// updateXMPPPingInterval.
+	xmppPingIntervalMutex sync.Mutex
+	xmppPingInterval      time.Duration
+
+	// Names of printers whose jobs are left queued in GCP; see PausePrinter.
+	pausedPrintersMutex sync.Mutex
+	pausedPrinters      map[string]struct{}
+
+	// Outcome of the last printer sync, for SyncStatus.
+	syncStatusMutex sync.Mutex
+	syncStatus      SyncStatus
+
+	// Settings that Reconfigure may change, and the download semaphore,
+	// which is replaced when its size changes.
+	settingsMutex     sync.RWMutex
+	s                 Settings
+	downloadSemaphore *lib.Semaphore
+	// Poll interval changes are sent to the poll loops on these.
+	printerPollIntervalUpdates      chan time.Duration
+	printerStatePollIntervalUpdates chan time.Duration
+	// Requests to synchronize printers before the next poll.
+	printerSyncRequests chan struct{}
+
+	// When printers are sharded across GCP accounts, this manager handles
+	// the printers in shard; sharder is nil otherwise.
+	sharder *lib.Sharder
+	shard   int
+
+	// File to save the GCP printer list in; empty when not cached.
+	printerCacheFile string
+	// True while the GCP printer list came from the cache, because GCP
+	// was unreachable at startup. Guarded by syncMutex.
+	degraded bool
+
+	// Whether to leave jobs queued in GCP for printers with SNMP faults.
+	snmpPauseOnFault bool
+
+	// Pages that each printer printed today, by GCP ID, to enforce daily
+	// quotas, and the pages reserved by jobs that print; see reserveQuota.
+	// Guarded by quotaMutex.
+	quotaMutex    sync.Mutex
+	pagesPrinted  map[string]*dailyPages
+	quotaReserved map[string]uint
+
+	// Whether GCP rejects the connector's credentials; see
+	// credentialsRevoked. Guarded by credentialsMutex.
+	credentialsMutex sync.Mutex
+	revoked          bool
+
+	// When GCP became unreachable, zero while it's reachable, and the local
+	// jobs that each printer took since, by GCP ID; see setGCPReachable.
+	// Guarded by offlineMutex.
+	offlineMutex sync.Mutex
+	offlineSince time.Time
+	offlineJobs  map[string]uint
+
+	// Directory whose group members printers are shared with, as users,
+	// and the members that it resolved last; see resolveMembersPeriodically.
+	// directory is nil when printers aren't shared so. Guarded by
+	// directoryMutex.
+	directory         directory.Resolver
+	directoryMutex    sync.Mutex
+	directoryMembers  []string
+	directoryResolved bool
+
+	// Printers whose queued jobs couldn't be fetched at startup, by GCP ID;
+	// see refetchPeriodically. Guarded by refetchMutex.
+	refetchMutex    sync.Mutex
+	refetchPrinters map[string]struct{}
+
+	// When each printer's device last answered, and the printers whose
+	// devices don't, by name; see printerReachable. Guarded by probeMutex.
+	probeMutex     sync.Mutex
+	deviceLastSeen map[string]time.Time
+	unreachable    map[string]struct{}
+
+	// Where finished jobs and printer state changes are recorded; nil when
+	// they aren't.
+	jobHistory *history.Store
+
+	// Where received and finished jobs are audited; nil when they aren't.
+	auditLog *audit.Log
+
+	// Name of this connector instance, tagged on its printers; see
+	// lib.InstanceTagKey.
+	instance string
+
+	// Temporary files that job documents are downloaded to.
+	spool *lib.Spool
+
+	// Where the documents of failed jobs are kept, and how many; see
+	// quarantineJob. Empty when they're removed.
+	quarantineDir     string
+	quarantineMaxJobs uint
+	quarantineMutex   sync.Mutex
+
+	// When each main loop last reported that it is alive; see Alive.
+	heartbeatsMutex sync.Mutex
+	heartbeats      map[string]time.Time
 
 	quit chan struct{}
 }
 
-func NewPrinterManager(cups *cups.CUPS, gcp *gcp.GoogleCloudPrint, xmpp *xmpp.XMPP, snmp *snmp.SNMPManager, printerPollInterval string, gcpMaxConcurrentDownload, cupsQueueSize uint, jobFullUsername, ignoreRawPrinters bool, shareScope string) (*PrinterManager, error) {
+// Options are what NewPrinterManager makes a PrinterManager of.
+type Options struct {
+	Backend PrintBackend
+	GCP     *gcp.GoogleCloudPrint
+	XMPP    *xmpp.XMPP
+	// Nil when SNMP is disabled.
+	SNMP *snmp.SNMPManager
+	// Nil when local printing is disabled.
+	Privet *privet.Privet
+
+	// Settings that Reconfigure may change later.
+	Settings Settings
+
+	// GCP IDs of printers whose share invites are accepted.
+	AcceptInvites []string
+	// Bounds of the interval between job polls while XMPP is down.
+	FallbackPollIntervalMin time.Duration
+	FallbackPollIntervalMax time.Duration
+	// File to save the GCP printer list in; empty when not cached.
+	PrinterCacheFile string
+	// When printers are sharded across GCP accounts, the manager handles
+	// the printers in Shard; Sharder is nil otherwise.
+	Sharder *lib.Sharder
+	Shard   int
+	// How often SNMP state is polled, and whether to leave jobs queued in
+	// GCP for printers with SNMP faults.
+	SNMPPollInterval time.Duration
+	SNMPPauseOnFault bool
+	// Where finished jobs and printer state changes are recorded, and where
+	// jobs are audited; nil when they aren't.
+	JobHistory *history.Store
+	AuditLog   *audit.Log
+	// Name of this connector instance, and whether to refuse to start when
+	// another instance registered printers under the same proxy name.
+	Instance            string
+	RefuseProxyConflict bool
+	// Temporary files that job documents are downloaded to.
+	Spool *lib.Spool
+	// Where the documents of failed jobs are kept, and how many; empty
+	// QuarantineDir removes them.
+	QuarantineDir     string
+	QuarantineMaxJobs uint
+	// Directory whose group members printers are shared with, and how often
+	// it is resolved; nil when printers aren't shared so.
+	Directory         directory.Resolver
+	DirectoryInterval time.Duration
+}
+
+func NewPrinterManager(o Options) (*PrinterManager, error) {
+	settings := o.Settings
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+
 	// Get the GCP printer list.
-	gcpPrinters, queuedJobsCount, err := allGCPPrinters(gcp)
+	var degraded bool
+	gcpPrinters, queuedJobsCount, err := allGCPPrinters(o.GCP)
 	if err != nil {
+		if o.PrinterCacheFile == "" {
+			return nil, err
+		}
+		// Start with the last known printers, rather than not at all.
+		cachedPrinters, cacheErr := lib.LoadPrinterCache(o.PrinterCacheFile)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("Failed to get GCP printers (%s), and no cached printers: %s", err, cacheErr)
+		}
+		glog.Warningf("Failed to get GCP printers; starting with %d cached printers until GCP is reachable: %s", len(cachedPrinters), err)
+		gcpPrinters, queuedJobsCount, degraded = cachedPrinters, map[string]uint{}, true
+	} else if err = checkProxyConflict(gcpPrinters, o.GCP.ProxyName(), o.Instance, o.RefuseProxyConflict); err != nil {
 		return nil, err
 	}
 	// Organize the GCP printers into a map.
 	for i := range gcpPrinters {
-		gcpPrinters[i].CUPSJobSemaphore = lib.NewSemaphore(cupsQueueSize)
+		gcpPrinters[i].CUPSJobSemaphore = lib.NewSemaphore(settings.CUPSQueueSize)
 	}
 	gcpPrintersByGCPID := lib.NewConcurrentPrinterMap(gcpPrinters)
 
 	// Construct.
 	pm := PrinterManager{
-		cups: cups,
-		gcp:  gcp,
-		xmpp: xmpp,
-		snmp: snmp,
+		backend: o.Backend,
+		gcp:     o.GCP,
+		xmpp:    o.XMPP,
+		snmp:    o.SNMP,
+
+		privet: o.Privet,
 
 		gcpPrintersByGCPID: gcpPrintersByGCPID,
-		downloadSemaphore:  lib.NewSemaphore(gcpMaxConcurrentDownload),
 
 		jobStatsMutex: sync.Mutex{},
 		jobsDone:      0,
 		jobsError:     0,
 
+		printerJobStats: make(map[string]*printerJobStats),
+
 		jobsInFlightMutex: sync.Mutex{},
-		jobsInFlight:      make(map[string]struct{}),
+		jobsInFlight:      make(map[string]*JobStatus),
+
+		pausedPrinters: make(map[string]struct{}),
 
-		cupsQueueSize:     cupsQueueSize,
-		jobFullUsername:   jobFullUsername,
-		ignoreRawPrinters: ignoreRawPrinters,
-		shareScope:        shareScope,
+		s:                               settings,
+		downloadSemaphore:               lib.NewSemaphore(settings.GCPMaxConcurrentDownload),
+		printerPollIntervalUpdates:      make(chan time.Duration, 1),
+		printerStatePollIntervalUpdates: make(chan time.Duration, 1),
+		printerSyncRequests:             make(chan struct{}, 1),
+
+		sharder: o.Sharder,
+		shard:   o.Shard,
+
+		printerCacheFile: o.PrinterCacheFile,
+		degraded:         degraded,
+
+		heartbeats: make(map[string]time.Time),
+
+		snmpPauseOnFault: o.SNMPPauseOnFault,
+		deviceLastSeen:   make(map[string]time.Time),
+		unreachable:      make(map[string]struct{}),
+		pagesPrinted:     make(map[string]*dailyPages),
+		quotaReserved:    make(map[string]uint),
+		refetchPrinters:  make(map[string]struct{}),
+		offlineJobs:      make(map[string]uint),
+
+		jobHistory: o.JobHistory,
+		auditLog:   o.AuditLog,
+		instance:   o.Instance,
+		spool:      o.Spool,
+
+		quarantineDir:     o.QuarantineDir,
+		quarantineMaxJobs: o.QuarantineMaxJobs,
+
+		directory: o.Directory,
+
+		dispatchQueues:       make(map[string][]*lib.Job),
+		dispatchQueued:       make(map[string]struct{}),
+		dispatchingByPrinter: make(map[string]uint),
+		lastDispatch:         make(map[string]time.Time),
+		dispatchWake:         make(chan struct{}, 1),
 
 		quit: make(chan struct{}),
 	}
+	pm.countPagesOfHistory()
+
+	if degraded {
+		// syncPrinters reloads the GCP printer list once GCP is reachable.
+		glog.Warning("Printers will be synchronized once GCP is reachable")
+		pm.offlineSince = time.Now()
+		if pm.privet != nil {
+			// Local clients can print to the cached printers meanwhile.
+			for _, printer := range gcpPrinters {
+				pm.announceLocally(printer)
+			}
+			pm.announceConnectionState()
+		}
+	} else {
+		pm.savePrinterCache()
 
-	// Sync once before returning, to make sure things are working.
-	if err = pm.syncPrinters(); err != nil {
-		return nil, err
+		// Sync once before returning, to make sure things are working.
+		if err = pm.syncPrinters(); err != nil {
+			return nil, err
+		}
 	}
 
-	ppi, err := time.ParseDuration(printerPollInterval)
-	if err != nil {
-		return nil, err
+	if o.GCP.CanShare() && o.Directory != nil {
+		// Sharing is reconciled once the directory's members are known, so
+		// that share_revoke_unlisted doesn't unshare them meanwhile.
+		pm.resolveMembersPeriodically(o.DirectoryInterval)
+	} else if o.GCP.CanShare() && !degraded {
+		// Apply scope changes to printers registered before the changes.
+		go pm.reconcileSharing()
+	}
+
+	// Apply local settings that changed while the connector was down.
+	for i := range gcpPrinters {
+		if gcpPrinters[i].PendingSettings != nil {
+			go pm.reconcileLocalSettings(&gcpPrinters[i])
+		}
+	}
+	pm.updateXMPPPingInterval()
+
+	pm.syncPrintersPeriodically(settings.PrinterPollInterval)
+	if len(o.AcceptInvites) > 0 {
+		pm.acceptInvitesPeriodically(o.AcceptInvites, settings.PrinterPollInterval)
 	}
-	pm.syncPrintersPeriodically(ppi)
+	if o.SNMP == nil {
+		pm.syncPrinterStatesPeriodically(settings.PrinterStatePollInterval)
+	} else {
+		// SNMP state augments CUPS state, so both are polled at the
+		// slower SNMP poll interval.
+		pm.syncPrinterStatesPeriodically(o.SNMPPollInterval)
+	}
+	pm.dispatchJobs()
 	pm.listenXMPPNotifications()
+	pm.pollJobsWithoutXMPP(o.FallbackPollIntervalMin, o.FallbackPollIntervalMax)
+	pm.refetchPeriodically()
 
 	for gcpID := range queuedJobsCount {
-		go pm.handlePrinterNewJobs(gcpID)
+		go pm.fetchQueuedJobs(gcpID)
 	}
 
 	return &pm, nil
 }
 
+// shareScopesFor returns the scopes to share a printer with, including the
+// members of directory groups.
+func (pm *PrinterManager) shareScopesFor(printerName string) []string {
+	s := pm.settings()
+	members := pm.directoryMembersScopes()
+	scopes := make([]string, 0, len(s.ShareScopes)+len(s.PrinterShareScopes[printerName])+len(members))
+	seen := make(map[string]struct{}, cap(scopes))
+	for _, list := range [][]string{s.ShareScopes, s.PrinterShareScopes[printerName], members} {
+		for _, scope := range list {
+			if _, exists := seen[scope]; !exists && scope != "" {
+				seen[scope] = struct{}{}
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// sharePrinter shares a printer with all of its scopes.
+func (pm *PrinterManager) sharePrinter(printer *lib.Printer) {
+	for _, scope := range pm.shareScopesFor(printer.Name) {
+		pm.share(printer, scope)
+	}
+}
+
+func (pm *PrinterManager) share(printer *lib.Printer, scope string) {
+	role := pm.settings().ShareRole
+	if err := pm.gcp.Share(printer.GCPID, scope, role); err != nil {
+		glog.Errorf("Failed to share printer %s with %s: %s", printer.Name, scope, err)
+	} else {
+		glog.Infof("Shared %s with %s as %s", printer.Name, scope, role)
+	}
+}
+
+// reconcileSharing makes the sharing of all printers match the config.
+// Configured scopes that are missing, or have a different role, are shared.
+// Other scopes are unshared when ShareRevokeUnlisted is true. The owner's
+// access is never changed.
+func (pm *PrinterManager) reconcileSharing() {
+	s := pm.settings()
+	for _, printer := range pm.gcpPrintersByGCPID.GetAll() {
+		access, err := pm.gcp.Access(printer.GCPID)
+		if err != nil {
+			glog.Errorf("Failed to get sharing of printer %s: %s", printer.Name, err)
+			continue
+		}
+
+		scopes := pm.shareScopesFor(printer.Name)
+		for _, scope := range scopes {
+			if role := access[scope]; role != s.ShareRole && role != "OWNER" {
+				pm.share(&printer, scope)
+			}
+		}
+
+		if !s.ShareRevokeUnlisted {
+			continue
+		}
+
+	nextScope:
+		for scope, role := range access {
+			if role == "OWNER" {
+				continue
+			}
+			for _, s := range scopes {
+				if s == scope {
+					continue nextScope
+				}
+			}
+			if err := pm.gcp.Unshare(printer.GCPID, scope); err != nil {
+				glog.Errorf("Failed to unshare printer %s from %s: %s", printer.Name, scope, err)
+			} else {
+				glog.Infof("Unshared %s from %s", printer.Name, scope)
+			}
+		}
+	}
+}
+
+// acceptInvitesPeriodically tries to accept share invitations for the
+// printers in gcpIDs, until all are accepted. An invitation may arrive
+// long after the connector starts.
+func (pm *PrinterManager) acceptInvitesPeriodically(gcpIDs []string, interval time.Duration) {
+	go func() {
+		pending := make(map[string]bool, len(gcpIDs))
+		for _, gcpID := range gcpIDs {
+			pending[gcpID] = false
+		}
+
+		t := time.NewTimer(0)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				for gcpID, reported := range pending {
+					if err := pm.gcp.ProcessInvite(gcpID, true); err != nil {
+						if !reported {
+							glog.Warningf("Failed to accept share invitation for printer %s; will keep trying: %s", gcpID, err)
+							pending[gcpID] = true
+						}
+						continue
+					}
+					glog.Infof("Accepted share invitation for printer %s", gcpID)
+					delete(pending, gcpID)
+				}
+				if len(pending) == 0 {
+					return
+				}
+				t.Reset(interval)
+
+			case <-pm.quit:
+				return
+			}
+		}
+	}()
+}
+
 func (pm *PrinterManager) Quit() {
 	close(pm.quit)
 }
@@ -173,18 +565,38 @@ func allGCPPrinters(gcp *gcp.GoogleCloudPrint) ([]lib.Printer, map[string]uint,
 }
 
 func (pm *PrinterManager) syncPrintersPeriodically(interval time.Duration) {
+	pm.heartbeat(syncLoop)
 	go func() {
 		t := time.NewTimer(interval)
 		defer t.Stop()
+		h := time.NewTicker(heartbeatInterval)
+		defer h.Stop()
 
 		for {
 			select {
+			case <-h.C:
+				pm.heartbeat(syncLoop)
+
 			case <-t.C:
 				if err := pm.syncPrinters(); err != nil {
-					glog.Error(err)
+					if err != errCredentialsRevoked {
+						logger.Errorf(logger.Fields{"phase": "sync"}, "%s", err)
+					}
+				} else {
+					pm.reconcileConnectionStatus()
+				}
+				t.Reset(interval)
+
+			case <-pm.printerSyncRequests:
+				if err := pm.syncPrinters(); err != nil && err != errCredentialsRevoked {
+					logger.Errorf(logger.Fields{"phase": "sync"}, "%s", err)
 				}
 				t.Reset(interval)
 
+			case interval = <-pm.printerPollIntervalUpdates:
+				glog.Infof("Printer poll interval changed to %s", interval.String())
+				t.Reset(interval)
+
 			case <-pm.quit:
 				return
 			}
@@ -192,27 +604,63 @@ func (pm *PrinterManager) syncPrintersPeriodically(interval time.Duration) {
 	}()
 }
 
-func (pm *PrinterManager) syncPrinters() error {
-	glog.Info("Synchronizing printers, stand by")
+func (pm *PrinterManager) syncPrinters() (err error) {
+	pm.syncMutex.Lock()
+	defer pm.syncMutex.Unlock()
+	// Record with syncMutex held, which guards degraded.
+	defer func() { pm.recordSync(err) }()
+	defer metrics.Since("sync.duration", time.Now(), nil)
+
+	if pm.credentialsRevoked() {
+		return errCredentialsRevoked
+	}
 
-	cupsPrinters, err := pm.cups.GetPrinters()
+	if pm.degraded {
+		if err := pm.leaveDegradedMode(); err != nil {
+			pm.setGCPReachable(false)
+			return fmt.Errorf("Not synchronizing cached printers, GCP is still unreachable: %s", err)
+		}
+		pm.setGCPReachable(true)
+	}
+
+	logger.Infof(logger.Fields{"phase": "sync"}, "Synchronizing printers, stand by")
+
+	cupsPrinters, err := pm.backend.GetPrinters()
 	if err != nil {
 		return fmt.Errorf("Sync failed while calling GetPrinters(): %s", err)
 	}
-	if pm.ignoreRawPrinters {
+	if pm.settings().IgnoreRawPrinters {
 		cupsPrinters, _ = lib.FilterRawPrinters(cupsPrinters)
 	}
+	if pm.settings().SharedPrintersOnly {
+		cupsPrinters, _ = lib.FilterUnsharedPrinters(cupsPrinters)
+	}
+	if pm.sharder != nil {
+		cupsPrinters = pm.sharder.FilterPrinters(cupsPrinters, pm.shard)
+	}
+	lib.AddPrinterTags(cupsPrinters, pm.settings().PrinterTags)
+	lib.SetDailyQuotas(cupsPrinters, pm.settings().PrinterDailyQuota)
+	lib.SetInstanceTag(cupsPrinters, pm.instance)
+	lib.SetConnectorInfo(cupsPrinters, pm.instance, time.Since(lib.StartTime))
 
 	if pm.snmp != nil {
-		pm.snmp.AugmentPrinters(cupsPrinters)
-		if err != nil {
+		if err := pm.snmp.AugmentPrinters(cupsPrinters); err != nil {
 			glog.Warningf("Failed to augment printers with SNMP data: %s", err)
 		}
 	}
 
-	diffs := lib.DiffPrinters(cupsPrinters, pm.gcpPrintersByGCPID.GetAll())
+	gcpPrinters := pm.gcpPrintersByGCPID.GetAll()
+	if queueSize := pm.settings().CUPSQueueSize; len(gcpPrinters) > 0 && gcpPrinters[0].CUPSJobSemaphore.Size() != queueSize {
+		// The queue size changed. Jobs in flight release the old semaphores.
+		for i := range gcpPrinters {
+			gcpPrinters[i].CUPSJobSemaphore = lib.NewSemaphore(queueSize)
+		}
+		pm.gcpPrintersByGCPID.Refresh(gcpPrinters)
+	}
+
+	diffs := lib.DiffPrinters(cupsPrinters, gcpPrinters)
 	if diffs == nil {
-		glog.Infof("Printers are already in sync; there are %d", len(cupsPrinters))
+		logger.Infof(logger.Fields{"phase": "sync"}, "Printers are already in sync; there are %d", len(cupsPrinters))
 		return nil
 	}
 
@@ -229,7 +677,131 @@ func (pm *PrinterManager) syncPrinters() error {
 	}
 
 	pm.gcpPrintersByGCPID.Refresh(currentPrinters)
-	glog.Infof("Finished synchronizing %d printers", len(currentPrinters))
+	pm.pruneDeviceLastSeen(currentPrinters)
+	pm.updateXMPPPingInterval()
+	pm.fetchJobsOfRecoveredPrinters(gcpPrinters, currentPrinters)
+	pm.alertPrinterChanges(gcpPrinters, currentPrinters)
+	pm.recordPrinterStateHistory(gcpPrinters, currentPrinters)
+	pm.savePrinterCache()
+	logger.Infof(logger.Fields{"phase": "sync"}, "Finished synchronizing %d printers", len(currentPrinters))
+
+	return nil
+}
+
+// leaveDegradedMode replaces the cached printers with the GCP printer list,
+// once GCP is reachable, so that printers can be synchronized. Called with
+// syncMutex held.
+func (pm *PrinterManager) leaveDegradedMode() error {
+	gcpPrinters, queuedJobsCount, err := allGCPPrinters(pm.gcp)
+	if err != nil {
+		return err
+	}
+
+	for i := range gcpPrinters {
+		// Keep the semaphores of printers that are already printing.
+		if p, exists := pm.gcpPrintersByGCPID.Get(gcpPrinters[i].GCPID); exists {
+			gcpPrinters[i].CUPSJobSemaphore = p.CUPSJobSemaphore
+		} else {
+			gcpPrinters[i].CUPSJobSemaphore = lib.NewSemaphore(pm.settings().CUPSQueueSize)
+		}
+	}
+	pm.gcpPrintersByGCPID.Refresh(gcpPrinters)
+	pm.degraded = false
+	glog.Infof("GCP is reachable; replaced cached printers with %d GCP printers", len(gcpPrinters))
+
+	if pm.gcp.CanShare() && !pm.directoryPending() {
+		go pm.reconcileSharing()
+	}
+	for gcpID := range queuedJobsCount {
+		go pm.fetchQueuedJobs(gcpID)
+	}
+
+	return nil
+}
+
+// savePrinterCache saves the GCP printer list, if a cache file is set.
+func (pm *PrinterManager) savePrinterCache() {
+	if pm.printerCacheFile == "" {
+		return
+	}
+	if err := lib.SavePrinterCache(pm.printerCacheFile, pm.gcpPrintersByGCPID.GetAll()); err != nil {
+		glog.Warning(err)
+	}
+}
+
+func (pm *PrinterManager) syncPrinterStatesPeriodically(interval time.Duration) {
+	go func() {
+		t := time.NewTimer(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				if err := pm.syncPrinterStates(); err != nil && err != errCredentialsRevoked {
+					glog.Error(err)
+				}
+				t.Reset(interval)
+
+			case interval = <-pm.printerStatePollIntervalUpdates:
+				glog.Infof("Printer state poll interval changed to %s", interval.String())
+				t.Reset(interval)
+
+			case <-pm.quit:
+				return
+			}
+		}
+	}()
+}
+
+// syncPrinterStates reports CUPS printer state changes to GCP, between
+// the (more expensive) full printer syncs.
+func (pm *PrinterManager) syncPrinterStates() error {
+	pm.syncMutex.Lock()
+	defer pm.syncMutex.Unlock()
+
+	if pm.credentialsRevoked() {
+		return errCredentialsRevoked
+	}
+	if pm.degraded {
+		// The next full sync takes care of it.
+		return nil
+	}
+
+	cupsStates, err := pm.backend.GetPrinterStates()
+	if err != nil {
+		return fmt.Errorf("State sync failed while calling GetPrinterStates(): %s", err)
+	}
+
+	printers := pm.gcpPrintersByGCPID.GetAll()
+	faults := pm.augmentStatesWithSNMP(printers, cupsStates)
+
+	oldPrinters := make([]lib.Printer, len(printers))
+	copy(oldPrinters, printers)
+	var changed bool
+	for i := range printers {
+		if f, exists := faults[printers[i].Name]; exists && !reflect.DeepEqual(f, printers[i].SNMPFaults) {
+			printers[i].SNMPFaults = f
+			changed = true
+		}
+		state, exists := cupsStates[printers[i].Name]
+		if !exists || reflect.DeepEqual(state, printers[i].State) {
+			continue
+		}
+		if err := pm.gcp.UpdateState(printers[i].GCPID, state); err != nil {
+			logger.Errorf(printerFields(&printers[i], "state"), "Failed to update state of %s: %s", printers[i].Name, err)
+			continue
+		}
+		logger.Infof(printerFields(&printers[i], "state"), "Updated state of %s", printers[i].Name)
+		printers[i].State = state
+		changed = true
+	}
+
+	if changed {
+		pm.gcpPrintersByGCPID.Refresh(printers)
+		pm.fetchJobsOfRecoveredPrinters(oldPrinters, printers)
+		pm.alertPrinterChanges(oldPrinters, printers)
+		pm.recordPrinterStateHistory(oldPrinters, printers)
+	}
 
 	return nil
 }
@@ -238,43 +810,70 @@ func (pm *PrinterManager) applyDiff(diff *lib.PrinterDiff, ch chan<- lib.Printer
 	switch diff.Operation {
 	case lib.RegisterPrinter:
 		if err := pm.gcp.Register(&diff.Printer); err != nil {
-			glog.Errorf("Failed to register printer %s: %s", diff.Printer.Name, err)
+			logger.Errorf(printerFields(&diff.Printer, "register"), "Failed to register printer %s: %s", diff.Printer.Name, err)
 			break
 		}
-		glog.Infof("Registered %s", diff.Printer.Name)
+		logger.Infof(printerFields(&diff.Printer, "register"), "Registered %s", diff.Printer.Name)
+		metrics.Count("printers.registered", 1, nil)
 
 		if pm.gcp.CanShare() {
-			if err := pm.gcp.Share(diff.Printer.GCPID, pm.shareScope); err != nil {
-				glog.Errorf("Failed to share printer %s: %s", diff.Printer.Name, err)
-			} else {
-				glog.Infof("Shared %s", diff.Printer.Name)
-			}
+			pm.sharePrinter(&diff.Printer)
 		}
 
-		diff.Printer.CUPSJobSemaphore = lib.NewSemaphore(pm.cupsQueueSize)
+		diff.Printer.CUPSJobSemaphore = lib.NewSemaphore(pm.settings().CUPSQueueSize)
+
+		if pm.privet != nil {
+			pm.announceLocally(diff.Printer)
+		}
 
 		ch <- diff.Printer
 		return
 
 	case lib.UpdatePrinter:
 		if err := pm.gcp.Update(diff); err != nil {
-			glog.Errorf("Failed to update %s: %s", diff.Printer.Name, err)
+			logger.Errorf(printerFields(&diff.Printer, "update"), "Failed to update %s: %s", diff.Printer.Name, err)
+		} else if diff.NameChanged {
+			logger.Infof(printerFields(&diff.Printer, "update"), "Updated %s, renamed in CUPS", diff.Printer.Name)
+			metrics.Count("printers.updated", 1, nil)
+		} else if diff.DeviceURIChanged {
+			logger.Infof(printerFields(&diff.Printer, "update"), "Updated %s, moved to %s",
+				diff.Printer.Name, lib.RedactDeviceURI(diff.Printer.Tags["device-uri"]))
+			metrics.Count("printers.updated", 1, nil)
+		} else if diff.CapabilitiesChanged() {
+			logger.Infof(printerFields(&diff.Printer, "update"), "Updated %s, including capabilities", diff.Printer.Name)
+			metrics.Count("printers.updated", 1, nil)
 		} else {
-			glog.Infof("Updated %s", diff.Printer.Name)
+			logger.Infof(printerFields(&diff.Printer, "update"), "Updated %s", diff.Printer.Name)
+			metrics.Count("printers.updated", 1, nil)
+		}
+
+		if pm.privet != nil && diff.Printer.LocalSettings.LocalDiscoveryEnabled() {
+			if err := pm.privet.UpdatePrinter(diff.Printer); err != nil {
+				glog.Warningf("Failed to update local announcement of printer %s: %s", diff.Printer.Name, err)
+			}
 		}
 
 		ch <- diff.Printer
 		return
 
 	case lib.DeletePrinter:
-		pm.cups.RemoveCachedPPD(diff.Printer.Name)
+		pm.backend.RemoveCachedPPD(diff.Printer.Name)
+		if pm.privet != nil && pm.privet.HasPrinter(diff.Printer.GCPID) {
+			if err := pm.privet.DeletePrinter(diff.Printer.GCPID); err != nil {
+				glog.Warningf("Failed to withdraw local announcement of printer %s: %s", diff.Printer.Name, err)
+			}
+		}
 		if err := pm.gcp.Delete(diff.Printer.GCPID); err != nil {
-			glog.Errorf("Failed to delete a printer %s: %s", diff.Printer.GCPID, err)
+			logger.Errorf(printerFields(&diff.Printer, "delete"), "Failed to delete a printer %s: %s", diff.Printer.GCPID, err)
 			break
 		}
-		glog.Infof("Deleted %s", diff.Printer.Name)
+		logger.Infof(printerFields(&diff.Printer, "delete"), "Deleted %s", diff.Printer.Name)
+		metrics.Count("printers.deleted", 1, nil)
 
 	case lib.NoChangeToPrinter:
+		if pm.privet != nil {
+			pm.announceLocally(diff.Printer)
+		}
 		ch <- diff.Printer
 		return
 	}
@@ -285,9 +884,16 @@ func (pm *PrinterManager) applyDiff(diff *lib.PrinterDiff, ch chan<- lib.Printer
 // listenXMPPNotifications processes the messages found on the xmpp.Notifications()
 // channel.
 func (pm *PrinterManager) listenXMPPNotifications() {
+	pm.heartbeat(notificationsLoop)
 	go func() {
+		h := time.NewTicker(heartbeatInterval)
+		defer h.Stop()
+
 		for {
 			select {
+			case <-h.C:
+				pm.heartbeat(notificationsLoop)
+
 			case <-pm.quit:
 				return
 
@@ -295,70 +901,236 @@ func (pm *PrinterManager) listenXMPPNotifications() {
 				switch notification.Type {
 				case xmpp.PrinterNewJobs:
 					go pm.handlePrinterNewJobs(notification.GCPID)
+				case xmpp.PrinterUpdateSettings:
+					go pm.handlePrinterUpdateSettings(notification.GCPID)
+				}
+			}
+		}
+	}()
+}
+
+// pollJobsWithoutXMPP fetches jobs for all printers while XMPP is not
+// connected, as a substitute for XMPP notifications.
+//
+// The interval between polls starts at min, and doubles each time no jobs
+// are found, up to max. When jobs are found, the interval returns to min.
+func (pm *PrinterManager) pollJobsWithoutXMPP(min, max time.Duration) {
+	go func() {
+		interval := min
+		t := time.NewTimer(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				if pm.xmpp.Connected() {
+					// Be ready to poll quickly when XMPP goes away.
+					interval = min
+
+				} else {
+					if pm.handleAllPrintersNewJobs() > 0 {
+						interval = min
+					} else {
+						interval *= 2
+						if interval > max {
+							interval = max
+						}
+					}
+					glog.Infof("XMPP is unavailable; polling for jobs again in %s", interval.String())
 				}
+				t.Reset(interval)
+
+			case <-pm.quit:
+				return
 			}
 		}
 	}()
 }
 
+// handleAllPrintersNewJobs gets and processes jobs waiting on all printers.
+//
+// Returns the quantity of jobs found.
+func (pm *PrinterManager) handleAllPrintersNewJobs() int {
+	if pm.credentialsRevoked() {
+		return 0
+	}
+
+	printers := pm.gcpPrintersByGCPID.GetAll()
+	ch := make(chan int)
+	for i := range printers {
+		go func(gcpID string) {
+			ch <- pm.handlePrinterNewJobs(gcpID)
+		}(printers[i].GCPID)
+	}
+
+	var count int
+	for _ = range printers {
+		count += <-ch
+	}
+
+	return count
+}
+
 // handlePrinterNewJobs gets and processes jobs waiting on a printer.
-func (pm *PrinterManager) handlePrinterNewJobs(gcpID string) {
-	jobs, err := pm.gcp.Fetch(gcpID)
+//
+// Returns the quantity of jobs found.
+func (pm *PrinterManager) handlePrinterNewJobs(gcpID string) int {
+	count, err := pm.fetchJobs(gcpID)
 	if err != nil {
-		glog.Errorf("Failed to fetch jobs for printer %s: %s", gcpID, err)
-		return
+		logger.Errorf(logger.Fields{"gcp_printer_id": gcpID, "phase": "fetch"}, "Failed to fetch jobs for printer %s: %s", gcpID, err)
+	}
+	return count
+}
+
+// fetchJobs gets jobs waiting on a printer, and queues them for processing,
+// unless the printer shouldn't print now.
+//
+// Returns the quantity of jobs found.
+func (pm *PrinterManager) fetchJobs(gcpID string) (int, error) {
+	if pm.credentialsRevoked() {
+		return 0, nil
+	}
+	if printer, exists := pm.gcpPrintersByGCPID.Get(gcpID); exists && pm.printerPaused(printer.Name) {
+		logger.Infof(logger.Fields{"gcp_printer_id": gcpID, "printer": printer.Name, "phase": "fetch"}, "Not fetching jobs for paused printer %s", printer.Name)
+		return 0, nil
+	} else if exists && pm.printerFaulted(printer) {
+		logger.Infof(logger.Fields{"gcp_printer_id": gcpID, "printer": printer.Name, "phase": "fetch"},
+			"Not fetching jobs for printer %s until it recovers from: %s", printer.Name, strings.Join(printer.SNMPFaults, ", "))
+		return 0, nil
+	} else if exists && !pm.printerReachable(printer) {
+		logger.Infof(logger.Fields{"gcp_printer_id": gcpID, "printer": printer.Name, "phase": "fetch"},
+			"Not fetching jobs for printer %s until its device answers", printer.Name)
+		return 0, nil
 	}
-	for i := range jobs {
-		go pm.processJob(&jobs[i])
+
+	jobs, err := pm.gcp.Fetch(gcpID)
+	if err != nil {
+		return 0, err
 	}
+	pm.refetched(gcpID)
+	pm.queueJobs(jobs)
+	return len(jobs), nil
 }
 
-func (pm *PrinterManager) incrementJobsProcessed(success bool) {
+// incrementJobsProcessed counts a finished job of a printer, by its final
+// state. message says why a failed job failed.
+func (pm *PrinterManager) incrementJobsProcessed(gcpPrinterID string, state cdd.JobState, message string) {
 	pm.jobStatsMutex.Lock()
 	defer pm.jobStatsMutex.Unlock()
 
-	if success {
+	stats, exists := pm.printerJobStats[gcpPrinterID]
+	if !exists {
+		stats = &printerJobStats{}
+		pm.printerJobStats[gcpPrinterID] = stats
+	}
+
+	var tags metrics.Tags
+	if printer, exists := pm.gcpPrintersByGCPID.Get(gcpPrinterID); exists {
+		tags = metrics.Tags{"printer": printer.Name}
+	}
+
+	switch {
+	case state.Type == "DONE":
 		pm.jobsDone += 1
-	} else {
+		stats.done += 1
+		metrics.Count("jobs.done", 1, tags)
+		pm.alertJobErrorRate(gcpPrinterID, stats, false)
+	case jobCancelled(state):
+		// A cancelled job is neither done nor failed.
+		stats.cancelled += 1
+		metrics.Count("jobs.cancelled", 1, tags)
+	default:
 		pm.jobsError += 1
+		stats.errored += 1
+		stats.lastError, stats.lastErrorTime = message, time.Now()
+		metrics.Count("jobs.error", 1, tags)
+		pm.alertJobErrorRate(gcpPrinterID, stats, true)
 	}
 }
 
-// addInFlightJob adds a job GCP ID to the in flight set.
+// jobCancelled says whether a job state means that a user cancelled the job.
+func jobCancelled(state cdd.JobState) bool {
+	return state.Type == "ABORTED" && state.UserActionCause != nil && state.UserActionCause.ActionCode == "CANCELLED"
+}
+
+// addInFlightJob adds a job to the in flight set.
 //
-// Returns true if the job GCP ID was added, false if it already exists.
-func (pm *PrinterManager) addInFlightJob(gcpJobID string) bool {
+// Returns true if the job was added, false if it already exists.
+func (pm *PrinterManager) addInFlightJob(job *lib.Job) bool {
 	pm.jobsInFlightMutex.Lock()
 	defer pm.jobsInFlightMutex.Unlock()
 
-	if _, exists := pm.jobsInFlight[gcpJobID]; exists {
+	if _, exists := pm.jobsInFlight[job.GCPJobID]; exists {
 		return false
 	}
 
-	pm.jobsInFlight[gcpJobID] = struct{}{}
+	pm.jobsInFlight[job.GCPJobID] = &JobStatus{
+		GCPJobID:     job.GCPJobID,
+		GCPPrinterID: job.GCPPrinterID,
+		Title:        job.Title,
+		OwnerID:      job.OwnerID,
+		State:        "QUEUED",
+		Phase:        "receive",
+		Received:     time.Now(),
+	}
 
 	return true
 }
 
+// updateInFlightJob changes the status of an in flight job.
+func (pm *PrinterManager) updateInFlightJob(gcpJobID string, update func(*JobStatus)) {
+	pm.jobsInFlightMutex.Lock()
+	defer pm.jobsInFlightMutex.Unlock()
+
+	if status, exists := pm.jobsInFlight[gcpJobID]; exists {
+		update(status)
+	}
+}
+
 // deleteInFlightJob deletes a job from the in flight set.
+// The job moves to the recent jobs; see RecentJobs.
 func (pm *PrinterManager) deleteInFlightJob(gcpID string) {
 	pm.jobsInFlightMutex.Lock()
 	defer pm.jobsInFlightMutex.Unlock()
 
+	if status, exists := pm.jobsInFlight[gcpID]; exists {
+		status.Finished = time.Now()
+		metrics.Timing("jobs.duration", status.Finished.Sub(status.Received),
+			metrics.Tags{"printer": status.PrinterName, "state": status.State})
+		pm.recentJobs = append(pm.recentJobs, *status)
+		if len(pm.recentJobs) > recentJobsQuantity {
+			pm.recentJobs = pm.recentJobs[len(pm.recentJobs)-recentJobsQuantity:]
+		}
+		go pm.recordJobHistory(*status)
+		go pm.auditJobFinished(*status)
+	}
 	delete(pm.jobsInFlight, gcpID)
 }
 
-// assembleJob prepares for printing a job by fetching the job's printer,
-// ticket, and the job's PDF (what we're printing)
-//
-// The caller is responsible to remove the returned PDF file.
+// recordJobPhase records how long a job spent in phase, in the
+// jobs.phase.<phase> histogram and in the job's status.
+func (pm *PrinterManager) recordJobPhase(job *lib.Job, printerName, phase string, d time.Duration) {
+	metrics.Timing("jobs.phase."+phase, d, metrics.Tags{"printer": printerName})
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		// Copy, as callers of InFlightJobs may hold the old map.
+		phaseSeconds := make(map[string]float64, len(status.PhaseSeconds)+1)
+		for p, seconds := range status.PhaseSeconds {
+			phaseSeconds[p] = seconds
+		}
+		phaseSeconds[phase] += d.Seconds()
+		status.PhaseSeconds = phaseSeconds
+	})
+}
+
+// assembleJob prepares for printing a job by fetching the job's printer
+// and ticket.
 //
 // Errors are returned as a string (last return value), for reporting
 // to GCP and local logging.
-func (pm *PrinterManager) assembleJob(job *lib.Job) (lib.Printer, cdd.CloudJobTicket, *os.File, string, cdd.PrintJobStateDiff) {
+func (pm *PrinterManager) assembleJob(job *lib.Job) (lib.Printer, cdd.CloudJobTicket, string, cdd.PrintJobStateDiff) {
 	printer, exists := pm.gcpPrintersByGCPID.Get(job.GCPPrinterID)
 	if !exists {
-		return lib.Printer{}, cdd.CloudJobTicket{}, nil,
+		return lib.Printer{}, cdd.CloudJobTicket{},
 			fmt.Sprintf("Failed to find GCP printer %s for job %s", job.GCPPrinterID, job.GCPJobID),
 			cdd.PrintJobStateDiff{
 				State: cdd.JobState{
@@ -370,7 +1142,7 @@ func (pm *PrinterManager) assembleJob(job *lib.Job) (lib.Printer, cdd.CloudJobTi
 
 	ticket, err := pm.gcp.Ticket(job.GCPJobID)
 	if err != nil {
-		return lib.Printer{}, cdd.CloudJobTicket{}, nil,
+		return lib.Printer{}, cdd.CloudJobTicket{},
 			fmt.Sprintf("Failed to get a ticket for job %s: %s", job.GCPJobID, err),
 			cdd.PrintJobStateDiff{
 				State: cdd.JobState{
@@ -380,9 +1152,21 @@ func (pm *PrinterManager) assembleJob(job *lib.Job) (lib.Printer, cdd.CloudJobTi
 			}
 	}
 
-	pdfFile, err := cups.CreateTempFile()
+	return printer, ticket, "", cdd.PrintJobStateDiff{}
+}
+
+// downloadJob downloads the job's document (what we're printing) to a
+// temporary file, as format, or as GCP chooses when format is "", and
+// detects its content type.
+//
+// The caller is responsible to remove the returned file.
+//
+// Errors are returned as a string (last return value), for reporting
+// to GCP and local logging.
+func (pm *PrinterManager) downloadJob(job *lib.Job, printerName, format string) (*os.File, string, string, cdd.PrintJobStateDiff) {
+	pdfFile, err := pm.backend.CreateTempFile()
 	if err != nil {
-		return lib.Printer{}, cdd.CloudJobTicket{}, nil,
+		return nil, "",
 			fmt.Sprintf("Failed to create a temporary file for job %s: %s", job.GCPJobID, err),
 			cdd.PrintJobStateDiff{
 				State: cdd.JobState{
@@ -392,94 +1176,491 @@ func (pm *PrinterManager) assembleJob(job *lib.Job) (lib.Printer, cdd.CloudJobTi
 			}
 	}
 
-	pm.downloadSemaphore.Acquire()
-	t := time.Now()
-	// Do not check err until semaphore is released and timer is stopped.
-	err = pm.gcp.Download(pdfFile, job.FileURL)
-	dt := time.Since(t)
-	pm.downloadSemaphore.Release()
+	w, err := pm.spool.Writer(pdfFile)
 	if err != nil {
-		// Clean up this temporary file so the caller doesn't need extra logic.
-		os.Remove(pdfFile.Name())
-		return lib.Printer{}, cdd.CloudJobTicket{}, nil,
-			fmt.Sprintf("Failed to download PDF for job %s: %s", job.GCPJobID, err),
+		pdfFile.Close()
+		pm.spool.Remove(pdfFile.Name())
+		return nil, "",
+			fmt.Sprintf("Failed to prepare a temporary file for job %s: %s", job.GCPJobID, err),
 			cdd.PrintJobStateDiff{
 				State: cdd.JobState{
 					Type:              "STOPPED",
-					DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "DOWNLOAD_FAILURE"},
+					DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "OTHER"},
 				},
 			}
 	}
 
-	glog.Infof("Downloaded job %s in %s", job.GCPJobID, dt.String())
+	downloadSemaphore := pm.getDownloadSemaphore()
+	downloadSemaphore.Acquire()
+	t := time.Now()
+	// Do not check err until semaphore is released and timer is stopped.
+	declaredContentType, err := pm.gcp.Download(w, job.FileURL, format, pm.maxDownloadSize())
+	dt := time.Since(t)
+	downloadSemaphore.Release()
+	pm.recordJobPhase(job, printerName, "download", dt)
+	if err != nil {
+		// Clean up this temporary file so the caller doesn't need extra logic.
+		pdfFile.Close()
+		pm.spool.Remove(pdfFile.Name())
+		if _, ok := err.(*gcp.DownloadTooLargeError); ok {
+			return nil, "", fmt.Sprintf("Failed to download document for job %s: %s; see gcp_max_download_mb", job.GCPJobID, err),
+				downloadTooLargeState
+		}
+		return nil, "",
+			fmt.Sprintf("Failed to download document for job %s: %s", job.GCPJobID, err),
+			downloadFailureState
+	}
+
+	logger.Infof(jobFields(job, "download"), "Downloaded job %s in %s", job.GCPJobID, dt.String())
+
 	pdfFile.Close()
+	head := make([]byte, lib.ContentTypeSniffLen)
+	var n int
+	if r, err := pm.spool.Open(pdfFile.Name()); err == nil {
+		n, _ = io.ReadFull(r, head)
+		r.Close()
+	}
+	contentType := lib.DetectContentType(head[:n], declaredContentType)
+	if !lib.ContentTypeSupported(contentType) {
+		pm.spool.Remove(pdfFile.Name())
+		return nil, "", fmt.Sprintf("Failed to print job %s: %s", job.GCPJobID, &unsupportedContentTypeError{contentType}),
+			unsupportedContentTypeState
+	}
+
+	return pdfFile, contentType, "", cdd.PrintJobStateDiff{}
+}
+
+// unsupportedContentTypeError is returned when a job document can't be
+// printed by CUPS.
+type unsupportedContentTypeError struct {
+	contentType string
+}
+
+func (e *unsupportedContentTypeError) Error() string {
+	if e.contentType == "" {
+		return "document content type not recognized"
+	}
+	return fmt.Sprintf("document content type %s not supported", e.contentType)
+}
+
+// maxDownloadSize returns the maximum size, in bytes, of a job document, or
+// zero when there's no limit.
+func (pm *PrinterManager) maxDownloadSize() int64 {
+	return int64(pm.settings().MaxDownloadMB) << 20
+}
 
-	return printer, ticket, pdfFile, "", cdd.PrintJobStateDiff{}
+// downloadFailureState reports a job document that couldn't be downloaded
+// to GCP.
+var downloadFailureState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:              "STOPPED",
+		DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "DOWNLOAD_FAILURE"},
+	},
+}
+
+// downloadError is returned when a job document couldn't be downloaded
+// while it was streamed.
+type downloadError struct {
+	err error
+}
+
+func (e *downloadError) Error() string {
+	return fmt.Sprintf("Failed to download document: %s", e.err)
+}
+
+// downloadTooLargeState reports a job document larger than the maximum
+// size to GCP.
+var downloadTooLargeState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:               "ABORTED",
+		ServiceActionCause: &cdd.ServiceActionCause{ErrorCode: "CONVERSION_FILE_TOO_BIG"},
+	},
+}
+
+// unsupportedContentTypeState reports an unsupported job document to GCP.
+var unsupportedContentTypeState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:               "STOPPED",
+		ServiceActionCause: &cdd.ServiceActionCause{ErrorCode: "CONVERSION_UNSUPPORTED_CONTENT_TYPE"},
+	},
+}
+
+// failJob logs a job failure, and reports it to GCP.
+//
+// While GCP rejects the connector's credentials, which likely caused the
+// failure, and which keep it from being reported, the job is left queued in
+// GCP instead, to be fetched again once the connector is re-authorized.
+func (pm *PrinterManager) failJob(job *lib.Job, message string, state cdd.PrintJobStateDiff) {
+	if !job.Local && pm.credentialsRevoked() {
+		logger.Infof(jobFields(job, "fail"), "Leaving job %s queued in GCP until the connector is re-authorized: %s", job.GCPJobID, message)
+		return
+	}
+
+	pm.incrementJobsProcessed(job.GCPPrinterID, state.State, message)
+	logger.Errorf(jobFields(job, "fail"), "%s", message)
+	pm.setJobState(job.GCPJobID, state.State.Type, message)
+	if err := pm.controlJob(job, state); err != nil {
+		logger.Errorf(jobFields(job, "report"), "%s", err)
+	}
+}
+
+// controlJob reports the state of a job to GCP, unless the job is local,
+// which GCP doesn't know.
+func (pm *PrinterManager) controlJob(job *lib.Job, state cdd.PrintJobStateDiff) error {
+	if job.Local {
+		return nil
+	}
+	return pm.gcp.Control(job.GCPJobID, state)
+}
+
+// jobFields returns the log fields of a job in a processing phase.
+func jobFields(job *lib.Job, phase string) logger.Fields {
+	return logger.Fields{"gcp_job_id": job.GCPJobID, "gcp_printer_id": job.GCPPrinterID, "phase": phase}
+}
+
+// cupsJobFields returns the log fields of a job in CUPS.
+func cupsJobFields(job *lib.Job, cupsJobID uint32, phase string) logger.Fields {
+	fields := jobFields(job, phase)
+	fields["cups_job_id"] = cupsJobID
+	return fields
+}
+
+// printerFields returns the log fields of a printer in a sync phase.
+func printerFields(printer *lib.Printer, phase string) logger.Fields {
+	return logger.Fields{"printer": printer.Name, "gcp_printer_id": printer.GCPID, "phase": phase}
 }
 
 // processJob performs these steps:
 //
-// 1) Assembles the job resources (printer, ticket, PDF)
-// 2) Creates a new job in CUPS.
+// 1) Assembles the job resources (printer, ticket)
+// 2) Streams the document into a new CUPS job, or else downloads it to
+// a temporary file and creates a new job in CUPS from it.
 // 3) Follows up with the job state until done or error.
-// 4) Deletes temporary file.
+//
+// submitted is called once the job is in CUPS, or has failed; see
+// dispatchJobs.
 //
 // Nothing is returned; intended for use as goroutine.
-func (pm *PrinterManager) processJob(job *lib.Job) {
-	if !pm.addInFlightJob(job.GCPJobID) {
+func (pm *PrinterManager) processJob(job *lib.Job, submitted func()) {
+	defer submitted()
+	if !pm.addInFlightJob(job) {
 		// This print job was already received. We probably received it
 		// again because the first instance is still queued (ie not
 		// IN_PROGRESS). That's OK, just throw away the second instance.
 		return
 	}
 	defer pm.deleteInFlightJob(job.GCPJobID)
+	defer pm.removeJobDocument(job)
 
-	glog.Infof("Received job %s", job.GCPJobID)
+	logger.Infof(jobFields(job, "receive"), "Received job %s", job.GCPJobID)
+	metrics.Count("jobs.received", 1, nil)
+	pm.auditJobReceived(job)
 
-	printer, ticket, pdfFile, message, state := pm.assembleJob(job)
-	if message != "" {
-		pm.incrementJobsProcessed(false)
-		glog.Error(message)
-		if err := pm.gcp.Control(job.GCPJobID, state); err != nil {
-			glog.Error(err)
-		}
+	if !ownerAllowed(job.OwnerID, pm.settings().JobOwnerAllowlist) {
+		pm.failJob(job, fmt.Sprintf("Refusing job %s: owner %s isn't in job_owner_allowlist", job.GCPJobID, job.OwnerID),
+			ownerForbiddenState)
 		return
 	}
-	defer os.Remove(pdfFile.Name())
+	if maxAge := pm.settings().MaxJobAge; jobExpired(job, maxAge, time.Now()) {
+		pm.failJob(job, fmt.Sprintf("Refusing job %s: it was submitted %s ago, longer than gcp_max_job_age (%s)",
+			job.GCPJobID, time.Since(job.CreateTime)/time.Second*time.Second, maxAge), jobExpiredState)
+		return
+	}
+	quota, ok := pm.reserveQuota(job.GCPPrinterID)
+	if !ok {
+		pm.failJob(job, fmt.Sprintf("Refusing job %s: its printer printed its daily quota of %d pages", job.GCPJobID, quota),
+			quotaExceededState)
+		return
+	}
+	defer pm.releaseQuota(job.GCPPrinterID)
 
-	ownerID := job.OwnerID
-	if !pm.jobFullUsername {
-		ownerID = strings.Split(ownerID, "@")[0]
+	printer, ticket, message, state := pm.assembleJob(job)
+	if message != "" {
+		pm.failJob(job, message, state)
+		return
 	}
 
-	printer.CUPSJobSemaphore.Acquire()
-	defer printer.CUPSJobSemaphore.Release()
+	s := pm.settings()
+	ownerID := pm.jobUser(job)
+	pm.addJobAttributes(job, printer.Name, &ticket)
 
 	jobTitle := fmt.Sprintf("gcp:%s %s", job.GCPJobID, job.Title)
 	if len(jobTitle) > 255 {
 		jobTitle = jobTitle[:255]
 	}
 
-	cupsJobID, err := pm.cups.Print(printer.Name, pdfFile.Name(), jobTitle, ownerID, ticket)
-	if err != nil {
-		pm.incrementJobsProcessed(false)
-		message = fmt.Sprintf("Failed to send job %s to CUPS: %s", job.GCPJobID, err)
-		glog.Error(message)
-		state := cdd.PrintJobStateDiff{
-			State: cdd.JobState{
-				Type:              "STOPPED",
-				DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "PRINT_FAILURE"},
-			},
-		}
-		if err := pm.gcp.Control(job.GCPJobID, state); err != nil {
-			glog.Error(err)
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		status.PrinterName = printer.Name
+		status.cupsUser = ownerID
+		status.ticket = &ticket
+		status.Phase = "download"
+	})
+
+	var cupsJobID uint32
+	var err error
+	streamed := false
+	format := ""
+	if s.StreamJobs {
+		cupsJobID, err = pm.streamJob(job, printer, ticket, jobTitle, ownerID)
+		if _, ok := err.(*unsupportedContentTypeError); ok {
+			logger.Warningf(jobFields(job, "download"), "Printing job %s as %s from a temporary file: %s", job.GCPJobID, alternateFormat, err)
+			format = alternateFormat
+		} else if _, ok := err.(*gcp.DownloadTooLargeError); ok {
+			pm.failJob(job, fmt.Sprintf("Failed to download document for job %s: %s; see gcp_max_download_mb", job.GCPJobID, err),
+				downloadTooLargeState)
+			return
+		} else if err, ok := err.(*downloadError); ok {
+			pm.failJob(job, fmt.Sprintf("Failed to download document for job %s: %s", job.GCPJobID, err.err), downloadFailureState)
+			return
+		} else {
+			streamed = true
+		}
+	}
+
+	if !streamed {
+		var retry bool
+		cupsJobID, message, state, retry, err = pm.downloadAndPrint(job, printer, ticket, jobTitle, ownerID, format)
+		if retry && format == "" {
+			reason := message
+			if err != nil {
+				reason = err.Error()
+			}
+			logger.Warningf(jobFields(job, "download"), "Retrying job %s as %s: %s", job.GCPJobID, alternateFormat, reason)
+			pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) { status.Phase = "download" })
+			cupsJobID, message, state, _, err = pm.downloadAndPrint(job, printer, ticket, jobTitle, ownerID, alternateFormat)
+		}
+		if message != "" {
+			pm.failJob(job, message, state)
+			return
 		}
+	}
+
+	if err != nil {
+		pm.failJob(job, fmt.Sprintf("Failed to send job %s to CUPS: %s", job.GCPJobID, err),
+			cdd.PrintJobStateDiff{
+				State: cdd.JobState{
+					Type:              "STOPPED",
+					DeviceActionCause: &cdd.DeviceActionCause{ErrorCode: "PRINT_FAILURE"},
+				},
+			})
 		return
 	}
 
-	glog.Infof("Submitted GCP job %s as CUPS job %d", job.GCPJobID, cupsJobID)
+	logger.Infof(cupsJobFields(job, cupsJobID, "submit"), "Submitted GCP job %s as CUPS job %d", job.GCPJobID, cupsJobID)
+	submitted()
+
+	var canceled bool
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		status.CUPSJobID = cupsJobID
+		status.State = "IN_PROGRESS"
+		status.Phase = "follow"
+		canceled = status.canceled
+	})
+	if canceled {
+		// CancelJob was called before the job reached CUPS.
+		if err = pm.backend.CancelJob(printer.Name, ownerID, cupsJobID); err != nil {
+			logger.Warningf(cupsJobFields(job, cupsJobID, "cancel"), "%s", err)
+		}
+	}
 
+	t := time.Now()
 	pm.followJob(job, cupsJobID)
+	pm.recordJobPhase(job, printer.Name, "print", time.Since(t))
+}
+
+// addJobAttributes adds the vendor ticket items that job accounting and
+// job_hold_until ask for to a job's ticket.
+func (pm *PrinterManager) addJobAttributes(job *lib.Job, printerName string, ticket *cdd.CloudJobTicket) {
+	s := pm.settings()
+	// The owner of a local job is unverified, so nobody is billed for it.
+	if s.JobAccountingOwner && !job.Local {
+		ticket.Print.VendorTicketItem = append(ticket.Print.VendorTicketItem,
+			cdd.VendorTicketItem{ID: jobAccountingUserIDAttribute, Value: job.OwnerID})
+	}
+	if holdUntil := jobHoldUntil(*ticket, printerName, s.JobHoldUntil); holdUntil != "" {
+		logger.Infof(jobFields(job, "receive"), "Holding job %s in CUPS until %s", job.GCPJobID, holdUntil)
+		ticket.Print.VendorTicketItem = append(ticket.Print.VendorTicketItem,
+			cdd.VendorTicketItem{ID: jobHoldUntilAttribute, Value: holdUntil})
+	}
+}
+
+// downloadAndPrint downloads a job document with downloadJob, then prints
+// it from the temporary file. Returns the CUPS job ID.
+//
+// Download failures are returned as a message and state, like downloadJob;
+// print failures as an error. retry says whether the job might print when
+// downloaded as alternateFormat.
+func (pm *PrinterManager) downloadAndPrint(job *lib.Job, printer lib.Printer, ticket cdd.CloudJobTicket, jobTitle, ownerID, format string) (uint32, string, cdd.PrintJobStateDiff, bool, error) {
+	pdfFile, contentType, message, state := pm.downloadJob(job, printer.Name, format)
+	if message != "" {
+		// Other formats can't help when the document is too large, or when
+		// there's no room for it.
+		retry := state.State.ServiceActionCause != nil && state.State.ServiceActionCause.ErrorCode == "CONVERSION_UNSUPPORTED_CONTENT_TYPE" ||
+			state.State.DeviceActionCause != nil && state.State.DeviceActionCause.ErrorCode == "DOWNLOAD_FAILURE"
+		return 0, message, state, retry, nil
+	}
+	if pm.quarantineDir == "" {
+		defer pm.spool.Remove(pdfFile.Name())
+	} else {
+		// Kept until the job is done, in case it fails; see
+		// removeJobDocument.
+		pm.keepJobDocument(job, pdfFile.Name())
+	}
+
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) { status.Phase = "submit" })
+	t := time.Now()
+	printer.CUPSJobSemaphore.Acquire()
+	pm.recordJobPhase(job, printer.Name, "queue", time.Since(t))
+	t = time.Now()
+	cupsJobID, err := pm.printFile(printer.Name, pdfFile.Name(), jobTitle, ownerID, contentType, ticket)
+	pm.recordJobPhase(job, printer.Name, "submit", time.Since(t))
+	printer.CUPSJobSemaphore.Release()
+
+	if err != nil {
+		// CUPS being unreachable isn't about the document.
+		_, unreachable := err.(*lib.UnreachableError)
+		return 0, "", cdd.PrintJobStateDiff{}, !unreachable && contentType != alternateFormat, err
+	}
+	return cupsJobID, "", cdd.PrintJobStateDiff{}, false, nil
+}
+
+// alternateFormat is the content type that a job is downloaded as when the
+// document that GCP chooses can't be downloaded or printed. GCP converts
+// documents to PWG raster on request, which CUPS can print on printers that
+// can't print PDFs.
+const alternateFormat = lib.ContentTypePWGRaster
+
+// printFile prints a downloaded job document. Encrypted documents are
+// decrypted on their way into CUPS: streamed when CUPS can receive a stream,
+// or else decrypted to another temporary file, which is removed as soon as
+// CUPS has it.
+func (pm *PrinterManager) printFile(printerName, filename, title, user, contentType string, ticket cdd.CloudJobTicket) (uint32, error) {
+	if !pm.spool.Encrypted() {
+		return pm.backend.Print(printerName, filename, title, user, contentType, ticket)
+	}
+
+	r, err := pm.spool.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	jobID, err := pm.backend.PrintStream(printerName, title, user, contentType, ticket, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if _, ok := err.(*lib.StreamUnsupportedError); !ok {
+		return jobID, err
+	}
+
+	plainFile, err := pm.backend.CreateTempFile()
+	if err != nil {
+		return 0, err
+	}
+	defer pm.spool.Remove(plainFile.Name())
+	_, err = io.Copy(plainFile, r)
+	plainFile.Close()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to decrypt document: %s", err)
+	}
+	return pm.backend.Print(printerName, plainFile.Name(), title, user, contentType, ticket)
+}
+
+// streamJob pipes the job's document directly from GCP into a new CUPS
+// job, so that the document is never written to disk. Returns the CUPS job
+// ID.
+//
+// The content type is detected from the start of the document, before the
+// CUPS job is created; CUPS detects it when it isn't recognized. Returns an
+// *unsupportedContentTypeError when CUPS can't print the document, and a
+// *gcp.DownloadTooLargeError when the document is too large, and a
+// *downloadError when it can't be downloaded otherwise. When CUPS can't
+// receive the document as a stream, the rest of the download is spooled to
+// a temporary file, which is printed instead.
+func (pm *PrinterManager) streamJob(job *lib.Job, printer lib.Printer, ticket cdd.CloudJobTicket, jobTitle, ownerID string) (uint32, error) {
+	t := time.Now()
+	printer.CUPSJobSemaphore.Acquire()
+	defer printer.CUPSJobSemaphore.Release()
+	pm.recordJobPhase(job, printer.Name, "queue", time.Since(t))
+
+	// Closing the reader stops the download when the job isn't printed.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	downloadFailed := make(chan error, 1)
+	go func() {
+		downloadSemaphore := pm.getDownloadSemaphore()
+		downloadSemaphore.Acquire()
+		defer downloadSemaphore.Release()
+
+		t := time.Now()
+		if _, err := pm.gcp.Download(pw, job.FileURL, "", pm.maxDownloadSize()); err != nil {
+			if _, ok := err.(*gcp.DownloadTooLargeError); !ok {
+				err = &downloadError{err}
+			}
+			downloadFailed <- err
+			pw.CloseWithError(err)
+			return
+		}
+		dt := time.Since(t)
+		pm.recordJobPhase(job, printer.Name, "download", dt)
+		logger.Infof(jobFields(job, "download"), "Streamed job %s in %s", job.GCPJobID, dt.String())
+		pw.Close()
+	}()
+
+	r := bufio.NewReaderSize(pr, lib.ContentTypeSniffLen)
+	head, err := r.Peek(lib.ContentTypeSniffLen)
+	if err != nil && err != io.EOF {
+		return 0, streamError(err, downloadFailed)
+	}
+	contentType := lib.DetectContentType(head, "")
+	if contentType != "" && !lib.ContentTypeSupported(contentType) {
+		return 0, &unsupportedContentTypeError{contentType}
+	}
+
+	t = time.Now()
+	defer func() { pm.recordJobPhase(job, printer.Name, "submit", time.Since(t)) }()
+	cupsJobID, err := pm.backend.PrintStream(printer.Name, jobTitle, ownerID, contentType, ticket, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if _, ok := err.(*lib.StreamUnsupportedError); ok {
+		logger.Warningf(jobFields(job, "submit"), "Printing job %s from a temporary file: %s", job.GCPJobID, err)
+		cupsJobID, err = pm.printSpooled(printer.Name, r, jobTitle, ownerID, contentType, ticket)
+	}
+	if err != nil {
+		err = streamError(err, downloadFailed)
+	}
+	return cupsJobID, err
+}
+
+// printSpooled writes a job document to a temporary file, and prints it.
+func (pm *PrinterManager) printSpooled(printerName string, r io.Reader, title, user, contentType string, ticket cdd.CloudJobTicket) (uint32, error) {
+	f, err := pm.backend.CreateTempFile()
+	if err != nil {
+		return 0, err
+	}
+	defer pm.spool.Remove(f.Name())
+
+	w, err := pm.spool.Writer(f)
+	if err == nil {
+		_, err = io.Copy(w, r)
+	}
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	return pm.printFile(printerName, f.Name(), title, user, contentType, ticket)
+}
+
+// streamError returns the download error of a streamed job, if the download
+// failed, rather than err, which is what the failed download caused.
+func streamError(err error, downloadFailed <-chan error) error {
+	select {
+	case downloadErr := <-downloadFailed:
+		return downloadErr
+	default:
+		return err
+	}
 }
 
 // followJob polls a CUPS job state to update the GCP job state and
@@ -489,14 +1670,30 @@ func (pm *PrinterManager) processJob(job *lib.Job) {
 // this function.
 func (pm *PrinterManager) followJob(job *lib.Job, cupsJobID uint32) {
 	var gcpState cdd.PrintJobStateDiff
+	var unreachableSince time.Time
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	for _ = range ticker.C {
-		cupsState, err := pm.cups.GetJobState(cupsJobID)
+		cupsState, err := pm.backend.GetJobState(cupsJobID)
+		if _, ok := err.(*lib.UnreachableError); ok {
+			// cupsd is probably restarting; the job is still there.
+			if unreachableSince.IsZero() {
+				unreachableSince = time.Now()
+				logger.Warningf(cupsJobFields(job, cupsJobID, "follow"), "CUPS server unreachable while following CUPS job %d; will keep trying: %s", cupsJobID, err)
+			}
+			if time.Since(unreachableSince) < cupsUnreachableTimeout {
+				continue
+			}
+		} else if err == nil && !unreachableSince.IsZero() {
+			logger.Infof(cupsJobFields(job, cupsJobID, "follow"), "CUPS server reachable again after %s; still following CUPS job %d",
+				time.Since(unreachableSince).String(), cupsJobID)
+			unreachableSince = time.Time{}
+		}
+
 		if err != nil {
-			glog.Warningf("Failed to get state of CUPS job %d: %s", cupsJobID, err)
+			logger.Warningf(cupsJobFields(job, cupsJobID, "follow"), "Failed to get state of CUPS job %d: %s", cupsJobID, err)
 
 			gcpState := cdd.PrintJobStateDiff{
 				State: cdd.JobState{
@@ -505,27 +1702,33 @@ func (pm *PrinterManager) followJob(job *lib.Job, cupsJobID uint32) {
 				},
 				PagesPrinted: gcpState.PagesPrinted,
 			}
-			if err := pm.gcp.Control(job.GCPJobID, gcpState); err != nil {
-				glog.Error(err)
+			pm.setJobState(job.GCPJobID, gcpState.State.Type, err.Error())
+			if err := pm.controlJob(job, gcpState); err != nil {
+				logger.Errorf(cupsJobFields(job, cupsJobID, "report"), "%s", err)
 			}
-			pm.incrementJobsProcessed(false)
+			pm.incrementJobsProcessed(job.GCPPrinterID, gcpState.State, err.Error())
 			return
 		}
 
 		if !reflect.DeepEqual(cupsState, gcpState) {
 			gcpState = cupsState
-			if err = pm.gcp.Control(job.GCPJobID, gcpState); err != nil {
-				glog.Error(err)
+			if err = pm.controlJob(job, gcpState); err != nil {
+				logger.Errorf(cupsJobFields(job, cupsJobID, "report"), "%s", err)
 			}
-			glog.Infof("Job %s state is now: %s", job.GCPJobID, gcpState.State.Type)
+			logger.Infof(cupsJobFields(job, cupsJobID, "follow"), "Job %s state is now: %s", job.GCPJobID, gcpState.State.Type)
+			pm.setJobState(job.GCPJobID, gcpState.State.Type, "")
+			pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) { status.Pages = gcpState.PagesPrinted })
 		}
 
 		if gcpState.State.Type != "IN_PROGRESS" {
 			if gcpState.State.Type == "DONE" {
-				pm.incrementJobsProcessed(true)
-			} else {
-				pm.incrementJobsProcessed(false)
+				if printer, exists := pm.gcpPrintersByGCPID.Get(job.GCPPrinterID); exists {
+					pm.deviceSeen(printer.Name)
+				}
 			}
+			pm.countPagesPrinted(job.GCPPrinterID, gcpState.PagesPrinted)
+			pm.incrementJobsProcessed(job.GCPPrinterID, gcpState.State,
+				fmt.Sprintf("CUPS job %d of GCP job %s ended %s", cupsJobID, job.GCPJobID, gcpState.State.Type))
 			return
 		}
 	}
@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/gcp"
+	"github.com/google/cups-connector/gcp/gcptest"
+	"github.com/google/cups-connector/lib"
+)
+
+// newBasePrinterManager returns a PrinterManager of printers, with every
+// map and channel that NewPrinterManager makes. Services aren't set, and
+// loops aren't started.
+func newBasePrinterManager(settings Settings, printers []lib.Printer) *PrinterManager {
+	return &PrinterManager{
+		gcpPrintersByGCPID: lib.NewConcurrentPrinterMap(printers),
+		printerJobStats:    make(map[string]*printerJobStats),
+		jobsInFlight:       make(map[string]*JobStatus),
+		pausedPrinters:     make(map[string]struct{}),
+
+		s:                               settings,
+		printerPollIntervalUpdates:      make(chan time.Duration, 1),
+		printerStatePollIntervalUpdates: make(chan time.Duration, 1),
+		printerSyncRequests:             make(chan struct{}, 1),
+
+		heartbeats: make(map[string]time.Time),
+
+		deviceLastSeen:  make(map[string]time.Time),
+		unreachable:     make(map[string]struct{}),
+		pagesPrinted:    make(map[string]*dailyPages),
+		quotaReserved:   make(map[string]uint),
+		refetchPrinters: make(map[string]struct{}),
+		offlineJobs:     make(map[string]uint),
+
+		dispatchQueues:       make(map[string][]*lib.Job),
+		dispatchQueued:       make(map[string]struct{}),
+		dispatchingByPrinter: make(map[string]uint),
+		lastDispatch:         make(map[string]time.Time),
+		dispatchWake:         make(chan struct{}, 1),
+
+		quit: make(chan struct{}),
+	}
+}
+
+// newTestPrinterManager returns a PrinterManager of printers registered
+// with the fake GCP service s, as the user too, so that they can be shared.
+// When s is nil, there's no GCP service, and each printer's GCP ID is its
+// name. See newBasePrinterManager.
+func newTestPrinterManager(t *testing.T, s *gcptest.Server, settings Settings, printerNames ...string) *PrinterManager {
+	printers := make([]lib.Printer, len(printerNames))
+	for i, name := range printerNames {
+		printers[i] = lib.Printer{Name: name, UUID: name, GCPVersion: "2.0"}
+	}
+	if s == nil {
+		for i := range printers {
+			printers[i].GCPID = printers[i].Name
+		}
+		return newBasePrinterManager(settings, printers)
+	}
+
+	g, err := gcp.NewGoogleCloudPrint(s.BaseURL(), "robot-refresh-token", "user-refresh-token", "test-proxy", "client-id", "client-secret", s.AuthURL(), s.TokenURL(), "", nil, 5*time.Minute, 0, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create GoogleCloudPrint: %s", err)
+	}
+	for i := range printers {
+		if err = g.Register(&printers[i]); err != nil {
+			t.Fatalf("Failed to register printer %s: %s", printers[i].Name, err)
+		}
+	}
+
+	pm := newBasePrinterManager(settings, printers)
+	pm.gcp = g
+	return pm
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/logger"
+)
+
+// How often to probe a device that didn't answer, until it does.
+const deviceReprobeInterval = 30 * time.Second
+
+// Ports of the device-uri schemes that are probed, when the URI has none.
+var probePorts = map[string]string{
+	"ipp":    "631",
+	"ipps":   "631",
+	"http":   "80",
+	"https":  "443",
+	"socket": "9100",
+	"lpd":    "515",
+}
+
+// probeAddress returns the host:port that a network device-uri prints to.
+// Returns false for devices that aren't reached over TCP, like usb and
+// dnssd devices, which aren't probed.
+func probeAddress(deviceURI string) (string, bool) {
+	u, err := url.Parse(deviceURI)
+	if err != nil || u.Hostname() == "" {
+		return "", false
+	}
+	port, exists := probePorts[strings.ToLower(u.Scheme)]
+	if !exists {
+		return "", false
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), true
+}
+
+// probeDevice connects to address, and hangs up.
+func probeDevice(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// deviceSeen records that the device of a printer answered just now.
+func (pm *PrinterManager) deviceSeen(name string) {
+	pm.probeMutex.Lock()
+	defer pm.probeMutex.Unlock()
+
+	pm.deviceLastSeen[name] = time.Now()
+}
+
+// pruneDeviceLastSeen forgets the devices of printers that are gone, or
+// were renamed.
+func (pm *PrinterManager) pruneDeviceLastSeen(printers []lib.Printer) {
+	names := make(map[string]struct{}, len(printers))
+	for _, printer := range printers {
+		names[printer.Name] = struct{}{}
+	}
+
+	pm.probeMutex.Lock()
+	defer pm.probeMutex.Unlock()
+
+	for name := range pm.deviceLastSeen {
+		if _, exists := names[name]; !exists {
+			delete(pm.deviceLastSeen, name)
+		}
+	}
+}
+
+// printerReachable answers the question "may jobs be fetched for printer,
+// as far as its device is concerned?" A device that hasn't answered within
+// the probe interval is probed first. When it doesn't answer, the printer is
+// reported stopped to GCP, and its jobs are fetched once it answers again.
+func (pm *PrinterManager) printerReachable(printer lib.Printer) bool {
+	s := pm.settings()
+	if s.ProbeInterval <= 0 {
+		return true
+	}
+	address, ok := probeAddress(printer.Tags["device-uri"])
+	if !ok {
+		return true
+	}
+
+	pm.probeMutex.Lock()
+	_, down := pm.unreachable[printer.Name]
+	lastSeen := pm.deviceLastSeen[printer.Name]
+	pm.probeMutex.Unlock()
+	if down {
+		return false
+	}
+	if time.Since(lastSeen) < s.ProbeInterval {
+		return true
+	}
+
+	err := probeDevice(address, s.ProbeTimeout)
+	if err == nil {
+		pm.deviceSeen(printer.Name)
+		return true
+	}
+
+	pm.probeMutex.Lock()
+	if _, down = pm.unreachable[printer.Name]; !down {
+		pm.unreachable[printer.Name] = struct{}{}
+	}
+	pm.probeMutex.Unlock()
+	if down {
+		return false
+	}
+
+	logger.Warningf(printerFields(&printer, "probe"), "Device of printer %s at %s is unreachable; leaving its jobs queued: %s", printer.Name, address, err)
+	pm.reportUnreachable(printer, err)
+	go pm.awaitDevice(printer.GCPID, printer.Name)
+	return false
+}
+
+// reportUnreachable reports printer stopped to GCP, with why its device is
+// unreachable, leaving the stored printer state as CUPS reported it.
+func (pm *PrinterManager) reportUnreachable(printer lib.Printer, err error) {
+	var state cdd.PrinterStateSection
+	if printer.State != nil {
+		state = *printer.State
+	}
+	state.State = cdd.CloudDeviceStateStopped
+	var items []cdd.VendorStateItem
+	if state.VendorState != nil {
+		items = append(items, state.VendorState.Item...)
+	}
+	items = append(items, cdd.VendorStateItem{
+		State:       cdd.VendorStateError,
+		Description: fmt.Sprintf("device unreachable: %s", err),
+	})
+	state.VendorState = &cdd.VendorState{Item: items}
+
+	if err := pm.gcp.UpdateState(printer.GCPID, &state); err != nil {
+		logger.Errorf(printerFields(&printer, "probe"), "Failed to report unreachable printer %s to GCP: %s", printer.Name, err)
+	}
+}
+
+// awaitDevice probes the device of an unreachable printer until it
+// answers, then reports the printer's CUPS state to GCP again, and fetches
+// the jobs that were left queued.
+func (pm *PrinterManager) awaitDevice(gcpID, name string) {
+	ticker := time.NewTicker(deviceReprobeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-pm.quit:
+			return
+		}
+
+		printer, exists := pm.gcpPrintersByGCPID.Get(gcpID)
+		if !exists {
+			pm.probeMutex.Lock()
+			delete(pm.unreachable, name)
+			pm.probeMutex.Unlock()
+			return
+		}
+
+		s := pm.settings()
+		if address, ok := probeAddress(printer.Tags["device-uri"]); ok && s.ProbeInterval > 0 {
+			if err := probeDevice(address, s.ProbeTimeout); err != nil {
+				continue
+			}
+		}
+
+		pm.probeMutex.Lock()
+		delete(pm.unreachable, name)
+		pm.deviceLastSeen[printer.Name] = time.Now()
+		pm.probeMutex.Unlock()
+
+		logger.Infof(printerFields(&printer, "probe"), "Device of printer %s answers again; fetching its jobs", printer.Name)
+		if printer.State != nil {
+			if err := pm.gcp.UpdateState(gcpID, printer.State); err != nil {
+				logger.Errorf(printerFields(&printer, "probe"), "Failed to report the state of printer %s to GCP: %s", printer.Name, err)
+			}
+		}
+		pm.handlePrinterNewJobs(gcpID)
+		return
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+)
+
+func TestProbeAddress(t *testing.T) {
+	cases := []struct {
+		deviceURI string
+		address   string
+		ok        bool
+	}{
+		{"ipp://printer.example.com/ipp/print", "printer.example.com:631", true},
+		{"ipps://printer.example.com/ipp/print", "printer.example.com:631", true},
+		{"http://printer.example.com/ipp", "printer.example.com:80", true},
+		{"https://printer.example.com/ipp", "printer.example.com:443", true},
+		{"socket://10.0.0.5", "10.0.0.5:9100", true},
+		{"lpd://10.0.0.5/queue", "10.0.0.5:515", true},
+		{"SOCKET://10.0.0.5", "10.0.0.5:9100", true},
+		{"ipp://printer.example.com:8631/ipp", "printer.example.com:8631", true},
+		{"socket://[fe80::1]:9101", "[fe80::1]:9101", true},
+		{"socket://[fe80::1]", "[fe80::1]:9100", true},
+		{"usb://HP/LaserJet?serial=123", "", false},
+		{"dnssd://Printer._ipp._tcp.local/", "", false},
+		{"ipp:///ipp/print", "", false},
+		{"", "", false},
+		{"%zz", "", false},
+	}
+	for _, c := range cases {
+		address, ok := probeAddress(c.deviceURI)
+		if address != c.address || ok != c.ok {
+			t.Errorf("probeAddress(%q) = %q, %t; want %q, %t", c.deviceURI, address, ok, c.address, c.ok)
+		}
+	}
+}
+
+func TestPruneDeviceLastSeen(t *testing.T) {
+	now := time.Now()
+	pm := &PrinterManager{deviceLastSeen: map[string]time.Time{"kept": now, "deleted": now}}
+
+	pm.pruneDeviceLastSeen([]lib.Printer{{Name: "kept"}, {Name: "new"}})
+
+	if len(pm.deviceLastSeen) != 1 || pm.deviceLastSeen["kept"] != now {
+		t.Errorf("Got %v, want only kept", pm.deviceLastSeen)
+	}
+}
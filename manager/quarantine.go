@@ -0,0 +1,138 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// keepJobDocument records the downloaded document of an in flight job, to
+// be quarantined if the job fails. A document downloaded earlier, for a
+// failed attempt in another format, is removed.
+func (pm *PrinterManager) keepJobDocument(job *lib.Job, filename string) {
+	var previous string
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		previous = status.documentFile
+		status.documentFile = filename
+	})
+	if previous != "" {
+		pm.spool.Remove(previous)
+	}
+}
+
+// removeJobDocument removes the document kept by keepJobDocument, after
+// quarantining it if the job failed.
+func (pm *PrinterManager) removeJobDocument(job *lib.Job) {
+	var status JobStatus
+	pm.updateInFlightJob(job.GCPJobID, func(s *JobStatus) {
+		status = *s
+		s.documentFile = ""
+		s.ticket = nil
+	})
+	if status.documentFile == "" {
+		return
+	}
+
+	if (status.State == "ABORTED" || status.State == "STOPPED") && !status.canceled {
+		if dir, err := pm.quarantineJob(status); err != nil {
+			glog.Errorf("Failed to quarantine job %s: %s", job.GCPJobID, err)
+		} else {
+			glog.Infof("Quarantined failed job %s in %s", job.GCPJobID, dir)
+		}
+	}
+	pm.spool.Remove(status.documentFile)
+}
+
+// quarantineJob copies the document of a failed job to a new directory in
+// the quarantine directory, with its ticket and status, as document,
+// ticket.json and job.json. Documents are decrypted. The oldest directories
+// are removed to keep at most quarantineMaxJobs. Returns the new directory.
+func (pm *PrinterManager) quarantineJob(status JobStatus) (string, error) {
+	pm.quarantineMutex.Lock()
+	defer pm.quarantineMutex.Unlock()
+
+	if err := os.MkdirAll(pm.quarantineDir, 0700); err != nil {
+		return "", err
+	}
+	// Named to sort by time.
+	dir := filepath.Join(pm.quarantineDir, fmt.Sprintf("%s-%s", status.Received.UTC().Format("20060102-150405"), status.GCPJobID))
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+
+	if err := pm.copyJobDocument(status.documentFile, filepath.Join(dir, "document")); err != nil {
+		return "", err
+	}
+	for name, v := range map[string]interface{}{"ticket.json": status.ticket, "job.json": status} {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			return "", err
+		}
+	}
+
+	pm.pruneQuarantine()
+	return dir, nil
+}
+
+// copyJobDocument copies a spooled document to dst, decrypted.
+func (pm *PrinterManager) copyJobDocument(src, dst string) error {
+	r, err := pm.spool.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pruneQuarantine removes the oldest job directories in the quarantine
+// directory beyond quarantineMaxJobs.
+func (pm *PrinterManager) pruneQuarantine() {
+	fis, err := ioutil.ReadDir(pm.quarantineDir)
+	if err != nil {
+		glog.Warningf("Failed to list quarantined jobs: %s", err)
+		return
+	}
+
+	var dirs []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			dirs = append(dirs, fi.Name())
+		}
+	}
+	if uint(len(dirs)) <= pm.quarantineMaxJobs {
+		return
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs[:uint(len(dirs))-pm.quarantineMaxJobs] {
+		if err := os.RemoveAll(filepath.Join(pm.quarantineDir, dir)); err != nil {
+			glog.Warningf("Failed to remove quarantined job %s: %s", dir, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+)
+
+// newQuarantinePrinterManager returns a PrinterManager that quarantines at
+// most maxJobs failed jobs in a new temporary directory, with an encrypted
+// spool.
+func newQuarantinePrinterManager(t *testing.T, maxJobs uint) *PrinterManager {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, err := lib.NewSpool(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := newTestPrinterManager(t, nil, Settings{})
+	pm.spool = spool
+	pm.quarantineDir = dir
+	pm.quarantineMaxJobs = maxJobs
+	return pm
+}
+
+// quarantineDirs returns the names of the job directories in the
+// quarantine directory, oldest first.
+func quarantineDirs(t *testing.T, pm *PrinterManager) []string {
+	fis, err := ioutil.ReadDir(pm.quarantineDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			dirs = append(dirs, fi.Name())
+		}
+	}
+	return dirs
+}
+
+func TestQuarantineFailedJob(t *testing.T) {
+	pm := newQuarantinePrinterManager(t, 5)
+	defer os.RemoveAll(pm.quarantineDir)
+
+	const document = "%PDF-1.4 document"
+	ticket := cdd.CloudJobTicket{
+		Version: "1.0",
+		Print:   cdd.PrintTicketSection{Copies: &cdd.CopiesTicketItem{Copies: 2}},
+	}
+	job := &lib.Job{GCPJobID: "job1", GCPPrinterID: "printer1", Title: "title"}
+	pm.addInFlightJob(job)
+	filename := spoolFile(t, pm.spool, document)
+	defer os.Remove(filename)
+	pm.keepJobDocument(job, filename)
+	pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+		status.ticket = &ticket
+		status.State = "ABORTED"
+		status.Error = "printer on fire"
+	})
+
+	pm.removeJobDocument(job)
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Spooled document %s wasn't removed", filename)
+	}
+	dirs := quarantineDirs(t, pm)
+	if len(dirs) != 1 {
+		t.Fatalf("Quarantined %v, want one job", dirs)
+	}
+	dir := filepath.Join(pm.quarantineDir, dirs[0])
+
+	// The quarantined document is decrypted.
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "document")); err != nil || string(b) != document {
+		t.Errorf("Quarantined document is %q, %v; want %q", b, err, document)
+	}
+
+	var gotTicket cdd.CloudJobTicket
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "ticket.json")); err != nil {
+		t.Error(err)
+	} else if err = json.Unmarshal(b, &gotTicket); err != nil {
+		t.Errorf("Failed to parse ticket.json: %s", err)
+	} else if !reflect.DeepEqual(gotTicket, ticket) {
+		t.Errorf("Quarantined ticket %+v, want %+v", gotTicket, ticket)
+	}
+
+	var status JobStatus
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "job.json")); err != nil {
+		t.Error(err)
+	} else if err = json.Unmarshal(b, &status); err != nil {
+		t.Errorf("Failed to parse job.json: %s", err)
+	} else if status.GCPJobID != "job1" || status.State != "ABORTED" || status.Error != "printer on fire" {
+		t.Errorf("Quarantined status %+v", status)
+	}
+
+	// The document is forgotten, so removing again does nothing.
+	pm.removeJobDocument(job)
+	if dirs = quarantineDirs(t, pm); len(dirs) != 1 {
+		t.Errorf("Quarantined %v after removing twice, want one job", dirs)
+	}
+}
+
+func TestQuarantineSkipsJobs(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		state    string
+		canceled bool
+	}{
+		{"done", "DONE", false},
+		{"in progress", "IN_PROGRESS", false},
+		{"canceled", "ABORTED", true},
+	} {
+		pm := newQuarantinePrinterManager(t, 5)
+		defer os.RemoveAll(pm.quarantineDir)
+
+		job := &lib.Job{GCPJobID: "job1"}
+		pm.addInFlightJob(job)
+		filename := spoolFile(t, pm.spool, "document")
+		defer os.Remove(filename)
+		pm.keepJobDocument(job, filename)
+		pm.updateInFlightJob(job.GCPJobID, func(status *JobStatus) {
+			status.State = test.state
+			status.canceled = test.canceled
+		})
+
+		pm.removeJobDocument(job)
+
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s: spooled document wasn't removed", test.name)
+		}
+		if dirs := quarantineDirs(t, pm); len(dirs) != 0 {
+			t.Errorf("%s: quarantined %v, want nothing", test.name, dirs)
+		}
+	}
+}
+
+func TestKeepJobDocumentReplaces(t *testing.T) {
+	pm := newQuarantinePrinterManager(t, 5)
+	defer os.RemoveAll(pm.quarantineDir)
+
+	job := &lib.Job{GCPJobID: "job1"}
+	pm.addInFlightJob(job)
+	first := spoolFile(t, pm.spool, "first format")
+	defer os.Remove(first)
+	second := spoolFile(t, pm.spool, "second format")
+	defer os.Remove(second)
+
+	pm.keepJobDocument(job, first)
+	pm.keepJobDocument(job, second)
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Error("The document of the earlier attempt wasn't removed")
+	}
+	if _, err := os.Stat(second); err != nil {
+		t.Errorf("The document of the latest attempt was removed: %s", err)
+	}
+}
+
+func TestPruneQuarantine(t *testing.T) {
+	pm := newQuarantinePrinterManager(t, 2)
+	defer os.RemoveAll(pm.quarantineDir)
+
+	for _, name := range []string{"20150102-000000-c", "20150101-000000-b", "20150103-000000-d", "20150101-000000-a"} {
+		if err := os.Mkdir(filepath.Join(pm.quarantineDir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files aren't jobs, so they're neither counted nor removed.
+	notes := filepath.Join(pm.quarantineDir, "notes.txt")
+	if err := ioutil.WriteFile(notes, []byte("notes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pm.pruneQuarantine()
+
+	want := []string{"20150102-000000-c", "20150103-000000-d"}
+	if dirs := quarantineDirs(t, pm); !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Kept %v, want %v", dirs, want)
+	}
+	if _, err := os.Stat(notes); err != nil {
+		t.Errorf("Pruning removed a file: %s", err)
+	}
+
+	// At the maximum, nothing is removed.
+	pm.pruneQuarantine()
+	if dirs := quarantineDirs(t, pm); !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Kept %v at the maximum, want %v", dirs, want)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/history"
+
+	"github.com/golang/glog"
+)
+
+// quotaExceededState reports to GCP a job that was refused because its
+// printer printed its daily quota already.
+var quotaExceededState = cdd.PrintJobStateDiff{
+	State: cdd.JobState{
+		Type:               "ABORTED",
+		ServiceActionCause: &cdd.ServiceActionCause{ErrorCode: "OTHER"},
+	},
+}
+
+// dailyPages counts the pages that a printer printed on one day.
+type dailyPages struct {
+	day   string
+	pages uint
+}
+
+// quotaDay returns the local day of t, which quotas count pages by.
+func quotaDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// countPagesPrinted adds pages to what a printer printed today.
+func (pm *PrinterManager) countPagesPrinted(gcpID string, pages int32) {
+	if pages <= 0 {
+		return
+	}
+
+	pm.quotaMutex.Lock()
+	defer pm.quotaMutex.Unlock()
+
+	today := quotaDay(time.Now())
+	usage, exists := pm.pagesPrinted[gcpID]
+	if !exists || usage.day != today {
+		usage = &dailyPages{day: today}
+		pm.pagesPrinted[gcpID] = usage
+	}
+	usage.pages += uint(pages)
+}
+
+// countPagesOfHistory counts the pages that printers printed today, as the
+// job history recorded them, so that a restart doesn't reset quotas.
+func (pm *PrinterManager) countPagesOfHistory() {
+	if pm.jobHistory == nil {
+		return
+	}
+	records, err := pm.jobHistory.Read()
+	if err != nil {
+		glog.Warningf("Failed to count the pages printed today from the job history: %s", err)
+		return
+	}
+
+	today := quotaDay(time.Now())
+	for _, r := range records {
+		if r.Kind == history.KindJob && quotaDay(r.Time.Local()) == today {
+			pm.countPagesPrinted(r.GCPPrinterID, r.Pages)
+		}
+	}
+}
+
+// reserveQuota answers the question "may the printer print another job
+// today?" GCP may not enforce quotas, so the connector does. When the
+// answer is yes, one page, the least a job prints, is reserved until
+// releaseQuota is called, once the job's pages are counted; jobs that are
+// dispatched together can't all print the last page of the quota. Pages
+// are reserved for printers without a quota too, in case one is set while
+// they print. Also returns the quota.
+func (pm *PrinterManager) reserveQuota(gcpID string) (uint, bool) {
+	var quota uint
+	if printer, exists := pm.gcpPrintersByGCPID.Get(gcpID); exists {
+		quota = printer.DailyQuota
+	}
+
+	pm.quotaMutex.Lock()
+	defer pm.quotaMutex.Unlock()
+
+	if quota > 0 {
+		var printed uint
+		if usage, exists := pm.pagesPrinted[gcpID]; exists && usage.day == quotaDay(time.Now()) {
+			printed = usage.pages
+		}
+		if printed+pm.quotaReserved[gcpID] >= quota {
+			return quota, false
+		}
+	}
+	pm.quotaReserved[gcpID]++
+	return quota, true
+}
+
+// releaseQuota releases what reserveQuota reserved for a job.
+func (pm *PrinterManager) releaseQuota(gcpID string) {
+	pm.quotaMutex.Lock()
+	defer pm.quotaMutex.Unlock()
+
+	if pm.quotaReserved[gcpID] <= 1 {
+		delete(pm.quotaReserved, gcpID)
+	} else {
+		pm.quotaReserved[gcpID]--
+	}
+}
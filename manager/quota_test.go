@@ -0,0 +1,125 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/history"
+)
+
+// newQuotaPrinterManager returns a PrinterManager of one printer, g1, with
+// a daily quota.
+func newQuotaPrinterManager(t *testing.T, quota uint) *PrinterManager {
+	pm := newTestPrinterManager(t, nil, Settings{}, "g1")
+	printers := pm.gcpPrintersByGCPID.GetAll()
+	printers[0].DailyQuota = quota
+	pm.gcpPrintersByGCPID.Refresh(printers)
+	return pm
+}
+
+func TestCountPagesPrinted(t *testing.T) {
+	pm := newQuotaPrinterManager(t, 10)
+	pm.countPagesPrinted("g1", 3)
+	pm.countPagesPrinted("g1", 4)
+	pm.countPagesPrinted("g1", 0)
+	pm.countPagesPrinted("g1", -1)
+	if pages := pm.pagesPrinted["g1"].pages; pages != 7 {
+		t.Errorf("Counted %d pages, want 7", pages)
+	}
+
+	// Pages of another day don't count.
+	pm.pagesPrinted["g1"].day = "2015-01-01"
+	pm.countPagesPrinted("g1", 2)
+	if usage := pm.pagesPrinted["g1"]; usage.pages != 2 || usage.day != quotaDay(time.Now()) {
+		t.Errorf("Counted %d pages on %s, want 2 today", usage.pages, usage.day)
+	}
+}
+
+func TestReserveQuota(t *testing.T) {
+	pm := newQuotaPrinterManager(t, 3)
+	pm.countPagesPrinted("g1", 1)
+
+	// Two jobs may print; each reserves a page.
+	for i := 0; i < 2; i++ {
+		if quota, ok := pm.reserveQuota("g1"); !ok || quota != 3 {
+			t.Fatalf("Job %d refused, with quota %d", i, quota)
+		}
+	}
+	if quota, ok := pm.reserveQuota("g1"); ok || quota != 3 {
+		t.Errorf("Third job allowed, with quota %d; want it refused", quota)
+	}
+
+	// Once a job ends, its pages count instead.
+	pm.countPagesPrinted("g1", 1)
+	pm.releaseQuota("g1")
+	if _, ok := pm.reserveQuota("g1"); ok {
+		t.Errorf("Job allowed after the quota was printed")
+	}
+	pm.releaseQuota("g1")
+	if reserved := pm.quotaReserved["g1"]; reserved != 0 {
+		t.Errorf("%d pages still reserved, want none", reserved)
+	}
+}
+
+func TestReserveQuotaWithoutQuota(t *testing.T) {
+	pm := newQuotaPrinterManager(t, 0)
+	pm.countPagesPrinted("g1", 100)
+	for i := 0; i < 3; i++ {
+		if quota, ok := pm.reserveQuota("g1"); !ok || quota != 0 {
+			t.Fatalf("Job %d refused, with quota %d", i, quota)
+		}
+	}
+	if quota, ok := pm.reserveQuota("unknown"); !ok || quota != 0 {
+		t.Errorf("Job of an unknown printer refused, with quota %d", quota)
+	}
+}
+
+func TestCountPagesOfHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := history.NewStore(filepath.Join(dir, "history"))
+	now := time.Now()
+	for _, r := range []history.Record{
+		{Time: now, Kind: history.KindJob, GCPPrinterID: "g1", State: "DONE", Pages: 3},
+		{Time: now, Kind: history.KindJob, GCPPrinterID: "g1", State: "ABORTED", Pages: 2},
+		{Time: now, Kind: history.KindJob, GCPPrinterID: "g2", State: "DONE", Pages: 4},
+		{Time: now.AddDate(0, 0, -1), Kind: history.KindJob, GCPPrinterID: "g1", State: "DONE", Pages: 8},
+		{Time: now, Kind: history.KindPrinterState, GCPPrinterID: "g1", State: "IDLE"},
+	} {
+		if err = store.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pm := newQuotaPrinterManager(t, 6)
+	pm.jobHistory = store
+	pm.countPagesOfHistory()
+
+	if pages := pm.pagesPrinted["g1"].pages; pages != 5 {
+		t.Errorf("Counted %d pages of g1, want 5", pages)
+	}
+	if pages := pm.pagesPrinted["g2"].pages; pages != 4 {
+		t.Errorf("Counted %d pages of g2, want 4", pages)
+	}
+	if _, ok := pm.reserveQuota("g1"); !ok {
+		t.Errorf("Job refused with 5 of 6 pages printed")
+	}
+	if _, ok := pm.reserveQuota("g1"); ok {
+		t.Errorf("Job allowed with 5 of 6 pages printed, and one reserved")
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"time"
+
+	"github.com/google/cups-connector/logger"
+)
+
+const (
+	// How often to fetch queued jobs at startup before giving up, and how
+	// long to wait before the first retry; the wait doubles after each.
+	queuedJobsFetchAttempts   = 4
+	queuedJobsFetchRetryDelay = 5 * time.Second
+
+	// How often to fetch jobs again for printers whose queued jobs couldn't
+	// be fetched at startup.
+	refetchInterval = time.Minute
+)
+
+// fetchQueuedJobs fetches the jobs that were queued in GCP for a printer
+// while the connector was down. Transient failures are retried with
+// backoff; when all attempts fail, the printer is left to refetchPeriodically.
+func (pm *PrinterManager) fetchQueuedJobs(gcpID string) {
+	delay := queuedJobsFetchRetryDelay
+	for attempt := 1; ; attempt++ {
+		_, err := pm.fetchJobs(gcpID)
+		if err == nil {
+			return
+		}
+
+		if attempt == queuedJobsFetchAttempts {
+			logger.Errorf(logger.Fields{"gcp_printer_id": gcpID, "phase": "fetch"},
+				"Failed to fetch queued jobs for printer %s %d times; trying again every %s: %s", gcpID, attempt, refetchInterval, err)
+			pm.refetchMutex.Lock()
+			pm.refetchPrinters[gcpID] = struct{}{}
+			pm.refetchMutex.Unlock()
+			return
+		}
+
+		logger.Warningf(logger.Fields{"gcp_printer_id": gcpID, "phase": "fetch"},
+			"Failed to fetch queued jobs for printer %s; retrying in %s: %s", gcpID, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-pm.quit:
+			return
+		}
+		delay *= 2
+	}
+}
+
+// refetchPeriodically fetches jobs for the printers whose queued jobs
+// couldn't be fetched at startup, until a fetch succeeds, or the printer is
+// deleted.
+func (pm *PrinterManager) refetchPeriodically() {
+	go func() {
+		t := time.NewTicker(refetchInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				pm.refetchMutex.Lock()
+				gcpIDs := make([]string, 0, len(pm.refetchPrinters))
+				for gcpID := range pm.refetchPrinters {
+					gcpIDs = append(gcpIDs, gcpID)
+				}
+				pm.refetchMutex.Unlock()
+
+				for _, gcpID := range gcpIDs {
+					if _, exists := pm.gcpPrintersByGCPID.Get(gcpID); !exists {
+						pm.refetched(gcpID)
+						continue
+					}
+					if _, err := pm.fetchJobs(gcpID); err != nil {
+						logger.Warningf(logger.Fields{"gcp_printer_id": gcpID, "phase": "fetch"},
+							"Failed to fetch queued jobs for printer %s again: %s", gcpID, err)
+					}
+				}
+
+			case <-pm.quit:
+				return
+			}
+		}
+	}()
+}
+
+// refetched forgets that a printer's queued jobs need to be fetched again.
+func (pm *PrinterManager) refetched(gcpID string) {
+	pm.refetchMutex.Lock()
+	defer pm.refetchMutex.Unlock()
+
+	delete(pm.refetchPrinters, gcpID)
+}
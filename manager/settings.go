@@ -0,0 +1,174 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// Settings are the PrinterManager settings that can be changed while the
+// connector runs, with Reconfigure.
+type Settings struct {
+	PrinterPollInterval      time.Duration
+	PrinterStatePollInterval time.Duration
+	GCPMaxConcurrentDownload uint
+	CUPSQueueSize            uint
+	JobFullUsername          bool
+	IgnoreRawPrinters        bool
+	SharedPrintersOnly       bool
+	StreamJobs               bool
+	// Scopes to share all printers with, and scopes to share individual
+	// printers with, by CUPS printer name.
+	ShareScopes        []string
+	PrinterShareScopes map[string][]string
+	// Role (USER or MANAGER) to share printers with.
+	ShareRole string
+	// Whether to unshare printers from scopes that aren't configured.
+	ShareRevokeUnlisted bool
+	// Tags to add to printers, by CUPS printer name; see lib.AddPrinterTags.
+	// Changes take effect at the next printer sync.
+	PrinterTags map[string]map[string]string
+	// Daily page quotas, by CUPS printer name; see lib.SetDailyQuotas.
+	// Changes take effect at the next printer sync.
+	PrinterDailyQuota map[string]uint
+	// Percentage of a printer's recent jobs that must fail to send an
+	// alert; zero disables. See alertJobErrorRate.
+	AlertJobErrorPercent uint
+	// Owners, as email addresses or domains, whose jobs are printed; empty
+	// allows everyone. See ownerAllowed.
+	JobOwnerAllowlist []string
+	// How to translate job owners into CUPS users; nil when they aren't.
+	// See jobUser.
+	JobOwnerMap *lib.JobOwnerMap
+	// The patterns of JobOwnerMap, compiled by validate.
+	ownerPatterns []*regexp.Regexp
+	// CUPS user to submit all jobs as; empty submits jobs as their owners.
+	JobUser string
+	// Whether to send job owners in the job-accounting-user-id attribute.
+	JobAccountingOwner bool
+	// When to print jobs, as job-hold-until values, by CUPS printer name;
+	// see jobHoldUntil.
+	JobHoldUntil map[string]string
+	// Maximum size, in megabytes, of a job document; zero means no limit.
+	MaxDownloadMB uint
+	// Maximum age of a job when it is fetched; zero means no limit. See
+	// jobExpired.
+	MaxJobAge time.Duration
+	// Maximum quantity of each printer's jobs to start processing per
+	// minute; zero means no limit. See dispatchJobs.
+	MaxJobsPerMinute uint
+	// How long a printer's device may go unseen before it is probed before
+	// fetching its jobs, and how long a probe waits; zero ProbeInterval
+	// disables probes. See printerReachable.
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+}
+
+func (s *Settings) validate() error {
+	if s.ShareRole != "USER" && s.ShareRole != "MANAGER" {
+		return fmt.Errorf("Share role must be USER or MANAGER, not %s", s.ShareRole)
+	}
+	if s.AlertJobErrorPercent > 100 {
+		return fmt.Errorf("Alert job error percent must be at most 100, not %d", s.AlertJobErrorPercent)
+	}
+	if s.PrinterPollInterval <= 0 || s.PrinterStatePollInterval <= 0 {
+		return fmt.Errorf("Printer poll intervals must be positive")
+	}
+	if s.MaxJobAge < 0 {
+		return fmt.Errorf("Max job age must not be negative, not %s", s.MaxJobAge)
+	}
+	if s.ProbeInterval > 0 && s.ProbeTimeout <= 0 {
+		return fmt.Errorf("Printer probe timeout must be positive, not %s", s.ProbeTimeout)
+	}
+
+	s.ownerPatterns = nil
+	if s.JobOwnerMap != nil {
+		for _, p := range s.JobOwnerMap.Patterns {
+			re, err := regexp.Compile(p.Match)
+			if err != nil {
+				return fmt.Errorf("Job owner pattern %s is invalid: %s", p.Match, err)
+			}
+			s.ownerPatterns = append(s.ownerPatterns, re)
+		}
+	}
+	return nil
+}
+
+// settings returns a copy of the current settings.
+func (pm *PrinterManager) settings() Settings {
+	pm.settingsMutex.RLock()
+	defer pm.settingsMutex.RUnlock()
+
+	return pm.s
+}
+
+// getDownloadSemaphore returns the semaphore that limits concurrent
+// downloads. Acquire and Release the same semaphore, because Reconfigure
+// may replace it in between.
+func (pm *PrinterManager) getDownloadSemaphore() *lib.Semaphore {
+	pm.settingsMutex.RLock()
+	defer pm.settingsMutex.RUnlock()
+
+	return pm.downloadSemaphore
+}
+
+// Reconfigure applies new settings without interrupting jobs. Poll
+// intervals take effect immediately, a new CUPS queue size and printer tags
+// take effect at the next printer sync, and printers are shared again when sharing
+// settings changed.
+func (pm *PrinterManager) Reconfigure(s Settings) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	pm.settingsMutex.Lock()
+	old := pm.s
+	pm.s = s
+	if s.GCPMaxConcurrentDownload != old.GCPMaxConcurrentDownload {
+		pm.downloadSemaphore = lib.NewSemaphore(s.GCPMaxConcurrentDownload)
+	}
+	if s.PrinterPollInterval != old.PrinterPollInterval {
+		updateInterval(pm.printerPollIntervalUpdates, s.PrinterPollInterval)
+	}
+	if s.PrinterStatePollInterval != old.PrinterStatePollInterval && pm.snmp == nil {
+		updateInterval(pm.printerStatePollIntervalUpdates, s.PrinterStatePollInterval)
+	}
+	pm.settingsMutex.Unlock()
+
+	if !reflect.DeepEqual(s.ShareScopes, old.ShareScopes) ||
+		!reflect.DeepEqual(s.PrinterShareScopes, old.PrinterShareScopes) ||
+		s.ShareRole != old.ShareRole || s.ShareRevokeUnlisted != old.ShareRevokeUnlisted {
+		if pm.gcp.CanShare() && pm.directoryPending() {
+			glog.Info("Sharing settings changed; printers are shared again once the directory groups are resolved")
+		} else if pm.gcp.CanShare() {
+			glog.Info("Sharing settings changed; sharing printers again")
+			go pm.reconcileSharing()
+		} else {
+			glog.Warning("Sharing settings changed, but printers can't be shared without the user refresh token")
+		}
+	}
+
+	return nil
+}
+
+// updateInterval replaces any pending interval update in ch with interval.
+// Called with settingsMutex held, so there is one sender at a time.
+func updateInterval(ch chan time.Duration, interval time.Duration) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- interval
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// augmentStatesWithSNMP adds the SNMP state of printers to their CUPS
+// states, in place. Returns the SNMP faults of the printers, by name; nil
+// when SNMP is disabled.
+func (pm *PrinterManager) augmentStatesWithSNMP(printers []lib.Printer, cupsStates map[string]*cdd.PrinterStateSection) map[string][]string {
+	if pm.snmp == nil {
+		return nil
+	}
+
+	// Augment copies with fresh CUPS states, so that the stored printers'
+	// states and descriptions, which are shared, don't change.
+	augmented := make([]lib.Printer, 0, len(printers))
+	for i := range printers {
+		if state, exists := cupsStates[printers[i].Name]; exists {
+			p := printers[i]
+			p.State = state
+			p.SNMPFaults = nil
+			augmented = append(augmented, p)
+		}
+	}
+	if err := pm.snmp.AugmentPrinterStates(augmented); err != nil {
+		glog.Warningf("Failed to augment printer states with SNMP data: %s", err)
+	}
+
+	faults := make(map[string][]string, len(augmented))
+	for i := range augmented {
+		faults[augmented[i].Name] = augmented[i].SNMPFaults
+	}
+	return faults
+}
+
+// printerFaulted answers the question "should jobs be left queued in GCP
+// because the printer reports a fault over SNMP, like door open?"
+func (pm *PrinterManager) printerFaulted(printer lib.Printer) bool {
+	return pm.snmpPauseOnFault && len(printer.SNMPFaults) > 0
+}
+
+// fetchJobsOfRecoveredPrinters fetches the jobs that were left queued for
+// printers that had faults in oldPrinters, and don't in currentPrinters.
+func (pm *PrinterManager) fetchJobsOfRecoveredPrinters(oldPrinters, currentPrinters []lib.Printer) {
+	if !pm.snmpPauseOnFault {
+		return
+	}
+
+	faulted := make(map[string]struct{})
+	for _, printer := range oldPrinters {
+		if pm.printerFaulted(printer) {
+			faulted[printer.GCPID] = struct{}{}
+		}
+	}
+	for _, printer := range currentPrinters {
+		if _, exists := faulted[printer.GCPID]; exists && !pm.printerFaulted(printer) {
+			glog.Infof("Printer %s recovered; fetching its jobs", printer.Name)
+			go pm.handlePrinterNewJobs(printer.GCPID)
+		}
+	}
+}
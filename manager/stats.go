@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import "time"
+
+// printerJobStats counts the finished jobs of one printer.
+type printerJobStats struct {
+	done      uint
+	errored   uint
+	cancelled uint
+
+	// Why the last failed job failed, and when.
+	lastError     string
+	lastErrorTime time.Time
+
+	// Whether each of the last alertJobWindow jobs failed, oldest first,
+	// and whether the error rate alert was sent; see alertJobErrorRate.
+	recentErrors []bool
+	alerted      bool
+}
+
+// PrinterStats describes the jobs and queue of one printer, for monitoring.
+type PrinterStats struct {
+	Name   string `json:"name"`
+	GCPID  string `json:"gcp_id"`
+	State  string `json:"state"`
+	Paused bool   `json:"paused"`
+
+	JobsDone       uint `json:"jobs_done"`
+	JobsError      uint `json:"jobs_error"`
+	JobsCancelled  uint `json:"jobs_cancelled"`
+	JobsInProgress uint `json:"jobs_in_progress"`
+
+	// Why the last failed job failed, and when; empty when no job failed.
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+
+	// Jobs submitted to CUPS and not finished, of at most QueueSize; see
+	// cups_job_queue_size.
+	QueueOccupancy uint `json:"queue_occupancy"`
+	QueueSize      uint `json:"queue_size"`
+}
+
+// DownloadStats describes the concurrent job downloads, for monitoring.
+type DownloadStats struct {
+	Downloads    uint `json:"downloads"`
+	MaxDownloads uint `json:"max_downloads"`
+}
+
+// GetPrinterStats returns the job stats of each printer that this manager
+// has registered with GCP, sorted by name.
+func (pm *PrinterManager) GetPrinterStats() []PrinterStats {
+	inProgress := make(map[string]uint)
+	for _, job := range pm.InFlightJobs() {
+		inProgress[job.GCPPrinterID]++
+	}
+
+	printers := pm.Printers()
+	stats := make([]PrinterStats, len(printers))
+
+	pm.jobStatsMutex.Lock()
+	defer pm.jobStatsMutex.Unlock()
+
+	for i, printer := range printers {
+		stats[i] = PrinterStats{
+			Name:           printer.Name,
+			GCPID:          printer.GCPID,
+			State:          printer.State,
+			Paused:         printer.Paused,
+			JobsInProgress: inProgress[printer.GCPID],
+		}
+		if s, exists := pm.printerJobStats[printer.GCPID]; exists {
+			stats[i].JobsDone = s.done
+			stats[i].JobsError = s.errored
+			stats[i].JobsCancelled = s.cancelled
+			stats[i].LastError = s.lastError
+			stats[i].LastErrorTime = s.lastErrorTime
+		}
+		if p, exists := pm.gcpPrintersByGCPID.Get(printer.GCPID); exists && p.CUPSJobSemaphore != nil {
+			stats[i].QueueOccupancy = p.CUPSJobSemaphore.Count()
+			stats[i].QueueSize = p.CUPSJobSemaphore.Size()
+		}
+	}
+
+	return stats
+}
+
+// GetDownloadStats returns how many jobs are being downloaded.
+func (pm *PrinterManager) GetDownloadStats() DownloadStats {
+	downloadSemaphore := pm.getDownloadSemaphore()
+	return DownloadStats{
+		Downloads:    downloadSemaphore.Count(),
+		MaxDownloads: downloadSemaphore.Size(),
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// How long TestPrint follows a test page in CUPS before it gives up.
+const testPrintTimeout = 2 * time.Minute
+
+// TestPrintPhase is the outcome of one phase of a test print: generate,
+// submit or print.
+type TestPrintPhase struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+	// Why the phase failed; empty when it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// TestPrintResult describes a test print, phase by phase. The phases after
+// a failed phase are missing.
+type TestPrintResult struct {
+	Printer string `json:"printer"`
+	// CUPS job ID; zero when the test page didn't reach CUPS.
+	CUPSJobID uint32 `json:"cups_job_id,omitempty"`
+	// GCP job state that the CUPS job ended in, or IN_PROGRESS when it
+	// didn't end in time.
+	State  string           `json:"state,omitempty"`
+	Phases []TestPrintPhase `json:"phases"`
+}
+
+// TestPrint prints a test page on a printer through the same steps as a
+// job from GCP, without GCP: the page is written to a temporary file,
+// submitted to CUPS, and followed until CUPS is done with it, or for
+// testPrintTimeout.
+//
+// Returns false when this manager doesn't handle the printer.
+func (pm *PrinterManager) TestPrint(printerName string) (*TestPrintResult, bool) {
+	var printer lib.Printer
+	var exists bool
+	for _, p := range pm.gcpPrintersByGCPID.GetAll() {
+		if p.Name == printerName {
+			printer, exists = p, true
+			break
+		}
+	}
+	if !exists {
+		return nil, false
+	}
+
+	result := &TestPrintResult{Printer: printerName}
+	phase := func(name string, start time.Time, err error) bool {
+		p := TestPrintPhase{Phase: name, Seconds: time.Since(start).Seconds()}
+		if err != nil {
+			p.Error = err.Error()
+			glog.Warningf("Test print on printer %s failed to %s: %s", printerName, name, err)
+		}
+		result.Phases = append(result.Phases, p)
+		return err == nil
+	}
+
+	t := time.Now()
+	filename, err := pm.writeTestPage(printerName)
+	if !phase("generate", t, err) {
+		return result, true
+	}
+	defer pm.spool.Remove(filename)
+
+	t = time.Now()
+	user := pm.settings().JobUser
+	if user == "" {
+		user = testPrintUser
+	}
+	ticket := cdd.CloudJobTicket{Version: "1.0"}
+	printer.CUPSJobSemaphore.Acquire()
+	result.CUPSJobID, err = pm.printFile(printerName, filename, "Test page", user, lib.ContentTypePDF, ticket)
+	printer.CUPSJobSemaphore.Release()
+	if !phase("submit", t, err) {
+		return result, true
+	}
+	glog.Infof("Submitted test page for printer %s as CUPS job %d", printerName, result.CUPSJobID)
+
+	t = time.Now()
+	state, err := pm.waitForCUPSJob(result.CUPSJobID, testPrintTimeout)
+	result.State = state.State.Type
+	if err == nil && state.State.Type != "DONE" {
+		err = fmt.Errorf("CUPS job %d is %s", result.CUPSJobID, state.State.Type)
+	}
+	phase("print", t, err)
+	return result, true
+}
+
+// testPrintUser is the CUPS user that test pages are submitted as, unless
+// all jobs are submitted as JobUser.
+const testPrintUser = "cups-connector"
+
+// writeTestPage writes a test page for a printer to a new temporary file,
+// through the spool, and returns the file's name.
+func (pm *PrinterManager) writeTestPage(printerName string) (string, error) {
+	f, err := pm.backend.CreateTempFile()
+	if err != nil {
+		return "", err
+	}
+	w, err := pm.spool.Writer(f)
+	if err == nil {
+		_, err = w.Write(testPagePDF(printerName, time.Now()))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		pm.spool.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// waitForCUPSJob polls the state of a CUPS job until it isn't IN_PROGRESS,
+// or until timeout, and returns the last state.
+func (pm *PrinterManager) waitForCUPSJob(cupsJobID uint32, timeout time.Duration) (cdd.PrintJobStateDiff, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := pm.backend.GetJobState(cupsJobID)
+		if err != nil || state.State.Type != "IN_PROGRESS" || time.Now().After(deadline) {
+			return state, err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// testPagePDF returns a one-page, letter-sized PDF that names the printer
+// and the time.
+func testPagePDF(printerName string, now time.Time) []byte {
+	lines := []string{
+		lib.FullName,
+		"",
+		"Test page for printer " + printerName,
+		"Printed " + now.Format(time.RFC1123),
+		"",
+		"If you can read this, the printer can print jobs from the connector.",
+	}
+	var content bytes.Buffer
+	content.WriteString("BT /F1 12 Tf 72 720 Td 16 TL\n")
+	for _, line := range lines {
+		fmt.Fprintf(&content, "(%s) '\n", pdfString(line))
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+// pdfString escapes s for a PDF literal string. Characters that the
+// standard fonts can't show become question marks.
+func pdfString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Tags are the dimensions of a metric, like the printer name.
+type Tags map[string]string
+
+// Exporter sends metrics to a monitoring system, like StatsD or an
+// OpenTelemetry collector. Methods must be safe to call concurrently, and
+// must not block for long.
+type Exporter interface {
+	// Count adds delta to a counter.
+	Count(name string, delta int64, tags Tags)
+	// Gauge sets a gauge to value.
+	Gauge(name string, value float64, tags Tags)
+	// Timing records a duration in a histogram.
+	Timing(name string, d time.Duration, tags Tags)
+	// Close sends what's left, and stops the exporter.
+	Close() error
+}
+
+var (
+	mutex     sync.RWMutex
+	exporters []Exporter
+	prefix    string
+)
+
+// Start sends metrics to exporters, with names that start with namePrefix
+// and a dot. Until Start is called, metrics are discarded.
+func Start(namePrefix string, e ...Exporter) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	prefix = namePrefix
+	exporters = e
+}
+
+// Stop closes the exporters, and discards metrics from then on.
+func Stop() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, e := range exporters {
+		if err := e.Close(); err != nil {
+			glog.Warningf("Failed to close metrics exporter: %s", err)
+		}
+	}
+	exporters = nil
+}
+
+// Count adds delta to the counter named name.
+func Count(name string, delta int64, tags Tags) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, e := range exporters {
+		e.Count(fullName(name), delta, tags)
+	}
+}
+
+// Gauge sets the gauge named name to value.
+func Gauge(name string, value float64, tags Tags) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, e := range exporters {
+		e.Gauge(fullName(name), value, tags)
+	}
+}
+
+// Timing records d in the histogram named name.
+func Timing(name string, d time.Duration, tags Tags) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, e := range exporters {
+		e.Timing(fullName(name), d, tags)
+	}
+}
+
+// Since records the time since start in the histogram named name.
+func Since(name string, start time.Time, tags Tags) {
+	Timing(name, time.Since(start), tags)
+}
+
+// fullName prefixes name. Called with mutex held.
+func fullName(name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
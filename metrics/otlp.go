@@ -0,0 +1,346 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const otlpTimeout = 10 * time.Second
+
+// Upper bounds, in seconds, of the histogram buckets of timings.
+var otlpBucketBounds = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// otlpExporter aggregates metrics in memory, and posts them every interval
+// to an OpenTelemetry collector, as OTLP/HTTP JSON. Counters and histograms
+// are cumulative since the exporter started.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+	start  time.Time
+
+	mutex      sync.Mutex
+	counters   map[string]*otlpCounter
+	gauges     map[string]*otlpGauge
+	histograms map[string]*otlpHistogram
+
+	quit chan chan error
+}
+
+type otlpCounter struct {
+	name  string
+	tags  Tags
+	value int64
+}
+
+type otlpGauge struct {
+	name  string
+	tags  Tags
+	value float64
+}
+
+type otlpHistogram struct {
+	name    string
+	tags    Tags
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+// NewOTLPExporter sends metrics every interval to the OpenTelemetry
+// collector at endpoint, like "http://localhost:4318".
+func NewOTLPExporter(endpoint string, interval time.Duration) (Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("OTLP endpoint must be an http or https URL, not %s", endpoint)
+	}
+
+	e := &otlpExporter{
+		url:        strings.TrimSuffix(endpoint, "/") + "/v1/metrics",
+		client:     &http.Client{Timeout: otlpTimeout},
+		start:      time.Now(),
+		counters:   make(map[string]*otlpCounter),
+		gauges:     make(map[string]*otlpGauge),
+		histograms: make(map[string]*otlpHistogram),
+		quit:       make(chan chan error),
+	}
+	go e.exportPeriodically(interval)
+	return e, nil
+}
+
+// seriesKey identifies a metric with tags.
+func seriesKey(name string, tags Tags) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(name)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\x00%s\x00%s", key, tags[key])
+	}
+	return b.String()
+}
+
+func (e *otlpExporter) Count(name string, delta int64, tags Tags) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	key := seriesKey(name, tags)
+	c, exists := e.counters[key]
+	if !exists {
+		c = &otlpCounter{name: name, tags: tags}
+		e.counters[key] = c
+	}
+	c.value += delta
+}
+
+func (e *otlpExporter) Gauge(name string, value float64, tags Tags) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.gauges[seriesKey(name, tags)] = &otlpGauge{name, tags, value}
+}
+
+func (e *otlpExporter) Timing(name string, d time.Duration, tags Tags) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	key := seriesKey(name, tags)
+	h, exists := e.histograms[key]
+	if !exists {
+		h = &otlpHistogram{name: name, tags: tags, buckets: make([]uint64, len(otlpBucketBounds)+1)}
+		e.histograms[key] = h
+	}
+	seconds := d.Seconds()
+	h.count++
+	h.sum += seconds
+	i := sort.SearchFloat64s(otlpBucketBounds, seconds)
+	h.buckets[i]++
+}
+
+func (e *otlpExporter) Close() error {
+	ch := make(chan error)
+	e.quit <- ch
+	return <-ch
+}
+
+func (e *otlpExporter) exportPeriodically(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := e.export(); err != nil {
+				glog.Warningf("Failed to export metrics: %s", err)
+			}
+		case ch := <-e.quit:
+			ch <- e.export()
+			return
+		}
+	}
+}
+
+// export posts the current values of all metrics.
+func (e *otlpExporter) export() error {
+	b, err := json.Marshal(e.request())
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("OTLP collector at %s answered %s", e.url, response.Status)
+	}
+	return nil
+}
+
+// The subset of the OTLP JSON encoding that the exporter uses. 64-bit
+// integers are strings, per the protobuf JSON mapping.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt,omitempty"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+	Count             string          `json:"count,omitempty"`
+	Sum               *float64        `json:"sum,omitempty"`
+	BucketCounts      []string        `json:"bucketCounts,omitempty"`
+	ExplicitBounds    []float64       `json:"explicitBounds,omitempty"`
+}
+
+type otlpDataPoints struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool            `json:"isMonotonic,omitempty"`
+}
+
+type otlpMetric struct {
+	Name      string          `json:"name"`
+	Unit      string          `json:"unit,omitempty"`
+	Sum       *otlpDataPoints `json:"sum,omitempty"`
+	Gauge     *otlpDataPoints `json:"gauge,omitempty"`
+	Histogram *otlpDataPoints `json:"histogram,omitempty"`
+}
+
+// Cumulative aggregation temporality.
+const otlpCumulative = 2
+
+func otlpAttributes(tags Tags) []otlpAttribute {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		attributes[i].Key = key
+		attributes[i].Value.StringValue = tags[key]
+	}
+	return attributes
+}
+
+func otlpNanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// request builds an OTLP ExportMetricsServiceRequest, with one metric per
+// name, and one data point per set of tags.
+func (e *otlpExporter) request() interface{} {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	start, now := otlpNanos(e.start), otlpNanos(time.Now())
+	// A name has one kind of metric; the first kind seen wins.
+	metrics := make(map[string]*otlpMetric)
+	metric := func(name, unit string) *otlpMetric {
+		m, exists := metrics[name]
+		if !exists {
+			m = &otlpMetric{Name: name, Unit: unit}
+			metrics[name] = m
+		}
+		return m
+	}
+
+	for _, c := range e.counters {
+		m := metric(c.name, "1")
+		if m.Sum == nil {
+			m.Sum = &otlpDataPoints{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		}
+		points := m.Sum
+		points.DataPoints = append(points.DataPoints, otlpDataPoint{
+			Attributes:        otlpAttributes(c.tags),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsInt:             strconv.FormatInt(c.value, 10),
+		})
+	}
+	for _, g := range e.gauges {
+		m := metric(g.name, "1")
+		if m.Sum != nil {
+			continue
+		}
+		if m.Gauge == nil {
+			m.Gauge = &otlpDataPoints{}
+		}
+		points := m.Gauge
+		value := g.value
+		points.DataPoints = append(points.DataPoints, otlpDataPoint{
+			Attributes:   otlpAttributes(g.tags),
+			TimeUnixNano: now,
+			AsDouble:     &value,
+		})
+	}
+	for _, h := range e.histograms {
+		m := metric(h.name, "s")
+		if m.Sum != nil || m.Gauge != nil {
+			continue
+		}
+		if m.Histogram == nil {
+			m.Histogram = &otlpDataPoints{AggregationTemporality: otlpCumulative}
+		}
+		points := m.Histogram
+		bucketCounts := make([]string, len(h.buckets))
+		for i, count := range h.buckets {
+			bucketCounts[i] = strconv.FormatUint(count, 10)
+		}
+		sum := h.sum
+		points.DataPoints = append(points.DataPoints, otlpDataPoint{
+			Attributes:        otlpAttributes(h.tags),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Count:             strconv.FormatUint(h.count, 10),
+			Sum:               &sum,
+			BucketCounts:      bucketCounts,
+			ExplicitBounds:    otlpBucketBounds,
+		})
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*otlpMetric, len(names))
+	for i, name := range names {
+		list[i] = metrics[name]
+	}
+
+	serviceName := otlpAttribute{Key: "service.name"}
+	serviceName.Value.StringValue = filepath.Base(os.Args[0])
+	hostName := otlpAttribute{Key: "host.name"}
+	hostName.Value.StringValue, _ = os.Hostname()
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{serviceName, hostName},
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "github.com/google/cups-connector/metrics"},
+						"metrics": list,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statsDExporter sends each metric as a UDP datagram, in the StatsD line
+// format, with tags in the DogStatsD extension that Datadog understands.
+type statsDExporter struct {
+	conn net.Conn
+}
+
+// NewStatsDExporter sends metrics to the StatsD server at address, like
+// "localhost:8125".
+func NewStatsDExporter(address string) (Exporter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to StatsD at %s: %s", address, err)
+	}
+	return &statsDExporter{conn}, nil
+}
+
+func (s *statsDExporter) Count(name string, delta int64, tags Tags) {
+	s.send(name, fmt.Sprintf("%d", delta), "c", tags)
+}
+
+func (s *statsDExporter) Gauge(name string, value float64, tags Tags) {
+	s.send(name, fmt.Sprintf("%g", value), "g", tags)
+}
+
+func (s *statsDExporter) Timing(name string, d time.Duration, tags Tags) {
+	s.send(name, fmt.Sprintf("%g", d.Seconds()*1000), "ms", tags)
+}
+
+func (s *statsDExporter) Close() error {
+	return s.conn.Close()
+}
+
+// send writes one metric. UDP doesn't block on an absent server, and lost
+// metrics aren't worth a log line, so errors are ignored.
+func (s *statsDExporter) send(name, value, statsDType string, tags Tags) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:%s|%s", statsDName(name), value, statsDType)
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			if i == 0 {
+				b.WriteString("|#")
+			} else {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s:%s", statsDName(key), statsDName(tags[key]))
+		}
+	}
+	s.conn.Write(b.Bytes())
+}
+
+// statsDName replaces the characters that delimit StatsD fields.
+func statsDName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '#', ',', '@', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
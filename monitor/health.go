@@ -0,0 +1,152 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/gcp"
+	"github.com/google/cups-connector/manager"
+	"github.com/google/cups-connector/xmpp"
+
+	"github.com/golang/glog"
+)
+
+// Readiness is checked at most this often, so that frequent probes don't
+// load CUPS and GCP.
+const readinessCheckInterval = 5 * time.Second
+
+// HealthServer serves HTTP endpoints for systemd, Kubernetes and uptime
+// checks:
+//
+// /healthz answers 200 while the connector runs.
+//
+// /readyz answers 200 when CUPS, or the print backend in use, is reachable,
+// the last printer sync of each GCP account succeeded, and all XMPP
+// conversations are connected, or 503 otherwise. The body has one line per
+// dependency, saying "ok" or what is wrong. GCP accounts and their XMPP
+// conversations are numbered in config order. GCP isn't called; the
+// outcome of the last sync is reported, so that probes can't pile up behind
+// GCP retries.
+type HealthServer struct {
+	backend  manager.PrintBackend
+	gcps     []*gcp.GoogleCloudPrint
+	pms      []*manager.PrinterManager
+	xmpps    []*xmpp.XMPP
+	listener net.Listener
+
+	readinessMutex sync.Mutex
+	checked        time.Time
+	ready          bool
+	report         []byte
+}
+
+// NewHealthServer serves the health endpoints on listener, which is bound
+// already, so that it can be bound before root privileges are dropped.
+// gcps, pms and xmpps hold one object per GCP account that printers are
+// sharded across.
+func NewHealthServer(backend manager.PrintBackend, gcps []*gcp.GoogleCloudPrint, pms []*manager.PrinterManager, xmpps []*xmpp.XMPP, listener net.Listener) *HealthServer {
+	h := HealthServer{backend: backend, gcps: gcps, pms: pms, xmpps: xmpps, listener: listener}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	go func() {
+		// Serve returns when the listener is closed by Quit.
+		if err := http.Serve(listener, mux); err != nil {
+			glog.Infof("Stopped serving health checks: %s", err)
+		}
+	}()
+
+	return &h
+}
+
+// syncError says what is wrong with GCP, as the outcome of the last printer
+// sync tells, or returns nil.
+func syncError(status manager.SyncStatus) error {
+	switch {
+	case status.LastSync.IsZero():
+		return fmt.Errorf("printers not synchronized yet")
+	case status.LastError != "":
+		return fmt.Errorf("last printer sync failed at %s: %s", status.LastSync.Format(time.RFC3339), status.LastError)
+	case status.Degraded:
+		return fmt.Errorf("unreachable since startup; printing to cached printers")
+	}
+	return nil
+}
+
+func (h *HealthServer) Quit() {
+	h.listener.Close()
+}
+
+func (h *HealthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+func (h *HealthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	ready, report := h.readiness()
+	w.Header().Set("Content-Type", "text/plain")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(report)
+}
+
+// readiness checks the dependencies, or returns the result of the last
+// check when it was recent.
+func (h *HealthServer) readiness() (bool, []byte) {
+	h.readinessMutex.Lock()
+	defer h.readinessMutex.Unlock()
+
+	if time.Since(h.checked) < readinessCheckInterval {
+		return h.ready, h.report
+	}
+
+	var report bytes.Buffer
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			ready = false
+			fmt.Fprintf(&report, "%s: %s\n", name, err)
+		} else {
+			fmt.Fprintf(&report, "%s: ok\n", name)
+		}
+	}
+
+	_, err := h.backend.GetPrinterStates()
+	check("cups", err)
+
+	for i, gcp := range h.gcps {
+		err := gcp.AuthError()
+		if err == nil {
+			err = syncError(h.pms[i].SyncStatus())
+		}
+		check(fmt.Sprintf("gcp-%d", i), err)
+	}
+
+	for i, x := range h.xmpps {
+		var err error
+		if health := x.Health(); !health.Connected {
+			if health.StateChanged.IsZero() {
+				err = fmt.Errorf("not connected yet")
+			} else {
+				err = fmt.Errorf("disconnected since %s", health.StateChanged.Format(time.RFC3339))
+			}
+		}
+		check(fmt.Sprintf("xmpp-%d", i), err)
+	}
+
+	h.checked, h.ready, h.report = time.Now(), ready, report.Bytes()
+	return h.ready, h.report
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package monitor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/manager"
+)
+
+func TestSyncError(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		status manager.SyncStatus
+		want   string
+	}{
+		{manager.SyncStatus{}, "not synchronized yet"},
+		{manager.SyncStatus{LastSync: now, LastSuccess: now}, ""},
+		{manager.SyncStatus{LastSync: now, LastError: "GCP said no"}, "GCP said no"},
+		{manager.SyncStatus{LastSync: now, Degraded: true}, "unreachable since startup"},
+	} {
+		err := syncError(test.status)
+		if test.want == "" && err != nil {
+			t.Errorf("syncError(%+v) = %s, want nil", test.status, err)
+		} else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("syncError(%+v) = %v, want %q", test.status, err, test.want)
+		}
+	}
+}
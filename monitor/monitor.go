@@ -10,11 +10,12 @@ package monitor
 import (
 	"fmt"
 	"net"
+	"time"
 
-	"github.com/google/cups-connector/cups"
 	"github.com/google/cups-connector/gcp"
 	"github.com/google/cups-connector/lib"
 	"github.com/google/cups-connector/manager"
+	"github.com/google/cups-connector/xmpp"
 
 	"github.com/golang/glog"
 )
@@ -22,22 +23,31 @@ import (
 const monitorFormat = `cups-printers=%d
 cups-raw-printers=%d
 gcp-printers=%d
+gcp-auth-errors=%d
 cups-conn-qty=%d
 cups-conn-max-qty=%d
 jobs-done=%d
 jobs-error=%d
 jobs-in-progress=%d
+xmpp-connected=%d
+xmpp-disconnected=%d
+xmpp-reconnects=%d
+xmpp-last-ping=%d
+xmpp-last-notification=%d
 `
 
 type Monitor struct {
-	cups         *cups.CUPS
-	gcp          *gcp.GoogleCloudPrint
-	pm           *manager.PrinterManager
+	backend      manager.PrintBackend
+	gcps         []*gcp.GoogleCloudPrint
+	pms          []*manager.PrinterManager
+	xmpps        []*xmpp.XMPP
 	listenerQuit chan bool
 }
 
-func NewMonitor(cups *cups.CUPS, gcp *gcp.GoogleCloudPrint, pm *manager.PrinterManager, socketFilename string) (*Monitor, error) {
-	m := Monitor{cups, gcp, pm, make(chan bool)}
+// NewMonitor listens for monitor requests. gcps, pms and xmpps hold one
+// object per GCP account that printers are sharded across.
+func NewMonitor(backend manager.PrintBackend, gcps []*gcp.GoogleCloudPrint, pms []*manager.PrinterManager, xmpps []*xmpp.XMPP, socketFilename string) (*Monitor, error) {
+	m := Monitor{backend, gcps, pms, xmpps, make(chan bool)}
 
 	listener, err := net.ListenUnix("unix", &net.UnixAddr{socketFilename, "unix"})
 	if err != nil {
@@ -74,8 +84,12 @@ func (m *Monitor) listen(listener net.Listener) {
 		select {
 		case conn := <-ch:
 			glog.Info("Received monitor request")
-			stats, err := m.getStats()
-			if err != nil {
+			if request, err := readRequest(conn); err != nil {
+				glog.Warningf("Monitor request failed: %s", err)
+				conn.Write([]byte("error"))
+			} else if request != nil {
+				conn.Write(m.getJSONStats(request))
+			} else if stats, err := m.getStats(); err != nil {
 				glog.Warningf("Monitor request failed: %s", err)
 				conn.Write([]byte("error"))
 			} else {
@@ -99,9 +113,9 @@ func (m *Monitor) Quit() {
 }
 
 func (m *Monitor) getStats() (string, error) {
-	var cupsPrinterQuantity, rawPrinterQuantity, gcpPrinterQuantity int
+	var cupsPrinterQuantity, rawPrinterQuantity, gcpPrinterQuantity, gcpAuthErrorQuantity int
 
-	if cupsPrinters, err := m.cups.GetPrinters(); err != nil {
+	if cupsPrinters, err := m.backend.GetPrinters(); err != nil {
 		return "", err
 	} else {
 		cupsPrinterQuantity = len(cupsPrinters)
@@ -109,25 +123,71 @@ func (m *Monitor) getStats() (string, error) {
 		rawPrinterQuantity = len(rawPrinters)
 	}
 
-	cupsConnOpen := m.cups.ConnQtyOpen()
-	cupsConnMax := m.cups.ConnQtyMax()
+	var cupsConnOpen, cupsConnMax uint
+	if c, ok := m.backend.(manager.ConnectionCounter); ok {
+		cupsConnOpen, cupsConnMax = c.ConnQtyOpen(), c.ConnQtyMax()
+	}
 
-	if gcpPrinters, err := m.gcp.List(); err != nil {
-		return "", err
-	} else {
-		gcpPrinterQuantity = len(gcpPrinters)
+	for _, gcp := range m.gcps {
+		if err := gcp.AuthError(); err != nil {
+			// Surface the degraded state rather than fail the whole request.
+			gcpAuthErrorQuantity++
+			continue
+		}
+		if gcpPrinters, err := gcp.List(); err != nil {
+			return "", err
+		} else {
+			gcpPrinterQuantity += len(gcpPrinters)
+		}
 	}
 
-	jobsDone, jobsError, jobsProcessing, err := m.pm.GetJobStats()
-	if err != nil {
-		return "", err
+	var jobsDone, jobsError, jobsProcessing uint
+	for _, pm := range m.pms {
+		done, errored, processing, err := pm.GetJobStats()
+		if err != nil {
+			return "", err
+		}
+		jobsDone += done
+		jobsError += errored
+		jobsProcessing += processing
+	}
+
+	// Timestamps are Unix seconds, or 0 for never. The last ping is that of
+	// the least recently pinged conversation, so that one stale conversation
+	// isn't hidden by the others.
+	var xmppConnected, xmppDisconnected, xmppReconnects uint
+	var xmppLastPing, xmppLastNotification time.Time
+	for i, x := range m.xmpps {
+		health := x.Health()
+		if health.Connected {
+			xmppConnected++
+		} else {
+			xmppDisconnected++
+		}
+		xmppReconnects += health.Reconnects
+		if i == 0 || health.LastPing.Before(xmppLastPing) {
+			xmppLastPing = health.LastPing
+		}
+		if health.LastNotification.After(xmppLastNotification) {
+			xmppLastNotification = health.LastNotification
+		}
 	}
 
 	stats := fmt.Sprintf(
 		monitorFormat,
-		cupsPrinterQuantity, rawPrinterQuantity, gcpPrinterQuantity,
+		cupsPrinterQuantity, rawPrinterQuantity, gcpPrinterQuantity, gcpAuthErrorQuantity,
 		cupsConnOpen, cupsConnMax,
-		jobsDone, jobsError, jobsProcessing)
+		jobsDone, jobsError, jobsProcessing,
+		xmppConnected, xmppDisconnected, xmppReconnects,
+		unixOrZero(xmppLastPing), unixOrZero(xmppLastNotification))
 
 	return stats, nil
 }
+
+// unixOrZero converts t to Unix seconds, or 0 when t is the zero time.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/cups-connector/lib"
+	"github.com/google/cups-connector/manager"
+)
+
+// ProtocolVersion is the version of the JSON monitor protocol.
+//
+// A client that writes a Request, as one line of JSON, receives Stats as
+// JSON. A client that writes nothing receives the text stats of
+// monitorFormat, as before the JSON protocol.
+const ProtocolVersion = 1
+
+// How long to wait for a client to write a Request.
+const requestTimeout = 200 * time.Millisecond
+
+// Request asks for Stats in the protocol version.
+type Request struct {
+	Version int `json:"version"`
+}
+
+// Stats is the JSON answer to a Request.
+type Stats struct {
+	Version int `json:"version"`
+	// Why the stats could not be collected; the other fields are empty.
+	Error string `json:"error,omitempty"`
+
+	CUPS     CUPSStats      `json:"cups"`
+	Accounts []AccountStats `json:"accounts"`
+	Jobs     JobStats       `json:"jobs"`
+	Printers []PrinterStats `json:"printers"`
+}
+
+// CUPSStats describes the connection to CUPS.
+type CUPSStats struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+
+	Printers       int  `json:"printers"`
+	RawPrinters    int  `json:"raw_printers"`
+	Connections    uint `json:"connections"`
+	MaxConnections uint `json:"max_connections"`
+}
+
+// AccountStats describes the connection to one GCP account that printers
+// are sharded across.
+type AccountStats struct {
+	Account int `json:"account"`
+	// Proxy name that the account's printers are registered under, which
+	// tells profiles apart.
+	ProxyName string `json:"proxy_name"`
+
+	// Why the account's credentials don't work; empty if they do.
+	AuthError string `json:"auth_error,omitempty"`
+
+	LastSync        time.Time `json:"last_sync"`
+	LastSyncSuccess time.Time `json:"last_sync_success"`
+	LastSyncError   string    `json:"last_sync_error,omitempty"`
+	Degraded        bool      `json:"degraded"`
+
+	XMPPConnected        bool      `json:"xmpp_connected"`
+	XMPPStateChanged     time.Time `json:"xmpp_state_changed"`
+	XMPPLastPing         time.Time `json:"xmpp_last_ping"`
+	XMPPLastNotification time.Time `json:"xmpp_last_notification"`
+	XMPPReconnects       uint      `json:"xmpp_reconnects"`
+	// Failed XMPP reads in a row, which reads back off after, and how many
+	// times too many failed reads restarted the conversation.
+	XMPPReadErrors       uint `json:"xmpp_read_errors"`
+	XMPPReadCircuitTrips uint `json:"xmpp_read_circuit_trips"`
+
+	manager.DownloadStats
+}
+
+// JobStats counts the jobs of all accounts.
+type JobStats struct {
+	Done       uint `json:"done"`
+	Error      uint `json:"error"`
+	InProgress uint `json:"in_progress"`
+}
+
+// PrinterStats describes the jobs and queue of one printer.
+type PrinterStats struct {
+	Account int `json:"account"`
+	manager.PrinterStats
+}
+
+// readRequest reads a Request from conn. Returns nil when the client wrote
+// nothing.
+func readRequest(conn net.Conn) (*Request, error) {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if len(line) == 0 {
+		// Timeout or EOF: a text client.
+		return nil, nil
+	}
+	if err != nil && err != io.EOF {
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return nil, err
+		}
+	}
+
+	var request Request
+	if err = json.Unmarshal(line, &request); err != nil {
+		return nil, fmt.Errorf("Failed to parse monitor request: %s", err)
+	}
+	return &request, nil
+}
+
+// getJSONStats returns the answer to request, as JSON.
+func (m *Monitor) getJSONStats(request *Request) []byte {
+	stats := Stats{Version: ProtocolVersion}
+	if request.Version != ProtocolVersion {
+		stats.Error = fmt.Sprintf("Protocol version %d is not supported; use %d", request.Version, ProtocolVersion)
+	} else {
+		m.collectStats(&stats)
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return []byte(fmt.Sprintf(`{"version":%d,"error":%q}`, ProtocolVersion, err.Error()))
+	}
+	return append(b, '\n')
+}
+
+// collectStats fills stats. Unreachable dependencies are reported in stats,
+// rather than failing the request.
+func (m *Monitor) collectStats(stats *Stats) {
+	if cupsPrinters, err := m.backend.GetPrinters(); err != nil {
+		stats.CUPS.Error = err.Error()
+	} else {
+		stats.CUPS.Reachable = true
+		stats.CUPS.Printers = len(cupsPrinters)
+		_, rawPrinters := lib.FilterRawPrinters(cupsPrinters)
+		stats.CUPS.RawPrinters = len(rawPrinters)
+	}
+	if c, ok := m.backend.(manager.ConnectionCounter); ok {
+		stats.CUPS.Connections = c.ConnQtyOpen()
+		stats.CUPS.MaxConnections = c.ConnQtyMax()
+	}
+
+	stats.Accounts = make([]AccountStats, len(m.pms))
+	stats.Printers = []PrinterStats{}
+	for i, pm := range m.pms {
+		account := &stats.Accounts[i]
+		account.Account = i
+		account.ProxyName = m.gcps[i].ProxyName()
+		if err := m.gcps[i].AuthError(); err != nil {
+			account.AuthError = err.Error()
+		}
+
+		syncStatus := pm.SyncStatus()
+		account.LastSync = syncStatus.LastSync
+		account.LastSyncSuccess = syncStatus.LastSuccess
+		account.LastSyncError = syncStatus.LastError
+		account.Degraded = syncStatus.Degraded
+
+		health := m.xmpps[i].Health()
+		account.XMPPConnected = health.Connected
+		account.XMPPStateChanged = health.StateChanged
+		account.XMPPLastPing = health.LastPing
+		account.XMPPLastNotification = health.LastNotification
+		account.XMPPReconnects = health.Reconnects
+		account.XMPPReadErrors = health.ReadErrors
+		account.XMPPReadCircuitTrips = health.ReadCircuitTrips
+
+		account.DownloadStats = pm.GetDownloadStats()
+
+		if done, errored, inProgress, err := pm.GetJobStats(); err == nil {
+			stats.Jobs.Done += done
+			stats.Jobs.Error += errored
+			stats.Jobs.InProgress += inProgress
+		}
+
+		for _, printer := range pm.GetPrinterStats() {
+			stats.Printers = append(stats.Printers, PrinterStats{i, printer})
+		}
+	}
+}
@@ -0,0 +1,470 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+	"github.com/google/cups-connector/lib"
+
+	"github.com/golang/glog"
+)
+
+// privetAPI serves the Privet API of one printer.
+type privetAPI struct {
+	gcpID string
+	name  string
+	// Service instance name that the printer is announced as; unique among
+	// the printers, which may share a CUPS printer name across profiles.
+	serviceName string
+	gcpBaseURL  string
+	xsrf        xsrfSecret
+	startTime   time.Time
+
+	// Whether the printer is reachable through GCP; see Privet.SetOnline.
+	onlineMutex sync.Mutex
+	online      bool
+
+	getPrinter        GetPrinterFunc
+	getProximityToken GetProximityTokenFunc
+	printJob          PrintJobFunc
+	getJobState       GetJobStateFunc
+
+	// Jobs created by local clients.
+	jobs *jobCache
+
+	listener *net.TCPListener
+}
+
+func newPrivetAPI(gcpID, name, gcpBaseURL string, portLow, portHigh uint16, getPrinter GetPrinterFunc, getProximityToken GetProximityTokenFunc, printJob PrintJobFunc, getJobState GetJobStateFunc) (*privetAPI, error) {
+	listener, err := listenOnPortRange(portLow, portHigh)
+	if err != nil {
+		return nil, err
+	}
+
+	xsrf, err := newXSRFSecret()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	api := &privetAPI{
+		gcpID:             gcpID,
+		name:              name,
+		gcpBaseURL:        gcpBaseURL,
+		xsrf:              xsrf,
+		startTime:         time.Now(),
+		online:            true,
+		getPrinter:        getPrinter,
+		getProximityToken: getProximityToken,
+		printJob:          printJob,
+		getJobState:       getJobState,
+		jobs:              newJobCache(),
+		listener:          listener,
+	}
+	go api.serve()
+
+	return api, nil
+}
+
+// listenOnPortRange listens on the first available port between low and high.
+func listenOnPortRange(low, high uint16) (*net.TCPListener, error) {
+	for port := uint32(low); port <= uint32(high); port++ {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("No local port available between %d and %d", low, high)
+}
+
+func (api *privetAPI) isOnline() bool {
+	api.onlineMutex.Lock()
+	defer api.onlineMutex.Unlock()
+
+	return api.online
+}
+
+func (api *privetAPI) setOnline(online bool) {
+	api.onlineMutex.Lock()
+	defer api.onlineMutex.Unlock()
+
+	api.online = online
+}
+
+func (api *privetAPI) port() uint16 {
+	return uint16(api.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (api *privetAPI) serve() {
+	sm := http.NewServeMux()
+	sm.HandleFunc("/privet/info", api.info)
+	sm.HandleFunc("/privet/accesstoken", api.accesstoken)
+	sm.HandleFunc("/privet/capabilities", api.capabilities)
+	sm.HandleFunc("/privet/printer/createjob", api.createjob)
+	sm.HandleFunc("/privet/printer/submitdoc", api.submitdoc)
+	sm.HandleFunc("/privet/printer/jobstate", api.jobstate)
+
+	err := http.Serve(api.listener, sm)
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		glog.Errorf("Privet API server for printer %s failed: %s", api.name, err)
+	}
+}
+
+func (api *privetAPI) quit() {
+	api.listener.Close()
+}
+
+// Privet error codes.
+const (
+	errInvalidXPrivetToken = "invalid_x_privet_token"
+	errInvalidParams       = "invalid_params"
+	errServerError         = "server_error"
+	errPrinterUnavailable  = "device_busy"
+	errAccessDenied        = "access_denied"
+	errInvalidTicket       = "invalid_ticket"
+	errInvalidPrintJob     = "invalid_print_job"
+	errInvalidDocumentType = "invalid_document_type"
+	errPrinterError        = "printer_error"
+)
+
+func writeError(w http.ResponseWriter, e, description string) {
+	response := struct {
+		Error       string `json:"error"`
+		Description string `json:"description,omitempty"`
+	}{e, description}
+	if b, err := json.Marshal(response); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	b, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		glog.Errorf("Failed to marshal Privet response: %s", err)
+		writeError(w, errServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// checkRequest verifies the HTTP method and the X-Privet-Token header, and
+// writes an error response when the request is not OK.
+func (api *privetAPI) checkRequest(w http.ResponseWriter, r *http.Request, method string, requireToken bool) bool {
+	if r.Method != method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	if _, exists := r.Header["X-Privet-Token"]; !exists {
+		// The missing header probably means that this isn't a Privet client.
+		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errInvalidXPrivetToken, "X-Privet-Token header is missing")
+		return false
+	}
+	if requireToken && !api.xsrf.isTokenValid(r.Header.Get("X-Privet-Token")) {
+		writeError(w, errInvalidXPrivetToken, "X-Privet-Token is invalid or expired")
+		return false
+	}
+	return true
+}
+
+func (api *privetAPI) info(w http.ResponseWriter, r *http.Request) {
+	if !api.checkRequest(w, r, "GET", false) {
+		return
+	}
+
+	printer, exists := api.getPrinter(api.gcpID)
+	if !exists {
+		writeError(w, errPrinterUnavailable, "Printer is not available")
+		return
+	}
+
+	apis := []string{"/privet/capabilities"}
+	if printer.LocalSettings.AccessTokenEnabled() {
+		apis = append([]string{"/privet/accesstoken"}, apis...)
+	}
+	if printer.LocalSettings.LocalJobsEnabled() {
+		apis = append(apis, "/privet/printer/createjob", "/privet/printer/submitdoc", "/privet/printer/jobstate")
+	}
+
+	deviceState := "idle"
+	if printer.State != nil && printer.State.State != "" {
+		deviceState = strings.ToLower(string(printer.State.State))
+	}
+	connectionState := "online"
+	if !api.isOnline() {
+		connectionState = "offline"
+	}
+
+	response := struct {
+		Version         string               `json:"version"`
+		Name            string               `json:"name"`
+		Description     string               `json:"description,omitempty"`
+		URL             string               `json:"url"`
+		Type            []string             `json:"type"`
+		ID              string               `json:"id"`
+		DeviceState     string               `json:"device_state"`
+		ConnectionState string               `json:"connection_state"`
+		Manufacturer    string               `json:"manufacturer"`
+		Model           string               `json:"model"`
+		SerialNumber    string               `json:"serial_number,omitempty"`
+		Firmware        string               `json:"firmware"`
+		Uptime          int64                `json:"uptime"`
+		SetupURL        string               `json:"setup_url,omitempty"`
+		SupportURL      string               `json:"support_url,omitempty"`
+		UpdateURL       string               `json:"update_url,omitempty"`
+		XPrivetToken    string               `json:"x-privet-token"`
+		API             []string             `json:"api"`
+		SemanticState   cdd.CloudDeviceState `json:"semantic_state"`
+	}{
+		Version:         "1.0",
+		Name:            displayName(&printer),
+		Description:     printer.Info,
+		URL:             api.gcpBaseURL,
+		Type:            []string{"printer"},
+		ID:              printer.GCPID,
+		DeviceState:     deviceState,
+		ConnectionState: connectionState,
+		Manufacturer:    printer.Manufacturer,
+		Model:           printer.Model,
+		SerialNumber:    printer.UUID,
+		Firmware:        printer.ConnectorVersion,
+		Uptime:          int64(time.Since(api.startTime).Seconds()),
+		SetupURL:        printer.SetupURL,
+		SupportURL:      printer.SupportURL,
+		UpdateURL:       printer.UpdateURL,
+		XPrivetToken:    api.xsrf.newToken(),
+		API:             apis,
+		SemanticState: cdd.CloudDeviceState{
+			Version: "1.0",
+			Printer: printer.State,
+		},
+	}
+
+	writeJSON(w, response)
+}
+
+func (api *privetAPI) accesstoken(w http.ResponseWriter, r *http.Request) {
+	if !api.checkRequest(w, r, "GET", true) {
+		return
+	}
+
+	if printer, exists := api.getPrinter(api.gcpID); !exists {
+		writeError(w, errPrinterUnavailable, "Printer is not available")
+		return
+	} else if !printer.LocalSettings.AccessTokenEnabled() {
+		writeError(w, errAccessDenied, "Access tokens are disabled in the printer's local settings")
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeError(w, errInvalidParams, "user parameter is required")
+		return
+	}
+
+	responseBody, httpStatusCode, err := api.getProximityToken(api.gcpID, user)
+	if err != nil {
+		glog.Errorf("Failed to get proximity token for user %s of printer %s: %s", user, api.name, err)
+		writeError(w, errServerError, err.Error())
+		return
+	}
+	if httpStatusCode != http.StatusOK {
+		writeError(w, errServerError, fmt.Sprintf("GCP responded with HTTP status %d", httpStatusCode))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseBody)
+}
+
+func (api *privetAPI) capabilities(w http.ResponseWriter, r *http.Request) {
+	if !api.checkRequest(w, r, "GET", true) {
+		return
+	}
+
+	printer, exists := api.getPrinter(api.gcpID)
+	if !exists {
+		writeError(w, errPrinterUnavailable, "Printer is not available")
+		return
+	}
+
+	writeJSON(w, cdd.CloudDeviceDescription{
+		Version: "1.0",
+		Printer: printer.Description,
+	})
+}
+
+// checkLocalJobs writes an error response when the printer doesn't take
+// jobs from local clients.
+func (api *privetAPI) checkLocalJobs(w http.ResponseWriter) bool {
+	if printer, exists := api.getPrinter(api.gcpID); !exists {
+		writeError(w, errPrinterUnavailable, "Printer is not available")
+		return false
+	} else if !printer.LocalSettings.LocalJobsEnabled() {
+		writeError(w, errAccessDenied, "Local printing is disabled in the printer's local settings")
+		return false
+	}
+	return true
+}
+
+// Tickets are much smaller than this.
+const maxTicketSize = 1 << 20
+
+func (api *privetAPI) createjob(w http.ResponseWriter, r *http.Request) {
+	if !api.checkRequest(w, r, "POST", true) || !api.checkLocalJobs(w) {
+		return
+	}
+
+	var ticket cdd.CloudJobTicket
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxTicketSize)).Decode(&ticket); err != nil {
+		writeError(w, errInvalidTicket, err.Error())
+		return
+	}
+
+	job, err := api.jobs.createJob(ticket)
+	if err != nil {
+		glog.Errorf("Failed to create local job for printer %s: %s", api.name, err)
+		writeError(w, errServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, struct {
+		JobID     string `json:"job_id"`
+		ExpiresIn int64  `json:"expires_in"`
+	}{job.id, job.expiresIn(time.Now())})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (api *privetAPI) submitdoc(w http.ResponseWriter, r *http.Request) {
+	if !api.checkRequest(w, r, "POST", true) || !api.checkLocalJobs(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	user := query.Get("user_name")
+	if user == "" {
+		user = query.Get("client_name")
+	}
+	if user == "" {
+		user = "anonymous"
+	}
+
+	body := bufio.NewReaderSize(r.Body, lib.ContentTypeSniffLen)
+	head, err := body.Peek(lib.ContentTypeSniffLen)
+	if err != nil && err != io.EOF {
+		writeError(w, errServerError, fmt.Sprintf("Failed to read document: %s", err))
+		return
+	}
+	contentType := lib.DetectContentType(head, r.Header.Get("Content-Type"))
+	if !lib.ContentTypeSupported(contentType) {
+		writeError(w, errInvalidDocumentType, fmt.Sprintf("Document content type %s is not supported", contentType))
+		return
+	}
+
+	jobID := query.Get("job_id")
+	if jobID == "" {
+		// Simple printing, without createjob, prints with the defaults.
+		job, err := api.jobs.createJob(cdd.CloudJobTicket{})
+		if err != nil {
+			glog.Errorf("Failed to create local job for printer %s: %s", api.name, err)
+			writeError(w, errServerError, err.Error())
+			return
+		}
+		jobID = job.id
+	}
+	job, ok := api.jobs.submitJob(jobID, query.Get("job_name"), contentType)
+	if !ok {
+		writeError(w, errInvalidPrintJob, "Job is unknown, expired, or has a document already")
+		return
+	}
+
+	document := &countingReader{r: body}
+	err = api.printJob(&Job{
+		ID:           job.id,
+		GCPPrinterID: api.gcpID,
+		Title:        job.name,
+		User:         user,
+		ContentType:  contentType,
+		Ticket:       job.ticket,
+		Document:     document,
+	})
+	api.jobs.updateJob(job.id, document.n, err == nil)
+	if e, ok := err.(*JobError); ok {
+		writeError(w, e.Code, e.Message)
+		return
+	} else if err != nil {
+		glog.Errorf("Failed to print local job %s on printer %s: %s", job.id, api.name, err)
+		writeError(w, errPrinterError, err.Error())
+		return
+	}
+
+	writeJSON(w, struct {
+		JobID     string `json:"job_id"`
+		ExpiresIn int64  `json:"expires_in"`
+		JobType   string `json:"job_type"`
+		JobSize   int64  `json:"job_size"`
+		JobName   string `json:"job_name,omitempty"`
+	}{job.id, job.expiresIn(time.Now()), contentType, document.n, job.name})
+}
+
+func (api *privetAPI) jobstate(w http.ResponseWriter, r *http.Request) {
+	if !api.checkRequest(w, r, "GET", true) {
+		return
+	}
+
+	job, exists := api.jobs.getJob(r.URL.Query().Get("job_id"))
+	if !exists {
+		writeError(w, errInvalidPrintJob, "Job is unknown or expired")
+		return
+	}
+
+	state := cdd.PrintJobState{Version: "1.0", State: cdd.JobState{Type: "DRAFT"}}
+	if job.final != nil {
+		state = *job.final
+	} else if job.submitted {
+		if state, exists = api.getJobState(job.id); !exists {
+			writeError(w, errInvalidPrintJob, "Job state is unknown")
+			return
+		}
+		job = api.jobs.updateJobState(job.id, state)
+	}
+
+	writeJSON(w, struct {
+		JobID         string            `json:"job_id"`
+		State         string            `json:"state"`
+		ExpiresIn     int64             `json:"expires_in"`
+		JobType       string            `json:"job_type,omitempty"`
+		JobSize       int64             `json:"job_size,omitempty"`
+		JobName       string            `json:"job_name,omitempty"`
+		SemanticState cdd.PrintJobState `json:"semantic_state"`
+	}{job.id, privetJobState(state), job.expiresIn(time.Now()), job.contentType, job.size, job.name, state})
+}
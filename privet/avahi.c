@@ -0,0 +1,126 @@
+//go:build linux || freebsd || openbsd
+// +build linux freebsd openbsd
+
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+#include "avahi.h"
+#include "_cgo_export.h"
+
+#include <stdio.h> // asprintf
+
+const char *SERVICE_TYPE    = "_privet._tcp";
+const char *SERVICE_SUBTYPE = "_printer._sub._privet._tcp";
+
+// clientCallback is called by avahi from the threaded poll thread, with
+// the threaded poll lock held.
+static void clientCallback(AvahiClient *client, AvahiClientState state, void *userdata) {
+	handleClientStateChange(client, state);
+}
+
+// entryGroupCallback is called by avahi from the threaded poll thread, with
+// the threaded poll lock held. userdata is the service name.
+static void entryGroupCallback(AvahiEntryGroup *group, AvahiEntryGroupState state, void *userdata) {
+	handleGroupStateChange(group, state, (char *)userdata);
+}
+
+// startAvahiClient creates and starts an avahi client.
+//
+// Sets err on failure.
+void startAvahiClient(AvahiThreadedPoll **threaded_poll, AvahiClient **client, char **err) {
+	*threaded_poll = avahi_threaded_poll_new();
+	if (!*threaded_poll) {
+		asprintf(err, "Failed to create avahi threaded poll");
+		return;
+	}
+
+	int error;
+	*client = avahi_client_new(avahi_threaded_poll_get(*threaded_poll), AVAHI_CLIENT_NO_FAIL,
+			clientCallback, NULL, &error);
+	if (!*client) {
+		asprintf(err, "Failed to create avahi client: %s", avahi_strerror(error));
+		avahi_threaded_poll_free(*threaded_poll);
+		*threaded_poll = NULL;
+		return;
+	}
+
+	error = avahi_threaded_poll_start(*threaded_poll);
+	if (error < 0) {
+		asprintf(err, "Failed to start avahi threaded poll: %s", avahi_strerror(error));
+		avahi_client_free(*client);
+		*client = NULL;
+		avahi_threaded_poll_free(*threaded_poll);
+		*threaded_poll = NULL;
+	}
+}
+
+// addAvahiGroup announces a printer service. The caller must hold the
+// threaded poll lock, and service_name must stay valid until the group is
+// removed.
+//
+// Sets err on failure.
+void addAvahiGroup(AvahiClient *client, AvahiEntryGroup **group, const char *service_name,
+		unsigned short port, AvahiStringList *txt, char **err) {
+	*group = avahi_entry_group_new(client, entryGroupCallback, (void *)service_name);
+	if (!*group) {
+		asprintf(err, "Failed to create avahi entry group: %s",
+				avahi_strerror(avahi_client_errno(client)));
+		return;
+	}
+
+	int error = avahi_entry_group_add_service_strlst(*group, AVAHI_IF_UNSPEC, AVAHI_PROTO_UNSPEC,
+			0, service_name, SERVICE_TYPE, NULL, NULL, port, txt);
+	if (error < 0) {
+		asprintf(err, "Failed to add avahi service: %s", avahi_strerror(error));
+		avahi_entry_group_free(*group);
+		*group = NULL;
+		return;
+	}
+
+	error = avahi_entry_group_add_service_subtype(*group, AVAHI_IF_UNSPEC, AVAHI_PROTO_UNSPEC,
+			0, service_name, SERVICE_TYPE, NULL, SERVICE_SUBTYPE);
+	if (error < 0) {
+		asprintf(err, "Failed to add avahi service subtype: %s", avahi_strerror(error));
+		avahi_entry_group_free(*group);
+		*group = NULL;
+		return;
+	}
+
+	error = avahi_entry_group_commit(*group);
+	if (error < 0) {
+		asprintf(err, "Failed to commit avahi entry group: %s", avahi_strerror(error));
+		avahi_entry_group_free(*group);
+		*group = NULL;
+	}
+}
+
+// updateAvahiGroup replaces the TXT record of a printer service. The caller
+// must hold the threaded poll lock.
+//
+// Sets err on failure.
+void updateAvahiGroup(AvahiEntryGroup *group, const char *service_name, AvahiStringList *txt, char **err) {
+	int error = avahi_entry_group_update_service_txt_strlst(group, AVAHI_IF_UNSPEC,
+			AVAHI_PROTO_UNSPEC, 0, service_name, SERVICE_TYPE, NULL, txt);
+	if (error < 0) {
+		asprintf(err, "Failed to update avahi service: %s", avahi_strerror(error));
+	}
+}
+
+// removeAvahiGroup withdraws a printer service. The caller must hold the
+// threaded poll lock.
+void removeAvahiGroup(AvahiEntryGroup *group) {
+	avahi_entry_group_free(group);
+}
+
+// stopAvahiClient stops and frees the avahi client. The caller must not
+// hold the threaded poll lock.
+void stopAvahiClient(AvahiThreadedPoll *threaded_poll, AvahiClient *client) {
+	avahi_threaded_poll_stop(threaded_poll);
+	avahi_client_free(client);
+	avahi_threaded_poll_free(threaded_poll);
+}
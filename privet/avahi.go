@@ -0,0 +1,244 @@
+//go:build linux || freebsd || openbsd
+// +build linux freebsd openbsd
+
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+// #cgo LDFLAGS: -lavahi-client -lavahi-common
+// #cgo freebsd openbsd CFLAGS: -I/usr/local/include
+// #cgo freebsd openbsd LDFLAGS: -L/usr/local/lib
+// #include "avahi.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// record is a printer service, announced when the avahi daemon is running.
+type record struct {
+	port   uint16
+	ty     string
+	url    string
+	id     string
+	online bool
+
+	// Service name, referenced by the entry group callback.
+	name  *C.char
+	group *C.AvahiEntryGroup
+}
+
+// zeroconf announces printers over mDNS/DNS-SD with avahi.
+//
+// All fields are protected by the avahi threaded poll lock.
+type zeroconf struct {
+	threadedPoll *C.AvahiThreadedPoll
+	client       *C.AvahiClient
+	state        C.AvahiClientState
+	// Records by GCP ID.
+	printers map[string]*record
+}
+
+// The only zeroconf instance, for use by the avahi callbacks.
+var instance *zeroconf
+
+func newZeroconf() (*zeroconf, error) {
+	if instance != nil {
+		return nil, errors.New("Avahi client is already running")
+	}
+
+	z := zeroconf{printers: make(map[string]*record)}
+	// The client state callback can be called before startAvahiClient returns.
+	instance = &z
+
+	var err *C.char
+	C.startAvahiClient(&z.threadedPoll, &z.client, &err)
+	if err != nil {
+		defer C.free(unsafe.Pointer(err))
+		instance = nil
+		return nil, errors.New(C.GoString(err))
+	}
+
+	return &z, nil
+}
+
+// prepareTXT creates a Privet TXT record. The caller must free it
+// with C.avahi_string_list_free().
+func prepareTXT(ty, url, id string, online bool) *C.AvahiStringList {
+	cs := "offline"
+	if online {
+		cs = "online"
+	}
+
+	var txt *C.AvahiStringList
+	for _, s := range []string{"txtvers=1", "ty=" + ty, "url=" + url, "type=printer", "id=" + id, "cs=" + cs} {
+		c := C.CString(s)
+		txt = C.avahi_string_list_add(txt, c)
+		C.free(unsafe.Pointer(c))
+	}
+	return txt
+}
+
+// announce adds the avahi entry group of r. The caller must hold the
+// threaded poll lock.
+func (z *zeroconf) announce(client *C.AvahiClient, r *record) error {
+	txt := prepareTXT(r.ty, r.url, r.id, r.online)
+	defer C.avahi_string_list_free(txt)
+
+	var err *C.char
+	C.addAvahiGroup(client, &r.group, r.name, C.ushort(r.port), txt, &err)
+	if err != nil {
+		defer C.free(unsafe.Pointer(err))
+		return errors.New(C.GoString(err))
+	}
+	return nil
+}
+
+func (z *zeroconf) addPrinter(id, name string, port uint16, ty, url string, online bool) error {
+	C.avahi_threaded_poll_lock(z.threadedPoll)
+	defer C.avahi_threaded_poll_unlock(z.threadedPoll)
+
+	if _, exists := z.printers[id]; exists {
+		return fmt.Errorf("Printer %s is already announced", id)
+	}
+
+	r := &record{
+		port:   port,
+		ty:     ty,
+		url:    url,
+		id:     id,
+		online: online,
+		name:   C.CString(name),
+	}
+
+	if z.state == C.AVAHI_CLIENT_S_RUNNING {
+		if err := z.announce(z.client, r); err != nil {
+			C.free(unsafe.Pointer(r.name))
+			return err
+		}
+	}
+
+	z.printers[id] = r
+	return nil
+}
+
+func (z *zeroconf) updatePrinterTXT(id, ty, url string, online bool) error {
+	C.avahi_threaded_poll_lock(z.threadedPoll)
+	defer C.avahi_threaded_poll_unlock(z.threadedPoll)
+
+	r, exists := z.printers[id]
+	if !exists {
+		return fmt.Errorf("Printer %s is not announced", id)
+	}
+
+	r.ty, r.url, r.online = ty, url, online
+	if r.group == nil {
+		// Will be announced with the new TXT record when avahi is running.
+		return nil
+	}
+
+	txt := prepareTXT(r.ty, r.url, r.id, r.online)
+	defer C.avahi_string_list_free(txt)
+
+	var err *C.char
+	C.updateAvahiGroup(r.group, r.name, txt, &err)
+	if err != nil {
+		defer C.free(unsafe.Pointer(err))
+		return errors.New(C.GoString(err))
+	}
+	return nil
+}
+
+func (z *zeroconf) removePrinter(id string) error {
+	C.avahi_threaded_poll_lock(z.threadedPoll)
+	defer C.avahi_threaded_poll_unlock(z.threadedPoll)
+
+	r, exists := z.printers[id]
+	if !exists {
+		return fmt.Errorf("Printer %s is not announced", id)
+	}
+
+	if r.group != nil {
+		C.removeAvahiGroup(r.group)
+	}
+	C.free(unsafe.Pointer(r.name))
+	delete(z.printers, id)
+	return nil
+}
+
+func (z *zeroconf) quit() {
+	C.avahi_threaded_poll_lock(z.threadedPoll)
+	for id, r := range z.printers {
+		if r.group != nil {
+			C.removeAvahiGroup(r.group)
+		}
+		C.free(unsafe.Pointer(r.name))
+		delete(z.printers, id)
+	}
+	C.avahi_threaded_poll_unlock(z.threadedPoll)
+
+	C.stopAvahiClient(z.threadedPoll, z.client)
+	instance = nil
+}
+
+// handleClientStateChange (re-)announces printers when the avahi daemon
+// is running, and withdraws them otherwise. Called with the threaded poll
+// lock held.
+//
+//export handleClientStateChange
+func handleClientStateChange(client *C.AvahiClient, newState C.AvahiClientState) {
+	z := instance
+	oldState := z.state
+	z.state = newState
+
+	switch newState {
+	case C.AVAHI_CLIENT_S_RUNNING:
+		if oldState == C.AVAHI_CLIENT_S_RUNNING {
+			return
+		}
+		for _, r := range z.printers {
+			if r.group == nil {
+				if err := z.announce(client, r); err != nil {
+					glog.Errorf("Failed to announce printer %s: %s", C.GoString(r.name), err)
+				}
+			}
+		}
+
+	case C.AVAHI_CLIENT_S_COLLISION, C.AVAHI_CLIENT_S_REGISTERING, C.AVAHI_CLIENT_CONNECTING, C.AVAHI_CLIENT_FAILURE:
+		if newState == C.AVAHI_CLIENT_CONNECTING {
+			glog.Warning("Waiting for avahi-daemon to announce printers")
+		} else if newState == C.AVAHI_CLIENT_FAILURE {
+			glog.Errorf("Avahi client failure: %s", C.GoString(C.avahi_strerror(C.avahi_client_errno(client))))
+		}
+		// Withdraw all printers; they are announced again when running.
+		for _, r := range z.printers {
+			if r.group != nil {
+				C.removeAvahiGroup(r.group)
+				r.group = nil
+			}
+		}
+	}
+}
+
+// handleGroupStateChange logs printer announcement failures. Called with
+// the threaded poll lock held.
+//
+//export handleGroupStateChange
+func handleGroupStateChange(group *C.AvahiEntryGroup, state C.AvahiEntryGroupState, name *C.char) {
+	switch state {
+	case C.AVAHI_ENTRY_GROUP_COLLISION:
+		glog.Errorf("Failed to announce printer %s: another service has the same name", C.GoString(name))
+	case C.AVAHI_ENTRY_GROUP_FAILURE:
+		glog.Errorf("Failed to announce printer %s: %s", C.GoString(name),
+			C.GoString(C.avahi_strerror(C.avahi_client_errno(C.avahi_entry_group_get_client(group)))))
+	}
+}
@@ -0,0 +1,22 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+#include <avahi-client/client.h>
+#include <avahi-client/publish.h>
+#include <avahi-common/error.h>
+#include <avahi-common/strlst.h>
+#include <avahi-common/thread-watch.h>
+
+#include <stdlib.h> // free
+
+void startAvahiClient(AvahiThreadedPoll **threaded_poll, AvahiClient **client, char **err);
+void addAvahiGroup(AvahiClient *client, AvahiEntryGroup **group, const char *service_name,
+		unsigned short port, AvahiStringList *txt, char **err);
+void updateAvahiGroup(AvahiEntryGroup *group, const char *service_name, AvahiStringList *txt, char **err);
+void removeAvahiGroup(AvahiEntryGroup *group);
+void stopAvahiClient(AvahiThreadedPoll *threaded_poll, AvahiClient *client);
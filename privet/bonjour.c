@@ -1,3 +1,6 @@
+//go:build darwin
+// +build darwin
+
 /*
 Copyright 2015 Google Inc. All rights reserved.
 
@@ -6,15 +9,10 @@ license that can be found in the LICENSE file or at
 https://developers.google.com/open-source/licenses/bsd
 */
 
-#include <CFNetwork/CFNetServices.h>
-#include <CoreFoundation/CFString.h>
-#include <CoreFoundation/CFStream.h>
+#include "bonjour.h"
+#include "_cgo_export.h"
 
 #include <stdio.h>  // asprintf
-#include <stdlib.h> // free
-
-// TODO: Uncomment when implemented in Go.
-//#include "_cgo_export.h"
 
 // streamErrorToString converts a CFStreamError to a string.
 char *streamErrorToString(CFStreamError *error) {
@@ -41,36 +39,60 @@ char *streamErrorToString(CFStreamError *error) {
 
 void registerCallback(CFNetServiceRef service, CFStreamError *streamError, void *info) {
 	CFStringRef printerName = (CFStringRef)info;
-	char *printerNameC = malloc(sizeof(char) * (CFStringGetLength(printerName) + 1));
+	CFIndex printerNameSize = CFStringGetMaximumSizeForEncoding(
+			CFStringGetLength(printerName), kCFStringEncodingUTF8) + 1;
+	char *printerNameC = malloc(sizeof(char) * printerNameSize);
+	CFStringGetCString(printerName, printerNameC, printerNameSize, kCFStringEncodingUTF8);
 	char *streamErrorC = streamErrorToString(streamError);
 	char *error = NULL;
 	asprintf(&error, "Error while announcing Bonjour service for printer %s: %s",
 			printerNameC, streamErrorC);
 
-	// TODO: Uncomment when implemented in Go.
-	//logBonjourError(error);
+	logBonjourError(error);
 
-	CFRelease(printerName);
 	free(printerNameC);
 	free(streamErrorC);
 	free(error);
 }
 
-// startBonjour starts and returns a bonjour service.
+// getRunLoop returns the run loop of the calling thread.
+CFRunLoopRef getRunLoop() {
+	return CFRunLoopGetCurrent();
+}
+
+// runBonjourLoop runs the run loop of the calling thread until stopBonjourLoop
+// is called.
+void runBonjourLoop() {
+	// Without a source, the run loop would return immediately.
+	CFRunLoopTimerRef timer = CFRunLoopTimerCreate(NULL, CFAbsoluteTimeGetCurrent() + 1e10,
+			1e10, 0, 0, NULL, NULL);
+	CFRunLoopAddTimer(CFRunLoopGetCurrent(), timer, kCFRunLoopCommonModes);
+	CFRunLoopRun();
+	CFRunLoopRemoveTimer(CFRunLoopGetCurrent(), timer, kCFRunLoopCommonModes);
+	CFRelease(timer);
+}
+
+// stopBonjourLoop stops runLoop, which is running in runBonjourLoop.
+void stopBonjourLoop(CFRunLoopRef runLoop) {
+	CFRunLoopStop(runLoop);
+}
+
+// startBonjour starts and returns a bonjour service, scheduled on runLoop.
 //
 // Returns a registered service. Returns NULL and sets err on failure.
-CFNetServiceRef startBonjour(char *name, char *type, char *domain, int port, char *url, char *id, char *cs, char **err) {
-	CFStringRef n = CFStringCreateWithCString(NULL, name, kCFStringEncodingASCII);
+CFNetServiceRef startBonjour(CFRunLoopRef runLoop, char *name, char *ty, char *type, char *domain, int port, char *url, char *id, char *cs, char **err) {
+	CFStringRef n = CFStringCreateWithCString(NULL, name, kCFStringEncodingUTF8);
+	CFStringRef y = CFStringCreateWithCString(NULL, ty, kCFStringEncodingUTF8);
 	CFStringRef t = CFStringCreateWithCString(NULL, type, kCFStringEncodingASCII);
 	CFStringRef d = CFStringCreateWithCString(NULL, domain, kCFStringEncodingASCII);
-	CFStringRef u = CFStringCreateWithCString(NULL, url, kCFStringEncodingASCII);
+	CFStringRef u = CFStringCreateWithCString(NULL, url, kCFStringEncodingUTF8);
 	CFStringRef i = CFStringCreateWithCString(NULL, id, kCFStringEncodingASCII);
 	CFStringRef c = CFStringCreateWithCString(NULL, cs, kCFStringEncodingASCII);
 
 	CFMutableDictionaryRef dict = CFDictionaryCreateMutable(NULL, 0,
 			&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
 	CFDictionarySetValue(dict, CFSTR("txtvers"), CFSTR("1"));
-	CFDictionarySetValue(dict, CFSTR("ty"), n);
+	CFDictionarySetValue(dict, CFSTR("ty"), y);
 	CFDictionarySetValue(dict, CFSTR("url"), u);
 	CFDictionarySetValue(dict, CFSTR("type"), CFSTR("printer"));
 	CFDictionarySetValue(dict, CFSTR("id"), i);
@@ -82,7 +104,7 @@ CFNetServiceRef startBonjour(char *name, char *type, char *domain, int port, cha
 	// context now owns n, and will release n when service is released.
 	CFNetServiceClientContext context = {0, (void *) n, NULL, CFRelease, NULL};
 	CFNetServiceSetClient(service, registerCallback, &context);
-	CFNetServiceScheduleWithRunLoop(service, CFRunLoopGetCurrent(), kCFRunLoopCommonModes);
+	CFNetServiceScheduleWithRunLoop(service, runLoop, kCFRunLoopCommonModes);
 
 	CFOptionFlags options = kCFNetServiceFlagNoAutoRename;
 	CFStreamError error;
@@ -91,10 +113,15 @@ CFNetServiceRef startBonjour(char *name, char *type, char *domain, int port, cha
 		char *errorString = streamErrorToString(&error);
 		asprintf(err, "Failed to register Bonjour service: %s", errorString);
 		free(errorString);
+		CFNetServiceUnscheduleFromRunLoop(service, runLoop, kCFRunLoopCommonModes);
+		CFNetServiceSetClient(service, NULL, NULL);
 		CFRelease(service);
 		service = NULL;
+	} else {
+		CFRunLoopWakeUp(runLoop);
 	}
 
+	CFRelease(y);
 	CFRelease(t);
 	CFRelease(d);
 	CFRelease(u);
@@ -107,8 +134,8 @@ CFNetServiceRef startBonjour(char *name, char *type, char *domain, int port, cha
 }
 
 // stopBonjour stops service and frees associated resources.
-void stopBonjour(CFNetServiceRef service) {
-	CFNetServiceUnscheduleFromRunLoop(service, CFRunLoopGetCurrent(), kCFRunLoopCommonModes);
+void stopBonjour(CFRunLoopRef runLoop, CFNetServiceRef service) {
+	CFNetServiceUnscheduleFromRunLoop(service, runLoop, kCFRunLoopCommonModes);
 	CFNetServiceSetClient(service, NULL, NULL);
 	CFNetServiceCancel(service);
 	CFRelease(service);
@@ -0,0 +1,170 @@
+//go:build darwin
+// +build darwin
+
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+// #cgo LDFLAGS: -framework CoreFoundation -framework CoreServices
+// #include "bonjour.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Privet service type, with the printer subtype.
+	bonjourType   = "_privet._tcp,_printer"
+	bonjourDomain = "local."
+)
+
+// record is an announced printer service.
+type record struct {
+	name    string
+	port    uint16
+	ty      string
+	url     string
+	id      string
+	online  bool
+	service C.CFNetServiceRef
+}
+
+// zeroconf announces printers over mDNS/DNS-SD with Bonjour.
+type zeroconf struct {
+	// Run loop of the thread that runs the Bonjour services.
+	runLoop C.CFRunLoopRef
+	done    chan struct{}
+
+	// Records by GCP ID.
+	printers map[string]*record
+	pMutex   sync.Mutex
+}
+
+func newZeroconf() (*zeroconf, error) {
+	z := zeroconf{
+		done:     make(chan struct{}),
+		printers: make(map[string]*record),
+	}
+
+	ch := make(chan C.CFRunLoopRef)
+	go func() {
+		// The run loop belongs to this thread.
+		runtime.LockOSThread()
+		ch <- C.getRunLoop()
+		C.runBonjourLoop()
+		close(z.done)
+	}()
+	z.runLoop = <-ch
+
+	return &z, nil
+}
+
+func (z *zeroconf) startService(r *record) error {
+	cs := "offline"
+	if r.online {
+		cs = "online"
+	}
+
+	n := C.CString(r.name)
+	defer C.free(unsafe.Pointer(n))
+	y := C.CString(r.ty)
+	defer C.free(unsafe.Pointer(y))
+	t := C.CString(bonjourType)
+	defer C.free(unsafe.Pointer(t))
+	d := C.CString(bonjourDomain)
+	defer C.free(unsafe.Pointer(d))
+	u := C.CString(r.url)
+	defer C.free(unsafe.Pointer(u))
+	i := C.CString(r.id)
+	defer C.free(unsafe.Pointer(i))
+	c := C.CString(cs)
+	defer C.free(unsafe.Pointer(c))
+
+	var err *C.char
+	r.service = C.startBonjour(z.runLoop, n, y, t, d, C.int(r.port), u, i, c, &err)
+	if err != nil {
+		defer C.free(unsafe.Pointer(err))
+		return errors.New(C.GoString(err))
+	}
+	return nil
+}
+
+func (z *zeroconf) addPrinter(id, name string, port uint16, ty, url string, online bool) error {
+	z.pMutex.Lock()
+	defer z.pMutex.Unlock()
+
+	if _, exists := z.printers[id]; exists {
+		return fmt.Errorf("Printer %s is already announced", id)
+	}
+
+	r := &record{name: name, port: port, ty: ty, url: url, id: id, online: online}
+	if err := z.startService(r); err != nil {
+		return err
+	}
+
+	z.printers[id] = r
+	return nil
+}
+
+func (z *zeroconf) updatePrinterTXT(id, ty, url string, online bool) error {
+	z.pMutex.Lock()
+	defer z.pMutex.Unlock()
+
+	r, exists := z.printers[id]
+	if !exists {
+		return fmt.Errorf("Printer %s is not announced", id)
+	}
+
+	// CFNetService can't update the TXT record of a running service.
+	C.stopBonjour(z.runLoop, r.service)
+	r.ty, r.url, r.online = ty, url, online
+	if err := z.startService(r); err != nil {
+		delete(z.printers, id)
+		return err
+	}
+	return nil
+}
+
+func (z *zeroconf) removePrinter(id string) error {
+	z.pMutex.Lock()
+	defer z.pMutex.Unlock()
+
+	r, exists := z.printers[id]
+	if !exists {
+		return fmt.Errorf("Printer %s is not announced", id)
+	}
+
+	C.stopBonjour(z.runLoop, r.service)
+	delete(z.printers, id)
+	return nil
+}
+
+func (z *zeroconf) quit() {
+	z.pMutex.Lock()
+	defer z.pMutex.Unlock()
+
+	for id, r := range z.printers {
+		C.stopBonjour(z.runLoop, r.service)
+		delete(z.printers, id)
+	}
+
+	C.stopBonjourLoop(z.runLoop)
+	<-z.done
+}
+
+//export logBonjourError
+func logBonjourError(err *C.char) {
+	glog.Warning(C.GoString(err))
+}
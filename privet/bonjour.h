@@ -0,0 +1,18 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+#include <CFNetwork/CFNetServices.h>
+#include <CoreFoundation/CoreFoundation.h>
+
+#include <stdlib.h> // free
+
+CFRunLoopRef getRunLoop();
+void runBonjourLoop();
+void stopBonjourLoop(CFRunLoopRef runLoop);
+CFNetServiceRef startBonjour(CFRunLoopRef runLoop, char *name, char *ty, char *type, char *domain, int port, char *url, char *id, char *cs, char **err);
+void stopBonjour(CFRunLoopRef runLoop, CFNetServiceRef service);
@@ -0,0 +1,195 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+// Job is a job that a local client submitted to a printer.
+type Job struct {
+	// Privet job ID, unique among all printers.
+	ID           string
+	GCPPrinterID string
+	Title        string
+	// User name, as the client claims it.
+	User        string
+	ContentType string
+	Ticket      cdd.CloudJobTicket
+	// The document, which is read until EOF.
+	Document io.Reader
+}
+
+// PrintJobFunc prints a job, and returns once the print system has the
+// job's document. Returns a *JobError when the printer refuses the job.
+type PrintJobFunc func(job *Job) error
+
+// GetJobStateFunc gets the state of a job that PrintJobFunc printed, by
+// Privet job ID. Returns false when the job is unknown.
+type GetJobStateFunc func(jobID string) (cdd.PrintJobState, bool)
+
+// Privet error codes that a PrintJobFunc can return in a JobError.
+const (
+	ErrAccessDenied     = errAccessDenied
+	ErrPrinterBusy      = "printer_busy"
+	ErrDocumentTooLarge = "document_too_large"
+)
+
+// JobError is returned by a PrintJobFunc that refuses a job, with the Privet
+// error code that tells the client why.
+type JobError struct {
+	Code    string
+	Message string
+}
+
+func (e *JobError) Error() string {
+	return e.Message
+}
+
+// How long a job is kept after it was created, submitted, or last seen in
+// progress. Clients submit documents, and poll job states, more often.
+const jobLifetime = 10 * time.Minute
+
+// localJob is a job created with /privet/printer/createjob or
+// /privet/printer/submitdoc.
+type localJob struct {
+	id          string
+	ticket      cdd.CloudJobTicket
+	name        string
+	contentType string
+	size        int64
+	// Whether the document was submitted; the job is a draft until then.
+	submitted bool
+	// Final state, once the job is done, stopped or aborted.
+	final   *cdd.PrintJobState
+	expires time.Time
+}
+
+// expiresIn returns the seconds until a job expires.
+func (j *localJob) expiresIn(now time.Time) int64 {
+	return int64(j.expires.Sub(now).Seconds())
+}
+
+// jobCache holds the jobs of a printer until they expire.
+type jobCache struct {
+	mutex sync.Mutex
+	jobs  map[string]*localJob
+}
+
+func newJobCache() *jobCache {
+	return &jobCache{jobs: make(map[string]*localJob)}
+}
+
+// newJobID returns a random job ID, which clients can't guess.
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createJob adds a draft job with ticket.
+func (c *jobCache) createJob(ticket cdd.CloudJobTicket) (localJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return localJob{}, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.removeExpired(now)
+	job := &localJob{id: id, ticket: ticket, expires: now.Add(jobLifetime)}
+	c.jobs[id] = job
+	return *job, nil
+}
+
+// getJob returns a copy of a job that hasn't expired.
+func (c *jobCache) getJob(id string) (localJob, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	job, exists := c.jobs[id]
+	if !exists || time.Now().After(job.expires) {
+		return localJob{}, false
+	}
+	return *job, true
+}
+
+// submitJob marks a draft job as submitted, so that its document isn't
+// submitted twice. Returns false when the job expired, or was submitted
+// already.
+func (c *jobCache) submitJob(id, name, contentType string) (localJob, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	job, exists := c.jobs[id]
+	if !exists || job.submitted || time.Now().After(job.expires) {
+		return localJob{}, false
+	}
+	job.submitted = true
+	job.name = name
+	job.contentType = contentType
+	job.expires = time.Now().Add(jobLifetime)
+	return *job, true
+}
+
+// updateJob records the size of a submitted job's document, or that the
+// document wasn't printed, which makes the job a draft again.
+func (c *jobCache) updateJob(id string, size int64, printed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if job, exists := c.jobs[id]; exists {
+		job.size = size
+		job.submitted = printed
+	}
+}
+
+// updateJobState extends the life of a job in progress, and keeps the final
+// state of a finished one. Returns a copy of the job.
+func (c *jobCache) updateJobState(id string, state cdd.PrintJobState) localJob {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	job, exists := c.jobs[id]
+	if !exists {
+		return localJob{id: id}
+	}
+	switch state.State.Type {
+	case "DONE", "STOPPED", "ABORTED":
+		job.final = &state
+	default:
+		job.expires = time.Now().Add(jobLifetime)
+	}
+	return *job
+}
+
+func (c *jobCache) removeExpired(now time.Time) {
+	for id, job := range c.jobs {
+		if now.After(job.expires) {
+			delete(c.jobs, id)
+		}
+	}
+}
+
+// privetJobState converts a GCP job state, like IN_PROGRESS, to the Privet
+// job state, like in_progress.
+func privetJobState(state cdd.PrintJobState) string {
+	return strings.ToLower(state.State.Type)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/cups-connector/cdd"
+)
+
+func TestJobCacheSubmit(t *testing.T) {
+	c := newJobCache()
+	created, err := c.createJob(cdd.CloudJobTicket{Version: "1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.id == "" || created.submitted {
+		t.Fatalf("createJob returned %+v, want a draft with an ID", created)
+	}
+	if job, exists := c.getJob(created.id); !exists || job.ticket.Version != "1.0" {
+		t.Errorf("getJob(%s) = %+v, %t", created.id, job, exists)
+	}
+
+	job, ok := c.submitJob(created.id, "report.pdf", "application/pdf")
+	if !ok || !job.submitted || job.name != "report.pdf" || job.contentType != "application/pdf" {
+		t.Fatalf("submitJob returned %+v, %t", job, ok)
+	}
+	if _, ok = c.submitJob(created.id, "again.pdf", "application/pdf"); ok {
+		t.Error("submitJob submitted a job twice")
+	}
+
+	// A document that wasn't printed may be submitted again.
+	c.updateJob(created.id, 0, false)
+	if _, ok = c.submitJob(created.id, "again.pdf", "application/pdf"); !ok {
+		t.Error("submitJob refused a job whose document wasn't printed")
+	}
+	c.updateJob(created.id, 1234, true)
+	if job, _ = c.getJob(created.id); job.size != 1234 || !job.submitted {
+		t.Errorf("After updateJob, job is %+v", job)
+	}
+
+	if _, ok = c.submitJob("unknown", "report.pdf", "application/pdf"); ok {
+		t.Error("submitJob submitted an unknown job")
+	}
+}
+
+func TestJobCacheState(t *testing.T) {
+	c := newJobCache()
+	created, _ := c.createJob(cdd.CloudJobTicket{})
+	c.submitJob(created.id, "report.pdf", "application/pdf")
+
+	job := c.updateJobState(created.id, cdd.PrintJobState{State: cdd.JobState{Type: "IN_PROGRESS"}})
+	if job.final != nil {
+		t.Errorf("Job in progress has final state %+v", job.final)
+	}
+	job = c.updateJobState(created.id, cdd.PrintJobState{State: cdd.JobState{Type: "DONE"}})
+	if job.final == nil || job.final.State.Type != "DONE" {
+		t.Errorf("Done job has final state %+v", job.final)
+	}
+	if got := privetJobState(*job.final); got != "done" {
+		t.Errorf("privetJobState = %q, want done", got)
+	}
+
+	if job = c.updateJobState("unknown", cdd.PrintJobState{}); job.id != "unknown" || job.final != nil {
+		t.Errorf("updateJobState of an unknown job returned %+v", job)
+	}
+}
+
+func TestJobCacheExpiry(t *testing.T) {
+	c := newJobCache()
+	expired, _ := c.createJob(cdd.CloudJobTicket{})
+	c.jobs[expired.id].expires = time.Now().Add(-time.Second)
+
+	if _, exists := c.getJob(expired.id); exists {
+		t.Error("getJob returned an expired job")
+	}
+	if _, ok := c.submitJob(expired.id, "report.pdf", "application/pdf"); ok {
+		t.Error("submitJob submitted an expired job")
+	}
+
+	// Expired jobs are removed when jobs are created.
+	if _, err := c.createJob(cdd.CloudJobTicket{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := c.jobs[expired.id]; exists {
+		t.Error("createJob kept an expired job")
+	}
+	if len(c.jobs) != 1 {
+		t.Errorf("Cache has %d jobs, want 1", len(c.jobs))
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+// +build !linux,!darwin,!freebsd,!openbsd
+
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+import (
+	"errors"
+	"runtime"
+)
+
+// zeroconf is not implemented on this platform.
+type zeroconf struct{}
+
+func newZeroconf() (*zeroconf, error) {
+	return nil, errors.New("Local printing is not supported on " + runtime.GOOS)
+}
+
+func (z *zeroconf) addPrinter(id, name string, port uint16, ty, url string, online bool) error {
+	return nil
+}
+
+func (z *zeroconf) updatePrinterTXT(id, ty, url string, online bool) error {
+	return nil
+}
+
+func (z *zeroconf) removePrinter(id string) error {
+	return nil
+}
+
+func (z *zeroconf) quit() {}
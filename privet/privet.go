@@ -0,0 +1,198 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+// Package privet implements GCP 2.0 local discovery and printing, which
+// lets clients on the LAN find and use printers without the cloud.
+package privet
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cups-connector/lib"
+)
+
+// GetPrinterFunc gets a printer by GCP ID.
+type GetPrinterFunc func(gcpID string) (lib.Printer, bool)
+
+// GetProximityTokenFunc gets a proximity token (JSON) from GCP for a user
+// of a printer. The HTTP status code of the GCP response is also returned.
+type GetProximityTokenFunc func(gcpID, user string) ([]byte, int, error)
+
+// Privet announces printers and serves the Privet API, one port per printer.
+type Privet struct {
+	apis      map[string]*privetAPI
+	apisMutex sync.Mutex
+
+	zc         *zeroconf
+	gcpBaseURL string
+	portLow    uint16
+	portHigh   uint16
+}
+
+// NewPrivet starts the zeroconf client. Printers are served on ports
+// between portLow and portHigh.
+func NewPrivet(gcpBaseURL string, portLow, portHigh uint16) (*Privet, error) {
+	if portLow > portHigh {
+		return nil, fmt.Errorf("Local port range %d-%d is empty", portLow, portHigh)
+	}
+
+	zc, err := newZeroconf()
+	if err != nil {
+		return nil, err
+	}
+
+	p := Privet{
+		apis:       make(map[string]*privetAPI),
+		zc:         zc,
+		gcpBaseURL: gcpBaseURL,
+		portLow:    portLow,
+		portHigh:   portHigh,
+	}
+
+	return &p, nil
+}
+
+// displayName returns the name that clients show for a printer.
+func displayName(printer *lib.Printer) string {
+	if printer.DefaultDisplayName != "" {
+		return printer.DefaultDisplayName
+	}
+	return printer.Name
+}
+
+// AddPrinter starts the Privet API server for a printer and announces it.
+// Jobs that local clients submit are printed with printJob. Adding a
+// printer that was already added does nothing.
+func (p *Privet) AddPrinter(printer lib.Printer, getPrinter GetPrinterFunc, getProximityToken GetProximityTokenFunc, printJob PrintJobFunc, getJobState GetJobStateFunc) error {
+	p.apisMutex.Lock()
+	defer p.apisMutex.Unlock()
+
+	if _, exists := p.apis[printer.GCPID]; exists {
+		return nil
+	}
+
+	api, err := newPrivetAPI(printer.GCPID, printer.Name, p.gcpBaseURL, p.portLow, p.portHigh, getPrinter, getProximityToken, printJob, getJobState)
+	if err != nil {
+		return err
+	}
+
+	api.serviceName = p.uniqueServiceName(printer)
+	if err = p.zc.addPrinter(printer.GCPID, api.serviceName, api.port(), displayName(&printer), p.gcpBaseURL, true); err != nil {
+		api.quit()
+		return err
+	}
+
+	p.apis[printer.GCPID] = api
+	return nil
+}
+
+// uniqueServiceName returns the service instance name to announce a
+// printer as: its CUPS name, unless another printer, of another profile,
+// is announced with that name already. Called with apisMutex held.
+func (p *Privet) uniqueServiceName(printer lib.Printer) string {
+	taken := make(map[string]struct{}, len(p.apis))
+	for gcpID, api := range p.apis {
+		if gcpID != printer.GCPID {
+			taken[api.serviceName] = struct{}{}
+		}
+	}
+	return uniqueServiceName(printer.Name, printer.GCPID, taken)
+}
+
+// uniqueServiceName returns name, or, when it's taken, name followed by
+// the start of gcpID, which is unique.
+func uniqueServiceName(name, gcpID string, taken map[string]struct{}) string {
+	if _, exists := taken[name]; !exists {
+		return name
+	}
+	id := gcpID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	unique := fmt.Sprintf("%s (%s)", name, id)
+	if _, exists := taken[unique]; exists {
+		return fmt.Sprintf("%s (%s)", name, gcpID)
+	}
+	return unique
+}
+
+// HasPrinter answers the question "is the printer served locally?"
+func (p *Privet) HasPrinter(gcpID string) bool {
+	p.apisMutex.Lock()
+	defer p.apisMutex.Unlock()
+
+	_, exists := p.apis[gcpID]
+	return exists
+}
+
+// UpdatePrinter announces changes to a printer's name. The service instance
+// name can't change in place, so a renamed printer is withdrawn, and
+// announced again under its new name.
+func (p *Privet) UpdatePrinter(printer lib.Printer) error {
+	p.apisMutex.Lock()
+	defer p.apisMutex.Unlock()
+
+	api, exists := p.apis[printer.GCPID]
+	if !exists {
+		return fmt.Errorf("Printer %s is not served locally", printer.Name)
+	}
+
+	if serviceName := p.uniqueServiceName(printer); serviceName != api.serviceName {
+		if err := p.zc.removePrinter(printer.GCPID); err != nil {
+			return err
+		}
+		api.serviceName = serviceName
+		return p.zc.addPrinter(printer.GCPID, serviceName, api.port(), displayName(&printer), p.gcpBaseURL, api.isOnline())
+	}
+
+	return p.zc.updatePrinterTXT(printer.GCPID, displayName(&printer), p.gcpBaseURL, api.isOnline())
+}
+
+// SetOnline announces whether a printer is reachable through GCP, which it
+// isn't while the connector's credentials don't work.
+func (p *Privet) SetOnline(printer lib.Printer, online bool) error {
+	p.apisMutex.Lock()
+	defer p.apisMutex.Unlock()
+
+	api, exists := p.apis[printer.GCPID]
+	if !exists {
+		return fmt.Errorf("Printer %s is not served locally", printer.Name)
+	}
+
+	api.setOnline(online)
+	return p.zc.updatePrinterTXT(printer.GCPID, displayName(&printer), p.gcpBaseURL, online)
+}
+
+// DeletePrinter withdraws a printer and stops its Privet API server.
+func (p *Privet) DeletePrinter(gcpID string) error {
+	p.apisMutex.Lock()
+	defer p.apisMutex.Unlock()
+
+	api, exists := p.apis[gcpID]
+	if !exists {
+		return fmt.Errorf("Printer %s is not served locally", gcpID)
+	}
+
+	err := p.zc.removePrinter(gcpID)
+	api.quit()
+	delete(p.apis, gcpID)
+	return err
+}
+
+// Quit withdraws all printers and stops all Privet API servers.
+func (p *Privet) Quit() {
+	p.apisMutex.Lock()
+	defer p.apisMutex.Unlock()
+
+	for gcpID, api := range p.apis {
+		api.quit()
+		delete(p.apis, gcpID)
+	}
+	p.zc.quit()
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+import "testing"
+
+func TestUniqueServiceName(t *testing.T) {
+	taken := map[string]struct{}{"lobby": {}, "front": {}, "front (0123abcd)": {}}
+	for _, test := range []struct {
+		name, gcpID, want string
+	}{
+		{"floor2", "0123abcd-ef", "floor2"},
+		{"lobby", "0123abcd-ef", "lobby (0123abcd)"},
+		{"lobby", "short", "lobby (short)"},
+		{"front", "0123abcd-ef", "front (0123abcd-ef)"},
+	} {
+		if got := uniqueServiceName(test.name, test.gcpID, taken); got != test.want {
+			t.Errorf("uniqueServiceName(%q, %q) = %q, want %q", test.name, test.gcpID, got, test.want)
+		}
+	}
+}
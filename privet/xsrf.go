@@ -0,0 +1,69 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package privet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// X-Privet-Token values are valid for this long.
+const xsrfTokenLifetime = 24 * time.Hour
+
+// xsrfSecret generates and verifies X-Privet-Token values, which protect
+// the Privet API from cross-site requests.
+type xsrfSecret []byte
+
+func newXSRFSecret() (xsrfSecret, error) {
+	secret := make([]byte, sha1.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("Failed to create Privet token secret: %s", err)
+	}
+	return xsrfSecret(secret), nil
+}
+
+func (x xsrfSecret) sign(issueTime string) []byte {
+	mac := hmac.New(sha1.New, x)
+	mac.Write([]byte(issueTime))
+	return mac.Sum(nil)
+}
+
+// newToken returns a token like base64(HMAC(issue time):issue time).
+func (x xsrfSecret) newToken() string {
+	issueTime := strconv.FormatInt(time.Now().Unix(), 10)
+	token := append(x.sign(issueTime), []byte(":"+issueTime)...)
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+// isTokenValid answers the question "was this token created by newToken,
+// and is it still fresh?"
+func (x xsrfSecret) isTokenValid(token string) bool {
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil || len(b) < sha1.Size+2 || b[sha1.Size] != ':' {
+		return false
+	}
+
+	issueTime := string(b[sha1.Size+1:])
+	if !hmac.Equal(b[:sha1.Size], x.sign(issueTime)) {
+		return false
+	}
+
+	issued, err := strconv.ParseInt(strings.TrimSpace(issueTime), 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(issued, 0))
+	return age >= -time.Minute && age < xsrfTokenLifetime
+}
@@ -139,3 +139,28 @@ func TestGetSubtree(t *testing.T) {
 	f(OID{10}, o.vars[4:11])
 	f(OID{10, 10}, o.vars[6:9])
 }
+
+func TestGetCriticalAlerts(t *testing.T) {
+	vs := VariableSet{}
+	vs.AddVariable(concat(PrinterAlertSeverityLevel, OID{1}), "4")
+	vs.AddVariable(concat(PrinterAlertSeverityLevel, OID{2}), "3")
+	vs.AddVariable(concat(PrinterAlertSeverityLevel, OID{3}), "3")
+	vs.AddVariable(concat(PrinterAlertCode, OID{1}), "807")
+	vs.AddVariable(concat(PrinterAlertCode, OID{2}), "501")
+	vs.AddVariable(concat(PrinterAlertCode, OID{3}), "8")
+	vs.AddVariable(concat(PrinterAlertDescription, OID{1}), `"Tray 1 low"`)
+	vs.AddVariable(concat(PrinterAlertDescription, OID{3}), `"Paper jam in tray 2"`)
+
+	alerts, ok := vs.GetCriticalAlerts()
+	if !ok {
+		t.Fatal("alert table not found")
+	}
+	expected := []string{"door open", "Paper jam in tray 2"}
+	if !reflect.DeepEqual(alerts, expected) {
+		t.Errorf("expected %v, got %v", expected, alerts)
+	}
+
+	if _, ok = (&VariableSet{}).GetCriticalAlerts(); ok {
+		t.Error("alert table found in empty variable set")
+	}
+}
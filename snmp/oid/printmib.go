@@ -19,32 +19,44 @@ import (
 // Some MIB definitions from Printer-MIB (RFC 3805).
 var (
 	PrinterMIB                       OID = OID{1, 3, 6, 1, 2, 1, 43}
-	PrinterMIBGeneral                    = append(PrinterMIB, OID{5}...)
-	PrinterGeneralSerialNumber           = append(PrinterMIBGeneral, OID{1, 1, 17, 1}...)
-	PrinterMIBCover                      = append(PrinterMIB, OID{6}...)
-	PrinterCoverDescription              = append(PrinterMIBCover, OID{1, 1, 2, 1}...)
-	PrinterCoverStatus                   = append(PrinterMIBCover, OID{1, 1, 3, 1}...)
-	PrinterMIBInput                      = append(PrinterMIB, OID{8}...)
-	PrinterInputMaxCapacity              = append(PrinterMIBInput, OID{2, 1, 9, 1}...)
-	PrinterInputCurrentLevel             = append(PrinterMIBInput, OID{2, 1, 10, 1}...)
-	PrinterInputStatus                   = append(PrinterMIBInput, OID{2, 1, 11, 1}...)
-	PrinterInputName                     = append(PrinterMIBInput, OID{2, 1, 13, 1}...)
-	PrinterMIBOutput                     = append(PrinterMIB, OID{9}...)
-	PrinterOutputMaxCapacity             = append(PrinterMIBOutput, OID{2, 1, 4, 1}...)
-	PrinterOutputRemainingCapacity       = append(PrinterMIBOutput, OID{2, 1, 5, 1}...)
-	PrinterOutputStatus                  = append(PrinterMIBOutput, OID{2, 1, 6, 1}...)
-	PrinterOutputName                    = append(PrinterMIBOutput, OID{2, 1, 7, 1}...)
-	PrinterMIBMarker                     = append(PrinterMIB, OID{11}...)
-	PrinterMarkerSuppliesClass           = append(PrinterMIBMarker, OID{1, 1, 4, 1}...)
-	PrinterMarkerSuppliesType            = append(PrinterMIBMarker, OID{1, 1, 5, 1}...)
-	PrinterMarkerSuppliesDescription     = append(PrinterMIBMarker, OID{1, 1, 6, 1}...)
-	PrinterMarkerSuppliesSupplyUnit      = append(PrinterMIBMarker, OID{1, 1, 7, 1}...)
-	PrinterMarkerSuppliesMaxCapacity     = append(PrinterMIBMarker, OID{1, 1, 8, 1}...)
-	PrinterMarkerSuppliesLevel           = append(PrinterMIBMarker, OID{1, 1, 9, 1}...)
-	PrinterMIBMarkerColorant             = append(PrinterMIB, OID{12}...)
-	PrinterMarkerColorantValue           = append(PrinterMIBMarkerColorant, OID{1, 1, 4, 1}...)
+	PrinterMIBGeneral                    = concat(PrinterMIB, OID{5})
+	PrinterGeneralSerialNumber           = concat(PrinterMIBGeneral, OID{1, 1, 17, 1})
+	PrinterMIBCover                      = concat(PrinterMIB, OID{6})
+	PrinterCoverDescription              = concat(PrinterMIBCover, OID{1, 1, 2, 1})
+	PrinterCoverStatus                   = concat(PrinterMIBCover, OID{1, 1, 3, 1})
+	PrinterMIBInput                      = concat(PrinterMIB, OID{8})
+	PrinterInputMaxCapacity              = concat(PrinterMIBInput, OID{2, 1, 9, 1})
+	PrinterInputCurrentLevel             = concat(PrinterMIBInput, OID{2, 1, 10, 1})
+	PrinterInputStatus                   = concat(PrinterMIBInput, OID{2, 1, 11, 1})
+	PrinterInputName                     = concat(PrinterMIBInput, OID{2, 1, 13, 1})
+	PrinterMIBOutput                     = concat(PrinterMIB, OID{9})
+	PrinterOutputMaxCapacity             = concat(PrinterMIBOutput, OID{2, 1, 4, 1})
+	PrinterOutputRemainingCapacity       = concat(PrinterMIBOutput, OID{2, 1, 5, 1})
+	PrinterOutputStatus                  = concat(PrinterMIBOutput, OID{2, 1, 6, 1})
+	PrinterOutputName                    = concat(PrinterMIBOutput, OID{2, 1, 7, 1})
+	PrinterMIBMarker                     = concat(PrinterMIB, OID{11})
+	PrinterMarkerSuppliesClass           = concat(PrinterMIBMarker, OID{1, 1, 4, 1})
+	PrinterMarkerSuppliesType            = concat(PrinterMIBMarker, OID{1, 1, 5, 1})
+	PrinterMarkerSuppliesDescription     = concat(PrinterMIBMarker, OID{1, 1, 6, 1})
+	PrinterMarkerSuppliesSupplyUnit      = concat(PrinterMIBMarker, OID{1, 1, 7, 1})
+	PrinterMarkerSuppliesMaxCapacity     = concat(PrinterMIBMarker, OID{1, 1, 8, 1})
+	PrinterMarkerSuppliesLevel           = concat(PrinterMIBMarker, OID{1, 1, 9, 1})
+	PrinterMIBMarkerColorant             = concat(PrinterMIB, OID{12})
+	PrinterMarkerColorantValue           = concat(PrinterMIBMarkerColorant, OID{1, 1, 4, 1})
+	PrinterMIBAlert                      = concat(PrinterMIB, OID{18})
+	PrinterAlertSeverityLevel            = concat(PrinterMIBAlert, OID{1, 1, 2, 1})
+	PrinterAlertCode                     = concat(PrinterMIBAlert, OID{1, 1, 7, 1})
+	PrinterAlertDescription              = concat(PrinterMIBAlert, OID{1, 1, 8, 1})
 )
 
+// concat returns a new OID of a followed by b. Unlike append, it never
+// shares the array behind a, so OIDs with a common prefix don't overwrite
+// each other.
+func concat(a, b OID) OID {
+	o := make(OID, 0, len(a)+len(b))
+	return append(append(o, a...), b...)
+}
+
 // GetSerialNumber gets the printer serial number, if available.
 func (vs *VariableSet) GetSerialNumber() (string, bool) {
 	return vs.GetValue(PrinterGeneralSerialNumber)
@@ -555,3 +567,66 @@ func (vs *VariableSet) GetMarkers() (*[]cdd.Marker, *cdd.MarkerState, *cdd.Vendo
 
 	return &markers, &markerState, &vendorState, true
 }
+
+// Printer alert severity level TC value of alerts that stop the printer.
+const PrinterAlertSeverityCritical = "3"
+
+// Printer alert code TC, of the codes that critical alerts commonly have.
+var PrinterAlertCodeTC map[string]string = map[string]string{
+	"3":    "cover open",
+	"5":    "interlock open",
+	"8":    "jam",
+	"9":    "subunit missing",
+	"11":   "subunit life over",
+	"13":   "subunit empty",
+	"15":   "subunit full",
+	"22":   "subunit offline",
+	"30":   "subunit unrecoverable failure",
+	"501":  "door open",
+	"801":  "input tray missing",
+	"808":  "input media empty",
+	"813":  "cannot feed size selected",
+	"901":  "output tray missing",
+	"903":  "output tray full",
+	"1101": "toner empty",
+	"1102": "ink empty",
+	"1301": "media path tray missing",
+	"1303": "media path tray full",
+}
+
+// GetCriticalAlerts gets descriptions of the alerts that stop the printer,
+// like "door open" or "jam", from the Printer MIB alert table.
+func (vs *VariableSet) GetCriticalAlerts() ([]string, bool) {
+	severities := vs.GetSubtree(PrinterAlertSeverityLevel).Variables()
+	if len(severities) < 1 {
+		return nil, false
+	}
+
+	// Rows are indexed by prtAlertIndex, the last OID digit.
+	codes := make(map[uint]string)
+	for _, v := range vs.GetSubtree(PrinterAlertCode).Variables() {
+		codes[v.Name[len(v.Name)-1]] = v.Value
+	}
+	descriptions := make(map[uint]string)
+	for _, v := range vs.GetSubtree(PrinterAlertDescription).Variables() {
+		descriptions[v.Name[len(v.Name)-1]] = v.Value
+	}
+
+	alerts := make([]string, 0)
+	for _, severity := range severities {
+		if severity.Value != PrinterAlertSeverityCritical {
+			continue
+		}
+		index := severity.Name[len(severity.Name)-1]
+		description := descriptions[index]
+		if description == "" {
+			description = PrinterAlertCodeTC[codes[index]]
+		}
+		if description == "" {
+			description = fmt.Sprintf("alert code %s", codes[index])
+		}
+		alerts = append(alerts, description)
+	}
+
+	return alerts, true
+}
@@ -10,6 +10,8 @@ package snmp
 /*
 #cgo CFLAGS: -std=gnu99
 #cgo LDFLAGS: -lnetsnmp
+#cgo freebsd openbsd CFLAGS: -I/usr/local/include
+#cgo freebsd openbsd LDFLAGS: -L/usr/local/lib
 #include <net-snmp/net-snmp-config.h>
 #include <net-snmp/net-snmp-includes.h>
 #include "snmp.h"
@@ -21,6 +23,7 @@ import (
 	"sync"
 	"unsafe"
 
+	"github.com/google/cups-connector/cdd"
 	"github.com/google/cups-connector/lib"
 	"github.com/google/cups-connector/snmp/oid"
 )
@@ -122,9 +125,37 @@ func (s *SNMPManager) getPrinters(hostnames []string) (map[string]*oid.VariableS
 	return results, nil
 }
 
+// FindPrinters queries the SNMP agent of every host, and returns the hosts
+// whose agent reports Printer MIB variables.
+func (s *SNMPManager) FindPrinters(hostnames []string) ([]string, error) {
+	varsByHostname, err := s.getPrinters(hostnames)
+	if err != nil {
+		return nil, err
+	}
+
+	printers := make([]string, 0)
+	for _, hostname := range hostnames {
+		if varsByHostname[hostname].Size() > 0 {
+			printers = append(printers, hostname)
+		}
+	}
+	return printers, nil
+}
+
 // AugmentPrinters queries every printer's SNMP agent, adds anything it
 // finds back to the printer object.
 func (s *SNMPManager) AugmentPrinters(printers []lib.Printer) error {
+	return s.augmentPrinters(printers, true)
+}
+
+// AugmentPrinterStates is like AugmentPrinters, but changes only the
+// printers' State and SNMPFaults, so that descriptions, which may be
+// shared, are left alone.
+func (s *SNMPManager) AugmentPrinterStates(printers []lib.Printer) error {
+	return s.augmentPrinters(printers, false)
+}
+
+func (s *SNMPManager) augmentPrinters(printers []lib.Printer, description bool) error {
 	hostnames := make([]string, 0, len(printers))
 	for _, printer := range printers {
 		if hostname, exists := printer.GetHostname(); exists {
@@ -146,30 +177,54 @@ func (s *SNMPManager) AugmentPrinters(printers []lib.Printer) error {
 		if !ok {
 			continue
 		}
-		if serialNumber, ok := vars.GetSerialNumber(); ok {
+		if serialNumber, ok := vars.GetSerialNumber(); ok && description {
 			printers[i].UUID = serialNumber
 		}
 		if covers, coverState, exists := vars.GetCovers(); exists {
 			printers[i].State.CoverState = coverState
-			printers[i].Description.Cover = covers
+			if description {
+				printers[i].Description.Cover = covers
+			}
 		}
 		if inputTrayUnits, inputTrayState, exists := vars.GetInputTrays(); exists {
 			printers[i].State.InputTrayState = inputTrayState
-			printers[i].Description.InputTrayUnit = inputTrayUnits
+			if description {
+				printers[i].Description.InputTrayUnit = inputTrayUnits
+			}
 		}
 		if outputBinUnits, outputBinState, exists := vars.GetOutputBins(); exists {
 			printers[i].State.OutputBinState = outputBinState
-			printers[i].Description.OutputBinUnit = outputBinUnits
+			if description {
+				printers[i].Description.OutputBinUnit = outputBinUnits
+			}
 		}
 		if markers, markerState, vendorState, exists := vars.GetMarkers(); exists {
 			if len(*markers) > 0 && len(markerState.Item) > 0 {
 				printers[i].State.MarkerState = markerState
-				printers[i].Description.Marker = markers
+				if description {
+					printers[i].Description.Marker = markers
+				}
 			}
 			if len(vendorState.Item) > 0 {
 				printers[i].State.VendorState = vendorState
 			}
 		}
+		if alerts, exists := vars.GetCriticalAlerts(); exists {
+			printers[i].SNMPFaults = alerts
+			if len(alerts) > 0 {
+				// The printer can't print, whatever CUPS thinks.
+				printers[i].State.State = cdd.CloudDeviceStateStopped
+				if printers[i].State.VendorState == nil {
+					printers[i].State.VendorState = &cdd.VendorState{}
+				}
+				for _, alert := range alerts {
+					printers[i].State.VendorState.Item = append(printers[i].State.VendorState.Item, cdd.VendorStateItem{
+						State:                cdd.VendorStateError,
+						DescriptionLocalized: cdd.NewLocalizedString(alert),
+					})
+				}
+			}
+		}
 	}
 
 	return nil
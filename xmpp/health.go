@@ -0,0 +1,113 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package xmpp
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Health describes the state of an XMPP conversation, for monitoring.
+type Health struct {
+	// Connected is true when notifications can arrive.
+	Connected bool
+	// When the conversation last connected or disconnected.
+	StateChanged time.Time
+	// When GCP last answered a ping; zero if never.
+	LastPing time.Time
+	// When a notification last arrived; zero if never.
+	LastNotification time.Time
+	// How many times the conversation has been restarted after dying.
+	Reconnects uint
+	// How many reads from the conversation failed in a row; while nonzero,
+	// reads back off.
+	ReadErrors uint
+	// How many times the conversation was dropped, and restarted, because
+	// too many reads failed in a row.
+	ReadCircuitTrips uint
+}
+
+// healthTracker is a Health shared by XMPP and its internalXMPP.
+type healthTracker struct {
+	mutex  sync.RWMutex
+	health Health
+}
+
+func (h *healthTracker) get() Health {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.health
+}
+
+func (h *healthTracker) setConnected(connected bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.health.Connected != connected || h.health.StateChanged.IsZero() {
+		h.health.Connected = connected
+		h.health.StateChanged = time.Now()
+	}
+}
+
+func (h *healthTracker) reconnected() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.Reconnects++
+}
+
+// readFailed counts a failed read, and returns the count of failed reads in
+// a row.
+func (h *healthTracker) readFailed() uint {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.ReadErrors++
+	return h.health.ReadErrors
+}
+
+func (h *healthTracker) readSucceeded() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.ReadErrors = 0
+}
+
+func (h *healthTracker) circuitTripped() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.ReadErrors = 0
+	h.health.ReadCircuitTrips++
+}
+
+func (h *healthTracker) pinged() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.LastPing = time.Now()
+}
+
+func (h *healthTracker) notified() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.health.LastNotification = time.Now()
+}
+
+// jitter returns a random duration between 0.75 and 1.25 times d, so that
+// many connectors that lose connectivity together don't reconnect together.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d*3/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -21,6 +21,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/cups-connector/lib"
+
 	"github.com/golang/glog"
 )
 
@@ -33,6 +35,13 @@ const (
 
 	// Set our own timeout, rather than have the OS or server timeout for us.
 	netTimeout = time.Second * 60
+
+	// After a failed read, wait this long before reading again, doubling the
+	// wait after each failure in a row, up to the maximum. After too many
+	// failures in a row, the conversation is dropped, and restarted.
+	readErrorBackoffMin = 100 * time.Millisecond
+	readErrorBackoffMax = 4 * time.Second
+	readErrorsMax       = 10
 )
 
 // Interface with XMPP server.
@@ -42,11 +51,20 @@ type internalXMPP struct {
 	xmlDecoder *xml.Decoder
 	fullJID    string
 
+	// JID of the GCP service.
+	cloudPrintJID string
+
 	notifications       chan<- PrinterNotification
 	pingIntervalUpdates <-chan time.Duration
 	pongs               chan uint8
 	nextPingID          uint8
 	dead                chan<- struct{}
+
+	// Records pings and notifications.
+	health *healthTracker
+
+	// Tunes the ping interval; nil when it isn't tuned.
+	tuner *pingTuner
 }
 
 // newInternalXMPP creates a new XMPP connection.
@@ -56,7 +74,11 @@ type internalXMPP struct {
 // Updates to the ping interval are received on pingIntervalUpdates.
 //
 // If the connection dies unexpectedly, a message is sent on dead.
-func newInternalXMPP(jid, accessToken, proxyName, server string, port uint16, pingTimeout, pingInterval time.Duration, notifications chan<- PrinterNotification, pingIntervalUpdates <-chan time.Duration, dead chan<- struct{}) (*internalXMPP, error) {
+//
+// Answered pings and received notifications are recorded in health.
+//
+// When tuner isn't nil, it shortens the ping interval.
+func newInternalXMPP(jid, accessToken, proxyName, server string, port, fallbackPort uint16, serverHostname, cloudPrintJID, proxyURL string, tlsConfig *tls.Config, pingTimeout, pingInterval time.Duration, notifications chan<- PrinterNotification, pingIntervalUpdates <-chan time.Duration, dead chan<- struct{}, health *healthTracker, tuner *pingTuner) (*internalXMPP, error) {
 	var user, domain string
 	if parts := strings.SplitN(jid, "@", 2); len(parts) != 2 {
 		return nil, fmt.Errorf("Tried to use invalid XMPP JID: %s", jid)
@@ -66,7 +88,7 @@ func newInternalXMPP(jid, accessToken, proxyName, server string, port uint16, pi
 	}
 
 	// Anyone home?
-	conn, err := dial(server, port)
+	conn, err := dialWithFallback(server, port, fallbackPort, serverHostname, proxyURL, tlsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to dial XMPP service: %s", err)
 	}
@@ -94,7 +116,7 @@ func newInternalXMPP(jid, accessToken, proxyName, server string, port uint16, pi
 	}
 
 	// Subscribe
-	if err = subscribe(xmlEncoder, xmlDecoder, fullJID); err != nil {
+	if err = subscribe(xmlEncoder, xmlDecoder, fullJID, cloudPrintJID); err != nil {
 		return nil, fmt.Errorf("Failed to subscribe: %s", err)
 	}
 
@@ -103,11 +125,14 @@ func newInternalXMPP(jid, accessToken, proxyName, server string, port uint16, pi
 		xmlEncoder:          xmlEncoder,
 		xmlDecoder:          xmlDecoder,
 		fullJID:             fullJID,
+		cloudPrintJID:       cloudPrintJID,
 		notifications:       notifications,
 		pingIntervalUpdates: pingIntervalUpdates,
 		pongs:               make(chan uint8, 10),
 		nextPingID:          0,
 		dead:                dead,
+		health:              health,
+		tuner:               tuner,
 	}
 
 	// dispatchIncoming signals pingPeriodically to return via dying.
@@ -132,21 +157,36 @@ func (x *internalXMPP) Quit() {
 }
 
 func (x *internalXMPP) pingPeriodically(timeout, interval time.Duration, dying <-chan struct{}) {
-	t := time.NewTimer(interval)
+	lastPing := time.Now()
+	t := time.NewTimer(x.pingInterval(interval))
 	defer t.Stop()
 
 	for {
 		select {
 		case <-t.C:
+			// Notifications keep the connection busy, like pings.
+			lastActive := lastPing
+			if n := x.health.get().LastNotification; n.After(lastActive) {
+				lastActive = n
+			}
+			idle := time.Since(lastActive)
 			if success, err := x.ping(timeout); success {
-				t.Reset(interval)
+				if x.tuner != nil {
+					x.tuner.pingSurvived(idle)
+				}
 			} else {
 				glog.Infof("XMPP ping failed; trying once more: %s", err)
 				// Ping failed; give it another try, then restart the XMPP conversation.
 				if success, _ := x.ping(timeout); !success {
+					if x.tuner != nil {
+						x.tuner.pingFailed(idle)
+					}
 					x.Quit()
+					continue
 				}
 			}
+			lastPing = time.Now()
+			t.Reset(x.pingInterval(interval))
 		case interval = <-x.pingIntervalUpdates:
 			t.Reset(time.Nanosecond) // Induce ping and interval reset now.
 		case <-dying:
@@ -168,6 +208,9 @@ func (x *internalXMPP) dispatchIncoming(dying chan<- struct{}) {
 				break
 			}
 			glog.Warningf("Failed to read the next start element: %s", err)
+			if x.backOffRead() {
+				break
+			}
 			continue
 		}
 
@@ -183,8 +226,12 @@ func (x *internalXMPP) dispatchIncoming(dying chan<- struct{}) {
 					break
 				}
 				glog.Warningf("Error while parsing print jobs notification via XMPP: %s", err)
+				if x.backOffRead() {
+					break
+				}
 				continue
 			}
+			x.health.readSucceeded()
 
 			messageData, err := base64.StdEncoding.DecodeString(message.Data)
 			if err != nil {
@@ -192,13 +239,18 @@ func (x *internalXMPP) dispatchIncoming(dying chan<- struct{}) {
 				continue
 			}
 
+			x.health.notified()
+
 			messageDataString := string(messageData)
 			if strings.ContainsRune(messageDataString, '/') {
 				if strings.HasSuffix(messageDataString, "/delete") {
 					gcpID := strings.TrimSuffix(messageDataString, "/delete")
 					x.notifications <- PrinterNotification{gcpID, PrinterDelete}
+				} else if strings.HasSuffix(messageDataString, "/update_settings") {
+					gcpID := strings.TrimSuffix(messageDataString, "/update_settings")
+					x.notifications <- PrinterNotification{gcpID, PrinterUpdateSettings}
 				}
-				// Ignore other suffixes, like /update_settings.
+				// Ignore other suffixes.
 			} else {
 				x.notifications <- PrinterNotification{messageDataString, PrinterNewJobs}
 			}
@@ -215,8 +267,12 @@ func (x *internalXMPP) dispatchIncoming(dying chan<- struct{}) {
 					break
 				}
 				glog.Warningf("Error while parsing XMPP pong: %s", err)
+				if x.backOffRead() {
+					break
+				}
 				continue
 			}
+			x.health.readSucceeded()
 
 			pingID, err := strconv.ParseUint(message.ID, 10, 8)
 			if err != nil {
@@ -233,6 +289,36 @@ func (x *internalXMPP) dispatchIncoming(dying chan<- struct{}) {
 	dying <- struct{}{}
 }
 
+// backOffRead waits before the next read, after a failed read, so that a
+// conversation that fails every read doesn't spin. Returns true when too
+// many reads failed in a row; the connection is then closed, so that the
+// conversation is restarted.
+func (x *internalXMPP) backOffRead() bool {
+	failures := x.health.readFailed()
+	if failures >= readErrorsMax {
+		glog.Errorf("%d reads from XMPP failed in a row; restarting the conversation", failures)
+		x.health.circuitTripped()
+		x.conn.Close()
+		return true
+	}
+
+	wait := readErrorBackoffMin << (failures - 1)
+	if wait > readErrorBackoffMax {
+		wait = readErrorBackoffMax
+	}
+	time.Sleep(jitter(wait))
+	return false
+}
+
+// pingInterval returns the ping interval to use, when the configured
+// interval is interval.
+func (x *internalXMPP) pingInterval(interval time.Duration) time.Duration {
+	if x.tuner == nil {
+		return interval
+	}
+	return x.tuner.interval(interval)
+}
+
 // ping sends a ping message and blocks until pong is received.
 //
 // Returns false if timeout time passes before pong, or on any
@@ -254,7 +340,7 @@ func (x *internalXMPP) ping(timeout time.Duration) (bool, error) {
 	x.nextPingID++
 
 	ping.From = x.fullJID
-	ping.To = "cloudprint.google.com"
+	ping.To = x.cloudPrintJID
 	ping.ID = fmt.Sprintf("%d", pingID)
 	ping.Type = "get"
 	ping.Ping.XMLNS = "urn:xmpp:ping"
@@ -267,6 +353,7 @@ func (x *internalXMPP) ping(timeout time.Duration) (bool, error) {
 		select {
 		case pongID := <-x.pongs:
 			if pongID == pingID {
+				x.health.pinged()
 				return true, nil
 			}
 		case <-time.After(timeout):
@@ -276,20 +363,65 @@ func (x *internalXMPP) ping(timeout time.Duration) (bool, error) {
 	panic("unreachable")
 }
 
-func dial(server string, port uint16) (*tls.Conn, error) {
-	tlsConfig := &tls.Config{
-		ServerName: server,
+// dialWithFallback dials the XMPP server on port, then on fallbackPort if
+// the server can't be reached on port. fallbackPort is not tried when the
+// server answers but the TLS session fails, because the fallback is meant
+// for networks that block the port, not for servers that misbehave.
+func dialWithFallback(server string, port, fallbackPort uint16, serverHostname, proxyURL string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	conn, err := dial(server, port, serverHostname, proxyURL, tlsConfig)
+	if err == nil || fallbackPort == 0 || fallbackPort == port {
+		return conn, err
+	}
+	if _, ok := err.(*unreachableError); !ok {
+		return nil, err
 	}
+
+	glog.Warningf("%s; trying port %d", err, fallbackPort)
+	return dial(server, fallbackPort, serverHostname, proxyURL, tlsConfig)
+}
+
+// unreachableError is returned by dial when the XMPP server can't be
+// reached at all.
+type unreachableError struct {
+	addr string
+	err  error
+}
+
+func (e *unreachableError) Error() string {
+	return fmt.Sprintf("Failed to connect to XMPP server at %s: %s", e.addr, e.err)
+}
+
+// dial connects to the XMPP server, through the proxy indicated by proxyURL
+// if not empty, and starts a TLS session, configured by tlsConfig if not nil.
+// The server's certificate must be valid for serverHostname.
+func dial(server string, port uint16, serverHostname, proxyURL string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.ServerName = server
 	netDialer := &net.Dialer{
 		KeepAlive: netKeepAlive,
 		Timeout:   netTimeout,
 	}
+	dial, err := lib.NewProxyDialFunc(proxyURL, netDialer)
+	if err != nil {
+		return nil, err
+	}
 	addr := fmt.Sprintf("%s:%d", server, port)
-	conn, err := tls.DialWithDialer(netDialer, "tcp", addr, tlsConfig)
+	netConn, err := dial("tcp", addr)
 	if err != nil {
+		return nil, &unreachableError{addr, err}
+	}
+	netConn.SetDeadline(time.Now().Add(netTimeout))
+	conn := tls.Client(netConn, tlsConfig)
+	if err = conn.Handshake(); err != nil {
+		netConn.Close()
 		return nil, fmt.Errorf("Failed to connect to XMPP server: %s", err)
 	}
-	if err = conn.VerifyHostname("talk.google.com"); err != nil {
+	netConn.SetDeadline(time.Time{})
+	if err = conn.VerifyHostname(serverHostname); err != nil {
 		return nil, fmt.Errorf("Failed to verify hostname of XMPP server: %s", err)
 	}
 
@@ -463,7 +595,7 @@ func xmppHandshake(xmlEncoder *xml.Encoder, xmlDecoder *xml.Decoder, domain, pro
 	return fullJID, nil
 }
 
-func subscribe(xmlEncoder *xml.Encoder, xmlDecoder *xml.Decoder, fullJID string) error {
+func subscribe(xmlEncoder *xml.Encoder, xmlDecoder *xml.Decoder, fullJID, cloudPrintJID string) error {
 	var bareJID string
 	if barePosition := strings.Index(fullJID, "/"); barePosition < 0 {
 		return fmt.Errorf("Can't split JID %s", fullJID)
@@ -488,8 +620,8 @@ func subscribe(xmlEncoder *xml.Encoder, xmlDecoder *xml.Decoder, fullJID string)
 	subscribe.Type = "set"
 	subscribe.To = bareJID
 	subscribe.ID = "3"
-	subscribe.Subscribe.Item.Channel = "cloudprint.google.com"
-	subscribe.Subscribe.Item.From = "cloudprint.google.com"
+	subscribe.Subscribe.Item.Channel = cloudPrintJID
+	subscribe.Subscribe.Item.From = cloudPrintJID
 	if err := xmlEncoder.Encode(&subscribe); err != nil {
 		return fmt.Errorf("XMPP subscription request failed: %s", err)
 	}
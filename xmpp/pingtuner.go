@@ -0,0 +1,167 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package xmpp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// The shortest ping interval that tuning chooses.
+	pingTuneMin = 30 * time.Second
+
+	// Tuning stops once the longest idle time that a ping survived, and the
+	// shortest that a ping failed after, are this close.
+	pingTuneResolution = 15 * time.Second
+
+	// Failures are forgotten after this long, so that a failure that wasn't
+	// caused by idleness, like an outage, doesn't shorten the interval for
+	// good, and so that the network is checked for changes.
+	pingTuneForget = 24 * time.Hour
+)
+
+// pingTuner learns how long an XMPP conversation may stay idle before
+// something on the way to GCP, like a NAT, forgets the connection, which
+// then dies without a word. It searches for the longest ping interval that
+// pings survive, up to the configured interval, between the idle times that
+// pings answered after, and that pings failed after.
+type pingTuner struct {
+	mutex sync.Mutex
+	// The longest idle time that a ping was answered after, and the shortest
+	// that a ping failed after, and when; zero when not known.
+	survived time.Duration
+	failed   time.Duration
+	failedAt time.Time
+
+	// Where survived and failed are saved; empty when they aren't.
+	filename string
+}
+
+// pingTuning is how a pingTuner is saved.
+type pingTuning struct {
+	Survived string    `json:"survived"`
+	Failed   string    `json:"failed"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// newPingTuner creates a pingTuner that starts from what was saved to
+// filename, if anything.
+func newPingTuner(filename string) *pingTuner {
+	t := pingTuner{filename: filename}
+	if filename == "" {
+		return &t
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Failed to read the XMPP ping tuning file %s; tuning from scratch: %s", filename, err)
+		}
+		return &t
+	}
+	var saved pingTuning
+	if err = json.Unmarshal(b, &saved); err != nil {
+		glog.Warningf("Failed to parse the XMPP ping tuning file %s; tuning from scratch: %s", filename, err)
+		return &t
+	}
+	t.survived, _ = time.ParseDuration(saved.Survived)
+	t.failed, _ = time.ParseDuration(saved.Failed)
+	t.failedAt = saved.FailedAt
+	glog.Infof("Resuming XMPP ping tuning: pings survived %s idle, and failed after %s", t.survived, t.failed)
+	return &t
+}
+
+// interval returns the ping interval to use, no longer than max: the
+// interval half way between what pings survived and failed after, or what
+// they survived once the two are close. Without recent failures, returns
+// max.
+func (t *pingTuner) interval(max time.Duration) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.failed != 0 && time.Since(t.failedAt) > pingTuneForget {
+		glog.Infof("Forgetting that an XMPP ping failed after %s idle, more than %s ago", t.failed, pingTuneForget)
+		t.failed = 0
+		t.save()
+	}
+	if t.failed == 0 || t.failed > max {
+		return max
+	}
+	low := t.survived
+	if low < pingTuneMin {
+		low = pingTuneMin
+	}
+	if t.failed-low <= pingTuneResolution {
+		return low
+	}
+	return low + (t.failed-low)/2
+}
+
+// pingSurvived records that a ping was answered after idle.
+func (t *pingTuner) pingSurvived(idle time.Duration) {
+	// Whole seconds, so that the file isn't saved for each jittery ping.
+	idle = idle / time.Second * time.Second
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if idle <= t.survived {
+		return
+	}
+	t.survived = idle
+	if t.failed != 0 && t.failed <= idle {
+		// The network changed; what failed before works now.
+		t.failed = 0
+	}
+	t.save()
+}
+
+// pingFailed records that a ping failed after idle.
+func (t *pingTuner) pingFailed(idle time.Duration) {
+	idle = idle / time.Second * time.Second
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.failed = idle
+	t.failedAt = time.Now()
+	if t.survived >= idle {
+		// The network changed; what worked before fails now.
+		t.survived = 0
+	}
+	glog.Warningf("XMPP ping failed after %s idle; shortening the ping interval", idle)
+	t.save()
+}
+
+// save writes survived and failed to the tuning file. Call with mutex held.
+func (t *pingTuner) save() {
+	if t.filename == "" {
+		return
+	}
+
+	b, err := json.Marshal(pingTuning{t.survived.String(), t.failed.String(), t.failedAt})
+	if err != nil {
+		glog.Errorf("Failed to save XMPP ping tuning: %s", err)
+		return
+	}
+	tempFilename := t.filename + ".tmp"
+	if err = ioutil.WriteFile(tempFilename, b, 0600); err != nil {
+		glog.Errorf("Failed to save XMPP ping tuning to %s: %s", t.filename, err)
+		return
+	}
+	if err = os.Rename(tempFilename, t.filename); err != nil {
+		glog.Errorf("Failed to save XMPP ping tuning to %s: %s", t.filename, err)
+	}
+}
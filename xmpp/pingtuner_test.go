@@ -0,0 +1,120 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Use of this source code is governed by a BSD-style
+license that can be found in the LICENSE file or at
+https://developers.google.com/open-source/licenses/bsd
+*/
+
+package xmpp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPingTunerWithoutFailures(t *testing.T) {
+	tuner := newPingTuner("")
+	if got := tuner.interval(10 * time.Minute); got != 10*time.Minute {
+		t.Errorf("interval = %s, want the configured 10m0s", got)
+	}
+	tuner.pingSurvived(10 * time.Minute)
+	if got := tuner.interval(10 * time.Minute); got != 10*time.Minute {
+		t.Errorf("interval = %s after pings survived, want the configured 10m0s", got)
+	}
+}
+
+func TestPingTunerSearch(t *testing.T) {
+	// Pings fail after the NAT forgets the connection, at 4 minutes.
+	const max, timeout = 30 * time.Minute, 4 * time.Minute
+	tuner := newPingTuner("")
+
+	interval := tuner.interval(max)
+	for i := 0; i < 20; i++ {
+		if interval < timeout {
+			tuner.pingSurvived(interval)
+		} else {
+			tuner.pingFailed(interval)
+		}
+		next := tuner.interval(max)
+		if next == interval {
+			break
+		}
+		interval = next
+	}
+
+	if interval >= timeout || interval < timeout-pingTuneResolution {
+		t.Errorf("Search settled on %s, want within %s below %s", interval, pingTuneResolution, timeout)
+	}
+	if tuner.interval(max) != interval {
+		t.Errorf("Search didn't settle on %s", interval)
+	}
+}
+
+func TestPingTunerInterval(t *testing.T) {
+	for _, test := range []struct {
+		survived, failed, max, want time.Duration
+	}{
+		// Half way between what survived and failed.
+		{2 * time.Minute, 6 * time.Minute, 10 * time.Minute, 4 * time.Minute},
+		// Never below the minimum.
+		{0, 90 * time.Second, 10 * time.Minute, time.Minute},
+		{0, 20 * time.Second, 10 * time.Minute, pingTuneMin},
+		// What survived, once the two are close.
+		{5 * time.Minute, 5*time.Minute + pingTuneResolution, 10 * time.Minute, 5 * time.Minute},
+		// Never above the configured interval.
+		{2 * time.Minute, 20 * time.Minute, 10 * time.Minute, 10 * time.Minute},
+	} {
+		tuner := pingTuner{survived: test.survived, failed: test.failed, failedAt: time.Now()}
+		if got := tuner.interval(test.max); got != test.want {
+			t.Errorf("interval(%s) with survived %s, failed %s = %s, want %s", test.max, test.survived, test.failed, got, test.want)
+		}
+	}
+}
+
+func TestPingTunerForgets(t *testing.T) {
+	tuner := pingTuner{survived: time.Minute, failed: 2 * time.Minute, failedAt: time.Now().Add(-pingTuneForget - time.Minute)}
+	if got := tuner.interval(10 * time.Minute); got != 10*time.Minute {
+		t.Errorf("interval = %s after an old failure, want the configured 10m0s", got)
+	}
+	if tuner.failed != 0 {
+		t.Errorf("An old failure after %s wasn't forgotten", tuner.failed)
+	}
+}
+
+func TestPingTunerNetworkChanges(t *testing.T) {
+	tuner := pingTuner{survived: time.Minute, failed: 4 * time.Minute, failedAt: time.Now()}
+	tuner.pingSurvived(5 * time.Minute)
+	if tuner.survived != 5*time.Minute || tuner.failed != 0 {
+		t.Errorf("After a ping survived longer than one failed, survived %s and failed %s; want 5m0s and 0", tuner.survived, tuner.failed)
+	}
+
+	tuner.pingFailed(3 * time.Minute)
+	if tuner.survived != 0 || tuner.failed != 3*time.Minute {
+		t.Errorf("After a ping failed sooner than one survived, survived %s and failed %s; want 0 and 3m0s", tuner.survived, tuner.failed)
+	}
+}
+
+func TestPingTunerSaves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingtuner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "xmpp-ping.json")
+
+	tuner := newPingTuner(filename)
+	tuner.pingSurvived(2*time.Minute + 500*time.Millisecond)
+	tuner.pingFailed(6 * time.Minute)
+
+	resumed := newPingTuner(filename)
+	if resumed.survived != 2*time.Minute || resumed.failed != 6*time.Minute {
+		t.Errorf("Resumed with survived %s and failed %s, want 2m0s and 6m0s", resumed.survived, resumed.failed)
+	}
+	if got := resumed.interval(10 * time.Minute); got != 4*time.Minute {
+		t.Errorf("Resumed interval = %s, want 4m0s", got)
+	}
+}
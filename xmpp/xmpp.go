@@ -9,7 +9,9 @@ https://developers.google.com/open-source/licenses/bsd
 package xmpp
 
 import (
+	"crypto/tls"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -20,6 +22,8 @@ type PrinterNotificationType uint8
 const (
 	PrinterNewJobs PrinterNotificationType = iota
 	PrinterDelete
+	// The printer's local settings changed in GCP.
+	PrinterUpdateSettings
 )
 
 type PrinterNotification struct {
@@ -30,6 +34,15 @@ type PrinterNotification struct {
 const (
 	// XMPP connections fail. Attempt to reconnect a few times before giving up.
 	restartXMPPMaxRetries = 4
+
+	// After giving up, try again after this long, doubling the wait after
+	// each failure until the maximum is reached.
+	restartXMPPIntervalMin = time.Minute
+	restartXMPPIntervalMax = 10 * time.Minute
+
+	// After the conversation dies, wait about this long before restarting it.
+	// All waits are jittered by up to 25%.
+	restartXMPPDelay = 5 * time.Second
 )
 
 type XMPP struct {
@@ -37,25 +50,55 @@ type XMPP struct {
 	proxyName      string
 	server         string
 	port           uint16
+	fallbackPort   uint16
+	serverHostname string
+	cloudPrintJID  string
+	proxyURL       string
+	tlsConfig      *tls.Config
 	pingTimeout    time.Duration
-	pingInterval   time.Duration
 	getAccessToken func() (string, error)
 
+	// The ping interval of new conversations; see SetPingInterval.
+	pingIntervalMutex sync.Mutex
+	pingInterval      time.Duration
+
+	// Tunes the ping interval; nil when it isn't tuned.
+	tuner *pingTuner
+
 	notifications       chan PrinterNotification
 	pingIntervalUpdates chan time.Duration
 	dead                chan struct{}
 
-	quit chan struct{}
+	health *healthTracker
+
+	quit     chan struct{}
+	quitDone chan struct{}
 
 	ix *internalXMPP
 }
 
-func NewXMPP(jid, proxyName, server string, port uint16, pingTimeout, pingInterval time.Duration, getAccessToken func() (string, error)) (*XMPP, error) {
+// NewXMPP starts an XMPP conversation with GCP.
+//
+// If the conversation can't be established, then an error is logged
+// and NewXMPP returns anyway; the conversation is retried in the
+// background. Use Connected to check whether notifications can arrive.
+//
+// When server is unreachable on port, fallbackPort is tried, unless it is 0.
+//
+// When pingIntervalAuto is true, the ping interval is shortened until pings
+// survive the network's idle timeout, and what is learned is saved to
+// pingIntervalFile, unless it is empty.
+func NewXMPP(jid, proxyName, server string, port, fallbackPort uint16, serverHostname, cloudPrintJID, proxyURL string, tlsConfig *tls.Config, pingTimeout, pingInterval time.Duration, pingIntervalAuto bool, pingIntervalFile string, getAccessToken func() (string, error)) (*XMPP, error) {
 	x := XMPP{
 		jid:                 jid,
 		proxyName:           proxyName,
 		server:              server,
 		port:                port,
+		fallbackPort:        fallbackPort,
+		serverHostname:      serverHostname,
+		cloudPrintJID:       cloudPrintJID,
+		proxyURL:            proxyURL,
+		tlsConfig:           tlsConfig,
 		pingTimeout:         pingTimeout,
 		pingInterval:        pingInterval,
 		getAccessToken:      getAccessToken,
@@ -63,77 +106,160 @@ func NewXMPP(jid, proxyName, server string, port uint16, pingTimeout, pingInterv
 		pingIntervalUpdates: make(chan time.Duration, 10),
 		dead:                make(chan struct{}),
 		quit:                make(chan struct{}),
+		quitDone:            make(chan struct{}),
+		health:              &healthTracker{},
+	}
+	x.health.setConnected(false)
+	if pingIntervalAuto {
+		x.tuner = newPingTuner(pingIntervalFile)
 	}
 
-	err := x.startXMPP()
-	if err != nil {
-		return nil, err
+	if err := x.startXMPP(); err != nil {
+		glog.Errorf("XMPP conversation failed to start, will retry in the background: %s", err)
 	}
+	go x.keepXMPPAlive()
 
 	return &x, nil
 }
 
+// NewXMPPFromChannel creates an XMPP that relays notifications from a
+// channel instead of from GCP, such as a fake service's, for tests.
+// It is always connected, and ping intervals are ignored.
+func NewXMPPFromChannel(notifications <-chan PrinterNotification) *XMPP {
+	x := XMPP{
+		notifications:       make(chan PrinterNotification, 10),
+		pingIntervalUpdates: make(chan time.Duration, 10),
+		quit:                make(chan struct{}),
+		quitDone:            make(chan struct{}),
+		health:              &healthTracker{},
+	}
+	x.health.setConnected(true)
+
+	go func() {
+		defer close(x.quitDone)
+		for {
+			select {
+			case n := <-notifications:
+				x.health.notified()
+				select {
+				case x.notifications <- n:
+				case <-x.quit:
+					x.health.setConnected(false)
+					return
+				}
+			case <-x.pingIntervalUpdates:
+			case <-x.quit:
+				x.health.setConnected(false)
+				return
+			}
+		}
+	}()
+
+	return &x
+}
+
 // Quit terminates the XMPP conversation so that new jobs stop arriving.
 func (x *XMPP) Quit() {
-	if x.ix != nil {
-		// Signal to KeepXMPPAlive.
-		x.quit <- struct{}{}
-		select {
-		case <-x.dead:
-			// Wait for XMPP to die.
-		case <-time.After(5 * time.Second):
-			// But not too long.
-			glog.Error("XMPP taking a while to close, so giving up")
-		}
+	// Signal to keepXMPPAlive.
+	close(x.quit)
+	select {
+	case <-x.quitDone:
+		// Wait for XMPP to die.
+	case <-time.After(5 * time.Second):
+		// But not too long.
+		glog.Error("XMPP taking a while to close, so giving up")
 	}
 }
 
+// Connected answers the question "is the XMPP conversation up?"
+// When it is not, print job notifications do not arrive.
+func (x *XMPP) Connected() bool {
+	return x.health.get().Connected
+}
+
+// Health reports the state of the XMPP conversation, including when GCP
+// last answered a ping and when a notification last arrived.
+func (x *XMPP) Health() Health {
+	return x.health.get()
+}
+
 // startXMPP tries to start an XMPP conversation.
 // Tries multiple times before returning an error.
 func (x *XMPP) startXMPP() error {
 	if x.ix != nil {
 		go x.ix.Quit()
+		x.ix = nil
 	}
+	x.health.setConnected(false)
 
 	password, err := x.getAccessToken()
 	if err != nil {
 		return fmt.Errorf("While starting XMPP, failed to get access token (password): %s", err)
 	}
 
+	x.pingIntervalMutex.Lock()
+	pingInterval := x.pingInterval
+	x.pingIntervalMutex.Unlock()
+
 	for i := 0; i < restartXMPPMaxRetries; i++ {
 		// The current access token is the XMPP password.
+		var ix *internalXMPP
+		ix, err = newInternalXMPP(x.jid, password, x.proxyName, x.server, x.port, x.fallbackPort, x.serverHostname, x.cloudPrintJID, x.proxyURL, x.tlsConfig, x.pingTimeout, pingInterval, x.notifications, x.pingIntervalUpdates, x.dead, x.health, x.tuner)
+
 		if err == nil {
-			var ix *internalXMPP
-			ix, err := newInternalXMPP(x.jid, password, x.proxyName, x.server, x.port, x.pingTimeout, x.pingInterval, x.notifications, x.pingIntervalUpdates, x.dead)
-
-			if err == nil {
-				// Success!
-				x.ix = ix
-				// Don't give up.
-				go x.keepXMPPAlive()
-				return nil
-			}
+			// Success!
+			x.ix = ix
+			x.health.setConnected(true)
+			return nil
 		}
 
-		// Sleep for 1, 2, 4, 8 seconds.
-		time.Sleep(time.Duration((i+1)*2) * time.Second)
+		// Sleep for about 2, 4, 6, 8 seconds.
+		time.Sleep(jitter(time.Duration((i+1)*2) * time.Second))
 	}
 
 	return fmt.Errorf("Failed to start XMPP conversation: %s", err)
 }
 
-// keepXMPPAlive restarts XMPP when it fails.
+// keepXMPPAlive restarts XMPP when it fails. When XMPP can't be restarted,
+// tries again later, waiting longer after each failure.
 func (x *XMPP) keepXMPPAlive() {
+	retryInterval := restartXMPPIntervalMin
+	retry := time.NewTimer(retryInterval)
+	if x.ix != nil {
+		retry.Stop()
+	}
+	defer retry.Stop()
+
 	for {
 		select {
 		case <-x.dead:
 			glog.Error("XMPP conversation died; restarting")
+			x.ix = nil
+			x.health.setConnected(false)
+			x.health.reconnected()
+			retryInterval = restartXMPPIntervalMin
+			retry.Reset(jitter(restartXMPPDelay))
+
+		case <-retry.C:
 			if err := x.startXMPP(); err != nil {
-				glog.Fatalf("Failed to keep XMPP conversation alive: %s", err)
+				glog.Errorf("Failed to restart XMPP conversation, will retry in %s: %s", retryInterval.String(), err)
+				retry.Reset(jitter(retryInterval))
+				retryInterval *= 2
+				if retryInterval > restartXMPPIntervalMax {
+					retryInterval = restartXMPPIntervalMax
+				}
+			} else {
+				glog.Info("XMPP conversation started")
 			}
+
 		case <-x.quit:
 			// Close XMPP.
-			x.ix.Quit()
+			if x.ix != nil {
+				x.ix.Quit()
+				<-x.dead
+			}
+			x.health.setConnected(false)
+			close(x.quitDone)
 			return
 		}
 	}
@@ -144,9 +270,14 @@ func (x *XMPP) Notifications() <-chan PrinterNotification {
 	return x.notifications
 }
 
-// SetPingInterval sets the XMPP ping interval. Should be the min of all
-// printers' ping intervals.
+// SetPingInterval sets the XMPP ping interval, of this conversation and
+// of the conversations that replace it. Should be the min of all printers'
+// ping intervals.
 func (x *XMPP) SetPingInterval(interval time.Duration) {
+	x.pingIntervalMutex.Lock()
+	x.pingInterval = interval
+	x.pingIntervalMutex.Unlock()
+
 	x.pingIntervalUpdates <- interval
 	glog.Infof("Connector XMPP ping interval changed to %s", interval.String())
 }